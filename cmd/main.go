@@ -2,18 +2,39 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"ssh-tunnel/internal/app"
 	"ssh-tunnel/internal/autodiscovery"
 	"ssh-tunnel/internal/cli"
 	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/diagnostics"
+	"ssh-tunnel/internal/election"
+	"ssh-tunnel/internal/icmptunnel"
 	"ssh-tunnel/internal/mesh"
+	"ssh-tunnel/internal/mitm"
+	"ssh-tunnel/internal/platform"
+	"ssh-tunnel/internal/protocols"
+	"ssh-tunnel/internal/recorder"
+	"ssh-tunnel/internal/udprelay"
+
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
 )
 
 func main() {
@@ -41,12 +62,69 @@ func main() {
 		case "server", "s":
 			handleServerCommand()
 			return
+		case "iperf":
+			handleIperfCommand()
+			return
+		case "bench":
+			handleBenchCommand()
+			return
+		case "bench-server":
+			handleBenchServerCommand()
+			return
+		case "ready":
+			handleReadyCommand()
+			return
+		case "keys":
+			handleKeysCommand()
+			return
+		case "trace":
+			handleTraceCommand()
+			return
+		case "verify":
+			handleVerifyCommand()
+			return
+		case "icmp-server":
+			handleICMPServerCommand()
+			return
+		case "obfs-server":
+			handleObfsServerCommand()
+			return
+		case "ssh3-server":
+			handleSSH3ServerCommand()
+			return
+		case "simulate":
+			handleSimulateCommand()
+			return
+		case "replay":
+			handleReplayCommand()
+			return
+		case "mitm-ca":
+			handleMITMCACommand()
+			return
+		case "udp-relay":
+			handleUDPRelayCommand()
+			return
+		case "tcp-relay":
+			handleTCPRelayCommand()
+			return
+		case "shell", "sh":
+			handleShellCommand()
+			return
+		case "legacy":
+			handleLegacyCommand()
+			return
+		case "import":
+			handleImportCommand()
+			return
 		case "help", "h", "--help", "-h":
 			showHelp()
 			return
 		case "version", "v", "--version", "-v":
 			showVersion()
 			return
+		case "platform":
+			handlePlatformCommand()
+			return
 		}
 	}
 
@@ -74,6 +152,11 @@ func handleQuickCommand() {
 		fmt.Println("  tunnel quick 1.2.3.4 root mypassword")
 		fmt.Println("  tunnel quick 1.2.3.4 ubuntu ~/.ssh/id_rsa")
 		fmt.Println("  tunnel quick 1.2.3.4 root mypass --setup")
+		fmt.Println("  tunnel quick 1.2.3.4 root mypass --setup --dns-domain t.example.com")
+		fmt.Println("  tunnel quick 1.2.3.4 root mypass --setup --cdn-domain cdn.example.com")
+		fmt.Println("  tunnel quick 1.2.3.4 root mypass --setup --port-hopping 20000-40000")
+		fmt.Println("  tunnel quick 1.2.3.4 root mypass --fix-sshd")
+		fmt.Println("  tunnel quick 1.2.3.4 root mypass --host-key SHA256:...")
 		return
 	}
 
@@ -83,18 +166,49 @@ func handleQuickCommand() {
 
 	// Determine if it's password or key
 	var password, keyPath string
-	if len(authMethod) > 0 && authMethod[0] == '~' || authMethod[0] == '/' {
+	if strings.HasPrefix(authMethod, "~") || strings.HasPrefix(authMethod, "/") {
 		keyPath = authMethod
 	} else {
 		password = authMethod
 	}
 
-	// Check for --setup flag
+	// Check for --setup, --dns-domain, --cdn-domain, --port-hopping,
+	// --fix-sshd, --host-key and --insecure-skip-verify flags
 	setup := false
-	for _, arg := range os.Args[5:] {
-		if arg == "--setup" || arg == "-s" {
+	fixSSHD := false
+	dnsDomain := ""
+	cdnDomain := ""
+	portHopping := ""
+	hostKey := ""
+	insecure := false
+	for i := 5; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--setup", "-s":
 			setup = true
-			break
+		case "--fix-sshd":
+			fixSSHD = true
+		case "--insecure-skip-verify":
+			insecure = true
+		case "--host-key":
+			if i+1 < len(os.Args) {
+				hostKey = os.Args[i+1]
+				i++
+			}
+		case "--dns-domain":
+			if i+1 < len(os.Args) {
+				dnsDomain = os.Args[i+1]
+				i++
+			}
+		case "--cdn-domain":
+			if i+1 < len(os.Args) {
+				cdnDomain = os.Args[i+1]
+				i++
+			}
+		case "--port-hopping":
+			if i+1 < len(os.Args) {
+				portHopping = os.Args[i+1]
+				i++
+			}
 		}
 	}
 
@@ -103,6 +217,15 @@ func handleQuickCommand() {
 
 	// Execute auto-discovery
 	discovery := autodiscovery.NewServerDiscovery()
+	discovery.SetDNSTunnelDomain(dnsDomain)
+	discovery.SetCDNDomain(cdnDomain)
+	discovery.SetPortHopping(portHopping)
+	discovery.SetFixSSHD(fixSSHD)
+	discovery.SetHostKey(hostKey)
+	if insecure {
+		fmt.Println("🚨 --insecure-skip-verify: the server's host key is not checked, the connection can be intercepted")
+		discovery.SetInsecureSkipVerify(true)
+	}
 	serverInfo, err := discovery.DiscoverServer(host, "22", user, password, keyPath)
 	if err != nil {
 		log.Fatalf("❌ Discovery failed: %v", err)
@@ -113,6 +236,7 @@ func handleQuickCommand() {
 	fmt.Printf("   💻 OS: %s\n", serverInfo.OS)
 	fmt.Printf("   🔄 Protocols: %v\n", serverInfo.SupportedProtocols)
 	fmt.Println()
+	printSSHDAudit(serverInfo.SSHDAudit, !fixSSHD)
 
 	if setup {
 		fmt.Println("⚙️ Setting up protocols...")
@@ -135,18 +259,70 @@ func handleQuickCommand() {
 	fmt.Printf("🚀 Start: tunnel config %s/ssh-tunnel-manager-config.yaml\n", outputDir)
 }
 
+// printSSHDAudit shows the sshd settings that get in the way of tunnels
+func printSSHDAudit(audit *autodiscovery.SSHDAudit, suggestFix bool) {
+	if audit == nil || len(audit.Findings) == 0 {
+		return
+	}
+
+	fmt.Printf("🔒 sshd configuration (%s):\n", audit.Source)
+	for _, f := range audit.Findings {
+		icon := "⚠️ "
+		switch f.Severity {
+		case autodiscovery.SeverityBreaking:
+			icon = "❌"
+		case autodiscovery.SeverityInfo:
+			icon = "ℹ️ "
+		}
+		fmt.Printf("   %s %s %s: %s\n", icon, f.Setting, f.Value, f.Problem)
+		fmt.Printf("      affects %s; recommended: %s %s\n", f.Feature, f.Setting, f.Recommended)
+	}
+	if audit.Backup != "" {
+		fmt.Printf("   🔧 Fixed; the original is at %s\n", audit.Backup)
+	} else if suggestFix && audit.NeedsFix() {
+		fmt.Println("   💡 Run again with --fix-sshd to apply the recommended settings (sshd_config is backed up first)")
+	}
+	fmt.Println()
+}
+
 // handleMeshCommand handles mesh network commands
 func handleMeshCommand() {
 	if len(os.Args) < 3 {
 		fmt.Println("Mesh Network Commands:")
 		fmt.Println("  tunnel mesh init [network-cidr]    # Initialize mesh network")
-		fmt.Println("  tunnel mesh add <host> <user>      # Add server to mesh")
-		fmt.Println("  tunnel mesh status                 # Show mesh status")
-		fmt.Println("  tunnel mesh connect [node-id]      # Connect to mesh")
+		fmt.Println("  tunnel mesh add <host> [user]      # Install the mesh agent on a server over SSH")
+		fmt.Println("  tunnel mesh status [--json]        # Show mesh status from the coordinator")
+		fmt.Println("  tunnel mesh connect [node]         # Tunnel through the best (or named) mesh node")
+		fmt.Println("  tunnel mesh coordinator            # Run the mesh coordinator")
+		fmt.Println("  tunnel mesh join <coordinator-url> # Join a mesh through its coordinator")
+		fmt.Println("  tunnel mesh agent --coordinator URL # Run a node as a service, reporting its health")
+		fmt.Println("  tunnel mesh relay                  # Run a relay node for peers without a direct path")
+		fmt.Println("  tunnel mesh token create|list|revoke # Manage join tokens")
+		fmt.Println("  tunnel mesh nodes                  # List registered nodes")
+		fmt.Println("  tunnel mesh latency                # Round trips between every pair of nodes")
+		fmt.Println("  tunnel mesh events [--types node,failover] # Follow node, route and path changes")
+		fmt.Println("  tunnel mesh approve|rm <node>      # Admit or remove a node")
+		fmt.Println("  tunnel mesh drain <node> [--undo]  # Move traffic off a node before maintenance")
+		fmt.Println("  tunnel mesh quarantine <node> [--release] # Cut a suspicious node off its peers")
+		fmt.Println("  tunnel mesh policy add|list|rm     # Steer subnet traffic through chosen gateways")
+		fmt.Println("  tunnel mesh acl add|list|rm        # Allow or deny traffic between nodes")
+		fmt.Println("  tunnel mesh config keygen|push|show # Sync config sections to every node, encrypted")
+		fmt.Println("  tunnel mesh expose <name> <port>   # Advertise a service on this node")
+		fmt.Println("  tunnel mesh services               # List the services nodes expose")
+		fmt.Println("  tunnel mesh forward <service>      # Forward a local port to a service by name")
+		fmt.Println("  tunnel mesh label <node> [key=value|key-] [--region R] # Edit a node's metadata")
 		fmt.Println()
 		fmt.Println("Examples:")
 		fmt.Println("  tunnel mesh init 10.99.0.0/24")
-		fmt.Println("  tunnel mesh add 1.2.3.4 root")
+		fmt.Println("  tunnel mesh coordinator --listen :8443 --manual-approval")
+		fmt.Println("  tunnel mesh relay --listen :8444 --secret s3cret")
+		fmt.Println("  tunnel mesh coordinator --relay https://relay.example.com:8444 --relay-secret s3cret")
+		fmt.Println("  tunnel mesh coordinator --tls-self-signed   # Then join with https:// and --encrypt")
+		fmt.Println("  tunnel mesh coordinator --ha consul --consul http://127.0.0.1:8500 --tls-cert c.pem --tls-key k.pem")
+		fmt.Println("  tunnel mesh token create --expires 1h --uses 1")
+		fmt.Println("  tunnel mesh join http://coord.example.com:8443 --name edge-1 --token mjt1...")
+		fmt.Println("  tunnel mesh add 1.2.3.4 root --key ~/.ssh/id_ed25519 --region eu")
+		fmt.Println("  tunnel mesh connect --coordinator http://coord.example.com:8443 --token mjt1... --key ~/.ssh/id_ed25519")
 		fmt.Println("  tunnel mesh status")
 		return
 	}
@@ -160,6 +336,40 @@ func handleMeshCommand() {
 		handleMeshStatus()
 	case "connect":
 		handleMeshConnect()
+	case "coordinator":
+		handleMeshCoordinator()
+	case "join":
+		handleMeshJoin()
+	case "agent":
+		handleMeshAgent()
+	case "acl", "acls":
+		handleMeshACL()
+	case "config":
+		handleMeshConfig()
+	case "expose":
+		handleMeshExpose()
+	case "unexpose":
+		handleMeshUnexpose()
+	case "services":
+		handleMeshServices()
+	case "forward":
+		handleMeshForward()
+	case "relay":
+		handleMeshRelay()
+	case "token":
+		handleMeshToken()
+	case "nodes":
+		handleMeshNodes()
+	case "latency":
+		handleMeshLatency()
+	case "events":
+		handleMeshEvents()
+	case "policy", "policies":
+		handleMeshPolicy()
+	case "label":
+		handleMeshLabel()
+	case "approve", "remove", "rm", "drain", "quarantine":
+		handleMeshNodeAction(os.Args[2])
 	default:
 		fmt.Printf("❌ Unknown mesh command: %s\n", os.Args[2])
 	}
@@ -168,12 +378,13 @@ func handleMeshCommand() {
 // handleConfigCommand handles configuration commands
 func handleConfigCommand() {
 	if len(os.Args) < 3 {
-		fmt.Println("Usage: tunnel config <config-file> [--server] [--port 8888]")
+		fmt.Println("Usage: tunnel config <config-file> [--server] [--port 8888] [--strict]")
 		fmt.Println()
 		fmt.Println("Examples:")
 		fmt.Println("  tunnel config configs/config.yaml")
 		fmt.Println("  tunnel config configs/config.yaml --server")
 		fmt.Println("  tunnel config client-configs/ssh-tunnel-manager-config.yaml --server --port 9999")
+		fmt.Println("  tunnel config configs/config.yaml --strict    # Exit if required servers fail to start")
 		return
 	}
 
@@ -181,11 +392,14 @@ func handleConfigCommand() {
 
 	// Check for flags
 	serverMode := false
+	strict := false
 	port := "8888"
 	for i := 3; i < len(os.Args); i++ {
 		switch os.Args[i] {
 		case "--server", "-s":
 			serverMode = true
+		case "--strict":
+			strict = true
 		case "--port", "-p":
 			if i+1 < len(os.Args) {
 				port = os.Args[i+1]
@@ -201,9 +415,13 @@ func handleConfigCommand() {
 	}
 
 	fmt.Printf("✅ Configuration loaded: %d servers\n", len(cfg.Servers))
+	if strict {
+		cfg.StrictStartup = true
+	}
 
 	// Create application
 	application := app.New(cfg)
+	application.SetConfigPath(configPath)
 
 	// Setup graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -223,19 +441,27 @@ func handleConfigCommand() {
 	}
 
 	// Wait for shutdown
-	<-sigChan
+	startupErr := waitForShutdown(application, sigChan)
 	fmt.Println("\n👋 Shutting down...")
 	application.Shutdown(ctx)
+	if startupErr != nil {
+		os.Exit(exitRequiredDown)
+	}
 }
 
 // handleServerCommand handles server mode
 func handleServerCommand() {
 	port := "8888"
 	configPath := "configs/config.yaml"
+	recordWindow := ""
+	recordOut := ""
+	strict := false
 
 	// Parse optional arguments
 	for i := 2; i < len(os.Args); i++ {
 		switch os.Args[i] {
+		case "--strict":
+			strict = true
 		case "--port", "-p":
 			if i+1 < len(os.Args) {
 				port = os.Args[i+1]
@@ -246,6 +472,16 @@ func handleServerCommand() {
 				configPath = os.Args[i+1]
 				i++
 			}
+		case "--record":
+			if i+1 < len(os.Args) {
+				recordWindow = os.Args[i+1]
+				i++
+			}
+		case "--record-out":
+			if i+1 < len(os.Args) {
+				recordOut = os.Args[i+1]
+				i++
+			}
 		}
 	}
 
@@ -269,6 +505,9 @@ func handleServerCommand() {
 			},
 		}
 	}
+	if strict {
+		cfg.StrictStartup = true
+	}
 
 	fmt.Printf("🌐 Starting SSH Tunnel Manager server on port %s\n", port)
 	fmt.Printf("🌍 Web interface: http://localhost:%s\n", port)
@@ -279,10 +518,25 @@ func handleServerCommand() {
 	fmt.Println("  GET  /api/v1/status        - System status")
 	fmt.Println("  POST /api/v1/tunnels/start - Start tunnel")
 	fmt.Println("  POST /api/v1/tunnels/stop  - Stop tunnels")
+	fmt.Println("  POST /api/v1/tunnels/:name/stop|restart - Stop or restart one tunnel")
 	fmt.Println()
 
 	// Start server
 	application := app.New(cfg)
+	application.SetConfigPath(configPath)
+
+	if recordWindow != "" {
+		window, err := time.ParseDuration(recordWindow)
+		if err != nil {
+			log.Fatalf("❌ Invalid record window %q: %v", recordWindow, err)
+		}
+		if recordOut == "" {
+			recordOut = fmt.Sprintf("data/debug-bundle-%s.json", time.Now().Format("20060102-150405"))
+		}
+		if err := application.EnableRecording(recordOut, window); err != nil {
+			log.Fatalf("❌ Failed to enable recording: %v", err)
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -292,194 +546,3272 @@ func handleServerCommand() {
 
 	go application.StartServer(port)
 
-	<-sigChan
+	startupErr := waitForShutdown(application, sigChan)
 	fmt.Println("\n👋 Shutting down server...")
 	application.Shutdown(ctx)
+	if startupErr != nil {
+		os.Exit(exitRequiredDown)
+	}
 }
 
-// Mesh command handlers
-func handleMeshInit() {
-	networkCIDR := "10.99.0.0/24"
-	if len(os.Args) >= 4 {
-		networkCIDR = os.Args[3]
+// waitForShutdown blocks until a shutdown signal or a failed strict
+// startup, which it reports and returns
+func waitForShutdown(application *app.Application, sigChan <-chan os.Signal) error {
+	select {
+	case <-sigChan:
+		return nil
+	case err := <-application.Failed():
+		fmt.Printf("❌ Startup failed: %v\n", err)
+		printStartupReport(application.StartupReport())
+		return err
 	}
+}
 
-	fmt.Printf("🌐 Initializing mesh network with CIDR: %s\n", networkCIDR)
+// printStartupReport lists how each server and listener fared at startup
+func printStartupReport(report protocols.StartupReport) {
+	for _, result := range report.Results {
+		name := result.Name
+		if result.Component != "server" {
+			name = result.Component + " " + name
+		}
+		if result.Required {
+			name += " (required)"
+		}
+		if result.OK {
+			fmt.Printf("  ✅ %s\n", name)
+		} else {
+			fmt.Printf("  ❌ %s: %s\n", name, result.Error)
+		}
+	}
+}
 
-	meshConfig := &mesh.MeshConfig{
-		NetworkCIDR:         networkCIDR,
-		LocalNodeName:       "local-node",
-		AutoDiscovery:       true,
-		HealthCheckInterval: 30000000000, // 30 seconds
-		LoadBalancing:       "latency",
-		FailoverTimeout:     30000000000, // 30 seconds
-		Encryption:          true,
+// handleIperfCommand connects one server's tunnel and runs a timed
+// bidirectional throughput test through it to the speed helper
+func handleIperfCommand() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: tunnel iperf <server> [--config configs/config.yaml] [--duration 10s] [--target 127.0.0.1:5201]")
+		fmt.Println()
+		fmt.Println("Streams both ways at once through the tunnel to the speed helper that")
+		fmt.Println("`tunnel quick --setup` runs on the server (`tunnel bench-server`).")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  tunnel iperf aws-us-east")
+		fmt.Println("  tunnel iperf aws-us-east --duration 30s")
+		return
 	}
 
-	meshNet := mesh.NewMeshNetwork(meshConfig)
-	if err := meshNet.Initialize(); err != nil {
-		log.Fatalf("❌ Failed to initialize mesh: %v", err)
+	serverName := os.Args[2]
+	configPath := "configs/config.yaml"
+	target := ""
+	duration := 10 * time.Second
+
+	for i := 3; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--config", "-c":
+			if i+1 < len(os.Args) {
+				configPath = os.Args[i+1]
+				i++
+			}
+		case "--target":
+			if i+1 < len(os.Args) {
+				target = os.Args[i+1]
+				i++
+			}
+		case "--duration", "-t":
+			if i+1 < len(os.Args) {
+				d, err := time.ParseDuration(os.Args[i+1])
+				if err != nil {
+					log.Fatalf("❌ Invalid duration: %v", err)
+				}
+				duration = d
+				i++
+			}
+		}
 	}
 
-	fmt.Println("✅ Mesh network initialized!")
-	fmt.Println("💡 Add servers with: tunnel mesh add <host> <user>")
-}
+	tm := startBenchTunnel(configPath, serverName)
+	defer tm.Stop()
 
-func handleMeshAdd() {
-	if len(os.Args) < 5 {
-		fmt.Println("Usage: tunnel mesh add <host> <user> [password]")
-		fmt.Println("Example: tunnel mesh add 1.2.3.4 root mypassword")
-		return
+	fmt.Printf("📶 Running throughput test through %s for %s...\n", serverName, duration)
+
+	result, err := tm.Throughput(serverName, target, duration)
+	if err != nil {
+		tm.Stop()
+		log.Fatalf("❌ Throughput test failed: %v", err)
 	}
 
-	host := os.Args[3]
-	user := os.Args[4]
-	password := ""
-	if len(os.Args) >= 6 {
-		password = os.Args[5]
+	for _, interval := range result.Intervals {
+		fmt.Printf("   %5s  ⬆️ %8.2f Mbps  ⬇️ %8.2f Mbps\n",
+			interval.Start,
+			float64(interval.UploadBytes*8)/1e6,
+			float64(interval.DownloadBytes*8)/1e6)
+	}
+	fmt.Println()
+	fmt.Printf("   🔧 Protocol:    %s\n", result.Protocol)
+	fmt.Printf("   🎯 Target:      %s\n", result.Target)
+	fmt.Printf("   ⬆️ Upload:      %.2f Mbps\n", result.UploadMbps)
+	fmt.Printf("   ⬇️ Download:    %.2f Mbps\n", result.DownloadMbps)
+	fmt.Printf("   ⏱️ Avg RTT:     %s\n", result.AvgRTT)
+	fmt.Printf("   〰️ Jitter:      %s\n", result.Jitter)
+	if result.Retransmits >= 0 {
+		fmt.Printf("   🔁 Retransmits: %d (by the speed helper)\n", result.Retransmits)
 	} else {
-		fmt.Print("🔐 Enter SSH password: ")
-		fmt.Scanln(&password)
+		fmt.Println("   🔁 Retransmits: n/a")
 	}
+}
 
-	fmt.Printf("➕ Adding %s@%s to mesh...\n", user, host)
+// handleBenchCommand connects one server's tunnel and measures throughput,
+// jitter and loss through it to the speed helper
+func handleBenchCommand() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: tunnel bench <server> [--config configs/config.yaml] [--bytes 32] [--target 127.0.0.1:5201] [--probes 50]")
+		fmt.Println()
+		fmt.Println("Pushes --bytes MB each way through the tunnel to the speed helper that")
+		fmt.Println("`tunnel quick --setup` runs on the server (`tunnel bench-server`).")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  tunnel bench aws-us-east")
+		fmt.Println("  tunnel bench aws-us-east --bytes 100 --target 10.0.0.5:5201")
+		return
+	}
 
-	// This would connect to existing mesh coordinator
-	fmt.Println("✅ Server added to mesh network!")
-	fmt.Println("💡 View status with: tunnel mesh status")
-}
+	serverName := os.Args[2]
+	configPath := "configs/config.yaml"
+	target := ""
+	var opts diagnostics.BenchOptions
 
-func handleMeshStatus() {
-	fmt.Println("🌐 Mesh Network Status")
-	fmt.Println("═════════════════════")
-	fmt.Println("   📊 Total Nodes: 3")
-	fmt.Println("   ✅ Online Nodes: 2")
-	fmt.Println("   ❌ Offline Nodes: 1")
-	fmt.Println("   🌍 Network: 10.99.0.0/24")
-	fmt.Println("   ⚖️ Load Balancing: latency")
-	fmt.Println()
-	fmt.Println("Nodes:")
-	fmt.Println("   🟢 local-node (10.99.0.1) - online")
-	fmt.Println("   🟢 server-1 (10.99.0.2) - online - 25ms")
-	fmt.Println("   🔴 server-2 (10.99.0.3) - offline")
-}
+	for i := 3; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--config", "-c":
+			if i+1 < len(os.Args) {
+				configPath = os.Args[i+1]
+				i++
+			}
+		case "--target", "-t":
+			if i+1 < len(os.Args) {
+				target = os.Args[i+1]
+				i++
+			}
+		case "--bytes", "-b":
+			if i+1 < len(os.Args) {
+				mb, err := strconv.ParseInt(os.Args[i+1], 10, 64)
+				if err != nil || mb <= 0 {
+					log.Fatalf("❌ Invalid size in MB: %s", os.Args[i+1])
+				}
+				opts.Bytes = mb << 20
+				i++
+			}
+		case "--probes":
+			if i+1 < len(os.Args) {
+				fmt.Sscanf(os.Args[i+1], "%d", &opts.Probes)
+				i++
+			}
+		}
+	}
 
-func handleMeshConnect() {
-	fmt.Println("🔗 Connecting to best mesh node...")
-	fmt.Println("✅ Connected to server-1 (10.99.0.2)")
-	fmt.Println("🌐 SOCKS5 proxy: 127.0.0.1:8080")
-	fmt.Println("🌐 HTTP proxy: 127.0.0.1:8081")
-}
+	tm := startBenchTunnel(configPath, serverName)
+	defer tm.Stop()
+
+	fmt.Println("📶 Running benchmark...")
+	result, err := tm.Bench(serverName, target, opts)
+	if err != nil {
+		tm.Stop()
+		log.Fatalf("❌ Benchmark failed: %v", err)
+	}
 
-// showHelp displays help information
-func showHelp() {
-	fmt.Println("🚀 SSH Tunnel Manager")
-	fmt.Println("=====================")
-	fmt.Println()
-	fmt.Println("SIMPLE COMMANDS:")
-	fmt.Println()
-	fmt.Println("🔍 Quick Setup:")
-	fmt.Println("  tunnel quick <ip> <user> <password>     # Auto-discover & setup")
-	fmt.Println("  tunnel quick 1.2.3.4 root mypass        # Example")
-	fmt.Println("  tunnel quick 1.2.3.4 ubuntu ~/.ssh/key  # With SSH key")
-	fmt.Println("  tunnel quick 1.2.3.4 root pass --setup  # Install protocols")
-	fmt.Println()
-	fmt.Println("🌐 Mesh Network:")
-	fmt.Println("  tunnel mesh init                        # Create mesh network")
-	fmt.Println("  tunnel mesh add <ip> <user>             # Add server to mesh")
-	fmt.Println("  tunnel mesh status                      # Show mesh status")
-	fmt.Println("  tunnel mesh connect                     # Connect to mesh")
-	fmt.Println()
-	fmt.Println("📁 Configuration:")
-	fmt.Println("  tunnel config <file>                    # Use config file")
-	fmt.Println("  tunnel config <file> --server           # With web interface")
-	fmt.Println("  tunnel server                           # Start web server")
-	fmt.Println()
-	fmt.Println("🎨 Interactive:")
-	fmt.Println("  tunnel                                  # Interactive menu")
-	fmt.Println("  tunnel interactive                      # Interactive menu")
-	fmt.Println("  tunnel menu                             # Interactive menu")
-	fmt.Println()
-	fmt.Println("ℹ️  Help:")
-	fmt.Println("  tunnel help                             # This help")
-	fmt.Println("  tunnel version                          # Show version")
-	fmt.Println()
-	fmt.Println("EXAMPLES:")
-	fmt.Println("  # Quick VPN setup")
-	fmt.Println("  tunnel quick 1.2.3.4 root mypassword --setup")
-	fmt.Println()
-	fmt.Println("  # Multi-server mesh like Tailscale")
-	fmt.Println("  tunnel mesh init")
-	fmt.Println("  tunnel mesh add server1.com root")
-	fmt.Println("  tunnel mesh add server2.com ubuntu")
-	fmt.Println("  tunnel mesh connect")
-	fmt.Println()
-	fmt.Println("  # Use generated config")
-	fmt.Println("  tunnel config client-configs/ssh-tunnel-manager-config.yaml")
-	fmt.Println()
-	fmt.Println("  # Start web management interface")
-	fmt.Println("  tunnel server --port 8888")
 	fmt.Println()
-	fmt.Println("For detailed documentation, see README.md and AUTODISCOVERY.md")
+	fmt.Printf("   🔧 Protocol:    %s\n", result.Protocol)
+	fmt.Printf("   🎯 Target:      %s (%d MB each way)\n", result.Target, result.Bytes>>20)
+	fmt.Printf("   ⬆️ Upload:      %.2f Mbps\n", result.UploadMbps)
+	fmt.Printf("   ⬇️ Download:    %.2f Mbps\n", result.DownloadMbps)
+	fmt.Printf("   ⏱️ Avg RTT:     %s\n", result.AvgRTT)
+	fmt.Printf("   〰️ Jitter:      %s\n", result.Jitter)
+	fmt.Printf("   📉 Loss:        %.1f%% (%s probes)\n", result.Loss, result.ProbeNetwork)
 }
 
-// showVersion displays version information
-func showVersion() {
-	fmt.Println("SSH Tunnel Manager v1.0.0")
-	fmt.Println("Enterprise-grade multi-protocol tunnel management")
-	fmt.Println("Built with Go • https://github.com/user/ssh-tunnel-manager")
+// startBenchTunnel connects only the named server's tunnel, without the
+// local listeners, for measuring through it
+func startBenchTunnel(configPath, serverName string) *protocols.TunnelManager {
+	tm, err := connectTunnel(configPath, serverName)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	return tm
 }
 
-// handleLegacyCLI handles the old CLI for backward compatibility
-func handleLegacyCLI() {
-	var configPath = flag.String("config", "configs/config.yaml", "Path to configuration file")
-	var serverMode = flag.Bool("server", false, "Run in server mode with REST API")
-	var port = flag.String("port", "8888", "Server port for REST API")
+// connectTunnel starts a tunnel manager running only the named server's
+// tunnel, without the local listeners, and waits for it to connect
+func connectTunnel(configPath, serverName string) (*protocols.TunnelManager, error) {
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
 
-	// Auto-discovery flags
-	var autodiscover = flag.Bool("autodiscover", false, "Auto-discover and setup server protocols")
-	var setupHost = flag.String("host", "", "Server host/IP for auto-discovery")
-	var setupPort = flag.String("setup-port", "22", "SSH port for auto-discovery")
-	var setupUser = flag.String("user", "", "SSH username for auto-discovery")
-	var setupPassword = flag.String("password", "", "SSH password for auto-discovery")
-	var setupKeyPath = flag.String("key", "", "SSH private key path for auto-discovery")
-	var outputDir = flag.String("output", "client-configs", "Output directory for generated configs")
-	var setupProtocols = flag.Bool("setup", false, "Automatically setup all supported protocols")
+	found := false
+	for i := range cfg.Servers {
+		server := &cfg.Servers[i]
+		server.Enabled = server.Name == serverName
+		found = found || server.Enabled
+		if server.UDP != nil {
+			udp := *server.UDP
+			udp.Forwards = nil
+			server.UDP = &udp
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("server not found: %s", serverName)
+	}
+	cfg.AutoSelect = false
+	cfg.MixedPort = 0
+	cfg.Shadowsocks.Enabled = false
 
-	flag.Parse()
+	tm := protocols.NewTunnelManager(cfg)
+	if err := tm.Start(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to start tunnel manager: %v", err)
+	}
 
-	// Handle auto-discovery mode
-	if *autodiscover {
-		if *setupHost == "" || *setupUser == "" {
-			fmt.Println("❌ -host and -user are required for auto-discovery")
-			fmt.Println()
-			fmt.Println("💡 TIP: Use the new simple commands instead!")
-			fmt.Println("   tunnel quick 1.2.3.4 root mypassword")
-			fmt.Println("   tunnel quick 1.2.3.4 root mypassword --setup")
-			os.Exit(1)
+	fmt.Printf("🔌 Connecting to %s...\n", serverName)
+	if err := tm.StartTunnel(serverName); err != nil {
+		tm.Stop()
+		return nil, fmt.Errorf("failed to start tunnel: %v", err)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		status := tm.GetStatus()[serverName]
+		if status != nil && status.Status == string(protocols.StateConnected) {
+			return tm, nil
 		}
-
-		if *setupPassword == "" && *setupKeyPath == "" {
-			fmt.Println("❌ Either -password or -key must be provided")
-			fmt.Println()
-			fmt.Println("💡 TIP: Use the new simple commands instead!")
-			fmt.Println("   tunnel quick 1.2.3.4 root mypassword")
-			os.Exit(1)
+		if time.Now().After(deadline) {
+			reason := "timed out"
+			if status != nil && status.LastError != "" {
+				reason = status.LastError
+			}
+			tm.Stop()
+			return nil, fmt.Errorf("tunnel %s did not connect: %s", serverName, reason)
 		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
 
-		runAutoDiscovery(*setupHost, *setupPort, *setupUser, *setupPassword, *setupKeyPath, *outputDir, *setupProtocols)
-		return
+// handleBenchServerCommand runs the speed helper that `tunnel bench`
+// measures against
+func handleBenchServerCommand() {
+	listen := fmt.Sprintf("127.0.0.1:%d", diagnostics.BenchPort)
+
+	for i := 2; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--listen", "-l":
+			if i+1 < len(os.Args) {
+				listen = os.Args[i+1]
+				i++
+			}
+		}
 	}
 
-	// Load configuration
-	cfg, err := config.LoadConfig(*configPath)
-	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+	fmt.Printf("📶 Speed helper listening on %s (tcp and udp)\n", listen)
+	if err := diagnostics.ServeBench(listen); err != nil {
+		log.Fatalf("❌ Speed helper failed: %v", err)
 	}
+}
 
-	// Create application context
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// Exit codes of tunnel ready and of a failed strict startup, so scripts can
+// tell a nice-to-have tunnel being down from a required one
+const (
+	exitOptionalDown = 1
+	exitRequiredDown = 2
+	exitUnreachable  = 3
+)
+
+// handleReadyCommand asks a running instance whether its tunnels are up
+// and exits 0 when all are, 1 when only optional servers are down, 2 when
+// a required server is down and 3 when the instance cannot be reached
+func handleReadyCommand() {
+	host := "localhost"
+	port := "8888"
+	token := os.Getenv("TUNNEL_API_TOKEN")
+	quiet := false
+
+	for i := 2; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--quiet", "-q":
+			quiet = true
+		case "--host":
+			if i+1 < len(os.Args) {
+				host = os.Args[i+1]
+				i++
+			}
+		case "--port", "-p":
+			if i+1 < len(os.Args) {
+				port = os.Args[i+1]
+				i++
+			}
+		case "--token", "-t":
+			if i+1 < len(os.Args) {
+				token = os.Args[i+1]
+				i++
+			}
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/api/v1/ready", net.JoinHostPort(host, port)), nil)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Printf("❌ Instance unreachable: %v\n", err)
+		os.Exit(exitUnreachable)
+	}
+	defer resp.Body.Close()
+
+	var readiness protocols.Readiness
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		fmt.Printf("❌ Instance answered %s\n", resp.Status)
+		os.Exit(exitUnreachable)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&readiness); err != nil {
+		fmt.Printf("❌ Invalid readiness response: %v\n", err)
+		os.Exit(exitUnreachable)
+	}
+
+	code := 0
+	switch {
+	case len(readiness.RequiredDown) > 0 || !readiness.Ready:
+		code = exitRequiredDown
+	case len(readiness.OptionalDown) > 0:
+		code = exitOptionalDown
+	}
+
+	if !quiet {
+		switch code {
+		case 0:
+			fmt.Println("✅ Ready")
+		case exitOptionalDown:
+			fmt.Println("⚠️  Ready, optional servers down")
+		default:
+			fmt.Println("❌ Not ready")
+		}
+		for _, name := range readiness.RequiredDown {
+			fmt.Printf("  ❌ %s (required)\n", name)
+		}
+		for _, name := range readiness.OptionalDown {
+			fmt.Printf("  ⚠️  %s\n", name)
+		}
+		if !readiness.Ready && len(readiness.Required) == 0 {
+			fmt.Println("  No tunnel is connected")
+		}
+	}
+	os.Exit(code)
+}
+
+// handleKeysCommand creates, lists and revokes the API keys of a running
+// instance through its API
+func handleKeysCommand() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: tunnel keys <create|list|revoke> [--host localhost] [--port 8888] [--token TOKEN]")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  tunnel keys create --name grafana                      # read-only, never expires")
+		fmt.Println("  tunnel keys create --name ci --role operator --expires 720h")
+		fmt.Println("  tunnel keys list")
+		fmt.Println("  tunnel keys revoke ci")
+		fmt.Println()
+		fmt.Println("Roles: read-only (GET requests), operator (also start, stop and test tunnels),")
+		fmt.Println("admin (anything). The token, or TUNNEL_API_TOKEN, needs the admin role.")
+		return
+	}
+
+	host := "localhost"
+	port := "8888"
+	token := os.Getenv("TUNNEL_API_TOKEN")
+	var args []string
+	req := map[string]interface{}{}
+	for i := 3; i < len(os.Args); i++ {
+		arg := os.Args[i]
+		if !strings.HasPrefix(arg, "--") {
+			args = append(args, arg)
+			continue
+		}
+		if i+1 >= len(os.Args) {
+			log.Fatalf("❌ Missing value for %s", arg)
+		}
+		value := os.Args[i+1]
+		i++
+		switch arg {
+		case "--host":
+			host = value
+		case "--port":
+			port = value
+		case "--token":
+			token = value
+		case "--name":
+			req["name"] = value
+		case "--role":
+			req["role"] = value
+		case "--expires":
+			req["expires"] = value
+		default:
+			log.Fatalf("❌ Unknown option: %s", arg)
+		}
+	}
+
+	call := func(method, path string, body, out interface{}) {
+		var reader io.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = strings.NewReader(string(data))
+		}
+		r, err := http.NewRequest(method, fmt.Sprintf("http://%s/api/v1%s", net.JoinHostPort(host, port), path), reader)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		r.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(r)
+		if err != nil {
+			log.Fatalf("❌ Instance unreachable: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			var apiErr struct {
+				Error string `json:"error"`
+			}
+			json.NewDecoder(resp.Body).Decode(&apiErr)
+			log.Fatalf("❌ %s: %s", resp.Status, apiErr.Error)
+		}
+		if out != nil {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				log.Fatalf("❌ Invalid response: %v", err)
+			}
+		}
+	}
+
+	switch os.Args[2] {
+	case "create":
+		if req["name"] == nil {
+			log.Fatalf("❌ Usage: tunnel keys create --name <name> [--role read-only|operator|admin] [--expires 720h]")
+		}
+		var created struct {
+			Key string `json:"key"`
+			config.APIKey
+		}
+		call(http.MethodPost, "/keys", req, &created)
+		fmt.Printf("✅ API key %s created (%s)\n", created.Name, created.Role)
+		fmt.Println(created.Key)
+		fmt.Println()
+		fmt.Println("It is not stored and cannot be shown again.")
+
+	case "list":
+		var keys []config.APIKey
+		call(http.MethodGet, "/keys", nil, &keys)
+		if len(keys) == 0 {
+			fmt.Println("No API keys")
+			return
+		}
+		fmt.Printf("%-14s %-20s %-10s %-22s %s\n", "ID", "NAME", "ROLE", "CREATED", "EXPIRES")
+		for _, key := range keys {
+			expires := "never"
+			switch {
+			case key.Expires.IsZero():
+			case time.Now().After(key.Expires):
+				expires = "expired"
+			default:
+				expires = key.Expires.Local().Format("2006-01-02 15:04")
+			}
+			fmt.Printf("%-14s %-20s %-10s %-22s %s\n", key.ID, key.Name, key.Role, key.Created.Local().Format("2006-01-02 15:04"), expires)
+		}
+
+	case "revoke":
+		if len(args) < 1 {
+			log.Fatalf("❌ Usage: tunnel keys revoke <id|name>")
+		}
+		call(http.MethodDelete, "/keys/"+url.PathEscape(args[0]), nil, nil)
+		fmt.Printf("✅ API key %s revoked\n", args[0])
+
+	default:
+		fmt.Printf("❌ Unknown keys command: %s\n", os.Args[2])
+	}
+}
+
+// handleTraceCommand runs an MTR-style traceroute to a server
+func handleTraceCommand() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: tunnel trace <server> [--config configs/config.yaml] [--via <destination>] [--mode icmp|udp] [--rounds 3] [--max-hops 30]")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  tunnel trace aws-us-east")
+		fmt.Println("  tunnel trace aws-us-east --via 1.1.1.1")
+		fmt.Println("  tunnel trace aws-us-east --mode udp")
+		fmt.Println("  tunnel trace all")
+		return
+	}
+
+	serverName := os.Args[2]
+	configPath := "configs/config.yaml"
+	destination := ""
+	mode := diagnostics.TraceICMP
+	rounds := 3
+	maxHops := 30
+
+	for i := 3; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--config", "-c":
+			if i+1 < len(os.Args) {
+				configPath = os.Args[i+1]
+				i++
+			}
+		case "--via":
+			if i+1 < len(os.Args) {
+				destination = os.Args[i+1]
+				i++
+			}
+		case "--mode":
+			if i+1 < len(os.Args) {
+				mode = os.Args[i+1]
+				i++
+			}
+		case "--rounds":
+			if i+1 < len(os.Args) {
+				fmt.Sscanf(os.Args[i+1], "%d", &rounds)
+				i++
+			}
+		case "--max-hops":
+			if i+1 < len(os.Args) {
+				fmt.Sscanf(os.Args[i+1], "%d", &maxHops)
+				i++
+			}
+		}
+	}
+
+	var servers []config.Server
+	if serverName == "all" {
+		cfg, err := config.LoadConfig(configPath)
+		if err != nil {
+			log.Fatalf("❌ Failed to load config: %v", err)
+		}
+		servers = cfg.Servers
+	} else {
+		servers = []config.Server{findServer(configPath, serverName)}
+	}
+
+	if mode != diagnostics.TraceICMP && mode != diagnostics.TraceUDP {
+		log.Fatalf("❌ Unsupported trace mode: %s (supported: icmp, udp)", mode)
+	}
+	tracer := diagnostics.NewTracer(maxHops, rounds, 2*time.Second, mode)
+	history := diagnostics.NewHistory("")
+
+	for _, server := range servers {
+		fmt.Printf("🛰️ Tracing route to %s (%s)...\n", server.Name, server.Host)
+		result, err := tracer.Trace(server)
+		if err != nil {
+			log.Printf("❌ Trace failed: %v", err)
+			continue
+		}
+
+		fmt.Println()
+		fmt.Print(result.Render())
+		if !result.Reached {
+			fmt.Println("⚠️ Destination not reached")
+		}
+
+		if destination != "" {
+			fmt.Println()
+			fmt.Printf("🔗 Tracing from %s to %s...\n", server.Name, destination)
+			output, err := traceThroughTunnel(configPath, server.Name, destination, tracer)
+			if err != nil {
+				log.Printf("⚠️ %v", err)
+			}
+			result.Remote = output
+			fmt.Println(output)
+		}
+
+		if err := history.Append("trace", server.Name, result); err != nil {
+			log.Printf("⚠️ Failed to store result in history: %v", err)
+		}
+		fmt.Println()
+	}
+}
+
+// traceThroughTunnel connects the server's tunnel and traces from the
+// server towards destination over it
+func traceThroughTunnel(configPath, serverName, destination string, tracer *diagnostics.Tracer) (string, error) {
+	tm, err := connectTunnel(configPath, serverName)
+	if err != nil {
+		return "", err
+	}
+	defer tm.Stop()
+	return tm.TraceRemote(serverName, destination, tracer)
+}
+
+// handleSimulateCommand replays recorded probe history against the
+// selection policies and compares their uptime and latency
+func handleSimulateCommand() {
+	configPath := "configs/config.yaml"
+	policy := ""
+	window := "7d"
+
+	for i := 2; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--config", "-c":
+			if i+1 < len(os.Args) {
+				configPath = os.Args[i+1]
+				i++
+			}
+		case "--policy", "-p":
+			if i+1 < len(os.Args) {
+				policy = os.Args[i+1]
+				i++
+			}
+		case "--history":
+			if i+1 < len(os.Args) {
+				window = os.Args[i+1]
+				i++
+			}
+		}
+	}
+
+	period, err := parseHistoryWindow(window)
+	if err != nil {
+		log.Fatalf("❌ Invalid history window %q: %v", window, err)
+	}
+
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Fatalf("❌ Failed to load config: %v", err)
+	}
+	if policy == "" {
+		policy = cfg.SelectionMethod
+	}
+
+	sim, err := diagnostics.NewSimulator(cfg, diagnostics.NewHistory(""), time.Now().Add(-period))
+	if err != nil {
+		log.Fatalf("❌ Failed to load history: %v", err)
+	}
+
+	fmt.Printf("🧪 Replaying %d probe rounds from the last %s\n", sim.Rounds(), window)
+	if sim.Rounds() < 2 {
+		fmt.Println("⚠️ Not enough probe history. Enable monitoring.record_probes and let the client run for a while.")
+		return
+	}
+
+	var results []*diagnostics.SimulationResult
+	for _, p := range diagnostics.SimulationPolicies {
+		result, err := sim.Run(p)
+		if err != nil {
+			log.Fatalf("❌ Simulation failed: %v", err)
+		}
+		results = append(results, result)
+	}
+	if _, err := sim.Run(policy); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	fmt.Println()
+	fmt.Print(diagnostics.RenderSimulation(results, policy))
+}
+
+// handleReplayCommand replays a recorded debug bundle against a local instance
+func handleReplayCommand() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: tunnel replay <bundle.json> [--target http://localhost:8888] [--token <token>] [--realtime]")
+		fmt.Println()
+		fmt.Println("Record a bundle with: tunnel server --record 10m [--record-out bundle.json]")
+		return
+	}
+
+	bundlePath := os.Args[2]
+	target := "http://localhost:8888"
+	token := ""
+	realtime := false
+
+	for i := 3; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--target", "-t":
+			if i+1 < len(os.Args) {
+				target = os.Args[i+1]
+				i++
+			}
+		case "--token":
+			if i+1 < len(os.Args) {
+				token = os.Args[i+1]
+				i++
+			}
+		case "--realtime":
+			realtime = true
+		}
+	}
+
+	bundle, err := recorder.LoadBundle(bundlePath)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	fmt.Printf("▶️ Replaying %d interactions recorded %s against %s\n\n",
+		len(bundle.Interactions), bundle.StartedAt.Format(time.RFC3339), target)
+
+	results := recorder.NewReplayer(target, token, realtime).Replay(bundle)
+	fmt.Print(recorder.RenderReplay(results))
+}
+
+// parseHistoryWindow parses a duration that may also be given in days ("7d")
+func parseHistoryWindow(window string) (time.Duration, error) {
+	if strings.HasSuffix(window, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(window, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("expected a number of days")
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(window)
+}
+
+// handleUDPRelayCommand relays UDP for an SSH tunnel's client, framed over
+// stdin and stdout; the client starts it on the server over SSH
+func handleUDPRelayCommand() {
+	if err := udprelay.Serve(os.Stdin, os.Stdout); err != nil {
+		log.Fatalf("udp relay: %v", err)
+	}
+}
+
+// handleTCPRelayCommand publishes a loopback remote forward on an address
+// sshd's GatewayPorts keeps it off; an SSH tunnel's client starts it on the
+// server when socat is missing and stops it with the connection
+func handleTCPRelayCommand() {
+	if len(os.Args) != 4 {
+		log.Fatalf("usage: tunnel tcp-relay <listen_address> <target_address>")
+	}
+	listen, target := os.Args[2], os.Args[3]
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Fatalf("tcp relay: %v", err)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatalf("tcp relay: %v", err)
+		}
+		go func() {
+			defer conn.Close()
+			upstream, err := net.DialTimeout("tcp", target, 10*time.Second)
+			if err != nil {
+				log.Printf("tcp relay: %v", err)
+				return
+			}
+			defer upstream.Close()
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+// handleMITMCACommand shows the HTTPS interception CA and how to trust it,
+// creating it if needed
+func handleMITMCACommand() {
+	configPath := "configs/config.yaml"
+	printPEM := false
+
+	for i := 2; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--config", "-c":
+			if i+1 < len(os.Args) {
+				configPath = os.Args[i+1]
+				i++
+			}
+		case "--pem":
+			printPEM = true
+		}
+	}
+
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Fatalf("❌ Failed to load config: %v", err)
+	}
+	if !cfg.MITM.Enabled {
+		fmt.Println("HTTPS interception is disabled. It is a debugging feature; enable it with:")
+		fmt.Println()
+		fmt.Println("  mitm:")
+		fmt.Println("    enabled: true")
+		fmt.Println("    domains: [\"api.example.com\"]")
+		return
+	}
+
+	authority, created, err := mitm.LoadOrCreate(cfg.MITM.CADir, cfg.MITM.Domains)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if printPEM {
+		os.Stdout.Write(authority.CertPEM())
+		return
+	}
+
+	if created {
+		fmt.Println("🔑 Created a new interception CA")
+	}
+	fmt.Println("⚠️  DEBUGGING ONLY: trusting this CA lets this machine decrypt HTTPS to:")
+	for _, domain := range cfg.MITM.Domains {
+		fmt.Printf("     %s\n", domain)
+	}
+	fmt.Println("   The CA is name-constrained to these domains and cannot vouch for others.")
+	fmt.Println("   Remove it from your trust store when you are done.")
+	fmt.Println()
+	fmt.Printf("Certificate: %s\n", authority.CertPath())
+	fmt.Printf("SHA-256:     %s\n", authority.Fingerprint())
+	fmt.Println()
+	fmt.Println("Trust it with:")
+	fmt.Printf("  Linux:   sudo cp %s /usr/local/share/ca-certificates/ssh-tunnel-debug.crt && sudo update-ca-certificates\n", authority.CertPath())
+	fmt.Printf("  macOS:   sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain %s\n", authority.CertPath())
+	fmt.Printf("  Windows: certutil -addstore -f Root %s\n", authority.CertPath())
+	fmt.Println("  Firefox: Settings → Privacy & Security → Certificates → Import")
+}
+
+// handleICMPServerCommand runs the ICMP tunnel agent on a server
+// handleObfsServerCommand runs the server side of the xor, tls and obfs4
+// obfuscation layers in front of sshd or a Trojan server
+func handleObfsServerCommand() {
+	obfs := config.ObfuscationConfig{Key: os.Getenv("OBFS_KEY")}
+	listen := ":8443"
+	forward := "127.0.0.1:22"
+	certFile, keyFile := "", ""
+	stateDir := "data/obfs4"
+
+	for i := 2; i < len(os.Args); i++ {
+		if i+1 >= len(os.Args) {
+			break
+		}
+		switch os.Args[i] {
+		case "--type", "-t":
+			obfs.Type = os.Args[i+1]
+		case "--key", "-k":
+			obfs.Key = os.Args[i+1]
+		case "--listen", "-l":
+			listen = os.Args[i+1]
+		case "--forward", "-f":
+			forward = os.Args[i+1]
+		case "--cert":
+			certFile = os.Args[i+1]
+		case "--cert-key":
+			keyFile = os.Args[i+1]
+		case "--state-dir":
+			stateDir = os.Args[i+1]
+		case "--iat-mode":
+			mode, err := strconv.Atoi(os.Args[i+1])
+			if err != nil {
+				log.Fatalf("❌ Invalid iat mode: %s", os.Args[i+1])
+			}
+			obfs.IATMode = mode
+		default:
+			continue
+		}
+		i++
+	}
+
+	if obfs.Type == "" {
+		fmt.Println("Usage: tunnel obfs-server --type xor --key <secret> [--listen :8443] [--forward 127.0.0.1:22]")
+		fmt.Println("       tunnel obfs-server --type tls --cert cert.pem --cert-key key.pem [--listen :443] [--forward 127.0.0.1:22]")
+		fmt.Println("       tunnel obfs-server --type obfs4 [--state-dir data/obfs4] [--iat-mode 0] [--listen :8443] [--forward 127.0.0.1:22]")
+		fmt.Println()
+		fmt.Println("Unwraps the obfuscation layer of servers with an obfuscation block and")
+		fmt.Println("forwards the connections to sshd or a Trojan server. Point the client's")
+		fmt.Println("host and port at --listen. The xor key can also be set with OBFS_KEY.")
+		fmt.Println("obfs4 keeps its identity in --state-dir, in obfs4proxy's format, and")
+		fmt.Println("prints the cert clients need.")
+		return
+	}
+
+	server, err := protocols.NewObfuscationListener(obfs, certFile, keyFile, stateDir, forward)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Fatalf("❌ Failed to listen on %s: %v", listen, err)
+	}
+
+	fmt.Printf("🎭 %s obfuscation on %s, forwarding to %s\n", obfs.Type, listen, forward)
+	if client := server.ClientConfig(); client.Type == "obfs4" {
+		fmt.Println("   Client obfuscation block:")
+		fmt.Println("     type: \"obfs4\"")
+		fmt.Printf("     cert: \"%s\"\n", client.Cert)
+		fmt.Printf("     iat_mode: %d\n", client.IATMode)
+	}
+	if err := server.Serve(listener); err != nil {
+		log.Fatalf("❌ Obfuscation server failed: %v", err)
+	}
+}
+
+func handleSSH3ServerCommand() {
+	listen := ":443"
+	path := "/ssh3-term"
+	sshAddr := "127.0.0.1:22"
+	hostKeys := "/etc/ssh/ssh_host_*_key.pub"
+	certFile, keyFile := "", ""
+
+	for i := 2; i < len(os.Args); i++ {
+		if i+1 >= len(os.Args) {
+			break
+		}
+		switch os.Args[i] {
+		case "--listen", "-l":
+			listen = os.Args[i+1]
+		case "--path":
+			path = os.Args[i+1]
+		case "--ssh":
+			sshAddr = os.Args[i+1]
+		case "--host-keys":
+			hostKeys = os.Args[i+1]
+		case "--cert":
+			certFile = os.Args[i+1]
+		case "--cert-key":
+			keyFile = os.Args[i+1]
+		default:
+			continue
+		}
+		i++
+	}
+
+	if certFile == "" || keyFile == "" {
+		fmt.Println("Usage: tunnel ssh3-server --cert cert.pem --cert-key key.pem [--listen :443] [--path /ssh3-term]")
+		fmt.Println("                          [--ssh 127.0.0.1:22] [--host-keys '/etc/ssh/ssh_host_*_key.pub']")
+		fmt.Println()
+		fmt.Println("Serves ssh3 transport clients over HTTP/3 (UDP). Each client logs in to")
+		fmt.Println("sshd at --ssh with its own user and password or key, and its connections")
+		fmt.Println("are forwarded through that login, so sshd's accounts and forwarding rules")
+		fmt.Println("apply. sshd is verified against the public keys matching --host-keys.")
+		return
+	}
+
+	hostKeyCallback, err := protocols.SSHDHostKeys(hostKeys)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	server, err := protocols.NewSSH3Server(certFile, keyFile, path, sshAddr, hostKeyCallback)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	conn, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		log.Fatalf("❌ Failed to listen on %s: %v", listen, err)
+	}
+
+	fmt.Printf("🚀 SSH3 on %s%s (udp), logging in to sshd at %s\n", listen, path, sshAddr)
+	if err := server.Serve(conn); err != nil {
+		log.Fatalf("❌ SSH3 server failed: %v", err)
+	}
+}
+
+func handleICMPServerCommand() {
+	key := os.Getenv("ICMP_TUNNEL_KEY")
+	forward := "127.0.0.1:22"
+	mtu := 0
+
+	for i := 2; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--key", "-k":
+			if i+1 < len(os.Args) {
+				key = os.Args[i+1]
+				i++
+			}
+		case "--forward", "-f":
+			if i+1 < len(os.Args) {
+				forward = os.Args[i+1]
+				i++
+			}
+		case "--mtu":
+			if i+1 < len(os.Args) {
+				fmt.Sscanf(os.Args[i+1], "%d", &mtu)
+				i++
+			}
+		}
+	}
+
+	if key == "" {
+		fmt.Println("Usage: tunnel icmp-server --key <secret> [--forward 127.0.0.1:22] [--mtu 1024]")
+		fmt.Println()
+		fmt.Println("The key can also be set with the ICMP_TUNNEL_KEY environment variable.")
+		fmt.Println("Run as root with: sysctl -w net.ipv4.icmp_echo_ignore_all=1")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		cancel()
+	}()
+
+	fmt.Printf("📡 ICMP tunnel agent forwarding to %s\n", forward)
+	server := icmptunnel.NewServer(key, forward, icmptunnel.Options{MTU: mtu})
+	if err := server.Serve(ctx); err != nil {
+		log.Fatalf("❌ ICMP tunnel agent failed: %v", err)
+	}
+}
+
+// handleVerifyCommand runs a server's protocol conformance suite and
+// prints the compatibility report; it exits non-zero when a check fails
+func handleVerifyCommand() {
+	if len(os.Args) < 3 || strings.HasPrefix(os.Args[2], "-") {
+		fmt.Println("Usage: tunnel verify <server> [--config configs/config.yaml] [--json]")
+		fmt.Println()
+		fmt.Println("Checks what the tunnel relies on before you do:")
+		fmt.Println("  ssh       channel types, global requests and SOCKS5/SOCKS4a/HTTP CONNECT through them")
+		fmt.Println("  vless     requests for each address type, split payloads and unknown UUIDs")
+		fmt.Println("  hysteria  QUIC version negotiation and Salamander obfuscation")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  tunnel verify new-provider")
+		fmt.Println("  tunnel verify new-provider --json")
+		return
+	}
+
+	serverName := os.Args[2]
+	configPath := "configs/config.yaml"
+	jsonOutput := false
+
+	for i := 3; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--config", "-c":
+			if i+1 < len(os.Args) {
+				configPath = os.Args[i+1]
+				i++
+			}
+		case "--json":
+			jsonOutput = true
+		}
+	}
+
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Fatalf("❌ Failed to load config: %v", err)
+	}
+	server := findServer(configPath, serverName)
+
+	if !jsonOutput {
+		fmt.Printf("🔬 Verifying %s (%s) at %s...\n\n", server.Name, server.Transport, net.JoinHostPort(server.Host, server.Port))
+	}
+	report, err := protocols.NewTunnelManager(cfg).Verify(serverName)
+	if err != nil {
+		log.Fatalf("❌ Verification failed: %v", err)
+	}
+	if err := diagnostics.NewHistory("").Append("verify", server.Name, report); err != nil {
+		log.Printf("⚠️ Failed to store result in history: %v", err)
+	}
+
+	if jsonOutput {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		fmt.Print(report.Render())
+		if report.Compatible() {
+			fmt.Printf("✅ %s is compatible\n", server.Name)
+		} else {
+			fmt.Printf("❌ %s failed conformance checks\n", server.Name)
+		}
+	}
+	if !report.Compatible() {
+		os.Exit(1)
+	}
+}
+
+// handleShellCommand opens a shell, or runs a command, on a server with
+// the server's agent forwarding policy
+func handleShellCommand() {
+	if len(os.Args) < 3 || strings.HasPrefix(os.Args[2], "-") {
+		fmt.Println("Usage: tunnel shell <server> [--config configs/config.yaml] [--no-agent] [--] [command...]")
+		fmt.Println()
+		fmt.Println("Agent forwarding follows the server's agent_forwarding setting:")
+		fmt.Println("  off      never forwarded (default)")
+		fmt.Println("  on       the server can use every key in the local ssh-agent")
+		fmt.Println("  confirm  each signature is confirmed on the terminal")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  tunnel shell aws-us-east")
+		fmt.Println("  tunnel shell aws-us-east -- uptime")
+		fmt.Println("  tunnel shell aws-us-east --no-agent")
+		return
+	}
+
+	serverName := os.Args[2]
+	configPath := "configs/config.yaml"
+	opts := protocols.ShellOptions{}
+	var command []string
+
+	for i := 3; i < len(os.Args); i++ {
+		if command != nil {
+			command = append(command, os.Args[i])
+			continue
+		}
+		switch os.Args[i] {
+		case "--config", "-c":
+			if i+1 < len(os.Args) {
+				configPath = os.Args[i+1]
+				i++
+			}
+		case "--no-agent", "-a":
+			opts.NoAgent = true
+		case "--":
+			command = []string{}
+		default:
+			command = []string{os.Args[i]}
+		}
+	}
+	opts.Command = strings.Join(command, " ")
+
+	server := findServer(configPath, serverName)
+	status, err := protocols.RunShell(server, opts)
+	if err != nil {
+		log.Fatalf("❌ Shell on %s failed: %v", server.Name, err)
+	}
+	os.Exit(status)
+}
+
+// findServer loads the configuration and returns the named server
+func findServer(configPath, name string) config.Server {
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Fatalf("❌ Failed to load config: %v", err)
+	}
+
+	for _, server := range cfg.Servers {
+		if server.Name == name {
+			return server
+		}
+	}
+
+	log.Fatalf("❌ Server not found: %s", name)
+	return config.Server{}
+}
+
+// Mesh command handlers
+func handleMeshInit() {
+	cfg := meshConfigFile(3)
+	meshConfig := mesh.NodeConfig(cfg.Mesh, cfg.Scoring)
+	meshConfig.AutoDiscovery = true
+	if len(os.Args) >= 4 && !strings.HasPrefix(os.Args[3], "-") {
+		meshConfig.NetworkCIDR = os.Args[3]
+	}
+
+	fmt.Printf("🌐 Initializing mesh network with CIDR: %s\n", meshConfig.NetworkCIDR)
+
+	if meshConfig.JoinToken == "" {
+		log.Fatalf("❌ A join token is required: create one with tunnel mesh token create")
+	}
+
+	meshNet := mesh.NewMeshNetwork(meshConfig)
+	if err := meshNet.Initialize(); err != nil {
+		log.Fatalf("❌ Failed to initialize mesh: %v", err)
+	}
+
+	fmt.Println("✅ Mesh network initialized!")
+	fmt.Println("💡 Add servers with: tunnel mesh add <host> <user> --coordinator <url>")
+}
+
+// handleMeshAdd provisions a node over SSH: it creates a single-use join
+// token, installs this binary and a tunnel mesh join service on the host,
+// and waits for the node to register with the coordinator
+func handleMeshAdd() {
+	client, args := meshAdminClient(3)
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		fmt.Println("Usage: tunnel mesh add <host> [user] [password] [--key ~/.ssh/id_ed25519] [--port 22] [--name <node>] [--region <region>] [--tags eu,prod] [--host-key SHA256:...] [--insecure-skip-verify] [--binary path] [--join-url URL] [--coordinator URL] [--admin-key KEY] [--config config.yaml]")
+		fmt.Println("Example: tunnel mesh add 1.2.3.4 root --key ~/.ssh/id_ed25519 --region eu")
+		return
+	}
+
+	server := config.Server{
+		Host:      args[0],
+		Port:      "22",
+		User:      "root",
+		Transport: config.TransportSSH,
+		Timeout:   30 * time.Second,
+	}
+	opts := mesh.ProvisionOptions{
+		CoordinatorURL: client.URL(),
+		Name:           args[0],
+	}
+	var positional []string
+	for i := 1; i < len(args); i++ {
+		if args[i] == "--insecure-skip-verify" {
+			server.InsecureSkipVerify = true
+			continue
+		}
+		if !strings.HasPrefix(args[i], "-") {
+			positional = append(positional, args[i])
+			continue
+		}
+		if i+1 >= len(args) {
+			log.Fatalf("❌ %s needs a value", args[i])
+		}
+		switch args[i] {
+		case "--key":
+			server.KeyPath = args[i+1]
+		case "--password":
+			server.Password = args[i+1]
+		case "--port", "-p":
+			server.Port = args[i+1]
+		case "--host-key":
+			server.HostKey = args[i+1]
+		case "--name", "-n":
+			opts.Name = args[i+1]
+		case "--region":
+			opts.Flags = append(opts.Flags, "--region", args[i+1])
+		case "--tags":
+			opts.Flags = append(opts.Flags, "--tags", args[i+1])
+		case "--binary":
+			opts.Binary = args[i+1]
+		case "--join-url":
+			opts.CoordinatorURL = args[i+1]
+		default:
+			log.Fatalf("❌ Unknown option: %s", args[i])
+		}
+		i++
+	}
+	if len(positional) > 0 {
+		server.User = positional[0]
+	}
+	if len(positional) > 1 {
+		server.Password = positional[1]
+	}
+	if server.Password == "" && server.KeyPath == "" {
+		fmt.Print("🔐 Enter SSH password: ")
+		password, err := term.ReadPassword(int(syscall.Stdin))
+		fmt.Println()
+		if err != nil {
+			log.Fatalf("❌ Failed to read password: %v", err)
+		}
+		server.Password = string(password)
+	}
+	encrypt := false
+	for _, coordinatorURL := range strings.Split(opts.CoordinatorURL, ",") {
+		if u, err := url.Parse(strings.TrimSpace(coordinatorURL)); err != nil || u.Host == "" {
+			log.Fatalf("❌ Invalid coordinator URL: %s", coordinatorURL)
+		} else if ip := net.ParseIP(u.Hostname()); (ip != nil && ip.IsLoopback()) || u.Hostname() == "localhost" {
+			log.Fatalf("❌ The new node cannot reach the coordinator at %s: pass the URLs it can with --join-url", coordinatorURL)
+		} else if u.Scheme == "https" {
+			encrypt = true
+		}
+	}
+	if encrypt {
+		opts.Flags = append(opts.Flags, "--encrypt") // The token carries a self-signed certificate's pin
+	}
+
+	fmt.Printf("🎟️  Creating a join token for %s...\n", opts.Name)
+	token, err := client.CreateToken(mesh.CreateTokenRequest{
+		TTL:     "1h",
+		MaxUses: 1,
+		Comment: "tunnel mesh add " + opts.Name,
+	})
+	if err != nil {
+		log.Fatalf("❌ Failed to create a join token: %v", err)
+	}
+	opts.JoinToken = token.Token
+
+	fmt.Printf("🔌 Connecting to %s@%s...\n", server.User, net.JoinHostPort(server.Host, server.Port))
+	sshClient, err := protocols.DialSSH(server)
+	if err != nil {
+		client.RevokeToken(token.ID)
+		log.Fatalf("❌ %v", err)
+	}
+	defer sshClient.Close()
+
+	fmt.Println("📦 Installing the mesh agent...")
+	result, err := mesh.Provision(sshClient, opts)
+	if err != nil {
+		client.RevokeToken(token.ID)
+		log.Fatalf("❌ Failed to provision %s: %v", server.Host, err)
+	}
+	fmt.Printf("✅ Agent installed on %s (%s) and started with %s\n", server.Host, result.Platform, result.Service)
+
+	fmt.Println("⏳ Waiting for the node to join...")
+	deadline := time.Now().Add(2 * time.Minute)
+	for time.Now().Before(deadline) {
+		nodes, err := client.ListNodes()
+		if err != nil {
+			log.Fatalf("❌ Failed to list mesh nodes: %v", err)
+		}
+		for _, node := range nodes {
+			if node.TokenID != token.ID {
+				continue
+			}
+			if !node.Approved {
+				fmt.Printf("⏳ %s registered as %s (%s) and is waiting for approval: tunnel mesh approve %s\n", node.Name, node.ID, node.MeshIP, node.Name)
+				return
+			}
+			if node.Status == "online" {
+				fmt.Printf("✅ %s joined the mesh as %s with mesh IP %s\n", node.Name, node.ID, node.MeshIP)
+				fmt.Println("💡 View status with: tunnel mesh status")
+				return
+			}
+		}
+		time.Sleep(2 * time.Second)
+	}
+
+	hint := "journalctl -u tunnel-mesh"
+	if result.Service == "nohup" {
+		hint = "/var/log/tunnel-mesh.log"
+	}
+	log.Fatalf("❌ %s did not join within 2 minutes; check %s on the host", opts.Name, hint)
+}
+
+// handleMeshStatus shows the mesh as its coordinator sees it: the members,
+// their mesh IPs and state, and the round trip their peers measure to them
+func handleMeshStatus() {
+	client, args := meshAdminClient(3)
+	jsonOutput := false
+	for _, arg := range args {
+		if arg == "--json" {
+			jsonOutput = true
+		}
+	}
+
+	status, err := client.Status()
+	if err != nil {
+		log.Fatalf("❌ Failed to get mesh status: %v", err)
+	}
+	if jsonOutput {
+		data, _ := json.MarshalIndent(status, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	online, offline, pending := 0, 0, 0
+	for _, node := range status.Nodes {
+		switch {
+		case !node.Approved:
+			pending++
+		case node.Status == "online":
+			online++
+		default:
+			offline++
+		}
+	}
+
+	fmt.Println("🌐 Mesh Network Status")
+	fmt.Println("═════════════════════")
+	fmt.Printf("   📊 Total Nodes: %d\n", len(status.Nodes))
+	fmt.Printf("   ✅ Online Nodes: %d\n", online)
+	fmt.Printf("   ❌ Offline Nodes: %d\n", offline)
+	if pending > 0 {
+		fmt.Printf("   ⏳ Awaiting Approval: %d\n", pending)
+	}
+	fmt.Printf("   🌍 Network: %s\n", status.Network)
+	fmt.Printf("   🔢 Addresses: %d leased, %d reserved, %d free\n", status.Addresses.Leased, status.Addresses.Reserved, status.Addresses.Free)
+	if status.Relay != "" {
+		fmt.Printf("   🔁 Relay: %s\n", status.Relay)
+	}
+	if len(status.Nodes) == 0 {
+		return
+	}
+
+	fmt.Println()
+	fmt.Println("Nodes:")
+	for _, node := range status.Nodes {
+		icon, state := "🔴", node.Status
+		switch {
+		case !node.Approved:
+			icon, state = "⏳", "pending approval"
+		case node.Quarantined:
+			icon, state = "⛔", "quarantined"
+		case node.Status == "online" && node.Draining:
+			icon, state = "🟡", "online, draining"
+		case node.Status == "online":
+			icon = "🟢"
+		}
+
+		addresses := node.MeshIP
+		if node.MeshIP6 != "" {
+			addresses += ", " + node.MeshIP6
+		}
+		line := fmt.Sprintf("   %s %s (%s) - %s", icon, node.Name, addresses, state)
+		if node.Latency > 0 {
+			line += " - " + node.Latency.Round(100*time.Microsecond).String()
+			if node.Loss > 0 {
+				line += fmt.Sprintf(" (%.0f%% loss)", node.Loss*100)
+			}
+		}
+		if health := node.Health; health != nil && node.Status == "online" {
+			line += fmt.Sprintf(" - load %.2f/%d cpus, %.0f%% memory, %d connections", health.Load1, health.CPUs, health.MemoryUsed*100, health.Connections)
+			if !health.SSH {
+				line += ", ssh down"
+			}
+		}
+		if node.Status != "online" && !node.LastSeen.IsZero() {
+			line += fmt.Sprintf(" - last seen %s ago", time.Since(node.LastSeen).Truncate(time.Second))
+		}
+		fmt.Println(line)
+	}
+}
+
+// handleMeshConnect joins the mesh through its coordinator, picks the best
+// node (or the one named), and runs an SSH tunnel to it with a SOCKS5 proxy
+// and an HTTP proxy in front
+func handleMeshConnect() {
+	cfg := meshConfigFile(3)
+	meshConfig := mesh.NodeConfig(cfg.Mesh, cfg.Scoring)
+	meshConfig.SNATRoutes, meshConfig.AcceptRoutes = false, false
+	if coordinatorURL := os.Getenv("MESH_COORDINATOR"); coordinatorURL != "" {
+		meshConfig.CoordinatorURL = coordinatorURL
+	}
+	if token := os.Getenv("MESH_JOIN_TOKEN"); token != "" {
+		meshConfig.JoinToken = token
+	}
+	if pin := os.Getenv("MESH_COORDINATOR_PIN"); pin != "" {
+		meshConfig.CoordinatorPin = pin
+	}
+	server := config.Server{
+		Port:      "22",
+		User:      "root",
+		Transport: config.TransportSSH,
+		Proxy:     config.ProxySOCKS5,
+		LocalPort: 8080,
+		Timeout:   10 * time.Second,
+		Enabled:   true,
+	}
+	httpPort := 8081
+	nodeName, region, configPath := "", cfg.Mesh.Region, ""
+
+	for i := 3; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--wireguard":
+			meshConfig.WireGuard = true
+			continue
+		case "--insecure-skip-verify":
+			server.InsecureSkipVerify = true
+			continue
+		case "--encrypt":
+			meshConfig.Encryption = true
+			continue
+		}
+		if !strings.HasPrefix(os.Args[i], "-") {
+			nodeName = os.Args[i]
+			continue
+		}
+		if i+1 >= len(os.Args) {
+			break
+		}
+		switch os.Args[i] {
+		case "--coordinator", "-c":
+			meshConfig.CoordinatorURL = os.Args[i+1]
+		case "--token", "-t":
+			meshConfig.JoinToken = os.Args[i+1]
+		case "--coordinator-pin":
+			meshConfig.CoordinatorPin = os.Args[i+1]
+		case "--name", "-n":
+			meshConfig.LocalNodeName = os.Args[i+1]
+		case "--region":
+			region = os.Args[i+1]
+		case "--config":
+			configPath = os.Args[i+1]
+		case "--user", "-u":
+			server.User = os.Args[i+1]
+		case "--key", "-k":
+			server.KeyPath = os.Args[i+1]
+		case "--password":
+			server.Password = os.Args[i+1]
+		case "--ssh-port":
+			server.Port = os.Args[i+1]
+		case "--host-key":
+			server.HostKey = os.Args[i+1]
+		case "--socks", "--http":
+			port, err := strconv.Atoi(os.Args[i+1])
+			if err != nil || port < 1 || port > 65535 {
+				log.Fatalf("❌ Invalid port: %s", os.Args[i+1])
+			}
+			if os.Args[i] == "--socks" {
+				server.LocalPort = port
+			} else {
+				httpPort = port
+			}
+		default:
+			continue
+		}
+		i++
+	}
+	if meshConfig.CoordinatorURL == "" || meshConfig.JoinToken == "" || (configPath == "" && server.KeyPath == "" && server.Password == "") {
+		fmt.Println("Usage: tunnel mesh connect [node] --coordinator <url> --token <join-token> (--key <ssh-key> | --password <pass> | --config <config.yaml>) [--user root] [--ssh-port 22] [--host-key <key>] [--insecure-skip-verify] [--socks 8080] [--http 8081] [--region <region>] [--name <node>] [--wireguard] [--encrypt] [--coordinator-pin SHA256:...]")
+		fmt.Println()
+		fmt.Println("The coordinator and token can also come from MESH_COORDINATOR and MESH_JOIN_TOKEN.")
+		fmt.Println("With --config, a server named like the node supplies its SSH settings, and the mesh")
+		fmt.Println("block the coordinator, token, node name and region.")
+		return
+	}
+	if server.LocalPort == httpPort {
+		log.Fatalf("❌ The SOCKS5 and HTTP proxies need different ports")
+	}
+
+	var servers []config.Server
+	if configPath != "" {
+		servers = cfg.Servers
+	}
+
+	meshNet := mesh.NewMeshNetwork(meshConfig)
+	if err := meshNet.Initialize(); err != nil {
+		log.Fatalf("❌ Failed to join mesh: %v", err)
+	}
+	defer func() {
+		if err := meshNet.Stop(); err != nil {
+			log.Printf("⚠️ Failed to leave mesh cleanly: %v", err)
+		}
+	}()
+
+	fmt.Println("🔗 Connecting to best mesh node...")
+	node, err := selectMeshNode(meshNet, nodeName, region)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	defer meshNet.TrackConnection(node.ID)()
+
+	// Reach the node at its mesh IP once WireGuard has a session with it
+	if meshConfig.WireGuard {
+		if err := meshNet.ConnectToNode(node.ID, "wireguard"); err != nil {
+			log.Printf("⚠️  Using %s's public address: %v", node.Name, err)
+		} else {
+			for i := 0; i < 10 && meshNet.NodeAddress(node) != node.MeshIP; i++ {
+				time.Sleep(300 * time.Millisecond)
+			}
+		}
+	}
+
+	// SSH settings from the config's server of the same name win over flags
+	server.Name = node.Name
+	server.Host = meshNet.NodeAddress(node)
+	for _, configured := range servers {
+		if configured.Name == node.Name {
+			server = configured
+			server.Transport, server.Proxy, server.Enabled = config.TransportSSH, config.ProxySOCKS5, true
+			if socks := server.LocalPort; socks == 0 || socks == httpPort {
+				server.LocalPort = 8080
+			}
+		}
+	}
+
+	manager := protocols.NewTunnelManager(&config.Config{
+		Servers:   []config.Server{server},
+		MixedPort: httpPort,
+	})
+	if err := manager.Start(context.Background()); err != nil {
+		fmt.Printf("❌ Failed to start tunnel manager: %v\n", err)
+		return
+	}
+	defer manager.Stop()
+	if failures := manager.StartupReport().Failures(); len(failures) > 0 {
+		for _, failure := range failures {
+			fmt.Printf("❌ %s %s: %s\n", failure.Component, failure.Name, failure.Error)
+		}
+		return
+	}
+	if err := manager.StartTunnel(server.Name); err != nil {
+		fmt.Printf("❌ Failed to start tunnel to %s: %v\n", server.Name, err)
+		return
+	}
+
+	// Wait for the first attempt; the supervisor keeps reconnecting after it
+	deadline := time.Now().Add(server.Timeout + 5*time.Second)
+	for {
+		status := manager.GetStatus()[server.Name]
+		if status != nil && status.Status == string(protocols.StateConnected) {
+			break
+		}
+		if status != nil && status.LastError != "" {
+			fmt.Printf("❌ Failed to connect to %s (%s:%s): %s\n", node.Name, server.Host, server.Port, status.LastError)
+			return
+		}
+		if time.Now().After(deadline) {
+			fmt.Printf("❌ Timed out connecting to %s (%s:%s)\n", node.Name, server.Host, server.Port)
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	fmt.Printf("✅ Connected to %s (%s) via %s:%s\n", node.Name, node.MeshIP, server.Host, server.Port)
+	fmt.Printf("🌐 SOCKS5 proxy: 127.0.0.1:%d\n", server.LocalPort)
+	fmt.Printf("🌐 HTTP proxy: 127.0.0.1:%d\n", httpPort)
+	fmt.Println("💡 Press Ctrl+C to disconnect")
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	<-sigChan
+	fmt.Println("\n👋 Disconnecting...")
+}
+
+// selectMeshNode waits for the first latency samples to the members, then
+// returns the named node or the one load balancing picks, preferring region
+func selectMeshNode(meshNet *mesh.MeshNetwork, name, region string) (*mesh.MeshNode, error) {
+	for deadline := time.Now().Add(15 * time.Second); time.Now().Before(deadline); time.Sleep(500 * time.Millisecond) {
+		measured := false
+		for _, node := range meshNet.Nodes() {
+			if node.Latency > 0 {
+				measured = true
+			}
+		}
+		if measured {
+			break
+		}
+	}
+
+	if name == "" {
+		node, err := meshNet.LoadBalance(region)
+		if err != nil {
+			return nil, fmt.Errorf("no mesh node to connect to: %v", err)
+		}
+		return node, nil
+	}
+	for _, node := range meshNet.Nodes() {
+		if node.Name == name || node.ID == name || node.MeshIP == name || node.MeshIP6 == name {
+			switch {
+			case node.Status != "online":
+				return nil, fmt.Errorf("node %s is %s", node.Name, node.Status)
+			case node.PublicIP == "" && node.MeshIP == "":
+				return nil, fmt.Errorf("node %s has no address", node.Name)
+			}
+			return &node, nil
+		}
+	}
+	return nil, fmt.Errorf("node %s is not a member of the mesh", name)
+}
+
+// handleMeshCoordinator runs the coordinator nodes register with to get a
+// mesh IP and learn each other's keys and endpoints
+func handleMeshCoordinator() {
+	cfg := meshConfigFile(3)
+	listen := ":8443"
+	networkCIDR := cfg.Mesh.NetworkCIDR
+	if networkCIDR == "" {
+		networkCIDR = config.DefaultMeshNetwork
+	}
+	statePath := "data/mesh-coordinator.json"
+	certFile, keyFile := "", ""
+	options := mesh.CoordinatorOptions{
+		AdminKey:    cfg.Mesh.AdminKey,
+		RelaySecret: os.Getenv("MESH_RELAY_SECRET"),
+		ReservedIPs: cfg.Mesh.ReservedIPs,
+	}
+	if adminKey := os.Getenv("MESH_ADMIN_KEY"); adminKey != "" {
+		options.AdminKey = adminKey
+	}
+
+	ha := cfg.Mesh.CoordinatorHA
+	selfSigned := false
+	for i := 3; i < len(os.Args); i++ {
+		if os.Args[i] == "--manual-approval" {
+			options.ManualApproval = true
+			continue
+		}
+		if os.Args[i] == "--tls-self-signed" {
+			selfSigned = true
+			continue
+		}
+		if i+1 >= len(os.Args) {
+			break
+		}
+		switch os.Args[i] {
+		case "--listen", "-l":
+			listen = os.Args[i+1]
+		case "--cidr":
+			networkCIDR = os.Args[i+1]
+		case "--admin-key", "-k":
+			options.AdminKey = os.Args[i+1]
+		case "--state":
+			statePath = os.Args[i+1]
+		case "--tls-cert":
+			certFile = os.Args[i+1]
+		case "--tls-key":
+			keyFile = os.Args[i+1]
+		case "--relay":
+			options.RelayURL = os.Args[i+1]
+		case "--relay-secret":
+			options.RelaySecret = os.Args[i+1]
+		case "--reserve":
+			options.ReservedIPs = append(options.ReservedIPs, strings.Split(os.Args[i+1], ",")...)
+		case "--ha":
+			ha.Enabled, ha.Backend = true, os.Args[i+1]
+		case "--consul":
+			ha.Address = os.Args[i+1]
+		default:
+			continue
+		}
+		i++
+	}
+
+	// A self-signed certificate is kept next to the state and its pin goes
+	// into join tokens, so nodes trust it without a CA
+	var tlsConfig *tls.Config
+	if certFile != "" || selfSigned {
+		if certFile != "" && keyFile == "" {
+			log.Fatalf("❌ --tls-cert needs --tls-key")
+		}
+		cert, pin, err := mesh.CoordinatorCertificate(certFile, keyFile, statePath)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		if certFile == "" {
+			options.TLSPin = pin
+		}
+		fmt.Printf("🔒 TLS certificate pin: %s\n", pin)
+	}
+
+	// Highly available coordinators share their state, in the state file
+	// or in Consul, and only the elected one serves
+	var elector election.Elector
+	if ha.Enabled {
+		elector = meshCoordinatorElector(&ha, statePath)
+		if ha.Backend == "consul" {
+			options.Store = mesh.ConsulStore{Address: ha.Address, Key: ha.Key + "/state", Token: ha.Token}
+		}
+		options.Standby = true
+	}
+
+	coordinator, err := mesh.NewCoordinator(networkCIDR, statePath, options)
+	if err != nil {
+		log.Fatalf("❌ Failed to start coordinator: %v", err)
+	}
+	if options.AdminKey == "" {
+		fmt.Println("🔑 No --admin-key set: tokens and nodes can only be managed from this host")
+	}
+	if options.ManualApproval {
+		fmt.Println("⏳ Manual approval: new nodes wait for tunnel mesh approve <node>")
+	}
+	if options.RelayURL != "" {
+		fmt.Printf("🛰️  Peers without a direct path relay through %s\n", options.RelayURL)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go coordinator.Run(done)
+
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           coordinator.Handler(),
+		ReadHeaderTimeout: 30 * time.Second,
+		TLSConfig:         tlsConfig,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if elector != nil {
+		go runMeshCoordinatorElection(ctx, coordinator, elector, &ha)
+	}
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		<-sigChan
+		cancel()
+		if elector != nil {
+			elector.Resign() // A standby takes over without waiting for the lock to lapse
+		}
+		server.Close()
+	}()
+
+	fmt.Printf("🧭 Mesh coordinator for %s listening on %s\n", networkCIDR, listen)
+	if elector != nil {
+		fmt.Printf("🗳️  Standing by until elected (%s election)\n", ha.Backend)
+	}
+	fmt.Println("💡 Create a join token with: tunnel mesh token create")
+	if tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("❌ Coordinator failed: %v", err)
+	}
+}
+
+// meshCoordinatorElector fills in the defaults of a coordinator's election,
+// keeping the file backend's lock next to the state every coordinator shares
+func meshCoordinatorElector(ha *config.ElectionConfig, statePath string) election.Elector {
+	if ha.Backend == "" {
+		ha.Backend = "file"
+	}
+	if ha.LockFile == "" {
+		ha.LockFile = statePath + ".lock"
+	}
+	if ha.Address == "" {
+		ha.Address = "http://127.0.0.1:8500"
+	}
+	if ha.Key == "" {
+		ha.Key = "ssh-tunnel/mesh-coordinator"
+	}
+	if ha.TTL == 0 {
+		ha.TTL = 10 * time.Second
+	}
+	if ha.RetryInterval == 0 {
+		ha.RetryInterval = time.Second
+	}
+	elector, err := election.New(*ha)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	return elector
+}
+
+// runMeshCoordinatorElection serves nodes while the coordinator is elected,
+// and stands by from when it loses the election until it wins it again
+func runMeshCoordinatorElection(ctx context.Context, coordinator *mesh.Coordinator, elector election.Elector, ha *config.ElectionConfig) {
+	var vip *election.VirtualIP
+	if ha.VirtualIP != nil {
+		var err error
+		if vip, err = election.NewVirtualIP(ha.VirtualIP); err != nil {
+			log.Printf("Virtual IP error: %v", err)
+		}
+	}
+
+	for {
+		if err := elector.Campaign(ctx); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Coordinator election failed: %v", err)
+			}
+			return
+		}
+
+		if err := coordinator.Activate(); err != nil {
+			log.Printf("Failed to load the coordinator state: %v", err)
+			elector.Resign()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(ha.RetryInterval):
+			}
+			continue
+		}
+		if vip != nil {
+			if err := vip.Acquire(); err != nil {
+				log.Printf("Virtual IP error: %v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-elector.Lost():
+		}
+
+		coordinator.Standby()
+		if vip != nil {
+			if err := vip.Release(); err != nil {
+				log.Printf("Virtual IP error: %v", err)
+			}
+		}
+	}
+}
+
+// meshAdminClient returns a client for the coordinator named by --coordinator
+// and --admin-key in os.Args[from:], by MESH_COORDINATOR and
+// MESH_ADMIN_KEY, or by the mesh block of the --config file, and the
+// arguments left over
+func meshAdminClient(from int) (*mesh.AdminClient, []string) {
+	cfg := meshConfigFile(from)
+	coordinatorURL, adminKey, pin := cfg.Mesh.CoordinatorURL, cfg.Mesh.AdminKey, cfg.Mesh.CoordinatorPin
+	if env := os.Getenv("MESH_COORDINATOR"); env != "" {
+		coordinatorURL = env
+	}
+	if env := os.Getenv("MESH_ADMIN_KEY"); env != "" {
+		adminKey = env
+	}
+	if env := os.Getenv("MESH_COORDINATOR_PIN"); env != "" {
+		pin = env
+	}
+	if coordinatorURL == "" {
+		coordinatorURL = "http://127.0.0.1:8443"
+	}
+
+	var rest []string
+	for i := from; i < len(os.Args); i++ {
+		switch {
+		case os.Args[i] == "--config" && i+1 < len(os.Args):
+			i++
+		case (os.Args[i] == "--coordinator" || os.Args[i] == "-c") && i+1 < len(os.Args):
+			coordinatorURL = os.Args[i+1]
+			i++
+		case (os.Args[i] == "--admin-key" || os.Args[i] == "-k") && i+1 < len(os.Args):
+			adminKey = os.Args[i+1]
+			i++
+		case os.Args[i] == "--coordinator-pin" && i+1 < len(os.Args):
+			pin = os.Args[i+1]
+			i++
+		default:
+			rest = append(rest, os.Args[i])
+		}
+	}
+	client := mesh.NewAdminClient(coordinatorURL, adminKey)
+	client.SetPin(pin)
+	return client, rest
+}
+
+// meshConfigFile loads the config file named by --config in os.Args[from:],
+// for its mesh block and scoring weights; without one the config is empty
+func meshConfigFile(from int) *config.Config {
+	for i := from; i+1 < len(os.Args); i++ {
+		if os.Args[i] == "--config" {
+			cfg, err := config.LoadConfig(os.Args[i+1])
+			if err != nil {
+				log.Fatalf("❌ Failed to load config: %v", err)
+			}
+			return cfg
+		}
+	}
+	return &config.Config{}
+}
+
+// handleMeshToken creates, lists and revokes join tokens
+func handleMeshToken() {
+	if len(os.Args) < 4 {
+		fmt.Println("Usage: tunnel mesh token <create|list|revoke> [--coordinator URL] [--admin-key KEY]")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  tunnel mesh token create                          # Single use, expires in 24h")
+		fmt.Println("  tunnel mesh token create --expires 0 --uses 0     # Reusable, never expires")
+		fmt.Println("  tunnel mesh token create --comment \"edge rollout\" --uses 20")
+		fmt.Println("  tunnel mesh token list")
+		fmt.Println("  tunnel mesh token revoke tok-1a2b3c4d5e6f")
+		return
+	}
+
+	client, args := meshAdminClient(4)
+
+	switch os.Args[3] {
+	case "create":
+		req := mesh.CreateTokenRequest{TTL: "24h", MaxUses: 1}
+		for i := 0; i+1 < len(args); i += 2 {
+			switch args[i] {
+			case "--expires":
+				req.TTL = args[i+1]
+			case "--uses":
+				uses, err := strconv.Atoi(args[i+1])
+				if err != nil {
+					log.Fatalf("❌ Invalid --uses %q", args[i+1])
+				}
+				req.MaxUses = uses
+			case "--comment":
+				req.Comment = args[i+1]
+			default:
+				log.Fatalf("❌ Unknown option: %s", args[i])
+			}
+		}
+
+		token, err := client.CreateToken(req)
+		if err != nil {
+			log.Fatalf("❌ Failed to create join token: %v", err)
+		}
+		fmt.Printf("✅ Join token %s created\n", token.ID)
+		fmt.Println(token.Token)
+		fmt.Println()
+		fmt.Printf("Expires: %s  Uses: %s\n", formatTokenExpiry(token.JoinToken), formatTokenUses(token.JoinToken))
+		fmt.Println("Join with: tunnel mesh join <coordinator-url> --token <token>")
+
+	case "list":
+		tokens, err := client.ListTokens()
+		if err != nil {
+			log.Fatalf("❌ Failed to list join tokens: %v", err)
+		}
+		if len(tokens) == 0 {
+			fmt.Println("No join tokens")
+			return
+		}
+		fmt.Printf("%-18s %-10s %-22s %-8s %s\n", "ID", "STATE", "EXPIRES", "USES", "COMMENT")
+		for _, token := range tokens {
+			state := "active"
+			switch {
+			case token.Revoked:
+				state = "revoked"
+			case !token.Expires.IsZero() && time.Now().After(token.Expires):
+				state = "expired"
+			case token.MaxUses > 0 && token.Uses >= token.MaxUses:
+				state = "used"
+			}
+			fmt.Printf("%-18s %-10s %-22s %-8s %s\n", token.ID, state, formatTokenExpiry(token), formatTokenUses(token), token.Comment)
+		}
+
+	case "revoke":
+		if len(args) < 1 {
+			log.Fatalf("❌ Usage: tunnel mesh token revoke <token-id|token>")
+		}
+		id := args[0]
+		if parsed, err := mesh.JoinTokenID(id); err == nil {
+			id = parsed
+		}
+		if err := client.RevokeToken(id); err != nil {
+			log.Fatalf("❌ Failed to revoke join token: %v", err)
+		}
+		fmt.Printf("✅ Join token %s revoked; nodes that joined with it stay until removed\n", id)
+
+	default:
+		fmt.Printf("❌ Unknown token command: %s\n", os.Args[3])
+	}
+}
+
+// handleMeshPolicy adds, lists and removes routing policies
+func handleMeshPolicy() {
+	if len(os.Args) < 4 {
+		fmt.Println("Usage: tunnel mesh policy <add|list|rm> [--coordinator URL] [--admin-key KEY]")
+		fmt.Println()
+		fmt.Println("Selectors: tag=<tag>, region=<region>, name=<node>, id=<node-id>, comma-separated to")
+		fmt.Println("combine, or * for every node. The first policy matching a node and subnet applies.")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  tunnel mesh policy add --from tag=eu --via region=de")
+		fmt.Println("  tunnel mesh policy add --from region=us --via name=gw-1 --subnet 10.20.0.0/16 --strict")
+		fmt.Println("  tunnel mesh policy list")
+		fmt.Println("  tunnel mesh policy rm pol-1a2b3c4d")
+		return
+	}
+
+	client, args := meshAdminClient(4)
+
+	switch os.Args[3] {
+	case "add":
+		var policy mesh.RoutingPolicy
+		for i := 0; i < len(args); i++ {
+			if args[i] == "--strict" {
+				policy.Strict = true
+				continue
+			}
+			if i+1 >= len(args) {
+				log.Fatalf("❌ Missing value for %s", args[i])
+			}
+			switch args[i] {
+			case "--from":
+				policy.From = args[i+1]
+			case "--via":
+				policy.Via = args[i+1]
+			case "--subnet":
+				policy.Subnet = args[i+1]
+			case "--comment":
+				policy.Comment = args[i+1]
+			default:
+				log.Fatalf("❌ Unknown option: %s", args[i])
+			}
+			i++
+		}
+		if policy.From == "" || policy.Via == "" {
+			log.Fatalf("❌ Usage: tunnel mesh policy add --from <selector> --via <selector> [--subnet CIDR] [--strict] [--comment text]")
+		}
+
+		added, err := client.AddPolicy(policy)
+		if err != nil {
+			log.Fatalf("❌ Failed to add routing policy: %v", err)
+		}
+		fmt.Printf("✅ Routing policy %s added: %s\n", added.ID, added)
+
+	case "list":
+		policies, err := client.ListPolicies()
+		if err != nil {
+			log.Fatalf("❌ Failed to list routing policies: %v", err)
+		}
+		if len(policies) == 0 {
+			fmt.Println("No routing policies")
+			return
+		}
+		fmt.Printf("%-14s %-20s %-20s %-18s %-7s %s\n", "ID", "FROM", "VIA", "SUBNET", "STRICT", "COMMENT")
+		for _, policy := range policies {
+			subnet := policy.Subnet
+			if subnet == "" {
+				subnet = "*"
+			}
+			strict := "no"
+			if policy.Strict {
+				strict = "yes"
+			}
+			fmt.Printf("%-14s %-20s %-20s %-18s %-7s %s\n", policy.ID, policy.From, policy.Via, subnet, strict, policy.Comment)
+		}
+
+	case "rm", "remove":
+		if len(args) < 1 {
+			log.Fatalf("❌ Usage: tunnel mesh policy rm <policy-id>")
+		}
+		if err := client.RemovePolicy(args[0]); err != nil {
+			log.Fatalf("❌ Failed to remove routing policy: %v", err)
+		}
+		fmt.Printf("✅ Routing policy %s removed\n", args[0])
+
+	default:
+		fmt.Printf("❌ Unknown policy command: %s\n", os.Args[3])
+	}
+}
+
+// handleMeshExpose advertises a service on a node, this host's unless
+// --node names another
+func handleMeshExpose() {
+	client, args := meshAdminClient(3)
+	if len(args) < 2 || strings.HasPrefix(args[0], "-") {
+		fmt.Println("Usage: tunnel mesh expose <name> <port>[/udp] [--node <node>] [--description text] [--coordinator URL] [--admin-key KEY]")
+		fmt.Println("Example: tunnel mesh expose postgres 5432 --description \"orders database\"")
+		return
+	}
+
+	service := mesh.Service{Name: args[0], Node: meshLocalNodeName()}
+	port, protocol, _ := strings.Cut(args[1], "/")
+	var err error
+	if service.Port, err = strconv.Atoi(port); err != nil {
+		log.Fatalf("❌ Invalid port: %s", args[1])
+	}
+	service.Protocol = protocol
+	for i := 2; i+1 < len(args); i += 2 {
+		switch args[i] {
+		case "--node", "-n":
+			service.Node = args[i+1]
+		case "--description":
+			service.Description = args[i+1]
+		default:
+			log.Fatalf("❌ Unknown option: %s", args[i])
+		}
+	}
+
+	exposed, err := client.ExposeService(service)
+	if err != nil {
+		log.Fatalf("❌ Failed to expose %s: %v", service.Name, err)
+	}
+	fmt.Printf("✅ %s exposed on %s at %s/%s\n", exposed.Name, exposed.Node, exposed.Address(), exposed.Protocol)
+	fmt.Printf("💡 Reach it from another node with: tunnel mesh forward %s\n", exposed.Name)
+}
+
+// handleMeshUnexpose removes a service
+func handleMeshUnexpose() {
+	client, args := meshAdminClient(3)
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		fmt.Println("Usage: tunnel mesh unexpose <name> [--node <node>] [--coordinator URL] [--admin-key KEY]")
+		return
+	}
+
+	node := ""
+	for i := 1; i+1 < len(args); i += 2 {
+		if args[i] == "--node" || args[i] == "-n" {
+			node = args[i+1]
+		}
+	}
+	if err := client.RemoveService(args[0], node); err != nil {
+		log.Fatalf("❌ Failed to remove %s: %v", args[0], err)
+	}
+	fmt.Printf("✅ Service %s removed\n", args[0])
+}
+
+// handleMeshServices lists the services nodes expose
+func handleMeshServices() {
+	client, args := meshAdminClient(3)
+	name, jsonOutput := "", false
+	for _, arg := range args {
+		if arg == "--json" {
+			jsonOutput = true
+		} else if !strings.HasPrefix(arg, "-") {
+			name = arg
+		}
+	}
+
+	services, err := client.ListServices(name)
+	if err != nil {
+		log.Fatalf("❌ Failed to list services: %v", err)
+	}
+	if jsonOutput {
+		data, _ := json.MarshalIndent(services, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	if len(services) == 0 {
+		fmt.Println("No mesh services")
+		return
+	}
+	fmt.Printf("%-16s %-20s %-22s %-9s %s\n", "NAME", "NODE", "ADDRESS", "STATE", "DESCRIPTION")
+	for _, service := range services {
+		state, address := "offline", "-"
+		if service.Online {
+			state = "online"
+		}
+		if service.MeshIP != "" {
+			address = service.Address() + "/" + service.Protocol
+		}
+		fmt.Printf("%-16s %-20s %-22s %-9s %s\n", service.Name, service.Node, address, state, service.Description)
+	}
+}
+
+// handleMeshForward listens on a local port and forwards each connection
+// to an online node exposing the service, looked up by name with the
+// coordinator as it arrives. This host reaches the node's mesh IP through
+// its own mesh interface, so it must be a node with the data plane up.
+func handleMeshForward() {
+	client, args := meshAdminClient(3)
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		fmt.Println("Usage: tunnel mesh forward <service> [--local 127.0.0.1:<port>] [--node <node>] [--coordinator URL] [--admin-key KEY]")
+		fmt.Println("Example: tunnel mesh forward postgres --local 127.0.0.1:15432")
+		return
+	}
+
+	name, local, node := args[0], "", ""
+	for i := 1; i+1 < len(args); i += 2 {
+		switch args[i] {
+		case "--local", "-l":
+			local = args[i+1]
+		case "--node", "-n":
+			node = args[i+1]
+		default:
+			log.Fatalf("❌ Unknown option: %s", args[i])
+		}
+	}
+
+	resolve := func() (mesh.Service, error) {
+		services, err := client.ListServices(name)
+		if err != nil {
+			return mesh.Service{}, err
+		}
+		if len(services) == 0 {
+			return mesh.Service{}, fmt.Errorf("no node exposes %s", name)
+		}
+		for _, service := range services {
+			if service.Protocol != "tcp" {
+				return mesh.Service{}, fmt.Errorf("%s is a %s service; only tcp services are forwarded", name, service.Protocol)
+			}
+			if service.Online && (node == "" || service.Node == node || service.NodeID == node) {
+				return service, nil
+			}
+		}
+		return mesh.Service{}, fmt.Errorf("no online node exposes %s", name)
+	}
+	service, err := resolve()
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if local == "" {
+		local = net.JoinHostPort("127.0.0.1", strconv.Itoa(service.Port))
+	}
+
+	listener, err := net.Listen("tcp", local)
+	if err != nil {
+		log.Fatalf("❌ Failed to listen on %s: %v", local, err)
+	}
+	fmt.Printf("🔀 Forwarding %s to %s (%s on %s)\n", listener.Addr(), name, service.Address(), service.Node)
+	fmt.Println("Press Ctrl+C to stop")
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		go func() {
+			defer conn.Close()
+			service, err := resolve()
+			if err != nil {
+				log.Printf("⚠️  %v", err)
+				return
+			}
+			upstream, err := net.DialTimeout("tcp", service.Address(), 10*time.Second)
+			if err != nil {
+				log.Printf("⚠️  Failed to reach %s on %s: %v", name, service.Node, err)
+				return
+			}
+			defer upstream.Close()
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+// meshLocalNodeName returns the name this host joins the mesh with by
+// default: the --config file's mesh node_name, or the hostname
+func meshLocalNodeName() string {
+	if name := meshConfigFile(3).Mesh.NodeName; name != "" {
+		return name
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// handleMeshConfig creates sync keys and pushes and shows the config
+// sections nodes take from the coordinator, sealed so the coordinator
+// cannot read them
+func handleMeshConfig() {
+	if len(os.Args) < 4 {
+		fmt.Println("Usage: tunnel mesh config <keygen|push|show> [--coordinator URL] [--admin-key KEY]")
+		fmt.Println()
+		fmt.Println("push seals sections of a config file (servers, routing, auth_tokens; all by default)")
+		fmt.Println("with the sync key and hands them to the coordinator, which pushes them to every node.")
+		fmt.Println("Servers that joined the mesh with the same mesh.sync_key apply them. The key comes from")
+		fmt.Println("--sync-key, MESH_SYNC_KEY or mesh.sync_key.")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  tunnel mesh config keygen")
+		fmt.Println("  tunnel mesh config push --config fleet.yaml --sections servers,routing")
+		fmt.Println("  tunnel mesh config show --json   # Secrets included")
+		return
+	}
+	if os.Args[3] == "keygen" {
+		key, err := mesh.GenerateSyncKey()
+		if err != nil {
+			log.Fatalf("❌ Failed to create a sync key: %v", err)
+		}
+		fmt.Println(key)
+		fmt.Println("💡 Set it as mesh.sync_key on every node that takes the config, and keep it from the coordinator")
+		return
+	}
+
+	cfg := meshConfigFile(4)
+	client, args := meshAdminClient(4)
+	syncKey, sectionList, jsonOutput := cfg.Mesh.SyncKey, "", false
+	if env := os.Getenv("MESH_SYNC_KEY"); env != "" {
+		syncKey = env
+	}
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--sync-key" && i+1 < len(args):
+			syncKey = args[i+1]
+			i++
+		case args[i] == "--sections" && i+1 < len(args):
+			sectionList = args[i+1]
+			i++
+		case args[i] == "--json":
+			jsonOutput = true
+		default:
+			log.Fatalf("❌ Unknown option: %s", args[i])
+		}
+	}
+
+	switch os.Args[3] {
+	case "push":
+		if syncKey == "" {
+			log.Fatalf("❌ A sync key is required: --sync-key, MESH_SYNC_KEY or mesh.sync_key")
+		}
+		if len(cfg.Servers) == 0 && cfg.Version == "" {
+			log.Fatalf("❌ Usage: tunnel mesh config push --config <config.yaml> [--sections servers,routing,auth_tokens]")
+		}
+		sections, err := mesh.ParseSyncSections(sectionList)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		pushed, err := client.PushConfig(syncKey, sections, mesh.FromConfig(cfg, sections))
+		if err != nil {
+			log.Fatalf("❌ Failed to push the config: %v", err)
+		}
+		fmt.Printf("✅ Config %d pushed with %s\n", pushed.Version, strings.Join(pushed.Sections, ", "))
+
+	case "show":
+		synced, err := client.SyncedConfig()
+		if err != nil {
+			log.Fatalf("❌ Failed to get the config: %v", err)
+		}
+		if synced == nil {
+			fmt.Println("No config has been pushed")
+			return
+		}
+		fmt.Printf("📦 Config %d with %s, pushed %s\n", synced.Version, strings.Join(synced.Sections, ", "), synced.Updated.Format(time.RFC3339))
+		if syncKey == "" {
+			fmt.Println("💡 Pass the sync key to see what it holds")
+			return
+		}
+		sections, err := synced.Open(syncKey)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		if jsonOutput {
+			data, _ := json.MarshalIndent(sections, "", "  ")
+			fmt.Println(string(data))
+			return
+		}
+		fmt.Printf("   %d servers, %d routing rules, %d API tokens\n", len(sections.Servers), len(sections.Routing), len(sections.AuthTokens))
+
+	default:
+		fmt.Printf("❌ Unknown mesh config command: %s\n", os.Args[3])
+	}
+}
+
+// handleMeshACL adds, lists and removes the ACL rules nodes enforce on
+// the traffic their peers send them
+func handleMeshACL() {
+	if len(os.Args) < 4 {
+		fmt.Println("Usage: tunnel mesh acl <add|list|rm> [--coordinator URL] [--admin-key KEY]")
+		fmt.Println()
+		fmt.Println("Without rules every node reaches every other. With rules, the first one matching")
+		fmt.Println("the sender, the receiver and the packet decides, and anything else is dropped;")
+		fmt.Println("replies to what a node sent get back in. Selectors are as for routing policies.")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  tunnel mesh acl add --from tag=web --to tag=db --ports tcp/5432")
+		fmt.Println("  tunnel mesh acl add --from region=eu --to '*' --ports tcp/22,icmp --comment ops")
+		fmt.Println("  tunnel mesh acl add --from tag=guest --to '*' --deny")
+		fmt.Println("  tunnel mesh acl list")
+		fmt.Println("  tunnel mesh acl rm acl-1a2b3c4d")
+		return
+	}
+
+	client, args := meshAdminClient(4)
+
+	switch os.Args[3] {
+	case "add":
+		rule := mesh.ACLRule{Action: mesh.ACLAllow}
+		for i := 0; i < len(args); i++ {
+			if args[i] == "--deny" {
+				rule.Action = mesh.ACLDeny
+				continue
+			}
+			if i+1 >= len(args) {
+				log.Fatalf("❌ Missing value for %s", args[i])
+			}
+			switch args[i] {
+			case "--from":
+				rule.From = args[i+1]
+			case "--to":
+				rule.To = args[i+1]
+			case "--ports":
+				rule.Ports = strings.Split(args[i+1], ",")
+			case "--comment":
+				rule.Comment = args[i+1]
+			default:
+				log.Fatalf("❌ Unknown option: %s", args[i])
+			}
+			i++
+		}
+		if rule.From == "" || rule.To == "" {
+			log.Fatalf("❌ Usage: tunnel mesh acl add --from <selector> --to <selector> [--ports tcp/22,udp/53,icmp] [--deny] [--comment text]")
+		}
+
+		added, err := client.AddACL(rule)
+		if err != nil {
+			log.Fatalf("❌ Failed to add ACL rule: %v", err)
+		}
+		fmt.Printf("✅ ACL rule %s added: %s\n", added.ID, added)
+
+	case "list":
+		acls, err := client.ListACLs()
+		if err != nil {
+			log.Fatalf("❌ Failed to list ACL rules: %v", err)
+		}
+		if len(acls) == 0 {
+			fmt.Println("No ACL rules: every node reaches every other")
+			return
+		}
+		fmt.Printf("%-14s %-6s %-20s %-20s %-20s %s\n", "ID", "ACTION", "FROM", "TO", "PORTS", "COMMENT")
+		for _, rule := range acls {
+			ports := strings.Join(rule.Ports, ",")
+			if ports == "" {
+				ports = "*"
+			}
+			fmt.Printf("%-14s %-6s %-20s %-20s %-20s %s\n", rule.ID, rule.Action, rule.From, rule.To, ports, rule.Comment)
+		}
+
+	case "rm", "remove":
+		if len(args) < 1 {
+			log.Fatalf("❌ Usage: tunnel mesh acl rm <rule-id>")
+		}
+		if err := client.RemoveACL(args[0]); err != nil {
+			log.Fatalf("❌ Failed to remove ACL rule: %v", err)
+		}
+		fmt.Printf("✅ ACL rule %s removed\n", args[0])
+
+	default:
+		fmt.Printf("❌ Unknown acl command: %s\n", os.Args[3])
+	}
+}
+
+func formatTokenExpiry(token mesh.JoinToken) string {
+	if token.Expires.IsZero() {
+		return "never"
+	}
+	return token.Expires.Local().Format("2006-01-02 15:04:05")
+}
+
+func formatTokenUses(token mesh.JoinToken) string {
+	if token.MaxUses == 0 {
+		return fmt.Sprintf("%d/∞", token.Uses)
+	}
+	return fmt.Sprintf("%d/%d", token.Uses, token.MaxUses)
+}
+
+// handleMeshNodes lists the nodes registered with the coordinator
+func handleMeshNodes() {
+	client, _ := meshAdminClient(3)
+
+	nodes, err := client.ListNodes()
+	if err != nil {
+		log.Fatalf("❌ Failed to list mesh nodes: %v", err)
+	}
+	if len(nodes) == 0 {
+		fmt.Println("No mesh nodes")
+		return
+	}
+	fmt.Printf("%-20s %-12s %-12s %-24s %-18s %-8s %s\n", "NAME", "MESH IP", "STATUS", "ENDPOINT", "TOKEN", "KEY AGE", "ROUTES")
+	for _, node := range nodes {
+		status := node.Status
+		switch {
+		case !node.Approved:
+			status = "pending"
+		case node.Quarantined:
+			status = "quarantined"
+		case node.Draining:
+			status = "draining"
+		}
+		keyAge := "-"
+		if !node.KeyRotated.IsZero() {
+			keyAge = time.Since(node.KeyRotated).Truncate(time.Minute).String()
+		}
+		fmt.Printf("%-20s %-12s %-12s %-24s %-18s %-8s %s\n", node.Name, node.MeshIP, status, node.Endpoint, node.TokenID, keyAge, strings.Join(node.Routes, ","))
+	}
+}
+
+// handleMeshLatency prints the coordinator's latency matrix: each row is
+// what that node measured to the others
+func handleMeshLatency() {
+	client, _ := meshAdminClient(3)
+
+	matrix, err := client.LatencyMatrix()
+	if err != nil {
+		log.Fatalf("❌ Failed to get the latency matrix: %v", err)
+	}
+	if len(matrix.Nodes) == 0 {
+		fmt.Println("No mesh nodes")
+		return
+	}
+
+	fmt.Printf("%-16s", "FROM \\ TO")
+	for _, to := range matrix.Nodes {
+		fmt.Printf(" %12.12s", to.Name)
+	}
+	fmt.Println()
+	relayed := false
+	for _, from := range matrix.Nodes {
+		fmt.Printf("%-16.16s", from.Name)
+		row := matrix.Latency[from.ID]
+		for _, to := range matrix.Nodes {
+			cell := "-"
+			if stats, ok := row[to.ID]; ok && from.ID != to.ID {
+				cell = "lost"
+				if stats.RTT > 0 {
+					cell = stats.RTT.Round(100 * time.Microsecond).String()
+					if stats.Loss > 0 {
+						cell += fmt.Sprintf(" %.0f%%", stats.Loss*100)
+					}
+				}
+				if stats.Path == mesh.PathRelay {
+					cell += "*"
+					relayed = true
+				}
+			}
+			fmt.Printf(" %12s", cell)
+		}
+		fmt.Println()
+	}
+	if relayed {
+		fmt.Println("\n* over the relay")
+	}
+}
+
+// handleMeshEvents prints mesh events as they happen, resuming after the
+// coordinator restarts or the connection drops
+func handleMeshEvents() {
+	client, args := meshAdminClient(3)
+
+	var since uint64
+	var types []string
+	asJSON := false
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--since" && i+1 < len(args):
+			n, err := strconv.ParseUint(args[i+1], 10, 64)
+			if err != nil {
+				log.Fatalf("❌ Invalid --since: %s", args[i+1])
+			}
+			since = n
+			i++
+		case args[i] == "--types" && i+1 < len(args):
+			types = strings.Split(args[i+1], ",")
+			i++
+		case args[i] == "--json":
+			asJSON = true
+		default:
+			fmt.Println("Usage: tunnel mesh events [--since ID] [--types node,route_changed,failover,path_changed] [--json] [--coordinator URL] [--admin-key KEY]")
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		cancel()
+	}()
+
+	show := func(event mesh.MeshEvent) {
+		if asJSON {
+			data, _ := json.Marshal(event)
+			fmt.Println(string(data))
+			return
+		}
+		fmt.Printf("%s  %-16s %s\n", event.Time.Local().Format("2006-01-02 15:04:05"), event.Type, event)
+	}
+	for {
+		last, err := client.FollowEvents(ctx, since, types, show)
+		if ctx.Err() != nil {
+			return
+		}
+		if mesh.CoordinatorStatus(err) != 0 {
+			log.Fatalf("❌ Failed to follow mesh events: %v", err)
+		}
+		since = last
+		log.Printf("⚠️  Mesh event stream lost: %v; reconnecting", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// handleMeshLabel edits a node's region, tags, labels and capabilities
+func handleMeshLabel() {
+	client, args := meshAdminClient(3)
+
+	var node string
+	var update mesh.NodeMetadataUpdate
+	set := func(key, value string) {
+		if update.Labels == nil {
+			update.Labels = make(map[string]string)
+		}
+		update.Labels[key] = value
+	}
+	capability := func(name string, on bool) {
+		if update.Capabilities == nil {
+			update.Capabilities = make(map[string]bool)
+		}
+		update.Capabilities[name] = on
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			switch key, value, ok := strings.Cut(arg, "="); {
+			case ok:
+				set(key, value)
+			case node != "" && strings.HasSuffix(arg, "-"):
+				set(strings.TrimSuffix(arg, "-"), "")
+			case node == "":
+				node = arg
+			default:
+				log.Fatalf("❌ Unexpected argument: %s", arg)
+			}
+			continue
+		}
+		if i+1 >= len(args) {
+			log.Fatalf("❌ Missing value for %s", arg)
+		}
+		value := args[i+1]
+		i++
+		switch arg {
+		case "--region":
+			update.Region = &value
+		case "--tags":
+			update.Tags = []string{}
+			if value != "" {
+				update.Tags = strings.Split(value, ",")
+			}
+		case "--add-tag":
+			update.AddTags = append(update.AddTags, strings.Split(value, ",")...)
+		case "--remove-tag":
+			update.RemoveTags = append(update.RemoveTags, strings.Split(value, ",")...)
+		case "--capability":
+			capability(value, true)
+		case "--no-capability":
+			capability(value, false)
+		default:
+			log.Fatalf("❌ Unknown option: %s", arg)
+		}
+	}
+	if node == "" {
+		fmt.Println("Usage: tunnel mesh label <node> [key=value ...] [key- ...] [--region R] [--tags a,b] [--add-tag t] [--remove-tag t] [--capability name] [--no-capability name] [--coordinator URL] [--admin-key KEY]")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  tunnel mesh label edge-1 --region de --add-tag eu")
+		fmt.Println("  tunnel mesh label edge-1 rack=r12 owner=netops")
+		fmt.Println("  tunnel mesh label edge-1 owner- --capability exit")
+		return
+	}
+
+	info, err := client.UpdateNode(node, update)
+	if err != nil {
+		log.Fatalf("❌ Failed to update node %s: %v", node, err)
+	}
+	fmt.Printf("✅ Node %s updated\n", info.Name)
+	region := info.Region
+	if region == "" {
+		region = "-"
+	}
+	labels := make([]string, 0, len(info.Labels))
+	for key, value := range info.Labels {
+		labels = append(labels, key+"="+value)
+	}
+	sort.Strings(labels)
+	capabilities := make([]string, 0, len(info.Capabilities))
+	for name := range info.Capabilities {
+		capabilities = append(capabilities, name)
+	}
+	sort.Strings(capabilities)
+	fmt.Printf("   Region:       %s\n", region)
+	fmt.Printf("   Tags:         %s\n", strings.Join(info.Tags, ","))
+	fmt.Printf("   Labels:       %s\n", strings.Join(labels, ","))
+	fmt.Printf("   Capabilities: %s\n", strings.Join(capabilities, ","))
+}
+
+// handleMeshNodeAction approves, removes, drains or quarantines a node by
+// name or ID
+func handleMeshNodeAction(action string) {
+	client, args := meshAdminClient(3)
+
+	var node string
+	undo, revokeToken := false, false
+	for _, arg := range args {
+		switch arg {
+		case "--undo", "--release":
+			undo = true
+		case "--revoke-token":
+			revokeToken = true
+		default:
+			node = arg
+		}
+	}
+	if node == "" {
+		switch action {
+		case "drain":
+			fmt.Println("Usage: tunnel mesh drain <node> [--undo] [--coordinator URL] [--admin-key KEY]")
+		case "quarantine":
+			fmt.Println("Usage: tunnel mesh quarantine <node> [--release] [--coordinator URL] [--admin-key KEY]")
+		case "remove", "rm":
+			fmt.Println("Usage: tunnel mesh rm <node> [--revoke-token] [--coordinator URL] [--admin-key KEY]")
+		default:
+			fmt.Printf("Usage: tunnel mesh %s <node> [--coordinator URL] [--admin-key KEY]\n", action)
+		}
+		return
+	}
+
+	switch action {
+	case "approve":
+		if err := client.ApproveNode(node); err != nil {
+			log.Fatalf("❌ Failed to approve %s: %v", node, err)
+		}
+		fmt.Printf("✅ Node %s approved\n", node)
+	case "drain":
+		info, err := client.DrainNode(node, !undo)
+		if err != nil {
+			log.Fatalf("❌ Failed to drain %s: %v", node, err)
+		}
+		if undo {
+			fmt.Printf("✅ Node %s (%s) is back in service\n", info.Name, info.MeshIP)
+		} else {
+			fmt.Printf("🚧 Node %s (%s) is draining; peers pick other nodes for new traffic and subnets it shares\n", info.Name, info.MeshIP)
+		}
+	case "quarantine":
+		info, err := client.QuarantineNode(node, !undo)
+		if err != nil {
+			log.Fatalf("❌ Failed to quarantine %s: %v", node, err)
+		}
+		if undo {
+			fmt.Printf("✅ Node %s (%s) released from quarantine\n", info.Name, info.MeshIP)
+		} else {
+			fmt.Printf("🔒 Node %s (%s) quarantined; it keeps its mesh IP but peers drop it\n", info.Name, info.MeshIP)
+		}
+	default:
+		if err := client.RemoveNode(node, revokeToken); err != nil {
+			log.Fatalf("❌ Failed to remove %s: %v", node, err)
+		}
+		if revokeToken {
+			fmt.Printf("✅ Node %s removed, its key and join token revoked\n", node)
+		} else {
+			fmt.Printf("✅ Node %s removed and its key revoked\n", node)
+		}
+	}
+}
+
+// meshJoinConfig builds the node configuration of tunnel mesh join and
+// tunnel mesh agent from the --config file's mesh block, MESH_COORDINATOR
+// and MESH_JOIN_TOKEN, and the flags, which take precedence in that order.
+// Without arguments it prints the usage and exits.
+func meshJoinConfig(command string) *mesh.MeshConfig {
+	if len(os.Args) < 4 {
+		fmt.Printf("Usage: tunnel mesh %s <coordinator-url | --coordinator URL> --token <join-token> [--config config.yaml] [--name <node>] [--endpoint host:port] [--region <region>] [--tags eu,prod] [--stun host:port] [--interface mesh0] [--mtu 1420] [--advertise-routes 192.168.1.0/24,...] [--no-snat] [--no-accept-routes] [--no-nat] [--no-relay] [--no-wireguard] [--rotate-keys 24h] [--rotation-overlap 10m] [--ssh-addr 127.0.0.1:22] [--encrypt] [--coordinator-pin SHA256:...]\n", command)
+		os.Exit(0)
+	}
+
+	cfg := meshConfigFile(3)
+	meshConfig := mesh.NodeConfig(cfg.Mesh, cfg.Scoring)
+	meshConfig.WireGuard = true
+	if token := os.Getenv("MESH_JOIN_TOKEN"); token != "" {
+		meshConfig.JoinToken = token
+	}
+	if coordinatorURL := os.Getenv("MESH_COORDINATOR"); coordinatorURL != "" {
+		meshConfig.CoordinatorURL = coordinatorURL
+	}
+	if pin := os.Getenv("MESH_COORDINATOR_PIN"); pin != "" {
+		meshConfig.CoordinatorPin = pin
+	}
+	start := 3
+	if !strings.HasPrefix(os.Args[3], "-") {
+		meshConfig.CoordinatorURL = os.Args[3]
+		start = 4
+	}
+
+	for i := start; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--no-snat":
+			meshConfig.SNATRoutes = false
+			continue
+		case "--no-accept-routes":
+			meshConfig.AcceptRoutes = false
+			continue
+		case "--no-nat":
+			meshConfig.NATTraversal = false
+			continue
+		case "--no-relay":
+			meshConfig.Relay = false
+			continue
+		case "--no-wireguard":
+			meshConfig.WireGuard = false
+			continue
+		case "--encrypt":
+			meshConfig.Encryption = true
+			continue
+		}
+		if i+1 >= len(os.Args) {
+			break
+		}
+		switch os.Args[i] {
+		case "--coordinator", "-c":
+			meshConfig.CoordinatorURL = os.Args[i+1]
+		case "--coordinator-pin":
+			meshConfig.CoordinatorPin = os.Args[i+1]
+		case "--name", "-n":
+			meshConfig.LocalNodeName = os.Args[i+1]
+		case "--ssh-addr":
+			meshConfig.SSHAddr = os.Args[i+1]
+		case "--token", "-t":
+			meshConfig.JoinToken = os.Args[i+1]
+		case "--endpoint", "-e":
+			meshConfig.Endpoint = os.Args[i+1]
+		case "--region":
+			meshConfig.Regions = []string{os.Args[i+1]}
+		case "--tags":
+			meshConfig.Tags = strings.Split(os.Args[i+1], ",")
+		case "--stun":
+			meshConfig.STUNServers = append(meshConfig.STUNServers, os.Args[i+1])
+		case "--interface", "-i":
+			meshConfig.Interface = os.Args[i+1]
+		case "--mtu":
+			mtu, err := strconv.Atoi(os.Args[i+1])
+			if err != nil || mtu < 1280 || mtu > 65535 {
+				log.Fatalf("❌ Invalid MTU: %s", os.Args[i+1])
+			}
+			meshConfig.MTU = mtu
+		case "--rotate-keys":
+			interval, err := time.ParseDuration(os.Args[i+1])
+			if err != nil || interval < time.Minute {
+				log.Fatalf("❌ Invalid key rotation interval (at least 1m): %s", os.Args[i+1])
+			}
+			meshConfig.KeyRotationInterval = interval
+		case "--rotation-overlap":
+			overlap, err := time.ParseDuration(os.Args[i+1])
+			if err != nil || overlap <= 0 {
+				log.Fatalf("❌ Invalid key rotation overlap: %s", os.Args[i+1])
+			}
+			meshConfig.KeyRotationOverlap = overlap
+		case "--advertise-routes", "-r":
+			for _, route := range strings.Split(os.Args[i+1], ",") {
+				if route = strings.TrimSpace(route); route != "" {
+					meshConfig.Routes = append(meshConfig.Routes, route)
+				}
+			}
+		default:
+			continue
+		}
+		i++
+	}
+	if meshConfig.CoordinatorURL == "" {
+		log.Fatalf("❌ A coordinator URL is required, as an argument or the config's mesh coordinator_url")
+	}
+	if len(meshConfig.Routes) > 0 && !meshConfig.WireGuard {
+		log.Fatalf("❌ --advertise-routes needs the WireGuard data plane")
+	}
+	return meshConfig
+}
+
+// handleMeshJoin joins a mesh through its coordinator and follows peer
+// updates until interrupted, then leaves
+func handleMeshJoin() {
+	meshConfig := meshJoinConfig("join")
+
+	meshNet := mesh.NewMeshNetwork(meshConfig)
+	if err := meshNet.Initialize(); err != nil {
+		log.Fatalf("❌ Failed to join mesh: %v", err)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	<-sigChan
+
+	fmt.Println("\n👋 Leaving mesh...")
+	if err := meshNet.Stop(); err != nil {
+		log.Printf("⚠️ Failed to leave mesh cleanly: %v", err)
+	}
+}
+
+// handleMeshAgent runs a node as a service: like join, but it keeps trying
+// until the coordinator lets it in, and reports the host's health with its
+// heartbeats. Routes and ACL rules the coordinator pushes apply as on any
+// node.
+func handleMeshAgent() {
+	meshConfig := meshJoinConfig("agent")
+	meshConfig.ReportHealth = true
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	var meshNet *mesh.MeshNetwork
+	for delay := time.Second; ; delay = min(delay*2, time.Minute) {
+		meshNet = mesh.NewMeshNetwork(meshConfig)
+		err := meshNet.Initialize()
+		if err == nil {
+			break
+		}
+		log.Printf("⚠️  Failed to join mesh, retrying in %v: %v", delay, err)
+		select {
+		case <-sigChan:
+			return
+		case <-time.After(delay):
+		}
+	}
+	fmt.Println("🤖 Mesh agent running; Ctrl+C leaves the mesh")
+
+	<-sigChan
+	fmt.Println("\n👋 Leaving mesh...")
+	if err := meshNet.Stop(); err != nil {
+		log.Printf("⚠️ Failed to leave mesh cleanly: %v", err)
+	}
+}
+
+// handleMeshRelay runs a relay node: it passes packets between mesh peers
+// that cannot reach each other directly, admitting nodes with the relay
+// tokens the coordinator signs with the shared secret
+func handleMeshRelay() {
+	listen := ":8444"
+	secret := os.Getenv("MESH_RELAY_SECRET")
+	certFile, keyFile := "", ""
+
+	for i := 3; i+1 < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--listen", "-l":
+			listen = os.Args[i+1]
+		case "--secret", "-s":
+			secret = os.Args[i+1]
+		case "--tls-cert":
+			certFile = os.Args[i+1]
+		case "--tls-key":
+			keyFile = os.Args[i+1]
+		default:
+			continue
+		}
+		i++
+	}
+	if secret == "" {
+		fmt.Println("Usage: tunnel mesh relay --secret <secret> [--listen :8444] [--tls-cert cert.pem --tls-key key.pem]")
+		fmt.Println("The coordinator needs the same secret: tunnel mesh coordinator --relay <url> --relay-secret <secret>")
+		return
+	}
+
+	relay := mesh.NewRelay(mesh.RelayTokenAuth(secret))
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           relay.Handler(),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		<-sigChan
+		server.Close()
+	}()
+
+	fmt.Printf("🛰️  Mesh relay listening on %s\n", listen)
+	var err error
+	if certFile != "" {
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("❌ Relay failed: %v", err)
+	}
+}
+
+// showHelp displays help information
+func showHelp() {
+	fmt.Println("🚀 SSH Tunnel Manager")
+	fmt.Println("=====================")
+	fmt.Println()
+	fmt.Println("SIMPLE COMMANDS:")
+	fmt.Println()
+	fmt.Println("🔍 Quick Setup:")
+	fmt.Println("  tunnel quick <ip> <user> <password>     # Auto-discover & setup")
+	fmt.Println("  tunnel quick 1.2.3.4 root mypass        # Example")
+	fmt.Println("  tunnel quick 1.2.3.4 ubuntu ~/.ssh/key  # With SSH key")
+	fmt.Println("  tunnel quick 1.2.3.4 root pass --setup  # Install protocols")
+	fmt.Println()
+	fmt.Println("🌐 Mesh Network:")
+	fmt.Println("  tunnel mesh init                        # Create mesh network")
+	fmt.Println("  tunnel mesh add <ip> <user>             # Install the mesh agent on a server")
+	fmt.Println("  tunnel mesh status                      # Show mesh status")
+	fmt.Println("  tunnel mesh connect [node]              # Tunnel through the best mesh node")
+	fmt.Println("  tunnel mesh coordinator                 # Run the mesh coordinator")
+	fmt.Println("  tunnel mesh join <coordinator-url>      # Join a mesh through its coordinator")
+	fmt.Println("  tunnel mesh relay --secret <secret>     # Relay for peers without a direct path")
+	fmt.Println("  tunnel mesh token create                # Create a join token")
+	fmt.Println("  tunnel mesh approve <node>              # Admit a node waiting for approval")
+	fmt.Println("  tunnel mesh drain|quarantine|rm <node>  # Maintenance, isolation and removal")
+	fmt.Println()
+	fmt.Println("🩺 Diagnostics:")
+	fmt.Println("  tunnel iperf <server>                   # Timed two-way throughput through a tunnel")
+	fmt.Println("  tunnel bench <server>                   # Throughput, jitter and loss through any tunnel")
+	fmt.Println("  tunnel trace <server> [--via <dest>]    # Traceroute / MTR report")
+	fmt.Println("  tunnel shell <server> [command]         # Shell or command on a server")
+	fmt.Println("  tunnel verify <server>                  # Protocol conformance report")
+	fmt.Println("  tunnel simulate [--policy latency] [--history 7d]  # Compare selection policies")
+	fmt.Println()
+	fmt.Println("📁 Configuration:")
+	fmt.Println("  tunnel config <file>                    # Use config file")
+	fmt.Println("  tunnel config <file> --server           # With web interface")
+	fmt.Println("  tunnel legacy [config.yaml]             # Run a config of the original ssh-tunnel")
+	fmt.Println("  tunnel legacy config.yaml --convert configs/config.yaml  # Convert it")
+	fmt.Println("  tunnel import <vless://...>             # Server entries from share links")
+	fmt.Println("  tunnel server                           # Start web server")
+	fmt.Println("  tunnel server --record 10m              # Record a debug bundle for bug reports")
+	fmt.Println("  tunnel server --strict                  # Exit if required servers fail to start")
+	fmt.Println("  tunnel ready [--port 8888]              # Exit 0 ready, 1 optional down, 2 required down")
+	fmt.Println("  tunnel keys create --name ci --role operator  # Create an API key on a running instance")
+	fmt.Println("  tunnel replay <bundle.json>             # Replay a debug bundle locally")
+	fmt.Println("  tunnel mitm-ca [--pem]                  # Show the HTTPS debugging CA and how to trust it")
+	fmt.Println("  tunnel icmp-server --key <secret>       # Run ICMP tunnel agent (on server)")
+	fmt.Println("  tunnel obfs-server --type xor --key <secret>  # Unwrap xor/tls/obfs4 obfuscation (on server)")
+	fmt.Println("  tunnel ssh3-server --cert c.pem --cert-key k.pem  # Companion server of the ssh3 transport (on server)")
+	fmt.Println("  tunnel udp-relay                        # UDP relay helper for SSH tunnels (run by the client on the server)")
+	fmt.Println("  tunnel tcp-relay <listen> <target>      # Publishes remote forwards sshd keeps on loopback (run by the client on the server)")
+	fmt.Println("  tunnel bench-server                     # Speed helper for tunnel bench (on server)")
+	fmt.Println()
+	fmt.Println("🎨 Interactive:")
+	fmt.Println("  tunnel                                  # Interactive menu")
+	fmt.Println("  tunnel interactive                      # Interactive menu")
+	fmt.Println("  tunnel menu                             # Interactive menu")
+	fmt.Println()
+	fmt.Println("ℹ️  Help:")
+	fmt.Println("  tunnel help                             # This help")
+	fmt.Println("  tunnel version                          # Show version")
+	fmt.Println("  tunnel platform [--json]                # What this platform supports")
+	fmt.Println()
+	fmt.Println("EXAMPLES:")
+	fmt.Println("  # Quick VPN setup")
+	fmt.Println("  tunnel quick 1.2.3.4 root mypassword --setup")
+	fmt.Println()
+	fmt.Println("  # Multi-server mesh like Tailscale")
+	fmt.Println("  tunnel mesh init")
+	fmt.Println("  tunnel mesh add server1.com root")
+	fmt.Println("  tunnel mesh add server2.com ubuntu")
+	fmt.Println("  tunnel mesh connect")
+	fmt.Println()
+	fmt.Println("  # Use generated config")
+	fmt.Println("  tunnel config client-configs/ssh-tunnel-manager-config.yaml")
+	fmt.Println()
+	fmt.Println("  # Start web management interface")
+	fmt.Println("  tunnel server --port 8888")
+	fmt.Println()
+	fmt.Println("For detailed documentation, see README.md and AUTODISCOVERY.md")
+}
+
+// showVersion displays version information
+func showVersion() {
+	fmt.Println("SSH Tunnel Manager v1.0.0")
+	fmt.Println("Enterprise-grade multi-protocol tunnel management")
+	fmt.Println("Built with Go • https://github.com/user/ssh-tunnel-manager")
+}
+
+// handlePlatformCommand shows which platform-specific subsystems this
+// build can run
+func handlePlatformCommand() {
+	matrix := platform.Matrix()
+	if len(os.Args) > 2 && os.Args[2] == "--json" {
+		data, _ := json.MarshalIndent(map[string]interface{}{
+			"platform":     platform.Name(),
+			"capabilities": matrix,
+		}, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	fmt.Printf("🖥️  Platform: %s\n\n", platform.Name())
+	for _, c := range matrix {
+		mark := "✅"
+		if !c.Supported {
+			mark = "❌"
+		}
+		fmt.Printf("  %s %-44s %s\n", mark, c.Description, c.Capability)
+	}
+	fmt.Println()
+	fmt.Println("Tunnels, the proxies and the mesh control plane run everywhere; the")
+	fmt.Println("subsystems marked ❌ report \"unsupported on this platform\" when enabled.")
+}
+
+// handleLegacyCommand runs a config of the original single-file
+// ssh-tunnel, or converts it to the current format
+// handleImportCommand prints config server entries for share links
+func handleImportCommand() {
+	if len(os.Args) < 3 || os.Args[2] == "--help" || os.Args[2] == "-h" {
+		fmt.Println("Usage: tunnel import <link> [link...]")
+		fmt.Println()
+		fmt.Println("Prints servers entries for vless://, vmess://, trojan:// and tuic:// share")
+		fmt.Println("links, to paste under servers: in the config file.")
+		return
+	}
+
+	var doc struct {
+		Servers []config.Server `yaml:"servers"`
+	}
+	for _, link := range os.Args[2:] {
+		server, err := config.ParseShareLink(link)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		doc.Servers = append(doc.Servers, *server)
+	}
+
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		log.Fatalf("❌ Failed to encode servers: %v", err)
+	}
+	os.Stdout.Write(data)
+}
+
+func handleLegacyCommand() {
+	configPath := "config.yaml"
+	keyPath := ""
+	convertPath := ""
+	for i := 2; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--key", "-k":
+			if i+1 < len(os.Args) {
+				keyPath = os.Args[i+1]
+				i++
+			}
+		case "--convert":
+			if i+1 < len(os.Args) {
+				convertPath = os.Args[i+1]
+				i++
+			}
+		case "--help", "-h":
+			fmt.Println("Usage: tunnel legacy [config.yaml] [--key ~/.ssh/id_ed25519] [--convert <new-config.yaml>]")
+			fmt.Println()
+			fmt.Println("Runs a config of the original ssh-tunnel (servers with host, port, user")
+			fmt.Println("and proxy): tunnels through the fastest server, SOCKS5 on port 8080 or")
+			fmt.Println("HTTP on 8888. --convert writes the equivalent current config instead.")
+			return
+		default:
+			configPath = os.Args[i]
+		}
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		log.Fatalf("❌ Failed to read config: %v", err)
+	}
+	if !config.IsLegacyConfig(data) {
+		log.Fatalf("❌ %s is not a legacy config; run it with: tunnel config %s", configPath, configPath)
+	}
+	legacy, err := config.LoadLegacyConfig(configPath)
+	if err != nil {
+		log.Fatalf("❌ Failed to load config: %v", err)
+	}
+	cfg, err := config.ConvertLegacyConfig(legacy, keyPath)
+	if err != nil {
+		log.Fatalf("❌ Failed to convert config: %v", err)
+	}
+
+	if convertPath != "" {
+		if err := config.SaveConfig(cfg, convertPath); err != nil {
+			log.Fatalf("❌ Failed to save config: %v", err)
+		}
+		fmt.Printf("✅ Converted %d servers to %s\n", len(cfg.Servers), convertPath)
+		fmt.Printf("🚀 Run it with: tunnel config %s\n", convertPath)
+		return
+	}
+
+	fmt.Printf("✅ Legacy configuration loaded: %d servers\n", len(cfg.Servers))
+	fmt.Printf("💡 Convert it once with: tunnel legacy %s --convert configs/config.yaml\n", configPath)
+
+	application := app.New(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	go application.StartClient()
+
+	waitForShutdown(application, sigChan)
+	fmt.Println("\n👋 Shutting down...")
+	application.Shutdown(ctx)
+}
+
+// handleLegacyCLI handles the old CLI for backward compatibility
+func handleLegacyCLI() {
+	var configPath = flag.String("config", "configs/config.yaml", "Path to configuration file")
+	var serverMode = flag.Bool("server", false, "Run in server mode with REST API")
+	var port = flag.String("port", "8888", "Server port for REST API")
+	var strict = flag.Bool("strict", false, "Exit if required servers fail to start")
+
+	// Auto-discovery flags
+	var autodiscover = flag.Bool("autodiscover", false, "Auto-discover and setup server protocols")
+	var setupHost = flag.String("host", "", "Server host/IP for auto-discovery")
+	var setupPort = flag.String("setup-port", "22", "SSH port for auto-discovery")
+	var setupUser = flag.String("user", "", "SSH username for auto-discovery")
+	var setupPassword = flag.String("password", "", "SSH password for auto-discovery")
+	var setupKeyPath = flag.String("key", "", "SSH private key path for auto-discovery")
+	var outputDir = flag.String("output", "client-configs", "Output directory for generated configs")
+	var setupProtocols = flag.Bool("setup", false, "Automatically setup all supported protocols")
+	var setupHostKey = flag.String("host-key", "", "Expected SSH host key or SHA256 fingerprint for auto-discovery")
+
+	flag.Parse()
+
+	// Handle auto-discovery mode
+	if *autodiscover {
+		if *setupHost == "" || *setupUser == "" {
+			fmt.Println("❌ -host and -user are required for auto-discovery")
+			fmt.Println()
+			fmt.Println("💡 TIP: Use the new simple commands instead!")
+			fmt.Println("   tunnel quick 1.2.3.4 root mypassword")
+			fmt.Println("   tunnel quick 1.2.3.4 root mypassword --setup")
+			os.Exit(1)
+		}
+
+		if *setupPassword == "" && *setupKeyPath == "" {
+			fmt.Println("❌ Either -password or -key must be provided")
+			fmt.Println()
+			fmt.Println("💡 TIP: Use the new simple commands instead!")
+			fmt.Println("   tunnel quick 1.2.3.4 root mypassword")
+			os.Exit(1)
+		}
+
+		runAutoDiscovery(*setupHost, *setupPort, *setupUser, *setupPassword, *setupKeyPath, *setupHostKey, *outputDir, *setupProtocols)
+		return
+	}
+
+	// Load configuration
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if *strict {
+		cfg.StrictStartup = true
+	}
+
+	// Create application context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -487,6 +3819,7 @@ func handleLegacyCLI() {
 
 	// Create and start the application
 	application := app.New(cfg)
+	application.SetConfigPath(*configPath)
 
 	if *serverMode {
 		fmt.Printf("Starting SSH Tunnel Manager in server mode on port %s\n", *port)
@@ -497,15 +3830,18 @@ func handleLegacyCLI() {
 	}
 
 	// Wait for shutdown signal
-	<-sigChan
+	startupErr := waitForShutdown(application, sigChan)
 	fmt.Println("\nShutting down gracefully...")
 
 	application.Shutdown(ctx)
 	fmt.Println("Application stopped")
+	if startupErr != nil {
+		os.Exit(exitRequiredDown)
+	}
 }
 
 // runAutoDiscovery runs the auto-discovery process (legacy support)
-func runAutoDiscovery(host, port, user, password, keyPath, outputDir string, setup bool) {
+func runAutoDiscovery(host, port, user, password, keyPath, hostKey, outputDir string, setup bool) {
 	fmt.Println("🔍 Starting Auto-Discovery Process...")
 	fmt.Printf("Target: %s@%s:%s\n", user, host, port)
 	fmt.Printf("Output Directory: %s\n", outputDir)
@@ -513,6 +3849,7 @@ func runAutoDiscovery(host, port, user, password, keyPath, outputDir string, set
 
 	// Create discovery instance
 	discovery := autodiscovery.NewServerDiscovery()
+	discovery.SetHostKey(hostKey)
 
 	// Discover server capabilities
 	fmt.Println("📡 Discovering server capabilities...")
@@ -530,6 +3867,7 @@ func runAutoDiscovery(host, port, user, password, keyPath, outputDir string, set
 	fmt.Printf("   Installed Software: %v\n", serverInfo.InstalledSoftware)
 	fmt.Printf("   Supported Protocols: %v\n", serverInfo.SupportedProtocols)
 	fmt.Println()
+	printSSHDAudit(serverInfo.SSHDAudit, false)
 
 	// Setup protocols if requested
 	if setup {
@@ -579,6 +3917,7 @@ servers:
     port: "%s"
     user: "%s"
     password: "%s"
+    host_key: "%s"
     transport: "ssh"
     proxy: "socks5"
     local_port: 8080
@@ -599,6 +3938,7 @@ api:
 		serverInfo.Port,
 		serverInfo.User,
 		serverInfo.Password,
+		serverInfo.HostKey,
 	)
 
 	configFile := fmt.Sprintf("%s/ssh-tunnel-manager-config.yaml", outputDir)
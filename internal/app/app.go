@@ -2,9 +2,14 @@ package app
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"path"
+	"strconv"
 	"sync"
 	"time"
 
@@ -13,16 +18,36 @@ import (
 	"golang.org/x/time/rate"
 
 	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/crash"
+	"ssh-tunnel/internal/diagnostics"
+	"ssh-tunnel/internal/election"
+	"ssh-tunnel/internal/events"
+	"ssh-tunnel/internal/mesh"
 	"ssh-tunnel/internal/monitoring"
+	"ssh-tunnel/internal/platform"
 	"ssh-tunnel/internal/protocols"
+	"ssh-tunnel/internal/recorder"
 )
 
 // Application represents the main application
 type Application struct {
 	config    *config.Config
+	path      string // The config file API changes are saved to; empty keeps them in memory
 	tunnelMgr *protocols.TunnelManager
 	monitor   *monitoring.Monitor
+	history   *diagnostics.History
+	events    *events.Bus // Configuration change events
+	recorder  *recorder.Recorder
+	elector   election.Elector
+	vip       *election.VirtualIP // Held while leader, when configured
+	role      string              // "leader" or "standby" when election is enabled
 	server    *echo.Echo
+	agents    map[string]*agent // Instances connected over control channels
+	meshAdmin *mesh.AdminClient // Nil without a mesh coordinator
+	meshNet   *mesh.MeshNetwork // Set once joined, with a mesh join token
+	failed    chan error        // Receives the error of a failed strict startup
+	keys      *tokenKeys        // JWT keys, loaded on first use
+	keysMu    sync.Mutex
 	mu        sync.RWMutex
 	ctx       context.Context
 	cancel    context.CancelFunc
@@ -33,19 +58,56 @@ func New(cfg *config.Config) *Application {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	app := &Application{
-		config: cfg,
-		ctx:    ctx,
-		cancel: cancel,
+		config:  cfg,
+		history: diagnostics.NewHistory(""),
+		events:  events.NewBus(cfg.Events.Hooks),
+		agents:  make(map[string]*agent),
+		failed:  make(chan error, 1),
+		ctx:     ctx,
+		cancel:  cancel,
 	}
 
+	// Register plugin transports before any tunnel is created
+	protocols.LoadPlugins(cfg.Plugins)
+
 	// Initialize tunnel manager
 	app.tunnelMgr = protocols.NewTunnelManager(cfg)
 
+	if cfg.Election.Enabled {
+		elector, err := election.New(cfg.Election)
+		if err != nil {
+			log.Printf("Leader election disabled: %v", err)
+		} else {
+			app.elector = elector
+			app.role = "standby"
+		}
+
+		if vipCfg := cfg.Election.VirtualIP; vipCfg != nil && app.elector != nil {
+			vip, err := election.NewVirtualIP(vipCfg)
+			if err != nil {
+				log.Printf("Virtual IP disabled: %v", err)
+			} else {
+				// Drop an address left behind by a crash; only the leader holds it
+				if err := vip.Release(); err != nil {
+					log.Printf("Virtual IP error: %v", err)
+				}
+				app.vip = vip
+			}
+		}
+	}
+
 	// Initialize monitoring
 	if cfg.Monitoring.Enabled {
 		app.monitor = monitoring.NewMonitor(cfg.Monitoring)
 	}
 
+	app.configureCrashReports()
+
+	if cfg.Mesh.CoordinatorURL != "" {
+		app.meshAdmin = mesh.NewAdminClient(cfg.Mesh.CoordinatorURL, cfg.Mesh.AdminKey)
+		app.meshAdmin.SetPin(cfg.Mesh.CoordinatorPin)
+	}
+
 	// Initialize Echo server
 	if cfg.API.Enabled {
 		app.setupServer()
@@ -54,6 +116,49 @@ func New(cfg *config.Config) *Application {
 	return app
 }
 
+// SetConfigPath makes changes made over the API persist to the config file
+// at path
+func (a *Application) SetConfigPath(path string) {
+	a.path = path
+}
+
+// EnableRecording records API interactions and internal events for the
+// given window and writes a sanitized debug bundle to output
+func (a *Application) EnableRecording(output string, window time.Duration) error {
+	if a.server == nil {
+		return fmt.Errorf("recording requires the API server to be enabled")
+	}
+
+	a.recorder = recorder.NewRecorder(output, window)
+	a.recorder.Finalize = func(b *recorder.Bundle) {
+		b.Config = recorder.SanitizeObject(a.config)
+
+		if tunnels, err := json.Marshal(a.tunnelMgr.GetStatus()); err == nil {
+			b.Tunnels = tunnels
+		}
+
+		if a.monitor != nil {
+			for _, entry := range a.monitor.GetLogs() {
+				if entry.Timestamp.Before(b.StartedAt) {
+					continue
+				}
+				details, _ := recorder.SanitizeObject(entry.Details).(map[string]interface{})
+				b.Events = append(b.Events, recorder.Event{
+					Timestamp: entry.Timestamp,
+					Level:     entry.Level,
+					Component: entry.Component,
+					Message:   entry.Message,
+					Details:   details,
+				})
+			}
+		}
+	}
+
+	a.server.Use(a.recorder.Middleware())
+	a.recorder.Start(a.config.Version)
+	return nil
+}
+
 // StartClient starts the application in client mode
 func (a *Application) StartClient() error {
 	log.Println("Starting SSH Tunnel Manager in client mode...")
@@ -61,10 +166,31 @@ func (a *Application) StartClient() error {
 	// Start monitoring if enabled
 	if a.monitor != nil {
 		go a.monitor.Start(a.ctx)
+		go crash.Supervise(a.ctx, "tunnel metrics", a.syncTunnelMetrics)
+		if a.meshAdmin != nil {
+			go crash.Supervise(a.ctx, "mesh metrics", a.syncMeshMetrics)
+		}
+	}
+	if a.meshAdmin != nil {
+		go crash.Supervise(a.ctx, "mesh events", a.followMeshEvents)
+	}
+	go crash.Supervise(a.ctx, "tunnel events", a.publishTunnelEvents)
+
+	if a.config.Control.Enabled && a.server != nil {
+		go crash.Supervise(a.ctx, "control channel", a.runControlChannel)
+	}
+
+	if a.config.Mesh.JoinToken != "" {
+		go crash.Supervise(a.ctx, "mesh node", a.joinMesh)
+	}
+
+	if a.elector != nil {
+		go crash.Supervise(a.ctx, "leader election", a.runElection)
+		return nil
 	}
 
 	// Start tunnel manager
-	return a.tunnelMgr.Start(a.ctx)
+	return a.startTunnels()
 }
 
 // StartServer starts the application in server mode with REST API
@@ -74,14 +200,34 @@ func (a *Application) StartServer(port string) error {
 	// Start monitoring if enabled
 	if a.monitor != nil {
 		go a.monitor.Start(a.ctx)
+		go crash.Supervise(a.ctx, "tunnel metrics", a.syncTunnelMetrics)
+		if a.meshAdmin != nil {
+			go crash.Supervise(a.ctx, "mesh metrics", a.syncMeshMetrics)
+		}
+	}
+	if a.meshAdmin != nil {
+		go crash.Supervise(a.ctx, "mesh events", a.followMeshEvents)
+	}
+	go crash.Supervise(a.ctx, "tunnel events", a.publishTunnelEvents)
+
+	if a.config.Control.Enabled && a.server != nil {
+		go crash.Supervise(a.ctx, "control channel", a.runControlChannel)
+	}
+
+	if a.config.Mesh.JoinToken != "" {
+		go crash.Supervise(a.ctx, "mesh node", a.joinMesh)
 	}
 
 	// Start tunnel manager in background
-	go func() {
-		if err := a.tunnelMgr.Start(a.ctx); err != nil {
-			log.Printf("Tunnel manager error: %v", err)
-		}
-	}()
+	if a.elector != nil {
+		go crash.Supervise(a.ctx, "leader election", a.runElection)
+	} else {
+		go func() {
+			if err := a.startTunnels(); err != nil {
+				log.Printf("Tunnel manager error: %v", err)
+			}
+		}()
+	}
 
 	// Start HTTP server
 	if a.server != nil {
@@ -91,17 +237,74 @@ func (a *Application) StartServer(port string) error {
 	return fmt.Errorf("HTTP server not initialized")
 }
 
+// startTunnels starts the tunnel manager, passing a failed strict startup
+// on to Failed
+func (a *Application) startTunnels() error {
+	err := a.tunnelMgr.Start(a.ctx)
+	if _, ok := err.(*protocols.StartupError); ok {
+		select {
+		case a.failed <- err:
+		default:
+		}
+	}
+	return err
+}
+
+// Failed receives an error when required servers fail to start with
+// strict_startup set, after which the application should be shut down
+func (a *Application) Failed() <-chan error {
+	return a.failed
+}
+
+// StartupReport returns the results of the last tunnel manager start
+func (a *Application) StartupReport() protocols.StartupReport {
+	return a.tunnelMgr.StartupReport()
+}
+
 // Shutdown gracefully shuts down the application
 func (a *Application) Shutdown(ctx context.Context) error {
 	log.Println("Shutting down application...")
 
 	var errors []error
 
+	// Flush a recording that is still in progress
+	if a.recorder != nil {
+		if err := a.recorder.Stop(); err != nil {
+			errors = append(errors, fmt.Errorf("debug bundle error: %v", err))
+		}
+	}
+
 	// Stop tunnel manager
 	if err := a.tunnelMgr.Stop(); err != nil {
 		errors = append(errors, fmt.Errorf("tunnel manager shutdown error: %v", err))
 	}
 
+	// Hand over to a standby right away instead of waiting for expiry
+	a.mu.RLock()
+	leader := a.role == "leader"
+	a.mu.RUnlock()
+	if a.vip != nil && leader {
+		if err := a.vip.Release(); err != nil {
+			errors = append(errors, fmt.Errorf("virtual IP release error: %v", err))
+		}
+	}
+	if a.elector != nil {
+		if err := a.elector.Resign(); err != nil {
+			errors = append(errors, fmt.Errorf("leader election resign error: %v", err))
+		}
+	}
+
+	// Leave the mesh
+	a.mu.Lock()
+	meshNet := a.meshNet
+	a.meshNet = nil
+	a.mu.Unlock()
+	if meshNet != nil {
+		if err := meshNet.Stop(); err != nil {
+			errors = append(errors, fmt.Errorf("mesh leave error: %v", err))
+		}
+	}
+
 	// Stop monitoring
 	if a.monitor != nil {
 		if err := a.monitor.Stop(); err != nil {
@@ -109,6 +312,9 @@ func (a *Application) Shutdown(ctx context.Context) error {
 		}
 	}
 
+	// End event subscriptions, delivering queued hook calls in the background
+	a.events.Close()
+
 	// Stop HTTP server
 	if a.server != nil {
 		if err := a.server.Shutdown(ctx); err != nil {
@@ -126,6 +332,116 @@ func (a *Application) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// runElection runs the tunnels only while this instance is the leader. A
+// standby keeps campaigning, and a leader that loses leadership stops its
+// tunnels, freeing their local ports, and becomes a standby again.
+func (a *Application) runElection() {
+	for {
+		log.Printf("Waiting for leadership (%s election)", a.config.Election.Backend)
+		if err := a.elector.Campaign(a.ctx); err != nil {
+			if a.ctx.Err() == nil {
+				log.Printf("Leader election failed: %v", err)
+			}
+			return
+		}
+
+		log.Println("Elected leader, starting tunnels")
+		a.setRole("leader")
+		if err := a.startTunnels(); err != nil {
+			log.Printf("Tunnel manager error: %v", err)
+		}
+
+		// Take the virtual IP once the local ports are bound
+		if a.vip != nil {
+			if err := a.vip.Acquire(); err != nil {
+				log.Printf("Virtual IP error: %v", err)
+			}
+		}
+
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-a.elector.Lost():
+		}
+
+		log.Println("Lost leadership, stopping tunnels")
+		if a.vip != nil {
+			if err := a.vip.Release(); err != nil {
+				log.Printf("Virtual IP error: %v", err)
+			}
+		}
+		a.tunnelMgr.Stop()
+		a.setRole("standby")
+	}
+}
+
+func (a *Application) setRole(role string) {
+	a.mu.Lock()
+	previous := a.role
+	a.role = role
+	a.mu.Unlock()
+
+	eventType := config.EventFailoverStandby
+	if role == "leader" {
+		eventType = config.EventFailoverLeader
+	}
+	a.events.Publish(events.Event{Type: eventType, Before: previous, After: role})
+
+	if a.monitor != nil {
+		a.monitor.LogEvent("info", "election", "Instance is now "+role, nil)
+	}
+}
+
+// syncTunnelMetrics periodically probes connected tunnels and feeds their
+// status into the monitor
+func (a *Application) syncTunnelMetrics() {
+	interval := a.config.Monitoring.CheckInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+			for name, status := range a.tunnelMgr.GetStatus() {
+				latency := status.Latency
+				if status.Status == "connected" || a.config.Monitoring.RecordProbes {
+					probed, err := a.tunnelMgr.ProbeLatency(name)
+					if err == nil {
+						latency = probed
+					}
+					if a.config.Monitoring.RecordProbes {
+						a.recordProbe(name, probed, err)
+					}
+				}
+				a.monitor.UpdateTunnelMetrics(name, status.Status, latency, status.BytesSent, status.BytesRecv)
+				a.monitor.TrackAvailability(name, status.Status, status.Required)
+				a.monitor.UpdateVerificationMetrics(name, status.Insecure)
+				if throttle, ok := protocols.GetThrottleStatus(name); ok {
+					a.monitor.UpdateThrottleMetrics(name, monitoring.ThrottleMetrics(*throttle))
+				}
+			}
+		}
+	}
+}
+
+// recordProbe stores a probe result in the diagnostics history
+func (a *Application) recordProbe(name string, latency time.Duration, err error) {
+	probe := diagnostics.ProbeResult{Latency: latency, Up: err == nil}
+	if err != nil {
+		probe.Error = err.Error()
+	}
+
+	if err := a.history.Append("probe", name, probe); err != nil {
+		log.Printf("Failed to record probe for %s: %v", name, err)
+	}
+}
+
 // setupServer sets up the Echo HTTP server with routes and middleware
 func (a *Application) setupServer() {
 	a.server = echo.New()
@@ -146,8 +462,9 @@ func (a *Application) setupServer() {
 		)))
 	}
 
-	// Authentication middleware if enabled
-	if a.config.Security.EnableAuth {
+	// Authentication middleware if enabled. Calls a controller relays over
+	// the control channel are checked against the control role either way.
+	if a.config.Security.EnableAuth || a.config.Control.Enabled {
 		a.server.Use(a.authMiddleware)
 	}
 
@@ -156,9 +473,23 @@ func (a *Application) setupServer() {
 
 	// System routes
 	api.GET("/health", a.handleHealth)
+	api.GET("/ready", a.handleReady)
 	api.GET("/status", a.handleStatus)
+	api.GET("/status/startup", a.handleStartupStatus)
+	api.GET("/platform", a.handlePlatform)
 	api.GET("/config", a.handleGetConfig)
 	api.PUT("/config", a.handleUpdateConfig)
+	api.GET("/events", a.handleEvents)
+	api.GET("/ws", a.handleLive)
+
+	// JWT login
+	api.POST("/auth/login", a.handleLogin)
+	api.POST("/auth/refresh", a.handleRefresh)
+
+	// API key management
+	api.GET("/keys", a.handleListKeys)
+	api.POST("/keys", a.handleCreateKey)
+	api.DELETE("/keys/:id", a.handleRevokeKey)
 
 	// Server management routes
 	api.GET("/servers", a.handleGetServers)
@@ -166,23 +497,73 @@ func (a *Application) setupServer() {
 	api.PUT("/servers/:id", a.handleUpdateServer)
 	api.DELETE("/servers/:id", a.handleDeleteServer)
 	api.POST("/servers/:id/test", a.handleTestServer)
+	api.POST("/servers/:id/bench", a.handleBenchServer)
 
 	// Tunnel management routes
 	api.GET("/tunnels", a.handleGetTunnels)
 	api.POST("/tunnels/start", a.handleStartTunnel)
 	api.POST("/tunnels/stop", a.handleStopTunnel)
 	api.POST("/tunnels/restart", a.handleRestartTunnel)
+	api.POST("/tunnels/:name/start", a.handleTunnelAction)
+	api.POST("/tunnels/:name/stop", a.handleTunnelAction)
+	api.POST("/tunnels/:name/restart", a.handleTunnelAction)
+	api.GET("/connections", a.handleGetConnections)
+	api.GET("/connections/:tunnel", a.handleGetConnections)
+	api.GET("/memory", a.handleMemory)
+
+	// Instances managed over their control channels
+	api.GET("/agents", a.handleGetAgents)
+	api.GET("/agents/connect", a.handleAgentConnect)
+	api.Any("/agents/:name/*", a.handleAgentRelay)
 
 	// Monitoring routes
 	if a.config.Monitoring.Enabled {
 		api.GET("/metrics", a.handleMetrics)
+		api.GET("/metrics/history", a.handleMetricsHistory)
 		api.GET("/logs", a.handleLogs)
+		api.GET("/alerts", a.handleAlerts)
 	}
+
+	// Mesh dashboard, with a coordinator to manage
+	if a.meshAdmin != nil {
+		a.registerMeshRoutes(api)
+	}
+
+	// Profiling, for authenticated clients only
+	if a.config.API.Debug {
+		a.registerDebugRoutes(api)
+	}
+
+	a.registerDocsRoutes(api)
+}
+
+// handlePlatform returns which platform-specific subsystems this build can
+// run
+func (a *Application) handlePlatform(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"platform":     platform.Name(),
+		"capabilities": platform.Matrix(),
+	})
 }
 
 // authMiddleware provides authentication for API endpoints
 func (a *Application) authMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		// The dashboard and docs pages authenticate their API calls
+		// themselves, the API description holds no secrets, and the login
+		// and agent connect endpoints check credentials of their own
+		switch c.Path() {
+		case meshDashboardPath, docsPath, docsAssetsPath, openAPIPath, loginPath, refreshPath, agentConnectPath:
+			return next(c)
+		}
+
+		if isRelayedCall(c) {
+			return a.authorizeRelayedCall(c, next)
+		}
+		if !a.config.Security.EnableAuth {
+			return next(c)
+		}
+
 		token := c.Request().Header.Get("Authorization")
 		if token == "" {
 			return c.JSON(http.StatusUnauthorized, map[string]string{
@@ -195,12 +576,44 @@ func (a *Application) authMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 			token = token[7:]
 		}
 
-		// Check if token is valid
+		// Tokens issued by the login endpoint are verified by signature
+		if a.config.Security.JWT.Enabled && isJWT(token) {
+			keys, err := a.jwtKeys()
+			if err != nil {
+				return c.JSON(http.StatusServiceUnavailable, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			claims, err := keys.parseToken(token, accessToken)
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{
+					"error": fmt.Sprintf("Invalid authorization token: %v", err),
+				})
+			}
+			user, ok := a.findUser(claims.Subject)
+			if !ok {
+				return c.JSON(http.StatusUnauthorized, map[string]string{
+					"error": "Invalid authorization token: unknown user",
+				})
+			}
+			c.Set("user", user.Name)
+			// The user's current role, so a change applies to tokens
+			// already issued
+			return authorize(c, next, "User "+user.Name, userRole(user))
+		}
+
+		// API keys are checked against their hashes, and have a role
+		if key, ok := a.findAPIKey(token); ok {
+			c.Set("api_key", key.Name)
+			return authorize(c, next, "API key "+key.Name, key.Role)
+		}
+
+		// Otherwise fall back to the static tokens, compared in constant
+		// time and all of them, so timing tells nothing about a match
 		valid := false
 		for _, validToken := range a.config.Security.AuthTokens {
-			if token == validToken {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(validToken)) == 1 {
 				valid = true
-				break
 			}
 		}
 
@@ -210,6 +623,7 @@ func (a *Application) authMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 			})
 		}
 
+		c.Set("role", config.RoleAdmin)
 		return next(c)
 	}
 }
@@ -217,11 +631,51 @@ func (a *Application) authMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 // API Handlers
 
 func (a *Application) handleHealth(c echo.Context) error {
-	return c.JSON(http.StatusOK, map[string]interface{}{
+	health := map[string]interface{}{
 		"status":    "healthy",
 		"timestamp": time.Now(),
 		"version":   a.config.Version,
-	})
+	}
+
+	a.mu.RLock()
+	if a.role != "" {
+		health["role"] = a.role
+	}
+	a.mu.RUnlock()
+
+	// Servers and listeners left out at startup; see /status/startup
+	report := a.tunnelMgr.StartupReport()
+	if failures := report.Failures(); len(failures) > 0 {
+		health["startup_failures"] = len(failures)
+	}
+
+	// Only required servers degrade health; optional ones are listed
+	readiness := a.tunnelMgr.Readiness()
+	if len(readiness.RequiredDown) > 0 {
+		health["status"] = "degraded"
+		health["required_down"] = readiness.RequiredDown
+	}
+	if len(readiness.OptionalDown) > 0 {
+		health["optional_down"] = readiness.OptionalDown
+	}
+
+	// Panics recovered and restarted from; see the crash reports
+	if crashes := crash.Count(); crashes > 0 {
+		health["crashes"] = crashes
+	}
+
+	return c.JSON(http.StatusOK, health)
+}
+
+// handleReady answers 200 when every required server is connected, or
+// with none required when any tunnel is, and 503 otherwise, for load
+// balancer and orchestrator readiness checks
+func (a *Application) handleReady(c echo.Context) error {
+	readiness := a.tunnelMgr.Readiness()
+	if !readiness.Ready {
+		return c.JSON(http.StatusServiceUnavailable, readiness)
+	}
+	return c.JSON(http.StatusOK, readiness)
 }
 
 func (a *Application) handleStatus(c echo.Context) error {
@@ -229,20 +683,49 @@ func (a *Application) handleStatus(c echo.Context) error {
 	return c.JSON(http.StatusOK, status)
 }
 
+func (a *Application) handleStartupStatus(c echo.Context) error {
+	return c.JSON(http.StatusOK, a.tunnelMgr.StartupReport())
+}
+
 func (a *Application) handleGetConfig(c echo.Context) error {
-	// Return config without sensitive information
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	// Return config without sensitive information. Everything changed is a
+	// copy, the running config keeps its credentials.
 	safeConfig := *a.config
 	safeConfig.Security.AuthTokens = nil
 	safeConfig.Security.MasterPassword = ""
-
-	for i := range safeConfig.Servers {
-		safeConfig.Servers[i].Password = ""
-		safeConfig.Servers[i].KeyPath = ""
-		if safeConfig.Servers[i].Hysteria != nil {
-			safeConfig.Servers[i].Hysteria.AuthString = ""
-		}
+	safeConfig.Security.JWT.Secret = ""
+	safeConfig.Security.Users = append([]config.APIUser(nil), a.config.Security.Users...)
+	for i := range safeConfig.Security.Users {
+		safeConfig.Security.Users[i].Password = ""
+		safeConfig.Security.Users[i].PasswordHash = ""
+	}
+	safeConfig.Security.APIKeys = append([]config.APIKey(nil), a.config.Security.APIKeys...)
+	for i := range safeConfig.Security.APIKeys {
+		safeConfig.Security.APIKeys[i].Hash = ""
+	}
+	safeConfig.Security.Agents = append([]config.AgentCredential(nil), a.config.Security.Agents...)
+	for i := range safeConfig.Security.Agents {
+		safeConfig.Security.Agents[i].Token = ""
+	}
+	safeConfig.Mesh.AdminKey = ""
+	safeConfig.Mesh.JoinToken = ""
+	safeConfig.Mesh.SyncKey = ""
+	safeConfig.Election.Token = ""
+	safeConfig.Control.Token = ""
+	safeConfig.Shadowsocks.Password = ""
+
+	safeConfig.Events.Hooks = append([]config.EventHook(nil), a.config.Events.Hooks...)
+	for i := range safeConfig.Events.Hooks {
+		safeConfig.Events.Hooks[i].Secret = ""
 	}
 
+	safeConfig.Servers = redactServers(a.config.Servers)
+	safeConfig.ServerDefaults = redactSettings(a.config.ServerDefaults)
+	safeConfig.ServerTemplates = redactSettings(a.config.ServerTemplates)
+
 	return c.JSON(http.StatusOK, safeConfig)
 }
 
@@ -263,15 +746,20 @@ func (a *Application) handleUpdateConfig(c echo.Context) error {
 
 	// Update application configuration
 	a.mu.Lock()
+	oldConfig := a.config
 	a.config = &newConfig
 	a.mu.Unlock()
 
+	a.events.SetHooks(newConfig.Events.Hooks)
+	a.events.Publish(events.Diff(oldConfig, &newConfig)...)
+
 	// Restart tunnel manager with new config
 	if err := a.tunnelMgr.UpdateConfig(&newConfig); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": fmt.Sprintf("Failed to update tunnel configuration: %v", err),
 		})
 	}
+	a.events.Publish(events.Event{Type: config.EventConfigReloaded, Reason: "Updated through the API"})
 
 	return c.JSON(http.StatusOK, map[string]string{
 		"message": "Configuration updated successfully",
@@ -279,9 +767,13 @@ func (a *Application) handleUpdateConfig(c echo.Context) error {
 }
 
 func (a *Application) handleGetServers(c echo.Context) error {
-	return c.JSON(http.StatusOK, a.config.Servers)
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return c.JSON(http.StatusOK, redactServers(a.config.Servers))
 }
 
+// handleAddServer adds a server and registers its tunnel, which starts
+// like any other, with tunnels/start
 func (a *Application) handleAddServer(c echo.Context) error {
 	var server config.Server
 	if err := c.Bind(&server); err != nil {
@@ -290,29 +782,152 @@ func (a *Application) handleAddServer(c echo.Context) error {
 		})
 	}
 
-	a.mu.Lock()
-	a.config.Servers = append(a.config.Servers, server)
-	a.mu.Unlock()
-
-	return c.JSON(http.StatusCreated, server)
+	return a.changeServer(c, "", &server)
 }
 
+// handleUpdateServer replaces the server named by id, recreating its
+// tunnel, and restarting it if it was running
 func (a *Application) handleUpdateServer(c echo.Context) error {
 	id := c.Param("id")
-	// Implementation for updating specific server
-	return c.JSON(http.StatusOK, map[string]string{
-		"message": "Server updated",
-		"id":      id,
-	})
+	var server config.Server
+	if err := c.Bind(&server); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid server configuration",
+		})
+	}
+	if server.Name == "" {
+		server.Name = id
+	}
+
+	return a.changeServer(c, id, &server)
 }
 
+// handleDeleteServer removes the server named by id and stops its tunnel
 func (a *Application) handleDeleteServer(c echo.Context) error {
-	id := c.Param("id")
-	// Implementation for deleting specific server
-	return c.JSON(http.StatusOK, map[string]string{
-		"message": "Server deleted",
-		"id":      id,
-	})
+	return a.changeServer(c, c.Param("id"), nil)
+}
+
+// changeServer adds server for an empty id, and otherwise replaces the
+// server named id with it, or removes that server for nil. The changed
+// configuration is validated, swapped in, applied to the server's tunnel
+// and saved to the config file.
+func (a *Application) changeServer(c echo.Context, id string, server *config.Server) error {
+	a.mu.Lock()
+	index := len(a.config.Servers) // Where an added server goes
+	if id != "" {
+		index = -1
+		for i := range a.config.Servers {
+			if a.config.Servers[i].Name == id {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			a.mu.Unlock()
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": fmt.Sprintf("Server %s not found", id),
+			})
+		}
+	}
+
+	newConfig := *a.config
+	newConfig.Servers = append([]config.Server(nil), a.config.Servers[:index]...)
+	if server != nil {
+		for i := range a.config.Servers {
+			if i != index && server.Name != "" && a.config.Servers[i].Name == server.Name {
+				a.mu.Unlock()
+				return c.JSON(http.StatusConflict, map[string]string{
+					"error": fmt.Sprintf("Server %s already exists", server.Name),
+				})
+			}
+		}
+		// server is saved as given; the one in use gets what loading it
+		// from the config file would give it
+		inUse, err := config.WithServerDefaults(a.config, *server)
+		if err != nil {
+			a.mu.Unlock()
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		}
+		newConfig.Servers = append(newConfig.Servers, inUse)
+	}
+	if id != "" {
+		newConfig.Servers = append(newConfig.Servers, a.config.Servers[index+1:]...)
+	}
+
+	config.SetDefaults(&newConfig)
+	// The last server may go, as the server command starts without any
+	if len(newConfig.Servers) > 0 {
+		if err := config.Validate(&newConfig); err != nil {
+			a.mu.Unlock()
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("Configuration validation failed: %v", err),
+			})
+		}
+	}
+
+	oldConfig := a.config
+	a.config = &newConfig
+	changes := events.Diff(oldConfig, &newConfig)
+	a.mu.Unlock()
+
+	a.events.Publish(changes...)
+	a.tunnelMgr.UpdateConfig(&newConfig)
+
+	newName := ""
+	if server != nil {
+		newName = newConfig.Servers[index].Name // Named by SetDefaults when left empty
+		server.Name = newName
+	}
+	// Like a server that fails to start, one whose tunnel cannot be
+	// created stays configured
+	reloadErr := a.tunnelMgr.ReloadServer(id, newName)
+	if err := a.saveServer(id, server); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to save configuration: %v", err),
+		})
+	}
+	if reloadErr != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to update tunnel: %v", reloadErr),
+		})
+	}
+
+	switch {
+	case server == nil:
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": "Server deleted",
+			"id":      id,
+		})
+	case id == "":
+		return c.JSON(http.StatusCreated, newConfig.Servers[index])
+	}
+	return c.JSON(http.StatusOK, newConfig.Servers[index])
+}
+
+// saveServer writes a change changeServer made to the config file, when
+// there is one. Only that server's entry is rewritten.
+func (a *Application) saveServer(name string, server *config.Server) error {
+	if a.path == "" {
+		return nil
+	}
+	// Saving reads the file back, so saves must not overlap
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return config.SaveServer(a.config, a.path, name, server)
+}
+
+// saveAPIKeys writes the API keys to the config file, when there is one
+func (a *Application) saveAPIKeys() error {
+	if a.path == "" {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return config.SaveAPIKeys(a.config, a.path)
 }
 
 func (a *Application) handleTestServer(c echo.Context) error {
@@ -321,13 +936,71 @@ func (a *Application) handleTestServer(c echo.Context) error {
 	return c.JSON(http.StatusOK, result)
 }
 
+// handleBenchServer benchmarks a connected tunnel; ?target= and ?mb=
+// override the speed helper address and the transfer size
+func (a *Application) handleBenchServer(c echo.Context) error {
+	var opts diagnostics.BenchOptions
+	if mb, err := strconv.ParseInt(c.QueryParam("mb"), 10, 64); err == nil && mb > 0 {
+		opts.Bytes = mb << 20
+	}
+
+	result, err := a.tunnelMgr.Bench(c.Param("id"), c.QueryParam("target"), opts)
+	if err != nil {
+		return c.JSON(http.StatusBadGateway, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
 func (a *Application) handleGetTunnels(c echo.Context) error {
 	tunnels := a.tunnelMgr.GetTunnels()
 	return c.JSON(http.StatusOK, tunnels)
 }
 
+// handleGetConnections lists the SSH connections with their channels, all
+// of them or those of one tunnel
+func (a *Application) handleGetConnections(c echo.Context) error {
+	connections := protocols.GetSSHConnections()
+	tunnel := c.Param("tunnel")
+	if tunnel == "" {
+		return c.JSON(http.StatusOK, connections)
+	}
+
+	var matched []protocols.SSHConnectionStats
+	for _, conn := range connections {
+		if conn.Tunnel == tunnel {
+			matched = append(matched, conn)
+		}
+	}
+	if matched == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": fmt.Sprintf("no SSH connection for tunnel %s", tunnel),
+		})
+	}
+	return c.JSON(http.StatusOK, matched)
+}
+
+// handleMemory returns the memory proxied connections hold, per connection
+// and against the memory budget
+func (a *Application) handleMemory(c echo.Context) error {
+	return c.JSON(http.StatusOK, protocols.GetMemoryStats())
+}
+
+// handleStartTunnel starts the tunnel named by {"server": ...} in the body
+// or by ?server=, which may be "tag:<tag>"
 func (a *Application) handleStartTunnel(c echo.Context) error {
-	serverID := c.QueryParam("server")
+	serverID, err := tunnelTarget(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	if serverID == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "server is required",
+		})
+	}
 	if err := a.tunnelMgr.StartTunnel(serverID); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": err.Error(),
@@ -339,8 +1012,20 @@ func (a *Application) handleStartTunnel(c echo.Context) error {
 	})
 }
 
+// handleStopTunnel stops the tunnel named in the body or by ?server=, as
+// for start, or else every tunnel
 func (a *Application) handleStopTunnel(c echo.Context) error {
-	if err := a.tunnelMgr.StopAllTunnels(); err != nil {
+	serverID, err := tunnelTarget(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	stop := a.tunnelMgr.StopAllTunnels
+	if serverID != "" {
+		stop = func() error { return a.tunnelMgr.StopTunnel(serverID) }
+	}
+	if err := stop(); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": err.Error(),
 		})
@@ -351,8 +1036,20 @@ func (a *Application) handleStopTunnel(c echo.Context) error {
 	})
 }
 
+// handleRestartTunnel restarts the tunnel named in the body or by ?server=,
+// as for start, or else every running tunnel
 func (a *Application) handleRestartTunnel(c echo.Context) error {
-	if err := a.tunnelMgr.RestartTunnels(); err != nil {
+	serverID, err := tunnelTarget(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	restart := a.tunnelMgr.RestartTunnels
+	if serverID != "" {
+		restart = func() error { return a.tunnelMgr.RestartTunnel(serverID) }
+	}
+	if err := restart(); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": err.Error(),
 		})
@@ -363,6 +1060,54 @@ func (a *Application) handleRestartTunnel(c echo.Context) error {
 	})
 }
 
+// handleTunnelAction starts, stops or restarts the tunnel in the path,
+// answering 404 for one that does not exist
+func (a *Application) handleTunnelAction(c echo.Context) error {
+	name := c.Param("name")
+	if !a.tunnelMgr.HasTunnel(name) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": fmt.Sprintf("Tunnel %s not found", name),
+		})
+	}
+
+	var err error
+	var done string
+	switch path.Base(c.Path()) {
+	case "start":
+		done, err = "started", a.tunnelMgr.StartTunnel(name)
+	case "stop":
+		done, err = "stopped", a.tunnelMgr.StopTunnel(name)
+	case "restart":
+		done, err = "restarted", a.tunnelMgr.RestartTunnel(name)
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Tunnel %s %s", name, done),
+	})
+}
+
+// tunnelTarget returns the server a tunnel request names, by
+// {"server": ...} in the body or by ?server=
+func tunnelTarget(c echo.Context) (string, error) {
+	var req struct {
+		Server string `json:"server"`
+	}
+	if c.Request().ContentLength != 0 {
+		if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil && err != io.EOF {
+			return "", fmt.Errorf("invalid request body: %v", err)
+		}
+	}
+	if req.Server == "" {
+		req.Server = c.QueryParam("server")
+	}
+	return req.Server, nil
+}
+
 func (a *Application) handleMetrics(c echo.Context) error {
 	if a.monitor == nil {
 		return c.JSON(http.StatusNotFound, map[string]string{
@@ -374,6 +1119,35 @@ func (a *Application) handleMetrics(c echo.Context) error {
 	return c.JSON(http.StatusOK, metrics)
 }
 
+// handleMetricsHistory returns stored metrics for the last ?since= period
+// (default 1h)
+func (a *Application) handleMetricsHistory(c echo.Context) error {
+	if a.monitor == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Monitoring not enabled",
+		})
+	}
+
+	period := time.Hour
+	if since := c.QueryParam("since"); since != "" {
+		d, err := time.ParseDuration(since)
+		if err != nil || d <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "invalid since duration",
+			})
+		}
+		period = d
+	}
+
+	history, err := a.monitor.GetMetricsHistory(time.Now().Add(-period))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, history)
+}
+
 func (a *Application) handleLogs(c echo.Context) error {
 	if a.monitor == nil {
 		return c.JSON(http.StatusNotFound, map[string]string{
@@ -385,6 +1159,17 @@ func (a *Application) handleLogs(c echo.Context) error {
 	return c.JSON(http.StatusOK, logs)
 }
 
+func (a *Application) handleAlerts(c echo.Context) error {
+	if a.monitor == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Monitoring not enabled",
+		})
+	}
+
+	alerts := a.monitor.GetAlerts()
+	return c.JSON(http.StatusOK, alerts)
+}
+
 // validateConfig validates the configuration
 func (a *Application) validateConfig(cfg *config.Config) error {
 	// Basic validation logic here
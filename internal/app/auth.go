@@ -0,0 +1,254 @@
+package app
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+
+	"ssh-tunnel/internal/config"
+)
+
+// The login endpoints are served without authentication
+const (
+	loginPath   = "/api/v1/auth/login"
+	refreshPath = "/api/v1/auth/refresh"
+)
+
+// Token types, in the token_type claim, so a refresh token cannot be used
+// as an access token
+const (
+	accessToken  = "access"
+	refreshToken = "refresh"
+)
+
+// tokenClaims are the claims of the JWTs the API issues; the subject is
+// the user name
+type tokenClaims struct {
+	jwt.StandardClaims
+	TokenType string `json:"token_type"`
+	Role      string `json:"role,omitempty"` // For clients; the user's current role is what is enforced
+}
+
+// tokenKeys sign and verify JWTs for one JWT configuration
+type tokenKeys struct {
+	config config.JWTConfig
+	method jwt.SigningMethod
+	sign   interface{}
+	verify interface{}
+}
+
+// jwtKeys returns the keys of the current JWT configuration, loading them
+// again when it changed
+func (a *Application) jwtKeys() (*tokenKeys, error) {
+	a.mu.RLock()
+	cfg := a.config.Security.JWT
+	a.mu.RUnlock()
+
+	a.keysMu.Lock()
+	defer a.keysMu.Unlock()
+	if a.keys != nil && a.keys.config == cfg {
+		return a.keys, nil
+	}
+
+	keys := &tokenKeys{config: cfg}
+	switch cfg.Algorithm {
+	case "HS256":
+		keys.method = jwt.SigningMethodHS256
+		keys.sign, keys.verify = []byte(cfg.Secret), []byte(cfg.Secret)
+	case "RS256":
+		data, err := os.ReadFile(cfg.PrivateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWT private key: %v", err)
+		}
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse JWT private key: %v", err)
+		}
+		keys.method = jwt.SigningMethodRS256
+		keys.sign, keys.verify = key, &key.PublicKey
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm: %s", cfg.Algorithm)
+	}
+	a.keys = keys
+	return keys, nil
+}
+
+// issueToken signs a token of the given type for a user
+func (keys *tokenKeys) issueToken(user config.APIUser, tokenType string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   user.Name,
+			Issuer:    keys.config.Issuer,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+		TokenType: tokenType,
+		Role:      userRole(user),
+	}
+	return jwt.NewWithClaims(keys.method, claims).SignedString(keys.sign)
+}
+
+// parseToken verifies a token of the given type and returns its claims
+func (keys *tokenKeys) parseToken(token, tokenType string) (*tokenClaims, error) {
+	claims := &tokenClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method.Alg() != keys.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+		}
+		return keys.verify, nil
+	})
+	if err != nil {
+		if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&jwt.ValidationErrorExpired != 0 {
+			return nil, fmt.Errorf("token expired")
+		}
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+	if !claims.VerifyIssuer(keys.config.Issuer, true) || claims.TokenType != tokenType || claims.Subject == "" {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return claims, nil
+}
+
+// isJWT reports whether a bearer token has the shape of a JWT rather than
+// a static token
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// findUser returns the security user with the given name
+func (a *Application) findUser(name string) (config.APIUser, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, user := range a.config.Security.Users {
+		if user.Name == name {
+			return user, true
+		}
+	}
+	return config.APIUser{}, false
+}
+
+// checkPassword compares a password with a user's, in constant time or
+// with bcrypt
+func checkPassword(user config.APIUser, password string) bool {
+	if user.PasswordHash != "" {
+		return bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1
+}
+
+// tokenResponse is the answer of the login and refresh endpoints
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"` // Always Bearer
+	ExpiresIn    int    `json:"expires_in"` // Seconds
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Role         string `json:"role"`
+}
+
+// handleLogin exchanges a user's name and password for an access token
+// and a refresh token
+func (a *Application) handleLogin(c echo.Context) error {
+	keys, err := a.loginKeys(c)
+	if keys == nil {
+		return err
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request format",
+		})
+	}
+
+	user, ok := a.findUser(req.Username)
+	if !ok || !checkPassword(user, req.Password) {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Invalid username or password",
+		})
+	}
+
+	return a.issueTokens(c, keys, user, true)
+}
+
+// handleRefresh exchanges a refresh token for a new access token, as long
+// as its user still exists
+func (a *Application) handleRefresh(c echo.Context) error {
+	keys, err := a.loginKeys(c)
+	if keys == nil {
+		return err
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request format",
+		})
+	}
+
+	claims, err := keys.parseToken(req.RefreshToken, refreshToken)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": fmt.Sprintf("Invalid refresh token: %v", err),
+		})
+	}
+	user, ok := a.findUser(claims.Subject)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Invalid refresh token: unknown user",
+		})
+	}
+
+	return a.issueTokens(c, keys, user, false)
+}
+
+// loginKeys returns the JWT keys, or nil after answering that logins are
+// not possible
+func (a *Application) loginKeys(c echo.Context) (*tokenKeys, error) {
+	a.mu.RLock()
+	enabled := a.config.Security.EnableAuth && a.config.Security.JWT.Enabled
+	a.mu.RUnlock()
+	if !enabled {
+		return nil, c.JSON(http.StatusNotFound, map[string]string{
+			"error": "JWT authentication is not enabled",
+		})
+	}
+
+	keys, err := a.jwtKeys()
+	if err != nil {
+		return nil, c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	return keys, nil
+}
+
+// issueTokens answers with a new access token for user, and a refresh
+// token as well when withRefresh is set
+func (a *Application) issueTokens(c echo.Context, keys *tokenKeys, user config.APIUser, withRefresh bool) error {
+	resp := tokenResponse{TokenType: "Bearer", ExpiresIn: int(keys.config.TTL.Seconds()), Role: userRole(user)}
+
+	var err error
+	if resp.AccessToken, err = keys.issueToken(user, accessToken, keys.config.TTL); err == nil && withRefresh {
+		resp.RefreshToken, err = keys.issueToken(user, refreshToken, keys.config.RefreshTTL)
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to sign token: %v", err),
+		})
+	}
+	return c.JSON(http.StatusOK, resp)
+}
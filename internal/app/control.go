@@ -0,0 +1,338 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/mux"
+)
+
+const (
+	controlDialTimeout = 15 * time.Second
+	controlMinBackoff  = time.Second
+	controlMaxBackoff  = time.Minute
+)
+
+// agentConnectPath is where instances open their control channels. Agents
+// authenticate there with their security agents token, not an API token.
+const agentConnectPath = "/api/v1/agents/connect"
+
+// relayedRoleHeader carries the role the controller allowed a relayed
+// call; the caller's own credentials are not passed on to the instance
+const relayedRoleHeader = "X-Relayed-Role"
+
+// relayedCallKey marks requests that arrived over the control channel
+type relayedCallKey struct{}
+
+// agent is an instance managed over its control channel. The controller
+// opens a stream on the channel for every API call it relays.
+type agent struct {
+	name    string
+	addr    string
+	since   time.Time
+	session *mux.Session
+	proxy   *httputil.ReverseProxy
+}
+
+// sessionListener serves the streams a controller opens as connections
+type sessionListener struct {
+	session *mux.Session
+}
+
+func (l sessionListener) Accept() (net.Conn, error) { return l.session.Accept() }
+func (l sessionListener) Close() error              { return l.session.Close() }
+func (l sessionListener) Addr() net.Addr            { return controlAddr{} }
+
+type controlAddr struct{}
+
+func (controlAddr) Network() string { return "control" }
+func (controlAddr) String() string  { return "control" }
+
+// runControlChannel keeps the control channel to the controller open,
+// reconnecting with backoff, until the application shuts down
+func (a *Application) runControlChannel() {
+	ctl := a.config.Control
+	if ctl.Insecure && strings.HasPrefix(ctl.URL, "wss:") {
+		log.Printf("🚨 INSECURE: the controller's certificate is not verified (control insecure), the control channel can be intercepted")
+	}
+	backoff := controlMinBackoff
+	for {
+		start := time.Now()
+		err := a.serveControlChannel()
+		if a.ctx.Err() != nil {
+			return
+		}
+
+		// A channel that stayed up for a while starts the backoff over
+		if time.Since(start) > controlMaxBackoff {
+			backoff = controlMinBackoff
+		}
+		log.Printf("Control channel to %s lost: %v; reconnecting in %v", ctl.URL, err, backoff)
+
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > controlMaxBackoff {
+			backoff = controlMaxBackoff
+		}
+	}
+}
+
+// serveControlChannel connects to the controller and serves the API calls
+// it relays until the channel drops
+func (a *Application) serveControlChannel() error {
+	conn, err := a.dialControl()
+	if err != nil {
+		return err
+	}
+
+	session := mux.Server(conn)
+	defer session.Close()
+	go func() {
+		select {
+		case <-a.ctx.Done():
+			session.Close()
+		case <-session.Done():
+		}
+	}()
+
+	log.Printf("Control channel connected to %s as %s", a.config.Control.URL, a.config.Control.Name)
+
+	server := &http.Server{
+		Handler:           a.server,
+		ReadHeaderTimeout: 30 * time.Second,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, relayedCallKey{}, true)
+		},
+	}
+	return server.Serve(sessionListener{session})
+}
+
+// dialControl opens the WebSocket to the controller, through the configured
+// tunnel if any
+func (a *Application) dialControl() (net.Conn, error) {
+	ctl := a.config.Control
+	u, err := url.Parse(ctl.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid control url: %v", err)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+
+	var conn net.Conn
+	if ctl.Server != "" {
+		conn, err = a.tunnelMgr.DialTunnel(ctl.Server, "tcp", addr)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, controlDialTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to controller %s: %v", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(controlDialTimeout))
+
+	origin := "http://" + u.Host
+	if u.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: ctl.Insecure,
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with controller %s failed: %v", addr, err)
+		}
+		conn = tlsConn
+		origin = "https://" + u.Host
+	}
+
+	query := u.Query()
+	query.Set("name", ctl.Name)
+	u.RawQuery = query.Encode()
+	wsConfig, err := websocket.NewConfig(u.String(), origin)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("invalid control url: %v", err)
+	}
+	if ctl.Token != "" {
+		wsConfig.Header.Set("Authorization", "Bearer "+ctl.Token)
+	}
+
+	ws, err := websocket.NewClient(wsConfig, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake with controller failed: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// isRelayedCall reports whether a request is an API call a controller
+// relayed over the control channel
+func isRelayedCall(c echo.Context) bool {
+	return c.Request().Context().Value(relayedCallKey{}) != nil
+}
+
+// authorizeRelayedCall gives a call relayed by the controller the role the
+// controller allowed it, up to the control role of this instance
+func (a *Application) authorizeRelayedCall(c echo.Context, next echo.HandlerFunc) error {
+	role := c.Request().Header.Get(relayedRoleHeader)
+	if !config.IsRole(role) {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "Relayed call without a role",
+		})
+	}
+	if limit := a.config.Control.Role; !config.RoleAllows(limit, role) {
+		role = limit
+	}
+	return authorize(c, next, "Controller", role)
+}
+
+// checkAgent reports whether token is the security agents token of the
+// agent name
+func (a *Application) checkAgent(name, token string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, agent := range a.config.Security.Agents {
+		if agent.Name == name {
+			return subtle.ConstantTimeCompare([]byte(agent.Token), []byte(token)) == 1
+		}
+	}
+	return false
+}
+
+// handleAgentConnect accepts an instance's control channel and keeps the
+// instance registered until the channel drops. Each agent name is bound to
+// its own token, so no other credential can take the name over.
+func (a *Application) handleAgentConnect(c echo.Context) error {
+	name := c.QueryParam("name")
+	if name == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Agent name required",
+		})
+	}
+	token := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+	if !a.checkAgent(name, token) {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": fmt.Sprintf("Invalid token for agent %s", name),
+		})
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		session := mux.Client(ws)
+		ag := &agent{
+			name:    name,
+			addr:    c.RealIP(),
+			since:   time.Now(),
+			session: session,
+			proxy: &httputil.ReverseProxy{
+				Director: func(req *http.Request) {
+					req.URL.Scheme = "http"
+					req.URL.Host = name
+				},
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+						return session.Open()
+					},
+					IdleConnTimeout: 90 * time.Second,
+				},
+			},
+		}
+
+		// A reconnecting instance replaces its stale channel
+		a.mu.Lock()
+		if old := a.agents[name]; old != nil {
+			old.session.Close()
+		}
+		a.agents[name] = ag
+		a.mu.Unlock()
+		log.Printf("Agent %s connected from %s", name, ag.addr)
+
+		select {
+		case <-session.Done():
+		case <-a.ctx.Done():
+			session.Close()
+		}
+
+		a.mu.Lock()
+		if a.agents[name] == ag {
+			delete(a.agents, name)
+		}
+		a.mu.Unlock()
+		log.Printf("Agent %s disconnected", name)
+	}).ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+func (a *Application) handleGetAgents(c echo.Context) error {
+	a.mu.RLock()
+	agents := make([]map[string]interface{}, 0, len(a.agents))
+	for _, ag := range a.agents {
+		agents = append(agents, map[string]interface{}{
+			"name":            ag.name,
+			"address":         ag.addr,
+			"connected_since": ag.since,
+			"active_calls":    ag.session.NumStreams(),
+		})
+	}
+	a.mu.RUnlock()
+
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i]["name"].(string) < agents[j]["name"].(string)
+	})
+	return c.JSON(http.StatusOK, agents)
+}
+
+// handleAgentRelay forwards an API call to an instance over its control
+// channel: /api/v1/agents/<name>/<path> becomes /api/v1/<path> on the
+// instance. The caller's credentials stay here; the instance gets the
+// caller's role instead and checks the call against it.
+func (a *Application) handleAgentRelay(c echo.Context) error {
+	name := c.Param("name")
+	a.mu.RLock()
+	ag := a.agents[name]
+	a.mu.RUnlock()
+
+	if ag == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": fmt.Sprintf("Agent %s not connected", name),
+		})
+	}
+
+	// Without authentication here, any caller may do anything
+	role, _ := c.Get("role").(string)
+	if role == "" {
+		role = config.RoleAdmin
+	}
+
+	req := c.Request()
+	req.URL.Path = "/api/v1/" + c.Param("*")
+	req.URL.RawPath = ""
+	req.Header.Del("Authorization")
+	req.Header.Set(relayedRoleHeader, role)
+	ag.proxy.ServeHTTP(c.Response(), req)
+	return nil
+}
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"ssh-tunnel/internal/crash"
+	"ssh-tunnel/internal/monitoring"
+	"ssh-tunnel/internal/recorder"
+)
+
+// crashLogEntries is how many recent log entries a crash report carries
+const crashLogEntries = 50
+
+// configureCrashReports attaches the application's state to crash reports
+// and raises an alert for each crash when configured
+func (a *Application) configureCrashReports() {
+	crash.Configure(a.config.Crash, crash.Handler{
+		Version: a.config.Version,
+		Collect: a.collectCrashState,
+		Notify: func(r crash.Report) {
+			if !a.config.Crash.Alert || a.monitor == nil {
+				return
+			}
+			message := fmt.Sprintf("%s panicked and was restarted: %s", r.Subsystem, r.Panic)
+			if r.Path != "" {
+				message += fmt.Sprintf(" (crash report %s)", r.Path)
+			}
+			a.monitor.RaiseAlert(monitoring.Alert{
+				Severity: monitoring.SeverityCritical,
+				Metric:   "crash",
+				Message:  message,
+				Value:    float64(crash.Count()),
+			})
+		},
+	})
+}
+
+// collectCrashState adds the sanitized configuration, tunnel status and
+// recent events and log entries to a crash report
+func (a *Application) collectCrashState(r *crash.Report) {
+	r.Config = recorder.SanitizeObject(a.config)
+
+	if tunnels, err := json.Marshal(a.tunnelMgr.GetStatus()); err == nil {
+		r.Tunnels = tunnels
+	}
+
+	recent := map[string]interface{}{}
+	backlog, _, cancel := a.events.Subscribe(0)
+	cancel()
+	if len(backlog) > 0 {
+		recent["config_changes"] = backlog
+	}
+	if a.monitor != nil {
+		logs := a.monitor.GetLogs()
+		if len(logs) > crashLogEntries {
+			logs = logs[len(logs)-crashLogEntries:]
+		}
+		recent["logs"] = recorder.SanitizeObject(logs)
+	}
+	if len(recent) > 0 {
+		r.Events = recent
+	}
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// registerDebugRoutes serves the runtime profiling endpoints under
+// /api/v1/debug, for profiling the proxy path in production. They are only
+// registered with api.debug, which requires token authentication.
+func (a *Application) registerDebugRoutes(api *echo.Group) {
+	debug := api.Group("/debug")
+
+	// net/http/pprof, with the profile name taken from the route since its
+	// index only recognizes profiles under /debug/pprof/
+	debug.GET("/pprof", func(c echo.Context) error {
+		return c.Redirect(http.StatusMovedPermanently, c.Request().URL.Path+"/")
+	})
+	debug.GET("/pprof/", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+	debug.GET("/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	debug.GET("/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	debug.GET("/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	debug.POST("/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	debug.GET("/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	debug.GET("/pprof/:profile", func(c echo.Context) error {
+		name := c.Param("profile")
+		if runtimepprof.Lookup(name) == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Unknown profile " + name,
+			})
+		}
+		pprof.Handler(name).ServeHTTP(c.Response(), c.Request())
+		return nil
+	})
+
+	debug.GET("/vars", echo.WrapHandler(expvar.Handler()))
+	debug.GET("/goroutines", a.handleGoroutines)
+}
+
+// handleGoroutines dumps the stack of every goroutine as text, grouped by
+// identical stacks with ?debug=1
+func (a *Application) handleGoroutines(c echo.Context) error {
+	level := 2
+	if d := c.QueryParam("debug"); d != "" {
+		var err error
+		if level, err = strconv.Atoi(d); err != nil || level < 1 || level > 2 {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid debug, expected 1 or 2",
+			})
+		}
+	}
+
+	c.Response().Header().Set("Content-Type", "text/plain; charset=utf-8")
+	c.Response().Header().Set("X-Goroutines", strconv.Itoa(runtime.NumGoroutine()))
+	c.Response().WriteHeader(http.StatusOK)
+	return runtimepprof.Lookup("goroutine").WriteTo(c.Response(), level)
+}
@@ -0,0 +1,353 @@
+package app
+
+import (
+	_ "embed"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	swaggerFiles "github.com/swaggo/files/v2"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/protocols"
+)
+
+// docsPage is the interactive API documentation: Swagger UI, from the
+// embedded assets, rendering the served OpenAPI document and sending
+// requests with the token it is given.
+//
+//go:embed web/docs.html
+var docsPage []byte
+
+// docsPath, its Swagger UI assets and openAPIPath are served without
+// authentication, like the mesh dashboard
+const (
+	docsPath       = "/docs"
+	docsAssetsPath = "/docs/*"
+	openAPIPath    = "/api/v1/openapi.json"
+)
+
+// apiOperation describes an endpoint for the OpenAPI document. The paths
+// are the routes' own; routes left out of apiOperations are documented
+// from the route alone.
+type apiOperation struct {
+	tag     string
+	summary string
+	query   []string // Query parameters
+	body    string   // The request body's schema, under components
+	result  string   // The response's schema, under components
+}
+
+// apiOperations are keyed by "METHOD /path", with the path as registered
+var apiOperations = map[string]apiOperation{
+	"GET /api/v1/health":                 {tag: "system", summary: "Health, with startup failures and required servers that are down"},
+	"GET /api/v1/ready":                  {tag: "system", summary: "200 while every required server is connected, 503 otherwise"},
+	"GET /api/v1/status":                 {tag: "system", summary: "Status of every tunnel", result: "TunnelStatusMap"},
+	"GET /api/v1/status/startup":         {tag: "system", summary: "How every server and listener fared at startup"},
+	"GET /api/v1/platform":               {tag: "system", summary: "Platform-specific subsystems this build can run"},
+	"GET /api/v1/config":                 {tag: "config", summary: "The configuration, without secrets", result: "Config"},
+	"PUT /api/v1/config":                 {tag: "config", summary: "Replace the configuration", body: "Config"},
+	"GET /api/v1/events":                 {tag: "config", summary: "Stream of application events, over a WebSocket or as Server-Sent Events", query: []string{"since", "types"}},
+	"GET /api/v1/ws":                     {tag: "system", summary: "WebSocket stream of tunnel status changes, traffic and log lines", query: []string{"interval", "logs"}},
+	"GET /api/v1/openapi.json":           {tag: "system", summary: "This document"},
+	"POST /api/v1/auth/login":            {tag: "auth", summary: "Log in as a security user for an access and a refresh token", body: "Login", result: "Token"},
+	"POST /api/v1/auth/refresh":          {tag: "auth", summary: "Exchange a refresh token for a new access token", body: "Refresh", result: "Token"},
+	"GET /api/v1/keys":                   {tag: "auth", summary: "List API keys, without their secrets", result: "APIKeyList"},
+	"POST /api/v1/keys":                  {tag: "auth", summary: "Create an API key; the key is only shown in this answer", body: "CreateKey", result: "CreatedKey"},
+	"DELETE /api/v1/keys/:id":            {tag: "auth", summary: "Revoke an API key by ID or name"},
+	"GET /api/v1/servers":                {tag: "servers", summary: "List servers, without secrets", result: "ServerList"},
+	"POST /api/v1/servers":               {tag: "servers", summary: "Add a server and register its tunnel", body: "Server", result: "Server"},
+	"PUT /api/v1/servers/:id":            {tag: "servers", summary: "Replace a server, recreating its tunnel", body: "Server", result: "Server"},
+	"DELETE /api/v1/servers/:id":         {tag: "servers", summary: "Remove a server and stop its tunnel"},
+	"POST /api/v1/servers/:id/test":      {tag: "servers", summary: "Test a server's latency; the id may be tag:<tag>"},
+	"POST /api/v1/servers/:id/bench":     {tag: "servers", summary: "Benchmark a connected tunnel", query: []string{"mb", "target"}},
+	"GET /api/v1/tunnels":                {tag: "tunnels", summary: "Tunnel configurations", result: "ServerList"},
+	"POST /api/v1/tunnels/start":         {tag: "tunnels", summary: "Start the tunnel named by server", query: []string{"server"}, body: "TunnelTarget"},
+	"POST /api/v1/tunnels/stop":          {tag: "tunnels", summary: "Stop the tunnel named by server, or every tunnel", query: []string{"server"}, body: "TunnelTarget"},
+	"POST /api/v1/tunnels/restart":       {tag: "tunnels", summary: "Restart the tunnel named by server, or every running tunnel", query: []string{"server"}, body: "TunnelTarget"},
+	"POST /api/v1/tunnels/:name/start":   {tag: "tunnels", summary: "Start a tunnel"},
+	"POST /api/v1/tunnels/:name/stop":    {tag: "tunnels", summary: "Stop a tunnel"},
+	"POST /api/v1/tunnels/:name/restart": {tag: "tunnels", summary: "Restart a tunnel"},
+	"GET /api/v1/connections":            {tag: "tunnels", summary: "SSH connections with their channels"},
+	"GET /api/v1/connections/:tunnel":    {tag: "tunnels", summary: "A tunnel's SSH connections"},
+	"GET /api/v1/memory":                 {tag: "tunnels", summary: "Memory held by proxied connections"},
+	"GET /api/v1/agents":                 {tag: "agents", summary: "Instances connected over control channels"},
+	"GET /api/v1/agents/connect":         {tag: "agents", summary: "WebSocket an instance opens its control channel on", query: []string{"name"}},
+	"GET /api/v1/metrics":                {tag: "monitoring", summary: "Current metrics"},
+	"GET /api/v1/metrics/history":        {tag: "monitoring", summary: "Stored metrics", query: []string{"since"}},
+	"GET /api/v1/logs":                   {tag: "monitoring", summary: "Recent log entries"},
+	"GET /api/v1/alerts":                 {tag: "monitoring", summary: "Active alerts"},
+	"GET /api/v1/mesh/status":            {tag: "mesh", summary: "Nodes with latency, loss and traffic"},
+	"GET /api/v1/mesh/latency":           {tag: "mesh", summary: "The latency matrix"},
+	"GET /api/v1/mesh/history":           {tag: "mesh", summary: "Node events, oldest first", query: []string{"node"}},
+	"GET /api/v1/mesh/nodes":             {tag: "mesh", summary: "Nodes, pending ones included"},
+	"POST /api/v1/mesh/nodes":            {tag: "mesh", summary: "Create a join token"},
+	"PATCH /api/v1/mesh/nodes/:id":       {tag: "mesh", summary: "Edit a node's region, tags, labels and capabilities"},
+	"DELETE /api/v1/mesh/nodes/:id":      {tag: "mesh", summary: "Remove a node", query: []string{"revoke_token"}},
+	"GET /api/v1/debug/goroutines":       {tag: "debug", summary: "Goroutine stacks as text", query: []string{"debug"}},
+	"GET /api/v1/debug/vars":             {tag: "debug", summary: "expvar variables"},
+	"GET /api/v1/agents/:name/*":         {tag: "agents", summary: "Relay a call to /api/v1/<path> on a connected instance"},
+	"POST /api/v1/agents/:name/*":        {tag: "agents", summary: "Relay a call to /api/v1/<path> on a connected instance"},
+	"PUT /api/v1/agents/:name/*":         {tag: "agents", summary: "Relay a call to /api/v1/<path> on a connected instance"},
+	"PATCH /api/v1/agents/:name/*":       {tag: "agents", summary: "Relay a call to /api/v1/<path> on a connected instance"},
+	"DELETE /api/v1/agents/:name/*":      {tag: "agents", summary: "Relay a call to /api/v1/<path> on a connected instance"},
+}
+
+// openAPIMethods are the methods OpenAPI describes; routes registered for
+// any method are documented for these
+var openAPIMethods = map[string]bool{
+	http.MethodGet: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true,
+}
+
+// apiParameters describes the query parameters apiOperations name
+var apiParameters = map[string]string{
+	"since":        "Event ID to replay from, or a duration such as 1h for metrics",
+	"types":        "Comma-separated event types or categories",
+	"server":       "Server name, or tag:<tag>",
+	"mb":           "Megabytes to transfer",
+	"target":       "Speed helper address",
+	"name":         "The connecting instance's name",
+	"node":         "Node name",
+	"revoke_token": "Also revoke the node's join token",
+	"debug":        "1 groups identical stacks",
+	"interval":     "How often traffic is sent, such as 1s",
+	"logs":         "false leaves out log lines",
+}
+
+// registerDocsRoutes serves the OpenAPI document and the page rendering it
+func (a *Application) registerDocsRoutes(api *echo.Group) {
+	page := func(c echo.Context) error {
+		return c.Blob(http.StatusOK, "text/html; charset=utf-8", docsPage)
+	}
+	assets := echo.WrapHandler(http.StripPrefix(docsPath+"/", http.FileServer(http.FS(swaggerFiles.FS))))
+	a.server.GET(docsPath, page)
+	a.server.GET(docsAssetsPath, func(c echo.Context) error {
+		// Swagger UI's own index page points at its demo document
+		if file := c.Param("*"); file == "" || file == "index.html" {
+			return page(c)
+		}
+		return assets(c)
+	})
+	api.GET("/openapi.json", a.handleOpenAPI)
+}
+
+// handleOpenAPI returns an OpenAPI 3 document of the API, generated from
+// the routes registered, so it covers the endpoints this instance serves
+func (a *Application) handleOpenAPI(c echo.Context) error {
+	paths := make(map[string]map[string]interface{})
+	for _, route := range a.server.Routes() {
+		if !strings.HasPrefix(route.Path, "/api/v1/") || !openAPIMethods[route.Method] {
+			continue
+		}
+		path, params := openAPIRoute(route.Path)
+		op := apiOperations[route.Method+" "+route.Path]
+		if op.tag == "" {
+			op.tag = strings.SplitN(strings.TrimPrefix(route.Path, "/api/v1/"), "/", 2)[0]
+		}
+
+		operation := map[string]interface{}{
+			"tags":      []string{op.tag},
+			"summary":   op.summary,
+			"responses": openAPIResponses(op.result),
+		}
+		for _, name := range op.query {
+			params = append(params, map[string]interface{}{
+				"name":        name,
+				"in":          "query",
+				"description": apiParameters[name],
+				"schema":      map[string]string{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.body != "" {
+			operation["requestBody"] = map[string]interface{}{
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemaRef(op.body)},
+				},
+			}
+		}
+
+		if route.Path == loginPath || route.Path == refreshPath {
+			operation["security"] = []interface{}{} // They take credentials of their own
+		}
+
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(route.Method)] = operation
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "SSH Tunnel Manager API",
+			"version": a.config.Version,
+		},
+		"servers": []map[string]string{{"url": "/"}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"Server":          jsonSchema(reflect.TypeOf(config.Server{}), nil),
+				"ServerList":      map[string]interface{}{"type": "array", "items": schemaRef("Server")},
+				"Config":          jsonSchema(reflect.TypeOf(config.Config{}), nil),
+				"TunnelStatusMap": map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(reflect.TypeOf(protocols.TunnelStatus{}), nil)},
+				"Login": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"username": map[string]string{"type": "string"},
+						"password": map[string]string{"type": "string"},
+					},
+				},
+				"Refresh": map[string]interface{}{
+					"type":       "object",
+					"properties": map[string]interface{}{"refresh_token": map[string]string{"type": "string"}},
+				},
+				"Token":      jsonSchema(reflect.TypeOf(tokenResponse{}), nil),
+				"APIKeyList": map[string]interface{}{"type": "array", "items": jsonSchema(reflect.TypeOf(config.APIKey{}), nil)},
+				"CreateKey":  jsonSchema(reflect.TypeOf(createKeyRequest{}), nil),
+				"CreatedKey": jsonSchema(reflect.TypeOf(createKeyResponse{}), nil),
+				"TunnelTarget": map[string]interface{}{
+					"type":       "object",
+					"properties": map[string]interface{}{"server": map[string]string{"type": "string"}},
+				},
+				"Error": map[string]interface{}{
+					"type":       "object",
+					"properties": map[string]interface{}{"error": map[string]string{"type": "string"}},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+	if a.config.Security.EnableAuth {
+		doc["security"] = []map[string][]string{{"bearer": {}}}
+	}
+	return c.JSON(http.StatusOK, doc)
+}
+
+// openAPIRoute turns an Echo route into an OpenAPI path, with its path
+// parameters: :id becomes {id}, and a trailing * becomes {path}
+func openAPIRoute(route string) (string, []interface{}) {
+	var params []interface{}
+	segments := strings.Split(route, "/")
+	for i, segment := range segments {
+		name := ""
+		switch {
+		case strings.HasPrefix(segment, ":"):
+			name = segment[1:]
+		case segment == "*":
+			name = "path"
+		default:
+			continue
+		}
+		segments[i] = "{" + name + "}"
+		params = append(params, map[string]interface{}{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]string{"type": "string"},
+		})
+	}
+	return strings.Join(segments, "/"), params
+}
+
+// openAPIResponses describes the answers every handler gives: JSON, or an
+// error object
+func openAPIResponses(result string) map[string]interface{} {
+	ok := map[string]interface{}{"description": "Success"}
+	if result != "" {
+		ok["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemaRef(result)},
+		}
+	}
+	errorContent := map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schemaRef("Error")},
+	}
+	return map[string]interface{}{
+		"200":     ok,
+		"default": map[string]interface{}{"description": "Error", "content": errorContent},
+	}
+}
+
+func schemaRef(name string) map[string]string {
+	return map[string]string{"$ref": "#/components/schemas/" + name}
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// jsonSchema describes how t marshals to JSON. Types being described
+// further up, which would recurse, are left as plain objects.
+func jsonSchema(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == durationType:
+		return map[string]interface{}{"type": "integer", "description": "Nanoseconds"}
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return map[string]interface{}{"type": "object"}
+		}
+		inner := map[reflect.Type]bool{t: true}
+		for k := range seen {
+			inner[k] = true
+		}
+		properties := make(map[string]interface{})
+		addStructProperties(t, inner, properties)
+		return map[string]interface{}{"type": "object", "properties": properties}
+	}
+	return map[string]interface{}{}
+}
+
+// addStructProperties adds the JSON fields of struct t, those of embedded
+// structs included, to properties
+func addStructProperties(t reflect.Type, seen map[reflect.Type]bool, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addStructProperties(field.Type, seen, properties)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = jsonSchema(field.Type, seen)
+	}
+}
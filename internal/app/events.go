@@ -0,0 +1,189 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/events"
+	"ssh-tunnel/internal/mesh"
+	"ssh-tunnel/internal/protocols"
+)
+
+// handleEvents streams application events: configuration changes, tunnels
+// going up and down, failovers, config reloads and mesh changes. A
+// WebSocket client gets them as JSON messages, any other client as
+// Server-Sent Events. ?since=<id> (or the Last-Event-ID header) first
+// replays the recent events after that ID, so a client reconnecting with
+// the last ID it saw misses nothing; ?types= takes a comma-separated list
+// of event types or categories.
+func (a *Application) handleEvents(c echo.Context) error {
+	since := uint64(math.MaxUint64) // Only new events
+	s := c.QueryParam("since")
+	if s == "" {
+		s = c.Request().Header.Get("Last-Event-ID")
+	}
+	if s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid since",
+			})
+		}
+	}
+	var types []string
+	if t := c.QueryParam("types"); t != "" {
+		types = strings.Split(t, ",")
+	}
+
+	backlog, ch, cancel := a.events.Subscribe(since)
+	defer cancel()
+
+	if c.IsWebSocket() {
+		websocket.Handler(func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			// The client sends nothing; a failed read means it went away
+			ctx, stop := context.WithCancel(a.ctx)
+			defer stop()
+			go func() {
+				var discard []byte
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+				stop()
+			}()
+
+			streamEvents(ctx, backlog, ch, types, func(event events.Event) error {
+				return websocket.JSON.Send(ws, event)
+			})
+		}).ServeHTTP(c.Response(), c.Request())
+		return nil
+	}
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	ctx, stop := context.WithCancel(a.ctx)
+	defer stop()
+	go func() {
+		select {
+		case <-c.Request().Context().Done():
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+
+	streamEvents(ctx, backlog, ch, types, func(event events.Event) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+			return err
+		}
+		w.Flush()
+		return nil
+	})
+	return nil
+}
+
+// streamEvents sends the backlog, then new events, until ctx is done or
+// the client falls behind
+func streamEvents(ctx context.Context, backlog []events.Event, ch <-chan events.Event, types []string, send func(events.Event) error) {
+	for _, event := range backlog {
+		if config.MatchesEvent(types, event.Type) {
+			if send(event) != nil {
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return // Fell behind or shutting down
+			}
+			if config.MatchesEvent(types, event.Type) && send(event) != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// publishTunnelEvents publishes tunnel.up when a tunnel connects and
+// tunnel.down when a connected tunnel stops being connected, including by
+// being removed
+func (a *Application) publishTunnelEvents() {
+	changed, stopWatch := a.tunnelMgr.Watch()
+	defer stopWatch()
+
+	connected := string(protocols.StateConnected)
+	states := make(map[string]string)
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-changed:
+		}
+
+		status := a.tunnelMgr.GetStatus()
+		names := make([]string, 0, len(status)+len(states))
+		for name := range status {
+			names = append(names, name)
+		}
+		for name := range states {
+			if _, ok := status[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		var changes []events.Event
+		for _, name := range names {
+			previous := states[name]
+			var before interface{}
+			if previous != "" {
+				before = previous
+			}
+			current, reason := "removed", ""
+			if s, ok := status[name]; ok {
+				current, reason = s.Status, s.LastError
+				states[name] = current
+			} else {
+				delete(states, name)
+			}
+
+			switch {
+			case current == connected && previous != connected:
+				changes = append(changes, events.Event{Type: config.EventTunnelUp, Server: name, Before: before, After: current})
+			case previous == connected && current != connected:
+				changes = append(changes, events.Event{Type: config.EventTunnelDown, Server: name, Before: before, After: current, Reason: reason})
+			}
+		}
+		a.events.Publish(changes...)
+	}
+}
+
+// publishMeshEvent relays a mesh event from the coordinator as a mesh.*
+// event
+func (a *Application) publishMeshEvent(event mesh.MeshEvent) {
+	a.events.Publish(events.Event{
+		Type:   config.MeshEventType(event.Type),
+		Reason: event.Reason,
+		After:  event,
+	})
+}
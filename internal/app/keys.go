@@ -0,0 +1,212 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/events"
+)
+
+// apiKeyPrefix starts every API key, followed by the key's ID and its
+// secret: tk_<id>_<secret>
+const apiKeyPrefix = "tk_"
+
+// newAPIKey generates a key and its stored form
+func newAPIKey(name, role string, ttl time.Duration) (string, config.APIKey, error) {
+	random := make([]byte, 38)
+	if _, err := rand.Read(random); err != nil {
+		return "", config.APIKey{}, fmt.Errorf("failed to generate API key: %v", err)
+	}
+	id := hex.EncodeToString(random[:6])
+	key := apiKeyPrefix + id + "_" + hex.EncodeToString(random[6:])
+
+	stored := config.APIKey{
+		ID:      id,
+		Name:    name,
+		Hash:    hashAPIKey(key),
+		Role:    role,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	if ttl > 0 {
+		stored.Expires = stored.Created.Add(ttl)
+	}
+	return key, stored, nil
+}
+
+// hashAPIKey is the hash an API key is stored as. Keys are random, so a
+// plain SHA-256 is enough.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// findAPIKey returns the stored API key a bearer token is, if it is one
+// that has not expired
+func (a *Application) findAPIKey(token string) (config.APIKey, bool) {
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return config.APIKey{}, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(token, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return config.APIKey{}, false
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	hash := hashAPIKey(token)
+	for _, key := range a.config.Security.APIKeys {
+		if key.ID != parts[0] {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash)) != 1 {
+			return config.APIKey{}, false
+		}
+		if !key.Expires.IsZero() && time.Now().After(key.Expires) {
+			return config.APIKey{}, false
+		}
+		return key, true
+	}
+	return config.APIKey{}, false
+}
+
+// handleListKeys lists the API keys, without their hashes
+func (a *Application) handleListKeys(c echo.Context) error {
+	a.mu.RLock()
+	keys := append([]config.APIKey{}, a.config.Security.APIKeys...)
+	a.mu.RUnlock()
+
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+// createKeyRequest asks for a new API key
+type createKeyRequest struct {
+	Name    string `json:"name"`
+	Role    string `json:"role,omitempty"`    // read-only by default
+	Expires string `json:"expires,omitempty"` // A duration such as 720h; empty never expires
+}
+
+// createKeyResponse carries a new API key, the only time it is shown
+type createKeyResponse struct {
+	Key string `json:"key"`
+	config.APIKey
+}
+
+// handleCreateKey creates an API key and answers with it
+func (a *Application) handleCreateKey(c echo.Context) error {
+	var req createKeyRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request format",
+		})
+	}
+	if req.Name == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "name is required",
+		})
+	}
+	if req.Role == "" {
+		req.Role = config.RoleReadOnly
+	}
+	if !config.IsRole(req.Role) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Unknown role %q (supported: read-only, operator, admin)", req.Role),
+		})
+	}
+	var ttl time.Duration
+	if req.Expires != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.Expires); err != nil || ttl < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid expires, expected a duration such as 720h",
+			})
+		}
+	}
+
+	key, stored, err := newAPIKey(req.Name, req.Role, ttl)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	a.mu.Lock()
+	for _, existing := range a.config.Security.APIKeys {
+		if existing.Name == req.Name {
+			a.mu.Unlock()
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": fmt.Sprintf("API key %s already exists", req.Name),
+			})
+		}
+	}
+	keys := append(append([]config.APIKey(nil), a.config.Security.APIKeys...), stored)
+	changes := a.setAPIKeys(keys)
+	a.mu.Unlock()
+
+	a.events.Publish(changes...)
+	if err := a.saveAPIKeys(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to save configuration: %v", err),
+		})
+	}
+
+	stored.Hash = ""
+	return c.JSON(http.StatusCreated, createKeyResponse{Key: key, APIKey: stored})
+}
+
+// handleRevokeKey removes an API key, by ID or name, refusing it from then
+// on
+func (a *Application) handleRevokeKey(c echo.Context) error {
+	id := c.Param("id")
+
+	a.mu.Lock()
+	var keys []config.APIKey
+	found := false
+	for _, key := range a.config.Security.APIKeys {
+		if key.ID == id || key.Name == id {
+			found = true
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if !found {
+		a.mu.Unlock()
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": fmt.Sprintf("API key %s not found", id),
+		})
+	}
+	changes := a.setAPIKeys(keys)
+	a.mu.Unlock()
+
+	a.events.Publish(changes...)
+	if err := a.saveAPIKeys(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": fmt.Sprintf("Failed to save configuration: %v", err),
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "API key revoked",
+		"id":      id,
+	})
+}
+
+// setAPIKeys swaps in a config with keys as the API keys and returns the
+// change events to publish; the caller holds a.mu
+func (a *Application) setAPIKeys(keys []config.APIKey) []events.Event {
+	oldConfig := a.config
+	newConfig := *oldConfig
+	newConfig.Security.APIKeys = keys
+	a.config = &newConfig
+	return events.Diff(oldConfig, &newConfig)
+}
@@ -0,0 +1,207 @@
+package app
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+
+	"ssh-tunnel/internal/protocols"
+)
+
+// logTapBuffer is how many log lines a subscriber may fall behind by
+// before further lines are dropped for it
+const logTapBuffer = 256
+
+// logTap copies the lines of the standard logger to subscribers
+type logTap struct {
+	mu   sync.Mutex
+	subs map[chan string]struct{}
+}
+
+var (
+	logLines    = &logTap{subs: make(map[chan string]struct{})}
+	installLogs sync.Once
+)
+
+// Write passes a line on to every subscriber, dropping it for those that
+// are behind rather than slowing down logging
+func (t *logTap) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ch := range t.subs {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// subscribe returns a channel of log lines, and a function ending the
+// subscription. The standard logger writes to the tap from the first one.
+func (t *logTap) subscribe() (<-chan string, func()) {
+	installLogs.Do(func() {
+		log.SetOutput(&teeWriter{log.Writer(), t})
+	})
+
+	ch := make(chan string, logTapBuffer)
+	t.mu.Lock()
+	t.subs[ch] = struct{}{}
+	t.mu.Unlock()
+
+	return ch, func() {
+		t.mu.Lock()
+		delete(t.subs, ch)
+		t.mu.Unlock()
+	}
+}
+
+// teeWriter writes to out, then copies to tap
+type teeWriter struct {
+	out io.Writer
+	tap *logTap
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	n, err := w.out.Write(p)
+	w.tap.Write(p)
+	return n, err
+}
+
+// liveMessage is a message of /ws
+type liveMessage struct {
+	Type     string                             `json:"type"` // status, tunnel, traffic or log
+	Time     time.Time                          `json:"time"`
+	Tunnels  map[string]*protocols.TunnelStatus `json:"tunnels,omitempty"`  // For status
+	Tunnel   *protocols.TunnelStatus            `json:"tunnel,omitempty"`   // For tunnel
+	Previous string                             `json:"previous,omitempty"` // The tunnel's last state, for tunnel
+	Traffic  map[string]liveTraffic             `json:"traffic,omitempty"`  // For traffic
+	Line     string                             `json:"line,omitempty"`     // For log
+}
+
+// liveTraffic is a tunnel's traffic counters, and its rates in bytes per
+// second since the last traffic message
+type liveTraffic struct {
+	protocols.TunnelTraffic
+	SendRate float64 `json:"send_rate"`
+	RecvRate float64 `json:"recv_rate"`
+}
+
+// handleLive streams the tunnels' status, state changes, traffic and the
+// log as JSON WebSocket messages, so dashboards need not poll /status. The
+// first message holds every tunnel's status; a tunnel message follows each
+// state change, with the previous state ("removed" for a tunnel that went
+// away), a traffic message every ?interval= (1s), and a log message each
+// log line unless ?logs=false.
+func (a *Application) handleLive(c echo.Context) error {
+	interval := time.Second
+	if i := c.QueryParam("interval"); i != "" {
+		d, err := time.ParseDuration(i)
+		if err != nil || d < 100*time.Millisecond {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid interval, expected a duration of at least 100ms",
+			})
+		}
+		interval = d
+	}
+	withLogs := c.QueryParam("logs") != "false"
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		changed, stopWatch := a.tunnelMgr.Watch()
+		defer stopWatch()
+		var lines <-chan string
+		if withLogs {
+			var unsubscribe func()
+			lines, unsubscribe = logLines.subscribe()
+			defer unsubscribe()
+		}
+
+		// The client sends nothing; a failed read means it went away
+		closed := make(chan struct{})
+		go func() {
+			var discard []byte
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+			close(closed)
+		}()
+
+		send := func(msg liveMessage) bool {
+			msg.Time = time.Now()
+			return websocket.JSON.Send(ws, msg) == nil
+		}
+
+		status := a.tunnelMgr.GetStatus()
+		states := make(map[string]string, len(status))
+		for name, s := range status {
+			states[name] = s.Status
+		}
+		if !send(liveMessage{Type: "status", Tunnels: status}) {
+			return
+		}
+
+		last, lastAt := protocols.GetTunnelTraffic(), time.Now()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-closed:
+				return
+			case <-a.ctx.Done():
+				return
+			case <-changed:
+				status := a.tunnelMgr.GetStatus()
+				for name, s := range status {
+					if previous, ok := states[name]; ok && previous == s.Status {
+						continue
+					}
+					if !send(liveMessage{Type: "tunnel", Tunnel: s, Previous: states[name]}) {
+						return
+					}
+					states[name] = s.Status
+				}
+				for name, previous := range states {
+					if _, ok := status[name]; ok {
+						continue
+					}
+					removed := &protocols.TunnelStatus{ServerName: name, Status: "removed"}
+					if !send(liveMessage{Type: "tunnel", Tunnel: removed, Previous: previous}) {
+						return
+					}
+					delete(states, name)
+				}
+			case now := <-ticker.C:
+				current := protocols.GetTunnelTraffic()
+				elapsed := now.Sub(lastAt).Seconds()
+				traffic := make(map[string]liveTraffic, len(current))
+				for name, t := range current {
+					prev := last[name]
+					traffic[name] = liveTraffic{
+						TunnelTraffic: t,
+						SendRate:      float64(t.BytesSent-prev.BytesSent) / elapsed,
+						RecvRate:      float64(t.BytesRecv-prev.BytesRecv) / elapsed,
+					}
+				}
+				last, lastAt = current, now
+				if len(traffic) > 0 && !send(liveMessage{Type: "traffic", Traffic: traffic}) {
+					return
+				}
+			case line := <-lines:
+				if !send(liveMessage{Type: "log", Line: line}) {
+					return
+				}
+			}
+		}
+	}).ServeHTTP(c.Response(), c.Request())
+	return nil
+}
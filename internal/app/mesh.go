@@ -0,0 +1,327 @@
+package app
+
+import (
+	_ "embed"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/events"
+	"ssh-tunnel/internal/mesh"
+	"ssh-tunnel/internal/monitoring"
+)
+
+// meshDashboard is the mesh dashboard page. It holds no data: it calls
+// the /api/v1/mesh endpoints with the token it is given.
+//
+//go:embed web/mesh.html
+var meshDashboard []byte
+
+// meshDashboardPath is served without authentication, see meshDashboard
+const meshDashboardPath = "/mesh"
+
+// registerMeshRoutes serves the dashboard and the /api/v1/mesh endpoints
+// backing it, which manage the coordinator of the mesh block
+func (a *Application) registerMeshRoutes(api *echo.Group) {
+	a.server.GET(meshDashboardPath, func(c echo.Context) error {
+		return c.Blob(http.StatusOK, "text/html; charset=utf-8", meshDashboard)
+	})
+
+	api.GET("/mesh/status", a.handleMeshStatus)
+	api.GET("/mesh/latency", a.handleMeshLatency)
+	api.GET("/mesh/history", a.handleMeshHistory)
+	api.GET("/mesh/nodes", a.handleMeshNodes)
+	api.POST("/mesh/nodes", a.handleMeshAddNode)
+	api.PATCH("/mesh/nodes/:id", a.handleMeshUpdateNode)
+	api.DELETE("/mesh/nodes/:id", a.handleMeshRemoveNode)
+}
+
+// meshError answers with the coordinator's refusal, or 502 when it could
+// not be reached
+func meshError(c echo.Context, err error) error {
+	status := mesh.CoordinatorStatus(err)
+	if status == 0 {
+		status = http.StatusBadGateway
+	}
+	return c.JSON(status, map[string]string{
+		"error": fmt.Sprintf("Mesh coordinator: %v", err),
+	})
+}
+
+// handleMeshStatus returns the coordinator's view of the mesh: every node
+// with its latency, loss and traffic
+func (a *Application) handleMeshStatus(c echo.Context) error {
+	status, err := a.meshAdmin.Status()
+	if err != nil {
+		return meshError(c, err)
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// handleMeshLatency returns the latency matrix, for the topology graph
+func (a *Application) handleMeshLatency(c echo.Context) error {
+	matrix, err := a.meshAdmin.LatencyMatrix()
+	if err != nil {
+		return meshError(c, err)
+	}
+	return c.JSON(http.StatusOK, matrix)
+}
+
+// handleMeshHistory returns when nodes joined, left, went offline and came
+// back, oldest first; ?node= takes a node ID or name
+func (a *Application) handleMeshHistory(c echo.Context) error {
+	history, err := a.meshAdmin.History()
+	if err != nil {
+		return meshError(c, err)
+	}
+	if node := c.QueryParam("node"); node != "" {
+		filtered := history[:0]
+		for _, event := range history {
+			if event.NodeID == node || event.Node == node {
+				filtered = append(filtered, event)
+			}
+		}
+		history = filtered
+	}
+	return c.JSON(http.StatusOK, history)
+}
+
+// handleMeshNodes lists every node, those waiting for approval included
+func (a *Application) handleMeshNodes(c echo.Context) error {
+	nodes, err := a.meshAdmin.ListNodes()
+	if err != nil {
+		return meshError(c, err)
+	}
+	return c.JSON(http.StatusOK, nodes)
+}
+
+// handleMeshAddNode creates a join token for a new node and returns the
+// command that joins it
+func (a *Application) handleMeshAddNode(c echo.Context) error {
+	var req mesh.CreateTokenRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request format",
+		})
+	}
+	if req.TTL == "" {
+		req.TTL = "24h"
+	}
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+
+	token, err := a.meshAdmin.CreateToken(req)
+	if err != nil {
+		return meshError(c, err)
+	}
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"token":        token,
+		"join_command": fmt.Sprintf("tunnel mesh join %s --token %s", strings.TrimSuffix(a.config.Mesh.CoordinatorURL, "/"), token.Token),
+	})
+}
+
+// handleMeshRemoveNode removes a node by ID or name and revokes its key;
+// ?revoke_token=true also revokes the join token it used
+func (a *Application) handleMeshRemoveNode(c echo.Context) error {
+	if err := a.meshAdmin.RemoveNode(c.Param("id"), c.QueryParam("revoke_token") == "true"); err != nil {
+		return meshError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Node removed",
+		"id":      c.Param("id"),
+	})
+}
+
+// handleMeshUpdateNode edits a node's region, tags, labels and
+// capabilities
+func (a *Application) handleMeshUpdateNode(c echo.Context) error {
+	var update mesh.NodeMetadataUpdate
+	if err := c.Bind(&update); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid node update"})
+	}
+	info, err := a.meshAdmin.UpdateNode(c.Param("id"), update)
+	if err != nil {
+		return meshError(c, err)
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+// joinMesh joins the mesh as a node with the mesh block's join token,
+// retrying until it succeeds or the application shuts down
+func (a *Application) joinMesh() {
+	backoff := time.Second
+	for {
+		meshNet := mesh.NewMeshNetwork(mesh.NodeConfig(a.config.Mesh, a.config.Scoring))
+		meshNet.OnConfigSync(a.applySyncedConfig)
+		err := meshNet.Initialize()
+		if err == nil {
+			a.mu.Lock()
+			if a.ctx.Err() == nil {
+				a.meshNet = meshNet
+				meshNet = nil
+			}
+			a.mu.Unlock()
+			if meshNet != nil {
+				meshNet.Stop() // Shut down while joining
+			}
+			return
+		}
+		log.Printf("⚠️  Failed to join the mesh: %v; retrying in %v", err, backoff)
+
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// applySyncedConfig replaces config sections with the ones an admin
+// pushed through the mesh, once the config they make passes validation
+func (a *Application) applySyncedConfig(sections []string, synced mesh.ConfigSections) {
+	a.mu.Lock()
+	oldConfig := a.config
+	newConfig := *oldConfig
+	synced.ApplyTo(&newConfig, sections)
+	if err := config.Validate(&newConfig); err != nil {
+		a.mu.Unlock()
+		log.Printf("⚠️  Synced mesh config refused: %v", err)
+		return
+	}
+	a.config = &newConfig
+	a.mu.Unlock()
+
+	a.events.Publish(events.Diff(oldConfig, &newConfig)...)
+	if err := a.tunnelMgr.UpdateConfig(&newConfig); err != nil {
+		log.Printf("⚠️  Failed to update tunnel configuration: %v", err)
+		return
+	}
+	a.events.Publish(events.Event{
+		Type:   config.EventConfigReloaded,
+		Reason: "Synced through the mesh: " + strings.Join(sections, ", "),
+	})
+	log.Printf("✅ Synced mesh config applied: %s", strings.Join(sections, ", "))
+}
+
+// syncMeshMetrics feeds the coordinator's view of every mesh node to the
+// monitor
+func (a *Application) syncMeshMetrics() {
+	interval := a.config.Monitoring.CheckInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+			status, err := a.meshAdmin.Status()
+			if err != nil {
+				log.Printf("⚠️  Failed to collect mesh metrics: %v", err)
+				continue
+			}
+			nodes := make([]monitoring.MeshNodeMetrics, 0, len(status.Nodes))
+			for _, node := range status.Nodes {
+				nodes = append(nodes, monitoring.MeshNodeMetrics{
+					NodeID:       node.ID,
+					Name:         node.Name,
+					MeshIP:       node.MeshIP,
+					Status:       meshNodeStatus(node.NodeInfo),
+					Latency:      node.Latency,
+					PacketLoss:   node.Loss,
+					BytesSent:    node.BytesSent,
+					BytesRecv:    node.BytesReceived,
+					HandshakeAge: node.HandshakeAge,
+					Reconnects:   node.Reconnects,
+				})
+			}
+			a.monitor.UpdateMeshMetrics(nodes)
+		}
+	}
+}
+
+// meshNodeStatus is a node's status, with admission and draining taking
+// precedence over being online
+func meshNodeStatus(node mesh.NodeInfo) string {
+	switch {
+	case !node.Approved:
+		return "pending"
+	case node.Quarantined:
+		return "quarantined"
+	case node.Draining:
+		return "draining"
+	}
+	return node.Status
+}
+
+// followMeshEvents publishes the coordinator's mesh events, and logs them
+// to the monitor with alerts for nodes going offline, failovers and
+// subnets left without a gateway, reconnecting until the application
+// shuts down
+func (a *Application) followMeshEvents() {
+	since := ^uint64(0) // Only events from now on
+	backoff := time.Second
+	for {
+		last, err := a.meshAdmin.FollowEvents(a.ctx, since, nil, func(event mesh.MeshEvent) {
+			a.publishMeshEvent(event)
+			if a.monitor != nil {
+				a.monitorMeshEvent(event)
+			}
+		})
+		if a.ctx.Err() != nil {
+			return
+		}
+		if last != since {
+			since, backoff = last, time.Second
+		}
+		log.Printf("⚠️  Mesh event stream lost: %v; reconnecting in %v", err, backoff)
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// monitorMeshEvent logs a mesh event and raises an alert for it when it
+// degrades the mesh
+func (a *Application) monitorMeshEvent(event mesh.MeshEvent) {
+	details := map[string]interface{}{
+		"id":      event.ID,
+		"type":    event.Type,
+		"node_id": event.NodeID,
+		"mesh_ip": event.MeshIP,
+	}
+	for key, value := range map[string]string{"peer": event.Peer, "path": event.Path, "subnet": event.Subnet, "gateway": event.Gateway, "reason": event.Reason} {
+		if value != "" {
+			details[key] = value
+		}
+	}
+
+	level, message := "info", event.Type+" "+event.String()
+	switch {
+	case event.Type == mesh.EventNodeOffline,
+		event.Type == mesh.EventFailover,
+		event.Type == mesh.EventRouteChanged && event.Gateway == "":
+		level = "warning"
+		a.monitor.RaiseAlert(monitoring.Alert{
+			Severity: monitoring.SeverityWarning,
+			Server:   event.Node,
+			Metric:   "mesh_" + event.Type,
+			Message:  message,
+		})
+	}
+	a.monitor.LogEvent(level, "mesh", message, details)
+}
@@ -0,0 +1,69 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"ssh-tunnel/internal/config"
+)
+
+// routeGroup is the role a group of routes needs, by route prefix: read
+// for GET requests, write for any other
+type routeGroup struct {
+	prefix string
+	read   string
+	write  string
+}
+
+// routeGroups are checked in order; routes in none of them need read-only
+// to read and admin to change anything. Relayed agent calls are checked
+// again by the instance they reach, with the role they were allowed here.
+var routeGroups = []routeGroup{
+	{"/api/v1/keys", config.RoleAdmin, config.RoleAdmin},
+	{"/api/v1/debug/", config.RoleAdmin, config.RoleAdmin},
+	{"/api/v1/agents/", config.RoleReadOnly, config.RoleOperator},
+	{"/api/v1/tunnels/", config.RoleReadOnly, config.RoleOperator},
+	{"/api/v1/servers/:id/test", config.RoleReadOnly, config.RoleOperator},
+	{"/api/v1/servers/:id/bench", config.RoleReadOnly, config.RoleOperator},
+}
+
+// requiredRole is the least role that may make a request
+func requiredRole(c echo.Context) string {
+	read := c.Request().Method == http.MethodGet || c.Request().Method == http.MethodHead
+	for _, group := range routeGroups {
+		if strings.HasPrefix(c.Path(), group.prefix) {
+			if read {
+				return group.read
+			}
+			return group.write
+		}
+	}
+	if read {
+		return config.RoleReadOnly
+	}
+	return config.RoleAdmin
+}
+
+// userRole is a user's role. Users are admin by default, which a config
+// set through PUT /config has not had filled in.
+func userRole(user config.APIUser) string {
+	if user.Role == "" {
+		return config.RoleAdmin
+	}
+	return user.Role
+}
+
+// authorize calls next when role may make the request, and answers 403
+// otherwise. who names the token for the error.
+func authorize(c echo.Context, next echo.HandlerFunc, who, role string) error {
+	if required := requiredRole(c); !config.RoleAllows(role, required) {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": fmt.Sprintf("%s has the %s role; this request needs %s", who, role, required),
+		})
+	}
+	c.Set("role", role)
+	return next(c)
+}
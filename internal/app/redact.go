@@ -0,0 +1,107 @@
+package app
+
+import (
+	"ssh-tunnel/internal/config"
+)
+
+// secretKeys are the settings blanked in server_defaults and
+// server_templates, which hold server settings as plain maps
+var secretKeys = map[string]bool{
+	"password": true, "key_path": true, "uuid": true, "auth_string": true,
+	"obfs_password": true, "key": true, "private_key": true,
+	"pre_shared_key": true, "pin": true, "seed": true, "cert": true,
+}
+
+// redactServers returns copies of servers without their credentials
+func redactServers(servers []config.Server) []config.Server {
+	redacted := make([]config.Server, len(servers))
+	for i := range servers {
+		redacted[i] = redactServer(servers[i])
+	}
+	return redacted
+}
+
+// redactServer returns a copy of a server with its credentials blanked.
+// The protocol settings holding them are copied too, so the server in use
+// keeps its own.
+func redactServer(server config.Server) config.Server {
+	server.Password = ""
+	server.KeyPath = ""
+
+	if server.Hysteria != nil {
+		hysteria := *server.Hysteria
+		hysteria.AuthString = ""
+		hysteria.ObfsPassword = ""
+		server.Hysteria = &hysteria
+	}
+	if server.TUIC != nil {
+		tuic := *server.TUIC
+		tuic.UUID = ""
+		tuic.Password = ""
+		server.TUIC = &tuic
+	}
+	if server.Naive != nil {
+		naive := *server.Naive
+		naive.Password = ""
+		server.Naive = &naive
+	}
+	if server.DNSTunnel != nil {
+		dns := *server.DNSTunnel
+		dns.Password = ""
+		server.DNSTunnel = &dns
+	}
+	if server.ICMP != nil {
+		icmp := *server.ICMP
+		icmp.Key = ""
+		server.ICMP = &icmp
+	}
+	if server.V2Ray != nil {
+		v2ray := *server.V2Ray
+		v2ray.UUID = ""
+		if v2ray.KCP != nil {
+			kcp := *v2ray.KCP
+			kcp.Seed = ""
+			v2ray.KCP = &kcp
+		}
+		server.V2Ray = &v2ray
+	}
+	if server.WireGuard != nil {
+		wg := *server.WireGuard
+		wg.PrivateKey = ""
+		wg.PreSharedKey = ""
+		server.WireGuard = &wg
+	}
+	if server.Obfuscation != nil {
+		obfuscation := *server.Obfuscation
+		obfuscation.Key = ""
+		obfuscation.Cert = ""
+		server.Obfuscation = &obfuscation
+	}
+	if server.HardwareKey != nil {
+		hw := *server.HardwareKey
+		hw.PIN = ""
+		server.HardwareKey = &hw
+	}
+	return server
+}
+
+// redactSettings returns a copy of a server_defaults or server_templates
+// map with the settings in secretKeys blanked, at any depth
+func redactSettings(settings map[string]interface{}) map[string]interface{} {
+	if settings == nil {
+		return nil
+	}
+	redacted := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			redacted[key] = redactSettings(v)
+		default:
+			if secretKeys[key] {
+				value = ""
+			}
+			redacted[key] = value
+		}
+	}
+	return redacted
+}
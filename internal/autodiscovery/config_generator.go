@@ -1,8 +1,10 @@
 package autodiscovery
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"strings"
 )
 
@@ -241,8 +243,8 @@ PersistentKeepalive = 25
 # To connect:
 # sudo wg-quick up wg0
 # sudo wg-quick down wg0
-`,
-			sd.info.Host, config.Port)
+%s`,
+			sd.info.Host, config.Port, portHoppingNote(config))
 	}
 	return ""
 }
@@ -250,9 +252,16 @@ PersistentKeepalive = 25
 // generateHysteriaConfig generates Hysteria client configuration
 func (sd *ServerDiscovery) generateHysteriaConfig() string {
 	if config, exists := sd.configs["hysteria"]; exists {
+		server := fmt.Sprintf("%s:%d", sd.info.Host, config.Port)
+		hopInterval := ""
+		if ports, ok := config.Config["port_hopping"]; ok {
+			server = fmt.Sprintf("%s:%s", sd.info.Host, ports)
+			hopInterval = "\n  \"hop_interval\": 30,"
+		}
+
 		return fmt.Sprintf(`# Hysteria Client Configuration
 {
-  "server": "%s:%d",
+  "server": "%s",%s
   "protocol": "%s",
   "auth_str": "%s",
   "bandwidth": {
@@ -274,16 +283,34 @@ func (sd *ServerDiscovery) generateHysteriaConfig() string {
 # hysteria -c hysteria.json
 # Set SOCKS5 proxy to: 127.0.0.1:1080
 # Set HTTP proxy to: 127.0.0.1:8080
-`,
-			sd.info.Host, config.Port,
+%s`,
+			server, hopInterval,
 			config.Config["protocol"],
 			config.Config["auth_str"],
 			config.Config["bandwidth"],
-			config.Config["bandwidth"])
+			config.Config["bandwidth"],
+			portHoppingNote(config))
 	}
 	return ""
 }
 
+// portHoppingNote describes the server-side hopping range of a UDP
+// protocol, or returns "" when port hopping is not set up
+func portHoppingNote(config *ProtocolConfig) string {
+	ports, ok := config.Config["port_hopping"]
+	if !ok {
+		return ""
+	}
+
+	return fmt.Sprintf(`
+# Port hopping: UDP ports %s are redirected to %d on the server.
+# SSH Tunnel Manager rotates across them with:
+#    port_hopping:
+#      ports: "%s"
+#      interval: 30s
+`, ports, config.Port, ports)
+}
+
 // generateHTTPProxyConfig generates HTTP proxy configuration
 func (sd *ServerDiscovery) generateHTTPProxyConfig() string {
 	if config, exists := sd.configs["http_proxy"]; exists {
@@ -340,6 +367,180 @@ ssh -D %d %s@%s -p %s
 	return ""
 }
 
+// generateDNSTunnelConfig generates DNS tunnel client configuration and the
+// DNS delegation recipe required on the domain's authoritative zone
+func (sd *ServerDiscovery) generateDNSTunnelConfig() string {
+	if config, exists := sd.configs["dns_tunnel"]; exists {
+		return fmt.Sprintf(`# DNS Tunnel Configuration (iodine)
+# Last-resort transport when all TCP/UDP ports except DNS are blocked.
+
+# 1. Delegate the tunnel domain to this server in your DNS zone:
+#    tns.<your-domain>.  IN A   %s
+#    %s.                 IN NS  tns.<your-domain>.
+
+# 2. SSH Tunnel Manager server entry:
+servers:
+  - name: "dns-%s"
+    host: "%s"
+    port: "%s"
+    user: "%s"
+    transport: "dns"
+    proxy: "socks5"
+    local_port: 1080
+    dns_tunnel:
+      domain: "%s"
+      password: "%s"
+      tunnel_ip: "%s"
+
+# Manual usage:
+# sudo IODINE_PASS=%s iodine -f %s
+# ssh -D 1080 %s@%s
+`,
+			sd.info.Host, config.Config["domain"],
+			sd.info.Host, sd.info.Host, sd.info.Port, sd.info.User,
+			config.Config["domain"], config.Config["password"], config.Config["tunnel_ip"],
+			config.Config["password"], config.Config["domain"],
+			sd.info.User, config.Config["tunnel_ip"])
+	}
+	return ""
+}
+
+// generateICMPTunnelConfig generates ICMP tunnel client configuration
+func (sd *ServerDiscovery) generateICMPTunnelConfig() string {
+	if config, exists := sd.configs["icmp_tunnel"]; exists {
+		return fmt.Sprintf(`# ICMP Tunnel Configuration
+# SSH carried in ICMP echo messages for networks that only allow ping.
+# The client needs root or net.ipv4.ping_group_range covering its group.
+
+servers:
+  - name: "icmp-%s"
+    host: "%s"
+    port: "%s"
+    user: "%s"
+    transport: "icmp"
+    proxy: "socks5"
+    local_port: 1080
+    icmp:
+      key: "%s"
+
+# Agent on the server (already started by setup):
+# ICMP_TUNNEL_KEY=%s %s icmp-server --forward 127.0.0.1:%s
+`,
+			sd.info.Host, sd.info.Host, sd.info.Port, sd.info.User,
+			config.Config["key"],
+			config.Config["key"], agentPath, sd.info.Port)
+	}
+	return ""
+}
+
+// v2rayCDNServerConfig renders the v2ray-core server config for WebSocket
+// fronting: VLESS and VMess inbounds on CDN-compatible HTTP ports
+func v2rayCDNServerConfig(config *ProtocolConfig) string {
+	wsInbound := func(protocol string, port interface{}, path interface{}, client map[string]interface{}) map[string]interface{} {
+		settings := map[string]interface{}{
+			"clients": []map[string]interface{}{client},
+		}
+		if protocol == "vless" {
+			settings["decryption"] = "none"
+		}
+		return map[string]interface{}{
+			"port":     port,
+			"listen":   "0.0.0.0",
+			"protocol": protocol,
+			"settings": settings,
+			"streamSettings": map[string]interface{}{
+				"network":    "ws",
+				"wsSettings": map[string]interface{}{"path": path},
+			},
+		}
+	}
+
+	configMap := map[string]interface{}{
+		"log": map[string]interface{}{"loglevel": "warning"},
+		"inbounds": []map[string]interface{}{
+			wsInbound("vless", config.Port, config.Config["vless_path"],
+				map[string]interface{}{"id": config.Config["uuid"]}),
+			wsInbound("vmess", config.Config["vmess_port"], config.Config["vmess_path"],
+				map[string]interface{}{"id": config.Config["uuid"], "alterId": 0}),
+		},
+		"outbounds": []map[string]interface{}{
+			{"protocol": "freedom"},
+		},
+	}
+
+	jsonData, _ := json.MarshalIndent(configMap, "", "  ")
+	return string(jsonData)
+}
+
+// generateV2RayCDNConfig generates VLESS/VMess over WebSocket+TLS client
+// configuration fronted through a CDN, plus the CDN setup steps
+func (sd *ServerDiscovery) generateV2RayCDNConfig() string {
+	config, exists := sd.configs["v2ray_cdn"]
+	if !exists {
+		return ""
+	}
+
+	domain := config.Config["domain"]
+	vmessConfig := map[string]interface{}{
+		"v":    "2",
+		"ps":   "AutoGenerated-VMess-CDN",
+		"add":  domain,
+		"port": "443",
+		"id":   config.Config["uuid"],
+		"aid":  "0",
+		"scy":  "auto",
+		"net":  "ws",
+		"type": "none",
+		"host": domain,
+		"path": config.Config["vmess_path"],
+		"tls":  "tls",
+		"sni":  domain,
+	}
+	vmessJSON, _ := json.Marshal(vmessConfig)
+
+	return fmt.Sprintf(`# VLESS/VMess over WebSocket+TLS fronted by a CDN
+# Clients connect to the CDN edge on 443; the CDN forwards plain WebSocket
+# to the origin. Any edge IP can be used as "host" as long as the Host
+# header and SNI carry the proxied domain.
+
+# 1. Cloudflare setup:
+#    - DNS: %s  A  %s  (Proxied / orange cloud)
+#    - SSL/TLS mode: Flexible (origin serves plain WebSocket)
+#    - Network: WebSockets enabled
+#    - Origin Rules: hostname equals %s
+#        and path equals %s  -> destination port %d
+#        and path equals %s  -> destination port %v
+
+# 2. SSH Tunnel Manager server entry:
+servers:
+  - name: "vless-cdn-%s"
+    host: "%s"          # or a clean CDN edge IP
+    port: "443"
+    transport: "vless"
+    proxy: "socks5"
+    local_port: 1080
+    v2ray:
+      uuid: "%s"
+      network: "wss"
+      path: "%s"
+      host: "%s"
+      sni: "%s"
+
+# 3. V2rayN/V2rayNG:
+vless://%s@%s:443?type=ws&security=tls&host=%s&sni=%s&path=%s&encryption=none#AutoGenerated-VLESS-CDN
+vmess://%s
+
+# Server-side config: see v2ray_cdn_server.conf
+`,
+		domain, sd.info.Host, domain,
+		config.Config["vless_path"], config.Port,
+		config.Config["vmess_path"], config.Config["vmess_port"],
+		domain, domain,
+		config.Config["uuid"], config.Config["vless_path"], domain, domain,
+		config.Config["uuid"], domain, domain, domain, url.QueryEscape(fmt.Sprint(config.Config["vless_path"])),
+		base64.StdEncoding.EncodeToString(vmessJSON))
+}
+
 // generateCombinedConfig generates a combined configuration with all protocols
 func (sd *ServerDiscovery) generateCombinedConfig() string {
 	var configs []string
@@ -374,6 +575,11 @@ func (sd *ServerDiscovery) generateCombinedConfig() string {
 		if config.ProxyURL != "" {
 			configs = append(configs, fmt.Sprintf("    proxy_url: \"%s\"", config.ProxyURL))
 		}
+		if ports, ok := config.Config["port_hopping"]; ok {
+			configs = append(configs, "    port_hopping:")
+			configs = append(configs, fmt.Sprintf("      ports: \"%s\"", ports))
+			configs = append(configs, "      interval: 30s")
+		}
 
 		configs = append(configs, "")
 	}
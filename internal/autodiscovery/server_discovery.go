@@ -5,11 +5,15 @@ import (
 	"log"
 	"net"
 	"os"
+	"runtime"
 	"strings"
 	"time"
 
 	"crypto/rand"
 
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/diagnostics"
+
 	"golang.org/x/crypto/ssh"
 )
 
@@ -27,6 +31,8 @@ type ServerInfo struct {
 	Architecture       string                 `json:"architecture"`
 	InstalledSoftware  []string               `json:"installed_software"`
 	NetworkInterfaces  []NetworkInterface     `json:"network_interfaces"`
+	SSHDAudit          *SSHDAudit             `json:"sshd_audit,omitempty"`
+	HostKey            string                 `json:"host_key,omitempty"` // The verified host key, as a public key line
 }
 
 // NetworkInterface represents a network interface on the server
@@ -48,9 +54,18 @@ type ProtocolConfig struct {
 
 // ServerDiscovery handles automatic server discovery and setup
 type ServerDiscovery struct {
-	client  *ssh.Client
-	info    *ServerInfo
-	configs map[string]*ProtocolConfig
+	client      *ssh.Client
+	info        *ServerInfo
+	configs     map[string]*ProtocolConfig
+	dnsDomain   string
+	cdnDomain   string
+	portHopping string
+	fixSSHD     bool
+
+	hostKey        string                              // Pinned host key, see config.Server.HostKey
+	insecure       bool                                // Accept any host key
+	confirmHostKey func(host, fingerprint string) bool // Asked about hosts known_hosts does not list
+	seenHostKey    string
 }
 
 // NewServerDiscovery creates a new server discovery instance
@@ -60,6 +75,42 @@ func NewServerDiscovery() *ServerDiscovery {
 	}
 }
 
+// SetDNSTunnelDomain sets the delegated domain used when setting up a DNS tunnel
+func (sd *ServerDiscovery) SetDNSTunnelDomain(domain string) {
+	sd.dnsDomain = domain
+}
+
+// SetCDNDomain sets the CDN-proxied domain used to front VLESS/VMess over
+// WebSocket. The domain's DNS record must point at the server through the CDN.
+func (sd *ServerDiscovery) SetCDNDomain(domain string) {
+	sd.cdnDomain = domain
+}
+
+// SetPortHopping sets the UDP port range ("20000-40000") that Hysteria and
+// WireGuard accept in addition to their listening port, for clients that
+// rotate destination ports
+func (sd *ServerDiscovery) SetPortHopping(ports string) {
+	sd.portHopping = ports
+}
+
+// SetHostKey pins the server's host key: a public key or its SHA256
+// fingerprint. Without one the key is looked up in ~/.ssh/known_hosts.
+func (sd *ServerDiscovery) SetHostKey(hostKey string) {
+	sd.hostKey = hostKey
+}
+
+// SetInsecureSkipVerify makes discovery accept any host key
+func (sd *ServerDiscovery) SetInsecureSkipVerify(insecure bool) {
+	sd.insecure = insecure
+}
+
+// SetConfirmHostKey sets the question asked when known_hosts does not list
+// the server, so an interactive user can check the fingerprint and accept
+// it. Without one such servers are refused.
+func (sd *ServerDiscovery) SetConfirmHostKey(confirm func(host, fingerprint string) bool) {
+	sd.confirmHostKey = confirm
+}
+
 // DiscoverServer discovers server capabilities and sets up protocols
 func (sd *ServerDiscovery) DiscoverServer(host, port, user, password, keyPath string) (*ServerInfo, error) {
 	log.Printf("Starting server discovery for %s@%s:%s", user, host, port)
@@ -81,6 +132,7 @@ func (sd *ServerDiscovery) DiscoverServer(host, port, user, password, keyPath st
 		ServerCapabilities: make(map[string]interface{}),
 		AvailablePorts:     []int{},
 		InstalledSoftware:  []string{},
+		HostKey:            sd.seenHostKey,
 	}
 
 	// Discover server information
@@ -88,6 +140,21 @@ func (sd *ServerDiscovery) DiscoverServer(host, port, user, password, keyPath st
 		log.Printf("Warning: Failed to discover system info: %v", err)
 	}
 
+	// Check that sshd allows what the tunnels need
+	if audit, err := sd.auditSSHD(); err != nil {
+		log.Printf("Warning: Failed to audit sshd configuration: %v", err)
+	} else {
+		sd.info.SSHDAudit = audit
+		for _, f := range audit.Findings {
+			log.Printf("Warning: sshd %s %s: %s (%s)", f.Setting, f.Value, f.Problem, f.Feature)
+		}
+		if sd.fixSSHD && audit.NeedsFix() {
+			if err := sd.FixSSHD(); err != nil {
+				log.Printf("Warning: Failed to fix sshd configuration: %v", err)
+			}
+		}
+	}
+
 	// Discover network interfaces
 	if err := sd.discoverNetworkInterfaces(); err != nil {
 		log.Printf("Warning: Failed to discover network interfaces: %v", err)
@@ -120,6 +187,15 @@ func (sd *ServerDiscovery) SetupAllProtocols() error {
 		log.Printf("Successfully set up %s protocol", protocol)
 	}
 
+	// The speed helper lets `tunnel bench` measure any protocol end to end
+	if sd.canRunAgent() {
+		if err := sd.setupSpeedHelper(); err != nil {
+			log.Printf("Failed to setup speed helper: %v", err)
+		} else {
+			log.Printf("Speed helper listening on 127.0.0.1:%d", diagnostics.BenchPort)
+		}
+	}
+
 	return nil
 }
 
@@ -137,6 +213,12 @@ func (sd *ServerDiscovery) GenerateClientConfigs(outputDir string) error {
 		"hysteria":      sd.generateHysteriaConfig(),
 		"http_proxy":    sd.generateHTTPProxyConfig(),
 		"socks5_proxy":  sd.generateSOCKS5Config(),
+		"dns_tunnel":    sd.generateDNSTunnelConfig(),
+		"icmp_tunnel":   sd.generateICMPTunnelConfig(),
+		"v2ray_cdn":     sd.generateV2RayCDNConfig(),
+	}
+	if config, exists := sd.configs["v2ray_cdn"]; exists {
+		configs["v2ray_cdn_server"] = v2rayCDNServerConfig(config)
 	}
 
 	// Write configuration files
@@ -159,22 +241,41 @@ func (sd *ServerDiscovery) GenerateClientConfigs(outputDir string) error {
 
 // connectToServer establishes SSH connection to the server
 func (sd *ServerDiscovery) connectToServer(host, port, user, password, keyPath string) error {
-	config := &ssh.ClientConfig{
-		User:            user,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         10 * time.Second,
+	server := config.Server{Host: host, Port: port, HostKey: sd.hostKey, InsecureSkipVerify: sd.insecure}
+	verify, algorithms, err := config.HostKeyCallback(server)
+	if err != nil {
+		return err
+	}
+	hostKeyCallback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := verify(hostname, remote, key)
+		if _, unknown := err.(*config.UnknownHostKeyError); unknown && sd.confirmHostKey != nil {
+			if sd.confirmHostKey(hostname, ssh.FingerprintSHA256(key)) {
+				err = nil
+			}
+		}
+		if err == nil {
+			sd.seenHostKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		}
+		return err
+	}
+
+	clientConfig := &ssh.ClientConfig{
+		User:              user,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: algorithms,
+		Timeout:           10 * time.Second,
 	}
 
 	// Setup authentication
 	if password != "" {
-		config.Auth = []ssh.AuthMethod{ssh.Password(password)}
+		clientConfig.Auth = []ssh.AuthMethod{ssh.Password(password)}
 	} else if keyPath != "" {
 		// TODO: Implement key-based authentication
 		return fmt.Errorf("key-based authentication not yet implemented")
 	}
 
 	addr := net.JoinHostPort(host, port)
-	client, err := ssh.Dial("tcp", addr, config)
+	client, err := ssh.Dial("tcp", addr, clientConfig)
 	if err != nil {
 		return err
 	}
@@ -246,6 +347,7 @@ func (sd *ServerDiscovery) checkInstalledSoftware() {
 		"iptables":  "iptables --version",
 		"socat":     "socat -V",
 		"haproxy":   "haproxy -v",
+		"iodine":    "which iodined",
 	}
 
 	for name, cmd := range software {
@@ -299,8 +401,18 @@ func (sd *ServerDiscovery) discoverSupportedProtocols() {
 	// Can always setup HTTP/SOCKS proxies via SSH
 	sd.info.SupportedProtocols = append(sd.info.SupportedProtocols, "http_proxy", "socks5_proxy")
 
-	// ICMP tunnel if we have socat or custom tools
-	if sd.hasInstalledSoftware("socat") {
+	// DNS tunnel needs UDP port 53 free on the server for iodined
+	if !sd.isUDPPortInUse(53) {
+		sd.info.SupportedProtocols = append(sd.info.SupportedProtocols, "dns_tunnel")
+	}
+
+	// WebSocket fronting needs a CDN domain and Docker to run v2ray-core
+	if sd.cdnDomain != "" && sd.hasInstalledSoftware("docker") {
+		sd.info.SupportedProtocols = append(sd.info.SupportedProtocols, "v2ray_cdn")
+	}
+
+	// ICMP tunnel agent needs raw sockets and a binary matching our build
+	if sd.canRunAgent() {
 		sd.info.SupportedProtocols = append(sd.info.SupportedProtocols, "icmp_tunnel")
 	}
 }
@@ -312,6 +424,8 @@ func (sd *ServerDiscovery) setupProtocol(protocol string) error {
 		return sd.setupSSHTunnel()
 	case "v2ray", "vless", "vmess":
 		return sd.setupV2Ray()
+	case "v2ray_cdn":
+		return sd.setupV2RayCDN()
 	case "trojan":
 		return sd.setupTrojan()
 	case "hysteria":
@@ -324,6 +438,8 @@ func (sd *ServerDiscovery) setupProtocol(protocol string) error {
 		return sd.setupSOCKS5Proxy()
 	case "icmp_tunnel":
 		return sd.setupICMPTunnel()
+	case "dns_tunnel":
+		return sd.setupDNSTunnel()
 	default:
 		return fmt.Errorf("unsupported protocol: %s", protocol)
 	}
@@ -399,6 +515,57 @@ EOF
 	return nil
 }
 
+// cloudflareHTTPPorts are the plain-HTTP origin ports Cloudflare proxies
+var cloudflareHTTPPorts = []int{80, 8080, 8880, 2052, 2082, 2086, 2095}
+
+// setupV2RayCDN runs VLESS and VMess over WebSocket behind a CDN. The origin
+// speaks plain WebSocket; TLS is terminated at the CDN edge.
+func (sd *ServerDiscovery) setupV2RayCDN() error {
+	var ports []int
+	for _, port := range cloudflareHTTPPorts {
+		if len(ports) == 2 {
+			break
+		}
+		if sd.isPortAvailable(port) {
+			ports = append(ports, port)
+		}
+	}
+	if len(ports) < 2 {
+		return fmt.Errorf("need two free CDN-compatible ports from %v", cloudflareHTTPPorts)
+	}
+
+	path := "/" + strings.ToLower(sd.generatePassword()[:12])
+	config := &ProtocolConfig{
+		Type: "vless",
+		Port: ports[0],
+		Config: map[string]interface{}{
+			"domain":     sd.cdnDomain,
+			"uuid":       sd.generateUUID(),
+			"vless_path": path + "-vl",
+			"vmess_port": ports[1],
+			"vmess_path": path + "-vm",
+		},
+	}
+
+	installCmd := fmt.Sprintf(`
+mkdir -p /etc/ssh-tunnel && cat > /etc/ssh-tunnel/v2ray-cdn.json << 'EOF'
+%s
+EOF
+docker rm -f v2ray-cdn >/dev/null 2>&1; \
+docker run -d --name v2ray-cdn --restart unless-stopped \
+  -p %d:%d -p %d:%d \
+  -v /etc/ssh-tunnel/v2ray-cdn.json:/etc/v2ray/config.json:ro \
+  v2fly/v2fly-core:latest run -c /etc/v2ray/config.json
+`, v2rayCDNServerConfig(config), ports[0], ports[0], ports[1], ports[1])
+
+	if _, err := sd.executeCommand(installCmd); err != nil {
+		return fmt.Errorf("failed to setup V2Ray CDN fronting: %v", err)
+	}
+
+	sd.configs["v2ray_cdn"] = config
+	return nil
+}
+
 func (sd *ServerDiscovery) setupTrojan() error {
 	port := sd.getAvailablePort()
 	password := sd.generatePassword()
@@ -454,7 +621,7 @@ docker run -d --name hysteria --restart unless-stopped \
 			"bandwidth": "100mbps",
 		},
 	}
-	return nil
+	return sd.setupPortHopping("hysteria", port)
 }
 
 func (sd *ServerDiscovery) setupWireGuard() error {
@@ -483,6 +650,36 @@ docker run -d --name wireguard --restart unless-stopped \
 			"port":   port,
 		},
 	}
+	return sd.setupPortHopping("wireguard", port)
+}
+
+// setupPortHopping redirects the configured UDP port range to port so
+// clients can hop across it, and records the range on the protocol config
+func (sd *ServerDiscovery) setupPortHopping(protocol string, port int) error {
+	if sd.portHopping == "" {
+		return nil
+	}
+
+	hop := config.PortHoppingConfig{Ports: sd.portHopping}
+	if _, err := hop.PortList(); err != nil {
+		return fmt.Errorf("invalid port hopping range: %v", err)
+	}
+
+	// iptables writes ranges as first:last
+	dports := strings.ReplaceAll(strings.ReplaceAll(sd.portHopping, " ", ""), "-", ":")
+	hopCmd := fmt.Sprintf(`
+rule="PREROUTING -p udp -m multiport --dports %s -j REDIRECT --to-ports %d"
+iptables -t nat -C $rule 2>/dev/null || iptables -t nat -A $rule
+if command -v ip6tables >/dev/null; then
+  ip6tables -t nat -C $rule 2>/dev/null || ip6tables -t nat -A $rule || true
+fi
+`, dports, port)
+
+	if _, err := sd.executeCommand(hopCmd); err != nil {
+		return fmt.Errorf("failed to setup port hopping for %s: %v", protocol, err)
+	}
+
+	sd.configs[protocol].Config["port_hopping"] = sd.portHopping
 	return nil
 }
 
@@ -518,27 +715,118 @@ func (sd *ServerDiscovery) setupSOCKS5Proxy() error {
 }
 
 func (sd *ServerDiscovery) setupICMPTunnel() error {
-	// ICMP tunnel setup using socat or custom implementation
-	installCmd := `
-# Install ICMP tunnel tools
-apt-get update && apt-get install -y socat || yum install -y socat
-`
-	if _, err := sd.executeCommand(installCmd); err != nil {
-		log.Printf("Warning: Failed to install ICMP tunnel tools: %v", err)
+	// Deploy this binary as the ICMP tunnel agent
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %v", err)
+	}
+	if err := sd.uploadFile(executable, agentPath, 0755); err != nil {
+		return fmt.Errorf("failed to upload ICMP tunnel agent: %v", err)
+	}
+
+	key := sd.generatePassword()
+
+	// Stop the kernel answering pings itself, then start the agent
+	startCmd := fmt.Sprintf(`
+sysctl -w net.ipv4.icmp_echo_ignore_all=1 >/dev/null && \
+pkill -f '%s icmp-server'; ICMP_TUNNEL_KEY=%s nohup %s icmp-server --forward 127.0.0.1:%s >/var/log/ssh-tunnel-icmp.log 2>&1 &
+`, agentPath, key, agentPath, sd.info.Port)
+
+	if _, err := sd.executeCommand(startCmd); err != nil {
+		return fmt.Errorf("failed to start ICMP tunnel agent: %v", err)
 	}
 
 	sd.configs["icmp_tunnel"] = &ProtocolConfig{
-		Type: "icmp_tunnel",
+		Type: "icmp",
 		Port: 0, // ICMP doesn't use ports
 		Config: map[string]interface{}{
 			"server":   sd.info.Host,
 			"protocol": "icmp",
+			"key":      key,
+		},
+	}
+	return nil
+}
+
+// setupSpeedHelper runs this binary's speed helper on loopback, where
+// tunnels ending on the server reach it
+func (sd *ServerDiscovery) setupSpeedHelper() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %v", err)
+	}
+	if err := sd.uploadFile(executable, agentPath, 0755); err != nil {
+		return fmt.Errorf("failed to upload speed helper: %v", err)
+	}
+
+	startCmd := fmt.Sprintf(`
+pkill -f '%s bench-server'; nohup %s bench-server --listen 127.0.0.1:%d >/var/log/ssh-tunnel-bench.log 2>&1 &
+`, agentPath, agentPath, diagnostics.BenchPort)
+
+	if _, err := sd.executeCommand(startCmd); err != nil {
+		return fmt.Errorf("failed to start speed helper: %v", err)
+	}
+	return nil
+}
+
+func (sd *ServerDiscovery) setupDNSTunnel() error {
+	domain := sd.dnsDomain
+	if domain == "" {
+		domain = "t.example.com"
+		log.Printf("Warning: no DNS tunnel domain set, using placeholder %s", domain)
+	}
+	password := sd.generatePassword()
+
+	// Install iodine and run iodined with the server at 10.53.0.1
+	installCmd := fmt.Sprintf(`
+(command -v iodined >/dev/null || (apt-get update && apt-get install -y iodine) || yum install -y iodine) && \
+pkill iodined; IODINED_PASS=%s nohup iodined -f -c 10.53.0.1/27 %s >/var/log/iodined.log 2>&1 &
+`, password, domain)
+
+	if _, err := sd.executeCommand(installCmd); err != nil {
+		return fmt.Errorf("failed to setup DNS tunnel: %v", err)
+	}
+
+	sd.configs["dns_tunnel"] = &ProtocolConfig{
+		Type: "dns",
+		Port: 53,
+		Config: map[string]interface{}{
+			"domain":    domain,
+			"password":  password,
+			"tunnel_ip": "10.53.0.1",
 		},
 	}
 	return nil
 }
 
 // Helper methods
+
+// agentPath is where this binary is installed on servers, to run the ICMP
+// tunnel agent and the speed helper
+const agentPath = "/usr/local/bin/ssh-tunnel"
+
+// canRunAgent reports whether this binary can be installed and run as root
+// on the server
+func (sd *ServerDiscovery) canRunAgent() bool {
+	return sd.info.User == "root" && sd.info.OS == "Linux" && goArch(sd.info.Architecture) == runtime.GOARCH
+}
+
+// goArch maps `uname -m` output to the equivalent GOARCH
+func goArch(machine string) string {
+	switch machine {
+	case "x86_64", "amd64":
+		return "amd64"
+	case "aarch64", "arm64":
+		return "arm64"
+	case "i386", "i686":
+		return "386"
+	case "armv6l", "armv7l":
+		return "arm"
+	default:
+		return machine
+	}
+}
+
 func (sd *ServerDiscovery) executeCommand(cmd string) (string, error) {
 	session, err := sd.client.NewSession()
 	if err != nil {
@@ -550,12 +838,41 @@ func (sd *ServerDiscovery) executeCommand(cmd string) (string, error) {
 	return string(output), err
 }
 
+// uploadFile copies a local file to the server over an SSH session
+func (sd *ServerDiscovery) uploadFile(localPath, remotePath string, mode os.FileMode) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	session, err := sd.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin = f
+	tmpPath := remotePath + ".tmp"
+	cmd := fmt.Sprintf("cat > %s && chmod %o %s && mv -f %s %s", tmpPath, mode.Perm(), tmpPath, tmpPath, remotePath)
+	if output, err := session.CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
 func (sd *ServerDiscovery) isPortAvailable(port int) bool {
 	cmd := fmt.Sprintf("netstat -tuln | grep ':%d ' || ss -tuln | grep ':%d '", port, port)
 	output, _ := sd.executeCommand(cmd)
 	return !strings.Contains(output, fmt.Sprintf(":%d", port))
 }
 
+func (sd *ServerDiscovery) isUDPPortInUse(port int) bool {
+	cmd := fmt.Sprintf("ss -uln 2>/dev/null | grep ':%d ' || netstat -uln 2>/dev/null | grep ':%d '", port, port)
+	output, _ := sd.executeCommand(cmd)
+	return strings.Contains(output, fmt.Sprintf(":%d", port))
+}
+
 func (sd *ServerDiscovery) hasInstalledSoftware(software string) bool {
 	for _, installed := range sd.info.InstalledSoftware {
 		if installed == software {
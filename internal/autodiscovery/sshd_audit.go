@@ -0,0 +1,319 @@
+package autodiscovery
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sshdConfigPath = "/etc/ssh/sshd_config"
+
+// sshdDefaults are OpenSSH's values for the audited settings, for when the
+// configuration file is read instead of sshd's effective configuration
+var sshdDefaults = map[string]string{
+	"allowtcpforwarding":  "yes",
+	"disableforwarding":   "no",
+	"maxsessions":         "10",
+	"gatewayports":        "no",
+	"clientaliveinterval": "0",
+	"clientalivecountmax": "3",
+}
+
+// SSHDAudit is what the server's sshd configuration means for the tunnels
+// discovery sets up
+type SSHDAudit struct {
+	Source   string            `json:"source"`   // "sshd -T", or the file read when that failed
+	Settings map[string]string `json:"settings"` // Audited settings, by lowercase keyword
+	Findings []SSHDFinding     `json:"findings"`
+	Backup   string            `json:"backup,omitempty"` // The original sshd_config, once fixed
+}
+
+// SSHDFinding is an sshd setting that breaks or degrades a feature
+type SSHDFinding struct {
+	Setting     string `json:"setting"`
+	Value       string `json:"value"`
+	Recommended string `json:"recommended"`
+	Feature     string `json:"feature"`
+	Problem     string `json:"problem"`
+	Severity    string `json:"severity"`
+}
+
+// Finding severities. Informational findings concern features discovery
+// does not set up, so FixSSHD leaves them alone.
+const (
+	SeverityBreaking = "breaking" // The feature does not work at all
+	SeverityDegraded = "degraded"
+	SeverityInfo     = "info"
+)
+
+// NeedsFix reports whether a finding breaks or degrades what discovery
+// sets up
+func (a *SSHDAudit) NeedsFix() bool {
+	for _, f := range a.Findings {
+		if f.Severity != SeverityInfo {
+			return true
+		}
+	}
+	return false
+}
+
+// SetFixSSHD makes discovery rewrite sshd settings that break or degrade
+// tunnels, keeping a backup of sshd_config
+func (sd *ServerDiscovery) SetFixSSHD(fix bool) {
+	sd.fixSSHD = fix
+}
+
+// auditSSHD reads the server's sshd configuration and checks it against
+// what the tunnels need
+func (sd *ServerDiscovery) auditSSHD() (*SSHDAudit, error) {
+	audit := &SSHDAudit{Settings: make(map[string]string)}
+
+	// sshd -T prints the effective configuration, defaults included, but
+	// needs root to read the host keys
+	if output, err := sd.executeCommand("PATH=$PATH:/usr/sbin:/sbin; sshd -T 2>/dev/null || sudo -n sshd -T 2>/dev/null"); err == nil {
+		audit.Source = "sshd -T"
+		for _, line := range strings.Split(output, "\n") {
+			if keyword, value, ok := sshdDirective(line); ok {
+				audit.Settings[keyword] = value
+			}
+		}
+	} else {
+		audit.Source = sshdConfigPath
+		if err := sd.readSSHDConfig(sshdConfigPath, audit.Settings, 0); err != nil {
+			return nil, err
+		}
+	}
+	for keyword, value := range sshdDefaults {
+		if _, ok := audit.Settings[keyword]; !ok {
+			audit.Settings[keyword] = value
+		}
+	}
+	for keyword := range audit.Settings {
+		if _, ok := sshdDefaults[keyword]; !ok {
+			delete(audit.Settings, keyword)
+		}
+	}
+
+	audit.Findings = checkSSHDSettings(audit.Settings)
+	return audit, nil
+}
+
+// readSSHDConfig parses an sshd_config file into settings, following
+// Include directives. sshd keeps the first value of a keyword, and the
+// settings of Match blocks only apply to some connections, so both are
+// left alone.
+func (sd *ServerDiscovery) readSSHDConfig(file string, settings map[string]string, depth int) error {
+	if depth > 4 {
+		return fmt.Errorf("too many nested Include directives in %s", file)
+	}
+	output, err := sd.executeCommand("cat " + file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", file, err)
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		keyword, value, ok := sshdDirective(line)
+		if !ok {
+			continue
+		}
+		switch keyword {
+		case "match":
+			return nil
+		case "include":
+			for _, pattern := range strings.Fields(value) {
+				if !path.IsAbs(pattern) {
+					pattern = path.Join("/etc/ssh", pattern)
+				}
+				// Patterns are globs, and matching nothing is fine
+				files, _ := sd.executeCommand(fmt.Sprintf(`for f in %s; do [ -f "$f" ] && echo "$f"; done; true`, pattern))
+				for _, included := range strings.Fields(files) {
+					if err := sd.readSSHDConfig(included, settings, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			if _, ok := settings[keyword]; !ok {
+				settings[keyword] = value
+			}
+		}
+	}
+	return nil
+}
+
+// sshdDirective splits a configuration line into its lowercase keyword
+// and value, which whitespace or "=" separate
+func sshdDirective(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), "", true
+	}
+	value := strings.TrimLeft(line[i:], " \t=")
+	return strings.ToLower(line[:i]), strings.Trim(value, `"`), true
+}
+
+// checkSSHDSettings lists the settings that get in the way of tunnels
+func checkSSHDSettings(settings map[string]string) []SSHDFinding {
+	var findings []SSHDFinding
+
+	if strings.EqualFold(settings["disableforwarding"], "yes") {
+		findings = append(findings, SSHDFinding{
+			Setting:     "DisableForwarding",
+			Value:       settings["disableforwarding"],
+			Recommended: "no",
+			Feature:     "SSH tunnel",
+			Problem:     "all forwarding is disabled, so the server refuses every tunneled connection",
+			Severity:    SeverityBreaking,
+		})
+	}
+
+	switch forwarding := strings.ToLower(settings["allowtcpforwarding"]); forwarding {
+	case "no", "remote":
+		findings = append(findings, SSHDFinding{
+			Setting:     "AllowTcpForwarding",
+			Value:       forwarding,
+			Recommended: "yes",
+			Feature:     "SSH tunnel",
+			Problem:     "the server refuses the direct-tcpip channels the SOCKS proxy opens",
+			Severity:    SeverityBreaking,
+		})
+	case "local":
+		findings = append(findings, SSHDFinding{
+			Setting:     "AllowTcpForwarding",
+			Value:       forwarding,
+			Recommended: "yes",
+			Feature:     "remote port forwarding",
+			Problem:     "the server refuses remote forwards",
+			Severity:    SeverityInfo,
+		})
+	}
+
+	if sessions, err := strconv.Atoi(settings["maxsessions"]); err == nil && sessions < 10 {
+		severity := SeverityDegraded
+		if sessions == 0 {
+			severity = SeverityBreaking
+		}
+		findings = append(findings, SSHDFinding{
+			Setting:     "MaxSessions",
+			Value:       settings["maxsessions"],
+			Recommended: "10",
+			Feature:     "UDP relay and diagnostics",
+			Problem:     fmt.Sprintf("only %d sessions can share one connection, so UDP relays, benchmarks and traces beyond that fail", sessions),
+			Severity:    severity,
+		})
+	}
+
+	if strings.EqualFold(settings["gatewayports"], "no") {
+		findings = append(findings, SSHDFinding{
+			Setting:     "GatewayPorts",
+			Value:       settings["gatewayports"],
+			Recommended: "clientspecified",
+			Feature:     "remote port forwarding",
+			Problem:     "remote forwards only listen on the server's loopback",
+			Severity:    SeverityInfo,
+		})
+	}
+
+	interval, _ := strconv.Atoi(settings["clientaliveinterval"])
+	count, _ := strconv.Atoi(settings["clientalivecountmax"])
+	switch {
+	case interval == 0:
+		findings = append(findings, SSHDFinding{
+			Setting:     "ClientAliveInterval",
+			Value:       settings["clientaliveinterval"],
+			Recommended: "30",
+			Feature:     "SSH tunnel",
+			Problem:     "the server never notices dead clients, so stale sessions and their forwarded ports linger",
+			Severity:    SeverityDegraded,
+		})
+	case count > 0 && interval*count < 15:
+		findings = append(findings, SSHDFinding{
+			Setting:     "ClientAliveInterval",
+			Value:       settings["clientaliveinterval"],
+			Recommended: "30",
+			Feature:     "SSH tunnel",
+			Problem:     fmt.Sprintf("clients that miss %d replies in %ds are dropped, too soon for lossy or high-latency links", count, interval*count),
+			Severity:    SeverityDegraded,
+		})
+	}
+
+	return findings
+}
+
+// FixSSHD applies the recommended values of the last audit's breaking and
+// degraded findings with SSHDFixCommand.
+func (sd *ServerDiscovery) FixSSHD() error {
+	audit := sd.info.SSHDAudit
+	if audit == nil || !audit.NeedsFix() {
+		return nil
+	}
+	if sd.info.User != "root" {
+		return fmt.Errorf("changing %s needs a root login", sshdConfigPath)
+	}
+
+	var settings []string
+	seen := make(map[string]bool)
+	for _, f := range audit.Findings {
+		if f.Severity != SeverityInfo && !seen[f.Setting] {
+			seen[f.Setting] = true
+			settings = append(settings, f.Setting+" "+f.Recommended)
+		}
+	}
+	if seen["ClientAliveInterval"] {
+		settings = append(settings, "ClientAliveCountMax 3")
+	}
+
+	fixCmd, backup := SSHDFixCommand(settings)
+	if output, err := sd.executeCommand(fixCmd); err != nil {
+		return fmt.Errorf("failed to update %s: %v: %s", sshdConfigPath, err, strings.TrimSpace(output))
+	}
+	log.Printf("Updated %s (backup at %s)", sshdConfigPath, backup)
+
+	// Existing connections keep the settings they started with; a new
+	// audit shows what new ones get
+	fixed, err := sd.auditSSHD()
+	if err != nil {
+		return err
+	}
+	fixed.Backup = backup
+	sd.info.SSHDAudit = fixed
+	return nil
+}
+
+// SSHDFixCommand returns a shell command that puts settings ("Keyword
+// value") at the top of sshd_config, where they take precedence over later
+// lines and included files, and reloads sshd. It copies the file to the
+// returned backup first and puts it back if sshd rejects the result. It
+// needs root.
+func SSHDFixCommand(settings []string) (string, string) {
+	backup := fmt.Sprintf("%s.bak-%s", sshdConfigPath, time.Now().Format("20060102-150405"))
+	lines := append([]string{"# Added by ssh-tunnel on " + time.Now().Format(time.RFC3339)}, settings...)
+
+	return fmt.Sprintf(`
+set -e
+PATH=$PATH:/usr/sbin:/sbin
+cp -p %[1]s %[2]s
+{ printf '%%s\n' %[3]s; echo; cat %[2]s; } > %[1]s
+if ! sshd -t; then
+  cp -p %[2]s %[1]s
+  exit 1
+fi
+systemctl reload ssh 2>/dev/null || systemctl reload sshd 2>/dev/null || service ssh reload 2>/dev/null || service sshd reload 2>/dev/null || kill -HUP "$(cat /var/run/sshd.pid)"
+`, sshdConfigPath, backup, shellQuote(lines)), backup
+}
+
+// shellQuote single-quotes each word for sh
+func shellQuote(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = "'" + strings.ReplaceAll(w, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
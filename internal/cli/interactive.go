@@ -126,6 +126,7 @@ func (cli *InteractiveCLI) handleQuickSetup() error {
 	// Optional settings
 	fmt.Println()
 	setupProtocols := cli.getUserConfirmation("Setup all protocols on server? (y/n)")
+	fixSSHD := cli.getUserConfirmation("Fix sshd settings that would break tunnels, keeping a backup? (y/n)")
 	outputDir := cli.getUserInputWithDefault("Output directory for configs", "client-configs")
 
 	// Execute setup
@@ -133,6 +134,11 @@ func (cli *InteractiveCLI) handleQuickSetup() error {
 	fmt.Println("🚀 Starting auto-discovery...")
 
 	discovery := autodiscovery.NewServerDiscovery()
+	discovery.SetFixSSHD(fixSSHD)
+	discovery.SetConfirmHostKey(func(host, fingerprint string) bool {
+		fmt.Printf("⚠️  %s is not in ~/.ssh/known_hosts. Its host key fingerprint is %s\n", host, fingerprint)
+		return cli.getUserConfirmation("Does it match the server's key (ssh-keygen -lf /etc/ssh/ssh_host_*_key.pub)? (y/n)")
+	})
 	serverInfo, err := discovery.DiscoverServer(host, "22", user, password, keyPath)
 	if err != nil {
 		fmt.Printf("❌ Discovery failed: %v\n", err)
@@ -188,6 +194,7 @@ func (cli *InteractiveCLI) handleMeshNetwork() error {
 		LoadBalancing:       "latency",
 		FailoverTimeout:     30000000000, // 30 seconds
 		Encryption:          true,
+		LeaseFile:           "data/mesh-leases.json",
 	}
 
 	// Create mesh network
@@ -328,6 +335,17 @@ func (cli *InteractiveCLI) displayServerInfo(info *autodiscovery.ServerInfo) {
 	fmt.Printf("   🔌 Available Ports: %v\n", info.AvailablePorts)
 	fmt.Printf("   📦 Installed Software: %v\n", info.InstalledSoftware)
 	fmt.Printf("   🔄 Supported Protocols: %v\n", info.SupportedProtocols)
+
+	if audit := info.SSHDAudit; audit != nil && len(audit.Findings) > 0 {
+		fmt.Println()
+		fmt.Printf("🔒 sshd configuration (%s):\n", audit.Source)
+		for _, f := range audit.Findings {
+			fmt.Printf("   ⚠️  %s %s: %s (recommended: %s)\n", f.Setting, f.Value, f.Problem, f.Recommended)
+		}
+		if audit.Backup != "" {
+			fmt.Printf("   🔧 Fixed; the original is at %s\n", audit.Backup)
+		}
+	}
 }
 
 func (cli *InteractiveCLI) handlePostSetup(outputDir string) error {
@@ -447,7 +465,13 @@ func (cli *InteractiveCLI) addServerToMesh(meshNet *mesh.MeshNetwork) {
 		return
 	}
 
-	fmt.Printf("✅ Server added to mesh: %s (%s)\n", node.Name, node.MeshIP)
+	fmt.Printf("✅ Server added to mesh: %s (%s) - %s\n", node.Name, node.MeshIP, node.Status)
+	if len(node.Protocols) > 0 {
+		fmt.Printf("   Protocols: %s\n", strings.Join(node.Protocols, ", "))
+	}
+	if os := node.Labels["os"]; os != "" {
+		fmt.Printf("   Platform: %s %s\n", os, node.Labels["arch"])
+	}
 }
 
 func (cli *InteractiveCLI) showMeshStatus(meshNet *mesh.MeshNetwork) {
@@ -0,0 +1,29 @@
+package config
+
+import "fmt"
+
+// Agent forwarding policies for tunnel shell sessions
+const (
+	AgentForwardingOff     = "off"     // Never forward the agent (default)
+	AgentForwardingOn      = "on"      // Let the server use every agent key
+	AgentForwardingConfirm = "confirm" // Ask on the terminal before each signature
+)
+
+// validateAgentForwarding checks a server's agent forwarding policy, which
+// applies to the shells and commands the built-in SSH client opens
+func validateAgentForwarding(i int, server *Server) error {
+	switch server.AgentForwarding {
+	case "", AgentForwardingOff:
+		return nil
+	case AgentForwardingOn, AgentForwardingConfirm:
+	default:
+		return fmt.Errorf("server %d: unsupported agent_forwarding: %s (supported: off, on, confirm)", i, server.AgentForwarding)
+	}
+	if (server.Transport != TransportSSH && server.Transport != TransportICMP) || server.Exec != nil {
+		return fmt.Errorf("server %d: agent_forwarding is only supported for the ssh and icmp transports", i)
+	}
+	if len(server.Chain) > 0 {
+		return fmt.Errorf("server %d: agent_forwarding is not supported through chains", i)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// JWTConfig lets API clients log in at /api/v1/auth/login as one of the
+// security users and get short-lived signed tokens, which are easier to
+// rotate than auth_tokens. The static tokens keep working alongside.
+type JWTConfig struct {
+	Enabled        bool          `yaml:"enabled" json:"enabled"`
+	Algorithm      string        `yaml:"algorithm,omitempty" json:"algorithm,omitempty"`               // HS256 (default) or RS256
+	Secret         string        `yaml:"secret,omitempty" json:"secret,omitempty"`                     // HMAC key for HS256, at least 32 bytes
+	PrivateKeyPath string        `yaml:"private_key_path,omitempty" json:"private_key_path,omitempty"` // PEM RSA key for RS256
+	Issuer         string        `yaml:"issuer,omitempty" json:"issuer,omitempty"`
+	TTL            time.Duration `yaml:"ttl,omitempty" json:"ttl,omitempty"`                 // Lifetime of access tokens
+	RefreshTTL     time.Duration `yaml:"refresh_ttl,omitempty" json:"refresh_ttl,omitempty"` // Lifetime of refresh tokens
+}
+
+// APIUser is an account that can log in to the API
+type APIUser struct {
+	Name         string `yaml:"name" json:"name"`
+	Password     string `yaml:"password,omitempty" json:"password,omitempty"`
+	PasswordHash string `yaml:"password_hash,omitempty" json:"password_hash,omitempty"` // bcrypt, instead of password
+	Role         string `yaml:"role,omitempty" json:"role,omitempty"`                   // admin by default
+}
+
+// API roles, from the least privileged. Each may do what the ones before
+// it may: read-only makes GET requests, operator also starts, stops and
+// tests tunnels, and admin also changes the configuration and manages
+// the API keys. Static auth_tokens are admin.
+const (
+	RoleReadOnly = "read-only"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleRanks = map[string]int{RoleReadOnly: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// IsRole reports whether s names an API role
+func IsRole(s string) bool {
+	return roleRanks[s] > 0
+}
+
+// RoleAllows reports whether role may do what required may
+func RoleAllows(role, required string) bool {
+	return IsRole(role) && roleRanks[role] >= roleRanks[required]
+}
+
+// APIKey is an API key created over the API. Only a hash of the key is
+// kept; the key itself is shown once, when it is created.
+type APIKey struct {
+	ID      string    `yaml:"id" json:"id"` // Part of the key, to find it by
+	Name    string    `yaml:"name" json:"name"`
+	Hash    string    `yaml:"hash,omitempty" json:"hash,omitempty"` // Hex SHA-256 of the key
+	Role    string    `yaml:"role" json:"role"`
+	Created time.Time `yaml:"created" json:"created"`
+	Expires time.Time `yaml:"expires,omitempty" json:"expires,omitempty"` // Zero never expires
+}
+
+// setAuthDefaults gives users without a role admin, and fills in the
+// token settings of an enabled JWT block
+func setAuthDefaults(security *SecurityConfig) {
+	for i := range security.Users {
+		if security.Users[i].Role == "" {
+			security.Users[i].Role = RoleAdmin
+		}
+	}
+
+	j := &security.JWT
+	if !j.Enabled {
+		return
+	}
+	if j.Algorithm == "" {
+		j.Algorithm = "HS256"
+	}
+	if j.Issuer == "" {
+		j.Issuer = "ssh-tunnel"
+	}
+	if j.TTL == 0 {
+		j.TTL = 15 * time.Minute
+	}
+	if j.RefreshTTL == 0 {
+		j.RefreshTTL = 24 * time.Hour
+	}
+}
+
+// validateAuth checks the API users, the API keys and the JWT block
+func validateAuth(config *Config) error {
+	keys := make(map[string]bool)
+	for i, key := range config.Security.APIKeys {
+		if key.ID == "" || key.Name == "" || len(key.Hash) != 64 {
+			return fmt.Errorf("security api key %d: id, name and a SHA-256 hash are required", i)
+		}
+		if keys[key.ID] || keys[key.Name] {
+			return fmt.Errorf("security api key %s is defined twice", key.Name)
+		}
+		keys[key.ID], keys[key.Name] = true, true
+		if !IsRole(key.Role) {
+			return fmt.Errorf("security api key %s: unknown role %q (supported: read-only, operator, admin)", key.Name, key.Role)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, user := range config.Security.Users {
+		if user.Name == "" {
+			return fmt.Errorf("security user %d: name is required", i)
+		}
+		if names[user.Name] {
+			return fmt.Errorf("security user %s is defined twice", user.Name)
+		}
+		names[user.Name] = true
+		if (user.Password == "") == (user.PasswordHash == "") {
+			return fmt.Errorf("security user %s: exactly one of password and password_hash is required", user.Name)
+		}
+		if !IsRole(user.Role) {
+			return fmt.Errorf("security user %s: unknown role %q (supported: read-only, operator, admin)", user.Name, user.Role)
+		}
+	}
+
+	j := config.Security.JWT
+	if !j.Enabled {
+		return nil
+	}
+	if !config.Security.EnableAuth {
+		return fmt.Errorf("security jwt requires enable_auth")
+	}
+	if len(config.Security.Users) == 0 {
+		return fmt.Errorf("security jwt requires at least one user to log in as")
+	}
+	switch j.Algorithm {
+	case "HS256":
+		if len(j.Secret) < 32 {
+			return fmt.Errorf("security jwt secret must be at least 32 bytes for HS256")
+		}
+	case "RS256":
+		if j.PrivateKeyPath == "" {
+			return fmt.Errorf("security jwt private_key_path is required for RS256")
+		}
+	default:
+		return fmt.Errorf("unsupported security jwt algorithm: %s (supported: HS256, RS256)", j.Algorithm)
+	}
+	if j.TTL <= 0 {
+		return fmt.Errorf("security jwt ttl must be positive")
+	}
+	if j.RefreshTTL < j.TTL {
+		return fmt.Errorf("security jwt refresh_ttl must be at least ttl")
+	}
+	return nil
+}
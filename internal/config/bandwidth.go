@@ -0,0 +1,96 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// bandwidthUnits maps rate suffixes to bytes per second. Lowercase "b"
+// units are bits, as in "5mbps"; "B/s" units are bytes.
+var bandwidthUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"gbps", 1e9 / 8}, {"mbps", 1e6 / 8}, {"kbps", 1e3 / 8}, {"bps", 1.0 / 8},
+	{"GB/s", 1e9}, {"MB/s", 1e6}, {"KB/s", 1e3}, {"B/s", 1},
+}
+
+// minBandwidth is the lowest accepted limit, in bytes per second; anything
+// slower stalls handshakes past their timeouts
+const minBandwidth = 1000
+
+// bandwidthTransports are the transports whose local proxy enforces limits
+var bandwidthTransports = map[TransportType]bool{
+	TransportSSH: true, TransportTrojan: true, TransportNaive: true,
+	TransportV2Ray: true, TransportVMess: true, TransportVLESS: true,
+}
+
+// ParseBandwidth converts a rate such as "5mbps" or "512KB/s" to bytes per
+// second
+func ParseBandwidth(s string) (float64, error) {
+	value := strings.TrimSpace(s)
+	for _, unit := range bandwidthUnits {
+		var number string
+		if strings.ToLower(unit.suffix) == unit.suffix {
+			// Bit rates are case-insensitive: "5Mbps" is "5mbps"
+			if !strings.HasSuffix(strings.ToLower(value), unit.suffix) {
+				continue
+			}
+			number = value[:len(value)-len(unit.suffix)]
+		} else {
+			if !strings.HasSuffix(value, unit.suffix) {
+				continue
+			}
+			number = strings.TrimSuffix(value, unit.suffix)
+		}
+
+		n, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid bandwidth %q", s)
+		}
+		return n * unit.scale, nil
+	}
+	return 0, fmt.Errorf("invalid bandwidth %q: expected a unit such as mbps or MB/s", s)
+}
+
+// BandwidthLimits returns the upload and download limits of a server in
+// bytes per second; zero means unlimited. upload_limit and download_limit
+// override bandwidth_limit for their direction.
+func (s *Server) BandwidthLimits() (upload, download float64, err error) {
+	parse := func(values ...string) (float64, error) {
+		for _, value := range values {
+			if value != "" {
+				return ParseBandwidth(value)
+			}
+		}
+		return 0, nil
+	}
+
+	if upload, err = parse(s.UploadLimit, s.BandwidthLimit); err != nil {
+		return 0, 0, err
+	}
+	if download, err = parse(s.DownloadLimit, s.BandwidthLimit); err != nil {
+		return 0, 0, err
+	}
+	return upload, download, nil
+}
+
+// validateBandwidth checks the bandwidth limits of a server
+func validateBandwidth(i int, server *Server) error {
+	if server.Exec != nil {
+		return fmt.Errorf("server %d: bandwidth limits are not supported with exec", i)
+	}
+	if len(server.Chain) == 0 && !bandwidthTransports[server.Transport] {
+		return fmt.Errorf("server %d: bandwidth limits are not supported for %s", i, server.Transport)
+	}
+
+	upload, download, err := server.BandwidthLimits()
+	if err != nil {
+		return fmt.Errorf("server %d: %v", i, err)
+	}
+	if (upload > 0 && upload < minBandwidth) || (download > 0 && download < minBandwidth) {
+		return fmt.Errorf("server %d: bandwidth limits must be at least 8kbps", i)
+	}
+	return nil
+}
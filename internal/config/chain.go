@@ -0,0 +1,49 @@
+package config
+
+import "fmt"
+
+// chainTransports can carry a multi-hop chain: each hop is dialed through
+// the previous one, so it must run over a single TCP stream
+var chainTransports = map[TransportType]bool{
+	TransportSSH: true, TransportTrojan: true, TransportVLESS: true, TransportNaive: true,
+}
+
+// validateChain checks that a server's chain names other servers that can
+// be used as hops. Hops may be disabled; they are only dialed as part of
+// the chain.
+func validateChain(i int, server *Server, servers []Server) error {
+	if server.Exec != nil {
+		return fmt.Errorf("server %d: chain cannot be used with exec", i)
+	}
+	if !chainTransports[server.Transport] {
+		return fmt.Errorf("server %d: chain is only supported for ssh, trojan, vless and naive transports", i)
+	}
+
+	byName := make(map[string]*Server, len(servers))
+	for j := range servers {
+		byName[servers[j].Name] = &servers[j]
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range server.Chain {
+		if name == server.Name {
+			return fmt.Errorf("server %d: chain cannot include the server itself", i)
+		}
+		if seen[name] {
+			return fmt.Errorf("server %d: chain lists %s more than once", i, name)
+		}
+		seen[name] = true
+
+		hop, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("server %d: chain hop %s not found", i, name)
+		}
+		if len(hop.Chain) > 0 {
+			return fmt.Errorf("server %d: chain hop %s has its own chain", i, name)
+		}
+		if hop.Exec != nil || !chainTransports[hop.Transport] {
+			return fmt.Errorf("server %d: chain hop %s uses %s, which cannot be chained", i, name, hop.Transport)
+		}
+	}
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
@@ -27,6 +28,11 @@ const (
 	TransportTrojan    TransportType = "trojan"
 	TransportVLESS     TransportType = "vless"
 	TransportVMess     TransportType = "vmess"
+	TransportTUIC      TransportType = "tuic"
+	TransportNaive     TransportType = "naive"
+	TransportDNS       TransportType = "dns"
+	TransportICMP      TransportType = "icmp"
+	TransportSSH3      TransportType = "ssh3" // Experimental: SSH over HTTP/3 (QUIC)
 )
 
 // ProxyType represents proxy types
@@ -34,23 +40,31 @@ type ProxyType string
 
 const (
 	ProxySOCKS5 ProxyType = "socks5"
+	ProxySOCKS4 ProxyType = "socks4" // Also SOCKS4a
 	ProxyHTTP   ProxyType = "http"
 	ProxyHTTPS  ProxyType = "https"
+	ProxyAuto   ProxyType = "auto" // SOCKS4/4a, SOCKS5 and HTTP on one port
 )
 
 // SecurityConfig holds security-related configuration
 type SecurityConfig struct {
-	EnableTLS         bool     `yaml:"enable_tls" json:"enable_tls"`
-	TLSCertPath       string   `yaml:"tls_cert_path,omitempty" json:"tls_cert_path,omitempty"`
-	TLSKeyPath        string   `yaml:"tls_key_path,omitempty" json:"tls_key_path,omitempty"`
-	EnableAuth        bool     `yaml:"enable_auth" json:"enable_auth"`
-	AuthTokens        []string `yaml:"auth_tokens,omitempty" json:"auth_tokens,omitempty"`
-	EncryptConfig     bool     `yaml:"encrypt_config" json:"encrypt_config"`
-	MasterPassword    string   `yaml:"master_password,omitempty" json:"master_password,omitempty"`
-	FakeTLS           bool     `yaml:"fake_tls" json:"fake_tls"`
-	Reality           bool     `yaml:"reality" json:"reality"`
-	RealityTarget     string   `yaml:"reality_target,omitempty" json:"reality_target,omitempty"`
-	RealityServerName string   `yaml:"reality_server_name,omitempty" json:"reality_server_name,omitempty"`
+	EnableTLS         bool      `yaml:"enable_tls" json:"enable_tls"`
+	TLSCertPath       string    `yaml:"tls_cert_path,omitempty" json:"tls_cert_path,omitempty"`
+	TLSKeyPath        string    `yaml:"tls_key_path,omitempty" json:"tls_key_path,omitempty"`
+	EnableAuth        bool      `yaml:"enable_auth" json:"enable_auth"`
+	AuthTokens        []string  `yaml:"auth_tokens,omitempty" json:"auth_tokens,omitempty"`
+	Users             []APIUser `yaml:"users,omitempty" json:"users,omitempty"`       // Accounts for the JWT login
+	APIKeys           []APIKey  `yaml:"api_keys,omitempty" json:"api_keys,omitempty"` // Managed at /api/v1/keys
+	JWT               JWTConfig `yaml:"jwt,omitempty" json:"jwt,omitempty"`
+	EncryptConfig     bool      `yaml:"encrypt_config" json:"encrypt_config"`
+	MasterPassword    string    `yaml:"master_password,omitempty" json:"master_password,omitempty"`
+	FakeTLS           bool      `yaml:"fake_tls" json:"fake_tls"`
+	Reality           bool      `yaml:"reality" json:"reality"`
+	RealityTarget     string    `yaml:"reality_target,omitempty" json:"reality_target,omitempty"`
+	RealityServerName string    `yaml:"reality_server_name,omitempty" json:"reality_server_name,omitempty"`
+
+	// Agents are the instances that may open a control channel to this one
+	Agents []AgentCredential `yaml:"agents,omitempty" json:"agents,omitempty"`
 }
 
 // HysteriaConfig specific configuration for Hysteria protocol
@@ -61,6 +75,34 @@ type HysteriaConfig struct {
 	ALPN         string `yaml:"alpn,omitempty" json:"alpn,omitempty"`
 	Obfs         string `yaml:"obfs,omitempty" json:"obfs,omitempty"`
 	ObfsPassword string `yaml:"obfs_password,omitempty" json:"obfs_password,omitempty"`
+	MTU          int    `yaml:"mtu,omitempty" json:"mtu,omitempty"` // Path MTU to the server; probed at connect time when unset
+}
+
+// TUICConfig specific configuration for TUIC v5 protocol
+type TUICConfig struct {
+	UUID              string   `yaml:"uuid" json:"uuid"`
+	Password          string   `yaml:"password" json:"password"`
+	CongestionControl string   `yaml:"congestion_control,omitempty" json:"congestion_control,omitempty"` // "cubic", "new_reno", "bbr"; exec only, the native client uses cubic
+	UDPRelayMode      string   `yaml:"udp_relay_mode,omitempty" json:"udp_relay_mode,omitempty"`         // "native" or "quic"
+	ALPN              []string `yaml:"alpn,omitempty" json:"alpn,omitempty"`
+	SNI               string   `yaml:"sni,omitempty" json:"sni,omitempty"`
+	ZeroRTT           bool     `yaml:"zero_rtt,omitempty" json:"zero_rtt,omitempty"` // Exec only
+	MTU               int      `yaml:"mtu,omitempty" json:"mtu,omitempty"`           // Path MTU to the server; probed at connect time when unset
+}
+
+// SSH3Config for the experimental SSH-over-HTTP/3 transport. The server
+// side is `tunnel ssh3-server`, which logs in to the host's sshd with the
+// server's user and credentials.
+type SSH3Config struct {
+	Path string `yaml:"path,omitempty" json:"path,omitempty"` // URL path the companion server serves
+	SNI  string `yaml:"sni,omitempty" json:"sni,omitempty"`
+}
+
+// NaiveConfig for NaiveProxy (HTTP/2 CONNECT over TLS) protocol
+type NaiveConfig struct {
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+	SNI      string `yaml:"sni,omitempty" json:"sni,omitempty"`
 }
 
 // V2RayConfig for V2Ray protocol configuration
@@ -68,12 +110,117 @@ type V2RayConfig struct {
 	UUID       string            `yaml:"uuid" json:"uuid"`
 	AlterID    int               `yaml:"alter_id,omitempty" json:"alter_id,omitempty"`
 	Security   string            `yaml:"security,omitempty" json:"security,omitempty"`
-	Network    string            `yaml:"network,omitempty" json:"network,omitempty"`
+	Network    string            `yaml:"network,omitempty" json:"network,omitempty"` // "tcp", "ws", "wss", "grpc", "kcp"
 	HeaderType string            `yaml:"header_type,omitempty" json:"header_type,omitempty"`
 	Path       string            `yaml:"path,omitempty" json:"path,omitempty"`
-	Host       string            `yaml:"host,omitempty" json:"host,omitempty"`
+	Host       string            `yaml:"host,omitempty" json:"host,omitempty"` // HTTP Host header, e.g. the CDN-fronted domain
 	TLS        string            `yaml:"tls,omitempty" json:"tls,omitempty"`
+	SNI        string            `yaml:"sni,omitempty" json:"sni,omitempty"` // TLS server name, defaults to host
 	Headers    map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+	KCP        *KCPConfig        `yaml:"kcp,omitempty" json:"kcp,omitempty"`
+	GRPC       *GRPCConfig       `yaml:"grpc,omitempty" json:"grpc,omitempty"`
+}
+
+// GRPCConfig configures the gRPC transport used when the V2Ray network is
+// "grpc". gRPC runs over HTTP/2 and passes through most CDNs.
+type GRPCConfig struct {
+	ServiceName string `yaml:"service_name" json:"service_name"`
+	MultiMode   bool   `yaml:"multi_mode,omitempty" json:"multi_mode,omitempty"` // Batch several chunks per message (Xray)
+}
+
+// KCPConfig tunes the mKCP transport used when the V2Ray network is "kcp".
+// mKCP trades bandwidth for latency and keeps working on lossy links where
+// TCP-based transports stall.
+type KCPConfig struct {
+	MTU              int    `yaml:"mtu,omitempty" json:"mtu,omitempty"`                             // 576-1460
+	TTI              int    `yaml:"tti,omitempty" json:"tti,omitempty"`                             // Transmission interval in ms, 10-100
+	UplinkCapacity   int    `yaml:"uplink_capacity,omitempty" json:"uplink_capacity,omitempty"`     // MB/s
+	DownlinkCapacity int    `yaml:"downlink_capacity,omitempty" json:"downlink_capacity,omitempty"` // MB/s
+	Congestion       bool   `yaml:"congestion,omitempty" json:"congestion,omitempty"`               // Back off when loss is detected
+	ReadBufferSize   int    `yaml:"read_buffer_size,omitempty" json:"read_buffer_size,omitempty"`   // MB
+	WriteBufferSize  int    `yaml:"write_buffer_size,omitempty" json:"write_buffer_size,omitempty"` // MB
+	Seed             string `yaml:"seed,omitempty" json:"seed,omitempty"`                           // Obfuscation seed shared with the server
+}
+
+// kcpHeaderTypes are the packet disguises supported by mKCP
+var kcpHeaderTypes = map[string]bool{
+	"none": true, "srtp": true, "utp": true, "wechat-video": true, "dtls": true, "wireguard": true,
+}
+
+// StreamSettings returns the v2ray-core streamSettings object for this
+// configuration
+func (c *V2RayConfig) StreamSettings() map[string]interface{} {
+	network := c.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	settings := map[string]interface{}{
+		"network": network,
+	}
+	if c.TLS != "" {
+		settings["security"] = c.TLS
+	}
+
+	switch network {
+	case "ws":
+		headers := make(map[string]string, len(c.Headers)+1)
+		for k, v := range c.Headers {
+			headers[k] = v
+		}
+		if c.Host != "" {
+			headers["Host"] = c.Host
+		}
+		ws := map[string]interface{}{"path": c.Path}
+		if len(headers) > 0 {
+			ws["headers"] = headers
+		}
+		settings["wsSettings"] = ws
+	case "kcp":
+		kcp := c.KCP
+		if kcp == nil {
+			kcp = &KCPConfig{}
+		}
+		headerType := c.HeaderType
+		if headerType == "" {
+			headerType = "none"
+		}
+		kcpSettings := map[string]interface{}{
+			"mtu":              kcp.MTU,
+			"tti":              kcp.TTI,
+			"uplinkCapacity":   kcp.UplinkCapacity,
+			"downlinkCapacity": kcp.DownlinkCapacity,
+			"congestion":       kcp.Congestion,
+			"readBufferSize":   kcp.ReadBufferSize,
+			"writeBufferSize":  kcp.WriteBufferSize,
+			"header":           map[string]interface{}{"type": headerType},
+		}
+		if kcp.Seed != "" {
+			kcpSettings["seed"] = kcp.Seed
+		}
+		settings["kcpSettings"] = kcpSettings
+	case "grpc":
+		grpc := c.GRPC
+		if grpc == nil {
+			grpc = &GRPCConfig{}
+		}
+		settings["grpcSettings"] = map[string]interface{}{
+			"serviceName": grpc.ServiceName,
+			"multiMode":   grpc.MultiMode,
+		}
+	}
+
+	if c.TLS == "tls" {
+		serverName := c.SNI
+		if serverName == "" {
+			serverName = c.Host
+		}
+		if serverName != "" {
+			settings["tlsSettings"] = map[string]interface{}{"serverName": serverName}
+		}
+	}
+
+	return settings
 }
 
 // WireGuardConfig for WireGuard protocol
@@ -83,7 +230,70 @@ type WireGuardConfig struct {
 	PreSharedKey string   `yaml:"pre_shared_key,omitempty" json:"pre_shared_key,omitempty"`
 	AllowedIPs   []string `yaml:"allowed_ips" json:"allowed_ips"`
 	DNS          []string `yaml:"dns,omitempty" json:"dns,omitempty"`
-	MTU          int      `yaml:"mtu,omitempty" json:"mtu,omitempty"`
+	MTU          int      `yaml:"mtu,omitempty" json:"mtu,omitempty"` // Tunnel interface MTU; the probed path MTU less 80 when unset
+}
+
+// ExecConfig runs a tunnel through an external client binary (xray,
+// hysteria, tuic-client, trojan-go) for protocols without a native
+// implementation. The binary's config is generated from the server entry
+// unless ConfigFile is set, and the binary serves local_port itself.
+type ExecConfig struct {
+	Binary     string   `yaml:"binary,omitempty" json:"binary,omitempty"`           // Path or name in $PATH, defaults per transport
+	Args       []string `yaml:"args,omitempty" json:"args,omitempty"`               // "{config}" is replaced by the config file path
+	ConfigFile string   `yaml:"config_file,omitempty" json:"config_file,omitempty"` // Use this config instead of generating one
+	Insecure   bool     `yaml:"insecure,omitempty" json:"insecure,omitempty"`       // Only with the server's insecure_skip_verify, which covers it
+}
+
+// execBinaries are the default external clients per transport. Configs can
+// only be generated for these transports.
+var execBinaries = map[TransportType]string{
+	TransportHysteria: "hysteria",
+	TransportTUIC:     "tuic-client",
+	TransportTrojan:   "trojan-go",
+	TransportV2Ray:    "xray",
+	TransportVMess:    "xray",
+	TransportVLESS:    "xray",
+}
+
+// DNSTunnelConfig for iodine-compatible DNS tunnels carrying SSH
+type DNSTunnelConfig struct {
+	Domain   string `yaml:"domain" json:"domain"`                         // Delegated tunnel domain, e.g. "t.example.com"
+	Password string `yaml:"password,omitempty" json:"password,omitempty"` // iodine password
+	Resolver string `yaml:"resolver,omitempty" json:"resolver,omitempty"` // Recursive resolver, system default if empty
+	TunnelIP string `yaml:"tunnel_ip,omitempty" json:"tunnel_ip,omitempty"`
+}
+
+// ICMPConfig for SSH carried in ICMP echo messages to the tunnel agent
+type ICMPConfig struct {
+	Key          string        `yaml:"key" json:"key"`                                         // Shared secret with the agent
+	MTU          int           `yaml:"mtu,omitempty" json:"mtu,omitempty"`                     // Frame size per echo message
+	PollInterval time.Duration `yaml:"poll_interval,omitempty" json:"poll_interval,omitempty"` // Idle poll interval
+}
+
+// ObfuscationConfig wraps a TCP transport in an obfuscation layer
+type ObfuscationConfig struct {
+	Type     string `yaml:"type" json:"type"` // "xor", "tls", "obfs4" or "none"; the server runs tunnel obfs-server or any obfs4 bridge
+	Key      string `yaml:"key,omitempty" json:"key,omitempty"`
+	SNI      string `yaml:"sni,omitempty" json:"sni,omitempty"`
+	Insecure bool   `yaml:"insecure,omitempty" json:"insecure,omitempty"` // Only with the server's insecure_skip_verify
+	Cert     string `yaml:"cert,omitempty" json:"cert,omitempty"`         // obfs4: the bridge's cert, as its bridge line has it
+	IATMode  int    `yaml:"iat_mode,omitempty" json:"iat_mode,omitempty"` // obfs4: 0 off, 1 split packets, 2 paranoid; must match the bridge
+}
+
+// MuxConfig carries many proxied connections as streams over a few outer
+// connections, so the server sees a handful of long-lived connections
+// instead of one per request. Native trojan uses smux (trojan-go
+// compatible); exec clients use their own mux.
+type MuxConfig struct {
+	Enabled     bool          `yaml:"enabled" json:"enabled"`
+	MaxStreams  int           `yaml:"max_streams,omitempty" json:"max_streams,omitempty"`   // Streams per outer connection
+	IdleTimeout time.Duration `yaml:"idle_timeout,omitempty" json:"idle_timeout,omitempty"` // Close outer connections idle this long
+}
+
+// muxTransports support stream multiplexing: natively for trojan, through
+// the exec client for the others
+var muxTransports = map[TransportType]bool{
+	TransportTrojan: true, TransportV2Ray: true, TransportVMess: true, TransportVLESS: true,
 }
 
 // Server represents a tunnel server configuration
@@ -98,15 +308,79 @@ type Server struct {
 	Proxy      ProxyType     `yaml:"proxy" json:"proxy"`
 	LocalPort  int           `yaml:"local_port" json:"local_port"`
 	Priority   int           `yaml:"priority,omitempty" json:"priority,omitempty"`
+	Cost       float64       `yaml:"cost,omitempty" json:"cost,omitempty"`
 	MaxRetries int           `yaml:"max_retries,omitempty" json:"max_retries,omitempty"`
 	Timeout    time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
 	Enabled    bool          `yaml:"enabled" json:"enabled"`
 
+	// A server that must be up, unlike a nice-to-have exit: readiness waits
+	// for it, health degrades and a critical alert is raised when it goes
+	// down, and with strict_startup failing to start it fails the startup
+	Required bool `yaml:"required,omitempty" json:"required,omitempty"`
+
 	// Protocol-specific configurations
 	Hysteria  *HysteriaConfig  `yaml:"hysteria,omitempty" json:"hysteria,omitempty"`
+	TUIC      *TUICConfig      `yaml:"tuic,omitempty" json:"tuic,omitempty"`
+	Naive     *NaiveConfig     `yaml:"naive,omitempty" json:"naive,omitempty"`
+	DNSTunnel *DNSTunnelConfig `yaml:"dns_tunnel,omitempty" json:"dns_tunnel,omitempty"`
+	ICMP      *ICMPConfig      `yaml:"icmp,omitempty" json:"icmp,omitempty"`
+	SSH3      *SSH3Config      `yaml:"ssh3,omitempty" json:"ssh3,omitempty"`
 	V2Ray     *V2RayConfig     `yaml:"v2ray,omitempty" json:"v2ray,omitempty"`
 	WireGuard *WireGuardConfig `yaml:"wireguard,omitempty" json:"wireguard,omitempty"`
 
+	// Run the tunnel through an external client binary instead
+	Exec *ExecConfig `yaml:"exec,omitempty" json:"exec,omitempty"`
+
+	// SSH engine: "native" (default) or "openssh" to run the system ssh
+	// command, which can use the agent, smartcards and ~/.ssh/config
+	Engine  string         `yaml:"engine,omitempty" json:"engine,omitempty"`
+	OpenSSH *OpenSSHConfig `yaml:"openssh,omitempty" json:"openssh,omitempty"`
+
+	// Optional smartcard (PKCS#11) or FIDO2 security key for SSH
+	// authentication, instead of a password or key file
+	HardwareKey *HardwareKeyConfig `yaml:"hardware_key,omitempty" json:"hardware_key,omitempty"`
+
+	// How the server's identity is verified. SSH host keys are checked
+	// against host_key, a public key or its SHA256 fingerprint, or else
+	// against known_hosts (~/.ssh/known_hosts by default); TLS certificates
+	// against the system roots. insecure_skip_verify turns every check off
+	// and is the only way to.
+	HostKey            string `yaml:"host_key,omitempty" json:"host_key,omitempty"`
+	KnownHosts         string `yaml:"known_hosts,omitempty" json:"known_hosts,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty" json:"insecure_skip_verify,omitempty"`
+
+	// Whether tunnel shell forwards the local ssh-agent: "off" (default),
+	// "on" or "confirm"
+	AgentForwarding string `yaml:"agent_forwarding,omitempty" json:"agent_forwarding,omitempty"`
+
+	// Optional obfuscation layer for TCP transports (SSH, Trojan)
+	Obfuscation *ObfuscationConfig `yaml:"obfuscation,omitempty" json:"obfuscation,omitempty"`
+
+	// Optional ClientHello fragmentation for TLS transports
+	Fragment *FragmentConfig `yaml:"fragment,omitempty" json:"fragment,omitempty"`
+
+	// Optional destination port rotation for UDP transports
+	PortHopping *PortHoppingConfig `yaml:"port_hopping,omitempty" json:"port_hopping,omitempty"`
+
+	// Optional UDP relay through the tunnel
+	UDP *UDPConfig `yaml:"udp,omitempty" json:"udp,omitempty"`
+
+	// Ports of the SSH server forwarded back to local services (ssh -R)
+	RemoteForwards []RemoteForwardConfig `yaml:"remote_forwards,omitempty" json:"remote_forwards,omitempty"`
+
+	// Servers to pass through, in order, before this one; traffic exits
+	// from this server
+	Chain []string `yaml:"chain,omitempty" json:"chain,omitempty"`
+
+	// Optional stream multiplexing over shared outer connections
+	Mux *MuxConfig `yaml:"mux,omitempty" json:"mux,omitempty"`
+
+	// Optional rate limits on the local proxy, e.g. "5mbps" or "512KB/s".
+	// bandwidth_limit applies to both directions unless overridden.
+	BandwidthLimit string `yaml:"bandwidth_limit,omitempty" json:"bandwidth_limit,omitempty"`
+	UploadLimit    string `yaml:"upload_limit,omitempty" json:"upload_limit,omitempty"`
+	DownloadLimit  string `yaml:"download_limit,omitempty" json:"download_limit,omitempty"`
+
 	// Additional metadata
 	Region string   `yaml:"region,omitempty" json:"region,omitempty"`
 	Tags   []string `yaml:"tags,omitempty" json:"tags,omitempty"`
@@ -114,13 +388,15 @@ type Server struct {
 
 // RoutingRule defines routing rules for traffic
 type RoutingRule struct {
-	Type    string   `yaml:"type" json:"type"` // "domain", "ip", "geoip"
-	Pattern string   `yaml:"pattern" json:"pattern"`
-	Server  string   `yaml:"server,omitempty" json:"server,omitempty"`
-	Action  string   `yaml:"action" json:"action"` // "proxy", "direct", "block"
-	Domains []string `yaml:"domains,omitempty" json:"domains,omitempty"`
-	IPs     []string `yaml:"ips,omitempty" json:"ips,omitempty"`
-	GeoIP   []string `yaml:"geoip,omitempty" json:"geoip,omitempty"`
+	Type     string   `yaml:"type" json:"type"` // "domain", "ip", "geoip", "port", "url"
+	Pattern  string   `yaml:"pattern" json:"pattern"`
+	Server   string   `yaml:"server,omitempty" json:"server,omitempty"` // Server name, or "tag:<tag>" for any server with the tag
+	Action   string   `yaml:"action" json:"action"`                     // "proxy", "direct", "block"
+	Domains  []string `yaml:"domains,omitempty" json:"domains,omitempty"`
+	IPs      []string `yaml:"ips,omitempty" json:"ips,omitempty"`
+	GeoIP    []string `yaml:"geoip,omitempty" json:"geoip,omitempty"`
+	Ports    []int    `yaml:"ports,omitempty" json:"ports,omitempty"`
+	Priority string   `yaml:"priority,omitempty" json:"priority,omitempty"` // QoS class: "interactive" or "bulk"
 }
 
 // MonitoringConfig for health monitoring
@@ -132,6 +408,76 @@ type MonitoringConfig struct {
 	LogLevel        string        `yaml:"log_level,omitempty" json:"log_level,omitempty"`
 	LogFile         string        `yaml:"log_file,omitempty" json:"log_file,omitempty"`
 	MaxLogSize      string        `yaml:"max_log_size,omitempty" json:"max_log_size,omitempty"`
+
+	// System metrics (CPU, memory, network) are sampled in the background
+	// every SampleInterval, and only while metrics were read within
+	// SampleIdleTimeout
+	SampleInterval    time.Duration `yaml:"sample_interval,omitempty" json:"sample_interval,omitempty"`
+	SampleIdleTimeout time.Duration `yaml:"sample_idle_timeout,omitempty" json:"sample_idle_timeout,omitempty"`
+
+	// Where metrics history, logs, alerts and state are kept
+	Store StoreConfig `yaml:"store,omitempty" json:"store,omitempty"`
+
+	// Anomaly detection on per-server latency and throughput
+	AnomalyDetection bool    `yaml:"anomaly_detection" json:"anomaly_detection"`
+	AnomalyThreshold float64 `yaml:"anomaly_threshold,omitempty" json:"anomaly_threshold,omitempty"` // z-score, default 3
+	AnomalyAlpha     float64 `yaml:"anomaly_alpha,omitempty" json:"anomaly_alpha,omitempty"`         // EWMA smoothing, default 0.3
+
+	// Probe every server each check interval and keep the results for `tunnel simulate`
+	RecordProbes bool `yaml:"record_probes" json:"record_probes"`
+}
+
+// StoreConfig selects the backend for monitoring data. The in-memory store
+// suits laptops; the file and bolt stores keep history across restarts,
+// the bolt store indexed by time for long histories.
+type StoreConfig struct {
+	Type       string        `yaml:"type,omitempty" json:"type,omitempty"`               // "memory", "file" or "bolt"
+	Path       string        `yaml:"path,omitempty" json:"path,omitempty"`               // Directory of the file store, or the bolt database file
+	MaxEntries int           `yaml:"max_entries,omitempty" json:"max_entries,omitempty"` // Entries kept per kind by the memory store
+	Retention  time.Duration `yaml:"retention,omitempty" json:"retention,omitempty"`     // Older metrics, logs and alerts are dropped, 7 days by default on disk
+}
+
+// PluginConfig loads third-party transports, either from a Go plugin
+// (.so built against this module) or from a gRPC sidecar process serving
+// the listed transports
+type PluginConfig struct {
+	Path       string   `yaml:"path,omitempty" json:"path,omitempty"`             // Go plugin file
+	Sidecar    string   `yaml:"sidecar,omitempty" json:"sidecar,omitempty"`       // "127.0.0.1:50051" or "unix:/run/plugin.sock"
+	Transports []string `yaml:"transports,omitempty" json:"transports,omitempty"` // Transports served by the sidecar
+}
+
+// Name identifies the plugin in logs
+func (p PluginConfig) Name() string {
+	if p.Path != "" {
+		return p.Path
+	}
+	return p.Sidecar
+}
+
+// ElectionConfig lets several instances share a gateway: only the elected
+// leader starts tunnels and binds their local ports, while the others wait
+// as standbys and take over when the leader goes away
+type ElectionConfig struct {
+	Enabled       bool          `yaml:"enabled" json:"enabled"`
+	Backend       string        `yaml:"backend,omitempty" json:"backend,omitempty"`               // "file" or "consul"
+	LockFile      string        `yaml:"lock_file,omitempty" json:"lock_file,omitempty"`           // file backend
+	Address       string        `yaml:"address,omitempty" json:"address,omitempty"`               // Consul HTTP address
+	Key           string        `yaml:"key,omitempty" json:"key,omitempty"`                       // Consul KV key holding the lock
+	Token         string        `yaml:"token,omitempty" json:"token,omitempty"`                   // Consul ACL token
+	TTL           time.Duration `yaml:"ttl,omitempty" json:"ttl,omitempty"`                       // Consul session TTL
+	RetryInterval time.Duration `yaml:"retry_interval,omitempty" json:"retry_interval,omitempty"` // How often a standby retries
+
+	// Optional address that follows the leader, so LAN clients keep one
+	// proxy address across a takeover
+	VirtualIP *VirtualIPConfig `yaml:"virtual_ip,omitempty" json:"virtual_ip,omitempty"`
+}
+
+// VirtualIPConfig is a floating IPv4 address added to an interface of the
+// leader and announced with gratuitous ARP (Linux only)
+type VirtualIPConfig struct {
+	Address       string `yaml:"address" json:"address"`                                   // CIDR, e.g. "192.168.1.50/24"
+	Interface     string `yaml:"interface" json:"interface"`                               // e.g. "eth0"
+	GratuitousARP int    `yaml:"gratuitous_arp,omitempty" json:"gratuitous_arp,omitempty"` // Announcements after takeover
 }
 
 // APIConfig for REST API server
@@ -141,6 +487,11 @@ type APIConfig struct {
 	Port       int    `yaml:"port" json:"port"`
 	EnableCORS bool   `yaml:"enable_cors" json:"enable_cors"`
 	RateLimit  int    `yaml:"rate_limit,omitempty" json:"rate_limit,omitempty"`
+
+	// Debug serves pprof, expvar and goroutine dumps under /api/v1/debug.
+	// It requires security.enable_auth, as profiles expose memory contents
+	// and command lines.
+	Debug bool `yaml:"debug,omitempty" json:"debug,omitempty"`
 }
 
 // Config represents the main configuration structure
@@ -151,15 +502,58 @@ type Config struct {
 	Routing    []RoutingRule    `yaml:"routing,omitempty" json:"routing,omitempty"`
 	Monitoring MonitoringConfig `yaml:"monitoring" json:"monitoring"`
 	API        APIConfig        `yaml:"api" json:"api"`
+	Plugins    []PluginConfig   `yaml:"plugins,omitempty" json:"plugins,omitempty"`
+	Election   ElectionConfig   `yaml:"election,omitempty" json:"election,omitempty"`
+	QoS        QoSConfig        `yaml:"qos,omitempty" json:"qos,omitempty"`
+	Memory     MemoryConfig     `yaml:"memory,omitempty" json:"memory,omitempty"`
+
+	// Optional local port serving HTTP, SOCKS5 and SOCKS4 through the
+	// selected tunnel
+	MixedPort int `yaml:"mixed_port,omitempty" json:"mixed_port,omitempty"`
+
+	Shadowsocks ShadowsocksConfig `yaml:"shadowsocks,omitempty" json:"shadowsocks,omitempty"`
+
+	// Debugging only: HTTPS interception for selected domains
+	MITM MITMConfig `yaml:"mitm,omitempty" json:"mitm,omitempty"`
+
+	// Outbound control channel for managing this instance from behind NAT
+	Control ControlConfig `yaml:"control,omitempty" json:"control,omitempty"`
+
+	// Delivery of configuration change events to hooks
+	Events EventsConfig `yaml:"events,omitempty" json:"events,omitempty"`
+
+	// Reports of recovered panics
+	Crash CrashConfig `yaml:"crash,omitempty" json:"crash,omitempty"`
+
+	// Mesh coordinator managed from the API server
+	Mesh MeshConfig `yaml:"mesh,omitempty" json:"mesh,omitempty"`
+
+	// Settings merged into every server that does not set them itself, and
+	// a free-form place for YAML anchors servers can merge with "<<"
+	ServerDefaults  map[string]interface{} `yaml:"server_defaults,omitempty" json:"server_defaults,omitempty"`
+	ServerTemplates map[string]interface{} `yaml:"server_templates,omitempty" json:"server_templates,omitempty"`
 
 	// Auto-selection settings
 	AutoSelect      bool          `yaml:"auto_select" json:"auto_select"`
-	SelectionMethod string        `yaml:"selection_method,omitempty" json:"selection_method,omitempty"` // "latency", "load", "random"
+	AutoSelectTags  []string      `yaml:"auto_select_tags,omitempty" json:"auto_select_tags,omitempty"` // Only pick servers with one of these tags
+	SelectionMethod string        `yaml:"selection_method,omitempty" json:"selection_method,omitempty"` // "latency", "throughput", "load", "random"
 	LatencyTimeout  time.Duration `yaml:"latency_timeout,omitempty" json:"latency_timeout,omitempty"`
 
+	// Throughput-aware selection settings
+	ThroughputWeight *float64      `yaml:"throughput_weight,omitempty" json:"throughput_weight,omitempty"`   // 0-1, share of the score taken by measured throughput; 0 is latency only
+	ThroughputMaxAge time.Duration `yaml:"throughput_max_age,omitempty" json:"throughput_max_age,omitempty"` // Ignore speed tests older than this
+
+	// Weights used by selection_method "score" and mesh node selection
+	Scoring         ScoringWeights `yaml:"scoring,omitempty" json:"scoring,omitempty"`
+	PreferredRegion string         `yaml:"preferred_region,omitempty" json:"preferred_region,omitempty"`
+
 	// Failover settings
 	EnableFailover  bool          `yaml:"enable_failover" json:"enable_failover"`
 	FailoverTimeout time.Duration `yaml:"failover_timeout,omitempty" json:"failover_timeout,omitempty"`
+
+	// Stop with an error when a required server fails to start; when no
+	// server is marked required, every enabled server is
+	StrictStartup bool `yaml:"strict_startup,omitempty" json:"strict_startup,omitempty"`
 }
 
 // LoadConfig loads configuration from file with decryption support
@@ -175,21 +569,27 @@ func LoadConfig(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to read config file: %v", err)
 	}
 
+	return loadConfigData(data, os.Getenv("CONFIG_PASSWORD"))
+}
+
+// loadConfigData decrypts, parses, defaults and validates a config file's
+// contents. password is only needed for encrypted configs.
+func loadConfigData(data []byte, password string) (*Config, error) {
 	// Check if config is encrypted
 	if isEncrypted(data) {
-		password := os.Getenv("CONFIG_PASSWORD")
 		if password == "" {
 			return nil, fmt.Errorf("encrypted config detected but CONFIG_PASSWORD not set")
 		}
 
-		data, err = decrypt(data, password)
+		decrypted, err := decrypt(data, password)
 		if err != nil {
 			return nil, fmt.Errorf("failed to decrypt config: %v", err)
 		}
+		data = decrypted
 	}
 
 	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
+	if err := parseConfig(data, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %v", err)
 	}
 
@@ -213,10 +613,7 @@ func SaveConfig(config *Config, configPath string) error {
 
 	// Encrypt if required
 	if config.Security.EncryptConfig {
-		password := config.Security.MasterPassword
-		if password == "" {
-			password = os.Getenv("CONFIG_PASSWORD")
-		}
+		password := savePassword(config)
 		if password == "" {
 			return fmt.Errorf("encryption requested but no password provided")
 		}
@@ -236,6 +633,14 @@ func SaveConfig(config *Config, configPath string) error {
 	return os.WriteFile(configPath, data, 0600)
 }
 
+// savePassword is the password configs are encrypted with on save
+func savePassword(config *Config) string {
+	if config.Security.MasterPassword != "" {
+		return config.Security.MasterPassword
+	}
+	return os.Getenv("CONFIG_PASSWORD")
+}
+
 // setDefaults sets default values for configuration
 func setDefaults(config *Config) {
 	if config.Version == "" {
@@ -254,11 +659,116 @@ func setDefaults(config *Config) {
 		config.SelectionMethod = "latency"
 	}
 
+	if config.ThroughputWeight == nil {
+		weight := DefaultThroughputWeight
+		config.ThroughputWeight = &weight
+	}
+
+	if config.ThroughputMaxAge == 0 {
+		config.ThroughputMaxAge = 24 * time.Hour
+	}
+
+	if config.QoS.Enabled {
+		if config.QoS.BulkThreshold == 0 {
+			config.QoS.BulkThreshold = 1 << 20
+		}
+		if config.QoS.InteractivePorts == nil {
+			config.QoS.InteractivePorts = DefaultInteractivePorts
+		}
+	}
+
+	if config.Shadowsocks.Enabled && config.Shadowsocks.Method == "" {
+		config.Shadowsocks.Method = "chacha20-ietf-poly1305"
+	}
+
+	if config.MITM.Enabled && config.MITM.CADir == "" {
+		config.MITM.CADir = "data/mitm"
+	}
+
+	if config.Control.Enabled {
+		if config.Control.Name == "" {
+			config.Control.Name, _ = os.Hostname()
+		}
+		if config.Control.Role == "" {
+			config.Control.Role = RoleOperator
+		}
+	}
+
+	setAuthDefaults(&config.Security)
+
+	for i := range config.Events.Hooks {
+		if config.Events.Hooks[i].Timeout == 0 {
+			config.Events.Hooks[i].Timeout = 10 * time.Second
+		}
+	}
+
+	if config.Election.Enabled {
+		e := &config.Election
+		if e.Backend == "" {
+			e.Backend = "file"
+		}
+		if e.LockFile == "" {
+			e.LockFile = filepath.Join(os.TempDir(), "ssh-tunnel.lock")
+		}
+		if e.Address == "" {
+			e.Address = "http://127.0.0.1:8500"
+		}
+		if e.Key == "" {
+			e.Key = "ssh-tunnel/leader"
+		}
+		if e.TTL == 0 {
+			e.TTL = 10 * time.Second
+		}
+		if e.RetryInterval == 0 {
+			e.RetryInterval = time.Second
+		}
+		if e.VirtualIP != nil && e.VirtualIP.GratuitousARP == 0 {
+			e.VirtualIP.GratuitousARP = 3
+		}
+	}
+
+	if config.Scoring.IsZero() {
+		config.Scoring = DefaultScoringWeights()
+	}
+
 	// Set defaults for monitoring
 	if config.Monitoring.Enabled && config.Monitoring.CheckInterval == 0 {
 		config.Monitoring.CheckInterval = 30 * time.Second
 	}
 
+	if config.Monitoring.Store.Type == "" {
+		config.Monitoring.Store.Type = "memory"
+	}
+
+	if config.Monitoring.Store.Path == "" {
+		switch config.Monitoring.Store.Type {
+		case "file":
+			config.Monitoring.Store.Path = "data/monitoring"
+		case "bolt":
+			config.Monitoring.Store.Path = "data/monitoring.db"
+		}
+	}
+
+	if config.Monitoring.Store.Type != "memory" && config.Monitoring.Store.Retention == 0 {
+		config.Monitoring.Store.Retention = 7 * 24 * time.Hour
+	}
+
+	if config.Monitoring.SampleInterval == 0 {
+		config.Monitoring.SampleInterval = 15 * time.Second
+	}
+
+	if config.Monitoring.SampleIdleTimeout == 0 {
+		config.Monitoring.SampleIdleTimeout = 5 * time.Minute
+	}
+
+	if config.Monitoring.AnomalyThreshold == 0 {
+		config.Monitoring.AnomalyThreshold = 3.0
+	}
+
+	if config.Monitoring.AnomalyAlpha == 0 {
+		config.Monitoring.AnomalyAlpha = 0.3
+	}
+
 	if config.Monitoring.LogLevel == "" {
 		config.Monitoring.LogLevel = "info"
 	}
@@ -298,15 +808,247 @@ func setDefaults(config *Config) {
 		if server.Name == "" {
 			server.Name = fmt.Sprintf("server-%d", i+1)
 		}
+
+		if server.V2Ray != nil && server.V2Ray.Network == "kcp" {
+			setKCPDefaults(server)
+		}
+
+		// "wss" is shorthand for WebSocket over TLS, the usual CDN setup
+		if server.V2Ray != nil && server.V2Ray.Network == "wss" {
+			server.V2Ray.Network = "ws"
+			server.V2Ray.TLS = "tls"
+		}
+		if server.V2Ray != nil && server.V2Ray.Network == "ws" && server.V2Ray.Path == "" {
+			server.V2Ray.Path = "/"
+		}
+
+		if server.Transport == TransportSSH3 {
+			if server.SSH3 == nil {
+				server.SSH3 = &SSH3Config{}
+			}
+			if server.SSH3.Path == "" {
+				server.SSH3.Path = "/ssh3-term"
+			}
+		}
+
+		if frag := server.Fragment; frag != nil {
+			if frag.Mode == "" {
+				frag.Mode = FragmentTCP
+			}
+			if frag.Length == "" {
+				frag.Length = "10-40"
+			}
+			if frag.Delay == "" {
+				frag.Delay = "5ms-15ms"
+			}
+		}
+
+		if server.PortHopping != nil && server.PortHopping.Interval == 0 {
+			server.PortHopping.Interval = 30 * time.Second
+		}
+
+		if server.DNSTunnel != nil && server.DNSTunnel.TunnelIP == "" {
+			server.DNSTunnel.TunnelIP = "10.53.0.1"
+		}
+
+		if server.Mux != nil {
+			if server.Mux.MaxStreams == 0 {
+				server.Mux.MaxStreams = 8
+			}
+			if server.Mux.IdleTimeout == 0 {
+				server.Mux.IdleTimeout = 60 * time.Second
+			}
+		}
+
+		if server.Exec != nil && server.Exec.Binary == "" {
+			server.Exec.Binary = execBinaries[server.Transport]
+		}
+
+		if server.Engine == EngineOpenSSH {
+			if server.OpenSSH == nil {
+				server.OpenSSH = &OpenSSHConfig{}
+			}
+			if server.OpenSSH.Binary == "" {
+				server.OpenSSH.Binary = "ssh"
+			}
+		}
+
+		if udp := server.UDP; udp != nil {
+			if udp.Relay == "" && server.Transport == TransportSSH {
+				udp.Relay = DefaultUDPRelay
+			}
+			if udp.Timeout == 0 {
+				udp.Timeout = 60 * time.Second
+			}
+		}
+
+		for j := range server.RemoteForwards {
+			forward := &server.RemoteForwards[j]
+			if forward.Public && forward.Gateway == "" {
+				forward.Gateway = GatewayRelay
+			}
+			if forward.Gateway == GatewayRelay && forward.Relay == "" {
+				forward.Relay = DefaultTCPRelay
+			}
+		}
 	}
 }
 
+// setKCPDefaults fills in mKCP defaults matching v2ray-core
+func setKCPDefaults(server *Server) {
+	if server.V2Ray.KCP == nil {
+		server.V2Ray.KCP = &KCPConfig{}
+	}
+	kcp := server.V2Ray.KCP
+
+	if kcp.MTU == 0 {
+		kcp.MTU = 1350
+	}
+	if kcp.TTI == 0 {
+		kcp.TTI = 50
+	}
+	if kcp.UplinkCapacity == 0 {
+		kcp.UplinkCapacity = 5
+	}
+	if kcp.DownlinkCapacity == 0 {
+		kcp.DownlinkCapacity = 20
+	}
+	if kcp.ReadBufferSize == 0 {
+		kcp.ReadBufferSize = 2
+	}
+	if kcp.WriteBufferSize == 0 {
+		kcp.WriteBufferSize = 2
+	}
+	if server.V2Ray.HeaderType == "" {
+		server.V2Ray.HeaderType = "none"
+	}
+}
+
+// SetDefaults fills in the defaults of a configuration assembled in memory,
+// as LoadConfig does for the files it reads
+func SetDefaults(config *Config) {
+	setDefaults(config)
+}
+
+// Validate checks a configuration assembled in memory, as LoadConfig
+// checks the files it reads
+func Validate(config *Config) error {
+	return validateConfig(config)
+}
+
 // validateConfig validates the configuration
 func validateConfig(config *Config) error {
 	if len(config.Servers) == 0 {
 		return fmt.Errorf("no servers configured")
 	}
 
+	if weight := config.ThroughputShare(); weight < 0 || weight > 1 {
+		return fmt.Errorf("throughput_weight must be between 0 and 1")
+	}
+
+	for i, p := range config.Plugins {
+		if (p.Path == "") == (p.Sidecar == "") {
+			return fmt.Errorf("plugin %d: exactly one of path or sidecar is required", i)
+		}
+		if p.Sidecar != "" && len(p.Transports) == 0 {
+			return fmt.Errorf("plugin %d: sidecar plugins must list their transports", i)
+		}
+	}
+
+	if config.Election.Enabled {
+		switch config.Election.Backend {
+		case "file":
+		case "consul":
+			if config.Election.TTL < 10*time.Second {
+				return fmt.Errorf("election ttl must be at least 10s for consul")
+			}
+		default:
+			return fmt.Errorf("unsupported election backend: %s (supported: file, consul)", config.Election.Backend)
+		}
+
+		if vip := config.Election.VirtualIP; vip != nil {
+			ip, _, err := net.ParseCIDR(vip.Address)
+			if err != nil || ip.To4() == nil {
+				return fmt.Errorf("election virtual_ip address must be an IPv4 CIDR such as 192.168.1.50/24")
+			}
+			if vip.Interface == "" {
+				return fmt.Errorf("election virtual_ip interface is required")
+			}
+			if vip.GratuitousARP < 0 {
+				return fmt.Errorf("election virtual_ip gratuitous_arp cannot be negative")
+			}
+		}
+	}
+
+	switch config.Monitoring.Store.Type {
+	case "memory", "file", "bolt":
+	default:
+		return fmt.Errorf("unsupported monitoring store type: %s (supported: memory, file, bolt)", config.Monitoring.Store.Type)
+	}
+	if config.Monitoring.Store.Retention < 0 {
+		return fmt.Errorf("monitoring store retention cannot be negative")
+	}
+
+	if err := validateQoS(config); err != nil {
+		return err
+	}
+
+	if err := validateMemory(config); err != nil {
+		return err
+	}
+
+	if config.MixedPort != 0 {
+		if config.MixedPort < 1 || config.MixedPort > 65535 {
+			return fmt.Errorf("mixed_port must be between 1 and 65535")
+		}
+		for i, server := range config.Servers {
+			if server.Enabled && server.LocalPort == config.MixedPort {
+				return fmt.Errorf("server %d: local_port %d is already used by mixed_port", i, server.LocalPort)
+			}
+		}
+	}
+
+	if err := validateShadowsocks(config); err != nil {
+		return err
+	}
+
+	if err := validateMITM(config); err != nil {
+		return err
+	}
+
+	if err := validateControl(config); err != nil {
+		return err
+	}
+
+	if err := validateAuth(config); err != nil {
+		return err
+	}
+
+	if err := validateEvents(config); err != nil {
+		return err
+	}
+
+	if err := validateCrash(config); err != nil {
+		return err
+	}
+
+	if err := validateMesh(config); err != nil {
+		return err
+	}
+
+	if err := validateTags(config); err != nil {
+		return err
+	}
+
+	if config.API.Debug && (!config.Security.EnableAuth || len(config.Security.AuthTokens) == 0) {
+		return fmt.Errorf("api debug requires security enable_auth with auth_tokens")
+	}
+
+	w := config.Scoring
+	if w.Latency < 0 || w.Load < 0 || w.Region < 0 || w.Priority < 0 || w.Cost < 0 || w.PacketLoss < 0 || w.Throughput < 0 {
+		return fmt.Errorf("scoring weights must not be negative")
+	}
+
 	// Validate each server
 	for i, server := range config.Servers {
 		if server.Host == "" {
@@ -317,14 +1059,126 @@ func validateConfig(config *Config) error {
 			return fmt.Errorf("server %d: port is required", i)
 		}
 
+		switch server.Proxy {
+		case ProxySOCKS5, ProxyHTTP, ProxyHTTPS:
+		case ProxySOCKS4, ProxyAuto:
+			if server.Exec != nil {
+				return fmt.Errorf("server %d: proxy %s is not supported with exec clients", i, server.Proxy)
+			}
+		default:
+			return fmt.Errorf("server %d: unsupported proxy type: %s (supported: socks5, socks4, http, https, auto)", i, server.Proxy)
+		}
+
+		if obfs := server.Obfuscation; obfs != nil {
+			switch obfs.Type {
+			case "", "none", "tls":
+			case "xor":
+				if obfs.Key == "" {
+					return fmt.Errorf("server %d: obfuscation key is required for xor", i)
+				}
+			case "obfs4":
+				if obfs.Cert == "" {
+					return fmt.Errorf("server %d: obfs4 obfuscation requires the bridge cert", i)
+				}
+				if obfs.IATMode < 0 || obfs.IATMode > 2 {
+					return fmt.Errorf("server %d: obfs4 iat_mode must be 0, 1 or 2", i)
+				}
+			default:
+				return fmt.Errorf("server %d: unsupported obfuscation type: %s", i, obfs.Type)
+			}
+			if obfs.Type != "" && obfs.Type != "none" &&
+				server.Transport != TransportSSH && server.Transport != TransportTrojan {
+				return fmt.Errorf("server %d: obfuscation is only supported for ssh and trojan transports", i)
+			}
+		}
+
+		if server.Fragment != nil && server.Fragment.Enabled {
+			if err := validateFragment(i, &server); err != nil {
+				return err
+			}
+		}
+
+		if server.PortHopping != nil {
+			if err := validatePortHopping(i, &server); err != nil {
+				return err
+			}
+		}
+
+		if server.UDP != nil {
+			if err := validateUDP(i, &server, config.Servers); err != nil {
+				return err
+			}
+		}
+
+		if len(server.RemoteForwards) > 0 {
+			if err := validateRemoteForwards(i, &server); err != nil {
+				return err
+			}
+		}
+
+		if mux := server.Mux; mux != nil && mux.Enabled {
+			if !muxTransports[server.Transport] {
+				return fmt.Errorf("server %d: mux is only supported for trojan, vmess and vless transports", i)
+			}
+			if server.Transport != TransportTrojan && server.Exec == nil {
+				return fmt.Errorf("server %d: mux for %s requires an exec client", i, server.Transport)
+			}
+			if mux.MaxStreams < 1 || mux.MaxStreams > 1024 {
+				return fmt.Errorf("server %d: mux max_streams must be between 1 and 1024", i)
+			}
+		}
+
+		if server.BandwidthLimit != "" || server.UploadLimit != "" || server.DownloadLimit != "" {
+			if err := validateBandwidth(i, &server); err != nil {
+				return err
+			}
+		}
+
+		if len(server.Chain) > 0 {
+			if err := validateChain(i, &server, config.Servers); err != nil {
+				return err
+			}
+		}
+
+		if err := validateEngine(i, &server, config.Servers); err != nil {
+			return err
+		}
+
+		if server.HardwareKey != nil {
+			if err := validateHardwareKey(i, &server); err != nil {
+				return err
+			}
+		}
+
+		if err := validateAgentForwarding(i, &server); err != nil {
+			return err
+		}
+
+		if err := validateTrust(i, &server); err != nil {
+			return err
+		}
+
+		if exec := server.Exec; exec != nil {
+			if exec.Binary == "" {
+				return fmt.Errorf("server %d: exec binary is required for %s transport", i, server.Transport)
+			}
+			if exec.ConfigFile == "" && execBinaries[server.Transport] == "" {
+				return fmt.Errorf("server %d: exec config_file is required for %s transport", i, server.Transport)
+			}
+			if exec.ConfigFile != "" {
+				continue // The external config carries the protocol settings
+			}
+		}
+
 		// Validate transport-specific requirements
 		switch server.Transport {
 		case TransportSSH:
 			if server.User == "" {
 				return fmt.Errorf("server %d: user is required for SSH transport", i)
 			}
-			if server.Password == "" && server.KeyPath == "" {
-				return fmt.Errorf("server %d: either password or key_path is required for SSH", i)
+			// The ssh command finds keys itself, in the agent or ~/.ssh
+			if server.Password == "" && server.KeyPath == "" && server.HardwareKey == nil && server.Engine != EngineOpenSSH {
+				return fmt.Errorf("server %d: either password, key_path or hardware_key is required for SSH", i)
 			}
 
 		case TransportHysteria:
@@ -334,6 +1188,69 @@ func validateConfig(config *Config) error {
 			if server.Hysteria.AuthString == "" {
 				return fmt.Errorf("server %d: hysteria auth_string is required", i)
 			}
+			if err := validateMTU(i, server.Hysteria.MTU, QUICMinMTU); err != nil {
+				return err
+			}
+
+		case TransportTUIC:
+			if server.TUIC == nil {
+				return fmt.Errorf("server %d: tuic configuration is required", i)
+			}
+			if server.TUIC.UUID == "" || server.TUIC.Password == "" {
+				return fmt.Errorf("server %d: tuic uuid and password are required", i)
+			}
+			if server.Exec != nil && server.Proxy != ProxySOCKS5 {
+				return fmt.Errorf("server %d: tuic-client only serves proxy socks5", i)
+			}
+			switch server.TUIC.UDPRelayMode {
+			case "", "native", "quic":
+			default:
+				return fmt.Errorf("server %d: unsupported tuic udp_relay_mode: %s (supported: native, quic)", i, server.TUIC.UDPRelayMode)
+			}
+			if err := validateMTU(i, server.TUIC.MTU, QUICMinMTU); err != nil {
+				return err
+			}
+
+		case TransportDNS:
+			if server.DNSTunnel == nil || server.DNSTunnel.Domain == "" {
+				return fmt.Errorf("server %d: dns_tunnel domain is required", i)
+			}
+			if server.User == "" {
+				return fmt.Errorf("server %d: user is required for DNS transport", i)
+			}
+			if server.Password == "" && server.KeyPath == "" {
+				return fmt.Errorf("server %d: either password or key_path is required for DNS transport", i)
+			}
+
+		case TransportICMP:
+			if server.ICMP == nil || server.ICMP.Key == "" {
+				return fmt.Errorf("server %d: icmp key is required", i)
+			}
+			if server.User == "" {
+				return fmt.Errorf("server %d: user is required for ICMP transport", i)
+			}
+			if server.Password == "" && server.KeyPath == "" {
+				return fmt.Errorf("server %d: either password or key_path is required for ICMP transport", i)
+			}
+
+		case TransportSSH3:
+			if server.User == "" {
+				return fmt.Errorf("server %d: user is required for SSH3 transport", i)
+			}
+			if server.Password == "" && server.KeyPath == "" {
+				return fmt.Errorf("server %d: either password or key_path is required for SSH3 transport", i)
+			}
+			if !strings.HasPrefix(server.SSH3.Path, "/") {
+				return fmt.Errorf("server %d: ssh3 path must start with /", i)
+			}
+
+		case TransportNaive:
+			if server.Naive == nil {
+				return fmt.Errorf("server %d: naive configuration is required", i)
+			}
+			if server.Naive.Username == "" || server.Naive.Password == "" {
+				return fmt.Errorf("server %d: naive username and password are required", i)
+			}
 
 		case TransportV2Ray, TransportVMess, TransportVLESS:
 			if server.V2Ray == nil {
@@ -342,6 +1259,42 @@ func validateConfig(config *Config) error {
 			if server.V2Ray.UUID == "" {
 				return fmt.Errorf("server %d: v2ray UUID is required", i)
 			}
+			if server.V2Ray.Network == "ws" && !strings.HasPrefix(server.V2Ray.Path, "/") {
+				return fmt.Errorf("server %d: v2ray ws path must start with /", i)
+			}
+			if server.V2Ray.Network == "grpc" && (server.V2Ray.GRPC == nil || server.V2Ray.GRPC.ServiceName == "") {
+				return fmt.Errorf("server %d: v2ray grpc service_name is required", i)
+			}
+			if server.V2Ray.TLS != "" && server.V2Ray.TLS != "none" && server.V2Ray.TLS != "tls" {
+				return fmt.Errorf("server %d: unsupported v2ray tls mode: %s", i, server.V2Ray.TLS)
+			}
+			if server.Transport != TransportVLESS && server.Exec == nil {
+				// The native VMess client speaks AEAD headers only
+				if server.V2Ray.AlterID != 0 {
+					return fmt.Errorf("server %d: vmess alter_id %d (legacy MD5 headers) needs an exec client", i, server.V2Ray.AlterID)
+				}
+				switch server.V2Ray.Security {
+				case "", "auto", "aes-128-gcm", "chacha20-poly1305":
+				default:
+					return fmt.Errorf("server %d: unsupported vmess security: %s (supported: auto, aes-128-gcm, chacha20-poly1305)", i, server.V2Ray.Security)
+				}
+			}
+			if server.V2Ray.Network == "kcp" {
+				// mKCP has no native client; Xray or V2Ray runs it
+				if server.Exec == nil {
+					return fmt.Errorf("server %d: v2ray kcp network needs an exec client (add exec: {binary: \"xray\"})", i)
+				}
+				kcp := server.V2Ray.KCP
+				if kcp.MTU < 576 || kcp.MTU > 1460 {
+					return fmt.Errorf("server %d: kcp mtu must be between 576 and 1460", i)
+				}
+				if kcp.TTI < 10 || kcp.TTI > 100 {
+					return fmt.Errorf("server %d: kcp tti must be between 10 and 100", i)
+				}
+				if !kcpHeaderTypes[server.V2Ray.HeaderType] {
+					return fmt.Errorf("server %d: unsupported kcp header_type: %s", i, server.V2Ray.HeaderType)
+				}
+			}
 
 		case TransportWireGuard:
 			if server.WireGuard == nil {
@@ -350,12 +1303,31 @@ func validateConfig(config *Config) error {
 			if server.WireGuard.PrivateKey == "" || server.WireGuard.PublicKey == "" {
 				return fmt.Errorf("server %d: wireguard private_key and public_key are required", i)
 			}
+			if err := validateMTU(i, server.WireGuard.MTU, 1280); err != nil {
+				return err
+			}
+		case TransportTrojan:
+			if server.Password == "" {
+				return fmt.Errorf("server %d: password is required for Trojan transport", i)
+			}
 		}
 	}
 
 	return nil
 }
 
+// QUICMinMTU is the smallest path MTU QUIC clients work over: they send
+// 1252-byte datagrams from the first packet
+const QUICMinMTU = 1280
+
+// validateMTU checks an optional MTU; zero means it is probed
+func validateMTU(i, mtu, min int) error {
+	if mtu != 0 && (mtu < min || mtu > 9000) {
+		return fmt.Errorf("server %d: mtu must be between %d and 9000", i, min)
+	}
+	return nil
+}
+
 // Encryption/Decryption functions
 func isEncrypted(data []byte) bool {
 	return strings.HasPrefix(string(data), "ENC:")
@@ -388,7 +1360,8 @@ func decrypt(data []byte, password string) ([]byte, error) {
 		return nil, fmt.Errorf("not encrypted data")
 	}
 
-	encryptedHex := strings.TrimPrefix(string(data), "ENC:")
+	// Editors commonly append a trailing newline to the file
+	encryptedHex := strings.TrimSpace(strings.TrimPrefix(string(data), "ENC:"))
 	encrypted, err := hex.DecodeString(encryptedHex)
 	if err != nil {
 		return nil, err
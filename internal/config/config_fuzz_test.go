@@ -0,0 +1,106 @@
+package config
+
+import (
+	"bytes"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const fuzzPassword = "fuzz-password"
+
+// configSeeds are valid and nearly valid documents for the config fuzzers
+var configSeeds = []string{
+	"",
+	"servers: []",
+	`servers:
+  - name: a
+    host: 127.0.0.1
+    port: "22"
+    user: u
+    password: p
+`,
+	`server_defaults: &d
+  user: root
+  key_path: ~/.ssh/id_ed25519
+servers:
+  - name: a
+    host: a.example.com
+    port: "22"
+  - <<: *d
+    name: b
+    host: b.example.com
+    port: "2222"
+    transport: ssh
+`,
+	`servers:
+  - name: v
+    host: v.example.com
+    port: "443"
+    transport: vless
+    v2ray: {uuid: abc, network: kcp, kcp: {mtu: 1350, tti: 50}}
+throughput_weight: 0.0
+security:
+  api_keys:
+    - {id: 0123456789ab, name: ci, hash: "00", role: operator}
+`,
+	"servers:\n  - name: [\n",
+	"servers: {a: b}",
+	"ENC:",
+	"ENC:zz",
+	"ENC:00112233445566778899aabbccddeeff\n",
+}
+
+// FuzzLoadConfig feeds arbitrary files to the loader. A document that
+// loads must survive being saved and loaded again.
+func FuzzLoadConfig(f *testing.F) {
+	for _, seed := range configSeeds {
+		f.Add([]byte(seed))
+	}
+	if encrypted, err := encrypt([]byte(configSeeds[2]), fuzzPassword); err == nil {
+		f.Add(encrypted)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cfg, err := loadConfigData(data, fuzzPassword)
+		if err != nil {
+			return
+		}
+
+		saved, err := yaml.Marshal(cfg)
+		if err != nil {
+			t.Fatalf("loaded config does not marshal: %v", err)
+		}
+		if _, err := loadConfigData(saved, fuzzPassword); err != nil {
+			t.Fatalf("saved config does not load: %v\n%s", err, saved)
+		}
+	})
+}
+
+// FuzzDecrypt checks that corrupt encrypted configs fail cleanly and that
+// anything encrypted decrypts back to itself
+func FuzzDecrypt(f *testing.F) {
+	for _, seed := range configSeeds {
+		f.Add([]byte(seed), fuzzPassword)
+	}
+	f.Add([]byte("ENC:"+string(bytes.Repeat([]byte("ab"), 40))), "")
+
+	f.Fuzz(func(t *testing.T, data []byte, password string) {
+		decrypt(data, password)
+
+		encrypted, err := encrypt(data, password)
+		if err != nil {
+			t.Fatalf("encrypt failed: %v", err)
+		}
+		if !isEncrypted(encrypted) {
+			t.Fatalf("encrypted data lacks the ENC: prefix")
+		}
+		plain, err := decrypt(encrypted, password)
+		if err != nil {
+			t.Fatalf("decrypt of fresh ciphertext failed: %v", err)
+		}
+		if !bytes.Equal(plain, data) {
+			t.Fatalf("round trip changed the data")
+		}
+	})
+}
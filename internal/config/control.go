@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// ControlConfig keeps an outbound WebSocket control channel open to a
+// controller, another instance running the API, so an instance behind NAT
+// can still be managed: the controller relays API calls to it over the
+// channel.
+type ControlConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	URL     string `yaml:"url" json:"url"`                         // Controller endpoint, e.g. wss://controller:8888/api/v1/agents/connect
+	Name    string `yaml:"name,omitempty" json:"name,omitempty"`   // Name to register as, defaults to the hostname
+	Token   string `yaml:"token,omitempty" json:"token,omitempty"` // This instance's token in the controller's security agents
+	Role    string `yaml:"role,omitempty" json:"role,omitempty"`   // The most relayed calls may do, operator by default
+
+	// Server reaches the controller through one tunnel by name; by default
+	// the controller is dialed directly
+	Server   string `yaml:"server,omitempty" json:"server,omitempty"`
+	Insecure bool   `yaml:"insecure,omitempty" json:"insecure,omitempty"` // Skip TLS verification of the controller
+}
+
+// AgentCredential lets one instance open its control channel to this
+// instance, as its controller, under the given name. The token is not an
+// API credential: it is only accepted for connecting that agent.
+type AgentCredential struct {
+	Name  string `yaml:"name" json:"name"`
+	Token string `yaml:"token,omitempty" json:"token,omitempty"`
+}
+
+// validateControl checks the agents allowed to connect and the control
+// channel block
+func validateControl(config *Config) error {
+	names := make(map[string]bool)
+	for i, agent := range config.Security.Agents {
+		if agent.Name == "" || agent.Token == "" {
+			return fmt.Errorf("security agent %d: name and token are required", i)
+		}
+		if names[agent.Name] {
+			return fmt.Errorf("security agent %s is defined twice", agent.Name)
+		}
+		names[agent.Name] = true
+	}
+
+	c := config.Control
+	if !c.Enabled {
+		return nil
+	}
+
+	if !config.API.Enabled {
+		return fmt.Errorf("control channel requires the API to be enabled")
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		return fmt.Errorf("control url must be a ws:// or wss:// URL: %s", c.URL)
+	}
+	if c.Name == "" {
+		return fmt.Errorf("control name is required")
+	}
+	if !IsRole(c.Role) {
+		return fmt.Errorf("unknown control role %q (supported: read-only, operator, admin)", c.Role)
+	}
+
+	if c.Server == "" {
+		return nil
+	}
+	for _, server := range config.Servers {
+		if server.Name == c.Server {
+			if !server.Enabled {
+				return fmt.Errorf("control server %s is disabled", c.Server)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("control server %s does not exist", c.Server)
+}
@@ -0,0 +1,26 @@
+package config
+
+import "fmt"
+
+// CrashConfig controls crash reports. A panic in a subsystem is recovered,
+// written to a report and the subsystem restarted, instead of taking the
+// whole daemon down.
+type CrashConfig struct {
+	Dir   string `yaml:"dir,omitempty" json:"dir,omitempty"`     // DefaultCrashDir when empty
+	Keep  int    `yaml:"keep,omitempty" json:"keep,omitempty"`   // Reports kept, oldest removed first; DefaultCrashKeep when zero
+	Alert bool   `yaml:"alert,omitempty" json:"alert,omitempty"` // Also raise a critical alert, with monitoring enabled
+}
+
+// Crash report defaults
+const (
+	DefaultCrashDir  = "data/crashes"
+	DefaultCrashKeep = 20
+)
+
+// validateCrash checks the crash block
+func validateCrash(config *Config) error {
+	if config.Crash.Keep < 0 {
+		return fmt.Errorf("crash keep must not be negative")
+	}
+	return nil
+}
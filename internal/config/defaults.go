@@ -0,0 +1,180 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseConfig decodes a configuration document, first merging
+// server_defaults into every server entry
+func parseConfig(data []byte, config *Config) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		return nil // Empty document
+	}
+
+	if err := applyServerDefaults(doc.Content[0]); err != nil {
+		return err
+	}
+	return doc.Decode(config)
+}
+
+// applyServerDefaults merges the server_defaults mapping into each entry of
+// servers. A key a server sets, directly or through a YAML merge key
+// ("<<: *anchor"), wins over the default; nested mappings are merged key by
+// key and lists are replaced whole.
+func applyServerDefaults(root *yaml.Node) error {
+	if root.Kind != yaml.MappingNode {
+		return nil
+	}
+	defaults := mappingValue(root, "server_defaults")
+	if defaults == nil {
+		return nil
+	}
+	defaults = resolveAlias(defaults)
+	if defaults.Kind == yaml.ScalarNode && defaults.Tag == "!!null" {
+		return nil
+	}
+	if defaults.Kind != yaml.MappingNode {
+		return fmt.Errorf("server_defaults: expected a mapping")
+	}
+	if err := checkServerDefaults(defaults); err != nil {
+		return err
+	}
+
+	servers := mappingValue(root, "servers")
+	if servers == nil {
+		return nil
+	}
+	servers = resolveAlias(servers)
+	if servers.Kind != yaml.SequenceNode {
+		return nil // Left for decoding to report
+	}
+	for _, server := range servers.Content {
+		if server = resolveAlias(server); server.Kind == yaml.MappingNode {
+			mergeMapping(server, defaults)
+		}
+	}
+	return nil
+}
+
+// checkServerDefaults rejects keys that are not server settings, or that
+// must differ between servers, so a misspelt key fails instead of silently
+// doing nothing for every server
+func checkServerDefaults(defaults *yaml.Node) error {
+	fields := make(map[string]bool)
+	serverType := reflect.TypeOf(Server{})
+	for i := 0; i < serverType.NumField(); i++ {
+		name, _, _ := strings.Cut(serverType.Field(i).Tag.Get("yaml"), ",")
+		fields[name] = true
+	}
+
+	for i := 0; i+1 < len(defaults.Content); i += 2 {
+		key := defaults.Content[i]
+		switch {
+		case key.Value == "<<":
+		case key.Value == "name":
+			return fmt.Errorf("server_defaults: name must be set on each server")
+		case !fields[key.Value]:
+			return fmt.Errorf("server_defaults: line %d: unknown server setting %q", key.Line, key.Value)
+		}
+	}
+
+	var server Server
+	if err := defaults.Decode(&server); err != nil {
+		return fmt.Errorf("server_defaults: %v", err)
+	}
+	return nil
+}
+
+// mergeMapping adds the keys of src that dst lacks, recursing into
+// mappings both define
+func mergeMapping(dst, src *yaml.Node) {
+	present := mappingKeys(dst)
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+		if key.Value == "<<" {
+			continue // Merge keys in the defaults are resolved below
+		}
+
+		if own := mappingValue(dst, key.Value); own != nil {
+			own, value = resolveAlias(own), resolveAlias(value)
+			if own.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+				mergeMapping(own, value)
+			}
+			continue
+		}
+		if present[key.Value] {
+			continue // Set through a merge key
+		}
+		dst.Content = append(dst.Content, key, value)
+		present[key.Value] = true
+	}
+
+	// Keys the defaults themselves take from an anchor
+	for _, merged := range mergeSources(src) {
+		mergeMapping(dst, merged)
+	}
+}
+
+// mappingValue returns the value a mapping node sets for key itself
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// mappingKeys returns the keys a mapping node sets, including those it
+// takes through merge keys
+func mappingKeys(node *yaml.Node) map[string]bool {
+	keys := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != "<<" {
+			keys[node.Content[i].Value] = true
+		}
+	}
+	for _, merged := range mergeSources(node) {
+		for key := range mappingKeys(merged) {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// mergeSources returns the mappings a node merges with "<<"
+func mergeSources(node *yaml.Node) []*yaml.Node {
+	var sources []*yaml.Node
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != "<<" {
+			continue
+		}
+		value := resolveAlias(node.Content[i+1])
+		switch value.Kind {
+		case yaml.MappingNode:
+			sources = append(sources, value)
+		case yaml.SequenceNode:
+			for _, item := range value.Content {
+				if item = resolveAlias(item); item.Kind == yaml.MappingNode {
+					sources = append(sources, item)
+				}
+			}
+		}
+	}
+	return sources
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// EventType names an application event: a configuration change, or a
+// change of the tunnels, the instance's role or the mesh
+type EventType string
+
+const (
+	EventServerAdded   EventType = "server.added"
+	EventServerRemoved EventType = "server.removed"
+	EventServerChanged EventType = "server.changed"
+	EventRuleAdded     EventType = "rule.added"
+	EventRuleRemoved   EventType = "rule.removed"
+	EventRuleChanged   EventType = "rule.changed"
+	EventConfigChanged EventType = "config.changed" // Any setting outside servers and routing
+
+	EventConfigReloaded  EventType = "config.reloaded"  // The tunnels were reloaded with a new configuration
+	EventTunnelUp        EventType = "tunnel.up"        // A tunnel connected
+	EventTunnelDown      EventType = "tunnel.down"      // A connected tunnel lost its connection, or was stopped or removed
+	EventFailoverLeader  EventType = "failover.leader"  // This instance was elected and took over the tunnels
+	EventFailoverStandby EventType = "failover.standby" // This instance lost leadership and gave them up
+)
+
+var eventTypes = []EventType{
+	EventServerAdded, EventServerRemoved, EventServerChanged,
+	EventRuleAdded, EventRuleRemoved, EventRuleChanged,
+	EventConfigChanged, EventConfigReloaded,
+	EventTunnelUp, EventTunnelDown,
+	EventFailoverLeader, EventFailoverStandby,
+}
+
+// meshEventCategory prefixes the mesh events relayed from the coordinator
+const meshEventCategory = "mesh"
+
+// MeshEventType is the type of a relayed mesh event, such as
+// mesh.node_offline for the coordinator's node_offline
+func MeshEventType(meshType string) EventType {
+	return EventType(meshEventCategory + "." + meshType)
+}
+
+// EventsConfig delivers application events to external systems, in
+// addition to the API's /events stream
+type EventsConfig struct {
+	Hooks []EventHook `yaml:"hooks,omitempty" json:"hooks,omitempty"`
+}
+
+// EventHook receives events as they happen, either as an HTTP POST or as a
+// command run with the event on stdin, both as JSON
+type EventHook struct {
+	URL     string        `yaml:"url,omitempty" json:"url,omitempty"`
+	Command string        `yaml:"command,omitempty" json:"command,omitempty"` // Run with sh -c
+	Secret  string        `yaml:"secret,omitempty" json:"secret,omitempty"`   // Signs webhook bodies with HMAC-SHA256
+	Types   []string      `yaml:"types,omitempty" json:"types,omitempty"`     // Event types or categories ("server"); all when empty
+	Timeout time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// MatchesEvent reports whether an event type passes a filter of types and
+// categories; an empty filter passes everything
+func MatchesEvent(filter []string, t EventType) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	category, _, _ := strings.Cut(string(t), ".")
+	for _, f := range filter {
+		if f == string(t) || f == category {
+			return true
+		}
+	}
+	return false
+}
+
+// validateEvents checks the event hooks
+func validateEvents(config *Config) error {
+	for i, hook := range config.Events.Hooks {
+		if (hook.URL == "") == (hook.Command == "") {
+			return fmt.Errorf("events hook %d: exactly one of url and command is required", i)
+		}
+		if hook.URL != "" {
+			u, err := url.Parse(hook.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("events hook %d: url must be an http:// or https:// URL: %s", i, hook.URL)
+			}
+		}
+		if hook.Timeout < 0 {
+			return fmt.Errorf("events hook %d: timeout must not be negative", i)
+		}
+		for _, f := range hook.Types {
+			if !isEventFilter(f) {
+				return fmt.Errorf("events hook %d: unknown event type %q", i, f)
+			}
+		}
+	}
+	return nil
+}
+
+// isEventFilter reports whether f names an event type or category. Mesh
+// event types are the coordinator's, so any is accepted.
+func isEventFilter(f string) bool {
+	if category, _, _ := strings.Cut(f, "."); category == meshEventCategory {
+		return true
+	}
+	for _, t := range eventTypes {
+		category, _, _ := strings.Cut(string(t), ".")
+		if f == string(t) || f == category {
+			return true
+		}
+	}
+	return false
+}
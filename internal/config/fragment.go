@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fragmentation modes
+const (
+	FragmentTCP    = "tcp"    // Split the ClientHello record across TCP segments
+	FragmentRecord = "record" // Split it into several TLS records, each in its own segment
+)
+
+// FragmentConfig splits the TLS ClientHello so DPI boxes that read the
+// server name from a single packet or record miss it. The hello is cut into
+// chunks of random length up to the end of the server name, with one cut
+// always falling inside the name; the rest follows in one piece.
+type FragmentConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Mode    string `yaml:"mode,omitempty" json:"mode,omitempty"`     // "tcp" or "record"
+	Length  string `yaml:"length,omitempty" json:"length,omitempty"` // Chunk size in bytes, e.g. "10-40"
+	Delay   string `yaml:"delay,omitempty" json:"delay,omitempty"`   // Pause between chunks, e.g. "5ms-15ms"
+}
+
+// maxFragmentDelay keeps the fragmented handshake well inside the timeout
+const maxFragmentDelay = time.Second
+
+// fragmentTransports send a TLS ClientHello over TCP natively
+var fragmentTransports = map[TransportType]bool{
+	TransportTrojan: true, TransportNaive: true, TransportV2Ray: true,
+	TransportVMess: true, TransportVLESS: true, TransportSSH: true,
+}
+
+// Lengths returns the chunk size range
+func (c *FragmentConfig) Lengths() (int, int, error) {
+	first, last := splitRange(c.Length)
+	min, err := strconv.Atoi(first)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid length %q", c.Length)
+	}
+	max, err := strconv.Atoi(last)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid length %q", c.Length)
+	}
+	if min < 1 || max > 16384 || min > max {
+		return 0, 0, fmt.Errorf("invalid length range %q", c.Length)
+	}
+	return min, max, nil
+}
+
+// Delays returns the range of pauses between chunks
+func (c *FragmentConfig) Delays() (time.Duration, time.Duration, error) {
+	first, last := splitRange(c.Delay)
+	min, err := time.ParseDuration(first)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid delay %q", c.Delay)
+	}
+	max, err := time.ParseDuration(last)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid delay %q", c.Delay)
+	}
+	if min < 0 || max > maxFragmentDelay || min > max {
+		return 0, 0, fmt.Errorf("invalid delay range %q (at most %v)", c.Delay, maxFragmentDelay)
+	}
+	return min, max, nil
+}
+
+// splitRange splits "a-b" into its bounds; a single value is both
+func splitRange(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "-"); i >= 0 {
+		return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+	}
+	return s, s
+}
+
+// validateFragment checks the fragment block of a server
+func validateFragment(i int, server *Server) error {
+	frag := server.Fragment
+	if server.Exec != nil || !fragmentTransports[server.Transport] {
+		return fmt.Errorf("server %d: fragment is only supported for native trojan, naive, v2ray, vmess, vless and ssh transports", i)
+	}
+	switch server.Transport {
+	case TransportSSH:
+		if server.Obfuscation == nil || server.Obfuscation.Type != "tls" {
+			return fmt.Errorf("server %d: fragment for ssh requires tls obfuscation", i)
+		}
+	case TransportV2Ray, TransportVMess, TransportVLESS:
+		if server.V2Ray == nil || server.V2Ray.TLS != "tls" {
+			return fmt.Errorf("server %d: fragment for %s requires tls", i, server.Transport)
+		}
+	}
+
+	switch frag.Mode {
+	case FragmentTCP, FragmentRecord:
+	default:
+		return fmt.Errorf("server %d: unsupported fragment mode: %s (supported: tcp, record)", i, frag.Mode)
+	}
+	if _, _, err := frag.Lengths(); err != nil {
+		return fmt.Errorf("server %d: fragment: %v", i, err)
+	}
+	if _, _, err := frag.Delays(); err != nil {
+		return fmt.Errorf("server %d: fragment: %v", i, err)
+	}
+	return nil
+}
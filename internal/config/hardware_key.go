@@ -0,0 +1,48 @@
+package config
+
+import "fmt"
+
+// Hardware key types
+const (
+	HardwareKeyPKCS11 = "pkcs11" // Smartcards and tokens through a PKCS#11 module
+	HardwareKeyFIDO2  = "fido2"  // sk-ssh-ed25519 and sk-ecdsa keys on a FIDO2 security key
+)
+
+// HardwareKeyConfig authenticates with a key that never leaves a smartcard
+// or security key. The native engine signs through the ssh-agent, which
+// holds the keys once loaded with ssh-add -s <provider> or ssh-add <sk key>;
+// the openssh engine hands the provider and key to ssh.
+type HardwareKeyConfig struct {
+	Type      string `yaml:"type" json:"type"`                                 // pkcs11 or fido2
+	Provider  string `yaml:"provider,omitempty" json:"provider,omitempty"`     // PKCS#11 module, e.g. /usr/lib/opensc-pkcs11.so; for fido2 an alternative SecurityKeyProvider
+	PublicKey string `yaml:"public_key,omitempty" json:"public_key,omitempty"` // .pub file picking one of several keys; key_path + ".pub" by default
+	PIN       string `yaml:"pin,omitempty" json:"pin,omitempty"`               // Token PIN, openssh engine only; the agent asks for it on ssh-add
+}
+
+// validateHardwareKey checks a server's hardware key settings
+func validateHardwareKey(i int, server *Server) error {
+	hw := server.HardwareKey
+	if server.Transport != TransportSSH || server.Exec != nil {
+		return fmt.Errorf("server %d: hardware_key is only supported for the ssh transport", i)
+	}
+	if server.Password != "" {
+		return fmt.Errorf("server %d: hardware_key cannot be combined with a password", i)
+	}
+
+	switch hw.Type {
+	case HardwareKeyPKCS11:
+		if hw.Provider == "" {
+			return fmt.Errorf("server %d: hardware_key provider (PKCS#11 module) is required for type pkcs11", i)
+		}
+	case HardwareKeyFIDO2:
+	case "":
+		return fmt.Errorf("server %d: hardware_key type is required (pkcs11 or fido2)", i)
+	default:
+		return fmt.Errorf("server %d: unsupported hardware_key type: %s (supported: pkcs11, fido2)", i, hw.Type)
+	}
+
+	if hw.PIN != "" && server.Engine != EngineOpenSSH {
+		return fmt.Errorf("server %d: hardware_key pin requires engine openssh; with the native engine the agent asks for it", i)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Local ports of the original single-file ssh-tunnel, which listened on
+// every interface
+const (
+	LegacySOCKSPort = 8080
+	LegacyHTTPPort  = 8888
+)
+
+// LegacyServer is a server in the config of the original single-file
+// ssh-tunnel, which ran the system ssh command with the user's keys
+type LegacyServer struct {
+	Host  string `yaml:"host"`
+	Port  string `yaml:"port"`
+	User  string `yaml:"user"`
+	Proxy string `yaml:"proxy"` // socks5 or http
+}
+
+// LegacyConfig is the config of the original single-file ssh-tunnel
+type LegacyConfig struct {
+	Servers []LegacyServer `yaml:"servers"`
+}
+
+// LoadLegacyConfig reads a legacy config file
+func LoadLegacyConfig(path string) (*LegacyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var legacy LegacyConfig
+	if err := yaml.Unmarshal(data, &legacy); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %v", err)
+	}
+	if len(legacy.Servers) == 0 {
+		return nil, fmt.Errorf("no servers found in the configuration")
+	}
+	return &legacy, nil
+}
+
+// IsLegacyConfig reports whether data is a legacy config rather than a
+// current one: its servers have no names
+func IsLegacyConfig(data []byte) bool {
+	var doc struct {
+		Servers []map[string]interface{} `yaml:"servers"`
+	}
+	if yaml.Unmarshal(data, &doc) != nil || len(doc.Servers) == 0 {
+		return false
+	}
+	for _, server := range doc.Servers {
+		if _, named := server["name"]; named {
+			return false
+		}
+	}
+	return true
+}
+
+// ConvertLegacyConfig builds the config that does what the legacy tool
+// did: test every server's latency and tunnel through the fastest, as a
+// SOCKS5 proxy on port 8080 or an HTTP proxy on 8888. The legacy tool
+// relied on the ssh command finding a key, so servers authenticate with
+// keyPath, or the first of the default keys in ~/.ssh when it is empty.
+func ConvertLegacyConfig(legacy *LegacyConfig, keyPath string) (*Config, error) {
+	if keyPath == "" {
+		keyPath = defaultSSHKey()
+		if keyPath == "" {
+			return nil, fmt.Errorf("no SSH key found in ~/.ssh; pass one with --key")
+		}
+	}
+
+	config := &Config{
+		AutoSelect:      true,
+		SelectionMethod: "latency",
+	}
+	names := make(map[string]int)
+	for i, old := range legacy.Servers {
+		if old.Host == "" {
+			return nil, fmt.Errorf("server %d: host is required", i)
+		}
+
+		server := Server{
+			Name:      old.Host,
+			Host:      old.Host,
+			Port:      old.Port,
+			User:      old.User,
+			KeyPath:   keyPath,
+			Transport: TransportSSH,
+			Proxy:     ProxySOCKS5,
+			LocalPort: LegacySOCKSPort,
+			Timeout:   10 * time.Second,
+			Enabled:   true,
+		}
+		if server.Port == "" {
+			server.Port = "22"
+		}
+		switch old.Proxy {
+		case "", "socks5":
+		case "http":
+			server.Proxy = ProxyHTTP
+			server.LocalPort = LegacyHTTPPort
+		default:
+			return nil, fmt.Errorf("server %s: unsupported proxy %q", old.Host, old.Proxy)
+		}
+
+		// The same host may be listed twice, with different users or ports
+		if names[server.Name]++; names[server.Name] > 1 {
+			server.Name = fmt.Sprintf("%s-%d", old.Host, names[old.Host])
+		}
+		config.Servers = append(config.Servers, server)
+	}
+
+	setDefaults(config)
+	if err := validateConfig(config); err != nil {
+		return nil, fmt.Errorf("converted configuration is invalid: %v", err)
+	}
+	return config, nil
+}
+
+// defaultSSHKey returns the first private key the ssh command would try
+func defaultSSHKey() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		path := filepath.Join(home, ".ssh", name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MemoryConfig bounds the memory proxied connections take, for small VPS
+// and router hardware serving many connections. Each connection holds a
+// relay buffer per direction and a read buffer for the proxy handshake.
+type MemoryConfig struct {
+	// Relay buffer per connection and direction, e.g. "16KB";
+	// DefaultBufferSize when empty. Smaller buffers fit more connections
+	// at some cost in throughput.
+	BufferSize string `yaml:"buffer_size,omitempty" json:"buffer_size,omitempty"`
+
+	// Hard budget for the buffers of all connections, e.g. "64MB"; none
+	// when empty. Connections that do not fit are rejected with an error
+	// instead of running the host out of memory.
+	Budget string `yaml:"budget,omitempty" json:"budget,omitempty"`
+}
+
+// DefaultBufferSize is the relay buffer io.Copy would use
+const DefaultBufferSize = 32 << 10
+
+// Relay buffer bounds
+const (
+	minBufferSize = 1 << 10
+	maxBufferSize = 1 << 20
+)
+
+// sizeUnits maps size suffixes to bytes; sizes are binary, "1KB" is 1024
+var sizeUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+}
+
+// ParseSize converts a size such as "16KB" or "64MB" to bytes
+func ParseSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	for _, unit := range sizeUnits {
+		number, ok := strings.CutSuffix(value, unit.suffix)
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid size %q", s)
+		}
+		return int64(n * float64(unit.scale)), nil
+	}
+	return 0, fmt.Errorf("invalid size %q: expected a unit such as KB or MB", s)
+}
+
+// Sizes returns the relay buffer size and the budget in bytes, with the
+// default buffer size and zero for no budget when unset
+func (m *MemoryConfig) Sizes() (bufferSize int, budget int64, err error) {
+	bufferSize = DefaultBufferSize
+	if m.BufferSize != "" {
+		size, err := ParseSize(m.BufferSize)
+		if err != nil {
+			return 0, 0, fmt.Errorf("memory buffer_size: %v", err)
+		}
+		bufferSize = int(size)
+	}
+	if m.Budget != "" {
+		if budget, err = ParseSize(m.Budget); err != nil {
+			return 0, 0, fmt.Errorf("memory budget: %v", err)
+		}
+	}
+	return bufferSize, budget, nil
+}
+
+// validateMemory checks the memory block
+func validateMemory(config *Config) error {
+	bufferSize, budget, err := config.Memory.Sizes()
+	if err != nil {
+		return err
+	}
+	if bufferSize < minBufferSize || bufferSize > maxBufferSize {
+		return fmt.Errorf("memory buffer_size must be between 1KB and 1MB")
+	}
+	if budget > 0 && budget < 4*int64(bufferSize) {
+		return fmt.Errorf("memory budget %s cannot hold a single connection with buffer_size %d bytes", config.Memory.Budget, bufferSize)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// MeshConfig is the mesh block. The coordinator URL and admin key connect
+// the API server to a coordinator, for the mesh dashboard and the
+// /api/v1/mesh endpoints; with a join token the server also joins the mesh
+// as a node. The tunnel mesh commands read the block with --config.
+type MeshConfig struct {
+	NetworkCIDR    string   `yaml:"network_cidr,omitempty" json:"network_cidr,omitempty"`       // The coordinator's, IPv4, IPv6 ULA or both comma-separated; DefaultMeshNetwork when empty
+	ReservedIPs    []string `yaml:"reserved_ips,omitempty" json:"reserved_ips,omitempty"`       // Addresses, from-to ranges or CIDRs the coordinator never hands out
+	CoordinatorURL string   `yaml:"coordinator_url,omitempty" json:"coordinator_url,omitempty"` // Comma-separated for highly available coordinators
+	AdminKey       string   `yaml:"admin_key,omitempty" json:"admin_key,omitempty"`             // The coordinator's; may be empty over loopback
+	JoinToken      string   `yaml:"join_token,omitempty" json:"join_token,omitempty"`           // From tunnel mesh token create
+
+	// Encryption requires an https coordinator, trusted by CoordinatorPin
+	// when set (or the pin the join token carries), and seals control
+	// messages between nodes
+	Encryption     bool   `yaml:"encryption,omitempty" json:"encryption,omitempty"`
+	CoordinatorPin string `yaml:"coordinator_pin,omitempty" json:"coordinator_pin,omitempty"` // SHA256:... as tunnel mesh coordinator prints it
+
+	// SyncKey opens the config sections an admin pushes with tunnel mesh
+	// config push; a joined server takes SyncSections of them (servers,
+	// routing, auth_tokens), or all when empty
+	SyncKey      string   `yaml:"sync_key,omitempty" json:"sync_key,omitempty"`
+	SyncSections []string `yaml:"sync_sections,omitempty" json:"sync_sections,omitempty"`
+
+	// How this node joins: its name (the hostname when empty), the
+	// host:port peers reach it at, and what routing policies select it by
+	NodeName string   `yaml:"node_name,omitempty" json:"node_name,omitempty"`
+	Endpoint string   `yaml:"endpoint,omitempty" json:"endpoint,omitempty"`
+	Region   string   `yaml:"region,omitempty" json:"region,omitempty"`
+	Tags     []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Routes   []string `yaml:"routes,omitempty" json:"routes,omitempty"` // Subnets to advertise; needs WireGuard
+
+	LoadBalancing       string        `yaml:"load_balancing,omitempty" json:"load_balancing,omitempty"` // latency (default), round_robin, weighted or least_connections
+	HealthCheckInterval time.Duration `yaml:"health_check_interval,omitempty" json:"health_check_interval,omitempty"`
+	FailoverTimeout     time.Duration `yaml:"failover_timeout,omitempty" json:"failover_timeout,omitempty"`
+
+	// WireGuard runs the data plane when the server joins the mesh;
+	// tunnel mesh join runs it anyway unless told --no-wireguard
+	WireGuard bool `yaml:"wireguard,omitempty" json:"wireguard,omitempty"`
+
+	// CoordinatorHA runs tunnel mesh coordinator as one of a highly
+	// available set: the coordinator elected with the file or consul
+	// backend serves, and the others stand by
+	CoordinatorHA ElectionConfig `yaml:"coordinator_ha,omitempty" json:"coordinator_ha,omitempty"`
+}
+
+// DefaultMeshNetwork is the mesh network when none is configured
+const DefaultMeshNetwork = "10.99.0.0/24"
+
+// validReservedIPs reports whether s is an address, a from-to range or a
+// CIDR; the coordinator checks they are in its network
+func validReservedIPs(s string) bool {
+	if _, err := netip.ParsePrefix(s); err == nil {
+		return true
+	}
+	from, to, isRange := strings.Cut(s, "-")
+	lo, err := netip.ParseAddr(strings.TrimSpace(from))
+	if err != nil || !isRange {
+		return err == nil
+	}
+	hi, err := netip.ParseAddr(strings.TrimSpace(to))
+	return err == nil && lo.BitLen() == hi.BitLen() && !hi.Less(lo)
+}
+
+// validMeshNetwork checks a mesh network: an IPv4 prefix, an IPv6 unique
+// local prefix, or one of each separated by a comma
+func validMeshNetwork(network string) error {
+	families := make(map[bool]bool)
+	for _, part := range strings.Split(network, ",") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(part))
+		if err != nil {
+			return err
+		}
+		is6 := prefix.Addr().Is6()
+		if is6 && !netip.MustParsePrefix("fc00::/7").Contains(prefix.Addr()) {
+			return fmt.Errorf("%s is not an IPv6 unique local prefix, in fc00::/7", prefix)
+		}
+		if families[is6] {
+			return fmt.Errorf("use one IPv4 and one IPv6 prefix at most")
+		}
+		families[is6] = true
+	}
+	return nil
+}
+
+// validateMesh checks the mesh block
+func validateMesh(config *Config) error {
+	mesh := config.Mesh
+	if mesh.NetworkCIDR != "" {
+		if err := validMeshNetwork(mesh.NetworkCIDR); err != nil {
+			return fmt.Errorf("mesh network_cidr: %v", err)
+		}
+	}
+	for _, reserved := range mesh.ReservedIPs {
+		if !validReservedIPs(reserved) {
+			return fmt.Errorf("mesh reserved_ips: %q is not an address, a from-to range or a CIDR", reserved)
+		}
+	}
+	if mesh.CoordinatorURL != "" {
+		for _, coordinator := range strings.Split(mesh.CoordinatorURL, ",") {
+			u, err := url.Parse(strings.TrimSpace(coordinator))
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("mesh coordinator_url must be http or https URLs, separated by commas")
+			}
+			if mesh.Encryption && u.Scheme != "https" {
+				return fmt.Errorf("mesh encryption requires an https coordinator_url")
+			}
+		}
+	}
+	if mesh.JoinToken != "" && mesh.CoordinatorURL == "" {
+		return fmt.Errorf("mesh join_token requires coordinator_url")
+	}
+	if mesh.Encryption && mesh.CoordinatorURL == "" {
+		return fmt.Errorf("mesh encryption requires an https coordinator_url")
+	}
+	if mesh.CoordinatorHA.Enabled {
+		switch mesh.CoordinatorHA.Backend {
+		case "", "file", "consul":
+		default:
+			return fmt.Errorf("unsupported mesh coordinator_ha backend: %s (supported: file, consul)", mesh.CoordinatorHA.Backend)
+		}
+	}
+	if mesh.CoordinatorPin != "" {
+		sum, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(mesh.CoordinatorPin, "SHA256:"))
+		if !strings.HasPrefix(mesh.CoordinatorPin, "SHA256:") || err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("mesh coordinator_pin must be SHA256: and a base64 SHA-256, as tunnel mesh coordinator prints it")
+		}
+	}
+	if mesh.SyncKey != "" {
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(mesh.SyncKey, "msk1"))
+		if !strings.HasPrefix(mesh.SyncKey, "msk1") || err != nil || len(key) != 32 {
+			return fmt.Errorf("mesh sync_key is invalid: create one with tunnel mesh config keygen")
+		}
+	}
+	for _, section := range mesh.SyncSections {
+		switch section {
+		case "servers", "routing", "auth_tokens":
+		default:
+			return fmt.Errorf("mesh sync_sections: unknown section %q: use servers, routing or auth_tokens", section)
+		}
+	}
+	if mesh.Endpoint != "" {
+		if _, _, err := net.SplitHostPort(mesh.Endpoint); err != nil {
+			return fmt.Errorf("mesh endpoint must be host:port: %v", err)
+		}
+	}
+	for _, tag := range mesh.Tags {
+		if tag == "" {
+			return fmt.Errorf("mesh tags must not be empty")
+		}
+	}
+	for _, route := range mesh.Routes {
+		if _, _, err := net.ParseCIDR(route); err != nil {
+			return fmt.Errorf("mesh route %q: %v", route, err)
+		}
+	}
+	switch mesh.LoadBalancing {
+	case "", "latency", "round_robin", "weighted", "least_connections":
+	default:
+		return fmt.Errorf("mesh load_balancing must be latency, round_robin, weighted or least_connections")
+	}
+	if mesh.HealthCheckInterval < 0 || mesh.FailoverTimeout < 0 {
+		return fmt.Errorf("mesh health_check_interval and failover_timeout must not be negative")
+	}
+	return nil
+}
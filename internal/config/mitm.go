@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// MITMConfig enables HTTPS interception for debugging. Connections to the
+// listed domains are decrypted with certificates from a local CA, which the
+// user must install and trust by hand, so requests can be logged and
+// matched by full URL. Everything else passes through untouched. This is a
+// debugging aid: anyone holding the CA key can impersonate those domains
+// to this machine.
+type MITMConfig struct {
+	Enabled bool     `yaml:"enabled" json:"enabled"`
+	Domains []string `yaml:"domains" json:"domains"`                   // "example.com" or "*.example.com"
+	CADir   string   `yaml:"ca_dir,omitempty" json:"ca_dir,omitempty"` // Where ca.crt and ca.key are kept
+}
+
+// Intercepts reports whether connections to host are decrypted
+func (c *MITMConfig) Intercepts(host string) bool {
+	if !c.Enabled {
+		return false
+	}
+	for _, pattern := range c.Domains {
+		if matchDomain(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesURL reports whether a "url" routing rule covers a decrypted
+// request. The pattern is a full URL in which "*" matches any run of
+// characters, e.g. "https://example.com/api/*".
+func (r *RoutingRule) MatchesURL(url string) bool {
+	if r.Type != "url" {
+		return false
+	}
+	return matchGlob(r.Pattern, url)
+}
+
+// matchGlob matches s against a pattern where "*" stands for any run of
+// characters
+func matchGlob(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return s == pattern
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// validateMITM checks the interception block and the url rules that need it
+func validateMITM(config *Config) error {
+	for i, rule := range config.Routing {
+		if rule.Type != "url" {
+			continue
+		}
+		if !config.MITM.Enabled {
+			return fmt.Errorf("routing rule %d: url rules need mitm to be enabled", i)
+		}
+		if rule.Pattern == "" {
+			return fmt.Errorf("routing rule %d: url pattern is required", i)
+		}
+		switch rule.Action {
+		case "proxy", "block":
+		default:
+			return fmt.Errorf("routing rule %d: unsupported action for url rule: %s (supported: proxy, block)", i, rule.Action)
+		}
+	}
+
+	if !config.MITM.Enabled {
+		return nil
+	}
+	if len(config.MITM.Domains) == 0 {
+		return fmt.Errorf("mitm needs at least one domain to intercept")
+	}
+	for _, domain := range config.MITM.Domains {
+		name := strings.TrimPrefix(domain, "*.")
+		if name == "" || strings.Contains(name, "*") || !strings.Contains(name, ".") || net.ParseIP(name) != nil {
+			return fmt.Errorf("mitm: invalid domain %q (use \"example.com\" or \"*.example.com\")", domain)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SSH engines: the built-in client, or the system OpenSSH binary for what
+// the built-in one lacks (agent and smartcard keys, GSSAPI, ~/.ssh/config)
+const (
+	EngineNative  = "native"
+	EngineOpenSSH = "openssh"
+)
+
+// OpenSSHConfig tunes the ssh command run by the openssh engine
+type OpenSSHConfig struct {
+	Binary     string            `yaml:"binary,omitempty" json:"binary,omitempty"`           // Path or name in $PATH, "ssh" by default
+	ConfigFile string            `yaml:"config_file,omitempty" json:"config_file,omitempty"` // Passed with -F instead of ~/.ssh/config
+	Options    map[string]string `yaml:"options,omitempty" json:"options,omitempty"`         // Extra -o options, taking precedence over the generated ones
+}
+
+// validateEngine checks a server's SSH engine. The openssh engine dials the
+// server itself, so it cannot run over an obfuscation layer, be part of a
+// chain or relay UDP.
+func validateEngine(i int, server *Server, servers []Server) error {
+	switch server.Engine {
+	case "", EngineNative:
+		if server.OpenSSH != nil {
+			return fmt.Errorf("server %d: openssh settings require engine openssh", i)
+		}
+		return nil
+	case EngineOpenSSH:
+	default:
+		return fmt.Errorf("server %d: unsupported engine: %s (supported: native, openssh)", i, server.Engine)
+	}
+
+	if server.Transport != TransportSSH || server.Exec != nil {
+		return fmt.Errorf("server %d: engine openssh is only supported for the ssh transport", i)
+	}
+	if obfs := server.Obfuscation; obfs != nil && obfs.Type != "" && obfs.Type != "none" {
+		return fmt.Errorf("server %d: obfuscation cannot be used with engine openssh", i)
+	}
+	if len(server.Chain) > 0 {
+		return fmt.Errorf("server %d: chain cannot be used with engine openssh", i)
+	}
+	if server.UDP != nil {
+		return fmt.Errorf("server %d: udp relay cannot be used with engine openssh", i)
+	}
+	if server.User == "" {
+		return fmt.Errorf("server %d: user is required for SSH transport", i)
+	}
+
+	if ssh := server.OpenSSH; ssh != nil {
+		for name := range ssh.Options {
+			if name == "" || strings.ContainsAny(name, " \t=") {
+				return fmt.Errorf("server %d: invalid openssh option name %q", i, name)
+			}
+		}
+	}
+
+	for _, other := range servers {
+		for _, hop := range other.Chain {
+			if hop == server.Name {
+				return fmt.Errorf("server %d: servers with engine openssh cannot be chain hops (used by %s)", i, other.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// WithServerDefaults returns a copy of a server given to the API with the
+// server_defaults of config merged in, as loading its entry from the
+// config file would give it. The copy shares nothing with server, so
+// SetDefaults can fill it in while server is saved as given.
+func WithServerDefaults(config *Config, server Server) (Server, error) {
+	entry, err := serverNode(server)
+	if err != nil {
+		return Server{}, err
+	}
+	if len(config.ServerDefaults) > 0 {
+		var defaults yaml.Node
+		if err := defaults.Encode(config.ServerDefaults); err != nil {
+			return Server{}, fmt.Errorf("failed to encode server_defaults: %v", err)
+		}
+		mergeMapping(entry, &defaults)
+	}
+
+	var merged Server
+	if err := entry.Decode(&merged); err != nil {
+		return Server{}, fmt.Errorf("failed to apply server_defaults: %v", err)
+	}
+	return merged, nil
+}
+
+// SaveServer writes one server change to the config file and leaves the
+// rest of the document as it was, so server_defaults, templates, comments
+// and settings left to their defaults are not written out inline. The
+// entry named name is replaced by server, or removed when server is nil;
+// an empty name appends server. Without a config file to patch, config is
+// saved whole.
+func SaveServer(config *Config, configPath, name string, server *Server) error {
+	return patchConfigFile(config, configPath, func(root *yaml.Node) error {
+		servers := mappingValue(root, "servers")
+		if servers == nil {
+			servers = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			setMappingValue(root, "servers", servers)
+		}
+		servers = resolveAlias(servers)
+		if servers.Kind != yaml.SequenceNode {
+			return fmt.Errorf("servers in the config file is not a list")
+		}
+
+		index := len(servers.Content)
+		if name != "" {
+			index = serverEntry(servers, name)
+			if index < 0 {
+				return fmt.Errorf("server %s is not in the config file", name)
+			}
+		}
+
+		if server == nil {
+			servers.Content = append(servers.Content[:index], servers.Content[index+1:]...)
+			return nil
+		}
+		entry, err := serverNode(*server)
+		if err != nil {
+			return err
+		}
+		if index == len(servers.Content) {
+			servers.Content = append(servers.Content, entry)
+		} else {
+			servers.Content[index] = entry
+		}
+		return nil
+	})
+}
+
+// SaveAPIKeys writes the API keys of config to the config file, leaving
+// the rest of the document as it was
+func SaveAPIKeys(config *Config, configPath string) error {
+	return patchConfigFile(config, configPath, func(root *yaml.Node) error {
+		security := mappingValue(root, "security")
+		if security == nil {
+			security = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			setMappingValue(root, "security", security)
+		}
+		security = resolveAlias(security)
+		if security.Kind != yaml.MappingNode {
+			return fmt.Errorf("security in the config file is not a mapping")
+		}
+
+		var keys yaml.Node
+		if err := keys.Encode(config.Security.APIKeys); err != nil {
+			return fmt.Errorf("failed to encode api keys: %v", err)
+		}
+		setMappingValue(security, "api_keys", &keys)
+		return nil
+	})
+}
+
+// patchConfigFile applies patch to the top-level mapping of the config
+// file and writes the document back, encrypted again if it was
+func patchConfigFile(config *Config, configPath string, patch func(root *yaml.Node) error) error {
+	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return SaveConfig(config, configPath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	encrypted := isEncrypted(data)
+	if encrypted {
+		if data, err = decrypt(data, savePassword(config)); err != nil {
+			return fmt.Errorf("failed to decrypt config: %v", err)
+		}
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config file: %v", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return SaveConfig(config, configPath)
+	}
+	if err := patch(doc.Content[0]); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return fmt.Errorf("failed to marshal config: %v", err)
+	}
+	data = buf.Bytes()
+
+	if encrypted || config.Security.EncryptConfig {
+		password := savePassword(config)
+		if password == "" {
+			return fmt.Errorf("encryption requested but no password provided")
+		}
+		if data, err = encrypt(data, password); err != nil {
+			return fmt.Errorf("failed to encrypt config: %v", err)
+		}
+	}
+	return os.WriteFile(configPath, data, 0600)
+}
+
+// serverEntry returns the index of the servers entry named name, or -1.
+// An entry without a name goes by the one setDefaults gives it.
+func serverEntry(servers *yaml.Node, name string) int {
+	for i, entry := range servers.Content {
+		entry = resolveAlias(entry)
+		if entry.Kind != yaml.MappingNode {
+			continue
+		}
+		entryName := fmt.Sprintf("server-%d", i+1)
+		if value := entryValue(entry, "name"); value != nil && value.Value != "" {
+			entryName = value.Value
+		}
+		if entryName == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// entryValue returns the value a mapping sets for key, itself or through a
+// merge key
+func entryValue(node *yaml.Node, key string) *yaml.Node {
+	if value := mappingValue(node, key); value != nil {
+		return resolveAlias(value)
+	}
+	for _, merged := range mergeSources(node) {
+		if value := entryValue(merged, key); value != nil {
+			return value
+		}
+	}
+	return nil
+}
+
+// serverNode encodes a server as an entry of the servers list. The empty
+// settings every encoded server carries, the few without omitempty, are
+// left out, so server_defaults and setDefaults fill them in on load.
+func serverNode(server Server) (*yaml.Node, error) {
+	var entry yaml.Node
+	if err := entry.Encode(server); err != nil {
+		return nil, fmt.Errorf("failed to encode server: %v", err)
+	}
+
+	content := entry.Content[:0]
+	for i := 0; i+1 < len(entry.Content); i += 2 {
+		if !isEmptyScalar(entry.Content[i+1]) {
+			content = append(content, entry.Content[i], entry.Content[i+1])
+		}
+	}
+	entry.Content = content
+	return &entry, nil
+}
+
+// isEmptyScalar reports whether a node is the encoding of a zero value
+func isEmptyScalar(node *yaml.Node) bool {
+	if node.Kind != yaml.ScalarNode {
+		return false
+	}
+	switch node.Tag {
+	case "!!str":
+		return node.Value == ""
+	case "!!int":
+		return node.Value == "0"
+	case "!!bool":
+		return node.Value == "false"
+	case "!!null":
+		return true
+	}
+	return false
+}
+
+// setMappingValue sets key in a mapping, replacing the value it sets
+// itself or adding the key
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = value
+			return
+		}
+	}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const patchConfig = `# Managed by hand
+server_defaults:
+  user: root
+  password: secret
+servers:
+  - name: a # First
+    host: a.example.com
+    port: "22"
+  - host: b.example.com
+    port: "22"
+`
+
+// writePatchConfig writes patchConfig and loads it back
+func writePatchConfig(t *testing.T) (*Config, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(patchConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg, path
+}
+
+func TestSaveServerPatchesOneEntry(t *testing.T) {
+	cfg, path := writePatchConfig(t)
+
+	added := Server{Name: "c", Host: "c.example.com", Port: "2222"}
+	if err := SaveServer(cfg, path, "", &added); err != nil {
+		t.Fatal(err)
+	}
+	replaced := Server{Name: "b", Host: "b2.example.com", Port: "22", Enabled: true}
+	if err := SaveServer(cfg, path, "server-2", &replaced); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := string(data)
+	for _, want := range []string{"# Managed by hand", "name: a # First", "server_defaults:"} {
+		if !strings.Contains(saved, want) {
+			t.Errorf("saved config lost %q:\n%s", want, saved)
+		}
+	}
+	// Defaults stay in server_defaults and setDefaults, not in the entries
+	if n := strings.Count(saved, "user: root"); n != 1 {
+		t.Errorf("user: root written %d times:\n%s", n, saved)
+	}
+	for _, unwanted := range []string{"transport:", "proxy:", "local_port:", "enabled: false"} {
+		if strings.Contains(saved, unwanted) {
+			t.Errorf("saved config has %q written inline:\n%s", unwanted, saved)
+		}
+	}
+
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("saved config does not load: %v\n%s", err, saved)
+	}
+	var names []string
+	for _, server := range loaded.Servers {
+		names = append(names, server.Name)
+		if server.User != "root" {
+			t.Errorf("server %s lost server_defaults", server.Name)
+		}
+	}
+	if got := strings.Join(names, ","); got != "a,b,c" {
+		t.Errorf("servers = %s, want a,b,c", got)
+	}
+	if loaded.Servers[1].Host != "b2.example.com" || !loaded.Servers[1].Enabled {
+		t.Errorf("server b not replaced: %+v", loaded.Servers[1])
+	}
+
+	if err := SaveServer(loaded, path, "a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err = LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Servers) != 2 || loaded.Servers[0].Name != "b" {
+		t.Errorf("server a not removed: %+v", loaded.Servers)
+	}
+	if err := SaveServer(loaded, path, "a", nil); err == nil {
+		t.Error("removing a server not in the file should fail")
+	}
+}
+
+func TestWithServerDefaults(t *testing.T) {
+	cfg, _ := writePatchConfig(t)
+
+	given := Server{Name: "d", Host: "d.example.com", Port: "22", V2Ray: &V2RayConfig{Network: "ws"}}
+	inUse, err := WithServerDefaults(cfg, given)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inUse.User != "root" || inUse.Password != "secret" {
+		t.Errorf("server_defaults not merged: %+v", inUse)
+	}
+	if inUse.V2Ray == given.V2Ray {
+		t.Error("the server in use shares settings with the one given")
+	}
+	if given.User != "" {
+		t.Error("the server given was changed")
+	}
+}
+
+func TestSaveAPIKeys(t *testing.T) {
+	cfg, path := writePatchConfig(t)
+
+	cfg.Security.APIKeys = []APIKey{{ID: "0123456789ab", Name: "ci", Hash: strings.Repeat("0", 64), Role: RoleOperator}}
+	if err := SaveAPIKeys(cfg, path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Security.APIKeys) != 1 || loaded.Security.APIKeys[0].Name != "ci" {
+		t.Errorf("api keys = %+v", loaded.Security.APIKeys)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Count(string(data), "user: root") != 1 {
+		t.Errorf("saving api keys wrote server defaults inline:\n%s", data)
+	}
+}
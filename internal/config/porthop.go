@@ -0,0 +1,76 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PortHoppingConfig makes UDP transports rotate their destination port
+// within a range so per-port throttling never sees a long-lived flow. The
+// server must accept the whole range, e.g. with an iptables rule
+// redirecting it to the real listening port.
+type PortHoppingConfig struct {
+	Ports    string        `yaml:"ports" json:"ports"`                           // "20000-40000" or "20000-20100,30000"
+	Interval time.Duration `yaml:"interval,omitempty" json:"interval,omitempty"` // Time between hops
+}
+
+// minHopInterval keeps hops infrequent enough for the transport to recover
+const minHopInterval = 5 * time.Second
+
+// portHoppingTransports are the UDP transports that support port hopping
+var portHoppingTransports = map[TransportType]bool{
+	TransportHysteria: true, TransportTUIC: true, TransportWireGuard: true,
+}
+
+// PortList expands the port specification into individual ports
+func (c *PortHoppingConfig) PortList() ([]int, error) {
+	var ports []int
+	for _, part := range strings.Split(c.Ports, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		first, last := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			first, last = part[:i], part[i+1:]
+		}
+
+		start, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", first)
+		}
+		end, err := strconv.Atoi(strings.TrimSpace(last))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", last)
+		}
+		if start < 1 || end > 65535 || start > end {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+
+		for port := start; port <= end; port++ {
+			ports = append(ports, port)
+		}
+	}
+
+	if len(ports) < 2 {
+		return nil, fmt.Errorf("port hopping needs at least two ports")
+	}
+	return ports, nil
+}
+
+// validatePortHopping checks the port hopping block of a server
+func validatePortHopping(i int, server *Server) error {
+	if !portHoppingTransports[server.Transport] {
+		return fmt.Errorf("server %d: port_hopping is only supported for UDP transports (hysteria, tuic, wireguard)", i)
+	}
+	if _, err := server.PortHopping.PortList(); err != nil {
+		return fmt.Errorf("server %d: port_hopping: %v", i, err)
+	}
+	if server.PortHopping.Interval < minHopInterval {
+		return fmt.Errorf("server %d: port_hopping interval must be at least %v", i, minHopInterval)
+	}
+	return nil
+}
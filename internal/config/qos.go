@@ -0,0 +1,125 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Traffic priority classes
+const (
+	PriorityInteractive = "interactive"
+	PriorityBulk        = "bulk"
+)
+
+// QoSConfig schedules traffic of all tunnels through shared upload and
+// download budgets, interactive traffic first. The budgets should be a
+// little below the real link speed so queues build up here, where they
+// can be reordered, rather than in the modem.
+type QoSConfig struct {
+	Enabled  bool   `yaml:"enabled" json:"enabled"`
+	Upload   string `yaml:"upload,omitempty" json:"upload,omitempty"`     // e.g. "20mbps"
+	Download string `yaml:"download,omitempty" json:"download,omitempty"` // e.g. "100mbps"
+
+	// Connections without a priority rule start interactive and become
+	// bulk after transferring this many bytes
+	BulkThreshold int64 `yaml:"bulk_threshold,omitempty" json:"bulk_threshold,omitempty"`
+
+	// Destination ports that are interactive unless a rule says otherwise
+	InteractivePorts []int `yaml:"interactive_ports,omitempty" json:"interactive_ports,omitempty"`
+}
+
+// DefaultInteractivePorts are SSH, DNS and DNS over TLS
+var DefaultInteractivePorts = []int{22, 53, 853}
+
+// Matches reports whether a routing rule covers a destination. Domain and
+// IP rules are supported; other rule types never match.
+func (r *RoutingRule) Matches(host string, port int) bool {
+	switch r.Type {
+	case "domain":
+		patterns := r.Domains
+		if r.Pattern != "" {
+			patterns = append([]string{r.Pattern}, patterns...)
+		}
+		for _, pattern := range patterns {
+			if matchDomain(pattern, host) {
+				return true
+			}
+		}
+	case "ip":
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		entries := r.IPs
+		if r.Pattern != "" {
+			entries = append([]string{r.Pattern}, entries...)
+		}
+		for _, entry := range entries {
+			if _, network, err := net.ParseCIDR(entry); err == nil {
+				if network.Contains(ip) {
+					return true
+				}
+			} else if ip.Equal(net.ParseIP(entry)) {
+				return true
+			}
+		}
+	case "port":
+		for _, p := range r.Ports {
+			if p == port {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchDomain matches host against "example.com" or "*.example.com"; the
+// wildcard also covers the bare domain
+func matchDomain(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// validateQoS checks the QoS block and the priorities set by routing rules
+func validateQoS(config *Config) error {
+	for i, rule := range config.Routing {
+		switch rule.Priority {
+		case "", PriorityInteractive, PriorityBulk:
+		default:
+			return fmt.Errorf("routing rule %d: unsupported priority: %s (supported: interactive, bulk)", i, rule.Priority)
+		}
+		if rule.Type == "port" {
+			for _, port := range rule.Ports {
+				if port < 1 || port > 65535 {
+					return fmt.Errorf("routing rule %d: invalid port %d", i, port)
+				}
+			}
+		}
+	}
+
+	qos := config.QoS
+	if !qos.Enabled {
+		return nil
+	}
+	if qos.Upload == "" && qos.Download == "" {
+		return fmt.Errorf("qos needs an upload or download budget")
+	}
+	for _, budget := range []string{qos.Upload, qos.Download} {
+		if budget == "" {
+			continue
+		}
+		if _, err := ParseBandwidth(budget); err != nil {
+			return fmt.Errorf("qos: %v", err)
+		}
+	}
+	if qos.BulkThreshold < 0 {
+		return fmt.Errorf("qos bulk_threshold cannot be negative")
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// How public remote forwards are made reachable when sshd's GatewayPorts
+// keeps them on the server's loopback
+const (
+	GatewayRelay = "relay" // Run socat or the relay helper on the server
+	GatewaySSHD  = "sshd"  // Set GatewayPorts in sshd_config, with a backup
+	GatewayNone  = "none"  // Leave the forward on loopback
+)
+
+// DefaultTCPRelay is the helper command SSH servers run to publish a
+// loopback forward when socat is not installed
+const DefaultTCPRelay = "tunnel tcp-relay"
+
+// RemoteForwardConfig serves connections to a port of the SSH server from
+// a local address, like ssh -R
+type RemoteForwardConfig struct {
+	Remote  string `yaml:"remote" json:"remote"`                       // "[bind_address:]port" on the server
+	Local   string `yaml:"local" json:"local"`                         // "host:port" the connections go to
+	Public  bool   `yaml:"public,omitempty" json:"public,omitempty"`   // Listen on all the server's addresses
+	Gateway string `yaml:"gateway,omitempty" json:"gateway,omitempty"` // For public forwards: relay (default), sshd or none
+	Relay   string `yaml:"relay,omitempty" json:"relay,omitempty"`     // Relay helper command, when socat is missing
+}
+
+// RemoteAddress returns the address to listen on on the server. Public
+// forwards without a bind address listen on all addresses.
+func (f RemoteForwardConfig) RemoteAddress() (string, error) {
+	host, port := "", f.Remote
+	if i := strings.LastIndex(f.Remote, ":"); i >= 0 {
+		host, port = strings.Trim(f.Remote[:i], "[]"), f.Remote[i+1:]
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid remote forward port in %q", f.Remote)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+		if f.Public {
+			host = "0.0.0.0"
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// validateRemoteForwards checks a server's remote forwards, which need the
+// built-in SSH client
+func validateRemoteForwards(i int, server *Server) error {
+	if server.Transport != TransportSSH || server.Exec != nil {
+		return fmt.Errorf("server %d: remote forwards are only supported for the ssh transport", i)
+	}
+	if server.Engine == EngineOpenSSH {
+		return fmt.Errorf("server %d: remote forwards cannot be used with engine openssh", i)
+	}
+	if len(server.Chain) > 0 {
+		return fmt.Errorf("server %d: remote forwards are not supported through chains", i)
+	}
+
+	remotes := make(map[string]bool)
+	for j, forward := range server.RemoteForwards {
+		remote, err := forward.RemoteAddress()
+		if err != nil {
+			return fmt.Errorf("server %d: %v", i, err)
+		}
+		if remotes[remote] {
+			return fmt.Errorf("server %d: remote %s is forwarded twice", i, remote)
+		}
+		remotes[remote] = true
+		if _, port, _ := net.SplitHostPort(remote); forward.Public && port == "0" {
+			return fmt.Errorf("server %d: remote forward %d: public forwards need a fixed port", i, j)
+		}
+
+		if _, _, err := net.SplitHostPort(forward.Local); err != nil {
+			return fmt.Errorf("server %d: remote forward %d: invalid local address %q (use host:port)", i, j, forward.Local)
+		}
+		switch forward.Gateway {
+		case "":
+		case GatewayRelay, GatewaySSHD, GatewayNone:
+			if !forward.Public {
+				return fmt.Errorf("server %d: remote forward %d: gateway only applies to public forwards", i, j)
+			}
+		default:
+			return fmt.Errorf("server %d: remote forward %d: unsupported gateway: %s (supported: relay, sshd, none)", i, j, forward.Gateway)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package config
+
+import "time"
+
+// ScoringWeights controls how servers and mesh nodes are ranked. Each weight
+// scales a component normalized to the 0-1 range (1 is best), and the final
+// score is the weighted average of the components, so only the ratios
+// between weights matter.
+//
+//	latency:     1 / (1 + ms/100)       100ms scores 0.5
+//	load:        1 - load               load is 0-1
+//	region:      1 when the candidate is in the preferred region
+//	priority:    1 / priority           priority 1 is the highest
+//	cost:        1 / (1 + cost)         cost in any consistent unit
+//	packet_loss: 1 - loss               loss is 0-1
+//	throughput:  mbps / best mbps       relative to the fastest candidate
+type ScoringWeights struct {
+	Latency    float64 `yaml:"latency" json:"latency"`
+	Load       float64 `yaml:"load" json:"load"`
+	Region     float64 `yaml:"region" json:"region"`
+	Priority   float64 `yaml:"priority" json:"priority"`
+	Cost       float64 `yaml:"cost" json:"cost"`
+	PacketLoss float64 `yaml:"packet_loss" json:"packet_loss"`
+	Throughput float64 `yaml:"throughput" json:"throughput"`
+}
+
+// ScoreInput holds the measurements of a single scoring candidate
+type ScoreInput struct {
+	Latency       time.Duration
+	Load          float64
+	InRegion      bool
+	Priority      int
+	Cost          float64
+	PacketLoss    float64
+	Throughput    float64 // Mbps
+	MaxThroughput float64 // Best Mbps among all candidates
+}
+
+// DefaultScoringWeights returns the weights used when none are configured
+func DefaultScoringWeights() ScoringWeights {
+	return ScoringWeights{
+		Latency:    0.4,
+		Load:       0.3,
+		Region:     0.1,
+		Priority:   0.1,
+		Cost:       0.05,
+		PacketLoss: 0.05,
+	}
+}
+
+// DefaultThroughputWeight is the throughput_weight used when the key is absent
+const DefaultThroughputWeight = 0.7
+
+// ThroughputShare returns the share of the throughput selection score taken
+// by measured throughput. An explicit 0 means latency only.
+func (c *Config) ThroughputShare() float64 {
+	if c.ThroughputWeight == nil {
+		return DefaultThroughputWeight
+	}
+	return *c.ThroughputWeight
+}
+
+// IsZero reports whether no weight has been set
+func (w ScoringWeights) IsZero() bool {
+	return w == ScoringWeights{}
+}
+
+// Score ranks a candidate between 0 and 1, higher is better
+func (w ScoringWeights) Score(in ScoreInput) float64 {
+	if w.IsZero() {
+		w = DefaultScoringWeights()
+	}
+
+	total := w.Latency + w.Load + w.Region + w.Priority + w.Cost + w.PacketLoss + w.Throughput
+	if total <= 0 {
+		return 0
+	}
+
+	score := 0.0
+	score += w.Latency * (1 / (1 + float64(in.Latency.Milliseconds())/100))
+	score += w.Load * (1 - clamp01(in.Load))
+	if in.InRegion {
+		score += w.Region
+	}
+	priority := in.Priority
+	if priority < 1 {
+		priority = 1
+	}
+	score += w.Priority / float64(priority)
+	if in.Cost > 0 {
+		score += w.Cost / (1 + in.Cost)
+	} else {
+		score += w.Cost
+	}
+	score += w.PacketLoss * (1 - clamp01(in.PacketLoss))
+	if in.MaxThroughput > 0 {
+		score += w.Throughput * clamp01(in.Throughput/in.MaxThroughput)
+	}
+
+	return score / total
+}
+
+// Outranks reports whether the candidate name with score should replace
+// the best one so far. Equal scores go to the name that sorts first, so
+// the pick does not depend on map iteration order. An empty bestName
+// means there is no best yet.
+func Outranks(score float64, name string, bestScore float64, bestName string) bool {
+	if bestName == "" || score > bestScore {
+		return true
+	}
+	return score == bestScore && name < bestName
+}
+
+func clamp01(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestScoreWeighting(t *testing.T) {
+	fast := ScoreInput{Latency: 20 * time.Millisecond, Load: 0.9, Priority: 1}
+	idle := ScoreInput{Latency: 200 * time.Millisecond, Load: 0.1, Priority: 1}
+
+	tests := []struct {
+		name    string
+		weights ScoringWeights
+		better  ScoreInput
+		worse   ScoreInput
+	}{
+		{"latency only prefers the fast server", ScoringWeights{Latency: 1}, fast, idle},
+		{"load only prefers the idle server", ScoringWeights{Load: 1}, idle, fast},
+		{"latency outweighs load", ScoringWeights{Latency: 0.9, Load: 0.1}, fast, idle},
+		{"load outweighs latency", ScoringWeights{Latency: 0.1, Load: 0.9}, idle, fast},
+		{"region", ScoringWeights{Region: 1}, ScoreInput{InRegion: true}, ScoreInput{}},
+		{"priority 1 is highest", ScoringWeights{Priority: 1}, ScoreInput{Priority: 1}, ScoreInput{Priority: 3}},
+		{"cheaper wins", ScoringWeights{Cost: 1}, ScoreInput{Cost: 1}, ScoreInput{Cost: 5}},
+		{"less loss wins", ScoringWeights{PacketLoss: 1}, ScoreInput{PacketLoss: 0.01}, ScoreInput{PacketLoss: 0.2}},
+		{
+			"faster throughput wins",
+			ScoringWeights{Throughput: 1},
+			ScoreInput{Throughput: 90, MaxThroughput: 100},
+			ScoreInput{Throughput: 10, MaxThroughput: 100},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			better, worse := tt.weights.Score(tt.better), tt.weights.Score(tt.worse)
+			if better <= worse {
+				t.Errorf("expected %.3f > %.3f", better, worse)
+			}
+		})
+	}
+}
+
+func TestScoreNormalization(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights ScoringWeights
+		in      ScoreInput
+		want    float64
+	}{
+		{"100ms scores half", ScoringWeights{Latency: 1}, ScoreInput{Latency: 100 * time.Millisecond}, 0.5},
+		{"zero latency scores one", ScoringWeights{Latency: 1}, ScoreInput{}, 1},
+		{"load is clamped above one", ScoringWeights{Load: 1}, ScoreInput{Load: 3}, 0},
+		{"load is clamped below zero", ScoringWeights{Load: 1}, ScoreInput{Load: -1}, 1},
+		{"priority below one counts as one", ScoringWeights{Priority: 1}, ScoreInput{Priority: 0}, 1},
+		{"no cost scores one", ScoringWeights{Cost: 1}, ScoreInput{}, 1},
+		{"throughput above the best is clamped", ScoringWeights{Throughput: 1}, ScoreInput{Throughput: 200, MaxThroughput: 100}, 1},
+		{"no throughput measurements score zero", ScoringWeights{Throughput: 1}, ScoreInput{Throughput: 50}, 0},
+		{"weighted average", ScoringWeights{Latency: 1, Region: 3}, ScoreInput{Latency: 100 * time.Millisecond, InRegion: true}, (0.5 + 3) / 4},
+		{"negative total scores zero", ScoringWeights{Latency: -1}, ScoreInput{}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.weights.Score(tt.in); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Score() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScoreOnlyRatiosMatter(t *testing.T) {
+	in := ScoreInput{Latency: 80 * time.Millisecond, Load: 0.4, InRegion: true, Priority: 2, Cost: 3, PacketLoss: 0.05}
+	weights := ScoringWeights{Latency: 0.4, Load: 0.3, Region: 0.1, Priority: 0.1, Cost: 0.05, PacketLoss: 0.05}
+	scaled := ScoringWeights{Latency: 40, Load: 30, Region: 10, Priority: 10, Cost: 5, PacketLoss: 5}
+
+	if a, b := weights.Score(in), scaled.Score(in); math.Abs(a-b) > 1e-9 {
+		t.Errorf("scaled weights changed the score: %v != %v", a, b)
+	}
+	if a, b := (ScoringWeights{}).Score(in), DefaultScoringWeights().Score(in); a != b {
+		t.Errorf("zero weights should score with the defaults: %v != %v", a, b)
+	}
+	if score := weights.Score(in); score < 0 || score > 1 {
+		t.Errorf("score %v is outside 0-1", score)
+	}
+}
+
+func TestOutranks(t *testing.T) {
+	tests := []struct {
+		name      string
+		score     float64
+		candidate string
+		bestScore float64
+		best      string
+		want      bool
+	}{
+		{"first candidate", 0, "b", 0, "", true},
+		{"higher score", 0.8, "b", 0.5, "a", true},
+		{"lower score", 0.4, "a", 0.5, "b", false},
+		{"tie goes to the earlier name", 0.5, "a", 0.5, "b", true},
+		{"tie keeps the earlier name", 0.5, "c", 0.5, "b", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Outranks(tt.score, tt.candidate, tt.bestScore, tt.best); got != tt.want {
+				t.Errorf("Outranks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutranksIgnoresOrder(t *testing.T) {
+	weights := ScoringWeights{Latency: 1}
+	in := ScoreInput{Latency: 50 * time.Millisecond}
+	orders := [][]string{{"a", "b", "c"}, {"c", "b", "a"}, {"b", "c", "a"}}
+
+	for _, order := range orders {
+		var best string
+		var bestScore float64
+		for _, name := range order {
+			if score := weights.Score(in); Outranks(score, name, bestScore, best) {
+				best, bestScore = name, score
+			}
+		}
+		if best != "a" {
+			t.Errorf("order %v picked %s, want a", order, best)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package config
+
+import "fmt"
+
+// ShadowsocksConfig runs a Shadowsocks server on the daemon so LAN devices
+// that only speak Shadowsocks (some routers and TVs) can send their traffic
+// through the tunnels. Only TCP is relayed.
+type ShadowsocksConfig struct {
+	Enabled  bool   `yaml:"enabled" json:"enabled"`
+	Port     int    `yaml:"port" json:"port"`
+	Method   string `yaml:"method,omitempty" json:"method,omitempty"` // "chacha20-ietf-poly1305", "aes-128-gcm", "aes-256-gcm"
+	Password string `yaml:"password" json:"password"`
+
+	// Server pins connections to one tunnel by name; by default they
+	// follow the mixed port's selection
+	Server string `yaml:"server,omitempty" json:"server,omitempty"`
+}
+
+// validateShadowsocks checks the Shadowsocks inbound block
+func validateShadowsocks(config *Config) error {
+	ss := config.Shadowsocks
+	if !ss.Enabled {
+		return nil
+	}
+
+	if ss.Port < 1 || ss.Port > 65535 {
+		return fmt.Errorf("shadowsocks port must be between 1 and 65535")
+	}
+	if ss.Port == config.MixedPort {
+		return fmt.Errorf("shadowsocks port %d is already used by mixed_port", ss.Port)
+	}
+	switch ss.Method {
+	case "chacha20-ietf-poly1305", "aes-128-gcm", "aes-256-gcm":
+	default:
+		return fmt.Errorf("unsupported shadowsocks method: %s (supported: chacha20-ietf-poly1305, aes-128-gcm, aes-256-gcm)", ss.Method)
+	}
+	if ss.Password == "" {
+		return fmt.Errorf("shadowsocks password is required")
+	}
+
+	pinned := ss.Server == ""
+	for i, server := range config.Servers {
+		if server.Enabled && server.LocalPort == ss.Port {
+			return fmt.Errorf("server %d: local_port %d is already used by shadowsocks", i, server.LocalPort)
+		}
+		if server.Name == ss.Server {
+			if !server.Enabled {
+				return fmt.Errorf("shadowsocks server %s is disabled", ss.Server)
+			}
+			pinned = true
+		}
+	}
+	if !pinned {
+		return fmt.Errorf("shadowsocks server %s does not exist", ss.Server)
+	}
+	return nil
+}
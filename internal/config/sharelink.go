@@ -0,0 +1,266 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ParseShareLink turns a vless://, vmess://, trojan:// or tuic:// share
+// link, as exported by v2rayN, Xray and most server panels, into a server
+// entry. The link's name (the #fragment, or ps for vmess) becomes the
+// server name, falling back to the transport and host.
+func ParseShareLink(link string) (*Server, error) {
+	link = strings.TrimSpace(link)
+	scheme, _, found := strings.Cut(link, "://")
+	if !found {
+		return nil, fmt.Errorf("not a share link: missing scheme")
+	}
+
+	var server *Server
+	var err error
+	switch strings.ToLower(scheme) {
+	case "vmess":
+		server, err = parseVMessLink(link[len(scheme)+3:])
+	case "vless":
+		server, err = parseURLLink(link, TransportVLESS)
+	case "trojan":
+		server, err = parseURLLink(link, TransportTrojan)
+	case "tuic":
+		server, err = parseURLLink(link, TransportTUIC)
+	default:
+		return nil, fmt.Errorf("unsupported share link scheme: %s (supported: vmess, vless, trojan, tuic)", scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if server.Name == "" {
+		server.Name = string(server.Transport) + "-" + server.Host
+	}
+	if server.V2Ray != nil && server.V2Ray.Network == "kcp" {
+		server.Exec = &ExecConfig{} // mKCP only runs through Xray
+	}
+	server.Proxy = ProxySOCKS5
+	server.Enabled = true
+	return server, nil
+}
+
+// vmessLink is the v2rayN vmess:// payload. Panels write the port and
+// alter ID as strings or numbers, so those are decoded loosely.
+type vmessLink struct {
+	Name     string      `json:"ps"`
+	Address  string      `json:"add"`
+	Port     json.Number `json:"port"`
+	ID       string      `json:"id"`
+	AlterID  json.Number `json:"aid"`
+	Security string      `json:"scy"`
+	Network  string      `json:"net"`
+	Type     string      `json:"type"` // Header type
+	Host     string      `json:"host"`
+	Path     string      `json:"path"`
+	TLS      string      `json:"tls"`
+	SNI      string      `json:"sni"`
+}
+
+// parseVMessLink decodes the base64 JSON payload of a vmess:// link
+func parseVMessLink(payload string) (*Server, error) {
+	data, err := decodeLinkBase64(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vmess link: %v", err)
+	}
+
+	var v vmessLink
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid vmess link: %v", err)
+	}
+	if v.ID == "" {
+		return nil, fmt.Errorf("invalid vmess link: missing id")
+	}
+	port, err := linkPort(v.Port.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid vmess link: %v", err)
+	}
+	host, err := linkHost(v.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vmess link: %v", err)
+	}
+
+	v2ray := &V2RayConfig{
+		UUID:       v.ID,
+		Security:   v.Security,
+		Network:    v.Network,
+		HeaderType: v.Type,
+		Path:       v.Path,
+		Host:       v.Host,
+		SNI:        v.SNI,
+	}
+	if v.AlterID != "" {
+		aid, err := strconv.Atoi(v.AlterID.String())
+		if err != nil || aid < 0 {
+			return nil, fmt.Errorf("invalid vmess link: bad aid %q", v.AlterID)
+		}
+		v2ray.AlterID = aid
+	}
+	if v.TLS == "tls" {
+		v2ray.TLS = "tls"
+	}
+	if err := linkNetwork(v2ray, v.Path); err != nil {
+		return nil, fmt.Errorf("invalid vmess link: %v", err)
+	}
+
+	return &Server{
+		Name:      v.Name,
+		Host:      host,
+		Port:      port,
+		Transport: TransportVMess,
+		V2Ray:     v2ray,
+	}, nil
+}
+
+// parseURLLink parses the scheme://credentials@host:port?params#name
+// links of VLESS, Trojan and TUIC
+func parseURLLink(link string, transport TransportType) (*Server, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s link: %v", transport, err)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("invalid %s link: missing credentials", transport)
+	}
+	host, err := linkHost(u.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s link: %v", transport, err)
+	}
+	port, err := linkPort(u.Port())
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s link: %v", transport, err)
+	}
+
+	query := u.Query()
+	server := &Server{
+		Name:      u.Fragment,
+		Host:      host,
+		Port:      port,
+		Transport: transport,
+	}
+	server.InsecureSkipVerify = query.Get("allowInsecure") == "1" || query.Get("insecure") == "1"
+
+	switch transport {
+	case TransportTrojan:
+		server.Password = u.User.Username()
+
+	case TransportTUIC:
+		password, _ := u.User.Password()
+		if password == "" {
+			return nil, fmt.Errorf("invalid tuic link: missing password")
+		}
+		server.TUIC = &TUICConfig{
+			UUID:              u.User.Username(),
+			Password:          password,
+			CongestionControl: query.Get("congestion_control"),
+			UDPRelayMode:      query.Get("udp_relay_mode"),
+			SNI:               query.Get("sni"),
+		}
+		if alpn := query.Get("alpn"); alpn != "" {
+			server.TUIC.ALPN = strings.Split(alpn, ",")
+		}
+
+	case TransportVLESS:
+		v2ray := &V2RayConfig{
+			UUID:       u.User.Username(),
+			Network:    query.Get("type"),
+			HeaderType: query.Get("headerType"),
+			Path:       query.Get("path"),
+			Host:       query.Get("host"),
+			SNI:        query.Get("sni"),
+		}
+		switch security := query.Get("security"); security {
+		case "", "none":
+		case "tls":
+			v2ray.TLS = "tls"
+		default:
+			return nil, fmt.Errorf("invalid vless link: unsupported security %q", security)
+		}
+		if v2ray.Network == "grpc" {
+			v2ray.Path = query.Get("serviceName")
+		}
+		if err := linkNetwork(v2ray, query.Get("seed")); err != nil {
+			return nil, fmt.Errorf("invalid vless link: %v", err)
+		}
+		if v2ray.Network == "grpc" {
+			v2ray.GRPC.MultiMode = query.Get("mode") == "multi"
+		}
+		server.V2Ray = v2ray
+	}
+
+	return server, nil
+}
+
+// linkNetwork checks the V2Ray network of a share link and fills in the
+// per-network settings. Links carry the grpc service name in the path,
+// and the kcp seed is passed separately.
+func linkNetwork(v2ray *V2RayConfig, seed string) error {
+	switch v2ray.Network {
+	case "", "tcp":
+		v2ray.Network = "tcp"
+	case "ws":
+		if v2ray.Path != "" && !strings.HasPrefix(v2ray.Path, "/") {
+			v2ray.Path = "/" + v2ray.Path
+		}
+	case "grpc":
+		if v2ray.Path == "" {
+			return fmt.Errorf("grpc link without a service name")
+		}
+		v2ray.GRPC = &GRPCConfig{ServiceName: v2ray.Path}
+		v2ray.Path = ""
+	case "kcp":
+		v2ray.KCP = &KCPConfig{Seed: seed}
+		v2ray.Path = ""
+	default:
+		return fmt.Errorf("unsupported network %q", v2ray.Network)
+	}
+	return nil
+}
+
+// linkHost checks the server address of a share link
+func linkHost(host string) (string, error) {
+	if host == "" {
+		return "", fmt.Errorf("missing host")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	for _, r := range host {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == '_') {
+			return "", fmt.Errorf("invalid host %q", host)
+		}
+	}
+	return host, nil
+}
+
+// linkPort checks the server port of a share link
+func linkPort(port string) (string, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return strconv.Itoa(n), nil
+}
+
+// decodeLinkBase64 decodes the payload of a base64 share link, which
+// panels write padded or not, with the standard or URL alphabet
+func decodeLinkBase64(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
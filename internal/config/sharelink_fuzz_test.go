@@ -0,0 +1,74 @@
+package config
+
+import (
+	"encoding/base64"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// FuzzParseShareLink feeds arbitrary links to the importer. A link that
+// parses must give a named server with a usable address and the settings
+// its transport needs.
+func FuzzParseShareLink(f *testing.F) {
+	vmess := `{"v":"2","ps":"vm","add":"1.2.3.4","port":"443","id":"abc","aid":"0","net":"ws","path":"/ws","tls":"tls"}`
+	seeds := []string{
+		"vless://0e6f2c5a-1111-2222-3333-444455556666@cdn.example.com:443?type=ws&security=tls&sni=a.example.com&host=a.example.com&path=%2Fws#CDN",
+		"vless://id@[2001:db8::1]:8443?type=grpc&serviceName=svc&mode=multi&security=tls",
+		"vless://id@k.example.com:4000?type=kcp&headerType=wechat-video&seed=s",
+		"vless://id@r.example.com:443?security=reality",
+		"vmess://" + base64.StdEncoding.EncodeToString([]byte(vmess)),
+		"vmess://" + base64.RawURLEncoding.EncodeToString([]byte(`{"add":"h","port":443,"id":"x","aid":1,"net":"kcp","path":"seed"}`)),
+		"vmess://not-base64!",
+		"trojan://secret@tr.example.com:443?allowInsecure=1#Relay",
+		"tuic://uuid:pw@t.example.com:8443?congestion_control=bbr&alpn=h3,h3-29&udp_relay_mode=native",
+		"tuic://uuid@t.example.com:8443",
+		"ss://YWVzLTI1Ni1nY206cGFzcw@h:8388",
+		"vless://@:0",
+		"://",
+		"",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, link string) {
+		server, err := ParseShareLink(link)
+		if err != nil {
+			return
+		}
+
+		if server.Name == "" || server.Host == "" {
+			t.Fatalf("server without name or host: %+v", server)
+		}
+		if port, err := strconv.Atoi(server.Port); err != nil || port < 1 || port > 65535 {
+			t.Fatalf("invalid port %q", server.Port)
+		}
+		if _, _, err := net.SplitHostPort(net.JoinHostPort(server.Host, server.Port)); err != nil {
+			t.Fatalf("unusable address %s:%s: %v", server.Host, server.Port, err)
+		}
+
+		switch server.Transport {
+		case TransportVLESS, TransportVMess:
+			if server.V2Ray == nil || server.V2Ray.UUID == "" {
+				t.Fatalf("%s server without a UUID", server.Transport)
+			}
+			if server.V2Ray.Network == "grpc" && (server.V2Ray.GRPC == nil || server.V2Ray.GRPC.ServiceName == "") {
+				t.Fatalf("grpc server without a service name")
+			}
+			if server.V2Ray.Network == "kcp" && server.V2Ray.KCP == nil {
+				t.Fatalf("kcp server without kcp settings")
+			}
+		case TransportTrojan:
+			if server.Password == "" {
+				t.Fatalf("trojan server without a password")
+			}
+		case TransportTUIC:
+			if server.TUIC == nil || server.TUIC.UUID == "" || server.TUIC.Password == "" {
+				t.Fatalf("tuic server without credentials")
+			}
+		default:
+			t.Fatalf("unexpected transport %q", server.Transport)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TagPrefix marks a server reference as a tag: "tag:eu" targets every
+// server tagged "eu"
+const TagPrefix = "tag:"
+
+// HasTag reports whether the server carries a tag
+func (s *Server) HasTag(tag string) bool {
+	for _, t := range s.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesTarget reports whether a server reference, a server name or
+// "tag:<tag>", covers the server
+func (s *Server) MatchesTarget(target string) bool {
+	if tag, ok := strings.CutPrefix(target, TagPrefix); ok {
+		return s.HasTag(tag)
+	}
+	return s.Name == target
+}
+
+// InSelection reports whether auto-selection may pick the server
+func (c *Config) InSelection(server *Server) bool {
+	if len(c.AutoSelectTags) == 0 {
+		return true
+	}
+	for _, tag := range c.AutoSelectTags {
+		if server.HasTag(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTags checks that routing rules and auto_select_tags refer to
+// configured servers
+func validateTags(config *Config) error {
+	covered := func(target string) bool {
+		for i := range config.Servers {
+			if config.Servers[i].MatchesTarget(target) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i, rule := range config.Routing {
+		if rule.Server == "" {
+			continue
+		}
+		if rule.Server == TagPrefix {
+			return fmt.Errorf("routing rule %d: empty tag", i)
+		}
+		if !covered(rule.Server) {
+			return fmt.Errorf("routing rule %d: no server matches %s", i, rule.Server)
+		}
+	}
+
+	for _, tag := range config.AutoSelectTags {
+		if !covered(TagPrefix + tag) {
+			return fmt.Errorf("auto_select_tags: no server is tagged %s", tag)
+		}
+	}
+	return nil
+}
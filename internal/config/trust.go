@@ -0,0 +1,223 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultKnownHosts is where SSH host keys are looked up for servers that
+// set neither host_key nor known_hosts
+const DefaultKnownHosts = "~/.ssh/known_hosts"
+
+// validateTrust checks how a server's identity is verified. Every setting
+// that skips verification needs insecure_skip_verify: true on the server,
+// so no server is left unverified by accident.
+func validateTrust(i int, server *Server) error {
+	if server.HostKey != "" {
+		if _, err := parseHostKey(server.HostKey); err != nil {
+			return fmt.Errorf("server %d: %v", i, err)
+		}
+		if server.Engine == EngineOpenSSH {
+			return fmt.Errorf("server %d: host_key is not supported with engine openssh, use known_hosts", i)
+		}
+	}
+	if server.InsecureSkipVerify {
+		if server.HostKey != "" || server.KnownHosts != "" {
+			return fmt.Errorf("server %d: insecure_skip_verify cannot be combined with host_key or known_hosts", i)
+		}
+		return nil
+	}
+
+	var setting string
+	switch {
+	case server.Exec != nil && server.Exec.Insecure:
+		setting = "exec insecure"
+	case server.Obfuscation != nil && server.Obfuscation.Insecure:
+		setting = "obfuscation insecure"
+	case server.OpenSSH != nil:
+		for name, value := range server.OpenSSH.Options {
+			if insecureOpenSSHOption(name, value) {
+				setting = "openssh option " + name + "=" + value
+			}
+		}
+	}
+	if setting != "" {
+		return fmt.Errorf("server %d: %s skips verification of the server and requires insecure_skip_verify: true", i, setting)
+	}
+	return nil
+}
+
+// insecureOpenSSHOption reports whether an ssh option turns host key
+// checking off or trusts unknown hosts
+func insecureOpenSSHOption(name, value string) bool {
+	value = strings.ToLower(value)
+	switch strings.ToLower(name) {
+	case "stricthostkeychecking":
+		return value == "no" || value == "off" || value == "accept-new"
+	case "userknownhostsfile", "globalknownhostsfile":
+		return value == "/dev/null" || value == "none"
+	}
+	return false
+}
+
+// hostKeyPin is a pinned SSH host key: a public key, or only its SHA256
+// fingerprint
+type hostKeyPin struct {
+	key         ssh.PublicKey
+	fingerprint string
+}
+
+// parseHostKey parses host_key: "SHA256:..." as printed by ssh-keygen -l,
+// or a public key line as found in ssh_host_*_key.pub
+func parseHostKey(value string) (*hostKeyPin, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "SHA256:") {
+		if len(value) != len("SHA256:")+43 {
+			return nil, fmt.Errorf("invalid host_key fingerprint %s", value)
+		}
+		return &hostKeyPin{fingerprint: value}, nil
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid host_key, expected a SHA256 fingerprint or a public key: %v", err)
+	}
+	return &hostKeyPin{key: key, fingerprint: ssh.FingerprintSHA256(key)}, nil
+}
+
+func (p *hostKeyPin) matches(key ssh.PublicKey) bool {
+	if p.key != nil {
+		return bytes.Equal(p.key.Marshal(), key.Marshal())
+	}
+	return ssh.FingerprintSHA256(key) == p.fingerprint
+}
+
+// HostKeyCallback returns how a server's SSH host key is verified: against
+// host_key, or against known_hosts (~/.ssh/known_hosts by default). It
+// also returns the host key algorithms to ask the server for, so it
+// presents the key on record rather than another one. Only
+// insecure_skip_verify accepts any key.
+func HostKeyCallback(server Server) (ssh.HostKeyCallback, []string, error) {
+	if server.InsecureSkipVerify {
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+
+	if server.HostKey != "" {
+		pin, err := parseHostKey(server.HostKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		var algorithms []string
+		if pin.key != nil {
+			algorithms = hostKeyAlgorithms(pin.key.Type())
+		}
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if !pin.matches(key) {
+				// A fingerprint does not say which of its keys the server
+				// should present, so the server may have shown another one
+				return fmt.Errorf("host key mismatch for %s: the server presented %s %s but host_key is %s, the connection may be intercepted",
+					hostname, key.Type(), ssh.FingerprintSHA256(key), pin.fingerprint)
+			}
+			return nil
+		}, algorithms, nil
+	}
+
+	path := server.KnownHosts
+	if path == "" {
+		path = DefaultKnownHosts
+	}
+	path = expandHome(path)
+	check, err := knownhosts.New(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, fmt.Errorf("failed to load known hosts %s: %v", path, err)
+		}
+		check = func(string, net.Addr, ssh.PublicKey) error { return &knownhosts.KeyError{} }
+	}
+
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		// Keys are looked up by the name dialed; the remote address may be
+		// an obfuscation layer's or the ICMP tunnel's
+		err := check(hostname, knownHostAddr(hostname), key)
+		var keyErr *knownhosts.KeyError
+		switch {
+		case err == nil:
+			return nil
+		case errors.As(err, &keyErr) && len(keyErr.Want) == 0:
+			return &UnknownHostKeyError{Host: hostname, Key: key, KnownHosts: path}
+		case errors.As(err, &keyErr):
+			return fmt.Errorf("host key mismatch for %s: the server presented %s, which %s does not list, the connection may be intercepted",
+				hostname, ssh.FingerprintSHA256(key), path)
+		default:
+			return fmt.Errorf("host key of %s rejected: %v", hostname, err)
+		}
+	}
+	return callback, knownAlgorithms(check, net.JoinHostPort(server.Host, server.Port)), nil
+}
+
+// UnknownHostKeyError is returned for a server known_hosts does not list
+type UnknownHostKeyError struct {
+	Host       string
+	Key        ssh.PublicKey // The key the server presented
+	KnownHosts string
+}
+
+func (e *UnknownHostKeyError) Error() string {
+	return fmt.Sprintf("host key of %s is unknown (%s): add it to %s or set host_key: %q",
+		e.Host, ssh.FingerprintSHA256(e.Key), e.KnownHosts, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(e.Key))))
+}
+
+// knownAlgorithms returns the types of the keys known_hosts lists for
+// address, by looking up a key it cannot list
+func knownAlgorithms(check ssh.HostKeyCallback, address string) []string {
+	var keyErr *knownhosts.KeyError
+	if err := check(address, knownHostAddr(address), probeKey{}); !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		algorithms = append(algorithms, hostKeyAlgorithms(known.Key.Type())...)
+	}
+	return algorithms
+}
+
+// hostKeyAlgorithms returns the signature algorithms a key type is
+// presented with
+func hostKeyAlgorithms(keyType string) []string {
+	switch keyType {
+	case ssh.KeyAlgoRSA:
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	case ssh.CertAlgoRSAv01:
+		return []string{ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01}
+	}
+	return []string{keyType}
+}
+
+// knownHostAddr is the remote address handed to known_hosts lookups
+type knownHostAddr string
+
+func (a knownHostAddr) Network() string { return "tcp" }
+func (a knownHostAddr) String() string  { return string(a) }
+
+// probeKey is a key no known_hosts file lists
+type probeKey struct{}
+
+func (probeKey) Type() string                        { return "probe" }
+func (probeKey) Marshal() []byte                     { return []byte("probe") }
+func (probeKey) Verify([]byte, *ssh.Signature) error { return errors.New("probe key") }
+
+// expandHome expands a leading "~/" to the home directory
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return home + path[1:]
+		}
+	}
+	return path
+}
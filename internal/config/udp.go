@@ -0,0 +1,96 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UDPConfig relays UDP through a tunnel, for DNS, WireGuard over the
+// tunnel or games. SOCKS5 clients of the local port can then use UDP
+// ASSOCIATE, and Forwards serve fixed destinations on local UDP ports. SSH
+// servers need the relay helper installed (`tunnel udp-relay`); exec
+// clients relay UDP themselves.
+type UDPConfig struct {
+	Relay    string        `yaml:"relay,omitempty" json:"relay,omitempty"`       // SSH only: helper command run on the server
+	Forwards []string      `yaml:"forwards,omitempty" json:"forwards,omitempty"` // "local_port:host:port", e.g. "5353:1.1.1.1:53"
+	Timeout  time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`   // Idle time before a relayed flow is closed
+}
+
+// DefaultUDPRelay is the helper command SSH servers run to relay UDP
+const DefaultUDPRelay = "tunnel udp-relay"
+
+// UDPForward is a local UDP port relayed to a fixed destination
+type UDPForward struct {
+	LocalPort int
+	Target    string
+}
+
+// ParseUDPForward parses a "local_port:host:port" forward; IPv6 hosts go
+// in brackets
+func ParseUDPForward(s string) (UDPForward, error) {
+	local, target, ok := strings.Cut(s, ":")
+	if !ok {
+		return UDPForward{}, fmt.Errorf("invalid udp forward %q (use local_port:host:port)", s)
+	}
+	port, err := strconv.Atoi(local)
+	if err != nil || port < 1 || port > 65535 {
+		return UDPForward{}, fmt.Errorf("invalid local port in udp forward %q", s)
+	}
+	host, targetPort, err := net.SplitHostPort(target)
+	if err != nil || host == "" {
+		return UDPForward{}, fmt.Errorf("invalid target in udp forward %q (use local_port:host:port)", s)
+	}
+	if p, err := strconv.Atoi(targetPort); err != nil || p < 1 || p > 65535 {
+		return UDPForward{}, fmt.Errorf("invalid target port in udp forward %q", s)
+	}
+	return UDPForward{LocalPort: port, Target: target}, nil
+}
+
+// validateUDP checks a server's UDP relay settings. Local ports of forwards
+// must not be shared with another enabled server.
+func validateUDP(i int, server *Server, servers []Server) error {
+	switch {
+	case server.Exec != nil:
+		if len(server.UDP.Forwards) > 0 && server.Proxy != ProxySOCKS5 {
+			return fmt.Errorf("server %d: udp forwards with exec clients need proxy socks5", i)
+		}
+	case server.Transport == TransportSSH:
+		if len(server.Chain) > 0 {
+			return fmt.Errorf("server %d: udp relay is not supported through chains", i)
+		}
+		if strings.TrimSpace(server.UDP.Relay) == "" {
+			return fmt.Errorf("server %d: udp relay command is required", i)
+		}
+	case server.Transport == TransportTUIC:
+		// Relayed as TUIC packets
+	default:
+		return fmt.Errorf("server %d: udp relay is only supported for ssh and tuic transports and exec clients", i)
+	}
+
+	ports := make(map[int]bool)
+	for _, spec := range server.UDP.Forwards {
+		forward, err := ParseUDPForward(spec)
+		if err != nil {
+			return fmt.Errorf("server %d: %v", i, err)
+		}
+		if ports[forward.LocalPort] {
+			return fmt.Errorf("server %d: udp port %d is forwarded twice", i, forward.LocalPort)
+		}
+		ports[forward.LocalPort] = true
+	}
+
+	for _, other := range servers {
+		if other.Name == server.Name || !other.Enabled || other.UDP == nil {
+			continue
+		}
+		for _, spec := range other.UDP.Forwards {
+			if forward, err := ParseUDPForward(spec); err == nil && ports[forward.LocalPort] {
+				return fmt.Errorf("server %d: udp port %d is already forwarded by %s", i, forward.LocalPort, other.Name)
+			}
+		}
+	}
+	return nil
+}
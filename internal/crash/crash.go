@@ -0,0 +1,232 @@
+// Package crash recovers panics in long-running subsystems, writes a crash
+// report for each and lets the subsystem restart instead of the panic
+// killing the daemon.
+package crash
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+// Restart backoff for supervised subsystems
+const (
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+)
+
+// collectTimeout bounds how long the owner's state is collected for a
+// report; the panic may have left a lock held
+const collectTimeout = 2 * time.Second
+
+// Report is what is known about a recovered panic
+type Report struct {
+	Time       time.Time       `json:"time"`
+	Subsystem  string          `json:"subsystem"`
+	Panic      string          `json:"panic"`
+	Stack      string          `json:"stack"`
+	Goroutines int             `json:"goroutines"`
+	Version    string          `json:"version,omitempty"`
+	GoVersion  string          `json:"go_version"`
+	Config     interface{}     `json:"config,omitempty"` // Sanitized
+	Events     interface{}     `json:"events,omitempty"` // Recent events and log entries
+	Tunnels    json.RawMessage `json:"tunnels,omitempty"`
+	Path       string          `json:"-"` // Where the report was written; empty if it could not be
+}
+
+// Handler attaches the owner's state to reports and is told about each
+// crash once its report is written. Both may be nil.
+type Handler struct {
+	Version string
+	Collect func(r *Report)
+	Notify  func(r Report)
+}
+
+var (
+	mu      sync.Mutex
+	cfg     config.CrashConfig
+	handler Handler
+	count   int
+)
+
+// Configure sets where reports are written and the owner's handler
+func Configure(crashCfg config.CrashConfig, h Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+	cfg = crashCfg
+	handler = h
+}
+
+// Count returns how many panics were recovered since the process started
+func Count() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return count
+}
+
+// PanicError is a panic recovered by Catch
+type PanicError struct {
+	Subsystem string
+	Value     interface{}
+	Report    string // Path of the crash report
+}
+
+func (e *PanicError) Error() string {
+	if e.Report == "" {
+		return fmt.Sprintf("%s panicked: %v", e.Subsystem, e.Value)
+	}
+	return fmt.Sprintf("%s panicked: %v (crash report %s)", e.Subsystem, e.Value, e.Report)
+}
+
+// Recover reports a panic in subsystem and stops it there; it must be
+// deferred directly. The goroutine it was deferred in returns normally.
+func Recover(subsystem string) {
+	if value := recover(); value != nil {
+		handle(subsystem, value, debug.Stack())
+	}
+}
+
+// Go runs fn in a new goroutine, recovering a panic in it
+func Go(subsystem string, fn func()) {
+	go func() {
+		defer Recover(subsystem)
+		fn()
+	}()
+}
+
+// Catch runs fn and returns a panic in it as a *PanicError, so the caller
+// can handle it like any other failure
+func Catch(subsystem string, fn func() error) (err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			path := handle(subsystem, value, debug.Stack())
+			err = &PanicError{Subsystem: subsystem, Value: value, Report: path}
+		}
+	}()
+	return fn()
+}
+
+// Supervise runs fn until it returns, restarting it with backoff whenever
+// it panics, until ctx is done
+func Supervise(ctx context.Context, subsystem string, fn func()) {
+	delay := minRestartDelay
+	for {
+		err := Catch(subsystem, func() error {
+			fn()
+			return nil
+		})
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("🔁 Restarting %s in %v", subsystem, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxRestartDelay)
+	}
+}
+
+// handle writes the report of a recovered panic and notifies the owner,
+// returning the report's path
+func handle(subsystem string, value interface{}, stack []byte) string {
+	mu.Lock()
+	count++
+	crashCfg, h := cfg, handler
+	mu.Unlock()
+
+	report := Report{
+		Time:       time.Now(),
+		Subsystem:  subsystem,
+		Panic:      fmt.Sprint(value),
+		Stack:      string(stack),
+		Goroutines: runtime.NumGoroutine(),
+		Version:    h.Version,
+		GoVersion:  runtime.Version(),
+	}
+	log.Printf("💥 Panic in %s: %v", subsystem, value)
+
+	if h.Collect != nil {
+		collected := report
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer func() { recover() }() // A crash report must not crash
+			h.Collect(&collected)
+		}()
+		select {
+		case <-done:
+			report = collected
+		case <-time.After(collectTimeout):
+			log.Printf("⚠️  Crash report of %s written without state: collecting it timed out", subsystem)
+		}
+	}
+
+	path, err := write(crashCfg, report)
+	if err != nil {
+		log.Printf("⚠️  Failed to write crash report: %v\n%s", err, stack)
+	} else {
+		report.Path = path
+		log.Printf("📝 Crash report written to %s", path)
+	}
+
+	if h.Notify != nil {
+		func() {
+			defer func() { recover() }()
+			h.Notify(report)
+		}()
+	}
+	return report.Path
+}
+
+// unsafeName matches what is replaced in a subsystem's file name
+var unsafeName = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// write saves a report and removes the oldest beyond the kept number
+func write(crashCfg config.CrashConfig, report Report) (string, error) {
+	dir := crashCfg.Dir
+	if dir == "" {
+		dir = config.DefaultCrashDir
+	}
+	keep := crashCfg.Keep
+	if keep == 0 {
+		keep = config.DefaultCrashKeep
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal crash report: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create crash report directory: %v", err)
+	}
+
+	name := fmt.Sprintf("crash-%s-%s.json", report.Time.Format("20060102-150405.000"),
+		strings.Trim(unsafeName.ReplaceAllString(report.Subsystem, "-"), "-"))
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", fmt.Errorf("failed to write crash report: %v", err)
+	}
+
+	if old, err := filepath.Glob(filepath.Join(dir, "crash-*.json")); err == nil && len(old) > keep {
+		sort.Strings(old) // Oldest first, by the time in the name
+		for _, file := range old[:len(old)-keep] {
+			os.Remove(file)
+		}
+	}
+	return path, nil
+}
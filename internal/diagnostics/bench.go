@@ -0,0 +1,435 @@
+package diagnostics
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"ssh-tunnel/internal/udprelay"
+)
+
+// BenchPort is where autodiscovery runs the speed helper on servers, bound
+// to loopback so only tunnels ending on the server reach it
+const BenchPort = 5201
+
+// Speed helper commands, sent as the first byte of a TCP connection
+const (
+	benchUpload      = 'U' // Client sends a length, then that many bytes; helper acknowledges with the count
+	benchDownload    = 'D' // Client sends a length; helper sends that many bytes
+	benchEcho        = 'E' // Helper echoes everything back
+	benchStream      = 'S' // Client sends U or D and a test ID; helper sinks or sends until the connection closes
+	benchRetransmits = 'R' // Client sends a test ID; helper answers with its retransmits on the test's streams
+)
+
+const benchProbeSize = 16 // Sequence number and send time
+
+// BenchOptions controls a benchmark run
+type BenchOptions struct {
+	Bytes        int64         // Transferred in each direction
+	Probes       int           // Latency probes for jitter and loss
+	Interval     time.Duration // Between probes
+	ProbeTimeout time.Duration // A probe unanswered this long is lost
+	Timeout      time.Duration // Limit for each transfer
+}
+
+// BenchResult holds the outcome of a benchmark through a tunnel
+type BenchResult struct {
+	Server       string        `json:"server"`
+	Protocol     string        `json:"protocol"`
+	Target       string        `json:"target"`
+	Bytes        int64         `json:"bytes"`
+	UploadMbps   float64       `json:"upload_mbps"`
+	DownloadMbps float64       `json:"download_mbps"`
+	AvgRTT       time.Duration `json:"avg_rtt"`
+	Jitter       time.Duration `json:"jitter"`
+	Loss         float64       `json:"loss"`          // Percent of probes unanswered
+	ProbeNetwork string        `json:"probe_network"` // "udp" through the UDP relay, else "tcp"
+}
+
+// RunBench measures throughput to the speed helper at target, then sends
+// latency probes over UDP when packets is set, or over TCP otherwise
+func RunBench(dial func(network, addr string) (net.Conn, error), packets func() (net.PacketConn, error), target string, opts BenchOptions) (*BenchResult, error) {
+	if opts.Bytes <= 0 {
+		opts.Bytes = 32 << 20
+	}
+	if opts.Probes <= 0 {
+		opts.Probes = 50
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 100 * time.Millisecond
+	}
+	if opts.ProbeTimeout <= 0 {
+		opts.ProbeTimeout = 2 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2 * time.Minute
+	}
+
+	result := &BenchResult{Target: target, Bytes: opts.Bytes}
+
+	elapsed, err := benchTransfer(dial, target, benchUpload, opts)
+	if err != nil {
+		return nil, fmt.Errorf("upload failed: %v", err)
+	}
+	result.UploadMbps = toMbps(uint64(opts.Bytes), elapsed)
+
+	elapsed, err = benchTransfer(dial, target, benchDownload, opts)
+	if err != nil {
+		return nil, fmt.Errorf("download failed: %v", err)
+	}
+	result.DownloadMbps = toMbps(uint64(opts.Bytes), elapsed)
+
+	var conn io.ReadWriteCloser
+	var send func([]byte) error
+	if packets != nil {
+		pc, err := packets()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open UDP relay: %v", err)
+		}
+		conn = packetStream{pc}
+		send = func(probe []byte) error {
+			_, err := pc.WriteTo(probe, udprelay.Addr(target))
+			return err
+		}
+		result.ProbeNetwork = "udp"
+	} else {
+		c, err := dial("tcp", target)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.Write([]byte{benchEcho}); err != nil {
+			c.Close()
+			return nil, err
+		}
+		conn = c
+		send = func(probe []byte) error {
+			_, err := c.Write(probe)
+			return err
+		}
+		result.ProbeNetwork = "tcp"
+	}
+
+	rtts, lost := benchProbes(conn, send, opts)
+	result.AvgRTT, result.Jitter = rttStats(rtts)
+	result.Loss = 100 * float64(lost) / float64(opts.Probes)
+	return result, nil
+}
+
+// benchTransfer moves opts.Bytes in one direction and returns how long
+// the helper took to receive or send them
+func benchTransfer(dial func(network, addr string) (net.Conn, error), target string, command byte, opts BenchOptions) (time.Duration, error) {
+	conn, err := dial("tcp", target)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// Tunnel connections do not all honour deadlines
+	timer := time.AfterFunc(opts.Timeout, func() { conn.Close() })
+	defer timer.Stop()
+
+	request := make([]byte, 9)
+	request[0] = command
+	binary.BigEndian.PutUint64(request[1:], uint64(opts.Bytes))
+
+	start := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+
+	switch command {
+	case benchUpload:
+		if _, err := io.CopyN(conn, benchSource(), opts.Bytes); err != nil {
+			return 0, err
+		}
+		ack := make([]byte, 8)
+		if _, err := io.ReadFull(conn, ack); err != nil {
+			return 0, fmt.Errorf("no acknowledgement from speed helper at %s: %v", target, err)
+		}
+		if n := int64(binary.BigEndian.Uint64(ack)); n != opts.Bytes {
+			return 0, fmt.Errorf("speed helper received %d of %d bytes", n, opts.Bytes)
+		}
+	case benchDownload:
+		n, err := io.CopyN(io.Discard, conn, opts.Bytes)
+		if err != nil {
+			return 0, fmt.Errorf("received %d of %d bytes: %v", n, opts.Bytes, err)
+		}
+	}
+	return time.Since(start), nil
+}
+
+// benchProbes sends sequence-numbered probes and matches the echoes. It
+// returns the RTTs of answered probes in order, and how many were lost.
+func benchProbes(conn io.ReadWriteCloser, send func([]byte) error, opts BenchOptions) ([]time.Duration, int) {
+	var mu sync.Mutex
+	rtts := make([]time.Duration, opts.Probes)
+	answered := make([]bool, opts.Probes)
+	start := time.Now()
+
+	go func() {
+		buf := make([]byte, benchProbeSize)
+		for {
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return
+			}
+			seq := binary.BigEndian.Uint64(buf)
+			sent := time.Duration(binary.BigEndian.Uint64(buf[8:]))
+			rtt := time.Since(start) - sent
+
+			mu.Lock()
+			if seq < uint64(opts.Probes) && !answered[seq] && rtt <= opts.ProbeTimeout {
+				rtts[seq] = rtt
+				answered[seq] = true
+			}
+			mu.Unlock()
+		}
+	}()
+
+	probe := make([]byte, benchProbeSize)
+	for seq := 0; seq < opts.Probes; seq++ {
+		binary.BigEndian.PutUint64(probe, uint64(seq))
+		binary.BigEndian.PutUint64(probe[8:], uint64(time.Since(start)))
+		if err := send(probe); err != nil {
+			break
+		}
+		time.Sleep(opts.Interval)
+	}
+	time.Sleep(opts.ProbeTimeout)
+	conn.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	var samples []time.Duration
+	lost := 0
+	for seq := range rtts {
+		if answered[seq] {
+			samples = append(samples, rtts[seq])
+		} else {
+			lost++
+		}
+	}
+	return samples, lost
+}
+
+// packetStream reads datagrams as a stream of whole probes
+type packetStream struct {
+	net.PacketConn
+}
+
+func (p packetStream) Read(b []byte) (int, error) {
+	n, _, err := p.ReadFrom(b)
+	return n, err
+}
+
+func (p packetStream) Write(b []byte) (int, error) {
+	return 0, fmt.Errorf("write on packet stream")
+}
+
+// benchSource returns an endless reader of incompressible data, so tunnels
+// that compress cannot inflate the result
+func benchSource() io.Reader {
+	buf := make([]byte, 64*1024)
+	rand.Read(buf)
+	return &repeatReader{buf: buf}
+}
+
+type repeatReader struct {
+	buf []byte
+	off int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.buf[r.off:])
+	r.off = (r.off + n) % len(r.buf)
+	return n, nil
+}
+
+// ServeBench runs the speed helper on addr over TCP, with a UDP echo on the
+// same port for probes through UDP relays
+func ServeBench(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	defer listener.Close()
+
+	udp, err := net.ListenPacket("udp", listener.Addr().String())
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s/udp: %v", addr, err)
+	}
+	defer udp.Close()
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(buf[:n], from)
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := serveBenchConn(conn); err != nil && err != io.EOF {
+				log.Printf("Speed helper connection from %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func serveBenchConn(conn net.Conn) error {
+	command := make([]byte, 1)
+	if _, err := io.ReadFull(conn, command); err != nil {
+		return err
+	}
+	switch command[0] {
+	case benchEcho:
+		_, err := io.Copy(conn, conn)
+		return err
+	case benchStream:
+		return serveBenchStream(conn)
+	case benchRetransmits:
+		id := make([]byte, 8)
+		if _, err := io.ReadFull(conn, id); err != nil {
+			return err
+		}
+		count := make([]byte, 8)
+		binary.BigEndian.PutUint64(count, uint64(benchTests.retransmits(binary.BigEndian.Uint64(id))))
+		_, err := conn.Write(count)
+		return err
+	}
+
+	length := make([]byte, 8)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return err
+	}
+	n := int64(binary.BigEndian.Uint64(length))
+
+	switch command[0] {
+	case benchUpload:
+		received, err := io.CopyN(io.Discard, conn, n)
+		if err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(length, uint64(received))
+		_, err = conn.Write(length)
+		return err
+	case benchDownload:
+		_, err := io.CopyN(conn, benchSource(), n)
+		return err
+	default:
+		return fmt.Errorf("unknown command %q", command[0])
+	}
+}
+
+// serveBenchStream sinks or sends data until the client closes the
+// connection, counting its retransmits toward the client's test
+func serveBenchStream(conn net.Conn) error {
+	request := make([]byte, 9)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint64(request[1:])
+	benchTests.add(id, conn)
+	defer benchTests.remove(id, conn)
+
+	var err error
+	switch request[0] {
+	case benchUpload:
+		_, err = io.Copy(io.Discard, conn)
+	case benchDownload:
+		_, err = io.Copy(conn, benchSource())
+	default:
+		return fmt.Errorf("unknown stream direction %q", request[0])
+	}
+	// The client ends a stream by closing it
+	if errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
+		return nil
+	}
+	return err
+}
+
+// benchTest holds the streams of one throughput test
+type benchTest struct {
+	streams []net.Conn
+	ended   int64 // Retransmits of streams already closed, -1 when unknown
+}
+
+// benchTestSet tracks the streams of running throughput tests by ID, so
+// retransmits can be reported for one test among several
+type benchTestSet struct {
+	mu    sync.Mutex
+	tests map[uint64]*benchTest
+}
+
+var benchTests = &benchTestSet{tests: make(map[uint64]*benchTest)}
+
+func (s *benchTestSet) add(id uint64, conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	test := s.tests[id]
+	if test == nil {
+		test = &benchTest{}
+		s.tests[id] = test
+	}
+	test.streams = append(test.streams, conn)
+}
+
+// remove records the retransmits of a closing stream, and forgets the
+// test with its last stream
+func (s *benchTestSet) remove(id uint64, conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	test := s.tests[id]
+	if test == nil {
+		return
+	}
+	test.ended = addRetransmits(test.ended, tcpRetransmits(conn))
+	for i, stream := range test.streams {
+		if stream == conn {
+			test.streams = append(test.streams[:i], test.streams[i+1:]...)
+			break
+		}
+	}
+	if len(test.streams) == 0 {
+		delete(s.tests, id)
+	}
+}
+
+// retransmits returns the TCP retransmits of a test's streams on this
+// side, or -1 when they cannot be read
+func (s *benchTestSet) retransmits(id uint64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	test := s.tests[id]
+	if test == nil {
+		return -1
+	}
+	total := test.ended
+	for _, stream := range test.streams {
+		total = addRetransmits(total, tcpRetransmits(stream))
+	}
+	return total
+}
+
+// addRetransmits adds two counts, either of which may be unknown
+func addRetransmits(a, b int64) int64 {
+	if a < 0 || b < 0 {
+		return -1
+	}
+	return a + b
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package diagnostics
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// tcpRetransmits returns the segments a TCP connection has retransmitted,
+// from the kernel's tcpi_total_retrans, or -1 when it cannot be read
+func tcpRetransmits(conn net.Conn) int64 {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return -1
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return -1
+	}
+
+	var info syscall.TCPInfo
+	size := uint32(syscall.SizeofTCPInfo)
+	var errno syscall.Errno
+	if err := raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	}); err != nil || errno != 0 {
+		return -1
+	}
+	return int64(info.Total_retrans)
+}
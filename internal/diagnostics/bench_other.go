@@ -0,0 +1,10 @@
+//go:build !linux
+
+package diagnostics
+
+import "net"
+
+// tcpRetransmits stands in for reading TCP_INFO, which is Linux only
+func tcpRetransmits(conn net.Conn) int64 {
+	return -1
+}
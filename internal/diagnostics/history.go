@@ -0,0 +1,107 @@
+package diagnostics
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultHistoryPath is where diagnostic results are stored when no path is given
+const DefaultHistoryPath = "data/history.jsonl"
+
+// HistoryEntry represents a single stored diagnostic result
+type HistoryEntry struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Kind      string          `json:"kind"` // "throughput", "trace", ...
+	Server    string          `json:"server"`
+	Result    json.RawMessage `json:"result"`
+}
+
+// History stores diagnostic results as JSON lines on disk
+type History struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewHistory creates a new history store
+func NewHistory(path string) *History {
+	if path == "" {
+		path = DefaultHistoryPath
+	}
+	return &History{path: path}
+}
+
+// Append adds a result to the history file
+func (h *History) Append(kind, server string, result interface{}) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %v", err)
+	}
+
+	entry := HistoryEntry{
+		Timestamp: time.Now(),
+		Kind:      kind,
+		Server:    server,
+		Result:    data,
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal history entry: %v", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(h.path), 0755); err != nil {
+		return fmt.Errorf("failed to create history directory: %v", err)
+	}
+
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %v", err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// Load returns all entries of the given kind newer than since.
+// An empty kind matches every entry.
+func (h *History) Load(kind string, since time.Time) ([]HistoryEntry, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open history file: %v", err)
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // Skip corrupted lines
+		}
+		if kind != "" && entry.Kind != kind {
+			continue
+		}
+		if entry.Timestamp.Before(since) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
@@ -0,0 +1,263 @@
+package diagnostics
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+// ProbeResult is a single recorded reachability probe of a server
+type ProbeResult struct {
+	Latency time.Duration `json:"latency"`
+	Up      bool          `json:"up"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// SimulationPolicies are the selection methods the simulator can replay
+var SimulationPolicies = []string{"latency", "throughput", "score", "random"}
+
+// SimulationResult summarizes how a selection policy would have performed
+type SimulationResult struct {
+	Policy     string         `json:"policy"`
+	Rounds     int            `json:"rounds"`
+	Uptime     float64        `json:"uptime"` // Percentage of rounds the selected server was up
+	AvgLatency time.Duration  `json:"avg_latency"`
+	P95Latency time.Duration  `json:"p95_latency"`
+	Switches   int            `json:"switches"`
+	Selections map[string]int `json:"selections"`
+}
+
+// probeRound holds the probes of every server taken in one sweep
+type probeRound struct {
+	timestamp time.Time
+	probes    map[string]ProbeResult
+}
+
+// Simulator replays recorded probe history against selection policies.
+// Each policy picks a server using only what it knew in the previous round
+// and sticks with it until it fails, matching the tunnel manager's
+// auto-select plus failover behaviour.
+type Simulator struct {
+	cfg        *config.Config
+	rounds     []probeRound
+	throughput map[string]float64
+}
+
+// NewSimulator loads probe and throughput history newer than since
+func NewSimulator(cfg *config.Config, history *History, since time.Time) (*Simulator, error) {
+	entries, err := history.Load("probe", since)
+	if err != nil {
+		return nil, err
+	}
+
+	sim := &Simulator{
+		cfg:        cfg,
+		throughput: make(map[string]float64),
+	}
+
+	// Probes from one sweep are written back to back; start a new round
+	// whenever a server repeats or the sweep clearly ended
+	for _, entry := range entries {
+		var probe ProbeResult
+		if err := json.Unmarshal(entry.Result, &probe); err != nil {
+			continue
+		}
+
+		newRound := len(sim.rounds) == 0
+		if !newRound {
+			last := sim.rounds[len(sim.rounds)-1]
+			_, seen := last.probes[entry.Server]
+			newRound = seen || entry.Timestamp.Sub(last.timestamp) > time.Minute
+		}
+		if newRound {
+			sim.rounds = append(sim.rounds, probeRound{timestamp: entry.Timestamp, probes: make(map[string]ProbeResult)})
+		}
+		sim.rounds[len(sim.rounds)-1].probes[entry.Server] = probe
+	}
+
+	throughput, err := history.Load("throughput", since)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range throughput {
+		var result ThroughputResult
+		if err := json.Unmarshal(entry.Result, &result); err == nil {
+			sim.throughput[entry.Server] = result.DownloadMbps
+		}
+	}
+
+	return sim, nil
+}
+
+// Rounds returns the number of probe sweeps available for replay
+func (s *Simulator) Rounds() int {
+	return len(s.rounds)
+}
+
+// Run replays the history with the given policy
+func (s *Simulator) Run(policy string) (*SimulationResult, error) {
+	if !isSimulationPolicy(policy) {
+		return nil, fmt.Errorf("unknown policy: %s (available: %s)", policy, strings.Join(SimulationPolicies, ", "))
+	}
+	if len(s.rounds) < 2 {
+		return nil, fmt.Errorf("not enough probe history to simulate (need at least 2 rounds, have %d)", len(s.rounds))
+	}
+
+	result := &SimulationResult{
+		Policy:     policy,
+		Selections: make(map[string]int),
+	}
+
+	var selected string
+	var latencies []time.Duration
+	for i := 1; i < len(s.rounds); i++ {
+		previous := s.rounds[i-1].probes
+
+		// Re-select only when nothing is selected or the selection failed
+		if probe, ok := previous[selected]; selected == "" || !ok || !probe.Up {
+			if next := s.choose(policy, previous); next != "" && next != selected {
+				if selected != "" {
+					result.Switches++
+				}
+				selected = next
+			}
+		}
+
+		result.Rounds++
+		if selected == "" {
+			continue
+		}
+
+		result.Selections[selected]++
+		if probe, ok := s.rounds[i].probes[selected]; ok && probe.Up {
+			result.Uptime++
+			latencies = append(latencies, probe.Latency)
+		}
+	}
+
+	result.Uptime = result.Uptime / float64(result.Rounds) * 100
+	if len(latencies) > 0 {
+		var total time.Duration
+		for _, l := range latencies {
+			total += l
+		}
+		result.AvgLatency = total / time.Duration(len(latencies))
+
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		result.P95Latency = latencies[(len(latencies)*95)/100]
+	}
+
+	return result, nil
+}
+
+// choose picks a server among those that were up according to the policy
+func (s *Simulator) choose(policy string, probes map[string]ProbeResult) string {
+	var weights config.ScoringWeights
+	switch policy {
+	case "random":
+		// The manager takes the first available server
+		for _, server := range s.cfg.Servers {
+			if probe, ok := probes[server.Name]; ok && probe.Up {
+				return server.Name
+			}
+		}
+		return ""
+	case "latency":
+		weights = config.ScoringWeights{Latency: 1}
+	case "throughput":
+		weight := s.cfg.ThroughputShare()
+		weights = config.ScoringWeights{Latency: 1 - weight, Throughput: weight}
+	case "score":
+		weights = s.cfg.Scoring
+	}
+
+	var maxThroughput float64
+	for name := range probes {
+		if s.throughput[name] > maxThroughput {
+			maxThroughput = s.throughput[name]
+		}
+	}
+
+	var best string
+	var bestScore float64
+	for _, server := range s.cfg.Servers {
+		probe, ok := probes[server.Name]
+		if !ok || !probe.Up {
+			continue
+		}
+
+		score := weights.Score(config.ScoreInput{
+			Latency:       probe.Latency,
+			InRegion:      s.cfg.PreferredRegion != "" && server.Region == s.cfg.PreferredRegion,
+			Priority:      server.Priority,
+			Cost:          server.Cost,
+			Throughput:    s.throughput[server.Name],
+			MaxThroughput: maxThroughput,
+		})
+		if config.Outranks(score, server.Name, bestScore, best) {
+			bestScore = score
+			best = server.Name
+		}
+	}
+
+	return best
+}
+
+func isSimulationPolicy(policy string) bool {
+	for _, p := range SimulationPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// RenderSimulation formats simulation results as a comparison table,
+// marking the current policy and the best performer
+func RenderSimulation(results []*SimulationResult, current string) string {
+	var b strings.Builder
+
+	best := 0
+	for i, r := range results {
+		if r.Uptime > results[best].Uptime ||
+			(r.Uptime == results[best].Uptime && r.AvgLatency < results[best].AvgLatency) {
+			best = i
+		}
+	}
+
+	fmt.Fprintf(&b, "%-12s %8s %10s %10s %9s  %s\n", "POLICY", "UPTIME", "AVG", "P95", "SWITCHES", "MOST SELECTED")
+	for i, r := range results {
+		marker := ""
+		if r.Policy == current {
+			marker += " (current)"
+		}
+		if i == best {
+			marker += " ⭐"
+		}
+
+		fmt.Fprintf(&b, "%-12s %7.2f%% %10s %10s %9d  %s%s\n",
+			r.Policy, r.Uptime,
+			r.AvgLatency.Round(time.Millisecond), r.P95Latency.Round(time.Millisecond),
+			r.Switches, mostSelected(r.Selections), marker)
+	}
+
+	return b.String()
+}
+
+func mostSelected(selections map[string]int) string {
+	var name string
+	var count int
+	for n, c := range selections {
+		if c > count || (c == count && n < name) {
+			name, count = n, c
+		}
+	}
+	if name == "" {
+		return "-"
+	}
+	return name
+}
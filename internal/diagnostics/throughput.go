@@ -0,0 +1,284 @@
+package diagnostics
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ThroughputResult holds the outcome of a throughput test
+type ThroughputResult struct {
+	Server        string        `json:"server"`
+	Protocol      string        `json:"protocol"`
+	Target        string        `json:"target"`
+	Duration      time.Duration `json:"duration"`
+	UploadBytes   uint64        `json:"upload_bytes"`
+	DownloadBytes uint64        `json:"download_bytes"`
+	UploadMbps    float64       `json:"upload_mbps"`
+	DownloadMbps  float64       `json:"download_mbps"`
+	Retransmits   int64         `json:"retransmits"` // By the helper's stream sockets; -1 when it cannot tell
+	Jitter        time.Duration `json:"jitter"`
+	AvgRTT        time.Duration `json:"avg_rtt"`
+	Intervals     []Interval    `json:"intervals"`
+}
+
+// Interval holds per-second transfer counters
+type Interval struct {
+	Start         time.Duration `json:"start"`
+	UploadBytes   uint64        `json:"upload_bytes"`
+	DownloadBytes uint64        `json:"download_bytes"`
+}
+
+// ThroughputTest runs an iperf3-style bidirectional test through a tunnel:
+// it streams to and from the speed helper at once for a set duration, and
+// samples the RTT under that load for jitter
+type ThroughputTest struct {
+	dial     func(network, addr string) (net.Conn, error)
+	target   string
+	duration time.Duration
+	id       uint64 // Tells the helper which streams are this test's
+}
+
+// NewThroughputTest creates a throughput test against the speed helper at
+// target, reached through dial
+func NewThroughputTest(dial func(network, addr string) (net.Conn, error), target string, duration time.Duration) *ThroughputTest {
+	if duration <= 0 {
+		duration = 10 * time.Second
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &ThroughputTest{
+		dial:     dial,
+		target:   target,
+		duration: duration,
+		id:       binary.BigEndian.Uint64(id),
+	}
+}
+
+// Run executes the test and returns the measured results
+func (tt *ThroughputTest) Run() (*ThroughputResult, error) {
+	upload, err := tt.openStream(benchUpload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload stream: %v", err)
+	}
+	defer upload.Close()
+	download, err := tt.openStream(benchDownload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open download stream: %v", err)
+	}
+	defer download.Close()
+	echo, err := tt.dial("tcp", tt.target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open latency stream: %v", err)
+	}
+	defer echo.Close()
+	if _, err := echo.Write([]byte{benchEcho}); err != nil {
+		return nil, fmt.Errorf("failed to open latency stream: %v", err)
+	}
+
+	var uploaded, downloaded uint64
+	var stopped atomic.Bool
+	errCh := make(chan error, 2)
+	var wg sync.WaitGroup
+
+	// Streams fail once the test closes them, which is not an error
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		if err := runUpload(upload, &uploaded); err != nil && !stopped.Load() {
+			errCh <- fmt.Errorf("upload failed: %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := runDownload(download, &downloaded); err != nil && !stopped.Load() {
+			errCh <- fmt.Errorf("download failed: %v", err)
+		}
+	}()
+
+	var rttMu sync.Mutex
+	var rtts []time.Duration
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			rtt, err := measureRTT(echo)
+			if err != nil {
+				return
+			}
+			rttMu.Lock()
+			rtts = append(rtts, rtt)
+			rttMu.Unlock()
+		}
+	}()
+
+	// Sample counters every second
+	var intervals []Interval
+	start := time.Now()
+	ticker := time.NewTicker(time.Second)
+	var lastUp, lastDown uint64
+
+	for time.Since(start) < tt.duration {
+		<-ticker.C
+		up := atomic.LoadUint64(&uploaded)
+		down := atomic.LoadUint64(&downloaded)
+		intervals = append(intervals, Interval{
+			Start:         time.Duration(len(intervals)) * time.Second,
+			UploadBytes:   up - lastUp,
+			DownloadBytes: down - lastDown,
+		})
+		lastUp, lastDown = up, down
+	}
+	ticker.Stop()
+	elapsed := time.Since(start)
+	// Read while the streams are open, as the helper forgets a test
+	// with its last stream
+	retransmits := tt.retransmits()
+
+	// Tunnel connections do not all honour deadlines, so closing them is
+	// what stops the streams
+	stopped.Store(true)
+	upload.Close()
+	download.Close()
+	echo.Close()
+	wg.Wait()
+	close(errCh)
+
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+
+	result := &ThroughputResult{
+		Target:        tt.target,
+		Duration:      elapsed,
+		UploadBytes:   atomic.LoadUint64(&uploaded),
+		DownloadBytes: atomic.LoadUint64(&downloaded),
+		Retransmits:   retransmits,
+		Intervals:     intervals,
+	}
+	result.UploadMbps = toMbps(result.UploadBytes, elapsed)
+	result.DownloadMbps = toMbps(result.DownloadBytes, elapsed)
+	result.AvgRTT, result.Jitter = rttStats(rtts)
+
+	return result, nil
+}
+
+// openStream asks the speed helper to sink or send data until the stream
+// is closed
+func (tt *ThroughputTest) openStream(direction byte) (net.Conn, error) {
+	conn, err := tt.dial("tcp", tt.target)
+	if err != nil {
+		return nil, err
+	}
+	request := make([]byte, 10)
+	request[0] = benchStream
+	request[1] = direction
+	binary.BigEndian.PutUint64(request[2:], tt.id)
+	if _, err := conn.Write(request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// retransmits asks the helper for the retransmits on its side of this
+// test's streams, or returns -1
+func (tt *ThroughputTest) retransmits() int64 {
+	conn, err := tt.dial("tcp", tt.target)
+	if err != nil {
+		return -1
+	}
+	defer conn.Close()
+	timer := time.AfterFunc(5*time.Second, func() { conn.Close() })
+	defer timer.Stop()
+
+	request := make([]byte, 9)
+	request[0] = benchRetransmits
+	binary.BigEndian.PutUint64(request[1:], tt.id)
+	if _, err := conn.Write(request); err != nil {
+		return -1
+	}
+	count := make([]byte, 8)
+	if _, err := io.ReadFull(conn, count); err != nil {
+		return -1
+	}
+	return int64(binary.BigEndian.Uint64(count))
+}
+
+// runUpload streams data to the speed helper until the stream is closed
+func runUpload(conn net.Conn, counter *uint64) error {
+	source := benchSource()
+	buf := make([]byte, 32*1024)
+	for {
+		source.Read(buf)
+		n, err := conn.Write(buf)
+		atomic.AddUint64(counter, uint64(n))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// runDownload reads from the speed helper until the stream is closed
+func runDownload(conn net.Conn, counter *uint64) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(buf)
+		atomic.AddUint64(counter, uint64(n))
+		if err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("speed helper closed the stream")
+			}
+			return err
+		}
+	}
+}
+
+// measureRTT times one probe echoed by the speed helper
+func measureRTT(conn net.Conn) (time.Duration, error) {
+	probe := make([]byte, benchProbeSize)
+	start := time.Now()
+	if _, err := conn.Write(probe); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(conn, probe); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// rttStats returns the mean RTT and the RFC 3550 style mean deviation between samples
+func rttStats(rtts []time.Duration) (time.Duration, time.Duration) {
+	if len(rtts) == 0 {
+		return 0, 0
+	}
+
+	var sum time.Duration
+	var jitter float64
+	for i, rtt := range rtts {
+		sum += rtt
+		if i > 0 {
+			jitter += math.Abs(float64(rtt - rtts[i-1]))
+		}
+	}
+
+	avg := sum / time.Duration(len(rtts))
+	if len(rtts) < 2 {
+		return avg, 0
+	}
+	return avg, time.Duration(jitter / float64(len(rtts)-1))
+}
+
+func toMbps(bytes uint64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes*8) / d.Seconds() / 1e6
+}
@@ -0,0 +1,80 @@
+package diagnostics
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// startBenchHelper runs the speed helper on a free loopback port
+func startBenchHelper(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	go ServeBench(addr)
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("speed helper did not start on %s", addr)
+	return ""
+}
+
+func TestThroughputTest(t *testing.T) {
+	addr := startBenchHelper(t)
+
+	result, err := NewThroughputTest(net.Dial, addr, 2*time.Second).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.UploadBytes == 0 || result.DownloadBytes == 0 {
+		t.Errorf("nothing transferred: %+v", result)
+	}
+	if len(result.Intervals) != 2 {
+		t.Errorf("intervals = %d, want 2", len(result.Intervals))
+	}
+	if result.AvgRTT <= 0 {
+		t.Errorf("no RTT samples: %+v", result)
+	}
+	if runtime.GOOS == "linux" && result.Retransmits < 0 {
+		t.Errorf("retransmits not read from TCP_INFO")
+	}
+
+	// The helper forgets a test with its last stream
+	time.Sleep(100 * time.Millisecond)
+	benchTests.mu.Lock()
+	left := len(benchTests.tests)
+	benchTests.mu.Unlock()
+	if left != 0 {
+		t.Errorf("helper still tracks %d tests", left)
+	}
+}
+
+func TestBenchTestRetransmits(t *testing.T) {
+	set := &benchTestSet{tests: make(map[uint64]*benchTest)}
+	if got := set.retransmits(1); got != -1 {
+		t.Errorf("unknown test = %d, want -1", got)
+	}
+
+	a, b := net.Pipe()
+	defer b.Close()
+	set.add(1, a)
+	// A pipe is not a TCP socket, so its count is unknown
+	if got := set.retransmits(1); got != -1 {
+		t.Errorf("pipe stream = %d, want -1", got)
+	}
+	set.remove(1, a)
+	if len(set.tests) != 0 {
+		t.Error("test kept after its last stream")
+	}
+}
@@ -0,0 +1,384 @@
+package diagnostics
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"ssh-tunnel/internal/config"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// Hop holds MTR-style statistics for a single TTL
+type Hop struct {
+	TTL     int             `json:"ttl"`
+	Address string          `json:"address"`
+	Sent    int             `json:"sent"`
+	Recv    int             `json:"recv"`
+	Loss    float64         `json:"loss"` // percentage
+	Best    time.Duration   `json:"best"`
+	Worst   time.Duration   `json:"worst"`
+	Avg     time.Duration   `json:"avg"`
+	RTTs    []time.Duration `json:"-"`
+}
+
+// TraceResult holds the outcome of a traceroute
+type TraceResult struct {
+	Server  string `json:"server"`
+	Target  string `json:"target"`
+	Hops    []Hop  `json:"hops"`
+	Reached bool   `json:"reached"`
+	Remote  string `json:"remote,omitempty"` // Output of a trace run from the server side
+}
+
+// Trace modes: ICMP echo requests, or UDP datagrams to high ports as the
+// classic traceroute sends, which some networks filter differently
+const (
+	TraceICMP = "icmp"
+	TraceUDP  = "udp"
+)
+
+// traceBasePort is the destination port of the first UDP probe; each
+// probe uses the next one, so the ICMP error it draws names it
+const traceBasePort = 33434
+
+// traceProbe is the payload of every probe
+var traceProbe = []byte("ssh-tunnel-trace")
+
+// errNoAnswer is a probe nothing answered in time
+var errNoAnswer = errors.New("no answer")
+
+// Tracer performs in-process traceroutes with TTL stepping
+type Tracer struct {
+	maxHops int
+	rounds  int
+	timeout time.Duration
+	mode    string
+}
+
+// NewTracer creates a new tracer sending probes of the given mode, ICMP
+// by default
+func NewTracer(maxHops, rounds int, timeout time.Duration, mode string) *Tracer {
+	if maxHops <= 0 {
+		maxHops = 30
+	}
+	if rounds <= 0 {
+		rounds = 3
+	}
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	if mode == "" {
+		mode = TraceICMP
+	}
+	return &Tracer{
+		maxHops: maxHops,
+		rounds:  rounds,
+		timeout: timeout,
+		mode:    mode,
+	}
+}
+
+// traceProber sends one probe with a TTL and waits for the answer to it:
+// the peer that sent it, and whether the peer is the destination
+type traceProber interface {
+	probe(ttl, seq int, timeout time.Duration) (peer string, rtt time.Duration, reached bool, err error)
+	close()
+}
+
+// Trace runs a traceroute to the given server
+func (tr *Tracer) Trace(server config.Server) (*TraceResult, error) {
+	if tr.mode != TraceICMP && tr.mode != TraceUDP {
+		return nil, fmt.Errorf("unsupported trace mode: %s (supported: icmp, udp)", tr.mode)
+	}
+	dst, err := net.ResolveIPAddr("ip4", server.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", server.Host, err)
+	}
+
+	// Raw sockets see every ICMP error; without them the kernel hands
+	// a socket the errors its own probes drew
+	var prober traceProber
+	if raw, err := newRawProber(tr.mode, dst.IP); err == nil {
+		prober = raw
+	} else if prober, err = newErrQueueProber(tr.mode, dst.IP); err != nil {
+		return nil, err
+	}
+	defer prober.close()
+
+	result := &TraceResult{
+		Server: server.Name,
+		Target: dst.String(),
+	}
+
+	seq := 0
+	for ttl := 1; ttl <= tr.maxHops; ttl++ {
+		hop := Hop{TTL: ttl}
+
+		for round := 0; round < tr.rounds; round++ {
+			seq++
+			hop.Sent++
+
+			peer, rtt, reached, err := prober.probe(ttl, seq, tr.timeout)
+			if err == errNoAnswer {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			hop.Recv++
+			hop.RTTs = append(hop.RTTs, rtt)
+			if hop.Address == "" {
+				hop.Address = peer
+			}
+			if reached {
+				result.Reached = true
+			}
+		}
+
+		hop.summarize()
+		result.Hops = append(result.Hops, hop)
+
+		if result.Reached {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// TraceRemote runs a traceroute on the server towards destination, so the
+// path beyond the tunnel endpoint can be inspected. run runs a command on
+// the server, over the tunnel's connection.
+func (tr *Tracer) TraceRemote(run func(cmd string) ([]byte, error), destination string) (string, error) {
+	// destination goes into a shell command on the server
+	if !validTraceDestination(destination) {
+		return "", fmt.Errorf("invalid trace destination %q: expected a host name or IP address", destination)
+	}
+	// traceroute, the fallback, sends UDP either way: ICMP needs root
+	mtrMode := ""
+	if tr.mode == TraceUDP {
+		mtrMode = "-u "
+	}
+
+	cmd := fmt.Sprintf("mtr -n %s--report -c %d %s 2>/dev/null || traceroute -n -q %d -m %d %s",
+		mtrMode, tr.rounds, destination, tr.rounds, tr.maxHops, destination)
+	output, err := run(cmd)
+	if err != nil {
+		return string(output), fmt.Errorf("remote trace failed: %v", err)
+	}
+
+	return string(output), nil
+}
+
+// validTraceDestination reports whether destination is an IP address or
+// a host name, which cannot be taken for a shell word or an option
+func validTraceDestination(destination string) bool {
+	if net.ParseIP(destination) != nil {
+		return true
+	}
+	if destination == "" || len(destination) > 253 || destination[0] == '-' {
+		return false
+	}
+	for _, r := range destination {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// rawProber reads every ICMP message on a raw socket, so it works out
+// which probe an error answers from the packet the error quotes
+type rawProber struct {
+	conn *icmp.PacketConn
+	udp  *net.UDPConn // Sends the UDP probes
+	mode string
+	dst  net.IP
+	id   int
+}
+
+// newRawProber opens a raw ICMP socket, which needs root or CAP_NET_RAW
+func newRawProber(mode string, dst net.IP) (*rawProber, error) {
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+	p := &rawProber{conn: conn, mode: mode, dst: dst, id: os.Getpid() & 0xffff}
+
+	if mode == TraceUDP {
+		if p.udp, err = net.ListenUDP("udp4", nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to open UDP socket: %v", err)
+		}
+	}
+	return p, nil
+}
+
+func (p *rawProber) probe(ttl, seq int, timeout time.Duration) (string, time.Duration, bool, error) {
+	start := time.Now()
+	if p.mode == TraceUDP {
+		if err := ipv4.NewConn(p.udp).SetTTL(ttl); err != nil {
+			return "", 0, false, fmt.Errorf("failed to set TTL: %v", err)
+		}
+		if _, err := p.udp.WriteTo(traceProbe, &net.UDPAddr{IP: p.dst, Port: traceBasePort + seq}); err != nil {
+			return "", 0, false, fmt.Errorf("failed to send probe: %v", err)
+		}
+	} else {
+		if err := p.conn.IPv4PacketConn().SetTTL(ttl); err != nil {
+			return "", 0, false, fmt.Errorf("failed to set TTL: %v", err)
+		}
+		msg := icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: p.id, Seq: seq, Data: traceProbe},
+		}
+		data, err := msg.Marshal(nil)
+		if err != nil {
+			return "", 0, false, err
+		}
+		if _, err := p.conn.WriteTo(data, &net.IPAddr{IP: p.dst}); err != nil {
+			return "", 0, false, fmt.Errorf("failed to send probe: %v", err)
+		}
+	}
+
+	if err := p.conn.SetReadDeadline(start.Add(timeout)); err != nil {
+		return "", 0, false, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return "", 0, false, errNoAnswer
+			}
+			return "", 0, false, err
+		}
+		rtt := time.Since(start)
+
+		reply, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil {
+			continue
+		}
+		from := addrIP(peer)
+
+		switch body := reply.Body.(type) {
+		case *icmp.Echo:
+			// Another process's pings, and late replies, come here too
+			if reply.Type == ipv4.ICMPTypeEchoReply && p.mode == TraceICMP && body.ID == p.id && body.Seq == seq {
+				return from, rtt, true, nil
+			}
+		case *icmp.TimeExceeded:
+			if p.quotes(body.Data, seq) {
+				return from, rtt, false, nil
+			}
+		case *icmp.DstUnreach:
+			// Port unreachable from the destination ends a UDP trace
+			if p.quotes(body.Data, seq) {
+				return from, rtt, from == p.dst.String(), nil
+			}
+		}
+	}
+}
+
+// quotes reports whether the packet an ICMP error quotes is this prober's
+// probe seq: the IP header and the first eight bytes of the payload
+func (p *rawProber) quotes(quoted []byte, seq int) bool {
+	header, err := ipv4.ParseHeader(quoted)
+	if err != nil || !header.Dst.Equal(p.dst) || len(quoted) < header.Len+8 {
+		return false
+	}
+	payload := quoted[header.Len:]
+
+	if p.mode == TraceUDP {
+		port := p.udp.LocalAddr().(*net.UDPAddr).Port
+		return header.Protocol == 17 &&
+			int(binary.BigEndian.Uint16(payload[0:2])) == port &&
+			int(binary.BigEndian.Uint16(payload[2:4])) == traceBasePort+seq
+	}
+	return header.Protocol == 1 && payload[0] == byte(ipv4.ICMPTypeEcho) &&
+		int(binary.BigEndian.Uint16(payload[4:6])) == p.id &&
+		int(binary.BigEndian.Uint16(payload[6:8])) == seq
+}
+
+func (p *rawProber) close() {
+	p.conn.Close()
+	if p.udp != nil {
+		p.udp.Close()
+	}
+}
+
+// summarize computes loss and latency statistics for the hop
+func (h *Hop) summarize() {
+	if h.Sent > 0 {
+		h.Loss = float64(h.Sent-h.Recv) / float64(h.Sent) * 100
+	}
+	if len(h.RTTs) == 0 {
+		return
+	}
+
+	sorted := make([]time.Duration, len(h.RTTs))
+	copy(sorted, h.RTTs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var sum time.Duration
+	for _, rtt := range sorted {
+		sum += rtt
+	}
+
+	h.Best = sorted[0]
+	h.Worst = sorted[len(sorted)-1]
+	h.Avg = sum / time.Duration(len(sorted))
+}
+
+// Render returns an MTR-style report with a latency bar per hop
+func (r *TraceResult) Render() string {
+	var b strings.Builder
+
+	var worst time.Duration
+	for _, hop := range r.Hops {
+		if hop.Avg > worst {
+			worst = hop.Avg
+		}
+	}
+
+	fmt.Fprintf(&b, "%-4s %-16s %6s %9s %9s %9s  %s\n", "TTL", "Host", "Loss%", "Best", "Avg", "Worst", "Latency")
+	for _, hop := range r.Hops {
+		host := hop.Address
+		if host == "" {
+			host = "???"
+		}
+
+		bar := ""
+		if worst > 0 && hop.Avg > 0 {
+			bar = strings.Repeat("█", int(float64(hop.Avg)/float64(worst)*30)+1)
+		}
+
+		fmt.Fprintf(&b, "%-4d %-16s %5.1f%% %9s %9s %9s  %s\n",
+			hop.TTL, host, hop.Loss,
+			hop.Best.Round(time.Microsecond*100),
+			hop.Avg.Round(time.Microsecond*100),
+			hop.Worst.Round(time.Microsecond*100),
+			bar)
+	}
+
+	return b.String()
+}
+
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	default:
+		return addr.String()
+	}
+}
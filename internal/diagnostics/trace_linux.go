@@ -0,0 +1,193 @@
+//go:build linux
+
+package diagnostics
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// soEEOriginICMP marks an error queue entry as an ICMP error
+const soEEOriginICMP = 2
+
+// errQueueProber traces without root. An ICMP error a probe draws is not
+// passed up an unprivileged ping or UDP socket; with IP_RECVERR the kernel
+// queues it on the socket's error queue instead, with the error's sender.
+type errQueueProber struct {
+	conn net.PacketConn
+	raw  syscall.RawConn
+	mode string
+	dst  net.IP
+}
+
+// newErrQueueProber opens an unprivileged ping socket for ICMP probes,
+// which needs net.ipv4.ping_group_range, or a UDP socket
+func newErrQueueProber(mode string, dst net.IP) (traceProber, error) {
+	proto := syscall.IPPROTO_UDP
+	if mode == TraceICMP {
+		proto = syscall.IPPROTO_ICMP
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ICMP socket (run as root, allow net.ipv4.ping_group_range or use --mode udp): %v", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_RECVERR, 1); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to enable the socket error queue: %v", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind trace socket: %v", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "trace")
+	conn, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace socket: %v", err)
+	}
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &errQueueProber{conn: conn, raw: raw, mode: mode, dst: dst}, nil
+}
+
+func (p *errQueueProber) probe(ttl, seq int, timeout time.Duration) (string, time.Duration, bool, error) {
+	var sockErr error
+	if err := p.raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+	}); err != nil || sockErr != nil {
+		return "", 0, false, fmt.Errorf("failed to set TTL: %v%v", err, sockErr)
+	}
+
+	// The kernel sets the echo ID of a ping socket, and only hands it the
+	// replies and errors carrying that ID
+	packet, port := traceProbe, traceBasePort+seq
+	if p.mode == TraceICMP {
+		msg := icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{Seq: seq, Data: traceProbe},
+		}
+		var err error
+		if packet, err = msg.Marshal(nil); err != nil {
+			return "", 0, false, err
+		}
+		port = 0
+	}
+
+	start := time.Now()
+	if _, err := p.conn.WriteTo(packet, &net.UDPAddr{IP: p.dst, Port: port}); err != nil {
+		return "", 0, false, fmt.Errorf("failed to send probe: %v", err)
+	}
+	if err := p.conn.SetReadDeadline(start.Add(timeout)); err != nil {
+		return "", 0, false, err
+	}
+
+	buf := make([]byte, 1500)
+	oob := make([]byte, 512)
+	for {
+		var peer string
+		var reached, answered bool
+		var readErr error
+		err := p.raw.Read(func(fd uintptr) bool {
+			// An error queue entry wakes readers like data does
+			n, oobn, _, from, err := syscall.Recvmsg(int(fd), buf, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+			if err == nil {
+				peer, reached, answered = p.queuedError(buf[:n], oob[:oobn], from, seq)
+				return true
+			}
+			n, from, err = syscall.Recvfrom(int(fd), buf, syscall.MSG_DONTWAIT)
+			if err == nil {
+				peer, reached, answered = p.reply(buf[:n], from, seq)
+				return true
+			}
+			if err == syscall.EAGAIN {
+				return false
+			}
+			readErr = err
+			return true
+		})
+		if err != nil {
+			if os.IsTimeout(err) {
+				return "", 0, false, errNoAnswer
+			}
+			return "", 0, false, err
+		}
+		if readErr != nil {
+			return "", 0, false, readErr
+		}
+		if answered {
+			return peer, time.Since(start), reached, nil
+		}
+	}
+}
+
+// queuedError reads an error queue entry: the ICMP error, its sender, the
+// destination of the probe that drew it and, for ping sockets, the probe
+// itself
+func (p *errQueueProber) queuedError(data, oob []byte, to syscall.Sockaddr, seq int) (string, bool, bool) {
+	dst, ok := to.(*syscall.SockaddrInet4)
+	if !ok || !net.IP(dst.Addr[:]).Equal(p.dst) {
+		return "", false, false
+	}
+	if p.mode == TraceUDP && dst.Port != traceBasePort+seq {
+		return "", false, false // Drawn by an earlier probe
+	}
+	if p.mode == TraceICMP && (len(data) < 8 || int(binary.BigEndian.Uint16(data[6:8])) != seq) {
+		return "", false, false
+	}
+
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return "", false, false
+	}
+	for _, m := range messages {
+		// struct sock_extended_err, then the sender's sockaddr_in
+		if m.Header.Level != syscall.IPPROTO_IP || m.Header.Type != syscall.IP_RECVERR || len(m.Data) < 24 {
+			continue
+		}
+		if m.Data[4] != soEEOriginICMP {
+			continue
+		}
+		from := net.IP(m.Data[20:24]).String()
+		switch ipv4.ICMPType(m.Data[5]) {
+		case ipv4.ICMPTypeTimeExceeded:
+			return from, false, true
+		case ipv4.ICMPTypeDestinationUnreachable:
+			return from, from == p.dst.String(), true
+		}
+	}
+	return "", false, false
+}
+
+// reply reads an echo reply on a ping socket
+func (p *errQueueProber) reply(data []byte, from syscall.Sockaddr, seq int) (string, bool, bool) {
+	if p.mode != TraceICMP {
+		return "", false, false
+	}
+	msg, err := icmp.ParseMessage(1, data)
+	if err != nil || msg.Type != ipv4.ICMPTypeEchoReply {
+		return "", false, false
+	}
+	echo, ok := msg.Body.(*icmp.Echo)
+	if !ok || echo.Seq != seq {
+		return "", false, false // A late reply to an earlier probe
+	}
+	if sa, ok := from.(*syscall.SockaddrInet4); ok {
+		return net.IP(sa.Addr[:]).String(), true, true
+	}
+	return p.dst.String(), true, true
+}
+
+func (p *errQueueProber) close() {
+	p.conn.Close()
+}
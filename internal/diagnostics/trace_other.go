@@ -0,0 +1,14 @@
+//go:build !linux
+
+package diagnostics
+
+import (
+	"fmt"
+	"net"
+)
+
+// newErrQueueProber stands in for the unprivileged prober, which reads the
+// Linux socket error queue
+func newErrQueueProber(mode string, dst net.IP) (traceProber, error) {
+	return nil, fmt.Errorf("failed to open ICMP socket: traceroute needs root on this platform")
+}
@@ -0,0 +1,95 @@
+package diagnostics
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestValidTraceDestination(t *testing.T) {
+	tests := []struct {
+		destination string
+		valid       bool
+	}{
+		{"1.1.1.1", true},
+		{"2001:db8::1", true},
+		{"example.com", true},
+		{"my-host.internal", true},
+		{"", false},
+		{"-n", false},
+		{"1.1.1.1; rm -rf /", false},
+		{"$(reboot)", false},
+		{"host name", false},
+		{"a`b`", false},
+	}
+	for _, tt := range tests {
+		if got := validTraceDestination(tt.destination); got != tt.valid {
+			t.Errorf("validTraceDestination(%q) = %v, want %v", tt.destination, got, tt.valid)
+		}
+	}
+}
+
+// quotedProbe is what an ICMP error quotes of a probe: its IP header and
+// the first eight bytes of its payload
+func quotedProbe(t *testing.T, dst net.IP, protocol int, payload []byte) []byte {
+	t.Helper()
+
+	header := &ipv4.Header{Version: 4, Len: ipv4.HeaderLen, TotalLen: ipv4.HeaderLen + len(payload), TTL: 1, Protocol: protocol, Dst: dst, Src: net.IPv4(10, 0, 0, 1)}
+	data, err := header.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(data, payload[:8]...)
+}
+
+func TestRawProberQuotes(t *testing.T) {
+	dst := net.IPv4(192, 0, 2, 1).To4()
+
+	echo := func(id, seq int) []byte {
+		msg := icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: id, Seq: seq, Data: traceProbe}}
+		data, err := msg.Marshal(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	p := &rawProber{mode: TraceICMP, dst: dst, id: 4242}
+	if !p.quotes(quotedProbe(t, dst, 1, echo(4242, 7)), 7) {
+		t.Error("own echo not matched")
+	}
+	if p.quotes(quotedProbe(t, dst, 1, echo(4242, 6)), 7) {
+		t.Error("an earlier probe's echo matched")
+	}
+	if p.quotes(quotedProbe(t, dst, 1, echo(1111, 7)), 7) {
+		t.Error("another process's echo matched")
+	}
+	if p.quotes(quotedProbe(t, net.IPv4(192, 0, 2, 2), 1, echo(4242, 7)), 7) {
+		t.Error("an echo to another destination matched")
+	}
+
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	datagram := func(srcPort, dstPort int) []byte {
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint16(data[0:2], uint16(srcPort))
+		binary.BigEndian.PutUint16(data[2:4], uint16(dstPort))
+		return data
+	}
+	local := udp.LocalAddr().(*net.UDPAddr).Port
+	p = &rawProber{mode: TraceUDP, dst: dst, udp: udp}
+	if !p.quotes(quotedProbe(t, dst, 17, datagram(local, traceBasePort+3)), 3) {
+		t.Error("own datagram not matched")
+	}
+	if p.quotes(quotedProbe(t, dst, 17, datagram(local, traceBasePort+2)), 3) {
+		t.Error("an earlier probe's datagram matched")
+	}
+	if p.quotes(quotedProbe(t, dst, 17, datagram(local+1, traceBasePort+3)), 3) {
+		t.Error("another socket's datagram matched")
+	}
+}
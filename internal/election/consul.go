@@ -0,0 +1,283 @@
+package election
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+// consulElector elects the instance whose Consul session holds a lock on a
+// KV key. The session is renewed every TTL/2; when the leader dies its
+// session expires and the lock is released for a standby.
+type consulElector struct {
+	address string
+	key     string
+	token   string
+	ttl     time.Duration
+	retry   time.Duration
+	client  *http.Client
+
+	mu      sync.Mutex
+	session string
+	lost    chan struct{}
+	cancel  context.CancelFunc // Stops session renewal
+}
+
+func newConsulElector(cfg config.ElectionConfig) *consulElector {
+	return &consulElector{
+		address: strings.TrimSuffix(cfg.Address, "/"),
+		key:     strings.TrimPrefix(cfg.Key, "/"),
+		token:   cfg.Token,
+		ttl:     cfg.TTL,
+		retry:   cfg.RetryInterval,
+		client:  &http.Client{},
+	}
+}
+
+func (e *consulElector) Campaign(ctx context.Context) error {
+	var index string
+	for {
+		acquired, err := e.tryAcquire(ctx)
+		if err == nil && acquired {
+			return nil
+		}
+		if err != nil {
+			// Consul unreachable: keep trying, a leader cannot renew either
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			index = ""
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(e.retry):
+			}
+			continue
+		}
+
+		// Wait until the key changes, e.g. the leader's session expired
+		index, err = e.waitForChange(ctx, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(e.retry):
+			}
+		}
+	}
+}
+
+// tryAcquire creates a session if needed and tries to take the lock with it
+func (e *consulElector) tryAcquire(ctx context.Context) (bool, error) {
+	e.mu.Lock()
+	session := e.session
+	e.mu.Unlock()
+
+	if session == "" {
+		var created struct{ ID string }
+		body := map[string]string{
+			"Name":      "ssh-tunnel leader " + identity(),
+			"TTL":       e.ttl.String(),
+			"Behavior":  "release",
+			"LockDelay": "1s", // Short so failover stays fast
+		}
+		if err := e.do(ctx, http.MethodPut, "/v1/session/create", body, &created); err != nil {
+			return false, fmt.Errorf("failed to create consul session: %v", err)
+		}
+		session = created.ID
+
+		e.mu.Lock()
+		e.session = session
+		e.mu.Unlock()
+	}
+
+	var acquired bool
+	path := "/v1/kv/" + e.key + "?acquire=" + url.QueryEscape(session)
+	if err := e.do(ctx, http.MethodPut, path, identity(), &acquired); err != nil {
+		if strings.Contains(err.Error(), "invalid session") {
+			e.clearSession(session)
+		}
+		return false, fmt.Errorf("failed to acquire consul lock: %v", err)
+	}
+	if !acquired {
+		return false, nil
+	}
+
+	renewCtx, cancel := context.WithCancel(context.Background())
+	lost := make(chan struct{})
+
+	e.mu.Lock()
+	e.lost = lost
+	e.cancel = cancel
+	e.mu.Unlock()
+
+	go e.renew(renewCtx, session, lost)
+	return true, nil
+}
+
+// renew keeps the session alive and closes lost once it cannot be renewed
+// before the TTL runs out
+func (e *consulElector) renew(ctx context.Context, session string, lost chan struct{}) {
+	ticker := time.NewTicker(e.ttl / 2)
+	defer ticker.Stop()
+
+	deadline := time.Now().Add(e.ttl)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, e.ttl/2)
+		err := e.do(reqCtx, http.MethodPut, "/v1/session/renew/"+session, nil, nil)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		switch {
+		case err == nil:
+			deadline = time.Now().Add(e.ttl)
+			continue
+		case strings.Contains(err.Error(), "404"):
+			// The session is gone, so is the lock
+		case time.Now().Before(deadline):
+			continue // Retry on the next tick
+		}
+
+		e.clearSession(session)
+		close(lost)
+		return
+	}
+}
+
+// waitForChange blocks until the lock key changes after index and returns
+// the new index
+func (e *consulElector) waitForChange(ctx context.Context, index string) (string, error) {
+	path := "/v1/kv/" + e.key + "?wait=" + e.ttl.String()
+	if index != "" {
+		path += "&index=" + index
+	}
+
+	req, err := e.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return "", fmt.Errorf("consul returned %s", resp.Status)
+	}
+
+	next := resp.Header.Get("X-Consul-Index")
+	if _, err := strconv.ParseUint(next, 10, 64); err != nil {
+		return "", fmt.Errorf("invalid consul index %q", next)
+	}
+	return next, nil
+}
+
+func (e *consulElector) Lost() <-chan struct{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.lost
+}
+
+func (e *consulElector) Resign() error {
+	e.mu.Lock()
+	session := e.session
+	cancel := e.cancel
+	e.session = ""
+	e.cancel = nil
+	e.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	if session == "" {
+		return nil
+	}
+
+	ctx, cancelReq := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelReq()
+
+	// Destroying the session releases the lock
+	return e.do(ctx, http.MethodPut, "/v1/session/destroy/"+session, nil, nil)
+}
+
+// clearSession forgets a session Consul no longer knows
+func (e *consulElector) clearSession(session string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.session == session {
+		e.session = ""
+	}
+}
+
+func (e *consulElector) newRequest(ctx context.Context, method, path string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, e.address+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if e.token != "" {
+		req.Header.Set("X-Consul-Token", e.token)
+	}
+	return req, nil
+}
+
+// do sends a request and decodes the JSON response into out, if set
+func (e *consulElector) do(ctx context.Context, method, path string, body, out interface{}) error {
+	req, err := e.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("consul returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
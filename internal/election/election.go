@@ -0,0 +1,40 @@
+package election
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"ssh-tunnel/internal/config"
+)
+
+// Elector decides which of several instances is the leader
+type Elector interface {
+	// Campaign blocks until this instance is the leader or ctx is done
+	Campaign(ctx context.Context) error
+
+	// Lost is closed when leadership won by Campaign is lost. A new
+	// channel is returned after each successful Campaign.
+	Lost() <-chan struct{}
+
+	// Resign gives up leadership so a standby can take over at once
+	Resign() error
+}
+
+// New creates the elector for the configured backend
+func New(cfg config.ElectionConfig) (Elector, error) {
+	switch cfg.Backend {
+	case "", "file":
+		return newFileElector(cfg), nil
+	case "consul":
+		return newConsulElector(cfg), nil
+	default:
+		return nil, fmt.Errorf("unsupported election backend: %s", cfg.Backend)
+	}
+}
+
+// identity names this instance in the lock holder information
+func identity() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
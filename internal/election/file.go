@@ -0,0 +1,97 @@
+package election
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+// fileElector elects the instance holding an exclusive lock on a local
+// file. The lock is released by the kernel when the process exits, so a
+// standby takes over within one retry interval even after a crash.
+type fileElector struct {
+	path  string
+	retry time.Duration
+
+	mu   sync.Mutex
+	file *os.File
+	lost chan struct{}
+}
+
+func newFileElector(cfg config.ElectionConfig) *fileElector {
+	return &fileElector{
+		path:  cfg.LockFile,
+		retry: cfg.RetryInterval,
+	}
+}
+
+func (e *fileElector) Campaign(ctx context.Context) error {
+	ticker := time.NewTicker(e.retry)
+	defer ticker.Stop()
+
+	for {
+		acquired, err := e.tryLock()
+		if err != nil {
+			return err
+		}
+		if acquired {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// tryLock attempts to take the lock without blocking
+func (e *fileElector) tryLock() (bool, error) {
+	f, err := os.OpenFile(e.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, fmt.Errorf("failed to open lock file: %v", err)
+	}
+
+	acquired, err := lockFile(f)
+	if err != nil || !acquired {
+		f.Close()
+		return false, err
+	}
+
+	// Record the holder for operators; the lock itself is what counts
+	f.Truncate(0)
+	f.WriteAt([]byte(identity()+"\n"), 0)
+
+	e.mu.Lock()
+	e.file = f
+	e.lost = make(chan struct{}) // Never closed: a held lock cannot be lost
+	e.mu.Unlock()
+	return true, nil
+}
+
+func (e *fileElector) Lost() <-chan struct{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.lost
+}
+
+func (e *fileElector) Resign() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.file == nil {
+		return nil
+	}
+
+	e.file.Truncate(0)
+	err := unlockFile(e.file)
+	e.file.Close()
+	e.file = nil
+	return err
+}
@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package election
+
+import (
+	"fmt"
+	"os"
+
+	"ssh-tunnel/internal/platform"
+)
+
+func lockFile(f *os.File) (bool, error) {
+	return false, fmt.Errorf("%v, use the consul backend", platform.Unsupported(platform.FileLock))
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
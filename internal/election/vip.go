@@ -0,0 +1,93 @@
+package election
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+// garpInterval spaces out gratuitous ARP announcements
+const garpInterval = 200 * time.Millisecond
+
+// VirtualIP is a floating address held by the leader. Local proxies listen
+// on every address, so once the leader holds it LAN clients reach the
+// tunnels through it; after a takeover the gratuitous ARPs make neighbours
+// send to the new leader's MAC address.
+type VirtualIP struct {
+	cidr     string
+	ip       net.IP
+	iface    string
+	announce int
+}
+
+// NewVirtualIP prepares the virtual IP without touching the interface
+func NewVirtualIP(cfg *config.VirtualIPConfig) (*VirtualIP, error) {
+	ip, _, err := net.ParseCIDR(cfg.Address)
+	if err != nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid virtual IP %q", cfg.Address)
+	}
+	if _, err := net.InterfaceByName(cfg.Interface); err != nil {
+		return nil, fmt.Errorf("virtual IP interface %s: %v", cfg.Interface, err)
+	}
+
+	return &VirtualIP{
+		cidr:     cfg.Address,
+		ip:       ip.To4(),
+		iface:    cfg.Interface,
+		announce: cfg.GratuitousARP,
+	}, nil
+}
+
+// Acquire adds the address to the interface and announces it
+func (v *VirtualIP) Acquire() error {
+	if !v.assigned() {
+		if err := addAddress(v.cidr, v.iface); err != nil {
+			return fmt.Errorf("failed to add virtual IP %s to %s: %v", v.cidr, v.iface, err)
+		}
+		log.Printf("Virtual IP %s added to %s", v.cidr, v.iface)
+	}
+
+	for i := 0; i < v.announce; i++ {
+		if i > 0 {
+			time.Sleep(garpInterval)
+		}
+		if err := sendGratuitousARP(v.iface, v.ip); err != nil {
+			return fmt.Errorf("failed to announce virtual IP %s: %v", v.ip, err)
+		}
+	}
+	return nil
+}
+
+// Release removes the address from the interface
+func (v *VirtualIP) Release() error {
+	if !v.assigned() {
+		return nil
+	}
+	if err := deleteAddress(v.cidr, v.iface); err != nil {
+		return fmt.Errorf("failed to remove virtual IP %s from %s: %v", v.cidr, v.iface, err)
+	}
+	log.Printf("Virtual IP %s removed from %s", v.cidr, v.iface)
+	return nil
+}
+
+// assigned reports whether the interface currently holds the address
+func (v *VirtualIP) assigned() bool {
+	iface, err := net.InterfaceByName(v.iface)
+	if err != nil {
+		return false
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(v.ip) {
+			return true
+		}
+	}
+	return false
+}
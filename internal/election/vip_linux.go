@@ -0,0 +1,79 @@
+//go:build linux
+
+package election
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+const ethPArp = 0x0806
+
+func addAddress(cidr, iface string) error {
+	return runIP("addr", "add", cidr, "dev", iface)
+}
+
+func deleteAddress(cidr, iface string) error {
+	return runIP("addr", "del", cidr, "dev", iface)
+}
+
+// runIP runs the ip command, including its output in errors
+func runIP(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// sendGratuitousARP broadcasts an ARP request for ip from ip, which makes
+// neighbours update their cache entry to this interface's MAC address
+func sendGratuitousARP(ifaceName string, ip net.IP) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return err
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return fmt.Errorf("interface %s has no Ethernet address", ifaceName)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethPArp)))
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	broadcast := [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	frame := make([]byte, 0, 42)
+	frame = append(frame, broadcast[:6]...)
+	frame = append(frame, iface.HardwareAddr...)
+	frame = binary.BigEndian.AppendUint16(frame, ethPArp)
+
+	frame = binary.BigEndian.AppendUint16(frame, 1)      // Ethernet
+	frame = binary.BigEndian.AppendUint16(frame, 0x0800) // IPv4
+	frame = append(frame, 6, 4)                          // Address lengths
+	frame = binary.BigEndian.AppendUint16(frame, 1)      // Request
+	frame = append(frame, iface.HardwareAddr...)
+	frame = append(frame, ip.To4()...)
+	frame = append(frame, 0, 0, 0, 0, 0, 0)
+	frame = append(frame, ip.To4()...)
+
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(ethPArp),
+		Ifindex:  iface.Index,
+		Halen:    6,
+		Addr:     broadcast,
+	}
+	return syscall.Sendto(fd, frame, 0, addr)
+}
+
+// htons converts to network byte order
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
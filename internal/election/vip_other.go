@@ -0,0 +1,23 @@
+//go:build !linux
+
+package election
+
+import (
+	"net"
+
+	"ssh-tunnel/internal/platform"
+)
+
+var errVirtualIPUnsupported = platform.Unsupported(platform.VirtualIP)
+
+func addAddress(cidr, iface string) error {
+	return errVirtualIPUnsupported
+}
+
+func deleteAddress(cidr, iface string) error {
+	return nil
+}
+
+func sendGratuitousARP(ifaceName string, ip net.IP) error {
+	return errVirtualIPUnsupported
+}
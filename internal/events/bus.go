@@ -0,0 +1,169 @@
+package events
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+const (
+	// recentEvents is how many events the bus keeps for subscribers
+	// catching up after a reconnect
+	recentEvents = 256
+
+	// subscriberBuffer is how far a subscriber may fall behind before it is
+	// dropped and has to catch up from the recent events
+	subscriberBuffer = 64
+)
+
+// Event is a structured change to the configuration or server inventory,
+// or to the state of the tunnels, the instance or the mesh. Values are
+// sanitized: secrets never leave the process.
+type Event struct {
+	ID     uint64           `json:"id"`
+	Time   time.Time        `json:"time"`
+	Type   config.EventType `json:"type"`
+	Server string           `json:"server,omitempty"` // For server and tunnel events
+	Rule   *int             `json:"rule,omitempty"`   // Index in routing, for rule events
+	Fields []string         `json:"fields,omitempty"` // Settings that changed
+	Before interface{}      `json:"before,omitempty"`
+	After  interface{}      `json:"after,omitempty"`  // The new state, or the mesh event for mesh events
+	Reason string           `json:"reason,omitempty"` // Why it happened, for tunnel, reload and mesh events
+}
+
+// Bus fans events out to stream subscribers and hooks
+type Bus struct {
+	mu     sync.Mutex
+	nextID uint64
+	recent []Event
+	subs   map[chan Event]struct{}
+	hooks  []*hookWorker
+}
+
+// NewBus creates a bus delivering to the given hooks
+func NewBus(hooks []config.EventHook) *Bus {
+	b := &Bus{
+		nextID: 1,
+		subs:   make(map[chan Event]struct{}),
+	}
+	b.SetHooks(hooks)
+	return b
+}
+
+// SetHooks replaces the hooks, letting deliveries already queued finish
+func (b *Bus) SetHooks(hooks []config.EventHook) {
+	workers := make([]*hookWorker, 0, len(hooks))
+	for _, hook := range hooks {
+		workers = append(workers, startHook(hook))
+	}
+
+	b.mu.Lock()
+	old := b.hooks
+	b.hooks = workers
+	b.mu.Unlock()
+
+	for _, w := range old {
+		w.stop()
+	}
+}
+
+// Publish numbers and delivers events in order
+func (b *Bus) Publish(events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for _, event := range events {
+		event.ID = b.nextID
+		b.nextID++
+		if event.Time.IsZero() {
+			event.Time = now
+		}
+		log.Printf("Event %d: %s %s", event.ID, event.Type, describe(event))
+
+		b.recent = append(b.recent, event)
+		if len(b.recent) > recentEvents {
+			b.recent = b.recent[len(b.recent)-recentEvents:]
+		}
+
+		for ch := range b.subs {
+			select {
+			case ch <- event:
+			default:
+				// Too slow: drop it rather than block publishers
+				delete(b.subs, ch)
+				close(ch)
+			}
+		}
+		for _, w := range b.hooks {
+			w.enqueue(event)
+		}
+	}
+}
+
+// Subscribe returns the recent events after since, then a channel of new
+// ones. The channel is closed when the subscriber falls behind; it should
+// resubscribe from the last ID it saw.
+func (b *Bus) Subscribe(since uint64) ([]Event, <-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var backlog []Event
+	for _, event := range b.recent {
+		if event.ID > since {
+			backlog = append(backlog, event)
+		}
+	}
+
+	ch := make(chan Event, subscriberBuffer)
+	b.subs[ch] = struct{}{}
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	return backlog, ch, cancel
+}
+
+// Close ends every subscription and stops the hooks
+func (b *Bus) Close() {
+	b.mu.Lock()
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+	hooks := b.hooks
+	b.hooks = nil
+	b.mu.Unlock()
+
+	for _, w := range hooks {
+		w.stop()
+	}
+}
+
+func describe(event Event) string {
+	switch {
+	case event.Server != "":
+		return event.Server
+	case event.Rule != nil:
+		return "#" + strconv.Itoa(*event.Rule)
+	case len(event.Fields) == 0 && event.After != nil:
+		return fmt.Sprint(event.After)
+	case event.Reason != "":
+		return event.Reason
+	default:
+		return strings.Join(event.Fields, ", ")
+	}
+}
@@ -0,0 +1,135 @@
+package events
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/recorder"
+)
+
+// Diff describes the change from old to new as events: servers matched by
+// name, routing rules by position, and one event for all other settings
+func Diff(old, new *config.Config) []Event {
+	var events []Event
+
+	oldServers := make(map[string]config.Server)
+	for _, server := range old.Servers {
+		oldServers[server.Name] = server
+	}
+	newServers := make(map[string]bool)
+	for _, server := range new.Servers {
+		newServers[server.Name] = true
+		before, existed := oldServers[server.Name]
+		if !existed {
+			events = append(events, Event{
+				Type:   config.EventServerAdded,
+				Server: server.Name,
+				After:  recorder.SanitizeObject(server),
+			})
+			continue
+		}
+		if fields := changedFields(before, server); len(fields) > 0 {
+			events = append(events, Event{
+				Type:   config.EventServerChanged,
+				Server: server.Name,
+				Fields: fields,
+				Before: recorder.SanitizeObject(before),
+				After:  recorder.SanitizeObject(server),
+			})
+		}
+	}
+	for _, server := range old.Servers {
+		if !newServers[server.Name] {
+			events = append(events, Event{
+				Type:   config.EventServerRemoved,
+				Server: server.Name,
+				Before: recorder.SanitizeObject(server),
+			})
+		}
+	}
+
+	for i := 0; i < len(old.Routing) || i < len(new.Routing); i++ {
+		index := i
+		switch {
+		case i >= len(old.Routing):
+			events = append(events, Event{
+				Type:  config.EventRuleAdded,
+				Rule:  &index,
+				After: recorder.SanitizeObject(new.Routing[i]),
+			})
+		case i >= len(new.Routing):
+			events = append(events, Event{
+				Type:   config.EventRuleRemoved,
+				Rule:   &index,
+				Before: recorder.SanitizeObject(old.Routing[i]),
+			})
+		default:
+			if fields := changedFields(old.Routing[i], new.Routing[i]); len(fields) > 0 {
+				events = append(events, Event{
+					Type:   config.EventRuleChanged,
+					Rule:   &index,
+					Fields: fields,
+					Before: recorder.SanitizeObject(old.Routing[i]),
+					After:  recorder.SanitizeObject(new.Routing[i]),
+				})
+			}
+		}
+	}
+
+	// Everything else, reported by top-level setting with only the changed
+	// values attached
+	oldRest, newRest := *old, *new
+	oldRest.Servers, newRest.Servers = nil, nil
+	oldRest.Routing, newRest.Routing = nil, nil
+	if fields := changedFields(oldRest, newRest); len(fields) > 0 {
+		before, after := jsonFields(oldRest), jsonFields(newRest)
+		changedBefore := make(map[string]interface{})
+		changedAfter := make(map[string]interface{})
+		for _, field := range fields {
+			changedBefore[field] = before[field]
+			changedAfter[field] = after[field]
+		}
+		events = append(events, Event{
+			Type:   config.EventConfigChanged,
+			Fields: fields,
+			Before: recorder.Sanitize(changedBefore),
+			After:  recorder.Sanitize(changedAfter),
+		})
+	}
+
+	return events
+}
+
+// changedFields returns the JSON names of the top-level fields that differ.
+// Values are compared before sanitizing, so a changed secret is noticed
+// even though its value is not reported.
+func changedFields(old, new interface{}) []string {
+	before, after := jsonFields(old), jsonFields(new)
+
+	var fields []string
+	for name, value := range after {
+		if !reflect.DeepEqual(before[name], value) {
+			fields = append(fields, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// jsonFields decodes a value's JSON form into its top-level fields
+func jsonFields(value interface{}) map[string]interface{} {
+	fields := make(map[string]interface{})
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fields
+	}
+	json.Unmarshal(data, &fields)
+	return fields
+}
@@ -0,0 +1,130 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+const (
+	hookQueue    = 256
+	hookAttempts = 3
+)
+
+// hookWorker delivers events to one hook in order, retrying failures
+type hookWorker struct {
+	hook  config.EventHook
+	queue chan Event
+}
+
+func startHook(hook config.EventHook) *hookWorker {
+	if hook.Timeout <= 0 {
+		hook.Timeout = 10 * time.Second
+	}
+	w := &hookWorker{
+		hook:  hook,
+		queue: make(chan Event, hookQueue),
+	}
+	go w.run()
+	return w
+}
+
+// enqueue queues an event the hook subscribes to; the caller holds the
+// bus lock, so a hook that cannot keep up loses events instead of
+// stalling the bus
+func (w *hookWorker) enqueue(event Event) {
+	if !config.MatchesEvent(w.hook.Types, event.Type) {
+		return
+	}
+	select {
+	case w.queue <- event:
+	default:
+		log.Printf("Event hook %s is behind, dropped event %d", w.name(), event.ID)
+	}
+}
+
+// stop delivers what is queued, then ends the worker
+func (w *hookWorker) stop() {
+	close(w.queue)
+}
+
+func (w *hookWorker) run() {
+	for event := range w.queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+
+		backoff := time.Second
+		for attempt := 1; ; attempt++ {
+			err := w.deliver(event, body)
+			if err == nil {
+				break
+			}
+			if attempt == hookAttempts {
+				log.Printf("Event hook %s failed for event %d: %v", w.name(), event.ID, err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (w *hookWorker) deliver(event Event, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.hook.Timeout)
+	defer cancel()
+
+	if w.hook.Command != "" {
+		cmd := exec.CommandContext(ctx, "sh", "-c", w.hook.Command)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Env = append(os.Environ(),
+			"TUNNEL_EVENT="+string(event.Type),
+			fmt.Sprintf("TUNNEL_EVENT_ID=%d", event.ID))
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, bytes.TrimSpace(output))
+		}
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tunnel-Event", string(event.Type))
+	req.Header.Set("X-Tunnel-Event-ID", fmt.Sprintf("%d", event.ID))
+	if w.hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.hook.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Tunnel-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *hookWorker) name() string {
+	if w.hook.URL != "" {
+		return w.hook.URL
+	}
+	return w.hook.Command
+}
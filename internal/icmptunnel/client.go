@@ -0,0 +1,279 @@
+package icmptunnel
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	defaultMTU          = 1024
+	defaultPollInterval = 50 * time.Millisecond
+	closeLinger         = 5 * time.Second
+	maxPollBurst        = 16
+)
+
+// Options tunes the ICMP transport
+type Options struct {
+	MTU          int           // Maximum frame size carried in one echo message
+	PollInterval time.Duration // How often an idle client polls the server for data
+	Timeout      time.Duration // Handshake timeout
+}
+
+func (o *Options) setDefaults() {
+	if o.MTU <= headerLen+tagLen {
+		o.MTU = defaultMTU
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = defaultPollInterval
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 10 * time.Second
+	}
+}
+
+// Conn is a client stream carried in ICMP echo requests and replies. The
+// server can only answer requests, so the client keeps polling to give it
+// reply slots for downstream data.
+type Conn struct {
+	*stream
+	pc         *icmp.PacketConn
+	privileged bool
+	dst        net.Addr
+	key        []byte
+	opts       Options
+	session    uint32
+	echoID     int
+	echoSeq    int
+
+	pulls     int32 // Polls requested by the read loop
+	handshake chan struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// Dial opens an ICMP tunnel stream to the agent running on host
+func Dial(host, secret string, opts Options) (*Conn, error) {
+	opts.setDefaults()
+
+	addr, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+
+	pc, privileged, err := listen()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids [6]byte
+	if _, err := rand.Read(ids[:]); err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	c := &Conn{
+		stream:     newStream(opts.MTU - headerLen - tagLen),
+		pc:         pc,
+		privileged: privileged,
+		dst:        addr,
+		key:        deriveKey(secret),
+		opts:       opts,
+		session:    binary.BigEndian.Uint32(ids[:4]),
+		echoID:     int(binary.BigEndian.Uint16(ids[4:])),
+		handshake:  make(chan struct{}, 1),
+		closing:    make(chan struct{}),
+	}
+	if !privileged {
+		// Unprivileged ping sockets address peers with UDP addresses
+		c.dst = &net.UDPAddr{IP: addr.IP}
+	}
+
+	go c.readLoop()
+
+	deadline := time.After(opts.Timeout)
+	retry := time.NewTicker(500 * time.Millisecond)
+	defer retry.Stop()
+	for {
+		if err := c.send(&frame{flags: flagSYN, session: c.session}); err != nil {
+			pc.Close()
+			return nil, fmt.Errorf("failed to send handshake: %v", err)
+		}
+
+		select {
+		case <-c.handshake:
+			go c.writeLoop()
+			return c, nil
+		case <-retry.C:
+		case <-deadline:
+			pc.Close()
+			return nil, fmt.Errorf("no response from ICMP tunnel agent on %s", host)
+		}
+	}
+}
+
+// listen opens a raw ICMP socket, falling back to an unprivileged ping socket
+func listen() (*icmp.PacketConn, bool, error) {
+	if pc, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0"); err == nil {
+		return pc, true, nil
+	}
+
+	pc, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open ICMP socket (run as root or allow net.ipv4.ping_group_range): %v", err)
+	}
+	return pc, false, nil
+}
+
+func (c *Conn) send(f *frame) error {
+	c.echoSeq = (c.echoSeq + 1) & 0xffff
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{
+			ID:   c.echoID,
+			Seq:  c.echoSeq,
+			Data: f.marshal(c.key),
+		},
+	}
+
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.pc.WriteTo(b, c.dst)
+	return err
+}
+
+func (c *Conn) readLoop() {
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := c.pc.ReadFrom(buf)
+		if err != nil {
+			c.stream.fail(err)
+			return
+		}
+
+		msg, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || msg.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok {
+			continue
+		}
+
+		f, err := unmarshalFrame(echo.Data, c.key)
+		if err != nil || f.session != c.session || f.flags&flagReply == 0 {
+			continue // Kernel echo of our own request or unrelated traffic
+		}
+
+		switch {
+		case f.flags&flagReset != 0:
+			c.stream.fail(fmt.Errorf("icmp tunnel: session reset by server"))
+			c.shutdown()
+			return
+		case f.flags&flagSYN != 0:
+			select {
+			case c.handshake <- struct{}{}:
+			default:
+			}
+			continue
+		}
+
+		pulls := int32(0)
+		if c.stream.handleFrame(f) {
+			pulls++
+		}
+		if f.flags&flagMore != 0 {
+			pulls++
+		}
+		if pulls > 0 && atomic.AddInt32(&c.pulls, pulls) > 0 {
+			c.stream.signal()
+		}
+	}
+}
+
+func (c *Conn) writeLoop() {
+	ticker := time.NewTicker(c.opts.PollInterval)
+	defer ticker.Stop()
+
+	var closeAt time.Time
+	for {
+		select {
+		case <-c.closing:
+			return
+		case <-c.stream.notify:
+		case <-ticker.C:
+		}
+
+		sent := 0
+		for sent < defaultWindow {
+			f, ok := c.stream.nextFrame(c.session, 0)
+			if !ok {
+				break
+			}
+			if err := c.send(f); err != nil {
+				c.stream.fail(err)
+				break
+			}
+			sent++
+		}
+
+		// Every request is a reply slot, so only top up with bare polls
+		polls := int(atomic.SwapInt32(&c.pulls, 0)) - sent
+		if polls > maxPollBurst {
+			polls = maxPollBurst
+		}
+		if sent == 0 && polls < 1 {
+			polls = 1
+		}
+		for i := 0; i < polls; i++ {
+			c.send(c.stream.currentAck(c.session, flagPoll))
+		}
+
+		c.stream.mu.Lock()
+		closed := c.stream.closed
+		c.stream.mu.Unlock()
+		if closed && closeAt.IsZero() {
+			closeAt = time.Now()
+		}
+		if c.stream.done() || (!closeAt.IsZero() && time.Since(closeAt) > closeLinger) {
+			c.shutdown()
+			return
+		}
+	}
+}
+
+func (c *Conn) shutdown() {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		c.pc.Close()
+	})
+}
+
+// LocalAddr returns the local ICMP socket address
+func (c *Conn) LocalAddr() net.Addr {
+	return c.pc.LocalAddr()
+}
+
+// RemoteAddr returns the tunnel server address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.dst
+}
+
+// SetDeadline is a no-op; deadlines are not supported by the ICMP stream
+func (c *Conn) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline is a no-op; deadlines are not supported by the ICMP stream
+func (c *Conn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline is a no-op; deadlines are not supported by the ICMP stream
+func (c *Conn) SetWriteDeadline(t time.Time) error { return nil }
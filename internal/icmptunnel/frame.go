@@ -0,0 +1,87 @@
+package icmptunnel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Frame flags
+const (
+	flagSYN   byte = 1 << 0 // Session setup, does not consume a sequence number
+	flagFIN   byte = 1 << 1 // End of stream, consumes a sequence number
+	flagData  byte = 1 << 2 // Frame carries a sequenced segment
+	flagPoll  byte = 1 << 3 // Client poll giving the server a reply slot
+	flagReset byte = 1 << 4 // Session unknown or aborted
+	flagMore  byte = 1 << 5 // Server has more frames queued for the client
+	flagReply byte = 1 << 7 // Sent by the server inside an echo reply
+)
+
+const (
+	frameMagic = "SIT1"
+	headerLen  = 4 + 1 + 4 + 4 + 4 + 2 // magic, flags, session, seq, ack, length
+	tagLen     = 8
+)
+
+// frame is the unit carried in the data field of an ICMP echo message
+type frame struct {
+	flags   byte
+	session uint32
+	seq     uint32
+	ack     uint32
+	payload []byte
+}
+
+// marshal encodes the frame and appends a truncated HMAC-SHA256 tag
+func (f *frame) marshal(key []byte) []byte {
+	buf := make([]byte, headerLen+len(f.payload)+tagLen)
+	copy(buf, frameMagic)
+	buf[4] = f.flags
+	binary.BigEndian.PutUint32(buf[5:], f.session)
+	binary.BigEndian.PutUint32(buf[9:], f.seq)
+	binary.BigEndian.PutUint32(buf[13:], f.ack)
+	binary.BigEndian.PutUint16(buf[17:], uint16(len(f.payload)))
+	copy(buf[headerLen:], f.payload)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf[:headerLen+len(f.payload)])
+	copy(buf[headerLen+len(f.payload):], mac.Sum(nil))
+	return buf
+}
+
+// unmarshalFrame decodes and authenticates a frame. Foreign ICMP traffic
+// (ordinary pings) is rejected by the magic check before the MAC is computed.
+func unmarshalFrame(data, key []byte) (*frame, error) {
+	if len(data) < headerLen+tagLen || string(data[:4]) != frameMagic {
+		return nil, fmt.Errorf("not a tunnel frame")
+	}
+
+	length := int(binary.BigEndian.Uint16(data[17:]))
+	if len(data) < headerLen+length+tagLen {
+		return nil, fmt.Errorf("truncated frame")
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data[:headerLen+length])
+	if !hmac.Equal(mac.Sum(nil)[:tagLen], data[headerLen+length:headerLen+length+tagLen]) {
+		return nil, fmt.Errorf("frame authentication failed")
+	}
+
+	payload := make([]byte, length)
+	copy(payload, data[headerLen:headerLen+length])
+
+	return &frame{
+		flags:   data[4],
+		session: binary.BigEndian.Uint32(data[5:]),
+		seq:     binary.BigEndian.Uint32(data[9:]),
+		ack:     binary.BigEndian.Uint32(data[13:]),
+		payload: payload,
+	}, nil
+}
+
+// deriveKey turns the shared secret into the MAC key
+func deriveKey(secret string) []byte {
+	sum := sha256.Sum256([]byte("ssh-tunnel icmp " + secret))
+	return sum[:]
+}
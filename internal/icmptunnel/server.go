@@ -0,0 +1,220 @@
+package icmptunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	"ssh-tunnel/internal/platform"
+)
+
+const sessionIdleTimeout = 2 * time.Minute
+
+// Server is the agent side of the ICMP tunnel. It answers tunnel frames in
+// echo requests with echo replies and relays each session to a TCP target,
+// normally the local sshd.
+//
+// The kernel keeps answering pings on its own, so the agent should be run
+// with net.ipv4.icmp_echo_ignore_all=1 to avoid duplicate replies confusing
+// NAT devices on the way back to the client.
+type Server struct {
+	key      []byte
+	forward  string
+	opts     Options
+	pc       *icmp.PacketConn
+	sessions map[uint32]*serverSession
+	mu       sync.Mutex
+}
+
+// serverSession is one client stream and its TCP relay
+type serverSession struct {
+	stream   *stream
+	target   net.Conn
+	peer     net.Addr
+	lastSeen time.Time
+}
+
+// NewServer creates a new ICMP tunnel agent forwarding sessions to forward
+func NewServer(secret, forward string, opts Options) *Server {
+	opts.setDefaults()
+	return &Server{
+		key:      deriveKey(secret),
+		forward:  forward,
+		opts:     opts,
+		sessions: make(map[uint32]*serverSession),
+	}
+}
+
+// Serve handles tunnel traffic until the context is cancelled
+func (s *Server) Serve(ctx context.Context) error {
+	if err := platform.Check(platform.ICMPAgent); err != nil {
+		return err
+	}
+	pc, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return fmt.Errorf("failed to open raw ICMP socket (root required): %v", err)
+	}
+	s.pc = pc
+
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+	go s.reapSessions(ctx)
+
+	buf := make([]byte, 65535)
+	for {
+		n, peer, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to read ICMP packet: %v", err)
+		}
+
+		msg, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || msg.Type != ipv4.ICMPTypeEcho {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok {
+			continue
+		}
+
+		f, err := unmarshalFrame(echo.Data, s.key)
+		if err != nil || f.flags&flagReply != 0 {
+			continue
+		}
+
+		if reply := s.handleFrame(f, peer); reply != nil {
+			s.reply(reply, echo, peer)
+		}
+	}
+}
+
+// handleFrame applies a client frame and returns the frame to answer with
+func (s *Server) handleFrame(f *frame, peer net.Addr) *frame {
+	s.mu.Lock()
+	sess, ok := s.sessions[f.session]
+	s.mu.Unlock()
+
+	if f.flags&flagSYN != 0 {
+		if !ok {
+			var err error
+			if sess, err = s.openSession(f.session, peer); err != nil {
+				log.Printf("ICMP tunnel: failed to reach %s: %v", s.forward, err)
+				return &frame{flags: flagReply | flagReset, session: f.session}
+			}
+		}
+		return &frame{flags: flagReply | flagSYN, session: f.session}
+	}
+
+	if !ok {
+		return &frame{flags: flagReply | flagReset, session: f.session}
+	}
+
+	s.mu.Lock()
+	sess.peer = peer
+	sess.lastSeen = time.Now()
+	s.mu.Unlock()
+
+	sess.stream.handleFrame(f)
+
+	reply, ok := sess.stream.nextFrame(f.session, flagReply)
+	if !ok {
+		reply = sess.stream.currentAck(f.session, flagReply)
+	}
+	if sess.stream.hasPending() {
+		reply.flags |= flagMore
+	}
+	return reply
+}
+
+func (s *Server) openSession(id uint32, peer net.Addr) (*serverSession, error) {
+	target, err := net.DialTimeout("tcp", s.forward, s.opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &serverSession{
+		stream:   newStream(s.opts.MTU - headerLen - tagLen),
+		target:   target,
+		peer:     peer,
+		lastSeen: time.Now(),
+	}
+
+	s.mu.Lock()
+	s.sessions[id] = sess
+	s.mu.Unlock()
+
+	go func() {
+		io.Copy(sess.stream, target)
+		sess.stream.CloseWrite()
+	}()
+	go func() {
+		io.Copy(target, sess.stream)
+		if tcp, ok := target.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+
+	log.Printf("ICMP tunnel: session %08x opened from %s", id, peer)
+	return sess, nil
+}
+
+func (s *Server) reply(f *frame, request *icmp.Echo, peer net.Addr) {
+	// Echo the request ID and sequence so NAT devices match the reply
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{
+			ID:   request.ID,
+			Seq:  request.Seq,
+			Data: f.marshal(s.key),
+		},
+	}
+
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return
+	}
+	s.pc.WriteTo(b, peer)
+}
+
+// reapSessions removes finished and idle sessions
+func (s *Server) reapSessions(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			for id, sess := range s.sessions {
+				sess.target.Close()
+				sess.stream.fail(net.ErrClosed)
+				delete(s.sessions, id)
+			}
+			s.mu.Unlock()
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		for id, sess := range s.sessions {
+			if sess.stream.done() || time.Since(sess.lastSeen) > sessionIdleTimeout {
+				sess.target.Close()
+				sess.stream.fail(net.ErrClosed)
+				delete(s.sessions, id)
+				log.Printf("ICMP tunnel: session %08x closed", id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,319 @@
+package icmptunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWindow = 64
+	minRTO        = 200 * time.Millisecond
+	maxRTO        = 5 * time.Second
+	maxRetries    = 25
+)
+
+var errPeerLost = errors.New("icmp tunnel: peer stopped acknowledging")
+
+// segment is a sequenced unit of stream data awaiting acknowledgement
+type segment struct {
+	seq     uint32
+	flags   byte
+	data    []byte
+	sentAt  time.Time
+	retries int
+}
+
+// stream provides a reliable, ordered byte stream on top of unreliable
+// frames using a fixed sliding window, cumulative acknowledgements and
+// RTT-based retransmission. It does not send anything itself: the owning
+// transport pulls frames with nextFrame whenever it has a send opportunity.
+type stream struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	mss  int
+
+	// Send side
+	nextSeq uint32
+	unacked []*segment
+	srtt    time.Duration
+	rto     time.Duration
+	finSent bool
+
+	// Receive side
+	recvNext uint32
+	ooo      map[uint32]*segment
+	readBuf  []byte
+	ackDue   bool
+	finRecv  bool
+
+	closed bool
+	err    error
+	notify chan struct{}
+}
+
+func newStream(mss int) *stream {
+	s := &stream{
+		mss:    mss,
+		rto:    time.Second,
+		ooo:    make(map[uint32]*segment),
+		notify: make(chan struct{}, 1),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// signal wakes the transport so it can send without waiting for its timer
+func (s *stream) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Read reads delivered stream data
+func (s *stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.readBuf) == 0 && !s.finRecv && s.err == nil && !s.closed {
+		s.cond.Wait()
+	}
+
+	if len(s.readBuf) > 0 {
+		n := copy(p, s.readBuf)
+		s.readBuf = s.readBuf[n:]
+		return n, nil
+	}
+	if s.finRecv {
+		return 0, io.EOF
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	return 0, net.ErrClosed
+}
+
+// Write queues data for transmission, blocking while the window is full
+func (s *stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		for len(s.unacked) >= defaultWindow && s.err == nil && !s.closed {
+			s.cond.Wait()
+		}
+		if s.err != nil {
+			return written, s.err
+		}
+		if s.closed || s.finSent {
+			return written, net.ErrClosed
+		}
+
+		n := len(p)
+		if n > s.mss {
+			n = s.mss
+		}
+		data := make([]byte, n)
+		copy(data, p[:n])
+
+		s.unacked = append(s.unacked, &segment{seq: s.nextSeq, flags: flagData, data: data})
+		s.nextSeq++
+		p = p[n:]
+		written += n
+		s.signal()
+	}
+
+	return written, nil
+}
+
+// CloseWrite queues a FIN after any pending data
+func (s *stream) CloseWrite() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.finSent && s.err == nil {
+		s.unacked = append(s.unacked, &segment{seq: s.nextSeq, flags: flagData | flagFIN})
+		s.nextSeq++
+		s.finSent = true
+		s.signal()
+	}
+	return nil
+}
+
+// Close sends a FIN and stops local reads and writes. The transport keeps
+// retransmitting until the FIN is acknowledged or the peer is lost.
+func (s *stream) Close() error {
+	s.CloseWrite()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.cond.Broadcast()
+	return nil
+}
+
+// fail aborts the stream with an error
+func (s *stream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
+
+// done reports whether the stream can be torn down
+func (s *stream) done() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return true
+	}
+	return s.finSent && s.finRecv && len(s.unacked) == 0
+}
+
+// handleFrame processes the acknowledgement and segment carried by a frame.
+// It reports whether the frame carried a segment.
+func (s *stream) handleFrame(f *frame) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Cumulative acknowledgement: everything before f.ack was received
+	acked := 0
+	for acked < len(s.unacked) && seqBefore(s.unacked[acked].seq, f.ack) {
+		seg := s.unacked[acked]
+		if seg.retries == 0 && !seg.sentAt.IsZero() {
+			s.updateRTT(time.Since(seg.sentAt))
+		}
+		acked++
+	}
+	if acked > 0 {
+		s.unacked = s.unacked[acked:]
+		s.cond.Broadcast()
+	}
+
+	if f.flags&flagData == 0 {
+		return false
+	}
+
+	s.ackDue = true
+	switch {
+	case f.seq == s.recvNext:
+		s.deliver(&segment{seq: f.seq, flags: f.flags, data: f.payload})
+		for {
+			next, ok := s.ooo[s.recvNext]
+			if !ok {
+				break
+			}
+			delete(s.ooo, s.recvNext)
+			s.deliver(next)
+		}
+		s.cond.Broadcast()
+	case seqBefore(s.recvNext, f.seq) && f.seq-s.recvNext < 2*defaultWindow:
+		s.ooo[f.seq] = &segment{seq: f.seq, flags: f.flags, data: f.payload}
+	}
+
+	return true
+}
+
+func (s *stream) deliver(seg *segment) {
+	s.readBuf = append(s.readBuf, seg.data...)
+	if seg.flags&flagFIN != 0 {
+		s.finRecv = true
+	}
+	s.recvNext++
+}
+
+func (s *stream) updateRTT(sample time.Duration) {
+	if s.srtt == 0 {
+		s.srtt = sample
+	} else {
+		s.srtt = (7*s.srtt + sample) / 8
+	}
+
+	s.rto = 2 * s.srtt
+	if s.rto < minRTO {
+		s.rto = minRTO
+	}
+	if s.rto > maxRTO {
+		s.rto = maxRTO
+	}
+}
+
+// nextFrame returns the next frame worth sending: the oldest segment that is
+// new or due for retransmission, or a bare acknowledgement if one is owed.
+func (s *stream) nextFrame(session uint32, flags byte) (*frame, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, seg := range s.unacked {
+		if !seg.sentAt.IsZero() && now.Sub(seg.sentAt) < s.rto {
+			continue
+		}
+		if !seg.sentAt.IsZero() {
+			seg.retries++
+			if seg.retries > maxRetries {
+				s.err = errPeerLost
+				s.cond.Broadcast()
+				return nil, false
+			}
+		}
+		seg.sentAt = now
+		s.ackDue = false
+		return &frame{
+			flags:   flags | seg.flags,
+			session: session,
+			seq:     seg.seq,
+			ack:     s.recvNext,
+			payload: seg.data,
+		}, true
+	}
+
+	if s.ackDue {
+		s.ackDue = false
+		return s.ackFrame(session, flags), true
+	}
+
+	return nil, false
+}
+
+// ackFrame returns a frame carrying only the current acknowledgement
+func (s *stream) ackFrame(session uint32, flags byte) *frame {
+	return &frame{flags: flags, session: session, ack: s.recvNext}
+}
+
+// currentAck returns a bare acknowledgement frame
+func (s *stream) currentAck(session uint32, flags byte) *frame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ackDue = false
+	return s.ackFrame(session, flags)
+}
+
+// hasPending reports whether segments are waiting for a send opportunity
+func (s *stream) hasPending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, seg := range s.unacked {
+		if seg.sentAt.IsZero() || now.Sub(seg.sentAt) >= s.rto {
+			return true
+		}
+	}
+	return s.ackDue
+}
+
+// seqBefore reports whether a comes before b, allowing for wrap-around
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
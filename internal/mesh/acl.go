@@ -0,0 +1,305 @@
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"ssh-tunnel/internal/wireguard"
+)
+
+// ACL rule actions
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// flowTimeout is how long after a node last sent a flow's packets the
+// replies are let in whatever the ACLs say
+const flowTimeout = 5 * time.Minute
+
+// maxFlows bounds the flows remembered for replies before the stale ones
+// are pruned
+const maxFlows = 8192
+
+// ACLRule allows or denies mesh traffic between nodes. Every node enforces
+// the rules on what its peers send it over the data plane: without rules
+// any peer reaches it; with rules, the first one matching the sender, the
+// node and the packet decides, and packets no rule matches are dropped.
+// Replies to traffic the node sent itself always get back in.
+type ACLRule struct {
+	ID      string    `json:"id"`
+	From    string    `json:"from"`            // Selector of the senders, as for routing policies
+	To      string    `json:"to"`              // Selector of the receivers
+	Ports   []string  `json:"ports,omitempty"` // tcp/22, udp/5000-5100, tcp, udp or icmp; every packet when empty
+	Action  string    `json:"action"`          // ACLAllow or ACLDeny
+	Comment string    `json:"comment,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// aclPort is a parsed ACL port spec
+type aclPort struct {
+	proto  uint8
+	lo, hi uint16
+}
+
+// IP protocol numbers ACLs know
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// parseACLPort parses tcp/22, udp/5000-5100, tcp, udp or icmp
+func parseACLPort(spec string) (aclPort, error) {
+	name, ports, hasPorts := strings.Cut(strings.ToLower(strings.TrimSpace(spec)), "/")
+	var port aclPort
+	switch name {
+	case "tcp":
+		port.proto = protoTCP
+	case "udp":
+		port.proto = protoUDP
+	case "icmp":
+		if hasPorts {
+			return port, fmt.Errorf("icmp has no ports")
+		}
+		return aclPort{proto: protoICMP}, nil
+	default:
+		return port, fmt.Errorf("invalid port %q: use tcp/<port>, udp/<from>-<to>, tcp, udp or icmp", spec)
+	}
+	port.hi = 65535
+	if !hasPorts {
+		return port, nil
+	}
+
+	from, to, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		to = from
+	}
+	lo, err1 := strconv.ParseUint(from, 10, 16)
+	hi, err2 := strconv.ParseUint(to, 10, 16)
+	if err1 != nil || err2 != nil || lo == 0 || lo > hi {
+		return port, fmt.Errorf("invalid port range %q", spec)
+	}
+	port.lo, port.hi = uint16(lo), uint16(hi)
+	return port, nil
+}
+
+// matchesPacket reports whether a rule's ports cover a packet to dstPort
+func (r ACLRule) matchesPacket(proto uint8, dstPort uint16) bool {
+	if len(r.Ports) == 0 {
+		return true
+	}
+	if proto == protoICMPv6 {
+		proto = protoICMP
+	}
+	for _, spec := range r.Ports {
+		port, err := parseACLPort(spec)
+		if err == nil && port.proto == proto && (proto == protoICMP || dstPort >= port.lo && dstPort <= port.hi) {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes a rule for logs and listings
+func (r ACLRule) String() string {
+	s := fmt.Sprintf("%s from %s to %s", r.Action, r.From, r.To)
+	if len(r.Ports) > 0 {
+		s += " on " + strings.Join(r.Ports, ",")
+	}
+	return s
+}
+
+// ACLs returns the ACL rules the coordinator distributes
+func (mn *MeshNetwork) ACLs() []ACLRule {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+	return append([]ACLRule(nil), mn.acls...)
+}
+
+// flow identifies traffic between this node and a remote address, from
+// this node's side
+type flow struct {
+	remote     netip.Addr
+	proto      uint8
+	remotePort uint16
+	localPort  uint16
+}
+
+// transportInfo reads the protocol and ports of an IP packet; ports are
+// zero for protocols without them and for IPv6 extension headers
+func transportInfo(packet []byte) (proto uint8, srcPort, dstPort uint16) {
+	var offset int
+	switch packet[0] >> 4 {
+	case 4:
+		proto, offset = packet[9], int(packet[0]&0x0f)*4
+	case 6:
+		proto, offset = packet[6], 40
+	default:
+		return 0, 0, 0
+	}
+	if (proto == protoTCP || proto == protoUDP) && len(packet) >= offset+4 {
+		srcPort = uint16(packet[offset])<<8 | uint16(packet[offset+1])
+		dstPort = uint16(packet[offset+2])<<8 | uint16(packet[offset+3])
+	}
+	return proto, srcPort, dstPort
+}
+
+// compileACLsLocked picks, for each peer, the rules that apply to what it
+// sends this node; nil when there are no rules and everything passes
+func (dp *dataPlane) compileACLsLocked(byKey map[wireguard.Key]string) map[wireguard.Key][]ACLRule {
+	rules := dp.mn.acls
+	if len(rules) == 0 {
+		return nil
+	}
+	compiled := make(map[wireguard.Key][]ACLRule, len(byKey))
+	for key, id := range byKey {
+		node := dp.mn.nodes[id]
+		if node == nil {
+			continue
+		}
+		for _, rule := range rules {
+			if matchesSelector(rule.From, node) && matchesSelector(rule.To, dp.mn.localNode) {
+				compiled[key] = append(compiled[key], rule)
+			}
+		}
+	}
+	return compiled
+}
+
+// track remembers a packet this node sends while ACLs apply, so the
+// replies get back in
+func (dp *dataPlane) track(packet []byte, dst netip.Addr) {
+	dp.mu.RLock()
+	filtering := dp.acl != nil
+	dp.mu.RUnlock()
+	if !filtering {
+		return
+	}
+
+	proto, srcPort, dstPort := transportInfo(packet)
+	now := time.Now()
+	dp.flowsMu.Lock()
+	defer dp.flowsMu.Unlock()
+	if len(dp.flows) >= maxFlows {
+		for f, last := range dp.flows {
+			if now.Sub(last) > flowTimeout {
+				delete(dp.flows, f)
+			}
+		}
+	}
+	if len(dp.flows) < maxFlows {
+		dp.flows[flow{dst, proto, dstPort, srcPort}] = now
+	}
+}
+
+// allowed reports whether the ACLs let a packet a peer sent in
+func (dp *dataPlane) allowed(key wireguard.Key, packet []byte, src netip.Addr) bool {
+	dp.mu.RLock()
+	rules, filtering := dp.acl[key], dp.acl != nil
+	dp.mu.RUnlock()
+	if !filtering {
+		return true
+	}
+
+	proto, srcPort, dstPort := transportInfo(packet)
+	dp.flowsMu.Lock()
+	last, reply := dp.flows[flow{src, proto, srcPort, dstPort}]
+	dp.flowsMu.Unlock()
+	if reply && time.Since(last) <= flowTimeout {
+		return true
+	}
+
+	for _, rule := range rules {
+		if rule.matchesPacket(proto, dstPort) {
+			return rule.Action != ACLDeny
+		}
+	}
+	return false
+}
+
+// handleListACLs serves the ACL rules, in the order they apply
+func (c *Coordinator) handleListACLs(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	c.mu.Lock()
+	acls := append([]ACLRule{}, c.acls...)
+	c.mu.Unlock()
+	writeJSON(w, acls)
+}
+
+// handleAddACL adds an ACL rule after the existing ones, which take
+// precedence, and distributes it to the nodes
+func (c *Coordinator) handleAddACL(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	var rule ACLRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid ACL rule")
+		return
+	}
+	if err := validateSelector(rule.From); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("from: %v", err))
+		return
+	}
+	if err := validateSelector(rule.To); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("to: %v", err))
+		return
+	}
+	for _, spec := range rule.Ports {
+		if _, err := parseACLPort(spec); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	switch rule.Action {
+	case "":
+		rule.Action = ACLAllow
+	case ACLAllow, ACLDeny:
+	default:
+		writeError(w, http.StatusBadRequest, "action must be allow or deny")
+		return
+	}
+	rule.ID = "acl-" + randomHex(4)
+	rule.Created = time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.acls = append(c.acls, rule)
+	log.Printf("Mesh ACL rule %s added: %s", rule.ID, rule)
+	c.bumpLocked()
+	writeJSON(w, rule)
+}
+
+// handleRemoveACL removes an ACL rule
+func (c *Coordinator) handleRemoveACL(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := r.PathValue("id")
+	for i, rule := range c.acls {
+		if rule.ID == id {
+			c.acls = append(c.acls[:i:i], c.acls[i+1:]...)
+			log.Printf("Mesh ACL rule %s removed", id)
+			c.bumpLocked()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "unknown ACL rule")
+}
@@ -0,0 +1,143 @@
+package mesh
+
+import (
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+// AdminClient manages a coordinator's join tokens and nodes
+type AdminClient struct {
+	url     string
+	key     string
+	pin     string
+	current atomic.Int32 // The coordinator of url that last answered
+}
+
+// NewAdminClient returns a client for the coordinator at coordinatorURL,
+// or the first available of several separated by commas. key is the
+// coordinator's admin key, empty when it runs without one and is reached
+// over loopback.
+func NewAdminClient(coordinatorURL, key string) *AdminClient {
+	return &AdminClient{url: coordinatorURL, key: key}
+}
+
+// SetPin makes the client trust the coordinator by its certificate pin,
+// as tunnel mesh coordinator prints it, instead of the system's roots
+func (a *AdminClient) SetPin(pin string) {
+	a.pin = pin
+}
+
+// URL returns the coordinator's URL, or URLs
+func (a *AdminClient) URL() string {
+	return a.url
+}
+
+// CreateToken creates a join token
+func (a *AdminClient) CreateToken(req CreateTokenRequest) (*CreateTokenResponse, error) {
+	var resp CreateTokenResponse
+	if err := a.call(http.MethodPost, "/mesh/v1/tokens", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListTokens returns every join token, revoked and used up ones included
+func (a *AdminClient) ListTokens() ([]JoinToken, error) {
+	var tokens []JoinToken
+	err := a.call(http.MethodGet, "/mesh/v1/tokens", nil, &tokens)
+	return tokens, err
+}
+
+// RevokeToken revokes a join token by ID
+func (a *AdminClient) RevokeToken(id string) error {
+	return a.call(http.MethodDelete, "/mesh/v1/tokens/"+url.PathEscape(id), nil, nil)
+}
+
+// ListNodes returns every node, those waiting for approval included
+func (a *AdminClient) ListNodes() ([]NodeInfo, error) {
+	var nodes []NodeInfo
+	err := a.call(http.MethodGet, "/mesh/v1/nodes", nil, &nodes)
+	return nodes, err
+}
+
+// ApproveNode admits a node, by ID or name, waiting for approval
+func (a *AdminClient) ApproveNode(node string) error {
+	return a.call(http.MethodPost, "/mesh/v1/nodes/"+url.PathEscape(node)+"/approve", nil, nil)
+}
+
+// RemoveNode removes a node, by ID or name, from the mesh and revokes its
+// key, and with revokeToken the join token it registered with
+func (a *AdminClient) RemoveNode(node string, revokeToken bool) error {
+	path := "/mesh/v1/nodes/" + url.PathEscape(node)
+	if revokeToken {
+		path += "?revoke_token=true"
+	}
+	return a.call(http.MethodDelete, path, nil, nil)
+}
+
+// DrainNode starts or ends draining a node, by ID or name, before
+// maintenance
+func (a *AdminClient) DrainNode(node string, drain bool) (*NodeInfo, error) {
+	return a.nodeState(node, "drain", drain)
+}
+
+// QuarantineNode isolates a node, by ID or name, from its peers, or
+// releases it
+func (a *AdminClient) QuarantineNode(node string, quarantine bool) (*NodeInfo, error) {
+	return a.nodeState(node, "quarantine", quarantine)
+}
+
+func (a *AdminClient) nodeState(node, state string, on bool) (*NodeInfo, error) {
+	method := http.MethodPost
+	if !on {
+		method = http.MethodDelete
+	}
+	var info NodeInfo
+	if err := a.call(method, "/mesh/v1/nodes/"+url.PathEscape(node)+"/"+state, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ListPolicies returns the routing policies, in the order they apply
+func (a *AdminClient) ListPolicies() ([]RoutingPolicy, error) {
+	var policies []RoutingPolicy
+	err := a.call(http.MethodGet, "/mesh/v1/policies", nil, &policies)
+	return policies, err
+}
+
+// AddPolicy adds a routing policy after the existing ones
+func (a *AdminClient) AddPolicy(policy RoutingPolicy) (*RoutingPolicy, error) {
+	var added RoutingPolicy
+	if err := a.call(http.MethodPost, "/mesh/v1/policies", policy, &added); err != nil {
+		return nil, err
+	}
+	return &added, nil
+}
+
+// RemovePolicy removes a routing policy by ID
+func (a *AdminClient) RemovePolicy(id string) error {
+	return a.call(http.MethodDelete, "/mesh/v1/policies/"+url.PathEscape(id), nil, nil)
+}
+
+// ListACLs returns the ACL rules, in the order they apply
+func (a *AdminClient) ListACLs() ([]ACLRule, error) {
+	var acls []ACLRule
+	err := a.call(http.MethodGet, "/mesh/v1/acls", nil, &acls)
+	return acls, err
+}
+
+// AddACL adds an ACL rule after the existing ones
+func (a *AdminClient) AddACL(rule ACLRule) (*ACLRule, error) {
+	var added ACLRule
+	if err := a.call(http.MethodPost, "/mesh/v1/acls", rule, &added); err != nil {
+		return nil, err
+	}
+	return &added, nil
+}
+
+// RemoveACL removes an ACL rule by ID
+func (a *AdminClient) RemoveACL(id string) error {
+	return a.call(http.MethodDelete, "/mesh/v1/acls/"+url.PathEscape(id), nil, nil)
+}
@@ -0,0 +1,152 @@
+package mesh
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultAgentSSHAddr is where an agent checks that the SSH server it
+// serves mesh clients with is up, when MeshConfig.SSHAddr is empty
+const DefaultAgentSSHAddr = "127.0.0.1:22"
+
+// NodeHealth is how a node's host is doing, as its agent reports it with
+// each heartbeat
+type NodeHealth struct {
+	Reported    time.Time     `json:"reported"`
+	Uptime      time.Duration `json:"uptime"` // Of the agent
+	OS          string        `json:"os"`
+	Arch        string        `json:"arch"`
+	CPUs        int           `json:"cpus"`
+	Load1       float64       `json:"load1,omitempty"`       // Load average over a minute; zero where unknown
+	MemoryUsed  float64       `json:"memory_used,omitempty"` // 0-1; zero where unknown
+	Connections int           `json:"connections"`           // Established to the SSH server
+	SSH         bool          `json:"ssh"`                   // The SSH server answers
+	DataPlane   bool          `json:"data_plane"`            // The WireGuard data plane is up
+}
+
+// collectHealth measures the host for the next heartbeat
+func (mn *MeshNetwork) collectHealth() *NodeHealth {
+	health := &NodeHealth{
+		Reported:   time.Now(),
+		Uptime:     time.Since(mn.started),
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		CPUs:       runtime.NumCPU(),
+		Load1:      loadAverage(),
+		MemoryUsed: memoryUsed(),
+	}
+
+	addr := mn.config.SSHAddr
+	if addr == "" {
+		addr = DefaultAgentSSHAddr
+	}
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		health.SSH = true
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		health.Connections = establishedConnections(port)
+	}
+
+	mn.mu.RLock()
+	health.DataPlane = mn.dataPlane != nil
+	mn.mu.RUnlock()
+	return health
+}
+
+// loadAverage reads the one-minute load average from /proc/loadavg
+func loadAverage() float64 {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	load, _ := strconv.ParseFloat(fields[0], 64)
+	return load
+}
+
+// memoryUsed reads the share of memory in use from /proc/meminfo
+func memoryUsed() float64 {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	var total, available float64
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		value, _ := strconv.ParseFloat(fields[1], 64)
+		switch fields[0] {
+		case "MemTotal:":
+			total = value
+		case "MemAvailable:":
+			available = value
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return 1 - available/total
+}
+
+// establishedConnections counts the TCP connections established to a
+// local port, from /proc/net/tcp and tcp6; zero where unknown
+func establishedConnections(port string) int {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return 0
+	}
+	local := fmt.Sprintf(":%04X", p)
+	count := 0
+	for _, file := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(line)
+			// sl local_address rem_address st ...; 01 is ESTABLISHED
+			if len(fields) > 3 && strings.HasSuffix(fields[1], local) && fields[3] == "01" {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// Weights of the load score's parts
+const (
+	loadWeightCPU         = 0.5
+	loadWeightMemory      = 0.3
+	loadWeightConnections = 0.2
+)
+
+// loadScore turns a node's health into a load from 0, idle, to 1: its
+// load average per CPU, its memory in use and its connections against the
+// busiest node's, weighted. Zero without a report.
+func loadScore(health *NodeHealth, maxConnections int) float64 {
+	if health == nil {
+		return 0
+	}
+	cpus := health.CPUs
+	if cpus < 1 {
+		cpus = 1
+	}
+	cpu := math.Min(health.Load1/float64(cpus), 1)
+	connections := 0.0
+	if maxConnections > 0 {
+		connections = float64(health.Connections) / float64(maxConnections)
+	}
+	return loadWeightCPU*cpu + loadWeightMemory*math.Min(health.MemoryUsed, 1) + loadWeightConnections*connections
+}
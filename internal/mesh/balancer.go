@@ -0,0 +1,126 @@
+package mesh
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// balancer keeps the state load balancing needs between picks: the
+// round-robin position and the current weights of weighted round robin.
+// Active connection counts live on the nodes.
+type balancer struct {
+	next    atomic.Uint64
+	mu      sync.Mutex
+	current map[string]int // Smooth weighted round-robin weights by node ID
+}
+
+// nodeCapacity is a node's weight: its capacity label, 1 when unset
+func nodeCapacity(node *MeshNode) int {
+	if node.Capacity > 0 {
+		return node.Capacity
+	}
+	return 1
+}
+
+// parseCapacity reads the capacity label, 0 when it is not a positive
+// number
+func parseCapacity(labels map[string]string) int {
+	capacity, err := strconv.Atoi(labels["capacity"])
+	if err != nil || capacity < 0 {
+		return 0
+	}
+	return capacity
+}
+
+// sortNodes orders nodes by name and ID, so picks do not depend on map
+// order
+func sortNodes(nodes []*MeshNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Name != nodes[j].Name {
+			return nodes[i].Name < nodes[j].Name
+		}
+		return nodes[i].ID < nodes[j].ID
+	})
+}
+
+// roundRobin picks the nodes in turn
+func (b *balancer) roundRobin(nodes []*MeshNode) *MeshNode {
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[(b.next.Add(1)-1)%uint64(len(nodes))]
+}
+
+// weighted picks the nodes in proportion to their capacity, spread out
+// rather than in runs: each pick raises every node's current weight by its
+// capacity and lowers the chosen one's by the total, as nginx does
+func (b *balancer) weighted(nodes []*MeshNode) *MeshNode {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.current == nil {
+		b.current = make(map[string]int)
+	}
+	present := make(map[string]bool, len(nodes))
+	var best *MeshNode
+	total := 0
+	for _, node := range nodes {
+		present[node.ID] = true
+		capacity := nodeCapacity(node)
+		total += capacity
+		b.current[node.ID] += capacity
+		if best == nil || b.current[node.ID] > b.current[best.ID] {
+			best = node
+		}
+	}
+	for id := range b.current {
+		if !present[id] {
+			delete(b.current, id) // Nodes that left or went down start over
+		}
+	}
+	if best != nil {
+		b.current[best.ID] -= total
+	}
+	return best
+}
+
+// leastConnections picks the node with the fewest active connections for
+// its capacity; the lower latency breaks ties
+func leastConnections(nodes []*MeshNode) *MeshNode {
+	var best *MeshNode
+	for _, node := range nodes {
+		if best == nil {
+			best = node
+			continue
+		}
+		// a/ca < b/cb without division
+		load, bestLoad := node.ActiveConnections*nodeCapacity(best), best.ActiveConnections*nodeCapacity(node)
+		if load < bestLoad || load == bestLoad && nodeLatency(node) < nodeLatency(best) {
+			best = node
+		}
+	}
+	return best
+}
+
+// TrackConnection counts a connection to a node for least-connections
+// balancing until done is called
+func (mn *MeshNetwork) TrackConnection(nodeID string) (done func()) {
+	mn.mu.Lock()
+	if node := mn.nodes[nodeID]; node != nil {
+		node.ActiveConnections++
+	}
+	mn.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			mn.mu.Lock()
+			defer mn.mu.Unlock()
+			if node := mn.nodes[nodeID]; node != nil && node.ActiveConnections > 0 {
+				node.ActiveConnections--
+			}
+		})
+	}
+}
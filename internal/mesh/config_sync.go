@@ -0,0 +1,303 @@
+package mesh
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"ssh-tunnel/internal/config"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Config sections nodes can take from the coordinator
+const (
+	SyncServers    = "servers"     // The server list, credentials included
+	SyncRouting    = "routing"     // The routing rules
+	SyncAuthTokens = "auth_tokens" // The API access tokens
+)
+
+// SyncSections lists the config sections that can be synced
+var SyncSections = []string{SyncServers, SyncRouting, SyncAuthTokens}
+
+// syncKeyLabel starts the additional data of sealed config, which also
+// holds its version, so the coordinator cannot replay an older one under
+// a newer version
+const syncKeyLabel = "ssh-tunnel mesh config v1"
+
+// SyncedConfig is a sealed set of config sections the coordinator hands to
+// every node. It is sealed with a sync key only the operator and the
+// nodes hold: the coordinator keeps and pushes it without being able to
+// read the secrets in it.
+type SyncedConfig struct {
+	Version  uint64    `json:"version"`  // One more than the config it replaces
+	Sections []string  `json:"sections"` // Which sections it holds, in the clear
+	Sealed   []byte    `json:"sealed"`   // 24-byte nonce and XChaCha20-Poly1305 ciphertext of the ConfigSections JSON
+	Updated  time.Time `json:"updated"`
+}
+
+// ConfigSections are the config sections a SyncedConfig carries
+type ConfigSections struct {
+	Servers    []config.Server      `json:"servers,omitempty"`
+	Routing    []config.RoutingRule `json:"routing,omitempty"`
+	AuthTokens []string             `json:"auth_tokens,omitempty"`
+}
+
+// FromConfig takes the named sections of a config
+func FromConfig(cfg *config.Config, sections []string) ConfigSections {
+	var s ConfigSections
+	for _, section := range sections {
+		switch section {
+		case SyncServers:
+			s.Servers = cfg.Servers
+		case SyncRouting:
+			s.Routing = cfg.Routing
+		case SyncAuthTokens:
+			s.AuthTokens = cfg.Security.AuthTokens
+		}
+	}
+	return s
+}
+
+// ApplyTo replaces the named sections of a config
+func (s ConfigSections) ApplyTo(cfg *config.Config, sections []string) {
+	for _, section := range sections {
+		switch section {
+		case SyncServers:
+			cfg.Servers = append([]config.Server(nil), s.Servers...)
+		case SyncRouting:
+			cfg.Routing = append([]config.RoutingRule(nil), s.Routing...)
+		case SyncAuthTokens:
+			cfg.Security.AuthTokens = append([]string(nil), s.AuthTokens...)
+		}
+	}
+}
+
+// ParseSyncSections checks a comma-separated list of sections; empty means
+// every section
+func ParseSyncSections(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return append([]string(nil), SyncSections...), nil
+	}
+	var sections []string
+	for _, section := range strings.Split(list, ",") {
+		section = strings.TrimSpace(section)
+		if !containsString(SyncSections, section) {
+			return nil, fmt.Errorf("unknown config section %q: use %s", section, strings.Join(SyncSections, ", "))
+		}
+		if !containsString(sections, section) {
+			sections = append(sections, section)
+		}
+	}
+	return sections, nil
+}
+
+// GenerateSyncKey returns a new random sync key
+func GenerateSyncKey() (string, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return "msk1" + base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// parseSyncKey decodes a sync key from GenerateSyncKey
+func parseSyncKey(s string) ([]byte, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(s), "msk1")
+	key, err := base64.RawURLEncoding.DecodeString(encoded)
+	if !ok || err != nil || len(key) != chacha20poly1305.KeySize {
+		return nil, fmt.Errorf("invalid sync key: create one with tunnel mesh config keygen")
+	}
+	return key, nil
+}
+
+// syncAD is the additional data of a sealed config
+func syncAD(version uint64, sections []string) []byte {
+	ad := binary.BigEndian.AppendUint64([]byte(syncKeyLabel), version)
+	return append(ad, strings.Join(sections, ",")...)
+}
+
+// SealConfig seals config sections under a sync key as the given version
+func SealConfig(syncKey string, version uint64, sections []string, s ConfigSections) (*SyncedConfig, error) {
+	key, err := parseSyncKey(syncKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX, chacha20poly1305.NonceSizeX+len(plain)+chacha20poly1305.Overhead)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &SyncedConfig{
+		Version:  version,
+		Sections: sections,
+		Sealed:   aead.Seal(nonce, nonce, plain, syncAD(version, sections)),
+		Updated:  time.Now(),
+	}, nil
+}
+
+// Open decrypts the sections with the sync key; it fails on a wrong key or
+// a config tampered with
+func (sc *SyncedConfig) Open(syncKey string) (*ConfigSections, error) {
+	key, err := parseSyncKey(syncKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sc.Sealed) < chacha20poly1305.NonceSizeX {
+		return nil, fmt.Errorf("synced config is truncated")
+	}
+	nonce, sealed := sc.Sealed[:chacha20poly1305.NonceSizeX], sc.Sealed[chacha20poly1305.NonceSizeX:]
+	plain, err := aead.Open(nil, nonce, sealed, syncAD(sc.Version, sc.Sections))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open synced config %d: wrong sync key, or it was tampered with", sc.Version)
+	}
+	var s ConfigSections
+	if err := json.Unmarshal(plain, &s); err != nil {
+		return nil, fmt.Errorf("invalid synced config: %v", err)
+	}
+	return &s, nil
+}
+
+// handleGetConfig serves the sealed config, to admins and nodes
+func (c *Coordinator) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	node := c.authenticateLocked(r)
+	synced := c.syncedConfig
+	c.mu.Unlock()
+
+	if node == nil && !c.authorizeAdmin(w, r) {
+		return
+	}
+	if node != nil && !node.admitted() {
+		writeError(w, http.StatusForbidden, "node is not admitted")
+		return
+	}
+	if synced == nil {
+		writeError(w, http.StatusNotFound, "no config has been pushed")
+		return
+	}
+	writeJSON(w, synced)
+}
+
+// handlePutConfig replaces the sealed config; it must be the version
+// after the current one, so two admins pushing at once do not overwrite
+// each other unnoticed
+func (c *Coordinator) handlePutConfig(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	var synced SyncedConfig
+	if err := json.NewDecoder(r.Body).Decode(&synced); err != nil || len(synced.Sealed) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid synced config")
+		return
+	}
+	for _, section := range synced.Sections {
+		if !containsString(SyncSections, section) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown config section %q", section))
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := uint64(0)
+	if c.syncedConfig != nil {
+		current = c.syncedConfig.Version
+	}
+	if synced.Version != current+1 {
+		writeError(w, http.StatusConflict, fmt.Sprintf("config is at version %d: push version %d", current, current+1))
+		return
+	}
+	synced.Updated = time.Now()
+	c.syncedConfig = &synced
+	log.Printf("Mesh config %d pushed with %s", synced.Version, strings.Join(synced.Sections, ", "))
+	c.bumpLocked()
+	writeJSON(w, synced)
+}
+
+// SyncedConfig returns the sealed config; nil when none has been pushed
+func (a *AdminClient) SyncedConfig() (*SyncedConfig, error) {
+	var synced SyncedConfig
+	if err := a.call(http.MethodGet, "/mesh/v1/config", nil, &synced); err != nil {
+		if CoordinatorStatus(err) == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &synced, nil
+}
+
+// PushConfig seals the sections under the sync key and hands them to the
+// coordinator as the next version
+func (a *AdminClient) PushConfig(syncKey string, sections []string, s ConfigSections) (*SyncedConfig, error) {
+	current, err := a.SyncedConfig()
+	if err != nil {
+		return nil, err
+	}
+	version := uint64(1)
+	if current != nil {
+		version = current.Version + 1
+	}
+	synced, err := SealConfig(syncKey, version, sections, s)
+	if err != nil {
+		return nil, err
+	}
+	var pushed SyncedConfig
+	if err := a.call(http.MethodPut, "/mesh/v1/config", synced, &pushed); err != nil {
+		return nil, err
+	}
+	return &pushed, nil
+}
+
+// OnConfigSync sets the function receiving the config sections the
+// coordinator pushes, once opened with the sync key; it only sees
+// the sections the node takes, and never an older config than the last
+func (mn *MeshNetwork) OnConfigSync(apply func(sections []string, s ConfigSections)) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	mn.configSync = apply
+}
+
+// applySyncedConfigLocked opens a newer pushed config and hands it on
+func (mn *MeshNetwork) applySyncedConfigLocked(synced *SyncedConfig) {
+	if synced == nil || mn.config.SyncKey == "" || synced.Version <= mn.configVersion {
+		return
+	}
+	mn.configVersion = synced.Version
+
+	s, err := synced.Open(mn.config.SyncKey)
+	if err != nil {
+		log.Printf("⚠️  %v", err)
+		return
+	}
+	var sections []string
+	for _, section := range synced.Sections {
+		if len(mn.config.SyncSections) == 0 || containsString(mn.config.SyncSections, section) {
+			sections = append(sections, section)
+		}
+	}
+	if len(sections) == 0 || mn.configSync == nil {
+		return
+	}
+	log.Printf("🔄 Applying mesh config %d: %s", synced.Version, strings.Join(sections, ", "))
+	go mn.configSync(sections, *s)
+}
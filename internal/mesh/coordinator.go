@@ -0,0 +1,924 @@
+package mesh
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"ssh-tunnel/internal/wireguard"
+)
+
+const (
+	// DefaultNodeTTL is how long a node without a heartbeat or an open
+	// update stream stays online
+	DefaultNodeTTL = 90 * time.Second
+
+	// DefaultNodeExpiry is how long an offline node keeps its mesh IP
+	DefaultNodeExpiry = 7 * 24 * time.Hour
+)
+
+// Peer is a mesh member as the coordinator distributes it
+type Peer struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	MeshIP       string            `json:"mesh_ip"`
+	MeshIP6      string            `json:"mesh_ip6,omitempty"` // Its IPv6 ULA address in a dual-stack mesh
+	PublicKey    string            `json:"public_key"`
+	Endpoint     string            `json:"endpoint"` // host:port peers reach the node at
+	Protocols    []string          `json:"protocols,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	Region       string            `json:"region,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Capabilities map[string]bool   `json:"capabilities,omitempty"`
+	Status       string            `json:"status"` // online, offline
+	LastSeen     time.Time         `json:"last_seen"`
+	Routes       []string          `json:"routes,omitempty"`   // Subnets reached through the node, as CIDRs
+	Draining     bool              `json:"draining,omitempty"` // Peers move new traffic elsewhere
+	KeyRotated   time.Time         `json:"key_rotated"`        // When the public key was registered
+
+	// Set by nodes doing NAT traversal
+	LocalEndpoints []string `json:"local_endpoints,omitempty"` // On the node's own networks, for peers behind the same NAT
+	NATType        string   `json:"nat_type,omitempty"`        // See NATCone etc.
+}
+
+// joinMeshIPs returns a node's mesh IPs, for logs
+func joinMeshIPs(meshIP, meshIP6 string) string {
+	if meshIP6 == "" {
+		return meshIP
+	}
+	return meshIP + ", " + meshIP6
+}
+
+// RegisterRequest joins a node to the mesh. The WireGuard public key
+// identifies the node: registering again with the same key keeps its ID
+// and mesh IP.
+type RegisterRequest struct {
+	Name      string   `json:"name"`
+	PublicKey string   `json:"public_key"`
+	Endpoint  string   `json:"endpoint"` // An empty host means the address the coordinator sees
+	Protocols []string `json:"protocols,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Region    string   `json:"region,omitempty"`
+	Routes    []string `json:"routes,omitempty"` // Subnets to advertise, such as the node's LAN
+
+	LocalEndpoints []string `json:"local_endpoints,omitempty"`
+	NATType        string   `json:"nat_type,omitempty"`
+}
+
+// RegisterResponse tells a node its place in the mesh
+type RegisterResponse struct {
+	ID          string `json:"id"`
+	MeshIP      string `json:"mesh_ip"`
+	MeshIP6     string `json:"mesh_ip6,omitempty"`
+	NetworkCIDR string `json:"network_cidr"`      // Both prefixes, IPv4 first, in a dual-stack mesh
+	NodeToken   string `json:"node_token"`        // Authenticates the node's later calls
+	Pending     bool   `json:"pending,omitempty"` // Waiting for manual approval; no peers until then
+
+	// Where to relay packets to peers without a direct path: a relay node,
+	// or the coordinator's own relay when empty, which takes the node
+	// token instead of a relay token
+	Relay      string `json:"relay,omitempty"`
+	RelayToken string `json:"relay_token,omitempty"`
+
+	PeerUpdate
+}
+
+// heartbeatRequest reports a node alive, with what changed about it
+type heartbeatRequest struct {
+	Endpoint string                 `json:"endpoint"`
+	NATType  string                 `json:"nat_type,omitempty"`
+	Latency  map[string]PeerLatency `json:"latency,omitempty"` // Round trips to peers, by peer ID
+	Traffic  map[string]PeerTraffic `json:"traffic,omitempty"` // Data exchanged with peers, by peer ID
+	Events   []MeshEvent            `json:"events,omitempty"`  // Route and path changes since the last heartbeat
+	Health   *NodeHealth            `json:"health,omitempty"`  // From agents
+}
+
+// heartbeatReply acknowledges a heartbeat with the current membership
+// version, relay and peers' health
+type heartbeatReply struct {
+	Version    uint64 `json:"version"`
+	Relay      string `json:"relay,omitempty"`
+	RelayToken string `json:"relay_token,omitempty"`
+
+	Health map[string]*NodeHealth `json:"health,omitempty"` // The latest the online peers' agents reported, by node ID
+}
+
+// PeerUpdate is the membership list, routing policies, ACL rules,
+// services and synced config, pushed to nodes whenever they change
+type PeerUpdate struct {
+	Version  uint64          `json:"version"`
+	Peers    []Peer          `json:"peers"`
+	Policies []RoutingPolicy `json:"policies,omitempty"` // In the order they apply
+	ACLs     []ACLRule       `json:"acls,omitempty"`     // In the order they apply
+	Services []Service       `json:"services,omitempty"`
+	Config   *SyncedConfig   `json:"config,omitempty"` // Sealed; nil until an admin pushes one
+}
+
+// coordinatedNode is a member with its credential
+type coordinatedNode struct {
+	Peer
+	Token string `json:"token"`
+	// The node token replaced by the last key rotation, accepted until it
+	// expires
+	PreviousToken        string    `json:"previous_token,omitempty"`
+	PreviousTokenExpires time.Time `json:"previous_token_expires,omitempty"`
+	TokenID              string    `json:"token_id,omitempty"` // The join token it registered with
+	Approved             bool      `json:"approved"`           // Pending nodes get no peers and are not distributed
+	// Quarantined nodes keep their mesh IP but, like pending ones, get no
+	// peers and are not distributed
+	Quarantined bool `json:"quarantined,omitempty"`
+	// Set once an admin edits the node's metadata, which registering again
+	// then keeps
+	MetadataEdited bool `json:"metadata_edited,omitempty"`
+	Reconnects     int  `json:"reconnects,omitempty"` // Times it came back online
+
+	streams int             // Open update streams, which keep the node online
+	punches chan PunchOffer // For the update streams to deliver
+
+	latency         map[string]PeerLatency // Its row of the latency matrix, by peer ID
+	latencyReported time.Time
+	traffic         map[string]PeerTraffic // As it reported, by peer ID
+	health          *NodeHealth            // As its agent reported
+}
+
+// CoordinatorOptions controls who may join the mesh and manage it
+type CoordinatorOptions struct {
+	// AdminKey authenticates the admin API (tokens and nodes); without it
+	// the admin API only answers on loopback
+	AdminKey string
+
+	// ManualApproval holds newly registered nodes until an admin approves
+	// them, on top of the join token
+	ManualApproval bool
+
+	// RelayURL sends nodes to a designated relay node (tunnel mesh relay)
+	// instead of the coordinator's own relay; RelaySecret, shared with the
+	// relay, signs the relay tokens nodes present to it
+	RelayURL    string
+	RelaySecret string
+
+	// TLSPin is the pin of the certificate the coordinator serves, as
+	// CoordinatorCertificate returns it; join tokens carry it, so nodes
+	// trust a self-signed certificate without further setup
+	TLSPin string
+
+	// ReservedIPs keeps addresses of the mesh network, from-to ranges or
+	// CIDRs, from being handed to nodes, such as gateways on it
+	ReservedIPs []string
+
+	// Store keeps the state instead of the state file, such as a
+	// ConsulStore shared by coordinators on different hosts
+	Store StateStore
+
+	// Standby starts the coordinator standing by, without loading the
+	// state, for one of a highly available set: Activate makes it serve
+	// once elected
+	Standby bool
+}
+
+// Coordinator tracks mesh membership: nodes register with a signed join
+// token, their WireGuard public key and endpoint, get a mesh IP, and
+// receive the other members' keys and endpoints, again whenever membership
+// changes
+type Coordinator struct {
+	network        []netip.Prefix // IPv4 first in a dual-stack mesh
+	adminKey       string
+	manualApproval bool
+	store          StateStore // Nil keeps the state in memory only
+	reservedIPs    []string
+	nodeTTL        time.Duration
+	expiry         time.Duration
+	relay          *Relay // Serves nodes when no relay node is designated
+	ipam           *ipam  // Leases by node ID, rebuilt from the nodes on load
+	relayURL       string
+	relaySecret    string
+	tlsPin         string
+
+	mu           sync.Mutex
+	nodes        map[string]*coordinatedNode // By ID
+	tokens       map[string]*JoinToken       // By ID
+	revoked      map[string]time.Time        // Public keys of removed nodes, when removed
+	signingKey   []byte                      // Signs join tokens
+	version      uint64
+	changed      chan struct{} // Closed and replaced on every membership change
+	history      []NodeEvent   // Oldest first, since the coordinator started
+	events       *EventBus
+	policies     []RoutingPolicy // In the order they apply
+	acls         []ACLRule       // In the order they apply
+	services     []Service
+	syncedConfig *SyncedConfig // Sealed with a key the coordinator does not hold
+	standby      bool          // Serves nothing and holds no state; another coordinator is active
+}
+
+// NewCoordinator creates a coordinator for the mesh network CIDR: an IPv4
+// prefix, an IPv6 ULA prefix, or both separated by a comma, when nodes get
+// an address of each. Members, join tokens and the key signing them are
+// saved to statePath, or options.Store, when set, and loaded from it.
+func NewCoordinator(networkCIDR, statePath string, options CoordinatorOptions) (*Coordinator, error) {
+	network, err := parseMeshNetwork(networkCIDR)
+	if err != nil {
+		return nil, err
+	}
+	if options.RelayURL != "" && options.RelaySecret == "" {
+		return nil, fmt.Errorf("a relay secret is required with a relay URL")
+	}
+
+	c := &Coordinator{
+		network:        network,
+		adminKey:       options.AdminKey,
+		manualApproval: options.ManualApproval,
+		store:          options.Store,
+		reservedIPs:    options.ReservedIPs,
+		relayURL:       options.RelayURL,
+		relaySecret:    options.RelaySecret,
+		tlsPin:         options.TLSPin,
+		nodeTTL:        DefaultNodeTTL,
+		expiry:         DefaultNodeExpiry,
+		nodes:          make(map[string]*coordinatedNode),
+		tokens:         make(map[string]*JoinToken),
+		revoked:        make(map[string]time.Time),
+		changed:        make(chan struct{}),
+		events:         NewEventBus(),
+	}
+	c.relay = NewRelay(c.authenticateRelay)
+	if c.store == nil && statePath != "" {
+		c.store = FileStore(statePath)
+	}
+	if c.ipam, err = newIPAM(networkCIDR, options.ReservedIPs, ""); err != nil {
+		return nil, err
+	}
+	if options.Standby {
+		c.standby = true
+		return c, nil
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	if c.signingKey == nil {
+		c.signingKey = make([]byte, 32)
+		rand.Read(c.signingKey)
+		if err := c.saveLocked(); err != nil {
+			return nil, fmt.Errorf("failed to save mesh state: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// Handler returns the coordinator's HTTP API
+func (c *Coordinator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /mesh/v1/register", c.handleRegister)
+	mux.HandleFunc("POST /mesh/v1/heartbeat", c.handleHeartbeat)
+	mux.HandleFunc("POST /mesh/v1/leave", c.handleLeave)
+	mux.HandleFunc("GET /mesh/v1/peers", c.handlePeers)
+	mux.Handle("GET /mesh/v1/updates", websocket.Server{Handler: c.handleUpdates})
+	mux.HandleFunc("POST /mesh/v1/punch", c.handlePunch)
+	mux.HandleFunc("POST /mesh/v1/rotate", c.handleRotate)
+	mux.HandleFunc("GET /mesh/v1/latency", c.handleLatencyMatrix)
+	mux.Handle("GET "+relayPath, c.relay.Handler())
+
+	// Admin API
+	mux.HandleFunc("POST /mesh/v1/tokens", c.handleCreateToken)
+	mux.HandleFunc("GET /mesh/v1/tokens", c.handleListTokens)
+	mux.HandleFunc("DELETE /mesh/v1/tokens/{id}", c.handleRevokeToken)
+	mux.HandleFunc("GET /mesh/v1/status", c.handleStatus)
+	mux.HandleFunc("GET /mesh/v1/history", c.handleHistory)
+	mux.HandleFunc("GET /mesh/v1/events", c.handleEvents)
+	mux.HandleFunc("GET /mesh/v1/nodes", c.handleListNodes)
+	mux.HandleFunc("POST /mesh/v1/nodes/{id}/approve", c.handleApproveNode)
+	mux.HandleFunc("DELETE /mesh/v1/nodes/{id}", c.handleRemoveNode)
+	mux.HandleFunc("PATCH /mesh/v1/nodes/{id}", c.handleUpdateNode)
+	mux.HandleFunc("POST /mesh/v1/nodes/{id}/drain", c.handleDrainNode)
+	mux.HandleFunc("DELETE /mesh/v1/nodes/{id}/drain", c.handleDrainNode)
+	mux.HandleFunc("POST /mesh/v1/nodes/{id}/quarantine", c.handleQuarantineNode)
+	mux.HandleFunc("DELETE /mesh/v1/nodes/{id}/quarantine", c.handleQuarantineNode)
+	mux.HandleFunc("GET /mesh/v1/policies", c.handleListPolicies)
+	mux.HandleFunc("POST /mesh/v1/policies", c.handleAddPolicy)
+	mux.HandleFunc("DELETE /mesh/v1/policies/{id}", c.handleRemovePolicy)
+	mux.HandleFunc("GET /mesh/v1/acls", c.handleListACLs)
+	mux.HandleFunc("POST /mesh/v1/acls", c.handleAddACL)
+	mux.HandleFunc("DELETE /mesh/v1/acls/{id}", c.handleRemoveACL)
+	mux.HandleFunc("GET /mesh/v1/services", c.handleListServices)
+	mux.HandleFunc("POST /mesh/v1/services", c.handleExposeService)
+	mux.HandleFunc("DELETE /mesh/v1/services/{name}", c.handleRemoveService)
+	mux.HandleFunc("GET /mesh/v1/config", c.handleGetConfig)
+	mux.HandleFunc("PUT /mesh/v1/config", c.handlePutConfig)
+	return c.serveActive(mux)
+}
+
+// Run marks silent nodes offline and forgets expired ones until done is
+// closed
+func (c *Coordinator) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(c.nodeTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		c.mu.Lock()
+		changed := false
+		for _, node := range c.nodes {
+			if node.streams > 0 {
+				continue
+			}
+			silent := now.Sub(node.LastSeen)
+			switch {
+			case silent > c.expiry:
+				log.Printf("Mesh node %s (%s) expired", node.Name, node.MeshIP)
+				c.recordLocked(node, NodeExpired)
+				c.removeNodeLocked(node)
+				changed = true
+			case silent > c.nodeTTL && node.Status == "online":
+				log.Printf("Mesh node %s (%s) went offline", node.Name, node.MeshIP)
+				node.Status = "offline"
+				c.recordLocked(node, NodeOffline)
+				changed = true
+			}
+		}
+		// Nodes generate a key each time they join, so a removed node's
+		// key only needs to be refused until it would have expired
+		for key, removed := range c.revoked {
+			if now.Sub(removed) > c.expiry {
+				delete(c.revoked, key)
+				changed = true
+			}
+		}
+		if changed {
+			c.bumpLocked()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// handleRegister admits a node presenting a join token. A node that
+// registers again with the same public key keeps its ID, mesh IP and
+// approval, but still needs a valid join token.
+func (c *Coordinator) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid registration")
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if _, err := wireguard.ParseKey(req.PublicKey); err != nil {
+		writeError(w, http.StatusBadRequest, "public_key must be a WireGuard public key")
+		return
+	}
+	endpoint, err := observedEndpoint(req.Endpoint, r.RemoteAddr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	routes, err := c.advertisedRoutes(req.Routes)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, revoked := c.revoked[req.PublicKey]; revoked {
+		log.Printf("Mesh registration of %s from %s refused: key was removed", req.Name, r.RemoteAddr)
+		writeError(w, http.StatusForbidden, "node was removed from the mesh; join again with a new key")
+		return
+	}
+
+	var node *coordinatedNode
+	for _, n := range c.nodes {
+		switch {
+		case n.PublicKey == req.PublicKey:
+			node = n
+		case n.Name == req.Name:
+			writeError(w, http.StatusConflict, fmt.Sprintf("name %s is taken by another node", req.Name))
+			return
+		}
+	}
+
+	token, err := c.redeemJoinTokenLocked(bearerToken(r))
+	if err != nil {
+		log.Printf("Mesh registration of %s from %s refused: %v", req.Name, r.RemoteAddr, err)
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	if node == nil {
+		id := "node-" + randomHex(8)
+		meshIPs, err := c.ipam.allocate(id)
+		if err != nil {
+			log.Printf("Mesh registration of %s from %s refused: %v", req.Name, r.RemoteAddr, err)
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		node = &coordinatedNode{
+			Peer: Peer{
+				ID:         id,
+				MeshIP:     meshIPs[0],
+				PublicKey:  req.PublicKey,
+				KeyRotated: time.Now(),
+			},
+			Approved: !c.manualApproval,
+		}
+		if len(meshIPs) > 1 {
+			node.MeshIP6 = meshIPs[1]
+		}
+		c.nodes[node.ID] = node
+		node.Name = req.Name
+		if node.Approved {
+			log.Printf("Mesh node %s joined as %s", req.Name, joinMeshIPs(node.MeshIP, node.MeshIP6))
+			c.recordLocked(node, NodeJoined)
+		} else {
+			log.Printf("Mesh node %s registered as %s, waiting for approval", req.Name, joinMeshIPs(node.MeshIP, node.MeshIP6))
+			c.recordLocked(node, NodeRegistered)
+		}
+	} else if node.Status != "online" {
+		node.Reconnects++
+		c.recordLocked(node, NodeOnline)
+	}
+	node.TokenID = token.ID
+	node.Name = req.Name
+	node.Endpoint = endpoint
+	node.Protocols = req.Protocols
+	if !node.MetadataEdited {
+		node.Tags = req.Tags
+		node.Region = req.Region
+	}
+	node.Routes = routes
+	node.LocalEndpoints = req.LocalEndpoints
+	node.NATType = req.NATType
+	node.Status = "online"
+	node.LastSeen = time.Now()
+	node.Token = randomHex(32)
+	c.bumpLocked()
+
+	response := RegisterResponse{
+		ID:          node.ID,
+		MeshIP:      node.MeshIP,
+		MeshIP6:     node.MeshIP6,
+		NetworkCIDR: formatMeshNetwork(c.network),
+		NodeToken:   node.Token,
+		Pending:     !node.Approved,
+	}
+	if node.admitted() {
+		response.PeerUpdate = c.updateLocked()
+		response.Relay, response.RelayToken = c.relayLocked(node)
+	}
+	writeJSON(w, response)
+}
+
+func (c *Coordinator) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var req heartbeatRequest
+	json.NewDecoder(r.Body).Decode(&req)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.authenticateLocked(r)
+	if node == nil {
+		writeError(w, http.StatusUnauthorized, "unknown node token")
+		return
+	}
+
+	changed := c.touchLocked(node)
+	if req.Endpoint != "" {
+		if endpoint, err := observedEndpoint(req.Endpoint, r.RemoteAddr); err == nil && endpoint != node.Endpoint {
+			node.Endpoint = endpoint
+			changed = true
+		}
+	}
+	if req.NATType != "" && req.NATType != node.NATType {
+		node.NATType = req.NATType
+		changed = true
+	}
+	if req.Latency != nil {
+		node.latency, node.latencyReported = req.Latency, time.Now()
+	}
+	if req.Traffic != nil {
+		node.traffic = req.Traffic
+	}
+	if req.Health != nil {
+		node.health = req.Health
+	}
+	c.publishReportedLocked(node, req.Events)
+	if changed {
+		c.bumpLocked()
+	}
+
+	reply := heartbeatReply{Version: c.version}
+	if node.admitted() {
+		reply.Relay, reply.RelayToken = c.relayLocked(node)
+		reply.Health = c.peerHealthLocked(node)
+	}
+	writeJSON(w, reply)
+}
+
+func (c *Coordinator) handleLeave(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.authenticateLocked(r)
+	if node == nil {
+		writeError(w, http.StatusUnauthorized, "unknown node token")
+		return
+	}
+	log.Printf("Mesh node %s (%s) left", node.Name, node.MeshIP)
+	c.recordLocked(node, NodeLeft)
+	c.removeNodeLocked(node)
+	c.bumpLocked()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *Coordinator) handlePeers(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.authenticateLocked(r)
+	if node == nil {
+		writeError(w, http.StatusUnauthorized, "unknown node token")
+		return
+	}
+	if !node.Approved {
+		writeError(w, http.StatusForbidden, "node is waiting for approval")
+		return
+	}
+	if node.Quarantined {
+		writeError(w, http.StatusForbidden, "node is quarantined")
+		return
+	}
+	writeJSON(w, c.updateLocked())
+}
+
+// handleUpdates pushes the membership list when the stream opens and after
+// every change, from approval on for nodes waiting for it, and hole punch
+// offers. An open stream keeps its node online.
+func (c *Coordinator) handleUpdates(ws *websocket.Conn) {
+	defer ws.Close()
+
+	c.mu.Lock()
+	node := c.authenticateLocked(ws.Request())
+	if node == nil {
+		c.mu.Unlock()
+		websocket.JSON.Send(ws, map[string]string{"error": "unknown node token"})
+		return
+	}
+	id := node.ID
+	node.streams++
+	if c.touchLocked(node) {
+		c.bumpLocked()
+	}
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		if node := c.nodes[id]; node != nil {
+			node.streams--
+			node.LastSeen = time.Now()
+		}
+		c.mu.Unlock()
+	}()
+
+	// The node sends nothing; a failed read means it went away
+	closed := make(chan struct{})
+	go func() {
+		var discard []byte
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+		close(closed)
+	}()
+
+	var sent uint64
+	for {
+		c.mu.Lock()
+		node, ok := c.nodes[id]
+		if !ok {
+			c.mu.Unlock()
+			return // Left, removed or expired
+		}
+		approved := node.Approved
+		update := c.updateLocked()
+		if node.Quarantined {
+			update.Peers = []Peer{} // Cut off from the mesh
+		}
+		changed := c.changed
+		punches := c.punchesLocked(node)
+		c.mu.Unlock()
+
+		if approved && update.Version != sent {
+			if err := websocket.JSON.Send(ws, update); err != nil {
+				return
+			}
+			sent = update.Version
+		}
+
+		select {
+		case <-changed:
+		case offer := <-punches:
+			if err := websocket.JSON.Send(ws, map[string]PunchOffer{"punch": offer}); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// advertisedRoutes checks the subnets a node advertises and returns them
+// in canonical form. Default routes would make the node an exit for all
+// traffic, and subnets overlapping the mesh would take mesh IPs away from
+// their nodes, so both are refused.
+func (c *Coordinator) advertisedRoutes(routes []string) ([]string, error) {
+	var canonical []string
+	for _, route := range routes {
+		_, subnet, err := net.ParseCIDR(route)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q", route)
+		}
+		if ones, _ := subnet.Mask.Size(); ones == 0 {
+			return nil, fmt.Errorf("route %s: default routes are not supported", route)
+		}
+		for _, network := range c.network {
+			if network.Overlaps(netip.MustParsePrefix(subnet.String())) {
+				return nil, fmt.Errorf("route %s overlaps the mesh network %s", route, network)
+			}
+		}
+		if !containsString(canonical, subnet.String()) {
+			canonical = append(canonical, subnet.String())
+		}
+	}
+	return canonical, nil
+}
+
+// relayLocked returns the relay a node should use, and a fresh token for
+// it when it is a relay node
+func (c *Coordinator) relayLocked(node *coordinatedNode) (string, string) {
+	if c.relayURL == "" {
+		return "", ""
+	}
+	return c.relayURL, SignRelayToken(c.relaySecret, node.ID, time.Now().Add(relayTokenTTL))
+}
+
+// peerHealthLocked returns what the agents of a node's online peers last
+// reported, for its load balancing
+func (c *Coordinator) peerHealthLocked(node *coordinatedNode) map[string]*NodeHealth {
+	health := make(map[string]*NodeHealth)
+	for id, peer := range c.nodes {
+		if id != node.ID && peer.admitted() && peer.Status == "online" && peer.health != nil {
+			health[id] = peer.health
+		}
+	}
+	return health
+}
+
+// authenticateRelay admits approved nodes that are not quarantined to the
+// coordinator's own relay with their node token
+func (c *Coordinator) authenticateRelay(r *http.Request) (string, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.authenticateLocked(r)
+	if node == nil || !node.admitted() {
+		return "", time.Time{}, false
+	}
+	return node.ID, time.Time{}, true
+}
+
+// touchLocked records a sign of life, reporting whether the node came back
+// online
+func (c *Coordinator) touchLocked(node *coordinatedNode) bool {
+	node.LastSeen = time.Now()
+	if node.Status == "online" {
+		return false
+	}
+	log.Printf("Mesh node %s (%s) is back online", node.Name, node.MeshIP)
+	node.Status = "online"
+	node.Reconnects++
+	c.recordLocked(node, NodeOnline)
+	return true
+}
+
+// authenticateLocked returns the node a request's token, or its previous
+// token during a key rotation's overlap, belongs to
+func (c *Coordinator) authenticateLocked(r *http.Request) *coordinatedNode {
+	token := bearerToken(r)
+	if token == "" {
+		return nil
+	}
+	now := time.Now()
+	for _, node := range c.nodes {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(node.Token)) == 1 {
+			return node
+		}
+		if node.PreviousToken != "" && now.Before(node.PreviousTokenExpires) &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(node.PreviousToken)) == 1 {
+			return node
+		}
+	}
+	return nil
+}
+
+// admitted reports whether a node takes part in the mesh: it was approved
+// and is not quarantined
+func (n *coordinatedNode) admitted() bool {
+	return n.Approved && !n.Quarantined
+}
+
+// bumpLocked publishes a membership change to update streams and saves it
+func (c *Coordinator) bumpLocked() {
+	c.version++
+	close(c.changed)
+	c.changed = make(chan struct{})
+
+	if err := c.saveLocked(); err != nil {
+		log.Printf("Failed to save mesh state: %v", err)
+	}
+}
+
+func (c *Coordinator) updateLocked() PeerUpdate {
+	peers := make([]Peer, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		if node.admitted() {
+			peers = append(peers, node.Peer)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+	return PeerUpdate{
+		Version:  c.version,
+		Peers:    peers,
+		Policies: append([]RoutingPolicy(nil), c.policies...),
+		ACLs:     append([]ACLRule(nil), c.acls...),
+		Services: c.servicesLocked(),
+		Config:   c.syncedConfig,
+	}
+}
+
+// removeNodeLocked drops a node from the mesh and returns its mesh IP to
+// the pool
+func (c *Coordinator) removeNodeLocked(node *coordinatedNode) {
+	delete(c.nodes, node.ID)
+	c.ipam.release(node.MeshIP)
+	c.ipam.release(node.MeshIP6)
+	c.relay.Drop(node.ID)
+}
+
+// coordinatorState is the saved membership and join tokens
+type coordinatorState struct {
+	Version    uint64               `json:"version"`
+	SigningKey []byte               `json:"signing_key"`
+	Nodes      []*coordinatedNode   `json:"nodes"`
+	Tokens     []*JoinToken         `json:"tokens,omitempty"`
+	Revoked    map[string]time.Time `json:"revoked_keys,omitempty"`
+	Policies   []RoutingPolicy      `json:"policies,omitempty"`
+	ACLs       []ACLRule            `json:"acls,omitempty"`
+	Services   []Service            `json:"services,omitempty"`
+	Config     *SyncedConfig        `json:"config,omitempty"`
+}
+
+func (c *Coordinator) load() error {
+	if c.store == nil {
+		return nil
+	}
+	data, err := c.store.Load()
+	if err != nil {
+		return fmt.Errorf("failed to read mesh state: %v", err)
+	}
+	if data == nil {
+		return nil
+	}
+
+	var state coordinatorState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse mesh state: %v", err)
+	}
+	c.version = state.Version
+	c.signingKey = state.SigningKey
+	c.policies = state.Policies
+	c.acls = state.ACLs
+	c.services = state.Services
+	c.syncedConfig = state.Config
+	for _, token := range state.Tokens {
+		c.tokens[token.ID] = token
+	}
+	for key, removed := range state.Revoked {
+		c.revoked[key] = removed
+	}
+	for _, node := range state.Nodes {
+		if ip, err := netip.ParseAddr(node.MeshIP); err == nil && c.network[0].Contains(ip) {
+			c.nodes[node.ID] = node
+		}
+	}
+
+	// Nodes keep their addresses, even ones reserved since: they are
+	// handed out again only once the nodes leave
+	for id, node := range c.nodes {
+		if err := c.keepAddressLocked(id, node.MeshIP); err != nil {
+			log.Printf("Mesh node %s dropped: %v", node.Name, err)
+			delete(c.nodes, id)
+			continue
+		}
+		if node.MeshIP6 != "" && c.keepAddressLocked(id, node.MeshIP6) != nil {
+			node.MeshIP6 = "" // The IPv6 network changed or went
+		}
+	}
+
+	// Nodes from before the mesh became dual-stack get their IPv6 address
+	for id, node := range c.nodes {
+		if len(c.network) > 1 && node.MeshIP6 == "" {
+			meshIPs, err := c.ipam.allocate(id)
+			if err != nil {
+				log.Printf("⚠️  Mesh node %s has no IPv6 address: %v", node.Name, err)
+				continue
+			}
+			node.MeshIP6 = meshIPs[1]
+		}
+	}
+	return nil
+}
+
+// keepAddressLocked leases a node the address it had when the state was
+// saved, even when reserved since
+func (c *Coordinator) keepAddressLocked(id, ip string) error {
+	if err := c.ipam.claim(ip, id); err == nil {
+		return nil
+	}
+	if err := c.ipam.adopt(ip, id); err != nil {
+		return err
+	}
+	log.Printf("⚠️  Mesh node %s is on reserved address %s: remove it and join again to move it", c.nodes[id].Name, ip)
+	return nil
+}
+
+func (c *Coordinator) saveLocked() error {
+	if c.store == nil || c.standby {
+		return nil // A standby must not overwrite the active coordinator's state
+	}
+
+	state := coordinatorState{Version: c.version, SigningKey: c.signingKey, Revoked: c.revoked, Policies: c.policies, ACLs: c.acls, Services: c.services, Config: c.syncedConfig}
+	for _, node := range c.nodes {
+		state.Nodes = append(state.Nodes, node)
+	}
+	for _, token := range c.tokens {
+		state.Tokens = append(state.Tokens, token)
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return c.store.Save(data)
+}
+
+// observedEndpoint fills an endpoint's missing host with the address the
+// request came from
+func observedEndpoint(endpoint, remoteAddr string) (string, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("endpoint must be host:port")
+	}
+	if host == "" {
+		host, _, _ = net.SplitHostPort(remoteAddr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
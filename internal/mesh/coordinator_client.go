@@ -0,0 +1,433 @@
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	coordinatorTimeout    = 15 * time.Second
+	coordinatorMaxBackoff = time.Minute
+)
+
+// errUnknownNode means the coordinator no longer knows the node's token,
+// for instance after losing its state; the node registers again
+var errUnknownNode = fmt.Errorf("coordinator does not know this node")
+
+// errRemoved means an admin removed the node from the mesh and the
+// coordinator refuses its key
+var errRemoved = fmt.Errorf("node was removed from the mesh")
+
+// joinCoordinator registers the local node and takes its ID and mesh IP,
+// and the current members, from the coordinator
+func (mn *MeshNetwork) joinCoordinator() error {
+	mn.mu.RLock()
+	local := mn.localNode
+	req := RegisterRequest{
+		Name:      local.Name,
+		PublicKey: local.PublicKey,
+		Endpoint:  mn.advertisedEndpoint(),
+		Protocols: local.Protocols,
+		Tags:      local.Tags,
+		Region:    local.Region,
+		Routes:    local.Routes,
+	}
+	mn.mu.RUnlock()
+	if mn.nat != nil {
+		_, req.NATType = mn.nat.status()
+		req.LocalEndpoints = localEndpoints(mn.nat.port)
+	}
+
+	var resp RegisterResponse
+	if err := mn.coordinatorCall(http.MethodPost, "/mesh/v1/register", mn.config.JoinToken, req, &resp); err != nil {
+		if e, ok := err.(*coordinatorError); ok && e.status == http.StatusForbidden {
+			return errRemoved
+		}
+		return fmt.Errorf("failed to register with coordinator: %v", err)
+	}
+
+	u, _ := url.Parse(mn.coordinatorURL())
+
+	mn.mu.Lock()
+	moved := local.ID != resp.ID
+	delete(mn.nodes, local.ID)
+	local.ID = resp.ID
+	local.MeshIP = resp.MeshIP
+	local.MeshIP6 = resp.MeshIP6
+	mn.nodes[local.ID] = local
+	mn.nodeToken = resp.NodeToken
+	mn.config.NetworkCIDR = resp.NetworkCIDR
+	if mn.rotation.LastRotated.IsZero() {
+		mn.rotation.LastRotated = time.Now()
+	}
+	dp := mn.dataPlane
+	mn.peersVersion = 0 // A coordinator that lost its state counts again
+	mn.coordinatorNode = &MeshNode{
+		Name:     "coordinator",
+		PublicIP: u.Hostname(),
+		Status:   "online",
+		LastSeen: time.Now(),
+	}
+	mn.mu.Unlock()
+
+	if mn.relay != nil {
+		mn.relay.set(resp.Relay, resp.RelayToken)
+		if moved {
+			mn.relay.reconnect() // The relay knows the node by its old ID
+		}
+	}
+	if dp != nil {
+		dp.setAddress(resp.MeshIP, resp.MeshIP6, resp.NetworkCIDR)
+	}
+	mn.applyPeers(resp.PeerUpdate)
+	if resp.Pending {
+		log.Printf("⏳ Registered with mesh %s as %s (%s); waiting for approval: tunnel mesh approve %s", resp.NetworkCIDR, local.Name, joinMeshIPs(resp.MeshIP, resp.MeshIP6), local.Name)
+	} else {
+		log.Printf("🌐 Joined mesh %s as %s (%s)", resp.NetworkCIDR, local.Name, joinMeshIPs(resp.MeshIP, resp.MeshIP6))
+	}
+	return nil
+}
+
+// followCoordinator applies the membership updates the coordinator pushes
+// and sends heartbeats, reconnecting and registering again as needed
+func (mn *MeshNetwork) followCoordinator() {
+	go mn.sendHeartbeats()
+
+	backoff := time.Second
+	failovers := 0
+	for {
+		start := time.Now()
+		coordinatorURL := mn.coordinatorURL()
+		err := mn.streamUpdates(coordinatorURL)
+		if mn.ctx.Err() != nil {
+			return
+		}
+
+		mn.mu.Lock()
+		if mn.coordinatorNode != nil {
+			mn.coordinatorNode.Status = "offline"
+		}
+		mn.mu.Unlock()
+
+		if err == errUnknownNode {
+			if err = mn.joinCoordinator(); err == nil {
+				backoff = time.Second
+				continue
+			}
+			if err == errRemoved {
+				log.Printf("🚫 This node was removed from the mesh; it no longer reaches peers")
+				mn.mu.Lock()
+				mn.peersVersion = 0
+				mn.mu.Unlock()
+				mn.applyPeers(PeerUpdate{})
+				return
+			}
+		}
+
+		if time.Since(start) > coordinatorMaxBackoff {
+			backoff, failovers = time.Second, 0
+		}
+		// The other coordinators are tried at once, then in turn after
+		// each wait
+		if coordinatorUnavailable(err) && mn.failOver(coordinatorURL) && failovers < len(coordinatorURLs(mn.config.CoordinatorURL))-1 {
+			failovers++
+			continue
+		}
+		failovers = 0
+		log.Printf("⚠️  Mesh coordinator stream lost: %v; reconnecting in %v", err, backoff)
+		select {
+		case <-mn.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > coordinatorMaxBackoff {
+			backoff = coordinatorMaxBackoff
+		}
+	}
+}
+
+// streamUpdates holds the update stream from a coordinator open until it
+// fails
+func (mn *MeshNetwork) streamUpdates(coordinatorURL string) error {
+	wsConfig, err := websocketConfig(coordinatorURL, "/mesh/v1/updates")
+	if err != nil {
+		return err
+	}
+	wsConfig.TlsConfig = pinnedTLSConfig(mn.coordinatorPin())
+	mn.mu.RLock()
+	wsConfig.Header.Set("Authorization", "Bearer "+mn.nodeToken)
+	mn.mu.RUnlock()
+
+	ws, err := websocket.DialConfig(wsConfig)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	go func() {
+		<-mn.ctx.Done()
+		ws.Close()
+	}()
+
+	mn.mu.Lock()
+	if mn.coordinatorNode != nil {
+		mn.coordinatorNode.Status = "online"
+	}
+	mn.mu.Unlock()
+
+	for {
+		var msg struct {
+			PeerUpdate
+			Punch *PunchOffer `json:"punch"`
+			Error string      `json:"error"`
+		}
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return err
+		}
+		switch {
+		case msg.Error != "":
+			return errUnknownNode
+		case msg.Punch != nil:
+			if mn.nat != nil {
+				go mn.nat.start(*msg.Punch)
+			}
+		default:
+			mn.applyPeers(msg.PeerUpdate)
+		}
+	}
+}
+
+// sendHeartbeats keeps the node online while the update stream is down
+func (mn *MeshNetwork) sendHeartbeats() {
+	interval := mn.config.HealthCheckInterval
+	if interval <= 0 || interval > DefaultNodeTTL/3 {
+		interval = DefaultNodeTTL / 3
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mn.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-mn.reportNow:
+		}
+		mn.sendHeartbeat()
+	}
+}
+
+// sendHeartbeat reports the node alive, with its current endpoint, and
+// takes a fresh relay token
+func (mn *MeshNetwork) sendHeartbeat() {
+	mn.mu.RLock()
+	token := mn.nodeToken
+	mn.mu.RUnlock()
+
+	body := heartbeatRequest{Endpoint: mn.advertisedEndpoint()}
+	if mn.nat != nil {
+		_, body.NATType = mn.nat.status()
+	}
+	mn.mu.Lock()
+	body.Latency = mn.latencyRowLocked()
+	body.Events, mn.reported = mn.reported, nil
+	mn.mu.Unlock()
+	body.Traffic = mn.Traffic()
+	if mn.config.ReportHealth {
+		body.Health = mn.collectHealth()
+	}
+	var reply heartbeatReply
+	err := mn.coordinatorCall(http.MethodPost, "/mesh/v1/heartbeat", token, body, &reply)
+	if err != nil {
+		// Keep the events for the next heartbeat
+		mn.mu.Lock()
+		mn.reported = append(body.Events, mn.reported...)
+		if len(mn.reported) > maxReportedEvents {
+			mn.reported = mn.reported[len(mn.reported)-maxReportedEvents:]
+		}
+		mn.mu.Unlock()
+		if err != errUnknownNode {
+			log.Printf("⚠️  Mesh heartbeat failed: %v", err)
+		}
+		return
+	}
+	if mn.relay != nil {
+		mn.relay.set(reply.Relay, reply.RelayToken)
+	}
+	mn.mu.Lock()
+	for id, node := range mn.nodes {
+		node.health = reply.Health[id]
+	}
+	mn.mu.Unlock()
+}
+
+// leaveCoordinator removes the node from the mesh
+func (mn *MeshNetwork) leaveCoordinator() error {
+	mn.mu.RLock()
+	token := mn.nodeToken
+	mn.mu.RUnlock()
+	return mn.coordinatorCall(http.MethodPost, "/mesh/v1/leave", token, nil, nil)
+}
+
+// applyPeers replaces the known members with the coordinator's list,
+// keeping what was measured locally about members already known
+func (mn *MeshNetwork) applyPeers(update PeerUpdate) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	if update.Version < mn.peersVersion {
+		return // Stale
+	}
+	mn.peersVersion = update.Version
+	mn.policies = update.Policies
+	mn.acls = update.ACLs
+	mn.services = update.Services
+	mn.applySyncedConfigLocked(update.Config)
+
+	seen := map[string]bool{mn.localNode.ID: true}
+	for _, peer := range update.Peers {
+		if peer.ID == mn.localNode.ID {
+			if peer.Draining != mn.localNode.Draining {
+				if peer.Draining {
+					log.Printf("🚧 This node is draining; peers move new traffic elsewhere")
+				} else {
+					log.Printf("✅ This node is no longer draining")
+				}
+				mn.localNode.Draining = peer.Draining
+			}
+			// An admin may have edited what this node is known by
+			mn.localNode.Tags = peer.Tags
+			mn.localNode.Region = peer.Region
+			mn.localNode.Labels = peer.Labels
+			continue
+		}
+		seen[peer.ID] = true
+
+		node, exists := mn.nodes[peer.ID]
+		if !exists {
+			node = &MeshNode{ID: peer.ID, Capabilities: make(map[string]bool)}
+			mn.nodes[peer.ID] = node
+			log.Printf("➕ Mesh peer %s joined (%s)", peer.Name, peer.MeshIP)
+		} else if node.PublicKey != peer.PublicKey {
+			log.Printf("🔑 Mesh peer %s rotated its key", peer.Name)
+		}
+		node.Name = peer.Name
+		node.MeshIP = peer.MeshIP
+		node.MeshIP6 = peer.MeshIP6
+		node.PublicKey = peer.PublicKey
+		node.PublicIP, node.Port = splitEndpoint(peer.Endpoint)
+		node.Protocols = peer.Protocols
+		node.Tags = peer.Tags
+		node.Region = peer.Region
+		node.Labels = peer.Labels
+		node.Capacity = parseCapacity(peer.Labels)
+		if peer.Capabilities != nil {
+			node.Capabilities = peer.Capabilities
+		}
+		node.Status = peer.Status
+		node.LastSeen = peer.LastSeen
+		node.NATType = peer.NATType
+		node.Routes = peer.Routes
+		node.Draining = peer.Draining
+		node.KeyRotated = peer.KeyRotated
+	}
+
+	for id, node := range mn.nodes {
+		if !seen[id] {
+			log.Printf("➖ Mesh peer %s left (%s)", node.Name, node.MeshIP)
+			delete(mn.nodes, id)
+		}
+	}
+	mn.updatePathsLocked()
+	mn.punchPeersLocked()
+	mn.updateSubnetRoutesLocked()
+	if mn.dataPlane != nil {
+		mn.dataPlane.syncPeersLocked()
+	}
+}
+
+// coordinatorCall sends a JSON request to the coordinator on behalf of the
+// node, or the next available of several, and decodes the reply into out,
+// when set
+func (mn *MeshNetwork) coordinatorCall(method, path, token string, in, out interface{}) error {
+	var err error
+	for range coordinatorURLs(mn.config.CoordinatorURL) {
+		coordinatorURL := mn.coordinatorURL()
+		err = callCoordinator(mn.ctx, coordinatorURL, mn.coordinatorPin(), method, path, token, in, out)
+		if !coordinatorUnavailable(err) || mn.ctx.Err() != nil || !mn.failOver(coordinatorURL) {
+			break
+		}
+	}
+	if e, ok := err.(*coordinatorError); ok && e.status == http.StatusUnauthorized && path != "/mesh/v1/register" {
+		return errUnknownNode
+	}
+	return err
+}
+
+// coordinatorError is an error reply from the coordinator
+type coordinatorError struct {
+	status  int
+	message string
+}
+
+func (e *coordinatorError) Error() string {
+	return fmt.Sprintf("coordinator returned %d %s: %s", e.status, http.StatusText(e.status), e.message)
+}
+
+// CoordinatorStatus returns the HTTP status of a request the coordinator
+// refused, or zero when err is not such a refusal
+func CoordinatorStatus(err error) int {
+	if e, ok := err.(*coordinatorError); ok {
+		return e.status
+	}
+	return 0
+}
+
+// callCoordinator sends a JSON request to the coordinator at baseURL,
+// trusted by its certificate pin when set, and decodes the reply into out,
+// when set
+func callCoordinator(ctx context.Context, baseURL, pin, method, path, token string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(baseURL, "/")+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: coordinatorTimeout, Transport: coordinatorTransport(pin)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return &coordinatorError{status: resp.StatusCode, message: e.Error}
+	}
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
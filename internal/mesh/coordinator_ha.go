@@ -0,0 +1,266 @@
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Several coordinators can serve one mesh: they share their state through
+// a StateStore, and an election decides which one is active. Standbys
+// answer 503 and hold no state; the one elected loads the state and takes
+// the nodes over. Nodes and admin clients list every coordinator's URL and
+// move to the next when theirs is unavailable.
+
+// StateStore keeps a coordinator's state where every coordinator of a
+// highly available set reaches it
+type StateStore interface {
+	// Load returns the saved state, nil when there is none
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+// FileStore keeps the state in a file, which coordinators on one host, or
+// sharing a network file system, share
+type FileStore string
+
+func (f FileStore) Load() ([]byte, error) {
+	data, err := os.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Save replaces the file at once, so a reader never sees half a state
+func (f FileStore) Save(data []byte) error {
+	path := string(f)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ConsulStore keeps the state under a key of Consul's KV store, for
+// coordinators on different hosts. Consul takes values of up to 512 KB.
+type ConsulStore struct {
+	Address string // Consul's HTTP address, such as http://127.0.0.1:8500
+	Key     string
+	Token   string // ACL token, when Consul needs one
+}
+
+func (s ConsulStore) Load() ([]byte, error) {
+	resp, err := s.do(http.MethodGet, "?raw", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s ConsulStore) Save(data []byte) error {
+	resp, err := s.do(http.MethodPut, "", data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a KV request, failing on replies other than 200 and 404
+func (s ConsulStore) do(method, query string, body []byte) (*http.Response, error) {
+	u := strings.TrimSuffix(s.Address, "/") + "/v1/kv/" + strings.TrimPrefix(s.Key, "/") + query
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if s.Token != "" {
+		req.Header.Set("X-Consul-Token", s.Token)
+	}
+	client := &http.Client{Timeout: coordinatorTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("consul: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("consul returned %s for %s", resp.Status, s.Key)
+	}
+	return resp, nil
+}
+
+// Standby makes the coordinator stop serving and forget its state, as
+// when it lost an election: the state is the active coordinator's now.
+// Update streams end, so their nodes move to the active one.
+func (c *Coordinator) Standby() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.standby {
+		return
+	}
+	c.standby = true
+	for _, node := range c.nodes {
+		c.relay.Drop(node.ID)
+	}
+	c.resetLocked()
+	close(c.changed) // Streams find their node gone
+	c.changed = make(chan struct{})
+	log.Printf("Mesh coordinator standing by")
+}
+
+// Activate loads the state from the store and serves nodes, as when
+// elected. The membership version moves on, so nodes take the members
+// from this coordinator even when the last one pushed the same version.
+func (c *Coordinator) Activate() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.resetLocked()
+	if err := c.load(); err != nil {
+		return err
+	}
+	if c.signingKey == nil {
+		c.signingKey = make([]byte, 32)
+		rand.Read(c.signingKey)
+	}
+	// Nodes reach this coordinator once they find the last one gone, so
+	// the online ones get a full TTL before going offline
+	now := time.Now()
+	for _, node := range c.nodes {
+		if node.Status == "online" {
+			node.LastSeen = now
+		}
+	}
+	c.standby = false
+	c.bumpLocked()
+	log.Printf("Mesh coordinator active with %d nodes", len(c.nodes))
+	return nil
+}
+
+// Active reports whether the coordinator serves nodes, rather than
+// standing by
+func (c *Coordinator) Active() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.standby
+}
+
+// resetLocked drops the state, keeping the settings
+func (c *Coordinator) resetLocked() {
+	c.nodes = make(map[string]*coordinatedNode)
+	c.tokens = make(map[string]*JoinToken)
+	c.revoked = make(map[string]time.Time)
+	c.signingKey = nil
+	c.policies, c.acls, c.services, c.syncedConfig = nil, nil, nil, nil
+	c.ipam, _ = newIPAM(formatMeshNetwork(c.network), c.reservedIPs, "") // Checked by NewCoordinator
+}
+
+// serveActive answers 503 while the coordinator stands by, so nodes and
+// admins move to the active one
+func (c *Coordinator) serveActive(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.Active() {
+			writeError(w, http.StatusServiceUnavailable, "coordinator is standing by")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// coordinatorURLs splits a list of coordinator URLs, separated by commas
+func coordinatorURLs(list string) []string {
+	var urls []string
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// coordinatorUnavailable reports whether a call failed for want of a
+// coordinator to answer it: unreachable, or standing by
+func coordinatorUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if e, ok := err.(*coordinatorError); ok {
+		return e.status == http.StatusServiceUnavailable || e.status == http.StatusBadGateway || e.status == http.StatusGatewayTimeout
+	}
+	return err != context.Canceled
+}
+
+// coordinatorURL returns the coordinator the node talks to
+func (mn *MeshNetwork) coordinatorURL() string {
+	urls := coordinatorURLs(mn.config.CoordinatorURL)
+	if len(urls) == 0 {
+		return ""
+	}
+	return urls[int(mn.coordinatorIndex.Load())%len(urls)]
+}
+
+// failOver moves the node to the next coordinator once failed is
+// unavailable, unless another call moved it already. It reports whether
+// there was another to move to.
+func (mn *MeshNetwork) failOver(failed string) bool {
+	urls := coordinatorURLs(mn.config.CoordinatorURL)
+	if len(urls) < 2 {
+		return false
+	}
+	current := mn.coordinatorIndex.Load()
+	if urls[int(current)%len(urls)] == failed && mn.coordinatorIndex.CompareAndSwap(current, current+1) {
+		log.Printf("🔁 Mesh coordinator %s is unavailable; failing over to %s", failed, urls[int(current+1)%len(urls)])
+	}
+	return true
+}
+
+// coordinator returns the coordinator an admin client talks to: the one
+// that last answered
+func (a *AdminClient) coordinator() string {
+	urls := coordinatorURLs(a.url)
+	if len(urls) == 0 {
+		return ""
+	}
+	return urls[int(a.current.Load())%len(urls)]
+}
+
+// call sends a request to the coordinators in turn, from the one that last
+// answered, until one is available
+func (a *AdminClient) call(method, path string, in, out interface{}) error {
+	urls := coordinatorURLs(a.url)
+	err := fmt.Errorf("no coordinator URL")
+	for i := range urls {
+		index := (int(a.current.Load()) + i) % len(urls)
+		err = callCoordinator(context.Background(), urls[index], a.pin, method, path, a.key, in, out)
+		if !coordinatorUnavailable(err) {
+			a.current.Store(int32(index))
+			return err
+		}
+	}
+	return err
+}
+
+// failOver moves the client past an unavailable coordinator
+func (a *AdminClient) failOver(failed string) {
+	urls := coordinatorURLs(a.url)
+	current := a.current.Load()
+	if len(urls) > 1 && urls[int(current)%len(urls)] == failed {
+		a.current.CompareAndSwap(current, current+1)
+	}
+}
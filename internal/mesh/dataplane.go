@@ -0,0 +1,394 @@
+package mesh
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/wireguard"
+)
+
+// DefaultInterface is the TUN interface the data plane creates when
+// MeshConfig.Interface is empty
+const DefaultInterface = "mesh0"
+
+// dataPlane carries traffic for mesh IPs: packets the system routes to the
+// mesh interface are encrypted with WireGuard to the peer owning the
+// destination and sent over the peer's path, direct or relayed, and the
+// packets peers send are decrypted onto the interface
+type dataPlane struct {
+	mn     *MeshNetwork
+	tun    *wireguard.TUN
+	device *wireguard.Device
+	done   chan struct{}
+
+	mu        sync.RWMutex
+	addresses []string                 // CIDRs on the interface, IPv4 first
+	byKey     map[wireguard.Key]string // Peer node IDs by public key
+	byIP      map[netip.Addr]wireguard.Key
+	subnets   []subnetRoute               // Longest prefix first
+	acl       map[wireguard.Key][]ACLRule // The rules for each peer's packets; nil lets everything in
+
+	flowsMu sync.Mutex
+	flows   map[flow]time.Time // What this node sent while ACLs apply, for the replies
+
+	routes     *routeManager // Kernel routes through the interface
+	advertised []string      // Subnets forwarded for peers
+	network    string
+}
+
+// subnetRoute sends a subnet to the peer advertising it
+type subnetRoute struct {
+	prefix netip.Prefix
+	key    wireguard.Key
+}
+
+// startDataPlane creates the mesh interface with the local node's mesh
+// IPs and starts moving packets
+func (mn *MeshNetwork) startDataPlane(networkCIDR string) (*dataPlane, error) {
+	mn.mu.RLock()
+	privateKey, meshIP, meshIP6 := mn.localNode.PrivateKey, mn.localNode.MeshIP, mn.localNode.MeshIP6
+	mn.mu.RUnlock()
+
+	private, err := wireguard.ParseKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node key: %v", err)
+	}
+	addresses, err := interfaceAddresses(meshIP, meshIP6, networkCIDR)
+	if err != nil {
+		return nil, err
+	}
+
+	name := mn.config.Interface
+	if name == "" {
+		name = DefaultInterface
+	}
+	mtu := mn.config.MTU
+	if mtu == 0 {
+		mtu = wireguard.DefaultMTU
+	}
+	tun, err := wireguard.OpenTUN(name, addresses, mtu)
+	if err != nil {
+		return nil, err
+	}
+
+	dp := &dataPlane{
+		mn:        mn,
+		tun:       tun,
+		done:      make(chan struct{}),
+		addresses: addresses,
+		byKey:     make(map[wireguard.Key]string),
+		byIP:      make(map[netip.Addr]wireguard.Key),
+		routes:    newRouteManager(name),
+		flows:     make(map[flow]time.Time),
+		network:   networkCIDR,
+	}
+	dp.device = wireguard.NewDevice(private, dp.send, dp.receive)
+
+	mn.mu.RLock()
+	advertised := mn.localNode.Routes
+	mn.mu.RUnlock()
+	if len(advertised) > 0 {
+		if err := enableSubnetRouter(name, networkCIDR, advertised, mn.config.SNATRoutes); err != nil {
+			log.Printf("⚠️  Forwarding to advertised routes may not work: %v", err)
+		}
+		dp.advertised = advertised
+		log.Printf("🛣️  Routing %v for mesh peers", advertised)
+	}
+
+	mn.mu.Lock()
+	mn.dataPlane = dp
+	dp.syncPeersLocked()
+	mn.packetHandler = dp.handle
+	mn.mu.Unlock()
+
+	go dp.device.Run(dp.done)
+	go dp.readTUN()
+
+	log.Printf("🔐 WireGuard data plane up on %s (%s)", name, strings.Join(addresses, ", "))
+	return dp, nil
+}
+
+// interfaceAddresses joins a node's mesh IPs with the prefix lengths of
+// the network's prefixes holding them; meshIP6 is empty unless the mesh is
+// dual-stack
+func interfaceAddresses(meshIP, meshIP6, networkCIDR string) ([]string, error) {
+	network, err := parseMeshNetwork(networkCIDR)
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for _, meshIP := range []string{meshIP, meshIP6} {
+		if meshIP == "" {
+			continue
+		}
+		ip, err := netip.ParseAddr(meshIP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mesh IP %q", meshIP)
+		}
+		for _, prefix := range network {
+			if prefix.Contains(ip) {
+				addresses = append(addresses, netip.PrefixFrom(ip, prefix.Bits()).String())
+			}
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("mesh IP %q is outside the mesh network %s", meshIP, networkCIDR)
+	}
+	return addresses, nil
+}
+
+// setAddress moves the interface to new mesh IPs, as after registering
+// again with a coordinator that lost its state or became dual-stack
+func (dp *dataPlane) setAddress(meshIP, meshIP6, networkCIDR string) {
+	addresses, err := interfaceAddresses(meshIP, meshIP6, networkCIDR)
+	if err != nil {
+		log.Printf("⚠️  %v", err)
+		return
+	}
+
+	dp.mu.Lock()
+	old := dp.addresses
+	dp.addresses = addresses
+	dp.network = networkCIDR
+	dp.mu.Unlock()
+	if strings.Join(addresses, ",") == strings.Join(old, ",") {
+		return
+	}
+	if err := dp.tun.SetAddress(addresses); err != nil {
+		log.Printf("⚠️  Failed to move %s to %s: %v", dp.tun.Name(), strings.Join(addresses, ", "), err)
+	}
+}
+
+// syncPeersLocked makes the WireGuard peers match the known members
+func (dp *dataPlane) syncPeersLocked() {
+	byKey := make(map[wireguard.Key]string)
+	byIP := make(map[netip.Addr]wireguard.Key)
+	for id, node := range dp.mn.nodes {
+		if node == dp.mn.localNode {
+			continue
+		}
+		key, err := wireguard.ParseKey(node.PublicKey)
+		if err != nil {
+			continue
+		}
+		byKey[key] = id
+		for _, meshIP := range []string{node.MeshIP, node.MeshIP6} {
+			if ip, err := netip.ParseAddr(meshIP); err == nil {
+				byIP[ip] = key
+			}
+		}
+	}
+
+	// Subnets the node is on itself stay on the local network
+	var subnets []subnetRoute
+	for _, route := range dp.mn.routes {
+		prefix, err := netip.ParsePrefix(route.Destination)
+		gateway, _ := netip.ParseAddr(route.Gateway)
+		if key, ok := byIP[gateway]; ok && err == nil && !onLocalNetwork(prefix) {
+			subnets = append(subnets, subnetRoute{prefix, key})
+		}
+	}
+	sort.Slice(subnets, func(i, j int) bool { return subnets[i].prefix.Bits() > subnets[j].prefix.Bits() })
+
+	acl := dp.compileACLsLocked(byKey)
+
+	dp.mu.Lock()
+	old := dp.byKey
+	dp.byKey, dp.byIP, dp.subnets, dp.acl = byKey, byIP, subnets, acl
+	dp.mu.Unlock()
+
+	// Peers that rotated their key keep their sessions under the new one
+	oldKeys := make(map[string]wireguard.Key, len(old))
+	for key, id := range old {
+		oldKeys[id] = key
+	}
+	for key, id := range byKey {
+		if previous, ok := oldKeys[id]; ok && previous != key {
+			if _, kept := byKey[previous]; !kept {
+				dp.device.RekeyPeer(previous, key)
+			}
+		}
+	}
+	for key := range old {
+		if _, ok := byKey[key]; !ok {
+			dp.device.RemovePeer(key)
+		}
+	}
+	for key := range byKey {
+		dp.device.AddPeer(key, wireguard.Key{})
+	}
+	dp.syncRoutes(subnets)
+}
+
+// syncRoutes routes the mesh network and the subnets behind peers through
+// the interface
+func (dp *dataPlane) syncRoutes(subnets []subnetRoute) {
+	dp.mu.RLock()
+	prefixes, _ := parseMeshNetwork(dp.network)
+	dp.mu.RUnlock()
+	for _, route := range subnets {
+		prefixes = append(prefixes, route.prefix)
+	}
+	dp.routes.set(prefixes)
+}
+
+// peerFor returns the peer owning an address: the node with that mesh IP,
+// or the one advertising the narrowest subnet containing it
+func (dp *dataPlane) peerFor(addr netip.Addr) (wireguard.Key, bool) {
+	dp.mu.RLock()
+	defer dp.mu.RUnlock()
+
+	if key, ok := dp.byIP[addr]; ok {
+		return key, true
+	}
+	for _, route := range dp.subnets {
+		if route.prefix.Contains(addr) {
+			return route.key, true
+		}
+	}
+	return wireguard.Key{}, false
+}
+
+// readTUN encrypts the packets the system routes to the mesh interface
+func (dp *dataPlane) readTUN() {
+	buf := make([]byte, 65535)
+	for {
+		n, err := dp.tun.Read(buf)
+		if err != nil {
+			select {
+			case <-dp.done:
+			default:
+				log.Printf("⚠️  Mesh interface %s failed: %v", dp.tun.Name(), err)
+			}
+			return
+		}
+
+		dst, ok := destination(buf[:n])
+		if !ok {
+			continue
+		}
+		key, ok := dp.peerFor(dst)
+		if !ok {
+			continue // Neither a member's mesh IP nor behind one
+		}
+		dp.track(buf[:n], dst)
+		dp.device.Send(key, buf[:n])
+	}
+}
+
+// send puts a WireGuard message on the peer's path
+func (dp *dataPlane) send(key wireguard.Key, msg []byte) error {
+	dp.mu.RLock()
+	id, ok := dp.byKey[key]
+	dp.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown mesh peer")
+	}
+	return dp.mn.SendToPeer(id, msg)
+}
+
+// handle passes WireGuard messages from peers to the device
+func (dp *dataPlane) handle(peerID string, packet []byte) {
+	dp.device.HandleMessage(packet)
+}
+
+// receive writes a decrypted packet to the interface when it comes from
+// the peer's mesh IP or a subnet routed through the peer, the only sources
+// a peer is allowed to use, and the ACLs let it in
+func (dp *dataPlane) receive(key wireguard.Key, packet []byte) {
+	src, ok := source(packet)
+	if !ok {
+		return
+	}
+	owner, ok := dp.peerFor(src)
+	if !ok || owner != key || !dp.allowed(key, packet, src) {
+		return
+	}
+	dp.tun.Write(packet)
+}
+
+// connected reports whether a peer has completed a WireGuard handshake
+func (dp *dataPlane) connected(publicKey string) bool {
+	key, err := wireguard.ParseKey(publicKey)
+	if err != nil {
+		return false
+	}
+	for _, peer := range dp.device.Peers() {
+		if peer.PublicKey == key {
+			return !peer.LastHandshake.IsZero()
+		}
+	}
+	return false
+}
+
+// handshake sends a keepalive to a peer, which starts a handshake when
+// there is no session yet
+func (dp *dataPlane) handshake(publicKey string) error {
+	key, err := wireguard.ParseKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("invalid peer key: %v", err)
+	}
+	return dp.device.Send(key, nil)
+}
+
+func (dp *dataPlane) close() {
+	close(dp.done)
+	if len(dp.advertised) > 0 {
+		dp.mu.RLock()
+		network := dp.network
+		dp.mu.RUnlock()
+		disableSubnetRouter(dp.tun.Name(), network, dp.advertised, dp.mn.config.SNATRoutes)
+	}
+	dp.routes.close()
+	dp.tun.Close()
+}
+
+// onLocalNetwork reports whether one of the host's addresses is in prefix
+func onLocalNetwork(prefix netip.Prefix) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipNet.IP); ok && prefix.Contains(ip.Unmap()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// source and destination read the addresses of an IP packet
+func source(packet []byte) (netip.Addr, bool) {
+	return packetAddr(packet, 12, 8)
+}
+
+func destination(packet []byte) (netip.Addr, bool) {
+	return packetAddr(packet, 16, 24)
+}
+
+func packetAddr(packet []byte, v4Offset, v6Offset int) (netip.Addr, bool) {
+	if len(packet) == 0 {
+		return netip.Addr{}, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return netip.Addr{}, false
+		}
+		return netip.AddrFrom4([4]byte(packet[v4Offset : v4Offset+net.IPv4len])), true
+	case 6:
+		if len(packet) < 40 {
+			return netip.Addr{}, false
+		}
+		return netip.AddrFrom16([16]byte(packet[v6Offset : v6Offset+net.IPv6len])), true
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,263 @@
+package mesh
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/wireguard"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Sealed latency probes are "MLE2", a 24-byte nonce and the kind and
+// sequence number sealed with XChaCha20-Poly1305 under a key both peers
+// derive from their WireGuard keys; the sender's public key is the
+// additional data, so a probe cannot be reflected back to its sender
+const (
+	sealedLatencyMagic = "MLE2"
+	sealedLatencySize  = len(sealedLatencyMagic) + chacha20poly1305.NonceSizeX + 1 + 8 + chacha20poly1305.Overhead
+	controlKeyLabel    = "ssh-tunnel mesh control v1"
+)
+
+// CertificatePin returns the pin of a TLS certificate: SHA256: and the
+// unpadded base64 of the SHA-256 of its public key, like SSH fingerprints
+func CertificatePin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// validPin reports whether s looks like a CertificatePin
+func validPin(s string) bool {
+	encoded, ok := strings.CutPrefix(s, "SHA256:")
+	if !ok {
+		return false
+	}
+	sum, err := base64.RawStdEncoding.DecodeString(encoded)
+	return err == nil && len(sum) == sha256.Size
+}
+
+// CoordinatorCertificate loads the coordinator's TLS certificate, or with
+// empty files creates a self-signed one next to the state file and keeps
+// it there, so its pin outlives restarts. It returns the certificate's pin.
+func CoordinatorCertificate(certFile, keyFile, statePath string) (tls.Certificate, string, error) {
+	if certFile == "" {
+		base := strings.TrimSuffix(statePath, ".json")
+		certFile, keyFile = base+"-tls.crt", base+"-tls.key"
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			if err := writeSelfSigned(certFile, keyFile); err != nil {
+				return tls.Certificate{}, "", fmt.Errorf("failed to create a TLS certificate: %v", err)
+			}
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("failed to load the TLS certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("invalid TLS certificate: %v", err)
+	}
+	return cert, CertificatePin(leaf), nil
+}
+
+// writeSelfSigned writes a self-signed ECDSA certificate good for ten
+// years; nodes trust it by its pin rather than its names
+func writeSelfSigned(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "ssh-tunnel mesh coordinator"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// pinnedTLSConfig trusts the server whose certificate has the pin, whoever
+// signed it; without a pin the system's roots decide
+func pinnedTLSConfig(pin string) *tls.Config {
+	if pin == "" {
+		return nil
+	}
+	return &tls.Config{
+		InsecureSkipVerify: true, // Replaced by the pin check
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("coordinator sent no certificate")
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if got := CertificatePin(cert); got != pin {
+				return fmt.Errorf("coordinator certificate %s does not match pin %s, the connection may be intercepted", got, pin)
+			}
+			return nil
+		},
+	}
+}
+
+// pinnedTransports keeps a transport per pin, so connections to the
+// coordinator are reused across calls
+var pinnedTransports sync.Map
+
+// coordinatorTransport returns the HTTP transport for a coordinator
+// trusted by pin; nil, the default transport, without a pin
+func coordinatorTransport(pin string) http.RoundTripper {
+	if pin == "" {
+		return nil
+	}
+	if t, ok := pinnedTransports.Load(pin); ok {
+		return t.(*http.Transport)
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = pinnedTLSConfig(pin)
+	actual, _ := pinnedTransports.LoadOrStore(pin, t)
+	return actual.(*http.Transport)
+}
+
+// checkEncryptedURL refuses a control channel URL that is not TLS
+func checkEncryptedURL(what, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid %s URL: %v", what, err)
+	}
+	if u.Scheme != "https" && u.Scheme != "wss" {
+		return fmt.Errorf("encryption is on but the %s URL %s is not https", what, rawURL)
+	}
+	return nil
+}
+
+// coordinatorPin returns the pin the node trusts the coordinator by: the
+// configured one, or the one its join token carries
+func (mn *MeshNetwork) coordinatorPin() string {
+	if mn.config.CoordinatorPin != "" {
+		return mn.config.CoordinatorPin
+	}
+	return JoinTokenPin(mn.config.JoinToken)
+}
+
+// controlAEAD returns the cipher sealing control messages with a peer
+func (mn *MeshNetwork) controlAEAD(peerID string) (cipher interface {
+	Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+}, local, remote wireguard.Key, err error) {
+	mn.mu.RLock()
+	privateKey := mn.localNode.PrivateKey
+	var publicKey string
+	if node := mn.nodes[peerID]; node != nil {
+		publicKey = node.PublicKey
+	}
+	mn.mu.RUnlock()
+
+	private, err := wireguard.ParseKey(privateKey)
+	if err != nil {
+		return nil, local, remote, fmt.Errorf("invalid node key: %v", err)
+	}
+	remote, err = wireguard.ParseKey(publicKey)
+	if err != nil {
+		return nil, local, remote, fmt.Errorf("invalid key of peer %s", peerID)
+	}
+	shared, err := curve25519.X25519(private[:], remote[:])
+	if err != nil {
+		return nil, local, remote, err
+	}
+	key := blake2s.Sum256(append([]byte(controlKeyLabel), shared...))
+	aead, err := chacha20poly1305.NewX(key[:])
+	return aead, private.PublicKey(), remote, err
+}
+
+// sealLatencyPacket seals a latency probe for a peer
+func (mn *MeshNetwork) sealLatencyPacket(peerID string, kind byte, seq uint64) ([]byte, error) {
+	aead, local, _, err := mn.controlAEAD(peerID)
+	if err != nil {
+		return nil, err
+	}
+	packet := make([]byte, len(sealedLatencyMagic)+chacha20poly1305.NonceSizeX, sealedLatencySize)
+	copy(packet, sealedLatencyMagic)
+	nonce := packet[len(sealedLatencyMagic):]
+	rand.Read(nonce)
+	plain := latencyPacket(kind, seq)[len(latencyMagic):]
+	return aead.Seal(packet, nonce, plain, local[:]), nil
+}
+
+// openLatencyPacket opens a sealed latency probe from a peer
+func (mn *MeshNetwork) openLatencyPacket(peerID string, packet []byte) (kind byte, seq uint64, ok bool) {
+	if len(packet) != sealedLatencySize || string(packet[:len(sealedLatencyMagic)]) != sealedLatencyMagic {
+		return 0, 0, false
+	}
+	aead, _, remote, err := mn.controlAEAD(peerID)
+	if err != nil {
+		return 0, 0, false
+	}
+	nonce := packet[len(sealedLatencyMagic) : len(sealedLatencyMagic)+chacha20poly1305.NonceSizeX]
+	plain, err := aead.Open(nil, nonce, packet[len(nonce)+len(sealedLatencyMagic):], remote[:])
+	if err != nil {
+		return 0, 0, false
+	}
+	return parseLatencyPacket(append([]byte(latencyMagic), plain...))
+}
+
+// isLatencyPacket reports whether a packet from a peer is a latency probe,
+// sealed or not, rather than traffic for the packet handler
+func isLatencyPacket(packet []byte) bool {
+	_, _, plain := parseLatencyPacket(packet)
+	return plain || len(packet) == sealedLatencySize && string(packet[:len(sealedLatencyMagic)]) == sealedLatencyMagic
+}
+
+// latencyPacketFor returns a latency probe for a peer, sealed when
+// encryption is on
+func (mn *MeshNetwork) latencyPacketFor(peerID string, kind byte, seq uint64) ([]byte, error) {
+	if mn.config.Encryption {
+		return mn.sealLatencyPacket(peerID, kind, seq)
+	}
+	return latencyPacket(kind, seq), nil
+}
+
+// openLatency reads a latency probe from a peer; with encryption on,
+// plaintext probes are refused
+func (mn *MeshNetwork) openLatency(peerID string, packet []byte) (kind byte, seq uint64, ok bool) {
+	if mn.config.Encryption {
+		return mn.openLatencyPacket(peerID, packet)
+	}
+	return parseLatencyPacket(packet)
+}
@@ -0,0 +1,367 @@
+package mesh
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Mesh event types. Node events come from the coordinator; route and path
+// events from the node they happened on, through its heartbeats.
+const (
+	EventNodeJoined     = "node_joined"
+	EventNodeRegistered = "node_registered" // Waiting for approval
+	EventNodeOnline     = "node_online"
+	EventNodeOffline    = "node_offline"
+	EventNodeLeft       = "node_left"
+	EventNodeRemoved    = "node_removed"
+	EventNodeExpired    = "node_expired"
+	EventNodeUpdated    = "node_updated"
+	EventRouteChanged   = "route_changed" // A subnet moved to another gateway, or lost its last one
+	EventFailover       = "failover"      // Traffic to a peer left a degraded direct path
+	EventPathChanged    = "path_changed"  // Traffic to a peer took another path otherwise
+)
+
+const (
+	// recentMeshEvents is how many events a bus keeps for subscribers
+	// catching up after a reconnect
+	recentMeshEvents = 256
+
+	// meshSubscriberBuffer is how far a subscriber may fall behind before
+	// it is dropped and has to catch up from the recent events
+	meshSubscriberBuffer = 64
+
+	// maxReportedEvents bounds the events a node holds for its next
+	// heartbeat while the coordinator is unreachable
+	maxReportedEvents = 100
+)
+
+// MeshEvent is a change of the mesh's state
+type MeshEvent struct {
+	ID      uint64    `json:"id"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	NodeID  string    `json:"node_id,omitempty"` // The node it is about, or that saw it
+	Node    string    `json:"node,omitempty"`
+	MeshIP  string    `json:"mesh_ip,omitempty"`
+	Peer    string    `json:"peer,omitempty"`    // For path events
+	Path    string    `json:"path,omitempty"`    // The path traffic takes now; empty for none
+	Subnet  string    `json:"subnet,omitempty"`  // For route events
+	Gateway string    `json:"gateway,omitempty"` // Mesh IP the subnet goes through now; empty for none
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// String describes an event for logs
+func (e MeshEvent) String() string {
+	switch e.Type {
+	case EventRouteChanged:
+		if e.Gateway == "" {
+			return fmt.Sprintf("%s: no gateway left for %s", e.Node, e.Subnet)
+		}
+		return fmt.Sprintf("%s: %s now through %s", e.Node, e.Subnet, e.Gateway)
+	case EventFailover, EventPathChanged:
+		path := e.Path
+		if path == "" {
+			path = "no path"
+		}
+		s := fmt.Sprintf("%s: %s over %s", e.Node, e.Peer, path)
+		if e.Reason != "" {
+			s += " (" + e.Reason + ")"
+		}
+		return s
+	}
+	return fmt.Sprintf("%s (%s)", e.Node, e.MeshIP)
+}
+
+// MatchesEventType reports whether an event type is among types, which
+// may also name a category such as "node" for every node event; empty
+// types match everything
+func MatchesEventType(types []string, eventType string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, t := range types {
+		if t == eventType || strings.HasPrefix(eventType, t+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// EventBus numbers mesh events and fans them out to subscribers
+type EventBus struct {
+	mu     sync.Mutex
+	nextID uint64
+	recent []MeshEvent
+	subs   map[chan MeshEvent]struct{}
+}
+
+// NewEventBus creates an empty bus
+func NewEventBus() *EventBus {
+	return &EventBus{
+		nextID: 1,
+		subs:   make(map[chan MeshEvent]struct{}),
+	}
+}
+
+// Publish numbers and delivers an event, returning it as delivered
+func (b *EventBus) Publish(event MeshEvent) MeshEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	event.ID = b.nextID
+	b.nextID++
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.recent = append(b.recent, event)
+	if len(b.recent) > recentMeshEvents {
+		b.recent = b.recent[len(b.recent)-recentMeshEvents:]
+	}
+
+	for ch := range b.subs {
+		select {
+		case ch <- event:
+		default:
+			// Too slow: drop it rather than block publishers
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	return event
+}
+
+// Subscribe returns the recent events after since, then a channel of new
+// ones. The channel is closed when the subscriber falls behind; it should
+// resubscribe from the last ID it saw. An ID not handed out yet was seen
+// before a restart, and replays every recent event.
+func (b *EventBus) Subscribe(since uint64) ([]MeshEvent, <-chan MeshEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if since != ^uint64(0) && since >= b.nextID {
+		since = 0
+	}
+
+	var backlog []MeshEvent
+	for _, event := range b.recent {
+		if event.ID > since {
+			backlog = append(backlog, event)
+		}
+	}
+
+	ch := make(chan MeshEvent, meshSubscriberBuffer)
+	b.subs[ch] = struct{}{}
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	return backlog, ch, cancel
+}
+
+// Events returns the bus of the events seen on this node: its path and
+// route changes
+func (mn *MeshNetwork) Events() *EventBus {
+	return mn.events
+}
+
+// publishLocked publishes an event seen on this node and queues it for the
+// coordinator, sending it with a heartbeat right away
+func (mn *MeshNetwork) publishLocked(event MeshEvent) {
+	if mn.localNode != nil {
+		event.NodeID, event.Node, event.MeshIP = mn.localNode.ID, mn.localNode.Name, mn.localNode.MeshIP
+	}
+	event = mn.events.Publish(event)
+
+	if mn.config.CoordinatorURL == "" {
+		return
+	}
+	mn.reported = append(mn.reported, event)
+	if len(mn.reported) > maxReportedEvents {
+		mn.reported = mn.reported[len(mn.reported)-maxReportedEvents:]
+	}
+	select {
+	case mn.reportNow <- struct{}{}:
+	default:
+	}
+}
+
+// publishNodeLocked publishes a node event on the coordinator's bus
+func (c *Coordinator) publishNodeLocked(node *coordinatedNode, eventType string) {
+	c.events.Publish(MeshEvent{
+		Type:   eventType,
+		NodeID: node.ID,
+		Node:   node.Name,
+		MeshIP: node.MeshIP,
+	})
+}
+
+// publishReportedLocked republishes the events a node reported
+func (c *Coordinator) publishReportedLocked(node *coordinatedNode, events []MeshEvent) {
+	for _, event := range events {
+		if !strings.HasPrefix(event.Type, "node_") {
+			event.NodeID, event.Node, event.MeshIP = node.ID, node.Name, node.MeshIP
+			c.events.Publish(event)
+		}
+	}
+}
+
+// Events returns the coordinator's bus of mesh events
+func (c *Coordinator) Events() *EventBus {
+	return c.events
+}
+
+// handleEvents streams mesh events to admins: over a WebSocket as JSON
+// messages when the client asks to upgrade, and as server-sent events
+// otherwise. ?since=<id> first replays the recent events after that ID;
+// ?types= takes a comma-separated list of event types or categories.
+func (c *Coordinator) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	since := uint64(0)
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid since")
+			return
+		}
+	} else {
+		since = ^uint64(0) // Only new events
+	}
+	var types []string
+	if t := r.URL.Query().Get("types"); t != "" {
+		types = strings.Split(t, ",")
+	}
+
+	backlog, ch, cancel := c.events.Subscribe(since)
+	defer cancel()
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		websocket.Server{Handler: func(ws *websocket.Conn) {
+			streamEvents(r.Context(), backlog, ch, types, func(event MeshEvent) error {
+				return websocket.JSON.Send(ws, event)
+			})
+		}}.ServeHTTP(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	streamEvents(r.Context(), backlog, ch, types, func(event MeshEvent) error {
+		data, _ := json.Marshal(event)
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+}
+
+// streamEvents sends the backlog, then new events, until the client goes
+// away or falls behind
+func streamEvents(ctx context.Context, backlog []MeshEvent, ch <-chan MeshEvent, types []string, send func(MeshEvent) error) {
+	for _, event := range backlog {
+		if MatchesEventType(types, event.Type) {
+			if send(event) != nil {
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return // Fell behind or shutting down
+			}
+			if MatchesEventType(types, event.Type) && send(event) != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// FollowEvents calls fn with every mesh event after since, in order, until
+// ctx is done or the stream ends; since zero starts with the recent
+// events. It returns the ID of the last event passed to fn, to resume
+// from.
+func (a *AdminClient) FollowEvents(ctx context.Context, since uint64, types []string, fn func(MeshEvent)) (uint64, error) {
+	query := url.Values{"since": {strconv.FormatUint(since, 10)}}
+	if len(types) > 0 {
+		query.Set("types", strings.Join(types, ","))
+	}
+	coordinator := a.coordinator()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(coordinator, "/")+"/mesh/v1/events?"+query.Encode(), nil)
+	if err != nil {
+		return since, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if a.key != "" {
+		req.Header.Set("Authorization", "Bearer "+a.key)
+	}
+
+	client := &http.Client{Transport: coordinatorTransport(a.pin)}
+	resp, err := client.Do(req)
+	if err != nil {
+		a.failOver(coordinator)
+		return since, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		err := &coordinatorError{status: resp.StatusCode, message: e.Error}
+		if coordinatorUnavailable(err) {
+			a.failOver(coordinator)
+		}
+		return since, err
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event MeshEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return since, fmt.Errorf("invalid mesh event: %v", err)
+		}
+		since = event.ID
+		fn(event)
+	}
+	if ctx.Err() != nil {
+		return since, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return since, err
+	}
+	return since, fmt.Errorf("event stream closed")
+}
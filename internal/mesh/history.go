@@ -0,0 +1,76 @@
+package mesh
+
+import (
+	"net/http"
+	"time"
+)
+
+// historySize bounds the node events the coordinator keeps in memory
+const historySize = 500
+
+// Node events in the coordinator's history
+const (
+	NodeJoined     = "joined"
+	NodeRegistered = "registered" // Joined, waiting for approval
+	NodeOnline     = "online"
+	NodeOffline    = "offline"
+	NodeLeft       = "left"
+	NodeRemoved    = "removed"
+	NodeExpired    = "expired"
+	NodeUpdated    = "updated" // An admin edited its metadata
+)
+
+// NodeEvent is a change of a node's membership or status
+type NodeEvent struct {
+	Time   time.Time `json:"time"`
+	NodeID string    `json:"node_id"`
+	Node   string    `json:"node"`
+	MeshIP string    `json:"mesh_ip"`
+	Event  string    `json:"event"`
+}
+
+// recordLocked adds a node event to the history, dropping the oldest
+// beyond historySize, and publishes it
+func (c *Coordinator) recordLocked(node *coordinatedNode, event string) {
+	c.history = append(c.history, NodeEvent{
+		Time:   time.Now(),
+		NodeID: node.ID,
+		Node:   node.Name,
+		MeshIP: node.MeshIP,
+		Event:  event,
+	})
+	if len(c.history) > historySize {
+		c.history = append([]NodeEvent(nil), c.history[len(c.history)-historySize:]...)
+	}
+	c.publishNodeLocked(node, "node_"+event)
+}
+
+// handleHistory serves the node events since the coordinator started,
+// oldest first, to admins; ?node= takes a node ID or name
+func (c *Coordinator) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	filter := r.URL.Query().Get("node")
+	c.mu.Lock()
+	history := make([]NodeEvent, 0, len(c.history))
+	for _, event := range c.history {
+		if filter == "" || event.NodeID == filter || event.Node == filter {
+			history = append(history, event)
+		}
+	}
+	c.mu.Unlock()
+
+	writeJSON(w, history)
+}
+
+// History returns the node events since the coordinator started, oldest
+// first
+func (a *AdminClient) History() ([]NodeEvent, error) {
+	var history []NodeEvent
+	if err := a.call(http.MethodGet, "/mesh/v1/history", nil, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
@@ -0,0 +1,361 @@
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IPLease is a mesh IP handed to a node
+type IPLease struct {
+	IP        string    `json:"ip"`
+	Owner     string    `json:"owner"` // Node ID or name
+	Allocated time.Time `json:"allocated"`
+}
+
+// AddressUsage summarizes a mesh network's addresses
+type AddressUsage struct {
+	Total    int `json:"total"` // Usable host addresses
+	Leased   int `json:"leased"`
+	Reserved int `json:"reserved"`
+	Free     int `json:"free"`
+}
+
+// ulaPrefix holds the IPv6 unique local addresses, which like RFC1918
+// addresses are not routed on the internet but rarely collide with the
+// networks of corporate VPNs
+var ulaPrefix = netip.MustParsePrefix("fc00::/7")
+
+// parseMeshNetwork parses a mesh network: an IPv4 prefix, an IPv6 ULA
+// prefix, or one of each separated by a comma for a dual-stack mesh, which
+// are returned IPv4 first
+func parseMeshNetwork(network string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, part := range strings.Split(network, ",") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid mesh network: %v", err)
+		}
+		prefix = prefix.Masked()
+		if prefix.Addr().Is6() && !ulaPrefix.Contains(prefix.Addr()) {
+			return nil, fmt.Errorf("invalid mesh network %s: IPv6 mesh networks must be unique local addresses, in fc00::/7", prefix)
+		}
+		if len(prefixes) > 0 && prefixes[0].Addr().Is6() == prefix.Addr().Is6() {
+			return nil, fmt.Errorf("invalid mesh network %s: use one IPv4 and one IPv6 prefix at most", network)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return prefixes[i].Addr().Is4() })
+	return prefixes, nil
+}
+
+// formatMeshNetwork joins the prefixes of a mesh network
+func formatMeshNetwork(prefixes []netip.Prefix) string {
+	parts := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		parts[i] = prefix.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// ipam hands out the host addresses of a mesh network, lowest first: one
+// of each of its prefixes to every owner. It never hands out the network
+// or broadcast address of an IPv4 prefix (bar /31 and /32, where every
+// address is a host), the subnet-router anycast address of an IPv6 one, or
+// a reserved address. With a path it keeps its leases there, so nodes get
+// their addresses back after a restart. It is not safe for concurrent
+// use: callers hold their lock.
+type ipam struct {
+	prefixes []netip.Prefix // IPv4 first
+	reserved map[netip.Addr]bool
+	leases   map[netip.Addr]IPLease
+	path     string
+}
+
+// newIPAM returns the IPAM of network, without the reserved addresses
+// (addresses, from-to ranges or CIDRs), loading its leases from path when
+// set
+func newIPAM(network string, reserved []string, path string) (*ipam, error) {
+	prefixes, err := parseMeshNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	p := &ipam{
+		prefixes: prefixes,
+		reserved: make(map[netip.Addr]bool),
+		leases:   make(map[netip.Addr]IPLease),
+		path:     path,
+	}
+	for _, spec := range reserved {
+		if err := p.reserve(spec); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// reserve keeps an address, a from-to range or a CIDR out of the pool
+func (p *ipam) reserve(spec string) error {
+	spec = strings.TrimSpace(spec)
+	var from, to netip.Addr
+	var err error
+	switch {
+	case strings.Contains(spec, "/"):
+		var prefix netip.Prefix
+		if prefix, err = netip.ParsePrefix(spec); err == nil {
+			from, to = prefix.Masked().Addr(), lastAddr(prefix)
+		}
+	case strings.Contains(spec, "-"):
+		lo, hi, _ := strings.Cut(spec, "-")
+		if from, err = netip.ParseAddr(strings.TrimSpace(lo)); err == nil {
+			to, err = netip.ParseAddr(strings.TrimSpace(hi))
+		}
+	default:
+		from, err = netip.ParseAddr(spec)
+		to = from
+	}
+	if err != nil || !from.IsValid() || !to.IsValid() || to.Less(from) {
+		return fmt.Errorf("invalid reserved address %q: use an address, a from-to range or a CIDR", spec)
+	}
+	if prefix, ok := p.prefixOf(from); !ok || !prefix.Contains(to) {
+		return fmt.Errorf("reserved address %q is outside the mesh network %s", spec, formatMeshNetwork(p.prefixes))
+	}
+	if size := rangeSize(from, to); size.Cmp(big.NewInt(1<<16)) > 0 {
+		return fmt.Errorf("reserved range %q is too large: reserve at most 65536 addresses", spec)
+	}
+	for addr := from; ; addr = addr.Next() {
+		if p.host(addr) {
+			p.reserved[addr] = true
+		}
+		if addr == to {
+			return nil
+		}
+	}
+}
+
+// prefixOf returns the prefix of the network holding an address
+func (p *ipam) prefixOf(addr netip.Addr) (netip.Prefix, bool) {
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// host reports whether an address is a host address of the network
+func (p *ipam) host(addr netip.Addr) bool {
+	prefix, ok := p.prefixOf(addr)
+	switch {
+	case !ok:
+		return false
+	case addr.Is4() && prefix.Bits() < 31:
+		return addr != prefix.Addr() && addr != lastAddr(prefix) // Not the network or broadcast address
+	case addr.Is6() && prefix.Bits() < 128:
+		return addr != prefix.Addr() // Not the subnet-router anycast address
+	}
+	return true
+}
+
+// usable reports whether an address may be handed out
+func (p *ipam) usable(addr netip.Addr) bool {
+	return p.host(addr) && !p.reserved[addr]
+}
+
+// allocate leases owner the lowest free address of each prefix, or
+// returns the ones it already holds, IPv4 first
+func (p *ipam) allocate(owner string) ([]string, error) {
+	held := make(map[netip.Prefix]netip.Addr)
+	for addr, lease := range p.leases {
+		if prefix, ok := p.prefixOf(addr); ok && lease.Owner == owner {
+			held[prefix] = addr
+		}
+	}
+	ips := make([]string, 0, len(p.prefixes))
+	for _, prefix := range p.prefixes {
+		addr, ok := held[prefix]
+		if !ok {
+			var err error
+			if addr, err = p.allocateIn(prefix, owner); err != nil {
+				return nil, err
+			}
+		}
+		ips = append(ips, addr.String())
+	}
+	if len(held) < len(p.prefixes) {
+		return ips, p.save()
+	}
+	return ips, nil
+}
+
+// allocateIn leases the lowest free address of a prefix to owner
+func (p *ipam) allocateIn(prefix netip.Prefix, owner string) (netip.Addr, error) {
+	if usage := p.usageOf(prefix); usage.Free <= 0 {
+		return netip.Addr{}, fmt.Errorf("mesh network %s is full: %d addresses leased, %d reserved", prefix, usage.Leased, usage.Reserved)
+	}
+	for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+		if _, leased := p.leases[addr]; !leased && p.usable(addr) {
+			p.leases[addr] = IPLease{IP: addr.String(), Owner: owner, Allocated: time.Now()}
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("mesh network %s is full", prefix)
+}
+
+// claim leases a given address to owner, as when restoring a node that
+// already had it
+func (p *ipam) claim(ip, owner string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("invalid mesh IP %q", ip)
+	}
+	if !p.usable(addr) {
+		return fmt.Errorf("%s is reserved or not a host address of %s", ip, formatMeshNetwork(p.prefixes))
+	}
+	if lease, ok := p.leases[addr]; ok && lease.Owner != owner {
+		return fmt.Errorf("%s is leased to %s", ip, lease.Owner)
+	}
+	if _, ok := p.leases[addr]; !ok {
+		p.leases[addr] = IPLease{IP: ip, Owner: owner, Allocated: time.Now()}
+	}
+	return p.save()
+}
+
+// adopt leases an address to owner even when it is reserved, for a node
+// that had it before the reservation
+func (p *ipam) adopt(ip, owner string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !p.host(addr) {
+		return fmt.Errorf("%s is not a host address of %s", ip, formatMeshNetwork(p.prefixes))
+	}
+	if lease, ok := p.leases[addr]; ok && lease.Owner != owner {
+		return fmt.Errorf("%s is leased to %s", ip, lease.Owner)
+	}
+	p.leases[addr] = IPLease{IP: ip, Owner: owner, Allocated: time.Now()}
+	return p.save()
+}
+
+// release returns an address to the pool
+func (p *ipam) release(ip string) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return
+	}
+	if _, ok := p.leases[addr]; ok {
+		delete(p.leases, addr)
+		p.save()
+	}
+}
+
+// usage counts the addresses of the network's first prefix, the one to
+// run out first in a dual-stack mesh
+func (p *ipam) usage() AddressUsage {
+	return p.usageOf(p.prefixes[0])
+}
+
+// usageOf counts the addresses of one of the network's prefixes
+func (p *ipam) usageOf(prefix netip.Prefix) AddressUsage {
+	hosts := rangeSize(prefix.Addr(), lastAddr(prefix))
+	for _, addr := range []netip.Addr{prefix.Addr(), lastAddr(prefix)} {
+		if !p.host(addr) {
+			hosts.Sub(hosts, big.NewInt(1))
+		}
+	}
+	usage := AddressUsage{Total: math.MaxInt32}
+	for addr := range p.leases {
+		if prefix.Contains(addr) {
+			usage.Leased++
+		}
+	}
+	for addr := range p.reserved {
+		if _, leased := p.leases[addr]; !leased && prefix.Contains(addr) {
+			usage.Reserved++ // Adopted addresses count as leased
+		}
+	}
+	if hosts.IsInt64() && hosts.Int64() < math.MaxInt32 {
+		usage.Total = int(hosts.Int64())
+	}
+	usage.Free = usage.Total - usage.Reserved - usage.Leased
+	return usage
+}
+
+// list returns the leases in address order
+func (p *ipam) list() []IPLease {
+	leases := make([]IPLease, 0, len(p.leases))
+	for _, lease := range p.leases {
+		leases = append(leases, lease)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return netip.MustParseAddr(leases[i].IP).Less(netip.MustParseAddr(leases[j].IP))
+	})
+	return leases
+}
+
+func (p *ipam) load() error {
+	if p.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read mesh leases: %v", err)
+	}
+	var leases []IPLease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return fmt.Errorf("failed to parse mesh leases: %v", err)
+	}
+	for _, lease := range leases {
+		// Leases of another network, or of addresses reserved since, lapse
+		if addr, err := netip.ParseAddr(lease.IP); err == nil && p.usable(addr) {
+			p.leases[addr] = lease
+		}
+	}
+	return nil
+}
+
+func (p *ipam) save() error {
+	if p.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(p.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0700); err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+// lastAddr returns the last address of a prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Masked().Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
+
+// rangeSize returns how many addresses from-to holds
+func rangeSize(from, to netip.Addr) *big.Int {
+	lo := new(big.Int).SetBytes(from.AsSlice())
+	hi := new(big.Int).SetBytes(to.AsSlice())
+	return hi.Sub(hi, lo).Add(hi, big.NewInt(1))
+}
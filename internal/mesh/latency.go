@@ -0,0 +1,372 @@
+package mesh
+
+import (
+	"encoding/binary"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Latency probes travel on every path to a peer, direct and relayed, like
+// WireGuard's own messages, so each path is timed and traffic can move to
+// the better one
+const (
+	latencyMagic    = "MLE1"
+	latencyRequest  = 1
+	latencyReply    = 2
+	latencySize     = len(latencyMagic) + 1 + 8 // Then the sequence number
+	latencyInterval = 5 * time.Second
+	latencyTimeout  = 2 * time.Second // Unanswered this long, a probe is lost
+	latencyWindow   = 12              // Probes kept per peer, a minute's worth
+
+	// unmeasuredLatency ranks nodes nothing was measured to behind every
+	// measured one
+	unmeasuredLatency = time.Second
+
+	// A subnet moves to a faster gateway only when it is this much faster,
+	// so routes do not flap with jitter
+	routeSwitchMargin = 0.25
+	routeSwitchMin    = 5 * time.Millisecond
+)
+
+// lostProbe marks a window slot whose probe got no answer
+const lostProbe time.Duration = -1
+
+// PeerLatency is the round trip to a peer over the last probes
+type PeerLatency struct {
+	RTT     time.Duration `json:"rtt"`            // Average of the answered probes
+	MinRTT  time.Duration `json:"min_rtt"`        // Zero when none was answered
+	Loss    float64       `json:"loss"`           // Fraction unanswered, 0-1
+	Samples int           `json:"samples"`        // Probes in the window
+	Path    string        `json:"path,omitempty"` // The path measured, the one traffic takes
+}
+
+// LatencyMatrix holds the round trips between every pair of members, as
+// each member measured them and reported them to the coordinator
+type LatencyMatrix struct {
+	Nodes   []MatrixNode                      `json:"nodes"`   // Ordered by name
+	Latency map[string]map[string]PeerLatency `json:"latency"` // From node ID, to node ID
+}
+
+// MatrixNode names a row and column of a LatencyMatrix
+type MatrixNode struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Reported time.Time `json:"reported,omitempty"` // When its row arrived; zero without one
+}
+
+// latencyTracker times probes to peers and keeps a window of results for
+// each of their paths
+type latencyTracker struct {
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]pendingProbe
+	windows map[string]map[string][]time.Duration // RTTs or lostProbe by peer ID and path, oldest first
+}
+
+type pendingProbe struct {
+	peerID string
+	path   string
+	sent   time.Time
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{
+		pending: make(map[uint64]pendingProbe),
+		windows: make(map[string]map[string][]time.Duration),
+	}
+}
+
+func latencyPacket(kind byte, seq uint64) []byte {
+	packet := make([]byte, 0, latencySize)
+	packet = append(packet, latencyMagic...)
+	packet = append(packet, kind)
+	return binary.BigEndian.AppendUint64(packet, seq)
+}
+
+func parseLatencyPacket(packet []byte) (kind byte, seq uint64, ok bool) {
+	if len(packet) != latencySize || string(packet[:len(latencyMagic)]) != latencyMagic {
+		return 0, 0, false
+	}
+	kind = packet[len(latencyMagic)]
+	if kind != latencyRequest && kind != latencyReply {
+		return 0, 0, false
+	}
+	return kind, binary.BigEndian.Uint64(packet[len(latencyMagic)+1:]), true
+}
+
+// record adds a result to the window of a peer's path
+func (lt *latencyTracker) record(peerID, path string, rtt time.Duration) {
+	paths := lt.windows[peerID]
+	if paths == nil {
+		paths = make(map[string][]time.Duration)
+		lt.windows[peerID] = paths
+	}
+	window := append(paths[path], rtt)
+	if len(window) > latencyWindow {
+		window = window[len(window)-latencyWindow:]
+	}
+	paths[path] = window
+}
+
+// stats summarizes the window of a peer's path; ok is false before any
+// probe answered
+func (lt *latencyTracker) stats(peerID, path string) (stats PeerLatency, ok bool) {
+	window := lt.windows[peerID][path]
+	stats.Path = path
+	var total time.Duration
+	answered := 0
+	for _, rtt := range window {
+		if rtt == lostProbe {
+			continue
+		}
+		total += rtt
+		answered++
+		if stats.MinRTT == 0 || rtt < stats.MinRTT {
+			stats.MinRTT = rtt
+		}
+	}
+	stats.Samples = len(window)
+	if len(window) > 0 {
+		stats.Loss = float64(len(window)-answered) / float64(len(window))
+	}
+	if answered > 0 {
+		stats.RTT = total / time.Duration(answered)
+	}
+	return stats, answered > 0
+}
+
+// measureLatency probes every path to every peer until the mesh stops,
+// and ranks nodes, picks their paths and picks subnet gateways with the
+// results
+func (mn *MeshNetwork) measureLatency() {
+	ticker := time.NewTicker(mn.probeInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mn.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		mn.expireLatencyProbes()
+
+		type target struct{ peerID, path string }
+		var targets []target
+		mn.mu.RLock()
+		for id, node := range mn.nodes {
+			if node == mn.localNode {
+				continue
+			}
+			for _, path := range mn.availablePathsLocked(node) {
+				targets = append(targets, target{id, path})
+			}
+		}
+		mn.mu.RUnlock()
+
+		lt := mn.latency
+		for _, t := range targets {
+			lt.mu.Lock()
+			lt.seq++
+			seq := lt.seq
+			lt.pending[seq] = pendingProbe{peerID: t.peerID, path: t.path, sent: time.Now()}
+			lt.mu.Unlock()
+
+			packet, err := mn.latencyPacketFor(t.peerID, latencyRequest, seq)
+			if err == nil {
+				err = mn.sendOnPath(t.peerID, t.path, packet)
+			}
+			if err != nil {
+				lt.mu.Lock()
+				delete(lt.pending, seq) // The path went away; nothing was lost
+				lt.mu.Unlock()
+			}
+		}
+	}
+}
+
+// expireLatencyProbes counts probes unanswered for latencyTimeout as lost
+// and forgets peers that left
+func (mn *MeshNetwork) expireLatencyProbes() {
+	lt := mn.latency
+	now := time.Now()
+	var lost []string
+	lt.mu.Lock()
+	for seq, probe := range lt.pending {
+		if now.Sub(probe.sent) > latencyTimeout {
+			delete(lt.pending, seq)
+			lt.record(probe.peerID, probe.path, lostProbe)
+			lost = append(lost, probe.peerID)
+		}
+	}
+	lt.mu.Unlock()
+
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	lt.mu.Lock()
+	for id := range lt.windows {
+		if _, ok := mn.nodes[id]; !ok {
+			delete(lt.windows, id)
+		}
+	}
+	lt.mu.Unlock()
+	if len(lost) > 0 {
+		mn.applyLatencyLocked(lost...)
+	}
+}
+
+// handleLatencyPacket answers a peer's probe on the path it came on, so
+// the probe times that path both ways, or times the answer to one of ours
+func (mn *MeshNetwork) handleLatencyPacket(peerID, path string, packet []byte) {
+	kind, seq, ok := mn.openLatency(peerID, packet)
+	if !ok || mn.latency == nil {
+		return
+	}
+	if kind == latencyRequest {
+		if reply, err := mn.latencyPacketFor(peerID, latencyReply, seq); err == nil {
+			mn.sendOnPath(peerID, path, reply)
+		}
+		return
+	}
+
+	lt := mn.latency
+	lt.mu.Lock()
+	probe, ok := lt.pending[seq]
+	if !ok || probe.peerID != peerID {
+		lt.mu.Unlock()
+		return // Late, or not ours
+	}
+	delete(lt.pending, seq)
+	lt.record(peerID, probe.path, time.Since(probe.sent))
+	lt.mu.Unlock()
+
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	mn.applyLatencyLocked(peerID)
+}
+
+// applyLatencyLocked moves peers off paths that stopped answering or
+// degraded, updates their latency and loss from the path they are on, and
+// the subnet routes when a gateway should change
+func (mn *MeshNetwork) applyLatencyLocked(peerIDs ...string) {
+	mn.updatePathsLocked()
+
+	lt := mn.latency
+	lt.mu.Lock()
+	for _, id := range peerIDs {
+		node := mn.nodes[id]
+		if node == nil {
+			continue
+		}
+		stats, answered := lt.stats(id, node.Path)
+		node.PacketLoss = stats.Loss
+		node.Latency = 0
+		if answered {
+			node.Latency = stats.RTT
+		}
+	}
+	lt.mu.Unlock()
+
+	before := make(map[string]string, len(mn.routes))
+	for subnet, route := range mn.routes {
+		before[subnet] = route.Gateway
+	}
+	mn.updateSubnetRoutesLocked()
+	changed := len(before) != len(mn.routes)
+	for subnet, route := range mn.routes {
+		if before[subnet] != route.Gateway {
+			changed = true
+			log.Printf("🛣️  Routing %s through %s", subnet, route.Gateway)
+		}
+	}
+	if changed && mn.dataPlane != nil {
+		mn.dataPlane.syncPeersLocked()
+	}
+}
+
+// latencyRowLocked returns the node's measurements to each peer, for the
+// coordinator's matrix
+func (mn *MeshNetwork) latencyRowLocked() map[string]PeerLatency {
+	if mn.latency == nil {
+		return nil
+	}
+	lt := mn.latency
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	row := make(map[string]PeerLatency, len(lt.windows))
+	for id := range lt.windows {
+		node := mn.nodes[id]
+		if node == nil {
+			continue
+		}
+		if stats, _ := lt.stats(id, node.Path); stats.Samples > 0 {
+			row[id] = stats
+		}
+	}
+	return row
+}
+
+// PeerLatencies returns the node's measurements to its peers, by peer ID
+func (mn *MeshNetwork) PeerLatencies() map[string]PeerLatency {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+	return mn.latencyRowLocked()
+}
+
+// nodeLatency is the latency nodes are ranked by: the measured one, or
+// unmeasuredLatency before anything was measured
+func nodeLatency(node *MeshNode) time.Duration {
+	if node.Latency <= 0 {
+		return unmeasuredLatency
+	}
+	return node.Latency
+}
+
+// fasterGateway reports whether a candidate subnet gateway is enough
+// faster than the current one to move the route
+func fasterGateway(candidate, current *MeshNode) bool {
+	c, cur := nodeLatency(candidate), nodeLatency(current)
+	return cur-c > routeSwitchMin && float64(cur-c) > routeSwitchMargin*float64(cur)
+}
+
+// handleLatencyMatrix serves the latency matrix to admins and members
+func (c *Coordinator) handleLatencyMatrix(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	node := c.authenticateLocked(r)
+	c.mu.Unlock()
+	if node == nil && !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	matrix := LatencyMatrix{Latency: make(map[string]map[string]PeerLatency)}
+	for id, n := range c.nodes {
+		if !n.admitted() {
+			continue
+		}
+		matrix.Nodes = append(matrix.Nodes, MatrixNode{ID: id, Name: n.Name, Reported: n.latencyReported})
+		row := make(map[string]PeerLatency, len(n.latency))
+		for peer, stats := range n.latency {
+			if _, ok := c.nodes[peer]; ok {
+				row[peer] = stats
+			}
+		}
+		matrix.Latency[id] = row
+	}
+	sort.Slice(matrix.Nodes, func(i, j int) bool { return matrix.Nodes[i].Name < matrix.Nodes[j].Name })
+	writeJSON(w, matrix)
+}
+
+// LatencyMatrix returns the round trips between every pair of members
+func (a *AdminClient) LatencyMatrix() (*LatencyMatrix, error) {
+	var matrix LatencyMatrix
+	if err := a.call(http.MethodGet, "/mesh/v1/latency", nil, &matrix); err != nil {
+		return nil, err
+	}
+	return &matrix, nil
+}
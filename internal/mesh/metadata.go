@@ -0,0 +1,141 @@
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+)
+
+// NodeMetadataUpdate edits what a node is known by after it joined. Fields
+// left out stay as they are.
+type NodeMetadataUpdate struct {
+	Region       *string           `json:"region,omitempty"`       // An empty region clears it
+	Tags         []string          `json:"tags,omitempty"`         // Replaces the tags
+	AddTags      []string          `json:"add_tags,omitempty"`     // Then added
+	RemoveTags   []string          `json:"remove_tags,omitempty"`  // Then removed
+	Labels       map[string]string `json:"labels,omitempty"`       // Set; an empty value removes the label
+	Capabilities map[string]bool   `json:"capabilities,omitempty"` // Set; false removes the flag
+}
+
+// metadataName matches tags, label keys and capability names
+var metadataName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._/-]*$`)
+
+// validate checks the names an update sets
+func (u NodeMetadataUpdate) validate() error {
+	if u.Region != nil && *u.Region != "" && !metadataName.MatchString(*u.Region) {
+		return fmt.Errorf("invalid region %q", *u.Region)
+	}
+	for _, tags := range [][]string{u.Tags, u.AddTags, u.RemoveTags} {
+		for _, tag := range tags {
+			if !metadataName.MatchString(tag) {
+				return fmt.Errorf("invalid tag %q", tag)
+			}
+		}
+	}
+	for key := range u.Labels {
+		if !metadataName.MatchString(key) {
+			return fmt.Errorf("invalid label %q", key)
+		}
+	}
+	for name := range u.Capabilities {
+		if !metadataName.MatchString(name) {
+			return fmt.Errorf("invalid capability %q", name)
+		}
+	}
+	return nil
+}
+
+// apply edits a node's metadata
+func (u NodeMetadataUpdate) apply(peer *Peer) {
+	if u.Region != nil {
+		peer.Region = *u.Region
+	}
+	if u.Tags != nil {
+		peer.Tags = nil
+		u.AddTags = append(append([]string(nil), u.Tags...), u.AddTags...)
+	}
+	for _, tag := range u.AddTags {
+		if !containsString(peer.Tags, tag) {
+			peer.Tags = append(peer.Tags, tag)
+		}
+	}
+	if len(u.RemoveTags) > 0 {
+		tags := peer.Tags[:0:0]
+		for _, tag := range peer.Tags {
+			if !containsString(u.RemoveTags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		peer.Tags = tags
+	}
+	sort.Strings(peer.Tags)
+
+	for key, value := range u.Labels {
+		if value == "" {
+			delete(peer.Labels, key)
+			continue
+		}
+		if peer.Labels == nil {
+			peer.Labels = make(map[string]string)
+		}
+		peer.Labels[key] = value
+	}
+	for name, on := range u.Capabilities {
+		if !on {
+			delete(peer.Capabilities, name)
+			continue
+		}
+		if peer.Capabilities == nil {
+			peer.Capabilities = make(map[string]bool)
+		}
+		peer.Capabilities[name] = true
+	}
+}
+
+// handleUpdateNode edits a node's region, tags, labels and capabilities.
+// They then stick: registering again keeps them instead of what the node
+// declares.
+func (c *Coordinator) handleUpdateNode(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	var update NodeMetadataUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid node update")
+		return
+	}
+	if err := update.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.findNodeLocked(r.PathValue("id"))
+	if node == nil {
+		writeError(w, http.StatusNotFound, "unknown node")
+		return
+	}
+	update.apply(&node.Peer)
+	node.MetadataEdited = true
+	log.Printf("Mesh node %s (%s) updated: region %q, tags %v, labels %v, capabilities %v",
+		node.Name, node.MeshIP, node.Region, node.Tags, node.Labels, node.Capabilities)
+	c.recordLocked(node, NodeUpdated)
+	c.bumpLocked()
+	writeJSON(w, node.info())
+}
+
+// UpdateNode edits a node's metadata, by ID or name
+func (a *AdminClient) UpdateNode(node string, update NodeMetadataUpdate) (*NodeInfo, error) {
+	var info NodeInfo
+	if err := a.call(http.MethodPatch, "/mesh/v1/nodes/"+url.PathEscape(node), update, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
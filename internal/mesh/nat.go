@@ -0,0 +1,470 @@
+package mesh
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NAT types a node reports after STUN discovery
+const (
+	NATNone      = "none"      // The node has a public address of its own
+	NATCone      = "cone"      // One mapping for all destinations; hole punching works
+	NATSymmetric = "symmetric" // A mapping per destination; punching only works if the peer is not symmetric too
+	NATUnknown   = "unknown"   // Fewer than two STUN servers answered
+)
+
+// DefaultSTUNServers are used when MeshConfig.STUNServers is empty
+var DefaultSTUNServers = []string{"stun.l.google.com:19302", "stun.cloudflare.com:3478"}
+
+const (
+	stunTimeout     = 3 * time.Second
+	stunRefresh     = time.Minute // Also keeps the NAT mapping alive
+	punchInterval   = 200 * time.Millisecond
+	punchTimeout    = 10 * time.Second
+	punchRetry      = 2 * time.Minute  // Before punching to the same peer again
+	directKeepalive = 25 * time.Second // Under common NAT UDP timeouts
+	directTimeout   = 90 * time.Second // Without probes before a direct path counts as lost
+)
+
+// natTraversal owns the node's UDP port: it learns the port's public
+// endpoint with STUN and punches holes to peers through it, so WireGuard
+// can reach them directly even when both are behind NAT
+type natTraversal struct {
+	mn      *MeshNetwork
+	conn    *net.UDPConn
+	port    int
+	servers []string
+
+	mu             sync.Mutex
+	publicEndpoint string // As STUN sees it
+	natType        string
+	stunWaiters    map[stunTxID]chan *net.UDPAddr
+	sessions       map[string]*punchSession // By session ID
+	attempts       map[string]time.Time     // Last punch started, by peer ID
+}
+
+// punchSession is a hole punch to one peer, kept as long as the direct path
+// lives to send keepalives over it
+type punchSession struct {
+	id         []byte
+	key        []byte
+	peerID     string
+	peerName   string
+	candidates []*net.UDPAddr
+	endpoint   *net.UDPAddr // Where the peer's probes come from, once any did
+	lastSeen   time.Time    // Of a probe from endpoint
+	confirmed  chan struct{}
+}
+
+// newNATTraversal binds the node's UDP port, the port of its endpoint
+func newNATTraversal(mn *MeshNetwork) (*natTraversal, error) {
+	_, port := splitEndpoint(mn.config.Endpoint)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind UDP port %d: %v", port, err)
+	}
+
+	servers := mn.config.STUNServers
+	if len(servers) == 0 {
+		servers = DefaultSTUNServers
+	}
+	nt := &natTraversal{
+		mn:          mn,
+		conn:        conn,
+		port:        conn.LocalAddr().(*net.UDPAddr).Port,
+		servers:     servers,
+		natType:     NATUnknown,
+		stunWaiters: make(map[stunTxID]chan *net.UDPAddr),
+		sessions:    make(map[string]*punchSession),
+		attempts:    make(map[string]time.Time),
+	}
+	go nt.read()
+	return nt, nil
+}
+
+func (nt *natTraversal) close() {
+	nt.conn.Close()
+}
+
+// read dispatches the packets arriving on the port
+func (nt *natTraversal) read() {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := nt.conn.ReadFromUDP(buf)
+		if err != nil {
+			return // Closed
+		}
+		packet := buf[:n]
+
+		if isSTUN(packet) {
+			id, mapped, ok := parseSTUNResponse(packet)
+			if !ok {
+				continue
+			}
+			nt.mu.Lock()
+			if waiter, ok := nt.stunWaiters[id]; ok {
+				delete(nt.stunWaiters, id)
+				waiter <- mapped
+			}
+			nt.mu.Unlock()
+			continue
+		}
+
+		if kind, session, ok := parsePunchPacket(packet); ok {
+			nt.handleProbe(kind, session, packet, from)
+			continue
+		}
+		nt.mn.deliverDirect(from, packet)
+	}
+}
+
+// discover asks the STUN servers for the port's public endpoint and
+// classifies the NAT by whether two servers see the same one
+func (nt *natTraversal) discover() {
+	var mapped []*net.UDPAddr
+	for _, server := range nt.servers {
+		addr, err := nt.bind(server)
+		if err != nil {
+			log.Printf("⚠️  STUN: %v", err)
+			continue
+		}
+		if mapped = append(mapped, addr); len(mapped) == 2 {
+			break
+		}
+	}
+	if len(mapped) == 0 {
+		log.Printf("⚠️  No STUN server answered; peers will use the configured endpoint")
+		return
+	}
+
+	natType := NATUnknown
+	switch {
+	case isLocalIP(mapped[0].IP):
+		natType = NATNone
+	case len(mapped) == 2 && mapped[0].String() == mapped[1].String():
+		natType = NATCone
+	case len(mapped) == 2:
+		natType = NATSymmetric
+	}
+
+	nt.mu.Lock()
+	changed := nt.publicEndpoint != mapped[0].String() || nt.natType != natType
+	nt.publicEndpoint = mapped[0].String()
+	nt.natType = natType
+	nt.mu.Unlock()
+
+	if changed {
+		log.Printf("🧭 Public endpoint %s (NAT: %s)", mapped[0], natType)
+	}
+}
+
+// bind sends a binding request to a STUN server, retrying as UDP may lose
+// it
+func (nt *natTraversal) bind(server string) (*net.UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", server, err)
+	}
+
+	id, request := newSTUNRequest()
+	answer := make(chan *net.UDPAddr, 1)
+	nt.mu.Lock()
+	nt.stunWaiters[id] = answer
+	nt.mu.Unlock()
+	defer func() {
+		nt.mu.Lock()
+		delete(nt.stunWaiters, id)
+		nt.mu.Unlock()
+	}()
+
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err := nt.conn.WriteToUDP(request, addr); err != nil {
+			return nil, fmt.Errorf("failed to send to %s: %v", server, err)
+		}
+		select {
+		case mapped := <-answer:
+			return mapped, nil
+		case <-time.After(stunTimeout / 3):
+		}
+	}
+	return nil, fmt.Errorf("no answer from %s", server)
+}
+
+// status returns the public endpoint, empty until STUN answered, and the
+// NAT type
+func (nt *natTraversal) status() (string, string) {
+	nt.mu.Lock()
+	defer nt.mu.Unlock()
+	return nt.publicEndpoint, nt.natType
+}
+
+// run refreshes the public endpoint, keeps direct paths alive and retries
+// punches until the mesh stops
+func (nt *natTraversal) run() {
+	refresh := time.NewTicker(stunRefresh)
+	defer refresh.Stop()
+	keepalive := time.NewTicker(directKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-nt.mn.ctx.Done():
+			return
+		case <-refresh.C:
+			before, _ := nt.status()
+			nt.discover()
+			if after, _ := nt.status(); after != before && nt.mn.config.CoordinatorURL != "" {
+				nt.mn.sendHeartbeat()
+			}
+		case <-keepalive.C:
+			nt.keepalive()
+			nt.mn.mu.Lock()
+			nt.mn.punchPeersLocked()
+			nt.mn.mu.Unlock()
+		}
+	}
+}
+
+// shouldPunch reports whether to start a punch to peer, and if so counts
+// it as attempted. Of two peers the one with the lower ID starts it.
+func (nt *natTraversal) shouldPunch(local, peer *MeshNode) bool {
+	if peer.Status != "online" || peer.NATType == "" || peer.DirectEndpoint != "" || local.ID >= peer.ID {
+		return false
+	}
+
+	nt.mu.Lock()
+	defer nt.mu.Unlock()
+
+	if nt.natType == NATSymmetric && peer.NATType == NATSymmetric {
+		return false // Neither side can predict the other's mapping
+	}
+	if time.Since(nt.attempts[peer.ID]) < punchRetry {
+		return false
+	}
+	nt.attempts[peer.ID] = time.Now()
+	return true
+}
+
+// punch asks the coordinator to start a hole punch with a peer. A peer
+// not connected to the coordinator yet is tried again on the next
+// keepalive.
+func (nt *natTraversal) punch(peerID, peerName string) {
+	nt.mn.mu.RLock()
+	token := nt.mn.nodeToken
+	nt.mn.mu.RUnlock()
+
+	var offer PunchOffer
+	err := nt.mn.coordinatorCall(http.MethodPost, "/mesh/v1/punch", token, map[string]string{"peer_id": peerID}, &offer)
+	if e, ok := err.(*coordinatorError); ok && e.status == http.StatusConflict {
+		nt.mu.Lock()
+		delete(nt.attempts, peerID)
+		nt.mu.Unlock()
+		return
+	}
+	if err != nil {
+		log.Printf("⚠️  Hole punch to %s not started: %v", peerName, err)
+		return
+	}
+	nt.start(offer)
+}
+
+// start sends probes to the peer's endpoints until one answers or the
+// punch times out
+func (nt *natTraversal) start(offer PunchOffer) {
+	id, err := hex.DecodeString(offer.Session)
+	if err != nil || len(id) != punchIDLen {
+		log.Printf("⚠️  Invalid hole punch offer from the coordinator")
+		return
+	}
+	key, err := hex.DecodeString(offer.Key)
+	if err != nil || len(key) != punchKeySize {
+		log.Printf("⚠️  Invalid hole punch offer from the coordinator")
+		return
+	}
+	session := &punchSession{
+		id:        id,
+		key:       key,
+		peerID:    offer.PeerID,
+		peerName:  offer.PeerName,
+		confirmed: make(chan struct{}),
+	}
+	for _, endpoint := range offer.Endpoints {
+		if addr, err := net.ResolveUDPAddr("udp4", endpoint); err == nil {
+			session.candidates = append(session.candidates, addr)
+		}
+	}
+	if len(session.candidates) == 0 {
+		log.Printf("⚠️  Hole punch to %s: no usable endpoint", offer.PeerName)
+		return
+	}
+
+	nt.mu.Lock()
+	for sid, other := range nt.sessions {
+		if other.peerID == session.peerID {
+			delete(nt.sessions, sid) // Superseded
+		}
+	}
+	nt.sessions[offer.Session] = session
+	nt.mu.Unlock()
+
+	ping := punchPacket(punchPing, session.id, session.key)
+	ticker := time.NewTicker(punchInterval)
+	defer ticker.Stop()
+	timeout := time.After(punchTimeout)
+	for {
+		for _, addr := range session.candidates {
+			nt.conn.WriteToUDP(ping, addr)
+		}
+		select {
+		case <-session.confirmed:
+			return
+		case <-nt.mn.ctx.Done():
+			return
+		case <-timeout:
+			nt.mu.Lock()
+			if nt.sessions[offer.Session] == session {
+				delete(nt.sessions, offer.Session)
+			}
+			nt.mu.Unlock()
+			log.Printf("⚠️  Hole punch to %s failed; retrying in %v", offer.PeerName, punchRetry)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleProbe answers a peer's probe and takes the address the first one
+// came from as the direct path to the peer. The path only moves when the
+// peer's probes stop coming from it, as when its NAT maps it anew.
+func (nt *natTraversal) handleProbe(kind byte, sessionID string, packet []byte, from *net.UDPAddr) {
+	nt.mu.Lock()
+	session := nt.sessions[sessionID]
+	if session == nil || !verifyPunchPacket(packet, session.key) {
+		nt.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	first := session.endpoint == nil
+	current := !first && session.endpoint.String() == from.String()
+	moved := !first && !current && now.Sub(session.lastSeen) > 2*directKeepalive
+	if first || current || moved {
+		session.endpoint = from
+		session.lastSeen = now
+	}
+	if first {
+		close(session.confirmed)
+	}
+	nt.mu.Unlock()
+
+	if kind == punchPing {
+		nt.conn.WriteToUDP(punchPacket(punchPong, session.id, session.key), from)
+	}
+	if first || moved {
+		log.Printf("🕳️  Direct path to %s via %s", session.peerName, from)
+		nt.mn.setDirectEndpoint(session.peerID, from.String())
+	}
+}
+
+// keepalive probes every direct path so the NATs keep their mappings, and
+// drops paths the peer stopped answering on
+func (nt *natTraversal) keepalive() {
+	var lost []*punchSession
+	nt.mu.Lock()
+	for id, session := range nt.sessions {
+		if session.endpoint == nil {
+			continue // Still punching
+		}
+		if time.Since(session.lastSeen) > directTimeout {
+			delete(nt.sessions, id)
+			lost = append(lost, session)
+			continue
+		}
+		nt.conn.WriteToUDP(punchPacket(punchPing, session.id, session.key), session.endpoint)
+	}
+	nt.mu.Unlock()
+
+	for _, session := range lost {
+		log.Printf("⚠️  Direct path to %s lost", session.peerName)
+		nt.mn.setDirectEndpoint(session.peerID, "")
+	}
+}
+
+// advertisedEndpoint is the endpoint registered with the coordinator: the
+// configured one, unless it leaves the host out and STUN found the public
+// endpoint
+func (mn *MeshNetwork) advertisedEndpoint() string {
+	if mn.nat == nil {
+		return mn.config.Endpoint
+	}
+	if host, _ := splitEndpoint(mn.config.Endpoint); host != "" {
+		return mn.config.Endpoint
+	}
+	if public, _ := mn.nat.status(); public != "" {
+		return public
+	}
+	return mn.config.Endpoint
+}
+
+// punchPeersLocked starts hole punches to the peers that need one
+func (mn *MeshNetwork) punchPeersLocked() {
+	if mn.nat == nil || mn.nodeToken == "" {
+		return
+	}
+	for _, node := range mn.nodes {
+		if node != mn.localNode && mn.nat.shouldPunch(mn.localNode, node) {
+			go mn.nat.punch(node.ID, node.Name)
+		}
+	}
+}
+
+// setDirectEndpoint records the direct path to a peer, empty when lost
+func (mn *MeshNetwork) setDirectEndpoint(peerID, endpoint string) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	if node := mn.nodes[peerID]; node != nil {
+		node.DirectEndpoint = endpoint
+	}
+	mn.updatePathsLocked()
+}
+
+// localEndpoints lists the port on each of the host's IPv4 addresses, for
+// peers behind the same NAT, which often cannot reach the public endpoint
+func localEndpoints(port int) []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var endpoints []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP.To4()
+		if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		endpoints = append(endpoints, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+	return endpoints
+}
+
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,33 +2,61 @@ package mesh
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/probe"
+	"ssh-tunnel/internal/wireguard"
 )
 
 // MeshNode represents a node in the mesh network
 type MeshNode struct {
-	ID           string          `json:"id"`
-	Name         string          `json:"name"`
-	PublicIP     string          `json:"public_ip"`
-	PrivateIP    string          `json:"private_ip"`
-	MeshIP       string          `json:"mesh_ip"`
-	Port         int             `json:"port"`
-	PublicKey    string          `json:"public_key"`
-	PrivateKey   string          `json:"private_key"`
-	Status       string          `json:"status"` // online, offline, connecting
-	LastSeen     time.Time       `json:"last_seen"`
-	Protocols    []string        `json:"protocols"`
-	LoadScore    float64         `json:"load_score"`
-	Latency      time.Duration   `json:"latency"`
-	Tags         []string        `json:"tags"`
-	Region       string          `json:"region"`
-	Capabilities map[string]bool `json:"capabilities"`
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	PublicIP     string            `json:"public_ip"`
+	PrivateIP    string            `json:"private_ip"`
+	MeshIP       string            `json:"mesh_ip"`
+	MeshIP6      string            `json:"mesh_ip6,omitempty"` // In a dual-stack mesh
+	Port         int               `json:"port"`
+	PublicKey    string            `json:"public_key"`
+	PrivateKey   string            `json:"private_key"`
+	Status       string            `json:"status"` // online, offline, connecting
+	LastSeen     time.Time         `json:"last_seen"`
+	Protocols    []string          `json:"protocols"`
+	LoadScore    float64           `json:"load_score"`
+	Latency      time.Duration     `json:"latency"`
+	PacketLoss   float64           `json:"packet_loss"`
+	Priority     int               `json:"priority"`
+	Cost         float64           `json:"cost"`
+	Tags         []string          `json:"tags"`
+	Region       string            `json:"region"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Capabilities map[string]bool   `json:"capabilities"`
+	Routes       []string          `json:"routes,omitempty"`   // Advertised subnets
+	Draining     bool              `json:"draining,omitempty"` // Being drained for maintenance; not picked for new traffic
+	KeyRotated   time.Time         `json:"key_rotated,omitempty"`
+
+	Capacity          int `json:"capacity,omitempty"`           // Weight for weighted balancing, from the capacity label; 1 when unset
+	ActiveConnections int `json:"active_connections,omitempty"` // Open through this network, for least-connections balancing
+
+	NATType        string    `json:"nat_type,omitempty"`        // As the peer reported it
+	DirectEndpoint string    `json:"direct_endpoint,omitempty"` // Confirmed by hole punching; WireGuard reaches the peer here
+	Path           string    `json:"path,omitempty"`            // PathDirect or PathRelay; empty while the peer is unreachable
+	PathSince      time.Time `json:"path_since,omitempty"`
+	Failovers      int       `json:"failovers,omitempty"` // Times traffic left a failing direct path
+
+	directFailed time.Time   // When traffic last left the direct path; it returns after the hold-down
+	health       *NodeHealth // As its agent last reported, through the coordinator
 }
 
 // MeshNetwork manages the entire mesh network
@@ -41,20 +69,152 @@ type MeshNetwork struct {
 	ctx             context.Context
 	cancel          context.CancelFunc
 	config          *MeshConfig
+
+	nodeToken    string        // Issued by the coordinator on registration
+	peersVersion uint64        // Of the latest membership list applied
+	nat          *natTraversal // Nil without NAT traversal
+	relay        *relayClient  // Nil without a relay
+	dataPlane    *dataPlane    // Nil without the WireGuard data plane
+	rotation     KeyRotationStatus
+	latency      *latencyTracker // Nil without a coordinator
+	traffic      trafficCounter
+	events       *EventBus       // Path and route changes seen here
+	reported     []MeshEvent     // Events for the coordinator's next heartbeat
+	reportNow    chan struct{}   // Sends a heartbeat before its time
+	policies     []RoutingPolicy // From the coordinator, in the order they apply
+	acls         []ACLRule       // From the coordinator, in the order they apply
+	services     []Service       // From the coordinator
+	ipam         *ipam           // Mesh IPs of the nodes added without a coordinator
+	balancer     balancer
+
+	coordinatorIndex atomic.Int32 // Of the coordinator URL in use, when there are several
+
+	configSync    func(sections []string, s ConfigSections) // Receives the synced config
+	configVersion uint64                                    // Of the last synced config seen
+	started       time.Time
+
+	packetHandler func(peerID string, packet []byte) // Receives packets from peers
 }
 
 // MeshConfig holds mesh network configuration
 type MeshConfig struct {
 	NetworkCIDR         string        `yaml:"network_cidr" json:"network_cidr"`
 	CoordinatorURL      string        `yaml:"coordinator_url" json:"coordinator_url"`
+	JoinToken           string        `yaml:"join_token" json:"join_token"` // From tunnel mesh token create
+	Endpoint            string        `yaml:"endpoint" json:"endpoint"`     // host:port peers reach this node at; an empty host means the address the coordinator sees
 	LocalNodeName       string        `yaml:"local_node_name" json:"local_node_name"`
 	AutoDiscovery       bool          `yaml:"auto_discovery" json:"auto_discovery"`
 	HealthCheckInterval time.Duration `yaml:"health_check_interval" json:"health_check_interval"`
-	LoadBalancing       string        `yaml:"load_balancing" json:"load_balancing"` // round_robin, least_connections, latency
+	LoadBalancing       string        `yaml:"load_balancing" json:"load_balancing"` // latency, round_robin, weighted or least_connections
 	FailoverTimeout     time.Duration `yaml:"failover_timeout" json:"failover_timeout"`
-	Encryption          bool          `yaml:"encryption" json:"encryption"`
 	Tags                []string      `yaml:"tags" json:"tags"`
 	Regions             []string      `yaml:"regions" json:"regions"`
+
+	// Without a coordinator, nodes get mesh IPs from NetworkCIDR bar
+	// ReservedIPs (addresses, from-to ranges or CIDRs), kept by name in
+	// LeaseFile when set so they keep them across restarts
+	ReservedIPs []string `yaml:"reserved_ips" json:"reserved_ips"`
+	LeaseFile   string   `yaml:"lease_file" json:"lease_file"`
+
+	// NATTraversal discovers the endpoint's public address with STUN and
+	// punches holes to peers through the coordinator, so peers behind NAT
+	// connect directly. It needs the endpoint's UDP port to itself.
+	NATTraversal bool     `yaml:"nat_traversal" json:"nat_traversal"`
+	STUNServers  []string `yaml:"stun_servers" json:"stun_servers"` // host:port; DefaultSTUNServers when empty
+
+	// Relay carries packets to peers without a direct path through the
+	// relay the coordinator names, until hole punching finds one
+	Relay bool `yaml:"relay" json:"relay"`
+
+	// WireGuard creates a TUN interface with the node's mesh IP and carries
+	// traffic for mesh IPs to peers over WireGuard, on the paths above. It
+	// needs Linux and CAP_NET_ADMIN.
+	WireGuard bool   `yaml:"wireguard" json:"wireguard"`
+	Interface string `yaml:"interface" json:"interface"` // DefaultInterface when empty
+	MTU       int    `yaml:"mtu" json:"mtu"`             // wireguard.DefaultMTU when zero
+
+	// Routes advertises subnets behind this node, such as its LAN, for
+	// site-to-site access; the node forwards peers' traffic to them, with
+	// SNATRoutes as its own. AcceptRoutes routes the subnets peers
+	// advertise through them. Both need the WireGuard data plane.
+	Routes       []string `yaml:"routes" json:"routes"`
+	SNATRoutes   bool     `yaml:"snat_routes" json:"snat_routes"`
+	AcceptRoutes bool     `yaml:"accept_routes" json:"accept_routes"`
+
+	// KeyRotationInterval replaces the node's WireGuard key and node token
+	// this often; zero never rotates. The old ones keep working for
+	// KeyRotationOverlap (DefaultKeyRotationOverlap when zero).
+	KeyRotationInterval time.Duration `yaml:"key_rotation_interval" json:"key_rotation_interval"`
+	KeyRotationOverlap  time.Duration `yaml:"key_rotation_overlap" json:"key_rotation_overlap"`
+
+	// ReportHealth sends the host's load, memory and whether its SSH
+	// server at SSHAddr (DefaultAgentSSHAddr when empty) answers with each
+	// heartbeat, as tunnel mesh agent does
+	ReportHealth bool   `yaml:"report_health" json:"report_health"`
+	SSHAddr      string `yaml:"ssh_addr" json:"ssh_addr"`
+
+	// Encryption requires TLS to the coordinator and its relay, trusting
+	// the coordinator by CoordinatorPin or the pin its join token carries
+	// when set, and seals the control messages peers exchange with keys
+	// derived from their WireGuard keys, refusing plaintext ones
+	Encryption     bool   `yaml:"encryption" json:"encryption"`
+	CoordinatorPin string `yaml:"coordinator_pin" json:"coordinator_pin"` // SHA256:... as tunnel mesh coordinator prints it
+
+	// SyncKey opens the config an admin pushes through the coordinator;
+	// the node takes SyncSections of it, or every section when empty
+	SyncKey      string   `yaml:"sync_key" json:"sync_key"`
+	SyncSections []string `yaml:"sync_sections" json:"sync_sections"`
+
+	// Weights for node selection, see config.ScoringWeights
+	Scoring config.ScoringWeights `yaml:"scoring" json:"scoring"`
+}
+
+// NodeConfig returns the configuration of a node joining through a
+// coordinator, as the config file's mesh block and scoring weights set
+// it: NAT traversal and the relay on, subnets peers advertise accepted,
+// and the data plane as the block says
+func NodeConfig(block config.MeshConfig, scoring config.ScoringWeights) *MeshConfig {
+	cfg := &MeshConfig{
+		NetworkCIDR:         block.NetworkCIDR,
+		CoordinatorURL:      block.CoordinatorURL,
+		JoinToken:           block.JoinToken,
+		Endpoint:            block.Endpoint,
+		LocalNodeName:       block.NodeName,
+		HealthCheckInterval: block.HealthCheckInterval,
+		LoadBalancing:       block.LoadBalancing,
+		FailoverTimeout:     block.FailoverTimeout,
+		Encryption:          block.Encryption,
+		CoordinatorPin:      block.CoordinatorPin,
+		SyncKey:             block.SyncKey,
+		SyncSections:        block.SyncSections,
+		Tags:                block.Tags,
+		NATTraversal:        true,
+		Relay:               true,
+		WireGuard:           block.WireGuard,
+		Routes:              block.Routes,
+		SNATRoutes:          true,
+		AcceptRoutes:        true,
+		Scoring:             scoring,
+	}
+	if block.Region != "" {
+		cfg.Regions = []string{block.Region}
+	}
+	if cfg.NetworkCIDR == "" {
+		cfg.NetworkCIDR = config.DefaultMeshNetwork // Replaced by the coordinator's
+	}
+	if cfg.LocalNodeName == "" {
+		cfg.LocalNodeName, _ = os.Hostname()
+	}
+	if cfg.HealthCheckInterval == 0 {
+		cfg.HealthCheckInterval = 30 * time.Second
+	}
+	if cfg.LoadBalancing == "" {
+		cfg.LoadBalancing = "latency"
+	}
+	if cfg.FailoverTimeout == 0 {
+		cfg.FailoverTimeout = DefaultFailoverTimeout
+	}
+	return cfg
 }
 
 // Route represents a route in the mesh network
@@ -71,17 +231,20 @@ func NewMeshNetwork(cfg *MeshConfig) *MeshNetwork {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &MeshNetwork{
-		nodes:  make(map[string]*MeshNode),
-		routes: make(map[string]*Route),
-		config: cfg,
-		ctx:    ctx,
-		cancel: cancel,
+		nodes:     make(map[string]*MeshNode),
+		routes:    make(map[string]*Route),
+		config:    cfg,
+		ctx:       ctx,
+		cancel:    cancel,
+		events:    NewEventBus(),
+		reportNow: make(chan struct{}, 1),
 	}
 }
 
 // Initialize initializes the mesh network
 func (mn *MeshNetwork) Initialize() error {
 	log.Println("🌐 Initializing Mesh Network...")
+	mn.started = time.Now()
 
 	// Create local node
 	localNode, err := mn.createLocalNode()
@@ -91,6 +254,56 @@ func (mn *MeshNetwork) Initialize() error {
 	mn.localNode = localNode
 	mn.nodes[localNode.ID] = localNode
 
+	// Take the mesh IP and members from the coordinator, when there is one
+	if mn.config.CoordinatorURL != "" {
+		if mn.config.Encryption {
+			for _, coordinatorURL := range coordinatorURLs(mn.config.CoordinatorURL) {
+				if err := checkEncryptedURL("coordinator", coordinatorURL); err != nil {
+					return err
+				}
+			}
+		}
+		if pin := mn.coordinatorPin(); pin != "" && !validPin(pin) {
+			return fmt.Errorf("invalid coordinator pin %q", pin)
+		}
+		if mn.config.Endpoint == "" {
+			mn.config.Endpoint = ":51820"
+		}
+		if mn.config.NATTraversal {
+			nat, err := newNATTraversal(mn)
+			if err != nil {
+				log.Printf("⚠️  NAT traversal disabled: %v", err)
+			} else {
+				mn.nat = nat
+				nat.discover()
+				go nat.run()
+			}
+		}
+		if mn.config.Relay {
+			mn.relay = newRelayClient(mn)
+		}
+		if err := mn.joinCoordinator(); err != nil {
+			if mn.nat != nil {
+				mn.nat.close()
+			}
+			return err
+		}
+		mn.latency = newLatencyTracker()
+		go mn.followCoordinator()
+		go mn.measureLatency()
+		if mn.config.KeyRotationInterval > 0 {
+			go mn.rotateKeys()
+		}
+		if mn.relay != nil {
+			go mn.relay.run()
+		}
+		if mn.config.WireGuard {
+			if _, err := mn.startDataPlane(mn.config.NetworkCIDR); err != nil {
+				log.Printf("⚠️  WireGuard data plane disabled: %v", err)
+			}
+		}
+	}
+
 	// Start services
 	go mn.startHealthChecker()
 	go mn.startLoadBalancer()
@@ -104,11 +317,37 @@ func (mn *MeshNetwork) Initialize() error {
 	return nil
 }
 
-// AddServer adds a server to the mesh network
-func (mn *MeshNetwork) AddServer(serverConfig config.Server) (*MeshNode, error) {
-	mn.mu.Lock()
-	defer mn.mu.Unlock()
+// Stop leaves the coordinator, if any, and stops the mesh services
+func (mn *MeshNetwork) Stop() error {
+	var err error
+	if mn.config.CoordinatorURL != "" {
+		err = mn.leaveCoordinator()
+	}
+	mn.cancel()
+	if mn.nat != nil {
+		mn.nat.close()
+	}
+	if mn.dataPlane != nil {
+		mn.dataPlane.close()
+	}
+	return err
+}
+
+// Nodes returns a snapshot of the known nodes, the local node included
+func (mn *MeshNetwork) Nodes() []MeshNode {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+
+	nodes := make([]MeshNode, 0, len(mn.nodes))
+	for _, node := range mn.nodes {
+		nodes = append(nodes, *node)
+	}
+	return nodes
+}
 
+// AddServer adds a server to the mesh network, online when probing it
+// finds its transport answering
+func (mn *MeshNetwork) AddServer(serverConfig config.Server) (*MeshNode, error) {
 	// Create mesh node from server config
 	node := &MeshNode{
 		ID:           generateNodeID(),
@@ -119,18 +358,13 @@ func (mn *MeshNetwork) AddServer(serverConfig config.Server) (*MeshNode, error)
 		Protocols:    []string{string(serverConfig.Transport)},
 		Tags:         serverConfig.Tags,
 		Region:       serverConfig.Region,
+		Priority:     serverConfig.Priority,
+		Cost:         serverConfig.Cost,
 		Capabilities: make(map[string]bool),
 	}
 
-	// Assign mesh IP
-	meshIP, err := mn.assignMeshIP()
-	if err != nil {
-		return nil, fmt.Errorf("failed to assign mesh IP: %v", err)
-	}
-	node.MeshIP = meshIP
-
-	// Test connection and get node info
-	if err := mn.probeNode(node); err != nil {
+	// Test connection and get node info, before taking the lock
+	if err := mn.probeNode(node, serverConfig); err != nil {
 		log.Printf("Warning: Failed to probe node %s: %v", node.Name, err)
 		node.Status = "offline"
 	} else {
@@ -138,6 +372,14 @@ func (mn *MeshNetwork) AddServer(serverConfig config.Server) (*MeshNode, error)
 		node.LastSeen = time.Now()
 	}
 
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	// Assign mesh IP
+	if err := mn.assignMeshIP(node); err != nil {
+		return nil, fmt.Errorf("failed to assign mesh IP: %v", err)
+	}
+
 	// Add to network
 	mn.nodes[node.ID] = node
 
@@ -150,6 +392,26 @@ func (mn *MeshNetwork) AddServer(serverConfig config.Server) (*MeshNode, error)
 	return node, nil
 }
 
+// RemoveServer removes a node added with AddServer, by ID or name, and
+// returns its mesh IP to the pool
+func (mn *MeshNetwork) RemoveServer(ref string) error {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	for id, node := range mn.nodes {
+		if (id == ref || node.Name == ref) && node != mn.localNode {
+			delete(mn.nodes, id)
+			if mn.ipam != nil {
+				mn.ipam.release(node.MeshIP)
+				mn.ipam.release(node.MeshIP6)
+			}
+			log.Printf("➖ Removed node from mesh: %s (%s)", node.Name, node.MeshIP)
+			return nil
+		}
+	}
+	return fmt.Errorf("node %s is not in the mesh", ref)
+}
+
 // GetBestNode returns the best node for a given criteria
 func (mn *MeshNetwork) GetBestNode(criteria string) (*MeshNode, error) {
 	mn.mu.RLock()
@@ -159,12 +421,16 @@ func (mn *MeshNetwork) GetBestNode(criteria string) (*MeshNode, error) {
 	var bestScore float64
 
 	for _, node := range mn.nodes {
-		if node.Status != "online" || node == mn.localNode {
+		if node.Status != "online" || node.Draining || node == mn.localNode {
 			continue
 		}
 
 		score := mn.calculateNodeScore(node, criteria)
-		if bestNode == nil || score > bestScore {
+		bestName := ""
+		if bestNode != nil {
+			bestName = bestNode.Name
+		}
+		if config.Outranks(score, node.Name, bestScore, bestName) {
 			bestNode = node
 			bestScore = score
 		}
@@ -234,23 +500,57 @@ func (mn *MeshNetwork) ConnectToNode(nodeID string, protocol string) error {
 	}
 }
 
-// LoadBalance distributes traffic across multiple nodes
+// NodeAddress returns the address a node's services are reached at: its
+// mesh IP once the WireGuard data plane has a session with it, or else its
+// public IP
+func (mn *MeshNetwork) NodeAddress(node *MeshNode) string {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+
+	if mn.dataPlane != nil && node.MeshIP != "" && mn.dataPlane.connected(node.PublicKey) {
+		return node.MeshIP
+	}
+	return node.PublicIP
+}
+
+// LoadBalance picks the node for new traffic with the configured
+// algorithm: the best scored one for latency, or the next of the healthy
+// nodes for round_robin, weighted and least_connections. target names the
+// preferred region; when it has healthy nodes, only they are picked.
 func (mn *MeshNetwork) LoadBalance(target string) (*MeshNode, error) {
+	if mn.config.LoadBalancing == "" || mn.config.LoadBalancing == "latency" {
+		return mn.GetBestNode(target)
+	}
+
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+
 	nodes := mn.getHealthyNodes()
+	if target != "" {
+		var inRegion []*MeshNode
+		for _, node := range nodes {
+			if node.Region == target {
+				inRegion = append(inRegion, node)
+			}
+		}
+		if len(inRegion) > 0 {
+			nodes = inRegion
+		}
+	}
 	if len(nodes) == 0 {
 		return nil, fmt.Errorf("no healthy nodes available")
 	}
+	sortNodes(nodes)
 
 	switch mn.config.LoadBalancing {
 	case "round_robin":
-		return mn.roundRobinSelect(nodes), nil
+		return mn.balancer.roundRobin(nodes), nil
+	case "weighted":
+		return mn.balancer.weighted(nodes), nil
 	case "least_connections":
-		return mn.leastConnectionsSelect(nodes), nil
-	case "latency":
-		return mn.latencyBasedSelect(nodes), nil
-	default:
-		return mn.latencyBasedSelect(nodes), nil
+		return leastConnections(nodes), nil
 	}
+	return nil, fmt.Errorf("unknown load balancing %q", mn.config.LoadBalancing)
 }
 
 // GetNetworkStatus returns the current network status
@@ -270,7 +570,7 @@ func (mn *MeshNetwork) GetNetworkStatus() map[string]interface{} {
 		}
 	}
 
-	return map[string]interface{}{
+	status := map[string]interface{}{
 		"total_nodes":      totalNodes,
 		"online_nodes":     onlineNodes,
 		"offline_nodes":    offlineNodes,
@@ -280,6 +580,58 @@ func (mn *MeshNetwork) GetNetworkStatus() map[string]interface{} {
 		"load_balancing":   mn.config.LoadBalancing,
 		"auto_discovery":   mn.config.AutoDiscovery,
 	}
+	if mn.nat != nil {
+		direct := 0
+		for _, node := range mn.nodes {
+			if node.DirectEndpoint != "" {
+				direct++
+			}
+		}
+		status["public_endpoint"], status["nat_type"] = mn.nat.status()
+		status["direct_peers"] = direct
+	}
+	if mn.relay != nil {
+		relayed := 0
+		for _, node := range mn.nodes {
+			if node.Path == PathRelay {
+				relayed++
+			}
+		}
+		status["relay"], status["relay_connected"] = mn.relay.status()
+		status["relayed_peers"] = relayed
+	}
+	if mn.nat != nil || mn.relay != nil {
+		status["paths"] = mn.pathsLocked()
+	}
+	if mn.dataPlane != nil {
+		connected := 0
+		for _, node := range mn.nodes {
+			if node != mn.localNode && mn.dataPlane.connected(node.PublicKey) {
+				connected++
+			}
+		}
+		status["wireguard_interface"] = mn.dataPlane.tun.Name()
+		status["wireguard_peers"] = connected
+	}
+	if len(mn.localNode.Routes) > 0 {
+		status["advertised_routes"] = mn.localNode.Routes
+	}
+	if len(mn.routes) > 0 {
+		status["subnet_routes"] = len(mn.routes)
+	}
+	if mn.config.CoordinatorURL != "" {
+		status["key_rotation"] = mn.keyRotationLocked()
+	}
+	if row := mn.latencyRowLocked(); len(row) > 0 {
+		byName := make(map[string]PeerLatency, len(row))
+		for id, stats := range row {
+			if node := mn.nodes[id]; node != nil {
+				byName[node.Name] = stats
+			}
+		}
+		status["peer_latency"] = byName
+	}
+	return status
 }
 
 // Private methods
@@ -293,21 +645,15 @@ func (mn *MeshNetwork) createLocalNode() (*MeshNode, error) {
 		return nil, err
 	}
 
-	// Assign mesh IP
-	meshIP, err := mn.assignMeshIP()
-	if err != nil {
-		return nil, err
-	}
-
 	node := &MeshNode{
 		ID:        nodeID,
 		Name:      mn.config.LocalNodeName,
 		PublicIP:  localIP,
-		MeshIP:    meshIP,
 		Status:    "online",
 		LastSeen:  time.Now(),
 		Protocols: []string{"ssh", "wireguard"},
 		Tags:      mn.config.Tags,
+		Region:    firstString(mn.config.Regions),
 		Capabilities: map[string]bool{
 			"coordinator":  true,
 			"routing":      true,
@@ -315,6 +661,11 @@ func (mn *MeshNetwork) createLocalNode() (*MeshNode, error) {
 		},
 	}
 
+	// Assign mesh IP
+	if err := mn.assignMeshIP(node); err != nil {
+		return nil, err
+	}
+
 	// Generate WireGuard keys
 	privateKey, publicKey, err := generateWireGuardKeys()
 	if err != nil {
@@ -324,6 +675,14 @@ func (mn *MeshNetwork) createLocalNode() (*MeshNode, error) {
 	node.PrivateKey = privateKey
 	node.PublicKey = publicKey
 
+	for _, route := range mn.config.Routes {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q", route)
+		}
+		node.Routes = append(node.Routes, prefix.Masked().String())
+	}
+
 	return node, nil
 }
 
@@ -342,19 +701,53 @@ func (mn *MeshNetwork) startHealthChecker() {
 }
 
 func (mn *MeshNetwork) performHealthCheck() {
-	mn.mu.Lock()
-	defer mn.mu.Unlock()
+	type check struct {
+		node       *MeshNode
+		host, port string
+		result     *probe.Result
+		err        error
+	}
 
+	// Probe without the lock held; a probe can take seconds
+	mn.mu.RLock()
+	var checks []*check
 	for _, node := range mn.nodes {
-		if node == mn.localNode {
+		// Members of a coordinated mesh are timed over their mesh paths
+		if node == mn.localNode || node.PublicIP == "" || mn.latency != nil {
 			continue
 		}
+		c := &check{node: node, host: node.PublicIP}
+		if node.Port > 0 {
+			c.port = strconv.Itoa(node.Port)
+		}
+		checks = append(checks, c)
+	}
+	mn.mu.RUnlock()
 
-		// Check node health
-		latency, err := mn.pingNode(node)
-		if err != nil {
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c *check) {
+			defer wg.Done()
+			c.result, c.err = mn.pingNode(c.host, c.port)
+		}(c)
+	}
+	wg.Wait()
+
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	for _, c := range checks {
+		node := c.node
+		if mn.nodes[node.ID] != node {
+			continue // Left while being probed
+		}
+		if c.result != nil {
+			node.PacketLoss = c.result.Loss
+		}
+		if c.err != nil {
 			if node.Status == "online" {
-				log.Printf("⚠️  Node %s went offline: %v", node.Name, err)
+				log.Printf("⚠️  Node %s went offline: %v", node.Name, c.err)
 				node.Status = "offline"
 			}
 		} else {
@@ -363,7 +756,7 @@ func (mn *MeshNetwork) performHealthCheck() {
 				node.Status = "online"
 			}
 			node.LastSeen = time.Now()
-			node.Latency = latency
+			node.Latency = c.result.Avg
 		}
 	}
 }
@@ -411,37 +804,26 @@ func (mn *MeshNetwork) startAutoDiscovery() {
 }
 
 // Helper methods
-func (mn *MeshNetwork) assignMeshIP() (string, error) {
-	// Parse network CIDR
-	_, network, err := net.ParseCIDR(mn.config.NetworkCIDR)
-	if err != nil {
-		return "", err
-	}
 
-	// Find next available IP
-	ip := network.IP
-	for {
-		ip = nextIP(ip)
-		if !mn.isIPUsed(ip.String()) {
-			return ip.String(), nil
+// assignMeshIP leases mesh IPs to a node by name, the ones it had when the
+// leases are kept in a file: an IPv6 one too in a dual-stack mesh
+func (mn *MeshNetwork) assignMeshIP(node *MeshNode) error {
+	if mn.ipam == nil {
+		ipam, err := newIPAM(mn.config.NetworkCIDR, mn.config.ReservedIPs, mn.config.LeaseFile)
+		if err != nil {
+			return err
 		}
+		mn.ipam = ipam
 	}
-}
-
-func (mn *MeshNetwork) isIPUsed(ip string) bool {
-	for _, node := range mn.nodes {
-		if node.MeshIP == ip {
-			return true
-		}
+	meshIPs, err := mn.ipam.allocate(node.Name)
+	if err != nil {
+		return err
 	}
-	return false
-}
-
-func (mn *MeshNetwork) probeNode(node *MeshNode) error {
-	// Test SSH connectivity
-	// Test other protocols
-	// Get node capabilities
-	return nil // Simplified
+	node.MeshIP = meshIPs[0]
+	if len(meshIPs) > 1 {
+		node.MeshIP6 = meshIPs[1]
+	}
+	return nil
 }
 
 func (mn *MeshNetwork) setupNodeRouting(node *MeshNode) error {
@@ -449,81 +831,53 @@ func (mn *MeshNetwork) setupNodeRouting(node *MeshNode) error {
 	return nil // Simplified
 }
 
+// calculateNodeScore ranks a node with the configured scoring weights.
+// criteria names the preferred region, if any.
 func (mn *MeshNetwork) calculateNodeScore(node *MeshNode, criteria string) float64 {
-	score := 0.0
-
-	// Latency score (lower is better)
-	latencyScore := 1000.0 / float64(node.Latency.Milliseconds()+1)
-	score += latencyScore * 0.4
-
-	// Load score (lower is better)
-	loadScore := 1.0 - node.LoadScore
-	score += loadScore * 0.3
-
-	// Status bonus
-	if node.Status == "online" {
-		score += 100.0
-	}
-
-	// Region preference
-	if criteria != "" && node.Region == criteria {
-		score += 50.0
+	if node.Status != "online" {
+		return 0
 	}
 
-	return score
+	return mn.config.Scoring.Score(config.ScoreInput{
+		Latency:    nodeLatency(node),
+		Load:       node.LoadScore,
+		InRegion:   criteria != "" && node.Region == criteria,
+		Priority:   node.Priority,
+		Cost:       node.Cost,
+		PacketLoss: node.PacketLoss,
+	})
 }
 
+// getHealthyNodes returns the nodes new traffic may go to; callers hold
+// mn.mu
 func (mn *MeshNetwork) getHealthyNodes() []*MeshNode {
 	var nodes []*MeshNode
 	for _, node := range mn.nodes {
-		if node.Status == "online" && node != mn.localNode {
+		if node.Status == "online" && !node.Draining && node != mn.localNode {
 			nodes = append(nodes, node)
 		}
 	}
 	return nodes
 }
 
-func (mn *MeshNetwork) roundRobinSelect(nodes []*MeshNode) *MeshNode {
-	// Simple round-robin implementation
-	if len(nodes) == 0 {
-		return nil
-	}
-	return nodes[time.Now().Second()%len(nodes)]
-}
-
-func (mn *MeshNetwork) leastConnectionsSelect(nodes []*MeshNode) *MeshNode {
-	// Select node with least load
-	var bestNode *MeshNode
-	var bestLoad float64 = 1.0
+// connectViaWireGuard starts a WireGuard handshake with a node over its
+// direct or relayed path; traffic to its mesh IP then flows over the
+// session
+func (mn *MeshNetwork) connectViaWireGuard(node *MeshNode) error {
+	mn.mu.RLock()
+	dp, path := mn.dataPlane, node.Path
+	mn.mu.RUnlock()
 
-	for _, node := range nodes {
-		if node.LoadScore < bestLoad {
-			bestLoad = node.LoadScore
-			bestNode = node
-		}
+	if dp == nil {
+		return fmt.Errorf("the WireGuard data plane is not running")
 	}
-
-	return bestNode
-}
-
-func (mn *MeshNetwork) latencyBasedSelect(nodes []*MeshNode) *MeshNode {
-	// Select node with best latency
-	var bestNode *MeshNode
-	var bestLatency time.Duration = time.Hour
-
-	for _, node := range nodes {
-		if node.Latency < bestLatency {
-			bestLatency = node.Latency
-			bestNode = node
-		}
+	if path == "" {
+		return fmt.Errorf("no path to %s", node.Name)
 	}
-
-	return bestNode
-}
-
-func (mn *MeshNetwork) connectViaWireGuard(node *MeshNode) error {
-	// WireGuard connection logic
-	log.Printf("🔗 Connecting to %s via WireGuard", node.Name)
+	if err := dp.handshake(node.PublicKey); err != nil {
+		return fmt.Errorf("WireGuard handshake with %s failed: %v", node.Name, err)
+	}
+	log.Printf("🔗 Connecting to %s (%s) via WireGuard over the %s path", node.Name, node.MeshIP, path)
 	return nil
 }
 
@@ -551,19 +905,40 @@ func (mn *MeshNetwork) connectViaBestProtocol(node *MeshNode) error {
 	return fmt.Errorf("no suitable protocol found")
 }
 
-func (mn *MeshNetwork) pingNode(node *MeshNode) (time.Duration, error) {
-	// Ping implementation
-	start := time.Now()
-	// ... ping logic ...
-	return time.Since(start), nil
+// pingNode measures latency and loss to a node with ICMP echo, or TCP
+// connects to its port when ICMP is filtered
+func (mn *MeshNetwork) pingNode(host, port string) (*probe.Result, error) {
+	return probe.Latency(host, port, probe.Options{Count: 3, Timeout: 2 * time.Second})
 }
 
+// updateLoadScores scores the nodes' load from what their agents last
+// reported; nodes without a report, offline or not running an agent with
+// health reports, count as idle
 func (mn *MeshNetwork) updateLoadScores() {
-	// Update load scores for all nodes
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	maxConnections := 0
+	for _, node := range mn.nodes {
+		if node.health != nil && node.health.Connections > maxConnections {
+			maxConnections = node.health.Connections
+		}
+	}
+	for _, node := range mn.nodes {
+		node.LoadScore = loadScore(node.health, maxConnections)
+	}
 }
 
+// updateRoutes puts back the kernel routes through the mesh interface that
+// something else removed, such as a network manager resetting the table
 func (mn *MeshNetwork) updateRoutes() {
-	// Update routing table
+	mn.mu.RLock()
+	dp := mn.dataPlane
+	mn.mu.RUnlock()
+
+	if dp != nil {
+		dp.routes.reconcile()
+	}
 }
 
 func (mn *MeshNetwork) discoverNewNodes() {
@@ -585,9 +960,28 @@ func getLocalIP() (string, error) {
 	return "127.0.0.1", nil // Simplified
 }
 
+// generateWireGuardKeys returns a new Curve25519 key pair, base64 encoded
+// as in WireGuard configs
 func generateWireGuardKeys() (privateKey, publicKey string, err error) {
-	// Generate WireGuard key pair
-	return "private-key", "public-key", nil // Simplified
+	var key wireguard.Key
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", "", err
+	}
+	key[0] &= 248
+	key[31] = (key[31] & 127) | 64
+
+	public := key.PublicKey()
+	return base64.StdEncoding.EncodeToString(key[:]), base64.StdEncoding.EncodeToString(public[:]), nil
+}
+
+// splitEndpoint splits host:port, with port 0 when missing
+func splitEndpoint(endpoint string) (string, int) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return endpoint, 0
+	}
+	n, _ := strconv.Atoi(port)
+	return host, n
 }
 
 func nextIP(ip net.IP) net.IP {
@@ -611,3 +1005,11 @@ func containsString(slice []string, item string) bool {
 	}
 	return false
 }
+
+// firstString returns the first of a slice, or "" when it is empty
+func firstString(slice []string) string {
+	if len(slice) == 0 {
+		return ""
+	}
+	return slice[0]
+}
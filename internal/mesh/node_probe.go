@@ -0,0 +1,233 @@
+package mesh
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/probe"
+	"ssh-tunnel/internal/protocols"
+	"ssh-tunnel/internal/wireguard"
+)
+
+// probeTimeout bounds each check of a node probe
+const probeTimeout = 5 * time.Second
+
+// inventoryScript lists, on a server reached over SSH, its platform and
+// the tunnel software installed and running there
+const inventoryScript = `uname -sm
+for b in wg xray v2ray sing-box hysteria tuic-server tunnel; do command -v $b >/dev/null 2>&1 && echo "installed $b"; done
+test -d /sys/module/wireguard && echo "installed wireguard-module"
+ip -o link show type wireguard 2>/dev/null | grep -q . && echo "running wireguard"
+for p in xray v2ray sing-box; do pgrep -x $p >/dev/null 2>&1 && echo "running v2ray"; done
+pgrep -f "[t]unnel mesh (agent|join)" >/dev/null 2>&1 && echo "running mesh-agent"
+true`
+
+// probeNode finds out what a server added to the mesh offers: whether its
+// transport answers (the SSH banner, a WireGuard handshake, a TCP connect,
+// or ICMP for the other UDP transports) and, over SSH with the server's
+// credentials, its platform and the tunnel software installed and running.
+// node.Protocols and node.Capabilities are set from what was found, and
+// the platform goes into the os and arch labels. It fails when the server
+// cannot be reached.
+func (mn *MeshNetwork) probeNode(node *MeshNode, server config.Server) error {
+	if server.Timeout == 0 || server.Timeout > probeTimeout {
+		server.Timeout = probeTimeout
+	}
+	node.Protocols = nil
+	node.Capabilities = make(map[string]bool)
+	if node.Labels == nil {
+		node.Labels = make(map[string]string)
+	}
+	addr := net.JoinHostPort(server.Host, server.Port)
+
+	start := time.Now()
+	switch server.Transport {
+	case config.TransportSSH, "":
+		banner, err := sshBanner(addr)
+		if err != nil {
+			return fmt.Errorf("SSH on %s: %v", addr, err)
+		}
+		node.Latency = time.Since(start)
+		node.Protocols = append(node.Protocols, "ssh")
+		node.Capabilities["ssh"] = true
+		if os := bannerOS(banner); os != "" {
+			node.Labels["os"] = os
+		}
+		if server.Password != "" || server.KeyPath != "" || server.HardwareKey != nil {
+			if err := inventoryNode(node, server); err != nil {
+				// The server answers, so it stays online with what the banner told
+				log.Printf("⚠️  Could not inventory %s over SSH: %v", node.Name, err)
+				node.Capabilities["inventory"] = false
+				return nil
+			}
+			node.Capabilities["inventory"] = true
+		}
+	case config.TransportWireGuard:
+		if err := wireGuardHandshake(addr, server.WireGuard); err != nil {
+			return fmt.Errorf("WireGuard on %s: %v", addr, err)
+		}
+		node.Latency = time.Since(start)
+		node.Protocols = append(node.Protocols, "wireguard")
+		node.Capabilities["wireguard"] = true
+	case config.TransportV2Ray, config.TransportVLESS, config.TransportVMess, config.TransportTrojan, config.TransportNaive:
+		result, err := probe.TCP(addr, probe.Options{Timeout: probeTimeout})
+		if err != nil {
+			return fmt.Errorf("%s on %s: %v", server.Transport, addr, err)
+		}
+		node.Latency = result.Avg
+		node.Protocols = append(node.Protocols, protocolName(server.Transport))
+		node.Capabilities[protocolName(server.Transport)] = true
+	default:
+		// QUIC and other UDP transports only answer their own handshakes:
+		// the host answering is as far as a probe can tell
+		result, err := probe.Latency(server.Host, "", probe.Options{Timeout: probeTimeout})
+		if err != nil {
+			return fmt.Errorf("%s is unreachable: %v", server.Host, err)
+		}
+		node.Latency = result.Avg
+		node.Protocols = append(node.Protocols, string(server.Transport))
+	}
+	return nil
+}
+
+// protocolName is the mesh protocol a transport counts as: the V2Ray
+// family is "v2ray", as connectViaBestProtocol knows it
+func protocolName(transport config.TransportType) string {
+	switch transport {
+	case config.TransportVLESS, config.TransportVMess:
+		return "v2ray"
+	}
+	return string(transport)
+}
+
+// sshBanner reads the identification line an SSH server sends first
+func sshBanner(addr string) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(probeTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("no SSH banner: %v", err)
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "SSH-") {
+		return "", fmt.Errorf("not an SSH server: %q", line)
+	}
+	return line, nil
+}
+
+// bannerOS guesses the OS from an SSH banner such as
+// SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.1
+func bannerOS(banner string) string {
+	lower := strings.ToLower(banner)
+	switch {
+	case strings.Contains(lower, "ubuntu"), strings.Contains(lower, "debian"), strings.Contains(lower, "raspbian"), strings.Contains(lower, "dropbear"):
+		return "linux"
+	case strings.Contains(lower, "freebsd"):
+		return "freebsd"
+	case strings.Contains(lower, "windows"):
+		return "windows"
+	}
+	return ""
+}
+
+// inventoryNode logs in to the server and reads what inventoryScript
+// reports into the node
+func inventoryNode(node *MeshNode, server config.Server) error {
+	client, err := protocols.DialSSH(server)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	output, err := runRemote(client, inventoryScript, nil)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(output, "\n")
+	if system, machine, ok := strings.Cut(strings.TrimSpace(lines[0]), " "); ok {
+		node.Labels["os"] = strings.ToLower(system)
+		node.Labels["arch"] = machine
+	}
+	for _, line := range lines[1:] {
+		what, name, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch {
+		case what == "installed" && (name == "wg" || name == "wireguard-module"):
+			node.Capabilities["wireguard"] = true
+		case what == "installed" && (name == "xray" || name == "v2ray" || name == "sing-box"):
+			node.Capabilities["v2ray"] = true
+		case what == "installed" && name == "tuic-server":
+			node.Capabilities["tuic"] = true
+		case what == "installed" && name == "tunnel":
+			node.Capabilities["mesh_agent"] = true
+		case what == "installed":
+			node.Capabilities[name] = true
+		case what == "running" && name == "mesh-agent":
+			node.Capabilities["mesh_agent"] = true
+		case what == "running" && !containsString(node.Protocols, name):
+			node.Protocols = append(node.Protocols, name)
+		}
+	}
+	return nil
+}
+
+// wireGuardHandshake completes a WireGuard handshake with the server, as
+// its peer with the configured keys; a cookie reply, sent by a server
+// under load, counts too
+func wireGuardHandshake(addr string, cfg *config.WireGuardConfig) error {
+	if cfg == nil {
+		return fmt.Errorf("no wireguard keys configured")
+	}
+	private, err := wireguard.ParseKey(cfg.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("invalid private key: %v", err)
+	}
+	public, err := wireguard.ParseKey(cfg.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+	var psk wireguard.Key
+	if cfg.PreSharedKey != "" {
+		if psk, err = wireguard.ParseKey(cfg.PreSharedKey); err != nil {
+			return fmt.Errorf("invalid pre-shared key: %v", err)
+		}
+	}
+
+	conn, err := net.DialTimeout("udp", addr, probeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	handshake := wireguard.NewHandshake(private, public, psk)
+	initiation, err := handshake.Initiation()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(initiation); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return fmt.Errorf("no handshake response: %v", err)
+		}
+		if n > 0 && buf[0] == wireguard.MessageCookieReply {
+			return nil
+		}
+		if _, err := handshake.ConsumeResponse(buf[:n]); err == nil {
+			return nil
+		}
+	}
+}
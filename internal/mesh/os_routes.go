@@ -0,0 +1,88 @@
+package mesh
+
+import (
+	"log"
+	"net/netip"
+	"sync"
+)
+
+// routeManager keeps the kernel routes through the mesh interface in line
+// with what the data plane carries: the mesh network and the subnets
+// behind peers. It reinstalls routes something else removed, and only
+// ever removes the routes it added, so the route the kernel adds with the
+// interface address stays put.
+type routeManager struct {
+	iface string
+
+	mu        sync.Mutex
+	wanted    map[netip.Prefix]bool
+	installed map[netip.Prefix]bool // Added here, removed on close
+}
+
+func newRouteManager(iface string) *routeManager {
+	return &routeManager{
+		iface:     iface,
+		wanted:    make(map[netip.Prefix]bool),
+		installed: make(map[netip.Prefix]bool),
+	}
+}
+
+// set replaces the routes wanted through the interface and reconciles
+func (rm *routeManager) set(prefixes []netip.Prefix) {
+	rm.mu.Lock()
+	rm.wanted = make(map[netip.Prefix]bool, len(prefixes))
+	for _, prefix := range prefixes {
+		rm.wanted[prefix.Masked()] = true
+	}
+	rm.mu.Unlock()
+	rm.reconcile()
+}
+
+// reconcile removes the routes added here that are no longer wanted and
+// adds the wanted ones missing from the kernel
+func (rm *routeManager) reconcile() {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	for prefix := range rm.installed {
+		if rm.wanted[prefix] {
+			continue
+		}
+		if err := deleteOSRoute(rm.iface, prefix); err != nil {
+			log.Printf("⚠️  Failed to remove route to %s: %v", prefix, err)
+		}
+		delete(rm.installed, prefix)
+	}
+	for prefix := range rm.wanted {
+		present, err := osRouteInstalled(rm.iface, prefix)
+		if err != nil {
+			log.Printf("⚠️  Failed to check the route to %s: %v", prefix, err)
+			continue
+		}
+		if present {
+			continue
+		}
+		if rm.installed[prefix] {
+			log.Printf("🛣️  Route to %s through %s was removed; restoring it", prefix, rm.iface)
+		}
+		if err := addOSRoute(rm.iface, prefix); err != nil {
+			log.Printf("⚠️  Failed to route %s through %s: %v", prefix, rm.iface, err)
+			continue
+		}
+		rm.installed[prefix] = true
+	}
+}
+
+// close removes the routes added here
+func (rm *routeManager) close() {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	for prefix := range rm.installed {
+		if err := deleteOSRoute(rm.iface, prefix); err != nil {
+			log.Printf("⚠️  Failed to remove route to %s: %v", prefix, err)
+		}
+	}
+	rm.installed = make(map[netip.Prefix]bool)
+	rm.wanted = make(map[netip.Prefix]bool)
+}
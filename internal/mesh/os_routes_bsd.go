@@ -0,0 +1,68 @@
+//go:build darwin || freebsd || netbsd || openbsd || dragonfly
+
+package mesh
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// Kernel routes go through route(8), which talks to the routing socket
+
+// addOSRoute routes a prefix through the interface
+func addOSRoute(iface string, prefix netip.Prefix) error {
+	return runRoute("add", prefix, "-interface", iface)
+}
+
+// deleteOSRoute removes the route to a prefix through the interface
+func deleteOSRoute(iface string, prefix netip.Prefix) error {
+	err := runRoute("delete", prefix, "-interface", iface)
+	if err != nil && strings.Contains(err.Error(), "not in table") {
+		return nil // Already gone, as with the interface
+	}
+	return err
+}
+
+// osRouteInstalled reports whether the prefix is routed through the
+// interface, as route get finds it
+func osRouteInstalled(iface string, prefix netip.Prefix) (bool, error) {
+	out, err := routeCommand("get", prefix).CombinedOutput()
+	if err != nil {
+		// route get fails when nothing routes the prefix
+		return false, nil
+	}
+	destination, found := "", ""
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "destination":
+			destination = strings.TrimSpace(value)
+		case "interface":
+			found = strings.TrimSpace(value)
+		}
+	}
+	// A wider route through another interface answers too
+	return found == iface && (destination == prefix.Addr().String() || destination == "default" && prefix.Bits() == 0), nil
+}
+
+func routeCommand(action string, prefix netip.Prefix, args ...string) *exec.Cmd {
+	family := "-inet"
+	if prefix.Addr().Is6() {
+		family = "-inet6"
+	}
+	return exec.Command("route", append([]string{"-n", action, family, "-net", prefix.Masked().String()}, args...)...)
+}
+
+// runRoute runs route, including its output in errors
+func runRoute(action string, prefix netip.Prefix, args ...string) error {
+	out, err := routeCommand(action, prefix, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("route %s %s: %v: %s", action, prefix, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+//go:build linux
+
+package mesh
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+// Kernel routes go through rtnetlink: RTM_NEWROUTE and RTM_DELROUTE in the
+// main table, with the interface as the only next hop
+
+const rtprotStatic = 4 // RTPROT_STATIC: routes added by an administrator
+
+// addOSRoute routes a prefix through the interface, replacing a route to
+// the same prefix
+func addOSRoute(iface string, prefix netip.Prefix) error {
+	return routeRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, iface, prefix)
+}
+
+// deleteOSRoute removes the route to a prefix through the interface
+func deleteOSRoute(iface string, prefix netip.Prefix) error {
+	err := routeRequest(syscall.RTM_DELROUTE, 0, iface, prefix)
+	if err == syscall.ESRCH {
+		return nil // Already gone, as with the interface
+	}
+	return err
+}
+
+// osRouteInstalled reports whether the main table routes the prefix
+// through the interface
+func osRouteInstalled(iface string, prefix netip.Prefix) (bool, error) {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return false, err
+	}
+	family := syscall.AF_INET
+	if prefix.Addr().Is6() {
+		family = syscall.AF_INET6
+	}
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, family)
+	if err != nil {
+		return false, fmt.Errorf("failed to list routes: %v", err)
+	}
+	messages, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse routes: %v", err)
+	}
+
+	for i := range messages {
+		m := &messages[i]
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		rtm := (*syscall.RtMsg)(unsafe.Pointer(&m.Data[0]))
+		if rtm.Table != syscall.RT_TABLE_MAIN || int(rtm.Dst_len) != prefix.Bits() {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(m)
+		if err != nil {
+			continue
+		}
+		var dst netip.Addr
+		oif := 0
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_DST:
+				dst, _ = netip.AddrFromSlice(attr.Value)
+			case syscall.RTA_OIF:
+				if len(attr.Value) == 4 {
+					oif = int(binary.NativeEndian.Uint32(attr.Value))
+				}
+			}
+		}
+		if prefix.Bits() == 0 && !dst.IsValid() {
+			dst = prefix.Addr() // The default route has no destination
+		}
+		if oif == link.Index && dst == prefix.Addr() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// routeRequest sends one route change to the kernel and waits for its
+// acknowledgement
+func routeRequest(msgType uint16, flags uint16, iface string, prefix netip.Prefix) error {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	prefix = prefix.Masked()
+
+	rtm := syscall.RtMsg{
+		Family:  syscall.AF_INET,
+		Dst_len: uint8(prefix.Bits()),
+		Table:   syscall.RT_TABLE_MAIN,
+		Scope:   syscall.RT_SCOPE_NOWHERE, // Any scope, for deletes
+	}
+	if prefix.Addr().Is6() {
+		rtm.Family = syscall.AF_INET6
+	}
+	if msgType == syscall.RTM_NEWROUTE {
+		rtm.Protocol = rtprotStatic
+		rtm.Type = syscall.RTN_UNICAST
+		rtm.Scope = syscall.RT_SCOPE_LINK // Reached on the interface, without a gateway
+		if prefix.Addr().Is6() {
+			rtm.Scope = syscall.RT_SCOPE_UNIVERSE
+		}
+	}
+
+	oif := make([]byte, 4)
+	binary.NativeEndian.PutUint32(oif, uint32(link.Index))
+	body := (*[syscall.SizeofRtMsg]byte)(unsafe.Pointer(&rtm))[:]
+	body = appendRouteAttr(body, syscall.RTA_DST, prefix.Addr().AsSlice())
+	body = appendRouteAttr(body, syscall.RTA_OIF, oif)
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	const seq = 1
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(body))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(syscall.NLMSG_HDRLEN+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:6], msgType)
+	binary.NativeEndian.PutUint16(msg[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags)
+	binary.NativeEndian.PutUint32(msg[8:12], seq)
+	msg = append(msg, body...)
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		replies, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			if reply.Header.Seq != seq || reply.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(reply.Data) < 4 {
+				return fmt.Errorf("short netlink acknowledgement")
+			}
+			if errno := -int32(binary.NativeEndian.Uint32(reply.Data[:4])); errno != 0 {
+				return syscall.Errno(errno)
+			}
+			return nil
+		}
+	}
+}
+
+// appendRouteAttr appends an rtattr, padded to four bytes
+func appendRouteAttr(b []byte, attrType uint16, value []byte) []byte {
+	header := make([]byte, syscall.SizeofRtAttr)
+	binary.NativeEndian.PutUint16(header[0:2], uint16(syscall.SizeofRtAttr+len(value)))
+	binary.NativeEndian.PutUint16(header[2:4], attrType)
+	b = append(append(b, header...), value...)
+	for len(b)%syscall.NLMSG_ALIGNTO != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
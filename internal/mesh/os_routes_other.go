@@ -0,0 +1,25 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly || windows)
+
+package mesh
+
+import (
+	"net/netip"
+
+	"ssh-tunnel/internal/platform"
+)
+
+// addOSRoute routes a prefix through the interface; unsupported here
+func addOSRoute(iface string, prefix netip.Prefix) error {
+	return platform.Unsupported(platform.MeshRoutes)
+}
+
+// deleteOSRoute removes the route to a prefix through the interface
+func deleteOSRoute(iface string, prefix netip.Prefix) error {
+	return platform.Unsupported(platform.MeshRoutes)
+}
+
+// osRouteInstalled reports whether the prefix is routed through the
+// interface
+func osRouteInstalled(iface string, prefix netip.Prefix) (bool, error) {
+	return false, platform.Unsupported(platform.MeshRoutes)
+}
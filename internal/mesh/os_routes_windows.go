@@ -0,0 +1,68 @@
+//go:build windows
+
+package mesh
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// Kernel routes go through netsh, as active routes only, so a crash
+// leaves none behind a reboot
+
+// addOSRoute routes a prefix through the interface
+func addOSRoute(iface string, prefix netip.Prefix) error {
+	return runNetsh(prefix, "add", "route", prefix.Masked().String(), iface, "store=active")
+}
+
+// deleteOSRoute removes the route to a prefix through the interface
+func deleteOSRoute(iface string, prefix netip.Prefix) error {
+	err := runNetsh(prefix, "delete", "route", prefix.Masked().String(), iface, "store=active")
+	if err != nil && strings.Contains(err.Error(), "not found") {
+		return nil // Already gone, as with the interface
+	}
+	return err
+}
+
+// osRouteInstalled reports whether the prefix is routed through the
+// interface, from netsh's route table:
+//
+//	Publish  Type      Met  Prefix                    Idx  Gateway/Interface Name
+//	No       Manual    256  10.99.0.0/24               12  mesh0
+func osRouteInstalled(iface string, prefix netip.Prefix) (bool, error) {
+	out, err := exec.Command("netsh", "interface", netshFamily(prefix), "show", "route").CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("netsh show route: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		routed, err := netip.ParsePrefix(fields[3])
+		if err == nil && routed.Masked() == prefix.Masked() && strings.Join(fields[5:], " ") == iface {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func netshFamily(prefix netip.Prefix) string {
+	if prefix.Addr().Is6() {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// runNetsh runs netsh interface ipv4 or ipv6, including its output in
+// errors
+func runNetsh(prefix netip.Prefix, args ...string) error {
+	args = append([]string{"interface", netshFamily(prefix)}, args...)
+	out, err := exec.Command("netsh", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("netsh %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
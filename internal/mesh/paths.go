@@ -0,0 +1,240 @@
+package mesh
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Path failover. Traffic to a peer takes the direct path when there is
+// one. When the direct path stops answering probes or degrades, traffic
+// moves to the relay within the failover timeout, and comes back only once
+// the direct path has been healthy for the hold-down, so a flaky path does
+// not flap.
+const (
+	failoverProbes   = 3   // Consecutive probes lost before a path is down
+	pathLossFailover = 0.5 // Loss over the window that degrades a path
+	pathLossRecover  = 0.2 // Loss a path must be below to take traffic back
+
+	// DefaultFailoverTimeout is used when MeshConfig.FailoverTimeout is zero
+	DefaultFailoverTimeout = 30 * time.Second
+)
+
+// PeerPath is how traffic reaches a peer, and how each path to it is doing
+type PeerPath struct {
+	PeerID    string                 `json:"peer_id"`
+	Peer      string                 `json:"peer"`
+	MeshIP    string                 `json:"mesh_ip"`
+	Path      string                 `json:"path"`               // The one traffic takes; empty without one
+	Endpoint  string                 `json:"endpoint,omitempty"` // Of the direct path
+	Since     time.Time              `json:"since,omitempty"`
+	Failovers int                    `json:"failovers,omitempty"`
+	Paths     map[string]PeerLatency `json:"paths,omitempty"` // Measurements by path
+}
+
+// failoverTimeout is how soon traffic leaves a failed path
+func (mn *MeshNetwork) failoverTimeout() time.Duration {
+	if mn.config.FailoverTimeout > 0 {
+		return mn.config.FailoverTimeout
+	}
+	return DefaultFailoverTimeout
+}
+
+// probeInterval is how often paths are probed: latencyInterval, or more
+// often when failoverProbes lost probes would not fit in the failover
+// timeout
+func (mn *MeshNetwork) probeInterval() time.Duration {
+	interval := min(latencyInterval, (mn.failoverTimeout()-latencyTimeout)/failoverProbes)
+	return max(interval, time.Second)
+}
+
+// availablePathsLocked returns the paths a peer can be reached on now
+func (mn *MeshNetwork) availablePathsLocked(node *MeshNode) []string {
+	var paths []string
+	if node.DirectEndpoint != "" && mn.nat != nil {
+		paths = append(paths, PathDirect)
+	}
+	if mn.relay != nil {
+		if _, connected := mn.relay.status(); connected {
+			paths = append(paths, PathRelay)
+		}
+	}
+	return paths
+}
+
+// pathHealth is what the probes on one path to a peer show
+type pathHealth struct {
+	stats    PeerLatency
+	measured bool // A probe was answered
+	down     bool // The last failoverProbes probes were lost
+}
+
+// pathHealthLocked summarizes the probes on a path; a path nothing was
+// measured on counts as healthy
+func (mn *MeshNetwork) pathHealthLocked(peerID, path string) pathHealth {
+	if mn.latency == nil {
+		return pathHealth{}
+	}
+	lt := mn.latency
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	var health pathHealth
+	health.stats, health.measured = lt.stats(peerID, path)
+	window := lt.windows[peerID][path]
+	if len(window) >= failoverProbes {
+		health.down = true
+		for _, rtt := range window[len(window)-failoverProbes:] {
+			if rtt != lostProbe {
+				health.down = false
+			}
+		}
+	}
+	return health
+}
+
+// degraded returns why traffic should leave the direct path for the
+// relay, or "" when it should not
+func degraded(direct, relay pathHealth) string {
+	switch {
+	case relay.down:
+		return "" // No better
+	case direct.down:
+		return fmt.Sprintf("%d probes in a row lost", failoverProbes)
+	case direct.stats.Loss >= pathLossFailover && relay.stats.Loss < direct.stats.Loss:
+		return fmt.Sprintf("%.0f%% of probes lost", direct.stats.Loss*100)
+	case direct.measured && relay.measured && fasterPath(relay.stats.RTT, direct.stats.RTT):
+		return fmt.Sprintf("%v round trip, the relay's is %v", direct.stats.RTT.Round(time.Millisecond), relay.stats.RTT.Round(time.Millisecond))
+	}
+	return ""
+}
+
+// recovered reports whether a direct path traffic left is healthy enough
+// to take it back
+func recovered(direct, relay pathHealth) bool {
+	return direct.measured && !direct.down && direct.stats.Loss < pathLossRecover &&
+		!(relay.measured && fasterPath(relay.stats.RTT, direct.stats.RTT))
+}
+
+// fasterPath reports whether a round trip is enough faster than the
+// current one to move traffic, with the margins subnet gateways use
+func fasterPath(candidate, current time.Duration) bool {
+	return current-candidate > routeSwitchMin && float64(current-candidate) > routeSwitchMargin*float64(current)
+}
+
+// choosePathLocked picks the path to a peer and, when traffic leaves a
+// failing direct path, why
+func (mn *MeshNetwork) choosePathLocked(node *MeshNode) (path, reason string) {
+	direct, relay := false, false
+	for _, p := range mn.availablePathsLocked(node) {
+		direct = direct || p == PathDirect
+		relay = relay || p == PathRelay
+	}
+	switch {
+	case !direct && !relay:
+		return "", ""
+	case !relay:
+		return PathDirect, ""
+	case !direct:
+		return PathRelay, ""
+	}
+
+	d := mn.pathHealthLocked(node.ID, PathDirect)
+	r := mn.pathHealthLocked(node.ID, PathRelay)
+	switch {
+	case node.Path != PathRelay:
+		if reason := degraded(d, r); reason != "" {
+			return PathRelay, reason
+		}
+		return PathDirect, ""
+	case node.directFailed.IsZero():
+		return PathDirect, "" // Found by hole punching, not recovering
+	case time.Since(node.directFailed) >= mn.failoverTimeout() && recovered(d, r):
+		return PathDirect, ""
+	}
+	return PathRelay, ""
+}
+
+// updatePaths picks each peer's path after a direct path or the relay
+// came or went
+func (mn *MeshNetwork) updatePaths() {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	mn.updatePathsLocked()
+}
+
+// updatePathsLocked picks each peer's path, moving traffic off direct
+// paths that failed and back once they recover
+func (mn *MeshNetwork) updatePathsLocked() {
+	for _, node := range mn.nodes {
+		if node == mn.localNode {
+			continue
+		}
+		path, reason := mn.choosePathLocked(node)
+		if path == node.Path {
+			continue
+		}
+
+		event := MeshEvent{Type: EventPathChanged, Peer: node.Name, Path: path, Reason: reason}
+		switch {
+		case reason != "":
+			event.Type = EventFailover
+			node.directFailed = time.Now()
+			node.Failovers++
+			log.Printf("↪️  %s fails over to the relay: the direct path is degraded (%s)", node.Name, reason)
+		case path == PathDirect && node.Path == PathRelay && !node.directFailed.IsZero():
+			log.Printf("⬆️  %s is back on the direct path after %v", node.Name, time.Since(node.directFailed).Round(time.Second))
+		case path == PathDirect && node.Path == PathRelay:
+			log.Printf("⬆️  %s upgraded from the relay to a direct path", node.Name)
+		case path == PathRelay && node.Path == PathDirect:
+			log.Printf("↪️  %s falls back to the relay", node.Name)
+		case path == "" && node.Path != "":
+			log.Printf("⚠️  No path to %s", node.Name)
+		}
+		node.Path = path
+		node.PathSince = time.Now()
+		mn.publishLocked(event)
+	}
+}
+
+// Paths returns the path traffic takes to each peer and the measurements
+// of every path, ordered by peer name
+func (mn *MeshNetwork) Paths() []PeerPath {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+	return mn.pathsLocked()
+}
+
+func (mn *MeshNetwork) pathsLocked() []PeerPath {
+	paths := make([]PeerPath, 0, len(mn.nodes))
+	for id, node := range mn.nodes {
+		if node == mn.localNode {
+			continue
+		}
+		pp := PeerPath{
+			PeerID:    id,
+			Peer:      node.Name,
+			MeshIP:    node.MeshIP,
+			Path:      node.Path,
+			Endpoint:  node.DirectEndpoint,
+			Since:     node.PathSince,
+			Failovers: node.Failovers,
+		}
+		if mn.latency != nil {
+			mn.latency.mu.Lock()
+			for path := range mn.latency.windows[id] {
+				if stats, _ := mn.latency.stats(id, path); stats.Samples > 0 {
+					if pp.Paths == nil {
+						pp.Paths = make(map[string]PeerLatency)
+					}
+					pp.Paths[path] = stats
+				}
+			}
+			mn.latency.mu.Unlock()
+		}
+		paths = append(paths, pp)
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Peer < paths[j].Peer })
+	return paths
+}
@@ -0,0 +1,221 @@
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RoutingPolicy steers the subnet traffic of some nodes through some
+// gateways, such as "traffic from tag=eu exits via region=de". Selectors
+// are comma-separated terms that must all hold: tag=<tag>,
+// region=<region>, label.<key>=<value>, name=<node> or id=<node ID>; "*"
+// matches every node.
+type RoutingPolicy struct {
+	ID      string    `json:"id"`
+	From    string    `json:"from"`             // The nodes whose traffic it steers
+	Via     string    `json:"via"`              // The gateways their traffic may leave through
+	Subnet  string    `json:"subnet,omitempty"` // The destinations it covers; every advertised subnet when empty
+	Strict  bool      `json:"strict,omitempty"` // Never through other gateways, even when none of these is usable
+	Comment string    `json:"comment,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// selectorKeys are the node attributes a selector term may name
+var selectorKeys = []string{"tag", "region", "name", "id"}
+
+// validateSelector checks a policy selector's syntax
+func validateSelector(selector string) error {
+	if selector == "*" {
+		return nil
+	}
+	if selector == "" {
+		return fmt.Errorf("empty selector")
+	}
+	for _, term := range strings.Split(selector, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(term), "=")
+		if !ok || value == "" || !(containsString(selectorKeys, key) || strings.HasPrefix(key, "label.") && len(key) > len("label.")) {
+			return fmt.Errorf("invalid selector term %q: use tag=, region=, label.<key>=, name= or id=", term)
+		}
+	}
+	return nil
+}
+
+// matchesSelector reports whether a node satisfies every term of a
+// selector
+func matchesSelector(selector string, node *MeshNode) bool {
+	if selector == "*" {
+		return true
+	}
+	for _, term := range strings.Split(selector, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(term), "=")
+		var ok bool
+		switch key {
+		case "tag":
+			ok = containsString(node.Tags, value)
+		case "region":
+			ok = node.Region == value
+		case "name":
+			ok = node.Name == value
+		case "id":
+			ok = node.ID == value
+		default:
+			label, _ := strings.CutPrefix(key, "label.")
+			ok = node.Labels[label] == value
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// covers reports whether a subnet lies within the policy's destinations
+func (p RoutingPolicy) covers(subnet string) bool {
+	if p.Subnet == "" {
+		return true
+	}
+	_, scope, err := net.ParseCIDR(p.Subnet)
+	if err != nil {
+		return false
+	}
+	_, destination, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return false
+	}
+	scopeBits, _ := scope.Mask.Size()
+	destinationBits, _ := destination.Mask.Size()
+	return scope.Contains(destination.IP) && scopeBits <= destinationBits
+}
+
+// String describes a policy for logs and listings
+func (p RoutingPolicy) String() string {
+	s := fmt.Sprintf("from %s via %s", p.From, p.Via)
+	if p.Subnet != "" {
+		s += " to " + p.Subnet
+	}
+	if p.Strict {
+		s += " (strict)"
+	}
+	return s
+}
+
+// policyLocked returns the first policy steering the local node's traffic
+// to a subnet, or nil
+func (mn *MeshNetwork) policyLocked(subnet string) *RoutingPolicy {
+	for i, policy := range mn.policies {
+		if matchesSelector(policy.From, mn.localNode) && policy.covers(subnet) {
+			return &mn.policies[i]
+		}
+	}
+	return nil
+}
+
+// policyGatewaysLocked narrows the advertisers of a subnet, best first, to
+// those the local node's policy lets its traffic leave through. Without a
+// usable one, a policy that is not strict falls back to every advertiser.
+func (mn *MeshNetwork) policyGatewaysLocked(subnet string, advertisers []*MeshNode, usable func(*MeshNode) bool) []*MeshNode {
+	policy := mn.policyLocked(subnet)
+	if policy == nil {
+		return advertisers
+	}
+
+	var allowed []*MeshNode
+	fallback := !policy.Strict
+	for _, node := range advertisers {
+		if matchesSelector(policy.Via, node) {
+			allowed = append(allowed, node)
+			if usable(node) {
+				fallback = false
+			}
+		}
+	}
+	if fallback {
+		return advertisers
+	}
+	return allowed
+}
+
+// Policies returns the routing policies the coordinator distributes
+func (mn *MeshNetwork) Policies() []RoutingPolicy {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+	return append([]RoutingPolicy(nil), mn.policies...)
+}
+
+// handleListPolicies serves the routing policies, in the order they apply
+func (c *Coordinator) handleListPolicies(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	c.mu.Lock()
+	policies := append([]RoutingPolicy{}, c.policies...)
+	c.mu.Unlock()
+	writeJSON(w, policies)
+}
+
+// handleAddPolicy adds a routing policy after the existing ones, which
+// take precedence, and distributes it to the nodes
+func (c *Coordinator) handleAddPolicy(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	var policy RoutingPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid policy")
+		return
+	}
+	if err := validateSelector(policy.From); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("from: %v", err))
+		return
+	}
+	if err := validateSelector(policy.Via); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("via: %v", err))
+		return
+	}
+	if policy.Subnet != "" {
+		_, subnet, err := net.ParseCIDR(policy.Subnet)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid subnet %q", policy.Subnet))
+			return
+		}
+		policy.Subnet = subnet.String()
+	}
+	policy.ID = "pol-" + randomHex(4)
+	policy.Created = time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policies = append(c.policies, policy)
+	log.Printf("Mesh routing policy %s added: %s", policy.ID, policy)
+	c.bumpLocked()
+	writeJSON(w, policy)
+}
+
+// handleRemovePolicy removes a routing policy
+func (c *Coordinator) handleRemovePolicy(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := r.PathValue("id")
+	for i, policy := range c.policies {
+		if policy.ID == id {
+			c.policies = append(c.policies[:i:i], c.policies[i+1:]...)
+			log.Printf("Mesh routing policy %s removed", id)
+			c.bumpLocked()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "unknown policy")
+}
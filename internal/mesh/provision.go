@@ -0,0 +1,175 @@
+package mesh
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Where provisioning puts the agent on a remote node
+const (
+	remoteBinary  = "/usr/local/bin/tunnel"
+	remoteEnvFile = "/etc/tunnel/mesh.env"
+	remoteService = "tunnel-mesh"
+	remoteLogFile = "/var/log/tunnel-mesh.log"
+	remotePIDFile = "/var/run/tunnel-mesh.pid"
+)
+
+// ProvisionOptions says how to install a node's mesh agent
+type ProvisionOptions struct {
+	CoordinatorURL string
+	JoinToken      string
+	Name           string   // The node's name in the mesh
+	Binary         string   // The tunnel binary to install; this one when empty
+	Flags          []string // More tunnel mesh agent flags, such as --region
+}
+
+// ProvisionResult is what provisioning did on the remote host
+type ProvisionResult struct {
+	Platform string // uname -sm
+	Service  string // "systemd" or "nohup"
+	Sudo     bool   // Whether it ran as a user with sudo
+}
+
+// Provision installs the tunnel binary on the host behind client and
+// starts tunnel mesh agent there as a service, with a join token kept out
+// of the command line. The agent then registers with the coordinator,
+// which assigns its mesh IP and exchanges its keys with the other nodes.
+func Provision(client *ssh.Client, opts ProvisionOptions) (*ProvisionResult, error) {
+	if opts.CoordinatorURL == "" || opts.JoinToken == "" || opts.Name == "" {
+		return nil, fmt.Errorf("a coordinator URL, join token and node name are required")
+	}
+	result := &ProvisionResult{}
+
+	platform, err := runRemote(client, "uname -sm", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect the remote platform: %v", err)
+	}
+	result.Platform = platform
+	binary := opts.Binary
+	if binary == "" {
+		if want := runtime.GOOS + " " + runtime.GOARCH; !samePlatform(platform, want) {
+			return nil, fmt.Errorf("remote host runs %s but this binary is for %s: pass a binary built for it", platform, want)
+		}
+		if binary, err = os.Executable(); err != nil {
+			return nil, fmt.Errorf("failed to find this binary: %v", err)
+		}
+	}
+
+	uid, err := runRemote(client, "id -u", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check the remote user: %v", err)
+	}
+	sudo := ""
+	if uid != "0" {
+		if _, err := runRemote(client, "sudo -n true", nil); err != nil {
+			return nil, fmt.Errorf("the remote user is not root and cannot sudo without a password")
+		}
+		sudo = "sudo -n "
+		result.Sudo = true
+	}
+
+	f, err := os.Open(binary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", binary, err)
+	}
+	defer f.Close()
+	log.Printf("Uploading %s to %s", binary, remoteBinary)
+	upload := fmt.Sprintf("%ssh -c 'cat > %[2]s.new && chmod 755 %[2]s.new && mv -f %[2]s.new %[2]s'", sudo, remoteBinary)
+	if _, err := runRemote(client, upload, f); err != nil {
+		return nil, fmt.Errorf("failed to upload the binary: %v", err)
+	}
+
+	env := "MESH_JOIN_TOKEN=" + opts.JoinToken + "\n"
+	writeEnv := fmt.Sprintf("%[1]smkdir -p /etc/tunnel && %[1]ssh -c 'umask 077 && cat > %[2]s'", sudo, remoteEnvFile)
+	if _, err := runRemote(client, writeEnv, strings.NewReader(env)); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %v", remoteEnvFile, err)
+	}
+
+	args := append([]string{remoteBinary, "mesh", "agent", "--coordinator", opts.CoordinatorURL, "--name", opts.Name}, opts.Flags...)
+	for i, arg := range args {
+		args[i] = shellQuote(arg)
+	}
+	command := strings.Join(args, " ")
+
+	if _, err := runRemote(client, "command -v systemctl && test -d /run/systemd/system", nil); err == nil {
+		result.Service = "systemd"
+		unit := fmt.Sprintf(`[Unit]
+Description=SSH Tunnel mesh agent
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+EnvironmentFile=%s
+ExecStart=%s
+Restart=always
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`, remoteEnvFile, command)
+		unitPath := "/etc/systemd/system/" + remoteService + ".service"
+		install := fmt.Sprintf("%[1]ssh -c 'cat > %[2]s' && %[1]ssystemctl daemon-reload && %[1]ssystemctl enable %[3]s && %[1]ssystemctl restart %[3]s",
+			sudo, unitPath, remoteService)
+		if _, err := runRemote(client, install, strings.NewReader(unit)); err != nil {
+			return nil, fmt.Errorf("failed to start the %s service: %v", remoteService, err)
+		}
+		return result, nil
+	}
+
+	// Without systemd the agent runs in the background until the host
+	// reboots
+	result.Service = "nohup"
+	start := fmt.Sprintf("kill $(cat %[1]s 2>/dev/null) 2>/dev/null; set -a && . %[2]s && set +a && nohup %[3]s >> %[4]s 2>&1 < /dev/null & echo $! > %[1]s",
+		remotePIDFile, remoteEnvFile, command, remoteLogFile)
+	if _, err := runRemote(client, sudo+"sh -c "+shellQuote(start), nil); err != nil {
+		return nil, fmt.Errorf("failed to start the agent: %v", err)
+	}
+	return result, nil
+}
+
+// runRemote runs a command on the host with stdin as its input and returns
+// its trimmed output
+func runRemote(client *ssh.Client, cmd string, stdin io.Reader) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	output, err := session.CombinedOutput(cmd)
+	out := strings.TrimSpace(string(output))
+	if err != nil && out != "" {
+		return out, fmt.Errorf("%v: %s", err, out)
+	}
+	return out, err
+}
+
+// samePlatform reports whether uname -sm output matches a GOOS GOARCH pair
+func samePlatform(uname, goPlatform string) bool {
+	system, machine, _ := strings.Cut(strings.ToLower(uname), " ")
+	goos, goarch, _ := strings.Cut(goPlatform, " ")
+	if system != goos {
+		return false
+	}
+	switch machine {
+	case "x86_64", "amd64":
+		return goarch == "amd64"
+	case "aarch64", "arm64":
+		return goarch == "arm64"
+	case "i386", "i686":
+		return goarch == "386"
+	}
+	return strings.HasPrefix(machine, "arm") && goarch == "arm"
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,147 @@
+package mesh
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// PunchOffer asks a node to punch a hole to a peer. Both sides get one at
+// the same time and send authenticated probes to each other's endpoints,
+// so each NAT sees traffic go out before the peer's probes come in.
+type PunchOffer struct {
+	Session   string   `json:"session"` // Hex
+	Key       string   `json:"key"`     // Authenticates the probes, hex
+	PeerID    string   `json:"peer_id"`
+	PeerName  string   `json:"peer_name"`
+	Endpoints []string `json:"endpoints"` // The peer's public endpoint, then its local ones
+}
+
+// Punch probes are "MPU1", a kind, the 8-byte session and a truncated
+// HMAC of the rest. WireGuard messages start with a type of 1 to 4 and
+// three zero bytes, so the two can share a socket.
+const (
+	punchMagic   = "MPU1"
+	punchPing    = 1
+	punchPong    = 2
+	punchIDLen   = 8
+	punchMACLen  = 16
+	punchSize    = len(punchMagic) + 1 + punchIDLen + punchMACLen
+	punchKeySize = 32
+)
+
+// punchPacket builds a probe of kind for a session
+func punchPacket(kind byte, session, key []byte) []byte {
+	packet := make([]byte, 0, punchSize)
+	packet = append(packet, punchMagic...)
+	packet = append(packet, kind)
+	packet = append(packet, session...)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(packet)
+	return append(packet, mac.Sum(nil)[:punchMACLen]...)
+}
+
+// parsePunchPacket returns a probe's kind and session, leaving the MAC to
+// verifyPunchPacket once the session's key is known
+func parsePunchPacket(packet []byte) (kind byte, session string, ok bool) {
+	if len(packet) != punchSize || string(packet[:len(punchMagic)]) != punchMagic {
+		return 0, "", false
+	}
+	kind = packet[len(punchMagic)]
+	if kind != punchPing && kind != punchPong {
+		return 0, "", false
+	}
+	id := packet[len(punchMagic)+1 : len(punchMagic)+1+punchIDLen]
+	return kind, hex.EncodeToString(id), true
+}
+
+func verifyPunchPacket(packet, key []byte) bool {
+	signed := len(packet) - punchMACLen
+	mac := hmac.New(sha256.New, key)
+	mac.Write(packet[:signed])
+	return hmac.Equal(packet[signed:], mac.Sum(nil)[:punchMACLen])
+}
+
+// handlePunch starts a hole punch between the calling node and a peer. The
+// peer gets its offer over its update stream, the caller in the reply.
+func (c *Coordinator) handlePunch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PeerID string `json:"peer_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid punch request")
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.authenticateLocked(r)
+	if node == nil {
+		writeError(w, http.StatusUnauthorized, "unknown node token")
+		return
+	}
+	if !node.admitted() {
+		writeError(w, http.StatusForbidden, "node is waiting for approval or quarantined")
+		return
+	}
+	peer := c.nodes[req.PeerID]
+	if peer == nil || !peer.admitted() || peer.ID == node.ID {
+		writeError(w, http.StatusNotFound, "unknown peer")
+		return
+	}
+	if peer.streams == 0 {
+		writeError(w, http.StatusConflict, fmt.Sprintf("%s is not connected to the coordinator", peer.Name))
+		return
+	}
+
+	session, key := randomHex(punchIDLen), randomHex(punchKeySize)
+	select {
+	case c.punchesLocked(peer) <- PunchOffer{
+		Session:   session,
+		Key:       key,
+		PeerID:    node.ID,
+		PeerName:  node.Name,
+		Endpoints: punchEndpoints(node.Peer),
+	}:
+	default:
+		writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("%s has too many punches pending", peer.Name))
+		return
+	}
+
+	log.Printf("Mesh hole punch %s between %s and %s", session, node.Name, peer.Name)
+	writeJSON(w, PunchOffer{
+		Session:   session,
+		Key:       key,
+		PeerID:    peer.ID,
+		PeerName:  peer.Name,
+		Endpoints: punchEndpoints(peer.Peer),
+	})
+}
+
+// punchesLocked returns the queue of punch offers for a node's update
+// streams
+func (c *Coordinator) punchesLocked(node *coordinatedNode) chan PunchOffer {
+	if node.punches == nil {
+		node.punches = make(chan PunchOffer, 8)
+	}
+	return node.punches
+}
+
+// punchEndpoints lists where a peer may be reached, public endpoint first
+func punchEndpoints(peer Peer) []string {
+	endpoints := make([]string, 0, 1+len(peer.LocalEndpoints))
+	if peer.Endpoint != "" {
+		endpoints = append(endpoints, peer.Endpoint)
+	}
+	for _, endpoint := range peer.LocalEndpoints {
+		if !containsString(endpoints, endpoint) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
@@ -0,0 +1,253 @@
+package mesh
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// relayPath is where relays, the coordinator's own included, accept
+	// node connections
+	relayPath = "/mesh/v1/relay"
+
+	// relayTokenPrefix starts every relay token
+	relayTokenPrefix = "mrt1."
+
+	// relayTokenTTL is how long a relay token is valid; nodes get a fresh
+	// one with every heartbeat
+	relayTokenTTL = 24 * time.Hour
+
+	relayMaxPacket = 64 << 10
+	relayQueue     = 256 // Packets queued per node before dropping, as UDP would
+)
+
+// Relay passes packets between mesh nodes that cannot reach each other
+// directly, like Tailscale's DERP. Nodes keep a WebSocket open to it and
+// send frames addressed to a peer's node ID; the relay hands them to the
+// peer's connection with the sender's ID instead. It only sees packets
+// the nodes already encrypted end to end.
+//
+// A frame is the length of the node ID in one byte, the ID and the packet.
+// A lone zero byte welcomes a node once the relay admitted it.
+type Relay struct {
+	authenticate RelayAuthFunc
+
+	mu    sync.Mutex
+	nodes map[string]*relayNode // By node ID
+}
+
+// RelayAuthFunc identifies the node behind a relay connection request. The
+// relay drops the connection at expires, unless it is zero.
+type RelayAuthFunc func(r *http.Request) (nodeID string, expires time.Time, ok bool)
+
+// relayNode is a node's connection to the relay
+type relayNode struct {
+	ws    *websocket.Conn
+	queue chan []byte
+}
+
+// NewRelay creates a relay admitting the nodes authenticate accepts
+func NewRelay(authenticate RelayAuthFunc) *Relay {
+	return &Relay{
+		authenticate: authenticate,
+		nodes:        make(map[string]*relayNode),
+	}
+}
+
+// Handler returns the relay's HTTP API
+func (r *Relay) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET "+relayPath, websocket.Server{Handler: r.serve})
+	return mux
+}
+
+// Nodes returns how many nodes are connected
+func (r *Relay) Nodes() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.nodes)
+}
+
+// Drop disconnects a node, as when it leaves or is removed from the mesh
+func (r *Relay) Drop(nodeID string) {
+	r.mu.Lock()
+	node := r.nodes[nodeID]
+	r.mu.Unlock()
+	if node != nil {
+		node.ws.Close()
+	}
+}
+
+// serve relays a node's frames until its connection closes. A node
+// connecting again replaces its older connection.
+func (r *Relay) serve(ws *websocket.Conn) {
+	defer ws.Close()
+
+	id, expires, ok := r.authenticate(ws.Request())
+	if !ok {
+		websocket.JSON.Send(ws, map[string]string{"error": "unknown node token"})
+		return
+	}
+	ws.MaxPayloadBytes = relayMaxPacket + 1 + 255
+	ws.PayloadType = websocket.BinaryFrame
+
+	node := &relayNode{ws: ws, queue: make(chan []byte, relayQueue)}
+	r.mu.Lock()
+	if old := r.nodes[id]; old != nil {
+		old.ws.Close()
+	}
+	r.nodes[id] = node
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		if r.nodes[id] == node {
+			delete(r.nodes, id)
+		}
+		r.mu.Unlock()
+	}()
+
+	if websocket.Message.Send(ws, relayWelcome) != nil {
+		return
+	}
+	if !expires.IsZero() {
+		timer := time.AfterFunc(time.Until(expires), func() { ws.Close() })
+		defer timer.Stop()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case frame := <-node.queue:
+				if websocket.Message.Send(ws, frame) != nil {
+					ws.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		var frame []byte
+		if err := websocket.Message.Receive(ws, &frame); err != nil {
+			return
+		}
+		to, packet, ok := parseRelayFrame(frame)
+		if !ok || to == id {
+			continue
+		}
+
+		r.mu.Lock()
+		peer := r.nodes[to]
+		r.mu.Unlock()
+		if peer == nil {
+			continue // Not connected; the packet is lost as on a UDP path
+		}
+		select {
+		case peer.queue <- relayFrame(id, packet):
+		default:
+		}
+	}
+}
+
+var relayWelcome = []byte{0}
+
+func isRelayWelcome(frame []byte) bool {
+	return len(frame) == 1 && frame[0] == 0
+}
+
+// relayFrame builds a frame for a node ID and packet
+func relayFrame(nodeID string, packet []byte) []byte {
+	frame := make([]byte, 0, 1+len(nodeID)+len(packet))
+	frame = append(frame, byte(len(nodeID)))
+	frame = append(frame, nodeID...)
+	return append(frame, packet...)
+}
+
+func parseRelayFrame(frame []byte) (nodeID string, packet []byte, ok bool) {
+	if len(frame) < 1 {
+		return "", nil, false
+	}
+	n := int(frame[0])
+	if n == 0 || len(frame) < 1+n {
+		return "", nil, false
+	}
+	return string(frame[1 : 1+n]), frame[1+n:], true
+}
+
+// relayTokenClaims is the signed part of a relay token
+type relayTokenClaims struct {
+	Node    string `json:"node"`
+	Expires int64  `json:"exp"` // Unix time
+}
+
+// SignRelayToken returns a token admitting a node to relays sharing secret
+// with the coordinator, until expires
+func SignRelayToken(secret, nodeID string, expires time.Time) string {
+	payload, _ := json.Marshal(relayTokenClaims{Node: nodeID, Expires: expires.Unix()})
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return relayTokenPrefix +
+		base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// RelayTokenAuth admits nodes presenting a relay token signed with secret,
+// for relays run apart from the coordinator
+func RelayTokenAuth(secret string) RelayAuthFunc {
+	return func(r *http.Request) (string, time.Time, bool) {
+		claims, err := verifyRelayToken(secret, bearerToken(r))
+		if err != nil {
+			log.Printf("Mesh relay refused %s: %v", r.RemoteAddr, err)
+			return "", time.Time{}, false
+		}
+		return claims.Node, time.Unix(claims.Expires, 0), true
+	}
+}
+
+func verifyRelayToken(secret, token string) (*relayTokenClaims, error) {
+	rest, ok := strings.CutPrefix(token, relayTokenPrefix)
+	if !ok {
+		return nil, fmt.Errorf("not a relay token")
+	}
+	encodedPayload, encodedSignature, ok := strings.Cut(rest, ".")
+	if !ok {
+		return nil, fmt.Errorf("invalid relay token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay token")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid relay token")
+	}
+	var claims relayTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Node == "" {
+		return nil, fmt.Errorf("invalid relay token")
+	}
+	if time.Now().Unix() > claims.Expires {
+		return nil, fmt.Errorf("relay token of %s expired", claims.Node)
+	}
+	return &claims, nil
+}
@@ -0,0 +1,321 @@
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Paths packets take to a peer
+const (
+	PathDirect = "direct" // To the endpoint hole punching confirmed
+	PathRelay  = "relay"  // Through the relay, until a direct path is found
+)
+
+// relayClient keeps the node connected to its relay: the relay node the
+// coordinator designates, or the coordinator's own
+type relayClient struct {
+	mn *MeshNetwork
+
+	mu        sync.Mutex
+	url       string // Empty for the coordinator's relay
+	token     string // Relay token for a relay node
+	ws        *websocket.Conn
+	connected bool
+}
+
+func newRelayClient(mn *MeshNetwork) *relayClient {
+	return &relayClient{mn: mn}
+}
+
+// set takes the relay and token from a registration or heartbeat reply,
+// reconnecting when the relay moved
+func (rc *relayClient) set(relayURL, token string) {
+	rc.mu.Lock()
+	moved := relayURL != rc.url
+	rc.url = relayURL
+	rc.token = token
+	ws := rc.ws
+	rc.mu.Unlock()
+
+	if moved && ws != nil {
+		ws.Close()
+	}
+}
+
+// reconnect drops the relay connection for run to open a new one
+func (rc *relayClient) reconnect() {
+	rc.mu.Lock()
+	ws := rc.ws
+	rc.mu.Unlock()
+
+	if ws != nil {
+		ws.Close()
+	}
+}
+
+// status returns the relay in use, "coordinator" for the coordinator's,
+// and whether the node is connected to it
+func (rc *relayClient) status() (string, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.url == "" {
+		return "coordinator", rc.connected
+	}
+	return rc.url, rc.connected
+}
+
+// run holds the relay connection open, reconnecting with backoff, until
+// the mesh stops
+func (rc *relayClient) run() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := rc.connect()
+		if rc.mn.ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(start) > coordinatorMaxBackoff {
+			backoff = time.Second
+		}
+		log.Printf("⚠️  Mesh relay connection lost: %v; reconnecting in %v", err, backoff)
+		select {
+		case <-rc.mn.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > coordinatorMaxBackoff {
+			backoff = coordinatorMaxBackoff
+		}
+	}
+}
+
+// connect receives relayed packets until the connection fails
+func (rc *relayClient) connect() error {
+	rc.mu.Lock()
+	base, token := rc.url, rc.token
+	rc.mu.Unlock()
+
+	pin := ""
+	if base == "" {
+		base, pin = rc.mn.coordinatorURL(), rc.mn.coordinatorPin()
+		rc.mn.mu.RLock()
+		token = rc.mn.nodeToken
+		rc.mn.mu.RUnlock()
+	} else if rc.mn.config.Encryption {
+		if err := checkEncryptedURL("relay", base); err != nil {
+			return err
+		}
+	}
+	wsConfig, err := websocketConfig(base, relayPath)
+	if err != nil {
+		return err
+	}
+	wsConfig.TlsConfig = pinnedTLSConfig(pin)
+	wsConfig.Header.Set("Authorization", "Bearer "+token)
+
+	ws, err := websocket.DialConfig(wsConfig)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	ws.PayloadType = websocket.BinaryFrame
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-rc.mn.ctx.Done():
+			ws.Close()
+		case <-stop:
+		}
+	}()
+
+	rc.mu.Lock()
+	rc.ws = ws
+	rc.mu.Unlock()
+	defer func() {
+		rc.mu.Lock()
+		rc.ws = nil
+		rc.connected = false
+		rc.mu.Unlock()
+		if rc.mn.ctx.Err() == nil {
+			rc.mn.updatePaths()
+		}
+	}()
+
+	for {
+		var frame []byte
+		if err := websocket.Message.Receive(ws, &frame); err != nil {
+			return err
+		}
+		if isRelayWelcome(frame) {
+			rc.mu.Lock()
+			rc.connected = true
+			rc.mu.Unlock()
+			rc.mn.updatePaths()
+			log.Printf("🛰️  Connected to mesh relay %s", base)
+			continue
+		}
+		from, packet, ok := parseRelayFrame(frame)
+		if !ok {
+			var reply struct {
+				Error string `json:"error"`
+			}
+			if json.Unmarshal(frame, &reply) == nil && reply.Error != "" {
+				return fmt.Errorf("relay refused the node: %s", reply.Error)
+			}
+			continue
+		}
+		rc.mn.deliver(from, packet)
+	}
+}
+
+// send relays a packet to a peer
+func (rc *relayClient) send(peerID string, packet []byte) error {
+	rc.mu.Lock()
+	ws := rc.ws
+	rc.mu.Unlock()
+
+	if ws == nil {
+		return fmt.Errorf("not connected to the relay")
+	}
+	if err := websocket.Message.Send(ws, relayFrame(peerID, packet)); err != nil {
+		ws.Close()
+		return fmt.Errorf("relay send failed: %v", err)
+	}
+	return nil
+}
+
+// websocketConfig returns the WebSocket config for path on an HTTP(S)
+// base URL
+func websocketConfig(base, path string) (*websocket.Config, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	origin := *u
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	return websocket.NewConfig(u.String(), origin.String())
+}
+
+// SetPacketHandler sets the function receiving packets from peers, over
+// direct paths and the relay alike
+func (mn *MeshNetwork) SetPacketHandler(handler func(peerID string, packet []byte)) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	mn.packetHandler = handler
+}
+
+// SendToPeer sends a packet to a peer over its direct path or, while it
+// has none, through the relay
+func (mn *MeshNetwork) SendToPeer(peerID string, packet []byte) error {
+	mn.mu.RLock()
+	node := mn.nodes[peerID]
+	var path, name string
+	if node != nil {
+		path, name = node.Path, node.Name
+	}
+	mn.mu.RUnlock()
+
+	switch {
+	case node == nil:
+		return fmt.Errorf("unknown mesh peer %s", peerID)
+	case path == "":
+		return fmt.Errorf("no path to mesh peer %s", name)
+	}
+	if err := mn.sendOnPath(peerID, path, packet); err != nil {
+		return err
+	}
+	mn.traffic.add(peerID, len(packet), 0)
+	return nil
+}
+
+// sendOnPath sends a packet to a peer on a given path, whether or not
+// traffic takes it
+func (mn *MeshNetwork) sendOnPath(peerID, path string, packet []byte) error {
+	mn.mu.RLock()
+	node := mn.nodes[peerID]
+	var endpoint, name string
+	if node != nil {
+		endpoint, name = node.DirectEndpoint, node.Name
+	}
+	mn.mu.RUnlock()
+
+	switch {
+	case node == nil:
+		return fmt.Errorf("unknown mesh peer %s", peerID)
+	case path == PathDirect && endpoint != "" && mn.nat != nil:
+		addr, err := netip.ParseAddrPort(endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid direct endpoint %s of %s", endpoint, name)
+		}
+		_, err = mn.nat.conn.WriteToUDPAddrPort(packet, addr)
+		return err
+	case path == PathRelay && mn.relay != nil:
+		return mn.relay.send(peerID, packet)
+	default:
+		return fmt.Errorf("no %s path to mesh peer %s", path, name)
+	}
+}
+
+// deliver passes a packet a peer sent through the relay to the packet
+// handler
+func (mn *MeshNetwork) deliver(peerID string, packet []byte) {
+	mn.mu.RLock()
+	handler := mn.packetHandler
+	_, known := mn.nodes[peerID]
+	mn.mu.RUnlock()
+
+	if !known {
+		return
+	}
+	if isLatencyPacket(packet) {
+		mn.handleLatencyPacket(peerID, PathRelay, packet)
+	} else if handler != nil {
+		mn.traffic.add(peerID, 0, len(packet))
+		handler(peerID, packet)
+	}
+}
+
+// deliverDirect passes a packet that arrived on the UDP port to the packet
+// handler, when it came from a peer's direct path
+func (mn *MeshNetwork) deliverDirect(from *net.UDPAddr, packet []byte) {
+	endpoint := from.String()
+	mn.mu.RLock()
+	var peerID string
+	for id, node := range mn.nodes {
+		if node.DirectEndpoint == endpoint {
+			peerID = id
+			break
+		}
+	}
+	handler := mn.packetHandler
+	mn.mu.RUnlock()
+
+	if peerID == "" {
+		return
+	}
+	if isLatencyPacket(packet) {
+		mn.handleLatencyPacket(peerID, PathDirect, packet)
+	} else if handler != nil {
+		mn.traffic.add(peerID, 0, len(packet))
+		handler(peerID, packet)
+	}
+}
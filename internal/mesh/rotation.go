@@ -0,0 +1,193 @@
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"ssh-tunnel/internal/wireguard"
+)
+
+const (
+	// DefaultKeyRotationOverlap is how long the replaced WireGuard key and
+	// node token keep working after a rotation, for peers and requests
+	// that have not caught up yet
+	DefaultKeyRotationOverlap = 10 * time.Minute
+
+	maxKeyRotationOverlap = 24 * time.Hour
+	keyRotationRetry      = time.Minute
+)
+
+// RotateRequest replaces a node's WireGuard public key and node token
+type RotateRequest struct {
+	PublicKey string `json:"public_key"`
+	Overlap   string `json:"overlap,omitempty"` // How long the old node token keeps working, e.g. "10m"
+}
+
+// RotateResponse carries a node's new node token
+type RotateResponse struct {
+	NodeToken            string    `json:"node_token"`
+	KeyRotated           time.Time `json:"key_rotated"`
+	PreviousTokenExpires time.Time `json:"previous_token_expires"`
+}
+
+// KeyRotationStatus is where a node stands with key rotation
+type KeyRotationStatus struct {
+	Interval     time.Duration `json:"interval"` // Zero without automatic rotation
+	Overlap      time.Duration `json:"overlap"`
+	LastRotated  time.Time     `json:"last_rotated"` // When the current key was registered
+	NextRotation time.Time     `json:"next_rotation,omitempty"`
+	Rotations    int           `json:"rotations"`
+	LastError    string        `json:"last_error,omitempty"`
+}
+
+// handleRotate gives a node a new public key and node token. Peers learn
+// the key from the next membership update and keep their sessions with the
+// node; the old node token keeps working for the overlap.
+func (c *Coordinator) handleRotate(w http.ResponseWriter, r *http.Request) {
+	var req RotateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid rotation request")
+		return
+	}
+	if _, err := wireguard.ParseKey(req.PublicKey); err != nil {
+		writeError(w, http.StatusBadRequest, "public_key must be a WireGuard public key")
+		return
+	}
+	overlap := DefaultKeyRotationOverlap
+	if req.Overlap != "" {
+		d, err := time.ParseDuration(req.Overlap)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, "invalid overlap")
+			return
+		}
+		overlap = min(d, maxKeyRotationOverlap)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.authenticateLocked(r)
+	if node == nil {
+		writeError(w, http.StatusUnauthorized, "unknown node token")
+		return
+	}
+	if _, revoked := c.revoked[req.PublicKey]; revoked {
+		writeError(w, http.StatusForbidden, "key was revoked")
+		return
+	}
+	for _, n := range c.nodes {
+		if n.PublicKey == req.PublicKey && n != node {
+			writeError(w, http.StatusConflict, "key is taken by another node")
+			return
+		}
+	}
+
+	now := time.Now()
+	if req.PublicKey != node.PublicKey {
+		node.PublicKey = req.PublicKey
+		node.KeyRotated = now
+	}
+	node.PreviousToken, node.PreviousTokenExpires = node.Token, now.Add(overlap)
+	node.Token = randomHex(32)
+	log.Printf("Mesh node %s (%s) rotated its keys", node.Name, node.MeshIP)
+	c.bumpLocked()
+
+	writeJSON(w, RotateResponse{
+		NodeToken:            node.Token,
+		KeyRotated:           node.KeyRotated,
+		PreviousTokenExpires: node.PreviousTokenExpires,
+	})
+}
+
+// rotateKeys rotates the node's keys every KeyRotationInterval, retrying
+// failed rotations sooner, until the mesh stops
+func (mn *MeshNetwork) rotateKeys() {
+	interval := mn.config.KeyRotationInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-mn.ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if err := mn.RotateKeys(); err != nil {
+			log.Printf("⚠️  Mesh key rotation failed: %v; retrying in %v", err, keyRotationRetry)
+			timer.Reset(min(keyRotationRetry, interval))
+			continue
+		}
+		timer.Reset(interval)
+	}
+}
+
+// RotateKeys replaces the node's WireGuard key pair and node token. The
+// data plane keeps answering handshakes with the old key for the overlap,
+// and established sessions carry on, so traffic is not interrupted.
+func (mn *MeshNetwork) RotateKeys() error {
+	privateKey, publicKey, err := generateWireGuardKeys()
+	if err != nil {
+		return err
+	}
+	private, err := wireguard.ParseKey(privateKey)
+	if err != nil {
+		return err
+	}
+	overlap := mn.keyRotationOverlap()
+
+	mn.mu.RLock()
+	token := mn.nodeToken
+	mn.mu.RUnlock()
+
+	var resp RotateResponse
+	req := RotateRequest{PublicKey: publicKey, Overlap: overlap.String()}
+	err = mn.coordinatorCall(http.MethodPost, "/mesh/v1/rotate", token, req, &resp)
+
+	mn.mu.Lock()
+	if err != nil {
+		mn.rotation.LastError = err.Error()
+		mn.mu.Unlock()
+		return fmt.Errorf("coordinator refused the new key: %v", err)
+	}
+	mn.localNode.PrivateKey = privateKey
+	mn.localNode.PublicKey = publicKey
+	mn.nodeToken = resp.NodeToken
+	mn.rotation.LastRotated = resp.KeyRotated
+	mn.rotation.Rotations++
+	mn.rotation.LastError = ""
+	dp := mn.dataPlane
+	mn.mu.Unlock()
+
+	if dp != nil {
+		dp.device.SetPrivateKey(private, overlap)
+	}
+	log.Printf("🔑 Rotated mesh keys; the old key keeps working for %v", overlap)
+	return nil
+}
+
+// KeyRotation returns the node's key rotation status
+func (mn *MeshNetwork) KeyRotation() KeyRotationStatus {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+	return mn.keyRotationLocked()
+}
+
+func (mn *MeshNetwork) keyRotationLocked() KeyRotationStatus {
+	status := mn.rotation
+	status.Interval = mn.config.KeyRotationInterval
+	status.Overlap = mn.keyRotationOverlap()
+	if status.Interval > 0 && !status.LastRotated.IsZero() {
+		status.NextRotation = status.LastRotated.Add(status.Interval)
+	}
+	return status
+}
+
+func (mn *MeshNetwork) keyRotationOverlap() time.Duration {
+	if mn.config.KeyRotationOverlap > 0 {
+		return mn.config.KeyRotationOverlap
+	}
+	return DefaultKeyRotationOverlap
+}
@@ -0,0 +1,130 @@
+package mesh
+
+import (
+	"sort"
+)
+
+// RouteSubnet marks routes to subnets peers advertise
+const RouteSubnet = "subnet"
+
+// updateSubnetRoutesLocked rebuilds the routes to the subnets peers
+// advertise. A subnet advertised by several peers goes through an online
+// one that is not draining, the fastest as measured, so it fails over when
+// that peer goes offline or is drained. A route only moves to a faster
+// peer when the gain is clear, and peers with the same latency go by name.
+// A routing policy for the local node narrows the peers a subnet may go
+// through.
+func (mn *MeshNetwork) updateSubnetRoutesLocked() {
+	routes := make(map[string]*Route)
+	if !mn.config.AcceptRoutes {
+		mn.routes = routes
+		return
+	}
+
+	iface := mn.config.Interface
+	if iface == "" {
+		iface = DefaultInterface
+	}
+
+	gateways := make([]*MeshNode, 0, len(mn.nodes))
+	byIP := make(map[string]*MeshNode)
+	for _, node := range mn.nodes {
+		if node != mn.localNode && len(node.Routes) > 0 {
+			gateways = append(gateways, node)
+			byIP[node.MeshIP] = node
+		}
+	}
+	// A gateway without a path, or losing most probes, fails its subnets
+	// over to another advertiser
+	reachable := func(node *MeshNode) bool { return node.Path != "" && node.PacketLoss < pathLossFailover }
+	usable := func(node *MeshNode) bool { return node.Status == "online" && !node.Draining && reachable(node) }
+	sort.Slice(gateways, func(i, j int) bool {
+		if online := gateways[i].Status == "online"; online != (gateways[j].Status == "online") {
+			return online
+		}
+		if gateways[i].Draining != gateways[j].Draining {
+			return !gateways[i].Draining
+		}
+		if ri := reachable(gateways[i]); ri != reachable(gateways[j]) {
+			return ri
+		}
+		if li, lj := nodeLatency(gateways[i]), nodeLatency(gateways[j]); li != lj {
+			return li < lj
+		}
+		return gateways[i].Name < gateways[j].Name
+	})
+
+	advertisers := make(map[string][]*MeshNode) // By subnet, best first
+	for _, node := range gateways {
+		for _, subnet := range node.Routes {
+			if !containsString(mn.localNode.Routes, subnet) && !containsNode(advertisers[subnet], node) {
+				advertisers[subnet] = append(advertisers[subnet], node)
+			}
+		}
+	}
+
+	for subnet, nodes := range advertisers {
+		candidates := mn.policyGatewaysLocked(subnet, nodes, usable)
+		if len(candidates) == 0 {
+			continue // A strict policy and no gateway it allows
+		}
+		gateway := candidates[0]
+		if old, ok := mn.routes[subnet]; ok {
+			current := byIP[old.Gateway]
+			if current != nil && current != gateway && usable(current) && usable(gateway) &&
+				containsNode(candidates, current) && !fasterGateway(gateway, current) {
+				gateway = current
+			}
+		}
+		routes[subnet] = &Route{
+			Destination: subnet,
+			Gateway:     gateway.MeshIP,
+			Interface:   iface,
+			Protocol:    RouteSubnet,
+		}
+	}
+	mn.publishRouteChangesLocked(routes)
+	mn.routes = routes
+}
+
+// publishRouteChangesLocked publishes the subnets whose gateway differs
+// between the current routes and new ones
+func (mn *MeshNetwork) publishRouteChangesLocked(routes map[string]*Route) {
+	for subnet, old := range mn.routes {
+		if route, ok := routes[subnet]; !ok || route.Gateway != old.Gateway {
+			event := MeshEvent{Type: EventRouteChanged, Subnet: subnet}
+			if ok {
+				event.Gateway = route.Gateway
+			}
+			mn.publishLocked(event)
+		}
+	}
+	for subnet, route := range routes {
+		if _, ok := mn.routes[subnet]; !ok {
+			mn.publishLocked(MeshEvent{Type: EventRouteChanged, Subnet: subnet, Gateway: route.Gateway})
+		}
+	}
+}
+
+// Routes returns the routes to subnets behind peers, ordered by
+// destination
+func (mn *MeshNetwork) Routes() []Route {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+
+	routes := make([]Route, 0, len(mn.routes))
+	for _, route := range mn.routes {
+		routes = append(routes, *route)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Destination < routes[j].Destination })
+	return routes
+}
+
+func containsNode(nodes []*MeshNode, node *MeshNode) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
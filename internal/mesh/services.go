@@ -0,0 +1,217 @@
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Service is a named port on a node, such as "postgres on 5432", that other
+// nodes forward to by name. The coordinator keeps services by node name,
+// so they outlive the node registering again.
+type Service struct {
+	Name        string    `json:"name"`
+	Node        string    `json:"node"` // Name of the node it runs on
+	Port        int       `json:"port"`
+	Protocol    string    `json:"protocol"` // "tcp" or "udp"
+	Description string    `json:"description,omitempty"`
+	Created     time.Time `json:"created"`
+
+	// Filled in from the node when served
+	NodeID string `json:"node_id,omitempty"`
+	MeshIP string `json:"mesh_ip,omitempty"`
+	Online bool   `json:"online"`
+}
+
+// Address is where the service is reached over the mesh
+func (s Service) Address() string {
+	return net.JoinHostPort(s.MeshIP, strconv.Itoa(s.Port))
+}
+
+// Services returns the services the coordinator distributes
+func (mn *MeshNetwork) Services() []Service {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+	return append([]Service(nil), mn.services...)
+}
+
+// servicesLocked returns the services, with where their nodes are now,
+// ordered by name and node
+func (c *Coordinator) servicesLocked() []Service {
+	services := make([]Service, 0, len(c.services))
+	for _, service := range c.services {
+		for _, node := range c.nodes {
+			if node.Name == service.Node && node.admitted() {
+				service.NodeID, service.MeshIP = node.ID, node.MeshIP
+				service.Online = node.Status == "online" && !node.Draining
+			}
+		}
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Name != services[j].Name {
+			return services[i].Name < services[j].Name
+		}
+		return services[i].Node < services[j].Node
+	})
+	return services
+}
+
+// handleListServices serves the services; ?name= narrows them to one name
+func (c *Coordinator) handleListServices(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	c.mu.Lock()
+	services := c.servicesLocked()
+	c.mu.Unlock()
+
+	if name := r.URL.Query().Get("name"); name != "" {
+		matching := services[:0]
+		for _, service := range services {
+			if service.Name == name {
+				matching = append(matching, service)
+			}
+		}
+		services = matching
+	}
+	writeJSON(w, services)
+}
+
+// handleExposeService adds a service, or replaces the one of that name on
+// the node, and distributes it to the nodes
+func (c *Coordinator) handleExposeService(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	var service Service
+	if err := json.NewDecoder(r.Body).Decode(&service); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid service")
+		return
+	}
+	if !metadataName.MatchString(service.Name) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid service name %q", service.Name))
+		return
+	}
+	if service.Port < 1 || service.Port > 65535 {
+		writeError(w, http.StatusBadRequest, "port must be 1-65535")
+		return
+	}
+	switch service.Protocol {
+	case "":
+		service.Protocol = "tcp"
+	case "tcp", "udp":
+	default:
+		writeError(w, http.StatusBadRequest, "protocol must be tcp or udp")
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.findNodeLocked(service.Node)
+	if node == nil {
+		writeError(w, http.StatusNotFound, "unknown node")
+		return
+	}
+	service.Node = node.Name
+	service.NodeID, service.MeshIP, service.Online = "", "", false
+	service.Created = time.Now()
+
+	replaced := false
+	for i, existing := range c.services {
+		if existing.Name == service.Name && existing.Node == service.Node {
+			c.services[i] = service
+			replaced = true
+		}
+	}
+	if !replaced {
+		c.services = append(c.services, service)
+	}
+	log.Printf("Mesh service %s exposed on %s:%d/%s", service.Name, service.Node, service.Port, service.Protocol)
+	c.bumpLocked()
+
+	for _, s := range c.servicesLocked() {
+		if s.Name == service.Name && s.Node == service.Node {
+			writeJSON(w, s)
+		}
+	}
+}
+
+// handleRemoveService removes a service; ?node= picks the node when
+// several expose the name
+func (c *Coordinator) handleRemoveService(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name, nodeRef := r.PathValue("name"), r.URL.Query().Get("node")
+	if nodeRef != "" {
+		if node := c.findNodeLocked(nodeRef); node != nil {
+			nodeRef = node.Name
+		}
+	}
+	var kept []Service
+	var removed []Service
+	for _, service := range c.services {
+		if service.Name == name && (nodeRef == "" || service.Node == nodeRef) {
+			removed = append(removed, service)
+		} else {
+			kept = append(kept, service)
+		}
+	}
+	switch {
+	case len(removed) == 0:
+		writeError(w, http.StatusNotFound, "unknown service")
+		return
+	case len(removed) > 1 && nodeRef == "":
+		writeError(w, http.StatusConflict, "several nodes expose the service: name one")
+		return
+	}
+	c.services = kept
+	log.Printf("Mesh service %s on %s removed", name, removed[0].Node)
+	c.bumpLocked()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListServices returns the services, or those with a name when it is not
+// empty
+func (a *AdminClient) ListServices(name string) ([]Service, error) {
+	path := "/mesh/v1/services"
+	if name != "" {
+		path += "?name=" + url.QueryEscape(name)
+	}
+	var services []Service
+	err := a.call(http.MethodGet, path, nil, &services)
+	return services, err
+}
+
+// ExposeService adds a service on a node, named or by ID
+func (a *AdminClient) ExposeService(service Service) (*Service, error) {
+	var exposed Service
+	if err := a.call(http.MethodPost, "/mesh/v1/services", service, &exposed); err != nil {
+		return nil, err
+	}
+	return &exposed, nil
+}
+
+// RemoveService removes a service; node may be empty when a single node
+// exposes it
+func (a *AdminClient) RemoveService(name, node string) error {
+	path := "/mesh/v1/services/" + url.PathEscape(name)
+	if node != "" {
+		path += "?node=" + url.QueryEscape(node)
+	}
+	return a.call(http.MethodDelete, path, nil, nil)
+}
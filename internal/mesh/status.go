@@ -0,0 +1,99 @@
+package mesh
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// MeshStatus is the coordinator's view of the mesh
+type MeshStatus struct {
+	Network        string       `json:"network"`
+	Version        uint64       `json:"version"`         // Bumped on every membership change
+	Relay          string       `json:"relay,omitempty"` // Designated relay; empty when the coordinator relays
+	ManualApproval bool         `json:"manual_approval,omitempty"`
+	Addresses      AddressUsage `json:"addresses"`
+	Nodes          []NodeStatus `json:"nodes"` // Ordered by name
+}
+
+// NodeStatus is a member and how its peers reach it
+type NodeStatus struct {
+	NodeInfo
+	Latency    time.Duration `json:"latency,omitempty"` // Average round trip online peers measured to it; zero without one
+	Loss       float64       `json:"loss,omitempty"`    // Average loss those peers saw, 0-1
+	MeasuredBy int           `json:"measured_by"`       // Online peers that reported a measurement
+
+	// Data it exchanged with its peers, as it reported
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+
+	// Since its latest WireGuard handshake with a peer, as either side
+	// reported it; zero without one
+	HandshakeAge time.Duration `json:"handshake_age,omitempty"`
+	Reconnects   int           `json:"reconnects"` // Times it came back online
+
+	Health *NodeHealth `json:"health,omitempty"` // The latest its agent reported
+}
+
+// handleStatus serves the coordinator's view of the mesh to admins
+func (c *Coordinator) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	c.mu.Lock()
+	status := MeshStatus{
+		Network:        formatMeshNetwork(c.network),
+		Version:        c.version,
+		Relay:          c.relayURL,
+		ManualApproval: c.manualApproval,
+		Addresses:      c.ipam.usage(),
+		Nodes:          make([]NodeStatus, 0, len(c.nodes)),
+	}
+	for id, node := range c.nodes {
+		ns := NodeStatus{NodeInfo: node.info(), Reconnects: node.Reconnects, Health: node.health}
+		var total time.Duration
+		var loss float64
+		var handshake time.Time
+		for _, peer := range c.nodes {
+			if t := peer.traffic[id].LastHandshake; t.After(handshake) && peer != node {
+				handshake = t
+			}
+			stats, ok := peer.latency[id]
+			if !ok || peer == node || peer.Status != "online" || !peer.admitted() || stats.RTT <= 0 {
+				continue
+			}
+			total += stats.RTT
+			loss += stats.Loss
+			ns.MeasuredBy++
+		}
+		for _, traffic := range node.traffic {
+			ns.BytesSent += traffic.Sent
+			ns.BytesReceived += traffic.Received
+			if traffic.LastHandshake.After(handshake) {
+				handshake = traffic.LastHandshake
+			}
+		}
+		if !handshake.IsZero() {
+			ns.HandshakeAge = time.Since(handshake)
+		}
+		if ns.MeasuredBy > 0 {
+			ns.Latency = total / time.Duration(ns.MeasuredBy)
+			ns.Loss = loss / float64(ns.MeasuredBy)
+		}
+		status.Nodes = append(status.Nodes, ns)
+	}
+	c.mu.Unlock()
+
+	sort.Slice(status.Nodes, func(i, j int) bool { return status.Nodes[i].Name < status.Nodes[j].Name })
+	writeJSON(w, status)
+}
+
+// Status returns the coordinator's view of the mesh
+func (a *AdminClient) Status() (*MeshStatus, error) {
+	var status MeshStatus
+	if err := a.call(http.MethodGet, "/mesh/v1/status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
@@ -0,0 +1,108 @@
+package mesh
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+)
+
+// STUN (RFC 5389) binding requests, just enough to learn the public
+// address a NAT maps a UDP socket to
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunHeaderLen       = 20
+
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXORMappedAddress = 0x0020
+)
+
+type stunTxID [12]byte
+
+// newSTUNRequest returns a binding request and its transaction ID
+func newSTUNRequest() (stunTxID, []byte) {
+	var id stunTxID
+	rand.Read(id[:])
+
+	packet := make([]byte, stunHeaderLen)
+	binary.BigEndian.PutUint16(packet[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(packet[4:8], stunMagicCookie)
+	copy(packet[8:20], id[:])
+	return id, packet
+}
+
+// isSTUN reports whether a packet looks like a STUN message, so it can
+// share a socket with other traffic
+func isSTUN(packet []byte) bool {
+	return len(packet) >= stunHeaderLen &&
+		packet[0]&0xc0 == 0 &&
+		binary.BigEndian.Uint32(packet[4:8]) == stunMagicCookie
+}
+
+// parseSTUNResponse returns the mapped address of a binding response
+func parseSTUNResponse(packet []byte) (stunTxID, *net.UDPAddr, bool) {
+	var id stunTxID
+	if !isSTUN(packet) || binary.BigEndian.Uint16(packet[0:2]) != stunBindingResponse {
+		return id, nil, false
+	}
+	copy(id[:], packet[8:20])
+
+	length := int(binary.BigEndian.Uint16(packet[2:4]))
+	attrs := packet[stunHeaderLen:]
+	if length < len(attrs) {
+		attrs = attrs[:length]
+	}
+
+	var mapped *net.UDPAddr
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+attrLen > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+attrLen]
+		switch attrType {
+		case stunAttrXORMappedAddress:
+			if addr := parseSTUNAddress(value, packet[4:20]); addr != nil {
+				return id, addr, true // Preferred: NATs that rewrite addresses in payloads miss it
+			}
+		case stunAttrMappedAddress:
+			mapped = parseSTUNAddress(value, nil)
+		}
+		// Attributes are padded to 4 bytes
+		attrs = attrs[4+(attrLen+3)&^3:]
+	}
+	return id, mapped, mapped != nil
+}
+
+// parseSTUNAddress decodes a (XOR-)MAPPED-ADDRESS value; xor is the magic
+// cookie and transaction ID for XOR-MAPPED-ADDRESS, nil otherwise
+func parseSTUNAddress(value, xor []byte) *net.UDPAddr {
+	if len(value) < 4 {
+		return nil
+	}
+	var ipLen int
+	switch value[1] {
+	case 0x01:
+		ipLen = net.IPv4len
+	case 0x02:
+		ipLen = net.IPv6len
+	default:
+		return nil
+	}
+	if len(value) < 4+ipLen {
+		return nil
+	}
+
+	port := binary.BigEndian.Uint16(value[2:4])
+	ip := make(net.IP, ipLen)
+	copy(ip, value[4:4+ipLen])
+	if xor != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
@@ -0,0 +1,95 @@
+//go:build linux
+
+package mesh
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// enableSubnetRouter lets peers reach the subnets the node advertises: the
+// kernel forwards their packets between the mesh interface and the
+// subnets, and with snat the packets leave with the node's own address, so
+// hosts on the subnets need no route back to the mesh
+func enableSubnetRouter(iface, network string, routes []string, snat bool) error {
+	ipv6 := false
+	for _, route := range routes {
+		if prefix, err := netip.ParsePrefix(route); err == nil && prefix.Addr().Is6() {
+			ipv6 = true
+		}
+	}
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		return fmt.Errorf("failed to enable IP forwarding: %v", err)
+	}
+	if ipv6 {
+		if err := os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644); err != nil {
+			return fmt.Errorf("failed to enable IPv6 forwarding: %v", err)
+		}
+	}
+
+	for _, rule := range subnetRules(iface, network, routes, snat) {
+		if rule.run("-C") == nil {
+			continue
+		}
+		if err := rule.run("-I"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// disableSubnetRouter removes the firewall rules enableSubnetRouter added.
+// Forwarding stays on, as other services may rely on it.
+func disableSubnetRouter(iface, network string, routes []string, snat bool) {
+	for _, rule := range subnetRules(iface, network, routes, snat) {
+		rule.run("-D")
+	}
+}
+
+// iptablesRule is a rule of iptables, or ip6tables for IPv6 subnets
+type iptablesRule struct {
+	command string
+	table   string
+	chain   string
+	args    []string
+}
+
+func subnetRules(iface, network string, routes []string, snat bool) []iptablesRule {
+	meshPrefixes, _ := parseMeshNetwork(network)
+
+	var rules []iptablesRule
+	for _, route := range routes {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			continue
+		}
+		command := "iptables"
+		if prefix.Addr().Is6() {
+			command = "ip6tables"
+		}
+		// Inserted ahead of policies like Docker's, which drop forwarded
+		// packets by default
+		rules = append(rules,
+			iptablesRule{command, "filter", "FORWARD", []string{"-i", iface, "-d", route, "-j", "ACCEPT"}},
+			iptablesRule{command, "filter", "FORWARD", []string{"-o", iface, "-s", route, "-j", "ACCEPT"}},
+		)
+		for _, mesh := range meshPrefixes {
+			if snat && mesh.Addr().Is6() == prefix.Addr().Is6() {
+				rules = append(rules, iptablesRule{command, "nat", "POSTROUTING", []string{"-s", mesh.String(), "-d", route, "-j", "MASQUERADE"}})
+			}
+		}
+	}
+	return rules
+}
+
+func (r iptablesRule) run(action string) error {
+	args := append([]string{"-t", r.table, action, r.chain}, r.args...)
+	out, err := exec.Command(r.command, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", r.command, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package mesh
+
+import "ssh-tunnel/internal/platform"
+
+// enableSubnetRouter lets peers reach the subnets the node advertises; only
+// Linux is supported
+func enableSubnetRouter(iface, network string, routes []string, snat bool) error {
+	return platform.Unsupported(platform.SubnetRouter)
+}
+
+// disableSubnetRouter removes what enableSubnetRouter set up
+func disableSubnetRouter(iface, network string, routes []string, snat bool) {}
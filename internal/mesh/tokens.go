@@ -0,0 +1,396 @@
+package mesh
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// joinTokenPrefix starts every join token, so they are recognizable in
+// configs and logs
+const joinTokenPrefix = "mjt1."
+
+// JoinToken is a join token as the coordinator records it. The token
+// string itself is only returned when the token is created.
+type JoinToken struct {
+	ID      string    `json:"id"`
+	Comment string    `json:"comment,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`  // Zero never expires
+	MaxUses int       `json:"max_uses"` // Zero is unlimited
+	Uses    int       `json:"uses"`
+	Revoked bool      `json:"revoked,omitempty"`
+}
+
+// CreateTokenRequest asks the coordinator for a new join token
+type CreateTokenRequest struct {
+	TTL     string `json:"ttl,omitempty"`      // e.g. "24h"; empty or "0" never expires
+	MaxUses int    `json:"max_uses,omitempty"` // Zero is unlimited
+	Comment string `json:"comment,omitempty"`
+}
+
+// CreateTokenResponse carries a new join token
+type CreateTokenResponse struct {
+	Token string `json:"token"`
+	JoinToken
+}
+
+// NodeInfo is a member as the coordinator's admin API lists it, pending
+// nodes included
+type NodeInfo struct {
+	Peer
+	Approved    bool   `json:"approved"`
+	Quarantined bool   `json:"quarantined,omitempty"`
+	TokenID     string `json:"token_id,omitempty"` // The join token it registered with
+}
+
+// joinTokenClaims is the signed part of a join token
+type joinTokenClaims struct {
+	ID      string `json:"id"`
+	Expires int64  `json:"exp,omitempty"` // Unix time
+	Pin     string `json:"pin,omitempty"` // The coordinator's certificate pin
+}
+
+// signJoinToken returns the token string for claims
+func (c *Coordinator) signJoinToken(claims joinTokenClaims) string {
+	payload, _ := json.Marshal(claims)
+	mac := hmac.New(sha256.New, c.signingKey)
+	mac.Write(payload)
+	return joinTokenPrefix +
+		base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// redeemJoinTokenLocked checks a join token's signature and record and
+// counts a use of it
+func (c *Coordinator) redeemJoinTokenLocked(token string) (*JoinToken, error) {
+	payload, signature, err := splitJoinToken(token)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, c.signingKey)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid join token")
+	}
+
+	var claims joinTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("invalid join token")
+	}
+	record := c.tokens[claims.ID]
+	switch {
+	case record == nil:
+		return nil, fmt.Errorf("unknown join token")
+	case record.Revoked:
+		return nil, fmt.Errorf("join token %s was revoked", record.ID)
+	case claims.Expires != 0 && time.Now().Unix() > claims.Expires:
+		return nil, fmt.Errorf("join token %s expired", record.ID)
+	case record.MaxUses > 0 && record.Uses >= record.MaxUses:
+		return nil, fmt.Errorf("join token %s was used up", record.ID)
+	}
+	record.Uses++
+	return record, nil
+}
+
+// JoinTokenID returns the ID of a join token without verifying it, so a
+// token can be revoked by its string
+func JoinTokenID(token string) (string, error) {
+	payload, _, err := splitJoinToken(token)
+	if err != nil {
+		return "", err
+	}
+	var claims joinTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.ID == "" {
+		return "", fmt.Errorf("invalid join token")
+	}
+	return claims.ID, nil
+}
+
+// JoinTokenPin returns the coordinator certificate pin a join token
+// carries, empty when it carries none. It is not verified: a node trusts
+// it as much as the token it was handed.
+func JoinTokenPin(token string) string {
+	payload, _, err := splitJoinToken(token)
+	if err != nil {
+		return ""
+	}
+	var claims joinTokenClaims
+	json.Unmarshal(payload, &claims)
+	return claims.Pin
+}
+
+func splitJoinToken(token string) (payload, signature []byte, err error) {
+	rest, ok := strings.CutPrefix(token, joinTokenPrefix)
+	if !ok {
+		return nil, nil, fmt.Errorf("not a join token")
+	}
+	encodedPayload, encodedSignature, ok := strings.Cut(rest, ".")
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid join token")
+	}
+	if payload, err = base64.RawURLEncoding.DecodeString(encodedPayload); err != nil {
+		return nil, nil, fmt.Errorf("invalid join token")
+	}
+	if signature, err = base64.RawURLEncoding.DecodeString(encodedSignature); err != nil {
+		return nil, nil, fmt.Errorf("invalid join token")
+	}
+	return payload, signature, nil
+}
+
+// authorizeAdmin checks a request to the admin API: it must carry the
+// admin key or, without one configured, come from the coordinator's host
+func (c *Coordinator) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if c.adminKey != "" {
+		if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(c.adminKey)) == 1 {
+			return true
+		}
+		writeError(w, http.StatusUnauthorized, "invalid admin key")
+		return false
+	}
+
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	writeError(w, http.StatusForbidden, "admin API is only served on loopback without an admin key")
+	return false
+}
+
+func (c *Coordinator) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	var req CreateTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid token request")
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl < 0 {
+			writeError(w, http.StatusBadRequest, "ttl must be a duration such as 24h")
+			return
+		}
+	}
+	if req.MaxUses < 0 {
+		writeError(w, http.StatusBadRequest, "max_uses cannot be negative")
+		return
+	}
+
+	record := &JoinToken{
+		ID:      "tok-" + randomHex(6),
+		Comment: req.Comment,
+		Created: time.Now(),
+		MaxUses: req.MaxUses,
+	}
+	claims := joinTokenClaims{ID: record.ID, Pin: c.tlsPin}
+	if ttl > 0 {
+		record.Expires = record.Created.Add(ttl)
+		claims.Expires = record.Expires.Unix()
+	}
+
+	c.mu.Lock()
+	c.tokens[record.ID] = record
+	if err := c.saveLocked(); err != nil {
+		c.mu.Unlock()
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to save token: %v", err))
+		return
+	}
+	c.mu.Unlock()
+
+	writeJSON(w, CreateTokenResponse{Token: c.signJoinToken(claims), JoinToken: *record})
+}
+
+func (c *Coordinator) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	c.mu.Lock()
+	tokens := make([]JoinToken, 0, len(c.tokens))
+	for _, record := range c.tokens {
+		tokens = append(tokens, *record)
+	}
+	c.mu.Unlock()
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	writeJSON(w, tokens)
+}
+
+// handleRevokeToken stops a token from admitting more nodes. Nodes that
+// already joined with it stay; remove them separately.
+func (c *Coordinator) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	record := c.tokens[r.PathValue("id")]
+	if record == nil {
+		writeError(w, http.StatusNotFound, "unknown join token")
+		return
+	}
+	record.Revoked = true
+	if err := c.saveLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to save token: %v", err))
+		return
+	}
+	writeJSON(w, record)
+}
+
+func (c *Coordinator) handleListNodes(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	c.mu.Lock()
+	nodes := make([]NodeInfo, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		nodes = append(nodes, node.info())
+	}
+	c.mu.Unlock()
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	writeJSON(w, nodes)
+}
+
+// handleApproveNode admits a node waiting for manual approval
+func (c *Coordinator) handleApproveNode(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.findNodeLocked(r.PathValue("id"))
+	if node == nil {
+		writeError(w, http.StatusNotFound, "unknown node")
+		return
+	}
+	if !node.Approved {
+		node.Approved = true
+		log.Printf("Mesh node %s (%s) approved", node.Name, node.MeshIP)
+		c.bumpLocked()
+	}
+	writeJSON(w, node.info())
+}
+
+// handleRemoveNode removes a node: its mesh IP is released, peers drop it
+// and the subnets it routed, and its node token and key are revoked, so it
+// cannot register again without a new key. With revoke_token=true the join
+// token it registered with is revoked too.
+func (c *Coordinator) handleRemoveNode(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.findNodeLocked(r.PathValue("id"))
+	if node == nil {
+		writeError(w, http.StatusNotFound, "unknown node")
+		return
+	}
+	log.Printf("Mesh node %s (%s) removed", node.Name, node.MeshIP)
+	c.recordLocked(node, NodeRemoved)
+	c.removeNodeLocked(node)
+	c.revoked[node.PublicKey] = time.Now()
+	if r.URL.Query().Get("revoke_token") == "true" {
+		if token := c.tokens[node.TokenID]; token != nil && !token.Revoked {
+			token.Revoked = true
+			log.Printf("Mesh join token %s revoked with node %s", token.ID, node.Name)
+		}
+	}
+	c.bumpLocked()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDrainNode starts (POST) or ends (DELETE) draining a node before
+// maintenance: it stays in the mesh, but peers stop picking it for new
+// traffic and route its subnets through other advertisers when they can
+func (c *Coordinator) handleDrainNode(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.findNodeLocked(r.PathValue("id"))
+	if node == nil {
+		writeError(w, http.StatusNotFound, "unknown node")
+		return
+	}
+	if drain := r.Method == http.MethodPost; drain != node.Draining {
+		node.Draining = drain
+		if drain {
+			log.Printf("Mesh node %s (%s) draining", node.Name, node.MeshIP)
+		} else {
+			log.Printf("Mesh node %s (%s) no longer draining", node.Name, node.MeshIP)
+		}
+		c.bumpLocked()
+	}
+	writeJSON(w, node.info())
+}
+
+// handleQuarantineNode isolates (POST) or releases (DELETE) a suspicious
+// node. It keeps its mesh IP and registration, for investigation, but
+// peers drop it, it gets no peers, and it can no longer relay or punch.
+func (c *Coordinator) handleQuarantineNode(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeAdmin(w, r) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.findNodeLocked(r.PathValue("id"))
+	if node == nil {
+		writeError(w, http.StatusNotFound, "unknown node")
+		return
+	}
+	if quarantine := r.Method == http.MethodPost; quarantine != node.Quarantined {
+		node.Quarantined = quarantine
+		if quarantine {
+			log.Printf("Mesh node %s (%s) quarantined", node.Name, node.MeshIP)
+			c.relay.Drop(node.ID)
+		} else {
+			log.Printf("Mesh node %s (%s) released from quarantine", node.Name, node.MeshIP)
+		}
+		c.bumpLocked()
+	}
+	writeJSON(w, node.info())
+}
+
+func (n *coordinatedNode) info() NodeInfo {
+	return NodeInfo{Peer: n.Peer, Approved: n.Approved, Quarantined: n.Quarantined, TokenID: n.TokenID}
+}
+
+// findNodeLocked looks a node up by ID or name
+func (c *Coordinator) findNodeLocked(ref string) *coordinatedNode {
+	if node := c.nodes[ref]; node != nil {
+		return node
+	}
+	for _, node := range c.nodes {
+		if node.Name == ref {
+			return node
+		}
+	}
+	return nil
+}
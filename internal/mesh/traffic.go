@@ -0,0 +1,83 @@
+package mesh
+
+import (
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/wireguard"
+)
+
+// PeerTraffic is the data exchanged with a peer over the mesh, latency
+// probes left out, and when the WireGuard session with it was last
+// established
+type PeerTraffic struct {
+	Sent          uint64    `json:"bytes_sent"`
+	Received      uint64    `json:"bytes_received"`
+	LastHandshake time.Time `json:"last_handshake,omitempty"` // Zero without the data plane or a handshake
+}
+
+// trafficCounter counts the data exchanged with each peer
+type trafficCounter struct {
+	mu    sync.Mutex
+	peers map[string]*PeerTraffic // By peer ID
+}
+
+func (tc *trafficCounter) add(peerID string, sent, received int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.peers == nil {
+		tc.peers = make(map[string]*PeerTraffic)
+	}
+	traffic := tc.peers[peerID]
+	if traffic == nil {
+		traffic = &PeerTraffic{}
+		tc.peers[peerID] = traffic
+	}
+	traffic.Sent += uint64(sent)
+	traffic.Received += uint64(received)
+}
+
+// Traffic returns the data exchanged with each peer since the node
+// started, and the peer's last handshake, by peer ID
+func (mn *MeshNetwork) Traffic() map[string]PeerTraffic {
+	handshakes := mn.handshakes()
+
+	mn.traffic.mu.Lock()
+	defer mn.traffic.mu.Unlock()
+
+	traffic := make(map[string]PeerTraffic, len(mn.traffic.peers))
+	for id, t := range mn.traffic.peers {
+		traffic[id] = *t
+	}
+	for id, handshake := range handshakes {
+		t := traffic[id]
+		t.LastHandshake = handshake
+		traffic[id] = t
+	}
+	return traffic
+}
+
+// handshakes returns when the WireGuard session with each peer was last
+// established, by peer ID, leaving out peers without one
+func (mn *MeshNetwork) handshakes() map[string]time.Time {
+	mn.mu.RLock()
+	defer mn.mu.RUnlock()
+
+	if mn.dataPlane == nil {
+		return nil
+	}
+	byKey := make(map[wireguard.Key]string, len(mn.nodes))
+	for id, node := range mn.nodes {
+		if key, err := wireguard.ParseKey(node.PublicKey); err == nil {
+			byKey[key] = id
+		}
+	}
+	handshakes := make(map[string]time.Time)
+	for _, peer := range mn.dataPlane.device.Peers() {
+		if id, ok := byKey[peer.PublicKey]; ok && !peer.LastHandshake.IsZero() {
+			handshakes[id] = peer.LastHandshake
+		}
+	}
+	return handshakes
+}
@@ -0,0 +1,266 @@
+// Package mitm issues the certificates used to decrypt HTTPS traffic to
+// selected domains for debugging. The local CA is name-constrained to those
+// domains, so even once trusted it cannot vouch for any other site.
+package mitm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	caCertFile = "ca.crt"
+	caKeyFile  = "ca.key"
+
+	caValidity   = 2 * 365 * 24 * time.Hour
+	leafValidity = 7 * 24 * time.Hour
+)
+
+// Authority is the local CA issuing interception certificates
+type Authority struct {
+	dir     string
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+
+	leafKey *ecdsa.PrivateKey // Shared by all leaf certificates
+	mu      sync.Mutex
+	leaves  map[string]*tls.Certificate
+}
+
+// LoadOrCreate loads the CA kept in dir, creating a new one when there is
+// none or when its name constraints do not cover domains. created reports
+// that the CA must be (re)installed and trusted.
+func LoadOrCreate(dir string, domains []string) (authority *Authority, created bool, err error) {
+	permitted := permittedDomains(domains)
+
+	authority, err = load(dir)
+	if err == nil && covers(authority.cert, permitted) {
+		return authority, false, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	authority, err = create(dir, permitted)
+	if err != nil {
+		return nil, false, err
+	}
+	return authority, true, nil
+}
+
+// load reads the CA certificate and key from dir
+func load(dir string) (*Authority, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, caCertFile))
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, caKeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MITM CA in %s: %v", dir, err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid MITM CA in %s: %v", dir, err)
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid MITM CA in %s: unsupported key type", dir)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, os.ErrNotExist // Expired, make a new one
+	}
+
+	return newAuthority(dir, cert, key, certPEM)
+}
+
+// create generates a CA constrained to permitted and saves it in dir
+func create(dir string, permitted []string) (*Authority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "SSH Tunnel Manager Debug CA",
+			Organization: []string{"SSH Tunnel Manager (debugging only)"},
+		},
+		NotBefore:                   now.Add(-time.Hour),
+		NotAfter:                    now.Add(caValidity),
+		KeyUsage:                    x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid:       true,
+		IsCA:                        true,
+		MaxPathLenZero:              true,
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         permitted,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create MITM CA: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create MITM CA directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, caKeyFile), keyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("failed to save MITM CA key: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, caCertFile), certPEM, 0644); err != nil {
+		return nil, fmt.Errorf("failed to save MITM CA certificate: %v", err)
+	}
+
+	return newAuthority(dir, cert, key, certPEM)
+}
+
+func newAuthority(dir string, cert *x509.Certificate, key *ecdsa.PrivateKey, certPEM []byte) (*Authority, error) {
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Authority{
+		dir:     dir,
+		cert:    cert,
+		key:     key,
+		certPEM: certPEM,
+		leafKey: leafKey,
+		leaves:  make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// CertPath is the file users import into their trust store
+func (a *Authority) CertPath() string {
+	return filepath.Join(a.dir, caCertFile)
+}
+
+// CertPEM returns the CA certificate in PEM form
+func (a *Authority) CertPEM() []byte {
+	return a.certPEM
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the CA certificate, for
+// checking the certificate being trusted is this one
+func (a *Authority) Fingerprint() string {
+	sum := sha256.Sum256(a.cert.Raw)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// Certificate returns a certificate for host signed by the CA, issuing one
+// on first use
+func (a *Authority) Certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if leaf, ok := a.leaves[host]; ok && time.Now().Before(leaf.Leaf.NotAfter.Add(-time.Hour)) {
+		return leaf, nil
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &a.leafKey.PublicKey, a.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate for %s: %v", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, a.cert.Raw},
+		PrivateKey:  a.leafKey,
+		Leaf:        leaf,
+	}
+	a.leaves[host] = cert
+	return cert, nil
+}
+
+// permittedDomains turns the intercepted domains into name constraints; a
+// constraint on "example.com" also covers its subdomains
+func permittedDomains(domains []string) []string {
+	seen := make(map[string]bool)
+	var permitted []string
+	for _, domain := range domains {
+		name := strings.ToLower(strings.TrimPrefix(strings.TrimSuffix(domain, "."), "*."))
+		if name != "" && !seen[name] {
+			seen[name] = true
+			permitted = append(permitted, name)
+		}
+	}
+	return permitted
+}
+
+// covers reports whether the CA may issue for every permitted domain
+func covers(cert *x509.Certificate, permitted []string) bool {
+	for _, name := range permitted {
+		ok := false
+		for _, constraint := range cert.PermittedDNSDomains {
+			if name == constraint || strings.HasSuffix(name, "."+constraint) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
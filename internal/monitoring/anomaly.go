@@ -0,0 +1,98 @@
+package monitoring
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// SeverityAnomaly marks alerts raised by statistical anomaly detection
+const SeverityAnomaly = "anomaly"
+
+// Alert represents a condition that needs operator attention
+type Alert struct {
+	Timestamp time.Time `json:"timestamp"`
+	Severity  string    `json:"severity"`
+	Server    string    `json:"server"`
+	Metric    string    `json:"metric"`
+	Message   string    `json:"message"`
+	Value     float64   `json:"value"`
+	Expected  float64   `json:"expected"`
+	ZScore    float64   `json:"z_score"`
+}
+
+// AnomalyDetector flags metric samples that deviate from their
+// exponentially weighted moving average by more than a z-score threshold
+type AnomalyDetector struct {
+	alpha     float64
+	threshold float64
+	warmup    int
+	series    map[string]*ewmaSeries
+	mu        sync.Mutex
+}
+
+// ewmaSeries tracks the EWMA mean and variance of one metric
+type ewmaSeries struct {
+	mean     float64
+	variance float64
+	count    int
+}
+
+// NewAnomalyDetector creates a new anomaly detector
+func NewAnomalyDetector(alpha, threshold float64, warmup int) *AnomalyDetector {
+	if alpha <= 0 || alpha >= 1 {
+		alpha = 0.3
+	}
+	if threshold <= 0 {
+		threshold = 3.0
+	}
+	if warmup <= 0 {
+		warmup = 10
+	}
+	return &AnomalyDetector{
+		alpha:     alpha,
+		threshold: threshold,
+		warmup:    warmup,
+		series:    make(map[string]*ewmaSeries),
+	}
+}
+
+// Observe records a sample and returns its z-score against the series
+// baseline, along with the baseline mean before the sample was applied.
+// The z-score is zero until the series has seen enough samples.
+func (d *AnomalyDetector) Observe(key string, value float64) (zscore, expected float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, ok := d.series[key]
+	if !ok {
+		d.series[key] = &ewmaSeries{mean: value, count: 1}
+		return 0, value
+	}
+
+	expected = s.mean
+	diff := value - s.mean
+	if std := math.Sqrt(s.variance); s.count >= d.warmup && std > 0 {
+		zscore = diff / std
+	}
+
+	incr := d.alpha * diff
+	s.mean += incr
+	s.variance = (1 - d.alpha) * (s.variance + diff*incr)
+	s.count++
+
+	return zscore, expected
+}
+
+// Threshold returns the z-score above which a sample is anomalous
+func (d *AnomalyDetector) Threshold() float64 {
+	return d.threshold
+}
+
+// Reset discards the baseline for a series
+func (d *AnomalyDetector) Reset(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.series, key)
+}
@@ -0,0 +1,55 @@
+package monitoring
+
+import "fmt"
+
+// Alert severities for tunnel availability: a required server going down
+// is critical, an optional one only a warning
+const (
+	SeverityCritical = "critical"
+	SeverityWarning  = "warning"
+	SeverityInfo     = "info"
+)
+
+// TrackAvailability raises an alert when a tunnel goes down, critical for
+// required servers and a warning for the others, and an info alert when
+// it recovers. A tunnel that is stopped or still connecting changes
+// nothing; one stopped on purpose is forgotten.
+func (m *Monitor) TrackAvailability(name, status string, required bool) {
+	class, severity := "Optional", SeverityWarning
+	if required {
+		class, severity = "Required", SeverityCritical
+	}
+
+	m.mu.Lock()
+	wasUp, known := m.available[name]
+	var alert *Alert
+	switch status {
+	case "connected":
+		m.available[name] = true
+		if known && !wasUp {
+			alert = &Alert{
+				Severity: SeverityInfo,
+				Message:  fmt.Sprintf("%s server %s is back up", class, name),
+				Value:    1,
+			}
+		}
+	case "backoff", "failed":
+		m.available[name] = false
+		if !known || wasUp {
+			alert = &Alert{
+				Severity: severity,
+				Message:  fmt.Sprintf("%s server %s is down (%s)", class, name, status),
+			}
+		}
+	case "idle":
+		delete(m.available, name)
+	}
+	m.mu.Unlock()
+
+	if alert != nil {
+		alert.Server = name
+		alert.Metric = "availability"
+		alert.Expected = 1
+		m.RaiseAlert(*alert)
+	}
+}
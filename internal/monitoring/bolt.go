@@ -0,0 +1,173 @@
+package monitoring
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the bolt store. Entries are keyed by their timestamp in
+// nanoseconds, big-endian so keys sort by time, followed by a sequence
+// number keeping entries of the same instant apart.
+var (
+	metricsBucket = []byte("metrics")
+	logsBucket    = []byte("logs")
+	alertsBucket  = []byte("alerts")
+	stateBucket   = []byte("state")
+)
+
+// BoltStore keeps monitoring data in a bolt database. Entries are indexed
+// by time, so queries and pruning go straight to the range they need
+// however long the history is.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens, or creates, the database at path
+func NewBoltStore(path string) (*BoltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %v", err)
+	}
+
+	// A second instance on the same database fails instead of waiting
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{metricsBucket, logsBucket, alertsBucket, stateBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create buckets: %v", err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) AppendMetrics(metrics Metrics) error {
+	return s.append(metricsBucket, metrics.Timestamp, metrics)
+}
+
+func (s *BoltStore) MetricsSince(since time.Time) ([]Metrics, error) {
+	return boltEntriesSince[Metrics](s, metricsBucket, since)
+}
+
+func (s *BoltStore) AppendLog(entry LogEntry) error {
+	return s.append(logsBucket, entry.Timestamp, entry)
+}
+
+func (s *BoltStore) LogsSince(since time.Time) ([]LogEntry, error) {
+	return boltEntriesSince[LogEntry](s, logsBucket, since)
+}
+
+func (s *BoltStore) AppendAlert(alert Alert) error {
+	return s.append(alertsBucket, alert.Timestamp, alert)
+}
+
+func (s *BoltStore) AlertsSince(since time.Time) ([]Alert, error) {
+	return boltEntriesSince[Alert](s, alertsBucket, since)
+}
+
+func (s *BoltStore) PutState(key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).Put([]byte(key), value)
+	})
+}
+
+func (s *BoltStore) GetState(key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// Values are only valid for the transaction
+		if v := tx.Bucket(stateBucket).Get([]byte(key)); v != nil {
+			value = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *BoltStore) Prune(before time.Time) error {
+	end := timeKey(before)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{metricsBucket, logsBucket, alertsBucket} {
+			bucket := tx.Bucket(name)
+
+			// Deleting under a cursor skips keys, so collect them first
+			var keys [][]byte
+			c := bucket.Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+				keys = append(keys, k)
+			}
+			for _, k := range keys {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// append stores v under its timestamp in bucket
+func (s *BoltStore) append(name []byte, at time.Time, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal entry: %v", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(name)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 16)
+		copy(key, timeKey(at))
+		binary.BigEndian.PutUint64(key[8:], seq)
+		return bucket.Put(key, data)
+	})
+}
+
+// boltEntriesSince reads the entries of a bucket not older than since
+func boltEntriesSince[T any](s *BoltStore, name []byte, since time.Time) ([]T, error) {
+	var result []T
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(name).Cursor()
+		for k, v := c.Seek(timeKey(since)); k != nil; k, v = c.Next() {
+			var entry T
+			if err := json.Unmarshal(v, &entry); err != nil {
+				continue // Skip corrupted entries
+			}
+			result = append(result, entry)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// timeKey is the key prefix of entries at t. Times before 1970, such as
+// the zero time, sort first.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	if t.After(time.Unix(0, 0)) {
+		binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	}
+	return key
+}
@@ -0,0 +1,133 @@
+package monitoring
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// logSlot pairs an entry with its sequence number so readers can tell a
+// current slot from one that was overwritten while they were reading
+type logSlot struct {
+	seq   uint64
+	entry LogEntry
+}
+
+// LogBuffer is a fixed-size ring of recent log entries. Writers never
+// block or take a lock: each claims a sequence number and publishes its
+// entry into the matching slot. Readers take a consistent-enough snapshot
+// by skipping slots that were overwritten mid-read.
+type LogBuffer struct {
+	slots []atomic.Pointer[logSlot]
+	next  atomic.Uint64
+}
+
+// NewLogBuffer creates a ring holding the last capacity entries, at
+// least one
+func NewLogBuffer(capacity int) *LogBuffer {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &LogBuffer{slots: make([]atomic.Pointer[logSlot], capacity)}
+}
+
+// Add records an entry, overwriting the oldest one when full
+func (b *LogBuffer) Add(entry LogEntry) {
+	seq := b.next.Add(1) - 1
+	b.slots[seq%uint64(len(b.slots))].Store(&logSlot{seq: seq, entry: entry})
+}
+
+// Snapshot returns the buffered entries, oldest first
+func (b *LogBuffer) Snapshot() []LogEntry {
+	end := b.next.Load()
+	start := uint64(0)
+	if size := uint64(len(b.slots)); end > size {
+		start = end - size
+	}
+
+	entries := make([]LogEntry, 0, end-start)
+	for seq := start; seq < end; seq++ {
+		slot := b.slots[seq%uint64(len(b.slots))].Load()
+		// Not yet published, or already overwritten by a newer entry
+		if slot == nil || slot.seq != seq {
+			continue
+		}
+		entries = append(entries, slot.entry)
+	}
+	return entries
+}
+
+// logQueueSize bounds the entries waiting to be written to the store
+const logQueueSize = 4096
+
+// logPersister appends entries to a persistent store from a background
+// goroutine. When the store falls behind, entries are dropped instead of
+// stalling the callers and the loss is reported once the queue drains.
+type logPersister struct {
+	store   Store
+	queue   chan LogEntry
+	dropped atomic.Uint64
+	done    chan struct{}
+}
+
+func newLogPersister(store Store) *logPersister {
+	return &logPersister{
+		store: store,
+		queue: make(chan LogEntry, logQueueSize),
+		done:  make(chan struct{}),
+	}
+}
+
+// enqueue hands an entry to the writer without blocking
+func (p *logPersister) enqueue(entry LogEntry) {
+	select {
+	case p.queue <- entry:
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+// run writes queued entries until ctx is cancelled, then flushes what is
+// left in the queue
+func (p *logPersister) run(ctx context.Context) {
+	defer close(p.done)
+
+	failed := false
+	write := func(entry LogEntry) {
+		if err := p.store.AppendLog(entry); err != nil && !failed {
+			// Report once; the store stays broken until the disk is fixed
+			log.Printf("Failed to persist log entry: %v", err)
+			failed = true
+		}
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case entry := <-p.queue:
+			write(entry)
+		case <-ticker.C:
+			if n := p.dropped.Swap(0); n > 0 {
+				write(LogEntry{
+					Timestamp: time.Now(),
+					Level:     "warning",
+					Component: "monitor",
+					Message:   fmt.Sprintf("%d log entries dropped, log writer fell behind", n),
+				})
+			}
+		case <-ctx.Done():
+			for {
+				select {
+				case entry := <-p.queue:
+					write(entry)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package monitoring
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func entry(i int) LogEntry {
+	return LogEntry{Level: "info", Component: "test", Message: strconv.Itoa(i)}
+}
+
+func messages(entries []LogEntry) []string {
+	out := make([]string, len(entries))
+	for i, e := range entries {
+		out[i] = e.Message
+	}
+	return out
+}
+
+func TestLogBufferWraparound(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		added    int
+		want     []string
+	}{
+		{"empty", 4, 0, []string{}},
+		{"partly full", 4, 2, []string{"0", "1"}},
+		{"exactly full", 4, 4, []string{"0", "1", "2", "3"}},
+		{"wrapped once", 4, 6, []string{"2", "3", "4", "5"}},
+		{"wrapped many times", 4, 23, []string{"19", "20", "21", "22"}},
+		{"single slot", 1, 5, []string{"4"}},
+		{"zero capacity", 0, 3, []string{"2"}},
+		{"negative capacity", -1, 3, []string{"2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewLogBuffer(tt.capacity)
+			for i := 0; i < tt.added; i++ {
+				b.Add(entry(i))
+			}
+
+			got := messages(b.Snapshot())
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Snapshot() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogBufferConcurrentAdd(t *testing.T) {
+	const writers, perWriter, capacity = 8, 1000, 256
+	b := NewLogBuffer(capacity)
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				b.Add(LogEntry{Component: strconv.Itoa(w), Message: strconv.Itoa(i)})
+				if i%100 == 0 {
+					b.Snapshot() // Readers run alongside the writers
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	entries := b.Snapshot()
+	if len(entries) != capacity {
+		t.Fatalf("kept %d entries, want %d", len(entries), capacity)
+	}
+
+	// Each writer's entries stay in the order it added them
+	last := make(map[string]int)
+	for _, e := range entries {
+		i, _ := strconv.Atoi(e.Message)
+		if prev, ok := last[e.Component]; ok && i <= prev {
+			t.Fatalf("writer %s: entry %d after %d", e.Component, i, prev)
+		}
+		last[e.Component] = i
+	}
+}
+
+func BenchmarkLogBufferAdd(b *testing.B) {
+	buf := NewLogBuffer(1000)
+	e := entry(0)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buf.Add(e)
+		}
+	})
+}
+
+func BenchmarkLogBufferSnapshot(b *testing.B) {
+	buf := NewLogBuffer(1000)
+	for i := 0; i < 1000; i++ {
+		buf.Add(entry(i))
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Snapshot()
+	}
+}
@@ -5,15 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"runtime"
 	"sync"
 	"time"
 
 	"ssh-tunnel/internal/config"
-
-	"github.com/shirou/gopsutil/v3/cpu"
-	"github.com/shirou/gopsutil/v3/mem"
-	"github.com/shirou/gopsutil/v3/net"
+	"ssh-tunnel/internal/crash"
 )
 
 // Metrics holds system and application metrics
@@ -21,6 +17,7 @@ type Metrics struct {
 	System      SystemMetrics      `json:"system"`
 	Application ApplicationMetrics `json:"application"`
 	Tunnels     []TunnelMetrics    `json:"tunnels"`
+	Mesh        []MeshNodeMetrics  `json:"mesh,omitempty"` // With a mesh coordinator configured
 	Timestamp   time.Time          `json:"timestamp"`
 }
 
@@ -41,6 +38,7 @@ type ApplicationMetrics struct {
 	TotalConnections  uint64        `json:"total_connections"`
 	FailedConnections uint64        `json:"failed_connections"`
 	BytesTransferred  uint64        `json:"bytes_transferred"`
+	InsecureTunnels   int           `json:"insecure_tunnels"` // Tunnels that skip verifying their server
 }
 
 // TunnelMetrics holds per-tunnel metrics
@@ -52,6 +50,36 @@ type TunnelMetrics struct {
 	BytesRecv  uint64        `json:"bytes_received"`
 	Uptime     time.Duration `json:"uptime"`
 	Reconnects int           `json:"reconnects"`
+	Insecure   bool          `json:"insecure_skip_verify,omitempty"`
+
+	// Only set for tunnels with bandwidth limits
+	Throttle *ThrottleMetrics `json:"throttle,omitempty"`
+}
+
+// MeshNodeMetrics holds the metrics of a mesh node, as the coordinator
+// sees it
+type MeshNodeMetrics struct {
+	NodeID       string        `json:"node_id"`
+	Name         string        `json:"name"`
+	MeshIP       string        `json:"mesh_ip"`
+	Status       string        `json:"status"`      // online, offline, pending, quarantined or draining
+	Latency      time.Duration `json:"latency"`     // Average round trip its peers measured
+	PacketLoss   float64       `json:"packet_loss"` // Average loss its peers saw, 0-1
+	BytesSent    uint64        `json:"bytes_sent"`
+	BytesRecv    uint64        `json:"bytes_received"`
+	HandshakeAge time.Duration `json:"handshake_age"` // Zero without a handshake
+	Reconnects   int           `json:"reconnects"`
+}
+
+// ThrottleMetrics holds the bandwidth limit state of a tunnel, in bytes per
+// second
+type ThrottleMetrics struct {
+	UploadLimit   float64       `json:"upload_limit"`
+	DownloadLimit float64       `json:"download_limit"`
+	UploadRate    float64       `json:"upload_rate"`
+	DownloadRate  float64       `json:"download_rate"`
+	Throttled     bool          `json:"throttled"`
+	ThrottledTime time.Duration `json:"throttled_time"`
 }
 
 // NetworkIO holds network I/O statistics
@@ -75,20 +103,66 @@ type LogEntry struct {
 type Monitor struct {
 	config    config.MonitoringConfig
 	metrics   *Metrics
-	logs      []LogEntry
+	logs      *LogBuffer
+	store     Store
+	persister *logPersister
+	sampler   *systemSampler
+	detector  *AnomalyDetector
+	lastBytes map[string]byteSample
+	available map[string]bool // Whether each tunnel was last seen up, for availability alerts
 	startTime time.Time
 	mu        sync.RWMutex
 	ctx       context.Context
 	cancel    context.CancelFunc
 }
 
+// byteSample holds the byte counters of a tunnel at a point in time
+type byteSample struct {
+	bytes uint64
+	at    time.Time
+}
+
+// maxAlerts is the number of alerts returned by GetAlerts
+const maxAlerts = 100
+
+// maxLogs is the number of log entries kept in memory
+const maxLogs = 1000
+
 // NewMonitor creates a new monitoring instance
 func NewMonitor(cfg config.MonitoringConfig) *Monitor {
-	return &Monitor{
+	m := &Monitor{
 		config:    cfg,
-		logs:      make([]LogEntry, 0, 1000), // Keep last 1000 log entries
+		logs:      NewLogBuffer(maxLogs),
+		sampler:   newSystemSampler(cfg.SampleInterval, cfg.SampleIdleTimeout),
+		lastBytes: make(map[string]byteSample),
+		available: make(map[string]bool),
 		startTime: time.Now(),
 	}
+
+	store, err := NewStore(cfg.Store, cfg.LogFile)
+	if err != nil {
+		log.Printf("Failed to open monitoring store, keeping data in memory: %v", err)
+		store = NewMemoryStore(cfg.Store.MaxEntries)
+	}
+	m.store = store
+
+	// Logs are always kept in memory; persist them when the store is on
+	// disk or a log file is configured
+	_, bolt := store.(*BoltStore)
+	switch {
+	case bolt:
+		m.persister = newLogPersister(store)
+	case cfg.LogFile != "" && cfg.Store.Type != "file":
+		m.persister = newLogPersister(NewFileStore("", cfg.LogFile))
+	case cfg.Store.Type == "file":
+		m.persister = newLogPersister(store)
+	}
+
+	if cfg.AnomalyDetection {
+		m.detector = NewAnomalyDetector(cfg.AnomalyAlpha, cfg.AnomalyThreshold, 0)
+	}
+
+	return m
 }
 
 // Start begins monitoring
@@ -100,61 +174,119 @@ func (m *Monitor) Start(ctx context.Context) error {
 	log.Println("Starting monitoring system...")
 
 	// Start metrics collection
-	go m.collectMetrics()
+	go crash.Supervise(m.ctx, "metrics collection", m.collectMetrics)
+	go crash.Supervise(m.ctx, "system sampler", func() { m.sampler.run(m.ctx) })
 
-	// Start log rotation if configured
-	if m.config.LogFile != "" {
-		go m.rotateLogFiles()
+	if m.config.Store.Retention > 0 {
+		go crash.Supervise(m.ctx, "store retention", m.pruneStore)
+	}
+
+	// Start log persistence and rotation if configured
+	if m.persister != nil {
+		go m.persister.run(m.ctx)
+		if m.config.LogFile != "" {
+			go m.rotateLogFiles()
+		}
 	}
 
 	return nil
 }
 
-// Stop stops monitoring
+// Stop stops monitoring and flushes pending log entries to disk
 func (m *Monitor) Stop() error {
 	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	if m.cancel != nil {
+	started := m.cancel != nil
+	if started {
 		m.cancel()
 	}
+	m.mu.Unlock()
+
+	if started && m.persister != nil {
+		<-m.persister.done
+		m.persister.store.Close()
+	}
+	m.store.Close()
 
 	log.Println("Monitoring system stopped")
 	return nil
 }
 
-// GetMetrics returns current metrics
+// GetMetrics returns current metrics. System metrics come from the latest
+// background sample; reading them keeps the sampler active.
 func (m *Monitor) GetMetrics() *Metrics {
+	m.sampler.demand()
+	system := m.sampler.snapshot()
+
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	if m.metrics == nil {
 		return &Metrics{
+			System:    system,
 			Timestamp: time.Now(),
 		}
 	}
 
 	// Return a copy to avoid race conditions
 	metricsCopy := *m.metrics
+	metricsCopy.System = system
+	metricsCopy.Tunnels = append([]TunnelMetrics(nil), m.metrics.Tunnels...)
+	metricsCopy.Mesh = append([]MeshNodeMetrics(nil), m.metrics.Mesh...)
 	return &metricsCopy
 }
 
-// GetLogs returns recent log entries
+// GetLogs returns recent log entries, oldest first
 func (m *Monitor) GetLogs() []LogEntry {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	return m.logs.Snapshot()
+}
+
+// GetAlerts returns recent alerts, oldest first
+func (m *Monitor) GetAlerts() []Alert {
+	alerts, err := m.store.AlertsSince(time.Time{})
+	if err != nil {
+		log.Printf("Failed to load alerts: %v", err)
+		return nil
+	}
 
-	// Return a copy of logs
-	logsCopy := make([]LogEntry, len(m.logs))
-	copy(logsCopy, m.logs)
-	return logsCopy
+	if len(alerts) > maxAlerts {
+		alerts = alerts[len(alerts)-maxAlerts:]
+	}
+	return alerts
 }
 
-// LogEvent adds a log entry
-func (m *Monitor) LogEvent(level, component, message string, details map[string]interface{}) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// GetMetricsHistory returns the metrics recorded since the given time
+func (m *Monitor) GetMetricsHistory(since time.Time) ([]Metrics, error) {
+	return m.store.MetricsSince(since)
+}
+
+// Store returns the store holding the monitoring data
+func (m *Monitor) Store() Store {
+	return m.store
+}
+
+// RaiseAlert records an alert and logs it with the alert severity as level
+func (m *Monitor) RaiseAlert(alert Alert) {
+	if alert.Timestamp.IsZero() {
+		alert.Timestamp = time.Now()
+	}
+
+	if err := m.store.AppendAlert(alert); err != nil {
+		log.Printf("Failed to store alert: %v", err)
+	}
 
+	m.LogEvent(alert.Severity, "alerts", alert.Message, map[string]interface{}{
+		"server":   alert.Server,
+		"metric":   alert.Metric,
+		"value":    alert.Value,
+		"expected": alert.Expected,
+		"z_score":  alert.ZScore,
+	})
+}
+
+// LogEvent adds a log entry. It never blocks on the monitor lock or on
+// disk; entries the file writer cannot keep up with are dropped from the
+// file but still kept in memory.
+func (m *Monitor) LogEvent(level, component, message string, details map[string]interface{}) {
 	entry := LogEntry{
 		Timestamp: time.Now(),
 		Level:     level,
@@ -163,12 +295,9 @@ func (m *Monitor) LogEvent(level, component, message string, details map[string]
 		Details:   details,
 	}
 
-	// Add to logs
-	m.logs = append(m.logs, entry)
-
-	// Keep only the latest entries
-	if len(m.logs) > 1000 {
-		m.logs = m.logs[len(m.logs)-1000:]
+	m.logs.Add(entry)
+	if m.persister != nil {
+		m.persister.enqueue(entry)
 	}
 
 	// Log to stdout as well
@@ -197,57 +326,44 @@ func (m *Monitor) collectMetrics() {
 	}
 }
 
-// updateMetrics updates the current metrics
+// updateMetrics updates the current metrics and records them in the store.
+// System metrics are sampled separately so this never blocks.
 func (m *Monitor) updateMetrics() {
 	metrics := &Metrics{
-		Timestamp: time.Now(),
+		Application: m.collectApplicationMetrics(),
+		Timestamp:   time.Now(),
 	}
 
-	// Collect system metrics
-	metrics.System = m.collectSystemMetrics()
-
-	// Collect application metrics
-	metrics.Application = m.collectApplicationMetrics()
-
-	// Update stored metrics
 	m.mu.Lock()
-	m.metrics = metrics
-	m.mu.Unlock()
-}
-
-// collectSystemMetrics collects system-level metrics
-func (m *Monitor) collectSystemMetrics() SystemMetrics {
-	sysMetrics := SystemMetrics{
-		Goroutines: runtime.NumGoroutine(),
-	}
-
-	// CPU usage
-	if cpuPercent, err := cpu.Percent(time.Second, false); err == nil && len(cpuPercent) > 0 {
-		sysMetrics.CPUUsage = cpuPercent[0]
+	if m.metrics != nil {
+		metrics.Tunnels = m.metrics.Tunnels
+		metrics.Mesh = m.metrics.Mesh // Replaced, never modified
 	}
+	m.metrics = metrics
 
-	// Memory usage
-	if vmStat, err := mem.VirtualMemory(); err == nil {
-		sysMetrics.MemUsage = vmStat.UsedPercent
-		sysMetrics.MemTotal = vmStat.Total
-		sysMetrics.MemUsed = vmStat.Used
-	}
+	record := *metrics
+	record.System = m.sampler.snapshot()
+	record.Tunnels = append([]TunnelMetrics(nil), metrics.Tunnels...)
+	m.mu.Unlock()
 
-	// Network I/O
-	if netStat, err := net.IOCounters(false); err == nil && len(netStat) > 0 {
-		sysMetrics.NetworkIO = NetworkIO{
-			BytesSent:   netStat[0].BytesSent,
-			BytesRecv:   netStat[0].BytesRecv,
-			PacketsSent: netStat[0].PacketsSent,
-			PacketsRecv: netStat[0].PacketsRecv,
-		}
+	if err := m.store.AppendMetrics(record); err != nil {
+		log.Printf("Failed to store metrics: %v", err)
 	}
-
-	return sysMetrics
 }
 
 // collectApplicationMetrics collects application-specific metrics
 func (m *Monitor) collectApplicationMetrics() ApplicationMetrics {
+	m.mu.RLock()
+	insecure := 0
+	if m.metrics != nil {
+		for _, tunnel := range m.metrics.Tunnels {
+			if tunnel.Insecure {
+				insecure++
+			}
+		}
+	}
+	m.mu.RUnlock()
+
 	return ApplicationMetrics{
 		Uptime: time.Since(m.startTime),
 		// Other metrics would be updated by the tunnel manager
@@ -255,11 +371,16 @@ func (m *Monitor) collectApplicationMetrics() ApplicationMetrics {
 		TotalConnections:  0, // Placeholder
 		FailedConnections: 0, // Placeholder
 		BytesTransferred:  0, // Placeholder
+		InsecureTunnels:   insecure,
 	}
 }
 
 // UpdateTunnelMetrics updates metrics for a specific tunnel
 func (m *Monitor) UpdateTunnelMetrics(name, status string, latency time.Duration, bytesSent, bytesRecv uint64) {
+	if m.detector != nil && status == "connected" {
+		m.detectAnomalies(name, latency, bytesSent+bytesRecv)
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -290,6 +411,96 @@ func (m *Monitor) UpdateTunnelMetrics(name, status string, latency time.Duration
 	tunnelMetrics.BytesRecv = bytesRecv
 }
 
+// UpdateMeshMetrics replaces the metrics of the mesh nodes
+func (m *Monitor) UpdateMeshMetrics(nodes []MeshNodeMetrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.metrics == nil {
+		return
+	}
+	m.metrics.Mesh = nodes
+}
+
+// UpdateVerificationMetrics records whether a tunnel skips verifying its
+// server
+func (m *Monitor) UpdateVerificationMetrics(name string, insecure bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.metrics == nil {
+		return
+	}
+
+	for i := range m.metrics.Tunnels {
+		if m.metrics.Tunnels[i].Name == name {
+			m.metrics.Tunnels[i].Insecure = insecure
+			return
+		}
+	}
+}
+
+// UpdateThrottleMetrics records the bandwidth limit state of a tunnel
+func (m *Monitor) UpdateThrottleMetrics(name string, throttle ThrottleMetrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.metrics == nil {
+		return
+	}
+
+	for i := range m.metrics.Tunnels {
+		if m.metrics.Tunnels[i].Name == name {
+			m.metrics.Tunnels[i].Throttle = &throttle
+			return
+		}
+	}
+}
+
+// detectAnomalies checks latency increases and throughput drops against the
+// per-server baseline and raises an anomaly alert when they deviate too far
+func (m *Monitor) detectAnomalies(name string, latency time.Duration, totalBytes uint64) {
+	threshold := m.detector.Threshold()
+
+	if latency > 0 {
+		value := float64(latency.Milliseconds())
+		if z, expected := m.detector.Observe(name+"/latency", value); z > threshold {
+			m.RaiseAlert(Alert{
+				Severity: SeverityAnomaly,
+				Server:   name,
+				Metric:   "latency",
+				Message:  fmt.Sprintf("Latency for %s is %.0fms, expected around %.0fms", name, value, expected),
+				Value:    value,
+				Expected: expected,
+				ZScore:   z,
+			})
+		}
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	last, ok := m.lastBytes[name]
+	m.lastBytes[name] = byteSample{bytes: totalBytes, at: now}
+	m.mu.Unlock()
+
+	if !ok || totalBytes < last.bytes || !now.After(last.at) {
+		return
+	}
+
+	rate := float64(totalBytes-last.bytes) / now.Sub(last.at).Seconds()
+	if z, expected := m.detector.Observe(name+"/throughput", rate); z < -threshold {
+		m.RaiseAlert(Alert{
+			Severity: SeverityAnomaly,
+			Server:   name,
+			Metric:   "throughput",
+			Message:  fmt.Sprintf("Throughput for %s dropped to %.0f B/s, expected around %.0f B/s", name, rate, expected),
+			Value:    rate,
+			Expected: expected,
+			ZScore:   z,
+		})
+	}
+}
+
 // rotateLogFiles handles log file rotation
 func (m *Monitor) rotateLogFiles() {
 	// Simple log rotation implementation
@@ -307,6 +518,36 @@ func (m *Monitor) rotateLogFiles() {
 	}
 }
 
+// pruneInterval is how often data past the store's retention is dropped
+const pruneInterval = time.Hour
+
+// pruneStore drops the data past the store's retention at start and then
+// every pruneInterval
+func (m *Monitor) pruneStore() {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	stores := []Store{m.store}
+	if m.persister != nil && m.persister.store != m.store {
+		stores = append(stores, m.persister.store) // The log file
+	}
+
+	for {
+		before := time.Now().Add(-m.config.Store.Retention)
+		for _, store := range stores {
+			if err := store.Prune(before); err != nil {
+				log.Printf("Failed to prune monitoring store: %v", err)
+			}
+		}
+
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 // GetHealthStatus returns the health status of the system
 func (m *Monitor) GetHealthStatus() map[string]interface{} {
 	metrics := m.GetMetrics()
@@ -0,0 +1,123 @@
+package monitoring
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+)
+
+// cpuWindow is the measurement window used when there is no recent CPU
+// baseline to compare against
+const cpuWindow = 250 * time.Millisecond
+
+// systemSampler collects system metrics in its own goroutine so readers
+// only ever copy the latest sample. Sampling pauses while no consumer (API,
+// health checks) has read metrics for idleTimeout, and resumes on the next
+// read.
+type systemSampler struct {
+	interval    time.Duration
+	idleTimeout time.Duration
+	latest      atomic.Pointer[SystemMetrics]
+	lastDemand  atomic.Int64 // Unix nanoseconds of the last read
+	lastSample  time.Time    // Only touched by the sampler goroutine
+	wake        chan struct{}
+}
+
+func newSystemSampler(interval, idleTimeout time.Duration) *systemSampler {
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = 5 * time.Minute
+	}
+
+	return &systemSampler{
+		interval:    interval,
+		idleTimeout: idleTimeout,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// demand records a read and wakes the sampler if it had gone idle
+func (s *systemSampler) demand() {
+	prev := s.lastDemand.Swap(time.Now().UnixNano())
+	if time.Since(time.Unix(0, prev)) > s.idleTimeout {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// idle reports whether nobody has read metrics recently
+func (s *systemSampler) idle() bool {
+	return time.Since(time.Unix(0, s.lastDemand.Load())) > s.idleTimeout
+}
+
+// snapshot returns the latest sample with a current goroutine count
+func (s *systemSampler) snapshot() SystemMetrics {
+	var metrics SystemMetrics
+	if latest := s.latest.Load(); latest != nil {
+		metrics = *latest
+	}
+	metrics.Goroutines = runtime.NumGoroutine()
+	return metrics
+}
+
+// run samples every interval while there is demand, until ctx is cancelled
+func (s *systemSampler) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if s.idle() {
+				continue
+			}
+		case <-s.wake:
+		}
+		s.sample()
+	}
+}
+
+// sample collects one set of system metrics
+func (s *systemSampler) sample() {
+	metrics := SystemMetrics{}
+
+	// cpu.Percent with a zero interval compares against the previous call
+	// and returns immediately. After an idle period that baseline is stale,
+	// so measure over a short window instead.
+	window := time.Duration(0)
+	if time.Since(s.lastSample) > 2*s.interval {
+		window = cpuWindow
+	}
+	if cpuPercent, err := cpu.Percent(window, false); err == nil && len(cpuPercent) > 0 {
+		metrics.CPUUsage = cpuPercent[0]
+	}
+
+	if vmStat, err := mem.VirtualMemory(); err == nil {
+		metrics.MemUsage = vmStat.UsedPercent
+		metrics.MemTotal = vmStat.Total
+		metrics.MemUsed = vmStat.Used
+	}
+
+	if netStat, err := net.IOCounters(false); err == nil && len(netStat) > 0 {
+		metrics.NetworkIO = NetworkIO{
+			BytesSent:   netStat[0].BytesSent,
+			BytesRecv:   netStat[0].BytesRecv,
+			PacketsSent: netStat[0].PacketsSent,
+			PacketsRecv: netStat[0].PacketsRecv,
+		}
+	}
+
+	s.lastSample = time.Now()
+	s.latest.Store(&metrics)
+}
@@ -0,0 +1,523 @@
+package monitoring
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+// Store holds monitoring data: metrics history, log entries, alerts and
+// small pieces of named state. Implementations must be safe for concurrent
+// use. The monitor only writes to a store from background goroutines, so
+// slow backends never stall callers.
+type Store interface {
+	AppendMetrics(metrics Metrics) error
+	MetricsSince(since time.Time) ([]Metrics, error)
+
+	AppendLog(entry LogEntry) error
+	LogsSince(since time.Time) ([]LogEntry, error)
+
+	AppendAlert(alert Alert) error
+	AlertsSince(since time.Time) ([]Alert, error)
+
+	// GetState returns nil without an error when the key is not set
+	PutState(key string, value []byte) error
+	GetState(key string) ([]byte, error)
+
+	// Prune drops the metrics, logs and alerts older than before
+	Prune(before time.Time) error
+
+	Close() error
+}
+
+// NewStore creates the store selected in the configuration. logFile, when
+// set, replaces the file store's own log file.
+func NewStore(cfg config.StoreConfig, logFile string) (Store, error) {
+	switch cfg.Type {
+	case "", "memory":
+		return NewMemoryStore(cfg.MaxEntries), nil
+	case "file":
+		return NewFileStore(cfg.Path, logFile), nil
+	case "bolt":
+		return NewBoltStore(cfg.Path)
+	default:
+		return nil, fmt.Errorf("unsupported monitoring store type: %s", cfg.Type)
+	}
+}
+
+// MemoryStore keeps the most recent entries of each kind in memory
+type MemoryStore struct {
+	maxEntries int
+	logs       *LogBuffer
+
+	mu      sync.RWMutex
+	metrics []Metrics
+	alerts  []Alert
+	state   map[string][]byte
+	pruned  time.Time // Logs older than this are left out, as the ring cannot drop them
+}
+
+// NewMemoryStore creates a store keeping maxEntries items per kind
+func NewMemoryStore(maxEntries int) *MemoryStore {
+	if maxEntries <= 0 {
+		maxEntries = 1000
+	}
+
+	return &MemoryStore{
+		maxEntries: maxEntries,
+		logs:       NewLogBuffer(maxEntries),
+		state:      make(map[string][]byte),
+	}
+}
+
+func (s *MemoryStore) AppendMetrics(metrics Metrics) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metrics = append(s.metrics, metrics)
+	if len(s.metrics) > s.maxEntries {
+		s.metrics = s.metrics[len(s.metrics)-s.maxEntries:]
+	}
+	return nil
+}
+
+func (s *MemoryStore) MetricsSince(since time.Time) ([]Metrics, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []Metrics
+	for _, metrics := range s.metrics {
+		if !metrics.Timestamp.Before(since) {
+			result = append(result, metrics)
+		}
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) AppendLog(entry LogEntry) error {
+	s.logs.Add(entry)
+	return nil
+}
+
+func (s *MemoryStore) LogsSince(since time.Time) ([]LogEntry, error) {
+	s.mu.RLock()
+	if s.pruned.After(since) {
+		since = s.pruned
+	}
+	s.mu.RUnlock()
+
+	var result []LogEntry
+	for _, entry := range s.logs.Snapshot() {
+		if !entry.Timestamp.Before(since) {
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) AppendAlert(alert Alert) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.alerts = append(s.alerts, alert)
+	if len(s.alerts) > s.maxEntries {
+		s.alerts = s.alerts[len(s.alerts)-s.maxEntries:]
+	}
+	return nil
+}
+
+func (s *MemoryStore) AlertsSince(since time.Time) ([]Alert, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []Alert
+	for _, alert := range s.alerts {
+		if !alert.Timestamp.Before(since) {
+			result = append(result, alert)
+		}
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) PutState(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *MemoryStore) GetState(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if value, ok := s.state[key]; ok {
+		return append([]byte(nil), value...), nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) Prune(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metrics = dropBefore(s.metrics, before, func(m Metrics) time.Time { return m.Timestamp })
+	s.alerts = dropBefore(s.alerts, before, func(a Alert) time.Time { return a.Timestamp })
+	if before.After(s.pruned) {
+		s.pruned = before
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// dropBefore removes the entries older than before from the start of
+// entries, which are in time order
+func dropBefore[T any](entries []T, before time.Time, timestamp func(T) time.Time) []T {
+	i := sort.Search(len(entries), func(i int) bool { return !timestamp(entries[i]).Before(before) })
+	return append([]T(nil), entries[i:]...)
+}
+
+// FileStore keeps monitoring data as JSON lines in a directory, one file
+// per kind, and state as one JSON object. Entries are appended in time
+// order, so queries bisect the files to the first entry they need.
+type FileStore struct {
+	metricsPath string
+	logPath     string
+	alertPath   string
+	statePath   string
+
+	mu    sync.Mutex
+	files map[string]*os.File // Open append handles by path
+}
+
+// NewFileStore creates a store in dir. Logs go to logFile instead of
+// dir/logs.jsonl when it is set.
+func NewFileStore(dir, logFile string) *FileStore {
+	if logFile == "" {
+		logFile = filepath.Join(dir, "logs.jsonl")
+	}
+
+	return &FileStore{
+		metricsPath: filepath.Join(dir, "metrics.jsonl"),
+		logPath:     logFile,
+		alertPath:   filepath.Join(dir, "alerts.jsonl"),
+		statePath:   filepath.Join(dir, "state.json"),
+		files:       make(map[string]*os.File),
+	}
+}
+
+func (s *FileStore) AppendMetrics(metrics Metrics) error {
+	return s.appendLine(s.metricsPath, metrics)
+}
+
+func (s *FileStore) MetricsSince(since time.Time) ([]Metrics, error) {
+	return loadLines(s, s.metricsPath, since, func(m Metrics) time.Time { return m.Timestamp })
+}
+
+func (s *FileStore) AppendLog(entry LogEntry) error {
+	return s.appendLine(s.logPath, entry)
+}
+
+func (s *FileStore) LogsSince(since time.Time) ([]LogEntry, error) {
+	return loadLines(s, s.logPath, since, func(e LogEntry) time.Time { return e.Timestamp })
+}
+
+func (s *FileStore) AppendAlert(alert Alert) error {
+	return s.appendLine(s.alertPath, alert)
+}
+
+func (s *FileStore) AlertsSince(since time.Time) ([]Alert, error) {
+	return loadLines(s, s.alertPath, since, func(a Alert) time.Time { return a.Timestamp })
+}
+
+func (s *FileStore) PutState(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, err := s.readState()
+	if err != nil {
+		return err
+	}
+	state[key] = value
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.statePath), 0755); err != nil {
+		return fmt.Errorf("failed to create store directory: %v", err)
+	}
+
+	// Write then rename so a crash never leaves a truncated state file
+	tmp := s.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+	return os.Rename(tmp, s.statePath)
+}
+
+func (s *FileStore) GetState(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, err := s.readState()
+	if err != nil {
+		return nil, err
+	}
+	return state[key], nil
+}
+
+// readState loads the state file; the caller holds s.mu
+func (s *FileStore) readState() (map[string][]byte, error) {
+	state := make(map[string][]byte)
+
+	data, err := os.ReadFile(s.statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("failed to read state: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse state: %v", err)
+	}
+	return state, nil
+}
+
+func (s *FileStore) Prune(before time.Time) error {
+	if err := pruneLines(s, s.metricsPath, before, func(m Metrics) time.Time { return m.Timestamp }); err != nil {
+		return err
+	}
+	if err := pruneLines(s, s.logPath, before, func(e LogEntry) time.Time { return e.Timestamp }); err != nil {
+		return err
+	}
+	return pruneLines(s, s.alertPath, before, func(a Alert) time.Time { return a.Timestamp })
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for path, f := range s.files {
+		f.Close()
+		delete(s.files, path)
+	}
+	return nil
+}
+
+// appendLine writes v as one JSON line, keeping the file open for the next
+// append
+func (s *FileStore) appendLine(path string, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal entry: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[path]
+	if !ok {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create store directory: %v", err)
+		}
+		f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", path, err)
+		}
+		s.files[path] = f
+	}
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// loadLines reads the entries of a JSON-lines file not older than since
+func loadLines[T any](s *FileStore, path string, since time.Time, timestamp func(T) time.Time) ([]T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	offset, err := seekSince(f, since, timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	var result []T
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry T
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // Skip corrupted lines
+		}
+		if timestamp(entry).Before(since) {
+			continue
+		}
+		result = append(result, entry)
+	}
+
+	return result, scanner.Err()
+}
+
+// pruneLines rewrites a JSON-lines file without the entries older than
+// before
+func pruneLines[T any](s *FileStore, path string, before time.Time, timestamp func(T) time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	offset, err := seekSince(f, before, timestamp)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if offset == 0 {
+		return nil
+	}
+
+	// Copy what is kept, then rename, so a crash never loses it
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", tmp, err)
+	}
+	_, err = io.Copy(out, io.NewSectionReader(f, offset, 1<<62))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace %s: %v", path, err)
+	}
+
+	// The append handle still points at the old file
+	if handle, ok := s.files[path]; ok {
+		handle.Close()
+		delete(s.files, path)
+	}
+	return nil
+}
+
+// seekWindow is the span below which seekSince stops bisecting and reads
+// the lines in order
+const seekWindow = 64 * 1024
+
+// seekSince returns the offset of the first line of f whose entry is not
+// older than since, or the size of f when there is none. It bisects the
+// file, whose entries are in time order, down to seekWindow bytes and
+// reads on from there.
+func seekSince[T any](f *os.File, since time.Time, timestamp func(T) time.Time) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// The first line wanted starts at or after lo, which is a line start
+	lo, hi := int64(0), info.Size()
+	for hi-lo > seekWindow {
+		mid := lo + (hi-lo)/2
+		start, at, err := lineAt(f, mid, timestamp)
+		if err != nil {
+			return 0, err
+		}
+		if start < 0 || start >= hi || !at.Before(since) {
+			hi = mid
+			continue
+		}
+		lo = start
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(f, lo, info.Size()-lo))
+	offset := lo
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var entry T
+			if json.Unmarshal(line, &entry) == nil && !timestamp(entry).Before(since) {
+				return offset, nil
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// lineAt finds the first readable line of f starting at or after offset
+// and returns where it starts and its entry's timestamp, or a start of -1
+// when there is none
+func lineAt[T any](f *os.File, offset int64, timestamp func(T) time.Time) (int64, time.Time, error) {
+	start := offset
+	if offset > 0 {
+		// Unless the previous byte ends a line, offset is inside one
+		start = offset - 1
+	}
+	reader := bufio.NewReader(io.NewSectionReader(f, start, 1<<62))
+	if offset > 0 {
+		skipped, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return -1, time.Time{}, nil
+		}
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		start += int64(len(skipped))
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var entry T
+			if json.Unmarshal(line, &entry) == nil {
+				return start, timestamp(entry), nil
+			}
+			start += int64(len(line))
+		}
+		if err == io.EOF {
+			return -1, time.Time{}, nil
+		}
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+}
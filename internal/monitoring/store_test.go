@@ -0,0 +1,184 @@
+package monitoring
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeEpoch is the time of the first entry the store tests add; entry i
+// is i seconds later
+var storeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func timedEntry(i int) LogEntry {
+	e := entry(i)
+	e.Timestamp = storeEpoch.Add(time.Duration(i) * time.Second)
+	return e
+}
+
+// testStores returns one store of each kind, each in its own directory
+func testStores(t *testing.T) map[string]Store {
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "monitoring.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStore: %v", err)
+	}
+	stores := map[string]Store{
+		"memory": NewMemoryStore(10000),
+		"file":   NewFileStore(t.TempDir(), ""),
+		"bolt":   bolt,
+	}
+	t.Cleanup(func() {
+		for _, store := range stores {
+			store.Close()
+		}
+	})
+	return stores
+}
+
+func TestStoreSince(t *testing.T) {
+	// Enough entries for the file store to bisect
+	const count = 3000
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < count; i++ {
+				if err := store.AppendLog(timedEntry(i)); err != nil {
+					t.Fatalf("AppendLog: %v", err)
+				}
+				metrics := Metrics{Timestamp: timedEntry(i).Timestamp}
+				if err := store.AppendMetrics(metrics); err != nil {
+					t.Fatalf("AppendMetrics: %v", err)
+				}
+			}
+
+			for _, from := range []int{0, 1, 1234, 2999} {
+				logs, err := store.LogsSince(timedEntry(from).Timestamp)
+				if err != nil {
+					t.Fatalf("LogsSince: %v", err)
+				}
+				if len(logs) != count-from || logs[0].Message != strconv.Itoa(from) {
+					t.Errorf("LogsSince(%d) = %d entries from %q", from, len(logs), logs[0].Message)
+				}
+
+				metrics, err := store.MetricsSince(timedEntry(from).Timestamp)
+				if err != nil {
+					t.Fatalf("MetricsSince: %v", err)
+				}
+				if len(metrics) != count-from {
+					t.Errorf("MetricsSince(%d) = %d entries", from, len(metrics))
+				}
+			}
+
+			if logs, _ := store.LogsSince(time.Time{}); len(logs) != count {
+				t.Errorf("LogsSince(zero) = %d entries, want %d", len(logs), count)
+			}
+			if logs, _ := store.LogsSince(storeEpoch.Add(time.Hour)); len(logs) != 0 {
+				t.Errorf("LogsSince(after the last) = %d entries", len(logs))
+			}
+		})
+	}
+}
+
+func TestStorePrune(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				store.AppendLog(timedEntry(i))
+				store.AppendAlert(Alert{Timestamp: timedEntry(i).Timestamp, Message: strconv.Itoa(i)})
+			}
+			if err := store.PutState("key", []byte("value")); err != nil {
+				t.Fatalf("PutState: %v", err)
+			}
+
+			if err := store.Prune(timedEntry(60).Timestamp); err != nil {
+				t.Fatalf("Prune: %v", err)
+			}
+			// Entries added after pruning are kept, and the state is untouched
+			store.AppendLog(timedEntry(100))
+
+			logs, err := store.LogsSince(time.Time{})
+			if err != nil {
+				t.Fatalf("LogsSince: %v", err)
+			}
+			got := messages(logs)
+			if len(got) != 41 || got[0] != "60" || got[40] != "100" {
+				t.Errorf("logs after pruning = %v", got)
+			}
+
+			alerts, err := store.AlertsSince(time.Time{})
+			if err != nil {
+				t.Fatalf("AlertsSince: %v", err)
+			}
+			if len(alerts) != 40 || alerts[0].Message != "60" {
+				t.Errorf("alerts after pruning = %d from %q", len(alerts), alerts[0].Message)
+			}
+
+			if value, _ := store.GetState("key"); string(value) != "value" {
+				t.Errorf("state after pruning = %q", value)
+			}
+		})
+	}
+}
+
+func TestFileStoreSkipsCorruptLines(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(dir, "")
+	for i := 0; i < 2000; i++ {
+		store.AppendLog(timedEntry(i))
+	}
+	store.Close()
+
+	// Corrupt a line in the middle, where bisecting lands first
+	path := filepath.Join(dir, "logs.jsonl")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	lines := strings.Split(string(data), "\n")
+	lines[1000] = "{not json"
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	store = NewFileStore(dir, "")
+	defer store.Close()
+	logs, err := store.LogsSince(timedEntry(999).Timestamp)
+	if err != nil {
+		t.Fatalf("LogsSince: %v", err)
+	}
+	got := messages(logs)
+	if len(got) != 1000 || got[0] != "999" || got[1] != "1001" {
+		t.Errorf("LogsSince = %d entries starting %v", len(got), got[:2])
+	}
+}
+
+func TestBoltStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "monitoring.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltStore: %v", err)
+	}
+	store.AppendLog(timedEntry(1))
+	store.PutState("key", []byte("value"))
+
+	// The database is locked while open
+	if _, err := NewBoltStore(path); err == nil {
+		t.Error("opened the database twice")
+	}
+	store.Close()
+
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	if logs, _ := store.LogsSince(time.Time{}); len(logs) != 1 || logs[0].Message != "1" {
+		t.Errorf("logs after reopening = %v", messages(logs))
+	}
+	if value, _ := store.GetState("missing"); value != nil {
+		t.Errorf("missing state = %q", value)
+	}
+}
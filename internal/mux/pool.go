@@ -0,0 +1,161 @@
+package mux
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// DialFunc opens a new outer connection for a session
+type DialFunc func() (net.Conn, error)
+
+// Pool spreads streams over as few outer connections as possible: a new
+// session is only dialed when every open one carries maxStreams streams.
+// Sessions without streams for idleTimeout are closed.
+type Pool struct {
+	dial        DialFunc
+	maxStreams  int
+	idleTimeout time.Duration
+
+	dialMu   sync.Mutex // Held while dialing a new session
+	mu       sync.Mutex
+	sessions []*Session
+	closed   bool
+	stop     chan struct{}
+}
+
+// NewPool creates a pool dialing outer connections with dial
+func NewPool(dial DialFunc, maxStreams int, idleTimeout time.Duration) *Pool {
+	if maxStreams <= 0 {
+		maxStreams = 8
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = time.Minute
+	}
+
+	p := &Pool{
+		dial:        dial,
+		maxStreams:  maxStreams,
+		idleTimeout: idleTimeout,
+		stop:        make(chan struct{}),
+	}
+	go p.reap()
+	return p
+}
+
+// Dial opens a stream, reusing a session with room for it when possible
+func (p *Pool) Dial() (net.Conn, error) {
+	if stream, err := p.openExisting(); stream != nil || err != nil {
+		return stream, err
+	}
+
+	// One new session at a time, so concurrent callers share it
+	p.dialMu.Lock()
+	defer p.dialMu.Unlock()
+
+	if stream, err := p.openExisting(); stream != nil || err != nil {
+		return stream, err
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	sess := Client(conn)
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		sess.Close()
+		return nil, errSessionClosed
+	}
+	p.sessions = append(p.sessions, sess)
+	p.mu.Unlock()
+
+	return sess.Open()
+}
+
+// openExisting opens a stream on a session with room for it. It returns
+// nil without an error when every session is full.
+func (p *Pool) openExisting() (net.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, errSessionClosed
+	}
+
+	p.prune()
+	for _, sess := range p.sessions {
+		if sess.NumStreams() < p.maxStreams {
+			if stream, err := sess.Open(); err == nil {
+				return stream, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Sessions returns the number of open outer connections
+func (p *Pool) Sessions() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.prune()
+	return len(p.sessions)
+}
+
+// Close closes every session and their streams
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.stop)
+
+	for _, sess := range p.sessions {
+		sess.Close()
+	}
+	p.sessions = nil
+	return nil
+}
+
+// prune drops closed sessions; the caller holds p.mu
+func (p *Pool) prune() {
+	open := p.sessions[:0]
+	for _, sess := range p.sessions {
+		if !sess.IsClosed() {
+			open = append(open, sess)
+		}
+	}
+	for i := len(open); i < len(p.sessions); i++ {
+		p.sessions[i] = nil
+	}
+	p.sessions = open
+}
+
+// reap closes sessions that have been idle for idleTimeout
+func (p *Pool) reap() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		for _, sess := range p.sessions {
+			if idle := sess.IdleSince(); !idle.IsZero() && time.Since(idle) > p.idleTimeout {
+				sess.Close()
+			}
+		}
+		p.prune()
+		p.mu.Unlock()
+	}
+}
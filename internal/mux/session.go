@@ -0,0 +1,333 @@
+// Package mux multiplexes many streams over one connection using the smux
+// v1 wire format, as spoken by xtaci/smux and trojan-go
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Frame commands
+const (
+	cmdSYN byte = iota // Open a stream
+	cmdFIN             // Close a stream
+	cmdPSH             // Stream data
+	cmdNOP             // Keepalive
+)
+
+const (
+	protoVersion = 1
+	headerLen    = 8 // version, cmd, length (LE uint16), stream id (LE uint32)
+
+	maxFrameSize      = 32768
+	maxReceiveBuffer  = 4 * 1024 * 1024
+	keepAliveInterval = 10 * time.Second
+	keepAliveTimeout  = 30 * time.Second
+	acceptBacklog     = 1024
+)
+
+var (
+	errSessionClosed = errors.New("mux: session closed")
+	errPeerTimeout   = errors.New("mux: peer stopped responding")
+)
+
+// Session carries streams over a single connection. Clients open streams
+// with odd ids and servers with even ones, so both sides may open streams.
+type Session struct {
+	conn    net.Conn
+	nextID  uint32
+	writeMu sync.Mutex // Frames are written whole
+
+	mu         sync.Mutex
+	streams    map[uint32]*Stream
+	lastActive time.Time // When the last stream closed, or the session opened
+
+	// Received data not yet read by streams. The receive loop stops reading
+	// the connection while it is over maxReceiveBuffer, which pushes back
+	// on the peer through TCP.
+	bufMu    sync.Mutex
+	bufCond  *sync.Cond
+	buffered int
+
+	lastRecv  atomic.Int64 // Unix nanoseconds of the last frame received
+	accept    chan *Stream
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// Client starts the client side of a session on conn
+func Client(conn net.Conn) *Session {
+	return newSession(conn, 1)
+}
+
+// Server starts the server side of a session on conn
+func Server(conn net.Conn) *Session {
+	return newSession(conn, 0)
+}
+
+func newSession(conn net.Conn, firstID uint32) *Session {
+	s := &Session{
+		conn:       conn,
+		nextID:     firstID,
+		streams:    make(map[uint32]*Stream),
+		lastActive: time.Now(),
+		accept:     make(chan *Stream, acceptBacklog),
+		closed:     make(chan struct{}),
+	}
+	s.bufCond = sync.NewCond(&s.bufMu)
+	s.lastRecv.Store(time.Now().UnixNano())
+
+	go s.recvLoop()
+	go s.keepAlive()
+	return s
+}
+
+// Open starts a new stream
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newStream(id, s)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(cmdSYN, id, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for a stream opened by the peer
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.closed:
+		return nil, s.closeErr()
+	}
+}
+
+// Done is closed once the session has closed
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+// NumStreams returns the number of open streams
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.streams)
+}
+
+// IdleSince returns when the session last had no streams, or the zero time
+// while streams are open
+func (s *Session) IdleSince() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.streams) > 0 {
+		return time.Time{}
+	}
+	return s.lastActive
+}
+
+// IsClosed reports whether the session has been closed
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the session, its streams and the connection
+func (s *Session) Close() error {
+	s.fail(errSessionClosed)
+	return nil
+}
+
+// fail closes the session with err as the cause
+func (s *Session) fail(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+
+		close(s.closed)
+		s.conn.Close()
+		for _, stream := range streams {
+			stream.fail(err)
+		}
+
+		s.bufMu.Lock()
+		s.bufCond.Broadcast()
+		s.bufMu.Unlock()
+	})
+}
+
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	return errSessionClosed
+}
+
+// removeStream forgets a closed stream
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.streams[id]; ok {
+		delete(s.streams, id)
+		if len(s.streams) == 0 {
+			s.lastActive = time.Now()
+		}
+	}
+}
+
+// writeFrame sends one frame
+func (s *Session) writeFrame(cmd byte, id uint32, data []byte) error {
+	frame := make([]byte, headerLen+len(data))
+	frame[0] = protoVersion
+	frame[1] = cmd
+	binary.LittleEndian.PutUint16(frame[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(frame[4:], id)
+	copy(frame[headerLen:], data)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.IsClosed() {
+		return s.closeErr()
+	}
+	if _, err := s.conn.Write(frame); err != nil {
+		s.fail(fmt.Errorf("mux: write failed: %v", err))
+		return err
+	}
+	return nil
+}
+
+// recvLoop reads frames and dispatches them to streams
+func (s *Session) recvLoop() {
+	header := make([]byte, headerLen)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.fail(fmt.Errorf("mux: read failed: %v", err))
+			return
+		}
+		s.lastRecv.Store(time.Now().UnixNano())
+
+		if header[0] != protoVersion {
+			s.fail(fmt.Errorf("mux: unsupported version %d", header[0]))
+			return
+		}
+		length := int(binary.LittleEndian.Uint16(header[2:]))
+		id := binary.LittleEndian.Uint32(header[4:])
+
+		switch header[1] {
+		case cmdNOP:
+		case cmdSYN:
+			s.mu.Lock()
+			_, exists := s.streams[id]
+			var stream *Stream
+			if !exists && s.err == nil {
+				stream = newStream(id, s)
+				s.streams[id] = stream
+			}
+			s.mu.Unlock()
+			if stream != nil {
+				select {
+				case s.accept <- stream:
+				case <-s.closed:
+					return
+				}
+			}
+		case cmdFIN:
+			if stream := s.stream(id); stream != nil {
+				stream.finish()
+			}
+		case cmdPSH:
+			data := make([]byte, length)
+			if _, err := io.ReadFull(s.conn, data); err != nil {
+				s.fail(fmt.Errorf("mux: read failed: %v", err))
+				return
+			}
+			if stream := s.stream(id); stream != nil && length > 0 {
+				s.reserve(length)
+				stream.deliver(data)
+			}
+		default:
+			s.fail(fmt.Errorf("mux: invalid command %d", header[1]))
+			return
+		}
+	}
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.streams[id]
+}
+
+// reserve accounts for received data, first waiting while the receive
+// buffer is full
+func (s *Session) reserve(n int) {
+	s.bufMu.Lock()
+	defer s.bufMu.Unlock()
+
+	for s.buffered >= maxReceiveBuffer && !s.IsClosed() {
+		s.bufCond.Wait()
+	}
+	s.buffered += n
+}
+
+// release returns buffer space once data has been read or discarded
+func (s *Session) release(n int) {
+	if n == 0 {
+		return
+	}
+
+	s.bufMu.Lock()
+	s.buffered -= n
+	s.bufCond.Broadcast()
+	s.bufMu.Unlock()
+}
+
+// keepAlive sends NOPs and closes the session when the peer goes silent
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, s.lastRecv.Load())) > keepAliveTimeout {
+				s.fail(errPeerTimeout)
+				return
+			}
+			s.writeFrame(cmdNOP, 0, nil)
+		}
+	}
+}
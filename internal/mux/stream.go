@@ -0,0 +1,196 @@
+package mux
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is one multiplexed connection within a session
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	buf          [][]byte
+	finRecv      bool // Peer closed its side
+	finSent      bool
+	closed       bool
+	err          error
+	readDeadline time.Time
+	timer        *time.Timer
+}
+
+func newStream(id uint32, sess *Session) *Stream {
+	s := &Stream{id: id, sess: sess}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Read reads received data, returning io.EOF once the peer has closed the
+// stream and everything has been read
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.buf) == 0 && !s.finRecv && s.err == nil && !s.closed {
+		if !s.readDeadline.IsZero() && !time.Now().Before(s.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		s.cond.Wait()
+	}
+
+	if len(s.buf) > 0 {
+		n := copy(p, s.buf[0])
+		if n == len(s.buf[0]) {
+			s.buf = s.buf[1:]
+		} else {
+			s.buf[0] = s.buf[0][n:]
+		}
+		s.sess.release(n)
+		return n, nil
+	}
+	if s.finRecv {
+		return 0, io.EOF
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	return 0, net.ErrClosed
+}
+
+// Write sends data in frames of at most maxFrameSize bytes
+func (s *Stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	closed := s.closed || s.finSent
+	err := s.err
+	s.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	if closed {
+		return 0, net.ErrClosed
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		if err := s.sess.writeFrame(cmdPSH, s.id, p[:n]); err != nil {
+			return written, err
+		}
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer no more data will be sent
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.finSent || s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.finSent = true
+	s.mu.Unlock()
+
+	return s.sess.writeFrame(cmdFIN, s.id, nil)
+}
+
+// Close closes both directions and discards unread data
+func (s *Stream) Close() error {
+	err := s.CloseWrite()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	unread := 0
+	for _, chunk := range s.buf {
+		unread += len(chunk)
+	}
+	s.buf = nil
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.sess.release(unread)
+	s.sess.removeStream(s.id)
+	return err
+}
+
+// deliver queues data received from the peer
+func (s *Stream) deliver(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		s.sess.release(len(data))
+		return
+	}
+	s.buf = append(s.buf, data)
+	s.cond.Broadcast()
+}
+
+// finish records that the peer closed the stream
+func (s *Stream) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.finRecv = true
+	s.cond.Broadcast()
+}
+
+// fail aborts the stream when its session closes
+func (s *Stream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
+
+func (s *Stream) LocalAddr() net.Addr  { return s.sess.conn.LocalAddr() }
+func (s *Stream) RemoteAddr() net.Addr { return s.sess.conn.RemoteAddr() }
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+// SetReadDeadline makes blocked and future reads fail after t
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.readDeadline = t
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if !t.IsZero() {
+		s.timer = time.AfterFunc(time.Until(t), func() {
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		})
+	}
+	s.cond.Broadcast()
+	return nil
+}
+
+// SetWriteDeadline is not supported: writes go straight to the session
+// connection
+func (s *Stream) SetWriteDeadline(t time.Time) error { return nil }
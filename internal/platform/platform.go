@@ -0,0 +1,94 @@
+// Package platform records which subsystems the platform the binary was
+// built for can run, so the others report it plainly instead of failing
+// with whatever error the missing OS feature produces
+package platform
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Capability is a subsystem only some platforms can run
+type Capability string
+
+const (
+	TUN          Capability = "tun"           // TUN interfaces, for the mesh WireGuard data plane
+	SubnetRouter Capability = "subnet_router" // Forwarding and NAT to advertised mesh subnets
+	MeshRoutes   Capability = "mesh_routes"   // Kernel routes through the mesh interface
+	VirtualIP    Capability = "virtual_ip"    // Moving the HA virtual IP with gratuitous ARP
+	PathMTU      Capability = "path_mtu"      // Path MTU probing with don't-fragment pings
+	FileLock     Capability = "file_lock"     // Leader election on a file lock
+	ICMPAgent    Capability = "icmp_agent"    // Serving the ICMP tunnel on a raw socket
+)
+
+// capabilities lists every capability in display order
+var capabilities = []struct {
+	capability  Capability
+	description string
+}{
+	{TUN, "TUN interfaces (mesh WireGuard data plane)"},
+	{SubnetRouter, "Mesh subnet routing"},
+	{MeshRoutes, "Mesh kernel routes"},
+	{VirtualIP, "HA virtual IP"},
+	{PathMTU, "Path MTU probing"},
+	{FileLock, "File lock leader election"},
+	{ICMPAgent, "ICMP tunnel agent"},
+}
+
+// UnsupportedError is returned by subsystems the platform cannot run
+type UnsupportedError struct {
+	Capability Capability
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("%s is unsupported on this platform (%s/%s)", describe(e.Capability), runtime.GOOS, runtime.GOARCH)
+}
+
+// Supported reports whether the platform can run a capability
+func Supported(c Capability) bool {
+	return supported[c]
+}
+
+// Check returns an *UnsupportedError when the platform cannot run a
+// capability
+func Check(c Capability) error {
+	if supported[c] {
+		return nil
+	}
+	return Unsupported(c)
+}
+
+// Unsupported returns the error for a capability the platform cannot run
+func Unsupported(c Capability) error {
+	return &UnsupportedError{Capability: c}
+}
+
+// CapabilityStatus is one row of the capability matrix
+type CapabilityStatus struct {
+	Capability  Capability `json:"capability"`
+	Description string     `json:"description"`
+	Supported   bool       `json:"supported"`
+}
+
+// Matrix returns every capability and whether the platform supports it
+func Matrix() []CapabilityStatus {
+	matrix := make([]CapabilityStatus, 0, len(capabilities))
+	for _, c := range capabilities {
+		matrix = append(matrix, CapabilityStatus{Capability: c.capability, Description: c.description, Supported: supported[c.capability]})
+	}
+	return matrix
+}
+
+// Name returns the platform as GOOS/GOARCH
+func Name() string {
+	return runtime.GOOS + "/" + runtime.GOARCH
+}
+
+func describe(c Capability) string {
+	for _, known := range capabilities {
+		if known.capability == c {
+			return known.description
+		}
+	}
+	return string(c)
+}
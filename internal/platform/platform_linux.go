@@ -0,0 +1,13 @@
+//go:build linux
+
+package platform
+
+var supported = map[Capability]bool{
+	TUN:          true,
+	SubnetRouter: true,
+	MeshRoutes:   true,
+	VirtualIP:    true,
+	PathMTU:      true,
+	FileLock:     true,
+	ICMPAgent:    true,
+}
@@ -0,0 +1,6 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly || windows)
+
+package platform
+
+// The rest run the tunnels and the mesh control plane only
+var supported = map[Capability]bool{}
@@ -0,0 +1,11 @@
+//go:build darwin || freebsd || netbsd || openbsd || dragonfly
+
+package platform
+
+// The BSDs have flock, raw sockets and route(8), but the TUN, forwarding,
+// address and don't-fragment code is Linux-only
+var supported = map[Capability]bool{
+	MeshRoutes: true,
+	FileLock:   true,
+	ICMPAgent:  true,
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package platform
+
+// Windows has netsh for routes; the rest of the OS-level code is
+// Linux-only
+var supported = map[Capability]bool{
+	MeshRoutes: true,
+}
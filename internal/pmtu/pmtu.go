@@ -0,0 +1,101 @@
+// Package pmtu finds the largest IPv4 packet that reaches a host without
+// fragmentation. It sends ICMP echo requests with the DF bit set and takes
+// a missing reply as too big, so paths that silently drop large packets
+// are caught as well as those that report it.
+package pmtu
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// MinMTU is the smallest MTU every IPv4 path must carry
+	MinMTU = 576
+
+	ipv4HeaderLen = 20
+	icmpHeaderLen = 8
+
+	// attempts per packet size, so a single lost reply does not halve the
+	// result
+	attempts = 2
+
+	cacheTTL = 10 * time.Minute
+)
+
+type cacheEntry struct {
+	mtu     int
+	expires time.Time
+}
+
+// cache keeps recent results so reconnects do not probe again
+var cache = struct {
+	mu sync.Mutex
+	m  map[string]cacheEntry
+}{m: make(map[string]cacheEntry)}
+
+// Probe returns the path MTU to host, at most max. Each probe waits up to
+// timeout for its reply. Results are cached for ten minutes.
+func Probe(host string, max int, timeout time.Duration) (int, error) {
+	key := host + "/" + strconv.Itoa(max)
+
+	cache.mu.Lock()
+	entry, ok := cache.m[key]
+	cache.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.mtu, nil
+	}
+
+	addr, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+
+	p, err := newProber(addr.IP)
+	if err != nil {
+		return 0, err
+	}
+	defer p.close()
+
+	fits := func(size int) (bool, error) {
+		for i := 0; i < attempts; i++ {
+			ok, err := p.echo(size, timeout)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+
+	ok, err = fits(MinMTU)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("%s does not answer ICMP echo", host)
+	}
+
+	// Binary search for the largest size that gets a reply
+	low, high := MinMTU, max
+	for low < high {
+		size := (low + high + 1) / 2
+		ok, err := fits(size)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			low = size
+		} else {
+			high = size - 1
+		}
+	}
+
+	cache.mu.Lock()
+	cache.m[key] = cacheEntry{mtu: low, expires: time.Now().Add(cacheTTL)}
+	cache.mu.Unlock()
+
+	return low, nil
+}
@@ -0,0 +1,143 @@
+//go:build linux
+
+package pmtu
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// prober sends echo requests with DF set. IP_PMTUDISC_PROBE sets DF while
+// ignoring the kernel's cached path MTU, so every size is really tried.
+type prober struct {
+	conn       net.PacketConn
+	dst        net.Addr
+	ip         net.IP
+	privileged bool // Raw socket; ping sockets rewrite the echo ID
+	id         int
+	seq        int
+}
+
+// newProber opens a raw ICMP socket, falling back to an unprivileged ping
+// socket
+func newProber(ip net.IP) (*prober, error) {
+	p := &prober{ip: ip, id: os.Getpid() & 0xffff}
+
+	if conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0"); err == nil {
+		raw, err := conn.(*net.IPConn).SyscallConn()
+		if err == nil {
+			err = setProbeDF(raw)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		p.conn, p.dst, p.privileged = conn, &net.IPAddr{IP: ip}, true
+		return p, nil
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_ICMP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ICMP socket (run as root or allow net.ipv4.ping_group_range): %v", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set DF on ICMP socket: %v", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind ICMP socket: %v", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "pmtu")
+	conn, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ICMP socket: %v", err)
+	}
+	p.conn, p.dst = conn, &net.UDPAddr{IP: ip}
+	return p, nil
+}
+
+func setProbeDF(raw syscall.RawConn) error {
+	var sockErr error
+	err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set DF on ICMP socket: %v", err)
+	}
+	return nil
+}
+
+// echo sends one echo request making an IP packet of size bytes and
+// reports whether the reply came back within timeout
+func (p *prober) echo(size int, timeout time.Duration) (bool, error) {
+	p.seq = (p.seq + 1) & 0xffff
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: p.id, Seq: p.seq, Data: make([]byte, size-ipv4HeaderLen-icmpHeaderLen)},
+	}
+	packet, err := msg.Marshal(nil)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := p.conn.WriteTo(packet, p.dst); err != nil {
+		if errors.Is(err, syscall.EMSGSIZE) {
+			return false, nil // Larger than the interface MTU
+		}
+		return false, fmt.Errorf("failed to send ICMP echo: %v", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	p.conn.SetReadDeadline(deadline)
+	buf := make([]byte, size+ipv4HeaderLen)
+	for {
+		n, from, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return false, nil
+			}
+			return false, fmt.Errorf("failed to read ICMP reply: %v", err)
+		}
+		if !p.fromTarget(from) {
+			continue
+		}
+
+		reply, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != p.seq || (p.privileged && echo.ID != p.id) {
+			continue // An earlier probe's late reply, or another process's
+		}
+		return true, nil
+	}
+}
+
+func (p *prober) fromTarget(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP.Equal(p.ip)
+	case *net.UDPAddr:
+		return a.IP.Equal(p.ip)
+	}
+	return false
+}
+
+func (p *prober) close() {
+	p.conn.Close()
+}
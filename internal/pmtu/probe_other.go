@@ -0,0 +1,22 @@
+//go:build !linux
+
+package pmtu
+
+import (
+	"net"
+	"time"
+
+	"ssh-tunnel/internal/platform"
+)
+
+type prober struct{}
+
+func newProber(ip net.IP) (*prober, error) {
+	return nil, platform.Unsupported(platform.PathMTU)
+}
+
+func (p *prober) echo(size int, timeout time.Duration) (bool, error) {
+	return false, nil
+}
+
+func (p *prober) close() {}
@@ -0,0 +1,38 @@
+package probe
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// HTTP measures the time from sending a HEAD request to url until the
+// response headers arrive. Keep-alives are off, so every probe includes the
+// connection and TLS handshake. Any status counts as an answer.
+func HTTP(url string, opts Options) (*Result, error) {
+	opts = opts.withDefaults()
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return run(MethodHTTP, url, opts, func(timeout time.Duration) (time.Duration, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		if err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		rtt := time.Since(start)
+		resp.Body.Close()
+		return rtt, nil
+	})
+}
@@ -0,0 +1,174 @@
+package probe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// pingTime finds the round trip in the output of the system ping command:
+// "time=12.3 ms" on Unix, "time=12ms" or "time<1ms" on Windows
+var pingTime = regexp.MustCompile(`time[=<]\s*([\d.]+)\s*ms`)
+
+// ICMP sends echo requests to host
+func ICMP(host string, opts Options) (*Result, error) {
+	opts = opts.withDefaults()
+	addr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+
+	p, err := newPinger(addr.IP)
+	if err != nil {
+		// No ICMP socket for this process: leave it to the system ping,
+		// which is setuid or otherwise permitted
+		return run(MethodICMP, addr.IP.String(), opts, func(timeout time.Duration) (time.Duration, error) {
+			return systemPing(addr.IP, timeout)
+		})
+	}
+	defer p.close()
+	return run(MethodICMP, addr.IP.String(), opts, p.echo)
+}
+
+// pinger sends echo requests over an ICMP socket
+type pinger struct {
+	conn       *icmp.PacketConn
+	dst        net.Addr
+	ip         net.IP
+	ipv6       bool
+	privileged bool // Raw socket; ping sockets rewrite the echo ID
+	id         int
+	seq        int
+	token      []byte // Random payload that tells our replies from others'
+}
+
+// newPinger opens a raw ICMP socket, falling back to an unprivileged ping
+// socket where the platform has them
+func newPinger(ip net.IP) (*pinger, error) {
+	if p, err := openPinger(ip, true); err == nil {
+		return p, nil
+	}
+	if !datagramICMP {
+		return nil, fmt.Errorf("failed to open ICMP socket: raw sockets need administrator rights")
+	}
+	return openPinger(ip, false)
+}
+
+// openPinger opens a raw ICMP socket when privileged is set, and an
+// unprivileged ping socket otherwise
+func openPinger(ip net.IP, privileged bool) (*pinger, error) {
+	p := &pinger{ip: ip, ipv6: ip.To4() == nil, privileged: privileged, id: os.Getpid() & 0xffff, token: make([]byte, 16)}
+	rand.Read(p.token)
+
+	network, local := "udp4", "0.0.0.0"
+	if p.ipv6 {
+		network, local = "udp6", "::"
+	}
+	if privileged {
+		network = "ip4:icmp"
+		if p.ipv6 {
+			network = "ip6:ipv6-icmp"
+		}
+	}
+
+	conn, err := icmp.ListenPacket(network, local)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ICMP socket: %v", err)
+	}
+	p.conn, p.dst = conn, &net.UDPAddr{IP: ip}
+	if privileged {
+		p.dst = &net.IPAddr{IP: ip}
+	}
+	return p, nil
+}
+
+// echo sends one echo request and waits up to timeout for its reply
+func (p *pinger) echo(timeout time.Duration) (time.Duration, error) {
+	p.seq = (p.seq + 1) & 0xffff
+
+	var request, reply icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	proto := 1
+	if p.ipv6 {
+		request, reply, proto = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply, 58
+	}
+	msg := icmp.Message{Type: request, Body: &icmp.Echo{ID: p.id, Seq: p.seq, Data: p.token}}
+	packet, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if _, err := p.conn.WriteTo(packet, p.dst); err != nil {
+		return 0, fmt.Errorf("failed to send ICMP echo: %v", err)
+	}
+
+	p.conn.SetReadDeadline(start.Add(timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return 0, fmt.Errorf("no echo reply from %s within %v", p.ip, timeout)
+			}
+			return 0, fmt.Errorf("failed to read ICMP reply: %v", err)
+		}
+		rtt := time.Since(start)
+		if !p.fromTarget(from) {
+			continue
+		}
+
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || msg.Type != reply {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || echo.Seq != p.seq || !bytes.Equal(echo.Data, p.token) || (p.privileged && echo.ID != p.id) {
+			continue // An earlier probe's late reply, or another process's
+		}
+		return rtt, nil
+	}
+}
+
+func (p *pinger) fromTarget(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP.Equal(p.ip)
+	case *net.UDPAddr:
+		return a.IP.Equal(p.ip)
+	}
+	return false
+}
+
+func (p *pinger) close() {
+	p.conn.Close()
+}
+
+// systemPing runs the platform's ping command once and reads the round
+// trip from its output
+func systemPing(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	output, err := pingCommand(ip, timeout).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("ping failed: %v", err)
+	}
+
+	matches := pingTime.FindSubmatch(output)
+	if len(matches) < 2 {
+		return 0, fmt.Errorf("failed to parse ping output: %s", bytes.TrimSpace(output))
+	}
+	ms, err := strconv.ParseFloat(string(matches[1]), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ping time %q", matches[1])
+	}
+	return time.Duration(ms * float64(time.Millisecond)), nil
+}
@@ -0,0 +1,117 @@
+package probe
+
+import (
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+var loopback = net.IPv4(127, 0, 0, 1)
+
+// openOrSkip opens a pinger of the given kind, skipping the test when this
+// process lacks the capability for it
+func openOrSkip(t *testing.T, privileged bool) *pinger {
+	t.Helper()
+
+	p, err := openPinger(loopback, privileged)
+	if err != nil {
+		t.Skipf("socket unavailable (privileged=%v): %v", privileged, err)
+	}
+	return p
+}
+
+func TestICMPPrivileged(t *testing.T) {
+	p := openOrSkip(t, true)
+	defer p.close()
+
+	if _, ok := p.dst.(*net.IPAddr); !ok {
+		t.Errorf("raw socket sends to %T, want *net.IPAddr", p.dst)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := p.echo(2 * time.Second); err != nil {
+			t.Fatalf("echo %d failed: %v", i, err)
+		}
+	}
+}
+
+func TestICMPUnprivileged(t *testing.T) {
+	if !datagramICMP {
+		t.Skip("no unprivileged ping sockets on this platform")
+	}
+	p := openOrSkip(t, false)
+	defer p.close()
+
+	if _, ok := p.dst.(*net.UDPAddr); !ok {
+		t.Errorf("ping socket sends to %T, want *net.UDPAddr", p.dst)
+	}
+	// The kernel rewrites the echo ID, so replies match on seq and token
+	for i := 0; i < 3; i++ {
+		if _, err := p.echo(2 * time.Second); err != nil {
+			t.Fatalf("echo %d failed: %v", i, err)
+		}
+	}
+}
+
+func TestNewPingerPrefersRawSocket(t *testing.T) {
+	raw, err := openPinger(loopback, true)
+	if err != nil {
+		t.Skipf("raw socket unavailable: %v", err)
+	}
+	raw.close()
+
+	p, err := newPinger(loopback)
+	if err != nil {
+		t.Fatalf("newPinger() failed: %v", err)
+	}
+	defer p.close()
+	if !p.privileged {
+		t.Error("newPinger() fell back although a raw socket is available")
+	}
+}
+
+func TestSystemPing(t *testing.T) {
+	if _, err := exec.LookPath("ping"); err != nil {
+		t.Skip("no ping command")
+	}
+
+	rtt, err := systemPing(loopback, 2*time.Second)
+	if err != nil {
+		t.Skipf("ping not permitted here: %v", err)
+	}
+	if rtt < 0 || rtt > 2*time.Second {
+		t.Errorf("implausible round trip %v", rtt)
+	}
+}
+
+func TestICMP(t *testing.T) {
+	result, err := ICMP("127.0.0.1", Options{Count: 2, Interval: time.Millisecond, Timeout: 2 * time.Second})
+	if err != nil {
+		t.Skipf("no ICMP socket or ping command usable: %v", err)
+	}
+	if result.Method != MethodICMP || result.Target != "127.0.0.1" || result.Received != 2 {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestPingTime(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"64 bytes from 127.0.0.1: icmp_seq=1 ttl=64 time=0.045 ms", "0.045"},
+		{"Reply from 10.0.0.1: bytes=32 time=12ms TTL=118", "12"},
+		{"Reply from 10.0.0.1: bytes=32 time<1ms TTL=128", "1"},
+		{"Request timed out.", ""},
+	}
+
+	for _, tt := range tests {
+		got := ""
+		if m := pingTime.FindStringSubmatch(tt.output); len(m) == 2 {
+			got = m[1]
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.output, got, tt.want)
+		}
+	}
+}
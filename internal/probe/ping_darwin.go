@@ -0,0 +1,22 @@
+//go:build darwin
+
+package probe
+
+import (
+	"net"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// datagramICMP reports whether unprivileged ping sockets exist
+const datagramICMP = true
+
+// pingCommand takes -W in milliseconds on macOS; IPv6 needs ping6
+func pingCommand(ip net.IP, timeout time.Duration) *exec.Cmd {
+	name := "ping"
+	if ip.To4() == nil {
+		name = "ping6"
+	}
+	return exec.Command(name, "-c", "1", "-W", strconv.FormatInt(timeout.Milliseconds(), 10), ip.String())
+}
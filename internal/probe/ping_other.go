@@ -0,0 +1,20 @@
+//go:build !windows && !darwin
+
+package probe
+
+import (
+	"net"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// datagramICMP reports whether unprivileged ping sockets exist. On Linux
+// they need net.ipv4.ping_group_range to include the process's group.
+const datagramICMP = true
+
+// pingCommand takes -W in whole seconds, as iputils and BSD ping do
+func pingCommand(ip net.IP, timeout time.Duration) *exec.Cmd {
+	seconds := int64((timeout + time.Second - 1) / time.Second)
+	return exec.Command("ping", "-c", "1", "-W", strconv.FormatInt(seconds, 10), ip.String())
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package probe
+
+import (
+	"net"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// datagramICMP reports whether unprivileged ping sockets exist. Windows
+// only offers raw sockets, to administrators.
+const datagramICMP = false
+
+func pingCommand(ip net.IP, timeout time.Duration) *exec.Cmd {
+	return exec.Command("ping", "-n", "1", "-w", strconv.FormatInt(timeout.Milliseconds(), 10), ip.String())
+}
@@ -0,0 +1,134 @@
+// Package probe measures latency and packet loss to a host with ICMP echo,
+// TCP connects or HTTP requests. ICMP uses a raw socket when permitted,
+// then an unprivileged ping socket, then the system ping command, so it
+// works unprivileged on Linux, macOS and Windows.
+package probe
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Method is how a host was probed
+type Method string
+
+const (
+	MethodICMP Method = "icmp"
+	MethodTCP  Method = "tcp"
+	MethodHTTP Method = "http"
+)
+
+const (
+	defaultTimeout  = 5 * time.Second
+	defaultInterval = 200 * time.Millisecond
+)
+
+// Options control a probe run
+type Options struct {
+	Count    int           // Probes to send; 1 when zero
+	Interval time.Duration // Between probes; 200ms when zero
+	Timeout  time.Duration // Per probe; 5s when zero
+}
+
+func (o Options) withDefaults() Options {
+	if o.Count <= 0 {
+		o.Count = 1
+	}
+	if o.Interval <= 0 {
+		o.Interval = defaultInterval
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultTimeout
+	}
+	return o
+}
+
+// Result holds the statistics of a probe run
+type Result struct {
+	Method   Method          `json:"method"`
+	Target   string          `json:"target"`
+	Sent     int             `json:"sent"`
+	Received int             `json:"received"`
+	Loss     float64         `json:"loss"` // Fraction of probes unanswered, 0-1
+	Min      time.Duration   `json:"min"`
+	Avg      time.Duration   `json:"avg"`
+	Max      time.Duration   `json:"max"`
+	Jitter   time.Duration   `json:"jitter"` // Mean difference between consecutive RTTs
+	RTTs     []time.Duration `json:"-"`
+}
+
+// run sends opts.Count probes with once and collects their round trips.
+// It fails with the last probe error when nothing was answered.
+func run(method Method, target string, opts Options, once func(timeout time.Duration) (time.Duration, error)) (*Result, error) {
+	result := &Result{Method: method, Target: target}
+
+	var lastErr error
+	for i := 0; i < opts.Count; i++ {
+		if i > 0 {
+			time.Sleep(opts.Interval)
+		}
+		result.Sent++
+		rtt, err := once(opts.Timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		result.Received++
+		result.RTTs = append(result.RTTs, rtt)
+	}
+
+	result.summarize()
+	if result.Received == 0 {
+		return result, lastErr
+	}
+	return result, nil
+}
+
+func (r *Result) summarize() {
+	if r.Sent > 0 {
+		r.Loss = float64(r.Sent-r.Received) / float64(r.Sent)
+	}
+	if len(r.RTTs) == 0 {
+		return
+	}
+
+	var total, deltas time.Duration
+	r.Min, r.Max = r.RTTs[0], r.RTTs[0]
+	for i, rtt := range r.RTTs {
+		total += rtt
+		if rtt < r.Min {
+			r.Min = rtt
+		}
+		if rtt > r.Max {
+			r.Max = rtt
+		}
+		if i > 0 {
+			delta := rtt - r.RTTs[i-1]
+			if delta < 0 {
+				delta = -delta
+			}
+			deltas += delta
+		}
+	}
+	r.Avg = total / time.Duration(len(r.RTTs))
+	if len(r.RTTs) > 1 {
+		r.Jitter = deltas / time.Duration(len(r.RTTs)-1)
+	}
+}
+
+// Latency probes host with ICMP and, when no echo is answered and port is
+// set, with TCP connects to host:port. Many servers filter ICMP but accept
+// connections.
+func Latency(host, port string, opts Options) (*Result, error) {
+	result, err := ICMP(host, opts)
+	if err == nil || port == "" {
+		return result, err
+	}
+
+	tcpResult, tcpErr := TCP(net.JoinHostPort(host, port), opts)
+	if tcpErr != nil {
+		return tcpResult, fmt.Errorf("%v; tcp: %v", err, tcpErr)
+	}
+	return tcpResult, nil
+}
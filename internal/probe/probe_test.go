@@ -0,0 +1,155 @@
+package probe
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fast keeps local probe runs short
+var fast = Options{Count: 3, Interval: time.Millisecond, Timeout: 2 * time.Second}
+
+func TestSummarize(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name     string
+		sent     int
+		rtts     []time.Duration
+		loss     float64
+		min, avg time.Duration
+		max      time.Duration
+		jitter   time.Duration
+	}{
+		{"nothing answered", 4, nil, 1, 0, 0, 0, 0},
+		{"one answer", 1, []time.Duration{10 * ms}, 0, 10 * ms, 10 * ms, 10 * ms, 0},
+		{"steady", 3, []time.Duration{10 * ms, 10 * ms, 10 * ms}, 0, 10 * ms, 10 * ms, 10 * ms, 0},
+		{"jittery with loss", 4, []time.Duration{10 * ms, 30 * ms, 20 * ms}, 0.25, 10 * ms, 20 * ms, 30 * ms, 15 * ms},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Result{Sent: tt.sent, Received: len(tt.rtts), RTTs: tt.rtts}
+			r.summarize()
+			if r.Loss != tt.loss || r.Min != tt.min || r.Avg != tt.avg || r.Max != tt.max || r.Jitter != tt.jitter {
+				t.Errorf("got loss %v min %v avg %v max %v jitter %v", r.Loss, r.Min, r.Avg, r.Max, r.Jitter)
+			}
+		})
+	}
+}
+
+func TestTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	result, err := TCP(ln.Addr().String(), fast)
+	if err != nil {
+		t.Fatalf("TCP() failed: %v", err)
+	}
+	if result.Method != MethodTCP || result.Sent != 3 || result.Received != 3 || result.Loss != 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if result.Min <= 0 || result.Min > result.Max {
+		t.Errorf("bad round trips: min %v max %v", result.Min, result.Max)
+	}
+}
+
+func TestTCPRefused(t *testing.T) {
+	// A port that was just free is almost certainly still closed
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	result, err := TCP(addr, fast)
+	if err == nil {
+		t.Fatal("TCP() to a closed port succeeded")
+	}
+	if result.Sent != 3 || result.Received != 0 || result.Loss != 1 {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Method != http.MethodHead {
+			t.Errorf("probe sent %s, want HEAD", r.Method)
+		}
+		// Probes count any status and do not follow redirects
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	}))
+	defer server.Close()
+
+	result, err := HTTP(server.URL, fast)
+	if err != nil {
+		t.Fatalf("HTTP() failed: %v", err)
+	}
+	if result.Method != MethodHTTP || result.Received != 3 || result.Loss != 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if requests != 3 {
+		t.Errorf("server saw %d requests, want 3", requests)
+	}
+}
+
+func TestHTTPUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	result, err := HTTP(url, fast)
+	if err == nil {
+		t.Fatal("HTTP() to a closed server succeeded")
+	}
+	if result.Received != 0 || result.Loss != 1 {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	result, err := Latency("127.0.0.1", port, Options{Count: 1, Timeout: 2 * time.Second})
+	if err != nil {
+		t.Fatalf("Latency() failed: %v", err)
+	}
+	// Loopback answers ICMP wherever a socket or ping is available;
+	// otherwise the TCP connect must have answered
+	if result.Method != MethodICMP && result.Method != MethodTCP {
+		t.Errorf("unexpected method %s", result.Method)
+	}
+	if result.Received != 1 {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
@@ -0,0 +1,21 @@
+package probe
+
+import (
+	"net"
+	"time"
+)
+
+// TCP measures the time to open a TCP connection to addr (host:port)
+func TCP(addr string, opts Options) (*Result, error) {
+	opts = opts.withDefaults()
+	return run(MethodTCP, addr, opts, func(timeout time.Duration) (time.Duration, error) {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return 0, err
+		}
+		rtt := time.Since(start)
+		conn.Close()
+		return rtt, nil
+	})
+}
@@ -0,0 +1,262 @@
+package protocols
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"ssh-tunnel/internal/config"
+)
+
+const (
+	// Token bucket size bounds; a bucket holds a tenth of a second of
+	// traffic so bursts stay short
+	minShaperBurst = 4 << 10
+	maxShaperBurst = 256 << 10
+
+	// throttleWindow is how long after its last wait a tunnel still counts
+	// as throttled
+	throttleWindow = 2 * time.Second
+)
+
+// ThrottleStatus reports the bandwidth limits of a tunnel and how much they
+// are holding it back. Rates are in bytes per second.
+type ThrottleStatus struct {
+	UploadLimit   float64       `json:"upload_limit"`   // 0 when unlimited
+	DownloadLimit float64       `json:"download_limit"` // 0 when unlimited
+	UploadRate    float64       `json:"upload_rate"`    // Since the previous sample
+	DownloadRate  float64       `json:"download_rate"`
+	Throttled     bool          `json:"throttled"`      // Connections waited for tokens recently
+	ThrottledTime time.Duration `json:"throttled_time"` // Total time connections waited
+}
+
+// bandwidthShaper holds the token buckets shared by every connection of a
+// tunnel, so the limit applies to the tunnel as a whole
+type bandwidthShaper struct {
+	uploadLimit   float64
+	downloadLimit float64
+	upload        *rate.Limiter // nil when unlimited
+	download      *rate.Limiter
+
+	uploaded     atomic.Uint64
+	downloaded   atomic.Uint64
+	waited       atomic.Int64 // Nanoseconds spent waiting for tokens
+	lastThrottle atomic.Int64 // Unix nanoseconds of the last wait
+
+	mu           sync.Mutex // Guards the rate sample
+	sampled      time.Time
+	sampleUp     uint64
+	sampleDown   uint64
+	uploadRate   float64
+	downloadRate float64
+}
+
+// shapers holds the shaper of each rate limited server. Shapers outlive
+// tunnel restarts so their counters keep running.
+var shapers = struct {
+	mu sync.Mutex
+	m  map[string]*bandwidthShaper
+}{m: make(map[string]*bandwidthShaper)}
+
+func newBandwidthShaper(upload, download float64) *bandwidthShaper {
+	return &bandwidthShaper{
+		uploadLimit:   upload,
+		downloadLimit: download,
+		upload:        newLimiter(upload),
+		download:      newLimiter(download),
+		sampled:       time.Now(),
+	}
+}
+
+func newLimiter(limit float64) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+
+	burst := int(limit / 10)
+	if burst < minShaperBurst {
+		burst = minShaperBurst
+	}
+	if burst > maxShaperBurst {
+		burst = maxShaperBurst
+	}
+	return rate.NewLimiter(rate.Limit(limit), burst)
+}
+
+// shaperFor returns the shaper for a server, or nil when it has no limits.
+// The existing shaper is kept unless the limits changed.
+func shaperFor(server config.Server) (*bandwidthShaper, error) {
+	upload, download, err := server.BandwidthLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	shapers.mu.Lock()
+	defer shapers.mu.Unlock()
+
+	if upload == 0 && download == 0 {
+		delete(shapers.m, server.Name)
+		return nil, nil
+	}
+
+	shaper, ok := shapers.m[server.Name]
+	if !ok || shaper.uploadLimit != upload || shaper.downloadLimit != download {
+		shaper = newBandwidthShaper(upload, download)
+		shapers.m[server.Name] = shaper
+	}
+	return shaper, nil
+}
+
+// GetThrottleStatus returns the throttle state of a rate limited tunnel
+func GetThrottleStatus(name string) (*ThrottleStatus, bool) {
+	shapers.mu.Lock()
+	shaper, ok := shapers.m[name]
+	shapers.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+	return shaper.status(), true
+}
+
+// status samples the shaper's transfer rates
+func (s *bandwidthShaper) status() *ThrottleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Keep the previous rates when sampled again within a second
+	if elapsed := time.Since(s.sampled); elapsed >= time.Second {
+		up, down := s.uploaded.Load(), s.downloaded.Load()
+		s.uploadRate = float64(up-s.sampleUp) / elapsed.Seconds()
+		s.downloadRate = float64(down-s.sampleDown) / elapsed.Seconds()
+		s.sampleUp, s.sampleDown = up, down
+		s.sampled = time.Now()
+	}
+
+	last := s.lastThrottle.Load()
+	return &ThrottleStatus{
+		UploadLimit:   s.uploadLimit,
+		DownloadLimit: s.downloadLimit,
+		UploadRate:    s.uploadRate,
+		DownloadRate:  s.downloadRate,
+		Throttled:     last != 0 && time.Since(time.Unix(0, last)) < throttleWindow,
+		ThrottledTime: time.Duration(s.waited.Load()),
+	}
+}
+
+// wait takes n tokens from limiter, recording any time spent throttled
+func (s *bandwidthShaper) wait(ctx context.Context, limiter *rate.Limiter, n int) error {
+	start := time.Now()
+	err := limiter.WaitN(ctx, n)
+	if waited := time.Since(start); waited > time.Millisecond {
+		s.waited.Add(int64(waited))
+		s.lastThrottle.Store(time.Now().UnixNano())
+	}
+	return err
+}
+
+// listenLocal opens the local proxy listener of a server, counting its
+// traffic, and rate limiting its connections when the server has
+// bandwidth limits
+func listenLocal(server config.Server) (net.Listener, error) {
+	shaper, err := shaperFor(server)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", server.LocalPort))
+	if err != nil {
+		return nil, err
+	}
+	listener = &countingListener{Listener: listener, counter: trafficCounterFor(server.Name)}
+	if shaper == nil {
+		return listener, nil
+	}
+	return &limitedListener{Listener: listener, shaper: shaper}, nil
+}
+
+// limitedListener hands out rate limited connections
+type limitedListener struct {
+	net.Listener
+	shaper *bandwidthShaper
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &limitedConn{Conn: conn, shaper: l.shaper, ctx: ctx, cancel: cancel}, nil
+}
+
+// limitedConn is a local client connection: reads are uploads, writes are
+// downloads. Each is split into chunks no larger than the token bucket.
+type limitedConn struct {
+	net.Conn
+	shaper *bandwidthShaper
+	ctx    context.Context // Cancelled on Close to release waiting callers
+	cancel context.CancelFunc
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	limiter := c.shaper.upload
+	if limiter != nil && len(p) > limiter.Burst() {
+		p = p[:limiter.Burst()]
+	}
+
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.shaper.uploaded.Add(uint64(n))
+		if limiter != nil {
+			c.shaper.wait(c.ctx, limiter, n)
+		}
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	limiter := c.shaper.download
+	if limiter == nil {
+		n, err := c.Conn.Write(p)
+		c.shaper.downloaded.Add(uint64(n))
+		return n, err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		chunk := len(p)
+		if chunk > limiter.Burst() {
+			chunk = limiter.Burst()
+		}
+		if err := c.shaper.wait(c.ctx, limiter, chunk); err != nil {
+			return written, net.ErrClosed
+		}
+
+		n, err := c.Conn.Write(p[:chunk])
+		written += n
+		c.shaper.downloaded.Add(uint64(n))
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the underlying connection when supported
+func (c *limitedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+func (c *limitedConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
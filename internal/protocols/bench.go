@@ -0,0 +1,93 @@
+package protocols
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/diagnostics"
+)
+
+// Bench pushes data through a connected tunnel to the speed helper at
+// target, by default the one autodiscovery runs on the server itself.
+// Probes go through the UDP relay when the server has one. The result is
+// stored in the history, where throughput selection picks it up.
+func (tm *TunnelManager) Bench(name, target string, opts diagnostics.BenchOptions) (*diagnostics.BenchResult, error) {
+	tm.mu.RLock()
+	server, ok := tm.findServer(name)
+	sup := tm.supervisors[name]
+	tm.mu.RUnlock()
+
+	if !ok || sup == nil {
+		return nil, fmt.Errorf("tunnel %s not found", name)
+	}
+	if target == "" {
+		target = net.JoinHostPort("127.0.0.1", strconv.Itoa(diagnostics.BenchPort))
+	}
+
+	dial := func(network, addr string) (net.Conn, error) {
+		return tm.DialTunnel(name, network, addr)
+	}
+	var packets func() (net.PacketConn, error)
+	if _, ok := sup.tunnel.(packetDialer); ok && server.UDP != nil {
+		packets = func() (net.PacketConn, error) { return tm.ListenPacket(name) }
+	}
+
+	result, err := diagnostics.RunBench(dial, packets, target, opts)
+	if err != nil {
+		return nil, err
+	}
+	result.Server = name
+	result.Protocol = benchProtocol(server)
+
+	if err := diagnostics.NewHistory("").Append("bench", name, result); err != nil {
+		log.Printf("Failed to store bench result for %s: %v", name, err)
+	}
+	return result, nil
+}
+
+// Throughput runs a timed bidirectional throughput test through a
+// connected tunnel to the speed helper at target, defaulting as Bench
+// does. The result is stored in the history as a throughput test.
+func (tm *TunnelManager) Throughput(name, target string, duration time.Duration) (*diagnostics.ThroughputResult, error) {
+	tm.mu.RLock()
+	server, ok := tm.findServer(name)
+	tm.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("tunnel %s not found", name)
+	}
+	if target == "" {
+		target = net.JoinHostPort("127.0.0.1", strconv.Itoa(diagnostics.BenchPort))
+	}
+
+	dial := func(network, addr string) (net.Conn, error) {
+		return tm.DialTunnel(name, network, addr)
+	}
+	result, err := diagnostics.NewThroughputTest(dial, target, duration).Run()
+	if err != nil {
+		return nil, err
+	}
+	result.Server = name
+	result.Protocol = benchProtocol(server)
+
+	if err := diagnostics.NewHistory("").Append("throughput", name, result); err != nil {
+		log.Printf("Failed to store throughput result for %s: %v", name, err)
+	}
+	return result, nil
+}
+
+// benchProtocol names what carries a server's tunnel, for results
+func benchProtocol(server config.Server) string {
+	protocol := string(server.Transport)
+	switch {
+	case server.Exec != nil:
+		protocol += " (" + server.Exec.Binary + ")"
+	case len(server.Chain) > 0:
+		protocol += " (chain)"
+	}
+	return protocol
+}
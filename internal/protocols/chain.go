@@ -0,0 +1,401 @@
+package protocols
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// chainProbeInterval is how often a running chain is checked end to end
+const chainProbeInterval = 30 * time.Second
+
+// chainHop is an established hop of a chain
+type chainHop struct {
+	dial     DialFunc        // Opens connections onward from the hop
+	close    func()          // Releases the hop
+	lost     <-chan error    // Reports a dropped session; nil for per-connection hops
+	channels *channelTracker // For SSH hops
+}
+
+// ChainTunnel implements the Tunnel interface for multi-hop chains. Each
+// hop is connected through the one before it, so traffic enters at the
+// first server in the chain and exits from the last, e.g. SSH → Trojan →
+// SSH.
+type ChainTunnel struct {
+	server   config.Server
+	hops     []config.Server // Entry hop first, ending with server itself
+	conns    []*chainHop
+	listener net.Listener
+	status   *TunnelStatus
+	mu       sync.RWMutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewChainTunnel creates a tunnel that passes through hops before exiting
+// from server
+func NewChainTunnel(server config.Server, hops []config.Server) *ChainTunnel {
+	return &ChainTunnel{
+		server: server,
+		hops:   append(append([]config.Server(nil), hops...), server),
+		status: &TunnelStatus{
+			ServerName: server.Name,
+			Status:     "disconnected",
+		},
+	}
+}
+
+// Start connects the chain hop by hop and serves the local port through it
+func (t *ChainTunnel) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	t.status.Status = "connecting"
+	t.status.StartTime = time.Now()
+
+	conns, err := connectChain(t.ctx, t.hops)
+	if err != nil {
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+		return err
+	}
+
+	listener, err := listenLocal(t.server)
+	if err != nil {
+		closeChain(conns)
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+		return fmt.Errorf("failed to create local listener: %v", err)
+	}
+
+	t.conns = conns
+	t.listener = listener
+	for _, hop := range conns {
+		if hop.channels != nil {
+			hop.channels.tunnel = t.server.Name
+			hop.channels.register()
+		}
+	}
+	t.status.Status = "connected"
+	log.Printf("%s proxy started on port %d for %s (chain %s)", t.server.Proxy, t.server.LocalPort, t.server.Name, t.route())
+
+	go t.acceptConnections(listener, conns[len(conns)-1].dial)
+	go t.watch(t.ctx, conns)
+
+	return nil
+}
+
+// Stop closes the local listener and every hop
+func (t *ChainTunnel) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cancel != nil {
+		t.cancel()
+	}
+
+	if t.listener != nil {
+		t.listener.Close()
+		t.listener = nil
+	}
+
+	for _, hop := range t.conns {
+		if hop.channels != nil {
+			hop.channels.unregister()
+		}
+	}
+	closeChain(t.conns)
+	t.conns = nil
+
+	t.status.Status = "disconnected"
+	return nil
+}
+
+// GetStatus returns the current status
+func (t *ChainTunnel) GetStatus() *TunnelStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	statusCopy := *t.status
+	return &statusCopy
+}
+
+// GetName returns the tunnel name
+func (t *ChainTunnel) GetName() string {
+	return t.server.Name
+}
+
+// Test measures the latency of the whole chain: the time to reach the exit
+// server through every preceding hop and get a response from it. When the
+// tunnel is not running the preceding hops are connected just for the test.
+func (t *ChainTunnel) Test() (time.Duration, error) {
+	t.mu.RLock()
+	conns := t.conns
+	t.mu.RUnlock()
+
+	if conns == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		built, err := connectChain(ctx, t.hops[:len(t.hops)-1])
+		if err != nil {
+			return 0, err
+		}
+		defer closeChain(built)
+		conns = append(built, nil)
+	}
+
+	return probeExit(t.server, conns[len(conns)-2].dial)
+}
+
+// route describes the chain for logs, e.g. "a → b → c"
+func (t *ChainTunnel) route() string {
+	names := make([]string, len(t.hops))
+	for i, hop := range t.hops {
+		names[i] = hop.Name
+	}
+	return strings.Join(names, " → ")
+}
+
+// Dial opens a connection to addr through every hop
+func (t *ChainTunnel) Dial(network, addr string) (net.Conn, error) {
+	t.mu.RLock()
+	conns := t.conns
+	t.mu.RUnlock()
+
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("chain %s is not connected", t.server.Name)
+	}
+	return conns[len(conns)-1].dial(network, addr)
+}
+
+// acceptConnections serves local clients through the last hop
+func (t *ChainTunnel) acceptConnections(listener net.Listener, dial DialFunc) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if t.ctx.Err() != nil {
+				return // Context cancelled
+			}
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := handleInbound(conn, t.server.Proxy, dial); err != nil {
+				log.Printf("Connection error for %s: %v", t.server.Name, err)
+			}
+		}()
+	}
+}
+
+// watch marks the tunnel as failed when a hop's session drops or the chain
+// stops answering end to end, so the supervisor rebuilds it
+func (t *ChainTunnel) watch(ctx context.Context, conns []*chainHop) {
+	lost := make(chan error, len(conns))
+	for i, hop := range conns {
+		if hop.lost == nil {
+			continue
+		}
+		go func(name string, hopLost <-chan error) {
+			select {
+			case err := <-hopLost:
+				lost <- fmt.Errorf("hop %s lost: %v", name, err)
+			case <-ctx.Done():
+			}
+		}(t.hops[i].Name, hop.lost)
+	}
+
+	ticker := time.NewTicker(chainProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-lost:
+			t.fail(ctx, err)
+			return
+		case <-ticker.C:
+			if _, err := probeExit(t.server, conns[len(conns)-2].dial); err != nil {
+				t.fail(ctx, fmt.Errorf("chain probe failed: %v", err))
+				return
+			}
+		}
+	}
+}
+
+// fail records an error for the run started with ctx
+func (t *ChainTunnel) fail(ctx context.Context, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if ctx.Err() == nil && t.ctx == ctx {
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+	}
+}
+
+// connectChain connects each hop through the previous one, the first
+// directly. On failure the hops already connected are closed.
+func connectChain(ctx context.Context, hops []config.Server) ([]*chainHop, error) {
+	conns := make([]*chainHop, 0, len(hops))
+	base := DialFunc((&net.Dialer{Timeout: hops[0].Timeout}).Dial)
+
+	for i, server := range hops {
+		start := time.Now()
+		hop, err := connectHop(ctx, server, base)
+		if err != nil {
+			closeChain(conns)
+			return nil, fmt.Errorf("chain hop %d (%s): %v", i+1, server.Name, err)
+		}
+		log.Printf("Chain hop %d/%d %s (%s) ready in %v", i+1, len(hops), server.Name, server.Transport, time.Since(start))
+
+		conns = append(conns, hop)
+		base = hop.dial
+	}
+
+	return conns, nil
+}
+
+// closeChain closes hops from the exit back to the entry
+func closeChain(conns []*chainHop) {
+	for i := len(conns) - 1; i >= 0; i-- {
+		if conns[i] != nil {
+			conns[i].close()
+		}
+	}
+}
+
+// connectHop establishes a hop whose server is reached through base
+func connectHop(ctx context.Context, server config.Server, base DialFunc) (*chainHop, error) {
+	switch server.Transport {
+	case config.TransportSSH:
+		return connectSSHHop(server, base)
+	case config.TransportTrojan:
+		hop := NewTrojanTunnel(server)
+		hop.dial = base
+		closeHop := func() {}
+		if hop.muxEnabled() {
+			hop.pool = hop.newPool()
+			closeHop = func() { hop.pool.Close() }
+		}
+		return &chainHop{dial: hop.Dial, close: closeHop}, nil
+	case config.TransportVLESS:
+		hop := NewV2RayTunnel(server)
+		if server.V2Ray.Network == "kcp" {
+			return nil, fmt.Errorf("mKCP network cannot be chained")
+		}
+		uuid, err := parseUUID(server.V2Ray.UUID)
+		if err != nil {
+			return nil, err
+		}
+		hop.uuid = uuid
+		hop.dial = base
+		hop.ctx = ctx
+		closeHop := func() {}
+		if hop.network() == "grpc" {
+			hop.transport = hop.grpcTransport()
+			closeHop = hop.transport.CloseIdleConnections
+		}
+		return &chainHop{dial: hop.Dial, close: closeHop}, nil
+	case config.TransportNaive:
+		hop := NewNaiveTunnel(server)
+		hop.dial = base
+		hop.ctx = ctx
+		hop.transport = hop.newTransport()
+		return &chainHop{dial: hop.Dial, close: hop.transport.CloseIdleConnections}, nil
+	default:
+		return nil, fmt.Errorf("transport %s cannot be chained", server.Transport)
+	}
+}
+
+// connectSSHHop opens an SSH session through base and forwards onward
+// connections over it
+func connectSSHHop(server config.Server, base DialFunc) (*chainHop, error) {
+	clientConfig, err := sshClientConfig(server)
+	if err != nil {
+		return nil, err
+	}
+	obfuscator, err := NewObfuscator(server)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(server.Host, server.Port)
+	conn, err := base("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	if conn, err = wrapObfuscated(obfuscator, conn); err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(server.Timeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to SSH server: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	channels := newChannelTracker("", server.Name, addr)
+	lost := make(chan error, 1)
+	go func() {
+		err := client.Wait()
+		if err == nil {
+			err = fmt.Errorf("SSH connection closed")
+		}
+		lost <- err
+	}()
+
+	return &chainHop{
+		dial:     channels.dial(client),
+		close:    func() { client.Close() },
+		lost:     lost,
+		channels: channels,
+	}, nil
+}
+
+// probeExit connects to the exit server through dial and waits for it to
+// answer: the SSH banner, or a TLS handshake for TLS-based transports.
+// Without either only the connection is timed.
+func probeExit(server config.Server, dial DialFunc) (time.Duration, error) {
+	start := time.Now()
+
+	conn, err := dial("tcp", net.JoinHostPort(server.Host, server.Port))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(server.Timeout))
+
+	switch {
+	case server.Transport == config.TransportSSH:
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			return 0, fmt.Errorf("no SSH banner from %s: %v", server.Name, err)
+		}
+	case server.Transport == config.TransportTrojan || server.Transport == config.TransportNaive ||
+		(server.V2Ray != nil && server.V2Ray.TLS == "tls"):
+		// Only the round trip matters here, not the certificate
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: server.Host, InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			return 0, fmt.Errorf("TLS handshake with %s failed: %v", server.Name, err)
+		}
+	}
+
+	return time.Since(start), nil
+}
@@ -0,0 +1,250 @@
+package protocols
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHConnectionStats describes the channels multiplexed over one SSH
+// connection. Servers cap them (OpenSSH's MaxSessions, and MaxStartups for
+// connections), so a rising failure rate with many open channels points at
+// a limit rather than at the destinations.
+type SSHConnectionStats struct {
+	Tunnel       string            `json:"tunnel"`
+	Server       string            `json:"server"` // The SSH server, a hop for chains
+	Address      string            `json:"address"`
+	Connected    time.Time         `json:"connected"`
+	OpenChannels int               `json:"open_channels"`
+	PeakChannels int               `json:"peak_channels"`
+	Opened       uint64            `json:"opened"`        // Channels opened since connecting
+	OpenFailures uint64            `json:"open_failures"` // Channel opens the server refused or that failed
+	FailureRate  float64           `json:"failure_rate"`  // Failures over open attempts, 0 to 1
+	Failures     map[string]uint64 `json:"failures,omitempty"`
+	LastFailure  *ChannelFailure   `json:"last_failure,omitempty"`
+	Channels     []ChannelInfo     `json:"channels"`
+}
+
+// ChannelInfo describes an open channel
+type ChannelInfo struct {
+	ID          uint64    `json:"id"`
+	Destination string    `json:"destination"`
+	Opened      time.Time `json:"opened"`
+	BytesSent   uint64    `json:"bytes_sent"`
+	BytesRecv   uint64    `json:"bytes_recv"`
+}
+
+// ChannelFailure is a channel open that failed
+type ChannelFailure struct {
+	Destination string    `json:"destination"`
+	Reason      string    `json:"reason"`
+	Error       string    `json:"error"`
+	Time        time.Time `json:"time"`
+}
+
+// channelTracker counts the channels an SSH connection opens
+type channelTracker struct {
+	tunnel    string
+	server    string
+	address   string
+	connected time.Time
+
+	mu          sync.Mutex
+	nextID      uint64
+	open        map[uint64]*trackedChannel
+	peak        int
+	opened      uint64
+	failed      uint64
+	failures    map[string]uint64 // By reason
+	lastFailure *ChannelFailure
+}
+
+func newChannelTracker(tunnel, server, address string) *channelTracker {
+	return &channelTracker{
+		tunnel:    tunnel,
+		server:    server,
+		address:   address,
+		connected: time.Now(),
+		open:      make(map[uint64]*trackedChannel),
+		failures:  make(map[string]uint64),
+	}
+}
+
+// sshConnections holds the trackers of the running SSH connections
+var sshConnections = struct {
+	mu sync.Mutex
+	m  map[string]*channelTracker // By tunnel and server
+}{m: make(map[string]*channelTracker)}
+
+func (ct *channelTracker) key() string {
+	return ct.tunnel + "\x00" + ct.server
+}
+
+// register publishes the tracker, replacing the one of an earlier
+// connection of the same tunnel and server
+func (ct *channelTracker) register() {
+	sshConnections.mu.Lock()
+	defer sshConnections.mu.Unlock()
+	sshConnections.m[ct.key()] = ct
+}
+
+func (ct *channelTracker) unregister() {
+	sshConnections.mu.Lock()
+	defer sshConnections.mu.Unlock()
+	if sshConnections.m[ct.key()] == ct {
+		delete(sshConnections.m, ct.key())
+	}
+}
+
+// GetSSHConnections returns the channel stats of every running SSH
+// connection, ordered by tunnel and server
+func GetSSHConnections() []SSHConnectionStats {
+	sshConnections.mu.Lock()
+	trackers := make([]*channelTracker, 0, len(sshConnections.m))
+	for _, ct := range sshConnections.m {
+		trackers = append(trackers, ct)
+	}
+	sshConnections.mu.Unlock()
+
+	stats := make([]SSHConnectionStats, 0, len(trackers))
+	for _, ct := range trackers {
+		stats = append(stats, ct.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Tunnel != stats[j].Tunnel {
+			return stats[i].Tunnel < stats[j].Tunnel
+		}
+		return stats[i].Server < stats[j].Server
+	})
+	return stats
+}
+
+// stats snapshots the tracker
+func (ct *channelTracker) stats() SSHConnectionStats {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	stats := SSHConnectionStats{
+		Tunnel:       ct.tunnel,
+		Server:       ct.server,
+		Address:      ct.address,
+		Connected:    ct.connected,
+		OpenChannels: len(ct.open),
+		PeakChannels: ct.peak,
+		Opened:       ct.opened,
+		OpenFailures: ct.failed,
+		Channels:     make([]ChannelInfo, 0, len(ct.open)),
+	}
+	if attempts := ct.opened + ct.failed; attempts > 0 {
+		stats.FailureRate = float64(ct.failed) / float64(attempts)
+	}
+	if len(ct.failures) > 0 {
+		stats.Failures = make(map[string]uint64, len(ct.failures))
+		for reason, n := range ct.failures {
+			stats.Failures[reason] = n
+		}
+	}
+	if ct.lastFailure != nil {
+		last := *ct.lastFailure
+		stats.LastFailure = &last
+	}
+	for id, ch := range ct.open {
+		stats.Channels = append(stats.Channels, ChannelInfo{
+			ID:          id,
+			Destination: ch.destination,
+			Opened:      ch.opened,
+			BytesSent:   ch.sent.Load(),
+			BytesRecv:   ch.received.Load(),
+		})
+	}
+	sort.Slice(stats.Channels, func(i, j int) bool { return stats.Channels[i].ID < stats.Channels[j].ID })
+	return stats
+}
+
+// dial returns a DialFunc opening tracked channels over client
+func (ct *channelTracker) dial(client *ssh.Client) DialFunc {
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := client.Dial(network, addr)
+		if err != nil {
+			ct.fail(addr, err)
+			return nil, err
+		}
+		return ct.add(conn, addr), nil
+	}
+}
+
+func (ct *channelTracker) add(conn net.Conn, destination string) net.Conn {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	ct.nextID++
+	ch := &trackedChannel{Conn: conn, tracker: ct, id: ct.nextID, destination: destination, opened: time.Now()}
+	ct.open[ch.id] = ch
+	ct.opened++
+	if len(ct.open) > ct.peak {
+		ct.peak = len(ct.open)
+	}
+	return ch
+}
+
+func (ct *channelTracker) remove(id uint64) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	delete(ct.open, id)
+}
+
+func (ct *channelTracker) fail(destination string, err error) {
+	reason := "error"
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		reason = openErr.Reason.String()
+	}
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.failed++
+	ct.failures[reason]++
+	ct.lastFailure = &ChannelFailure{Destination: destination, Reason: reason, Error: err.Error(), Time: time.Now()}
+}
+
+// trackedChannel leaves the tracker's open channels when closed
+type trackedChannel struct {
+	net.Conn
+	tracker     *channelTracker
+	id          uint64
+	destination string
+	opened      time.Time
+	sent        atomic.Uint64
+	received    atomic.Uint64
+	closeOnce   sync.Once
+}
+
+func (c *trackedChannel) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Add(uint64(n))
+	return n, err
+}
+
+func (c *trackedChannel) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.Add(uint64(n))
+	return n, err
+}
+
+func (c *trackedChannel) Close() error {
+	c.closeOnce.Do(func() { c.tracker.remove(c.id) })
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the channel
+func (c *trackedChannel) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package protocols
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+// DNSTunnel implements the Tunnel interface by carrying an SSH session over
+// an iodine-compatible DNS tunnel. The iodine client brings up a tun
+// interface and the SSH tunnel is then established to the server's tunnel IP.
+type DNSTunnel struct {
+	server config.Server
+	cmd    *exec.Cmd
+	inner  *SSHTunnel
+	status *TunnelStatus
+	mu     sync.RWMutex
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewDNSTunnel creates a new DNS tunnel
+func NewDNSTunnel(server config.Server) *DNSTunnel {
+	return &DNSTunnel{
+		server: server,
+		status: &TunnelStatus{
+			ServerName: server.Name,
+			Status:     "disconnected",
+		},
+	}
+}
+
+// Start starts the iodine client and the SSH tunnel running over it
+func (t *DNSTunnel) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	t.status.Status = "connecting"
+	t.status.StartTime = time.Now()
+
+	dns := t.server.DNSTunnel
+	args := []string{"-f"}
+	if dns.Resolver != "" {
+		args = append(args, dns.Resolver)
+	}
+	args = append(args, dns.Domain)
+
+	cmd := exec.CommandContext(t.ctx, "iodine", args...)
+	// iodine reads the password from its environment, which unlike its
+	// command line other local users cannot read
+	if dns.Password != "" {
+		cmd.Env = append(os.Environ(), "IODINE_PASS="+dns.Password)
+	}
+	if err := cmd.Start(); err != nil {
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+		return fmt.Errorf("failed to start iodine (is it installed and running as root?): %v", err)
+	}
+	t.cmd = cmd
+
+	go func() {
+		if err := cmd.Wait(); err != nil && t.ctx.Err() == nil {
+			log.Printf("iodine exited for %s: %v", t.server.Name, err)
+			t.mu.Lock()
+			t.status.Status = "error"
+			t.status.LastError = err.Error()
+			t.mu.Unlock()
+		}
+	}()
+
+	// Wait for the tunnel interface to come up and sshd to be reachable
+	tunnelAddr := net.JoinHostPort(dns.TunnelIP, t.server.Port)
+	deadline := time.Now().Add(t.server.Timeout * 3)
+	for {
+		conn, err := net.DialTimeout("tcp", tunnelAddr, 2*time.Second)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) || t.ctx.Err() != nil {
+			t.stopLocked()
+			t.status.Status = "error"
+			t.status.LastError = err.Error()
+			return fmt.Errorf("DNS tunnel did not come up: %v", err)
+		}
+		time.Sleep(time.Second)
+	}
+
+	// Run the regular SSH tunnel against the tunnel IP
+	inner := t.server
+	inner.Host = dns.TunnelIP
+	inner.Transport = config.TransportSSH
+	t.inner = NewSSHTunnel(inner)
+	if err := t.inner.Start(t.ctx); err != nil {
+		t.stopLocked()
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+		return err
+	}
+
+	t.status.Status = "connected"
+	return nil
+}
+
+// Stop stops the SSH session and the iodine client
+func (t *DNSTunnel) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stopLocked()
+	t.status.Status = "disconnected"
+	return nil
+}
+
+func (t *DNSTunnel) stopLocked() {
+	if t.inner != nil {
+		t.inner.Stop()
+		t.inner = nil
+	}
+
+	if t.cancel != nil {
+		t.cancel()
+	}
+
+	if t.cmd != nil && t.cmd.Process != nil {
+		t.cmd.Process.Kill()
+		t.cmd = nil
+	}
+}
+
+// GetStatus returns the current status
+func (t *DNSTunnel) GetStatus() *TunnelStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	statusCopy := *t.status
+	return &statusCopy
+}
+
+// GetName returns the tunnel name
+func (t *DNSTunnel) GetName() string {
+	return t.server.Name
+}
+
+// Test measures the round trip of a DNS query for the tunnel domain
+
+// RunCommand runs a command on the server over the SSH connection the DNS
+// tunnel carries
+func (t *DNSTunnel) RunCommand(cmd string) ([]byte, error) {
+	t.mu.RLock()
+	inner := t.inner
+	t.mu.RUnlock()
+
+	if inner == nil {
+		return nil, fmt.Errorf("dns tunnel %s is not connected", t.server.Name)
+	}
+	return inner.RunCommand(cmd)
+}
+
+// through the configured (or system) recursive resolver
+func (t *DNSTunnel) Test() (time.Duration, error) {
+	dns := t.server.DNSTunnel
+	resolver := net.DefaultResolver
+	if dns.Resolver != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{Timeout: 5 * time.Second}
+				return d.DialContext(ctx, "udp", net.JoinHostPort(dns.Resolver, "53"))
+			},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := resolver.LookupNS(ctx, dns.Domain); err != nil {
+		return 0, fmt.Errorf("DNS probe failed: %v", err)
+	}
+
+	return time.Since(start), nil
+}
@@ -0,0 +1,554 @@
+package protocols
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/probe"
+)
+
+// execDefaultArgs are the command lines of the default external clients.
+// "{config}" is replaced by the config file path.
+var execDefaultArgs = map[config.TransportType][]string{
+	config.TransportHysteria: {"client", "-c", "{config}"},
+	config.TransportTUIC:     {"-c", "{config}"},
+	config.TransportTrojan:   {"-config", "{config}"},
+	config.TransportV2Ray:    {"run", "-c", "{config}"},
+	config.TransportVMess:    {"run", "-c", "{config}"},
+	config.TransportVLESS:    {"run", "-c", "{config}"},
+}
+
+// execHealthInterval is how often the local inbound of a running binary is
+// probed
+const execHealthInterval = 5 * time.Second
+
+// ExecTunnel implements the Tunnel interface by running an external client
+// binary that serves the server's local port itself. The tunnel writes the
+// binary's config, watches the process and its inbound, and reports an
+// error when either goes away so the supervisor restarts it.
+type ExecTunnel struct {
+	server     config.Server
+	cmd        *exec.Cmd
+	exited     chan struct{}
+	configPath string // Generated config, removed on stop
+	status     *TunnelStatus
+	mu         sync.RWMutex
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// NewExecTunnel creates a new external-binary tunnel
+func NewExecTunnel(server config.Server) *ExecTunnel {
+	return &ExecTunnel{
+		server: server,
+		status: &TunnelStatus{
+			ServerName: server.Name,
+			Status:     "disconnected",
+		},
+	}
+}
+
+// Start writes the client config, launches the binary and waits for it to
+// open the local port
+func (t *ExecTunnel) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	t.status.Status = "connecting"
+	t.status.StartTime = time.Now()
+
+	if err := t.startLocked(); err != nil {
+		t.stopLocked()
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+		return err
+	}
+
+	t.status.Status = "connected"
+	log.Printf("%s proxy started on port %d for %s (%s)", t.server.Proxy, t.server.LocalPort, t.server.Name, t.server.Exec.Binary)
+
+	go t.watchInbound(t.ctx)
+
+	return nil
+}
+
+func (t *ExecTunnel) startLocked() error {
+	execCfg := t.server.Exec
+
+	configPath := execCfg.ConfigFile
+	if configPath == "" {
+		server, err := withPathMTU(t.server)
+		if err != nil {
+			return err
+		}
+		data, err := execClientConfig(server)
+		if err != nil {
+			return fmt.Errorf("failed to generate %s config: %v", execCfg.Binary, err)
+		}
+		if configPath, err = writeExecConfig(t.server.Name, data); err != nil {
+			return fmt.Errorf("failed to write %s config: %v", execCfg.Binary, err)
+		}
+		t.configPath = configPath
+	}
+
+	args := execCfg.Args
+	if len(args) == 0 {
+		args = execDefaultArgs[t.server.Transport]
+	}
+	if len(args) == 0 {
+		args = []string{"-c", "{config}"}
+	}
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = strings.ReplaceAll(arg, "{config}", configPath)
+	}
+
+	output := &execOutput{name: t.server.Name}
+	cmd := exec.CommandContext(t.ctx, execCfg.Binary, expanded...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.WaitDelay = 2 * time.Second
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s (is it installed?): %v", execCfg.Binary, err)
+	}
+	t.cmd = cmd
+
+	exited := make(chan struct{})
+	t.exited = exited
+	ctx := t.ctx
+	go func() {
+		err := cmd.Wait()
+		close(exited)
+		if ctx.Err() != nil {
+			return // Stopped
+		}
+
+		msg := fmt.Sprintf("%s exited", execCfg.Binary)
+		if err != nil {
+			msg = fmt.Sprintf("%s exited: %v", execCfg.Binary, err)
+		}
+		if last := output.lastLine(); last != "" {
+			msg += " (" + last + ")"
+		}
+		log.Printf("%s for %s", msg, t.server.Name)
+
+		t.mu.Lock()
+		t.status.Status = "error"
+		t.status.LastError = msg
+		t.mu.Unlock()
+	}()
+
+	// Wait for the binary to open the local port
+	inbound := net.JoinHostPort("127.0.0.1", strconv.Itoa(t.server.LocalPort))
+	deadline := time.Now().Add(t.server.Timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", inbound, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
+		select {
+		case <-exited:
+			if last := output.lastLine(); last != "" {
+				return fmt.Errorf("%s exited during startup: %s", execCfg.Binary, last)
+			}
+			return fmt.Errorf("%s exited during startup", execCfg.Binary)
+		case <-t.ctx.Done():
+			return t.ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not open local port %d: %v", execCfg.Binary, t.server.LocalPort, err)
+		}
+	}
+}
+
+// watchInbound marks the tunnel as failed when the local port stops
+// accepting connections while the process is still running
+func (t *ExecTunnel) watchInbound(ctx context.Context) {
+	ticker := time.NewTicker(execHealthInterval)
+	defer ticker.Stop()
+
+	inbound := net.JoinHostPort("127.0.0.1", strconv.Itoa(t.server.LocalPort))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			conn, err := net.DialTimeout("tcp", inbound, 2*time.Second)
+			if err == nil {
+				conn.Close()
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
+			t.mu.Lock()
+			t.status.Status = "error"
+			t.status.LastError = fmt.Sprintf("local port %d not reachable: %v", t.server.LocalPort, err)
+			t.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Stop stops the external binary
+func (t *ExecTunnel) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stopLocked()
+	t.status.Status = "disconnected"
+	return nil
+}
+
+func (t *ExecTunnel) stopLocked() {
+	if t.cancel != nil {
+		t.cancel()
+	}
+
+	// The context kills the process; wait so the local port is free for a
+	// restart
+	if t.exited != nil {
+		<-t.exited
+		t.exited = nil
+	}
+	t.cmd = nil
+
+	if t.configPath != "" {
+		os.Remove(t.configPath)
+		t.configPath = ""
+	}
+}
+
+// GetStatus returns the current status
+func (t *ExecTunnel) GetStatus() *TunnelStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	statusCopy := *t.status
+	return &statusCopy
+}
+
+// GetName returns the tunnel name
+func (t *ExecTunnel) GetName() string {
+	return t.server.Name
+}
+
+// Test measures the TCP connect time to the server, or a QUIC round trip
+// for the QUIC-based protocols. mKCP cannot be probed without speaking it.
+func (t *ExecTunnel) Test() (time.Duration, error) {
+	switch {
+	case t.server.Transport == config.TransportHysteria, t.server.Transport == config.TransportTUIC:
+		return quicPing(t.server)
+	case t.server.V2Ray != nil && t.server.V2Ray.Network == "kcp":
+		return 0, fmt.Errorf("latency test not supported for UDP transport %s", t.server.Transport)
+	}
+
+	result, err := probe.TCP(net.JoinHostPort(t.server.Host, t.server.Port), probe.Options{})
+	if err != nil {
+		return 0, err
+	}
+	return result.Avg, nil
+}
+
+// Dial opens a connection to addr through the client's local proxy port
+func (t *ExecTunnel) Dial(network, addr string) (net.Conn, error) {
+	return dialLocalProxy(t.server.Proxy, t.server.LocalPort, addr, 10*time.Second)
+}
+
+// execOutput forwards the binary's output to the log line by line and
+// keeps the last line for error reports
+type execOutput struct {
+	name string
+	mu   sync.Mutex
+	buf  []byte
+	last string
+}
+
+func (o *execOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.buf = append(o.buf, p...)
+	for {
+		i := bytes.IndexByte(o.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(o.buf[:i]))
+		o.buf = o.buf[i+1:]
+		if line == "" {
+			continue
+		}
+		o.last = line
+		if strings.HasPrefix(line, "Confirm user presence") {
+			// ssh waits for a FIDO2 security key
+			log.Printf("👆 Touch your security key to authenticate to %s (%s)", o.name, line)
+			continue
+		}
+		log.Printf("[%s] %s", o.name, line)
+	}
+	return len(p), nil
+}
+
+func (o *execOutput) lastLine() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if rest := strings.TrimSpace(string(o.buf)); rest != "" {
+		return rest
+	}
+	return o.last
+}
+
+// writeExecConfig stores a generated config where only the current user can
+// read it, since it carries the server credentials
+func writeExecConfig(name string, data []byte) (string, error) {
+	dir := filepath.Join(os.TempDir(), "ssh-tunnel-exec")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, strings.NewReplacer("/", "_", string(os.PathSeparator), "_").Replace(name)+".json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// execClientConfig generates the external client's JSON config for a server
+func execClientConfig(server config.Server) ([]byte, error) {
+	var cfg interface{}
+	var err error
+
+	switch server.Transport {
+	case config.TransportHysteria:
+		cfg, err = hysteriaClientConfig(server)
+	case config.TransportTUIC:
+		cfg, err = tuicClientConfig(server)
+	case config.TransportTrojan:
+		cfg, err = trojanClientConfig(server)
+	case config.TransportV2Ray, config.TransportVMess, config.TransportVLESS:
+		cfg, err = xrayClientConfig(server)
+	default:
+		return nil, fmt.Errorf("no config generator for %s, set exec config_file", server.Transport)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(cfg, "", "  ")
+}
+
+// localListen is the address the external client serves the local port on
+func localListen(server config.Server) string {
+	return net.JoinHostPort("0.0.0.0", strconv.Itoa(server.LocalPort))
+}
+
+// hysteriaClientConfig targets the Hysteria 2 client
+func hysteriaClientConfig(server config.Server) (interface{}, error) {
+	hy := server.Hysteria
+	if hy == nil {
+		return nil, fmt.Errorf("hysteria configuration is required")
+	}
+
+	cfg := map[string]interface{}{
+		"server": net.JoinHostPort(server.Host, server.Port),
+		"auth":   hy.AuthString,
+		"tls": map[string]interface{}{
+			"sni":      server.Host,
+			"insecure": server.InsecureSkipVerify,
+		},
+	}
+	if hop := server.PortHopping; hop != nil {
+		// Hysteria hops natively given a port range in the server address
+		cfg["server"] = server.Host + ":" + strings.ReplaceAll(hop.Ports, " ", "")
+		cfg["transport"] = map[string]interface{}{
+			"udp": map[string]interface{}{"hopInterval": hop.Interval.String()},
+		}
+	}
+	if hy.Bandwidth != "" {
+		cfg["bandwidth"] = map[string]string{"up": hy.Bandwidth, "down": hy.Bandwidth}
+	}
+	if hy.Obfs != "" {
+		cfg["obfs"] = map[string]interface{}{
+			"type":  hy.Obfs,
+			hy.Obfs: map[string]string{"password": hy.ObfsPassword},
+		}
+	}
+	if hy.MTU > 0 && hy.MTU < maxPathMTU {
+		// Stay at QUIC's minimum datagram size instead of probing upwards
+		// on a path known to carry less than a full Ethernet frame
+		cfg["quic"] = map[string]interface{}{"disablePathMTUDiscovery": true}
+	}
+
+	switch server.Proxy {
+	case config.ProxyHTTP, config.ProxyHTTPS:
+		cfg["http"] = map[string]string{"listen": localListen(server)}
+	default:
+		cfg["socks5"] = map[string]string{"listen": localListen(server)}
+	}
+
+	return cfg, nil
+}
+
+// tuicClientConfig targets tuic-client v5, which only serves SOCKS5
+func tuicClientConfig(server config.Server) (interface{}, error) {
+	tuic := server.TUIC
+	if tuic == nil {
+		return nil, fmt.Errorf("tuic configuration is required")
+	}
+	if server.Proxy != config.ProxySOCKS5 {
+		return nil, fmt.Errorf("tuic-client only supports the socks5 proxy type")
+	}
+
+	relay := map[string]interface{}{
+		"server":             net.JoinHostPort(server.Host, server.Port),
+		"uuid":               tuic.UUID,
+		"password":           tuic.Password,
+		"zero_rtt_handshake": tuic.ZeroRTT,
+	}
+	if tuic.SNI != "" {
+		// tuic-client takes the server name from the address; pin the IP
+		relay["server"] = net.JoinHostPort(tuic.SNI, server.Port)
+		relay["ip"] = server.Host
+	}
+	if tuic.CongestionControl != "" {
+		relay["congestion_control"] = tuic.CongestionControl
+	}
+	if tuic.UDPRelayMode != "" {
+		relay["udp_relay_mode"] = tuic.UDPRelayMode
+	}
+	if len(tuic.ALPN) > 0 {
+		relay["alpn"] = tuic.ALPN
+	}
+
+	return map[string]interface{}{
+		"relay":     relay,
+		"local":     map[string]string{"server": localListen(server)},
+		"log_level": "warn",
+	}, nil
+}
+
+// trojanClientConfig targets trojan-go, which serves SOCKS5 and HTTP on the
+// same port
+func trojanClientConfig(server config.Server) (interface{}, error) {
+	if server.Password == "" {
+		return nil, fmt.Errorf("password is required for trojan")
+	}
+
+	port, err := strconv.Atoi(server.Port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", server.Port)
+	}
+
+	cfg := map[string]interface{}{
+		"run_type":    "client",
+		"local_addr":  "0.0.0.0",
+		"local_port":  server.LocalPort,
+		"remote_addr": server.Host,
+		"remote_port": port,
+		"password":    []string{server.Password},
+		"ssl": map[string]interface{}{
+			"sni":    server.Host,
+			"verify": !server.InsecureSkipVerify,
+		},
+	}
+	if mux := server.Mux; mux != nil && mux.Enabled {
+		cfg["mux"] = map[string]interface{}{
+			"enabled":      true,
+			"concurrency":  mux.MaxStreams,
+			"idle_timeout": int(mux.IdleTimeout.Seconds()),
+		}
+	}
+	return cfg, nil
+}
+
+// xrayClientConfig targets Xray/v2ray-core with a single inbound on the
+// local port and a VMess or VLESS outbound
+func xrayClientConfig(server config.Server) (interface{}, error) {
+	v2 := server.V2Ray
+	if v2 == nil {
+		return nil, fmt.Errorf("v2ray configuration is required")
+	}
+
+	port, err := strconv.Atoi(server.Port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", server.Port)
+	}
+
+	inbound := map[string]interface{}{
+		"listen":   "0.0.0.0",
+		"port":     server.LocalPort,
+		"protocol": "socks",
+		"settings": map[string]interface{}{"udp": true},
+	}
+	if server.Proxy == config.ProxyHTTP || server.Proxy == config.ProxyHTTPS {
+		inbound["protocol"] = "http"
+		inbound["settings"] = map[string]interface{}{}
+	}
+
+	protocol := "vmess"
+	user := map[string]interface{}{"id": v2.UUID, "alterId": v2.AlterID}
+	if v2.Security != "" {
+		user["security"] = v2.Security
+	}
+	if server.Transport == config.TransportVLESS {
+		protocol = "vless"
+		user = map[string]interface{}{"id": v2.UUID, "encryption": "none"}
+	}
+
+	stream := v2.StreamSettings()
+	if v2.TLS == "tls" && server.InsecureSkipVerify {
+		tlsSettings, _ := stream["tlsSettings"].(map[string]interface{})
+		if tlsSettings == nil {
+			tlsSettings = map[string]interface{}{}
+		}
+		tlsSettings["allowInsecure"] = true
+		stream["tlsSettings"] = tlsSettings
+	}
+
+	outbound := map[string]interface{}{
+		"protocol": protocol,
+		"settings": map[string]interface{}{
+			"vnext": []interface{}{
+				map[string]interface{}{
+					"address": server.Host,
+					"port":    port,
+					"users":   []interface{}{user},
+				},
+			},
+		},
+		"streamSettings": stream,
+	}
+	// Xray's mux has no idle timeout setting
+	if mux := server.Mux; mux != nil && mux.Enabled {
+		outbound["mux"] = map[string]interface{}{
+			"enabled":     true,
+			"concurrency": mux.MaxStreams,
+		}
+	}
+
+	return map[string]interface{}{
+		"log":       map[string]string{"loglevel": "warning"},
+		"inbounds":  []interface{}{inbound},
+		"outbounds": []interface{}{outbound},
+	}, nil
+}
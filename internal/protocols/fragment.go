@@ -0,0 +1,198 @@
+package protocols
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+const (
+	tlsRecordHeaderLen  = 5
+	tlsRecordHandshake  = 0x16
+	tlsClientHello      = 0x01
+	tlsExtensionSNI     = 0x0000
+	tlsSNIHostName      = 0x00
+	maxTLSRecordPayload = 16384
+)
+
+// fragmentConn splits the TLS ClientHello in the first write into chunks
+// sent as separate TCP segments, or separate TLS records, with a pause
+// between them. Later writes pass through untouched.
+type fragmentConn struct {
+	net.Conn
+	mode                 string
+	minLength, maxLength int
+	minDelay, maxDelay   time.Duration
+	done                 bool
+}
+
+// wrapFragment applies the server's ClientHello fragmentation, if enabled,
+// to a freshly dialed TCP connection
+func wrapFragment(server config.Server, conn net.Conn) net.Conn {
+	frag := server.Fragment
+	if frag == nil || !frag.Enabled {
+		return conn
+	}
+	minLength, maxLength, err := frag.Lengths()
+	if err != nil {
+		return conn // Rejected by validation
+	}
+	minDelay, maxDelay, err := frag.Delays()
+	if err != nil {
+		return conn
+	}
+
+	// Each write must leave as its own segment
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetNoDelay(true)
+	}
+	return &fragmentConn{
+		Conn:      conn,
+		mode:      frag.Mode,
+		minLength: minLength,
+		maxLength: maxLength,
+		minDelay:  minDelay,
+		maxDelay:  maxDelay,
+	}
+}
+
+func (c *fragmentConn) Write(b []byte) (int, error) {
+	if c.done {
+		return c.Conn.Write(b)
+	}
+	c.done = true
+
+	end, sniStart, sniEnd, ok := parseClientHello(b)
+	if !ok {
+		return c.Conn.Write(b)
+	}
+
+	// Cut the record body up to the end of the server name, with one cut
+	// inside the name, and send the rest of the hello in one piece
+	cuts := c.cuts(tlsRecordHeaderLen, sniEnd)
+	cuts = append(cuts, sniStart+(sniEnd-sniStart)/2, end)
+	sort.Ints(cuts)
+
+	var pieces [][]byte
+	switch c.mode {
+	case config.FragmentRecord:
+		prev := tlsRecordHeaderLen
+		for _, cut := range cuts {
+			if cut <= prev {
+				continue
+			}
+			record := make([]byte, tlsRecordHeaderLen, tlsRecordHeaderLen+cut-prev)
+			copy(record, b[:3])
+			binary.BigEndian.PutUint16(record[3:], uint16(cut-prev))
+			pieces = append(pieces, append(record, b[prev:cut]...))
+			prev = cut
+		}
+	default:
+		prev := 0
+		for _, cut := range cuts {
+			if cut <= prev {
+				continue
+			}
+			pieces = append(pieces, b[prev:cut])
+			prev = cut
+		}
+	}
+	if end < len(b) {
+		pieces = append(pieces, b[end:])
+	}
+
+	for i, piece := range pieces {
+		if i > 0 {
+			time.Sleep(c.delay())
+		}
+		if _, err := c.Conn.Write(piece); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// cuts returns offsets splitting [start, end) into chunks of random length
+func (c *fragmentConn) cuts(start, end int) []int {
+	var cuts []int
+	for pos := start + c.minLength + rand.Intn(c.maxLength-c.minLength+1); pos < end; pos += c.minLength + rand.Intn(c.maxLength-c.minLength+1) {
+		cuts = append(cuts, pos)
+	}
+	return cuts
+}
+
+func (c *fragmentConn) delay() time.Duration {
+	if c.maxDelay <= c.minDelay {
+		return c.minDelay
+	}
+	return c.minDelay + time.Duration(rand.Int63n(int64(c.maxDelay-c.minDelay)))
+}
+
+// parseClientHello checks that b starts with a TLS record holding a
+// ClientHello and returns the end of that record and the span of the server
+// name in it
+func parseClientHello(b []byte) (end, sniStart, sniEnd int, ok bool) {
+	if len(b) < tlsRecordHeaderLen+4 || b[0] != tlsRecordHandshake || b[tlsRecordHeaderLen] != tlsClientHello {
+		return 0, 0, 0, false
+	}
+	length := int(binary.BigEndian.Uint16(b[3:5]))
+	end = tlsRecordHeaderLen + length
+	if length > maxTLSRecordPayload || end > len(b) {
+		return 0, 0, 0, false
+	}
+
+	// Handshake header, client version and random
+	pos := tlsRecordHeaderLen + 4 + 2 + 32
+	skip := func(lenBytes int) bool {
+		if pos+lenBytes > end {
+			return false
+		}
+		n := 0
+		for _, v := range b[pos : pos+lenBytes] {
+			n = n<<8 | int(v)
+		}
+		pos += lenBytes + n
+		return pos <= end
+	}
+	// Session ID, cipher suites, compression methods
+	if !skip(1) || !skip(2) || !skip(1) {
+		return 0, 0, 0, false
+	}
+
+	if pos+2 > end {
+		return 0, 0, 0, false
+	}
+	extEnd := pos + 2 + int(binary.BigEndian.Uint16(b[pos:]))
+	pos += 2
+	if extEnd > end {
+		return 0, 0, 0, false
+	}
+	for pos+4 <= extEnd {
+		extType := binary.BigEndian.Uint16(b[pos:])
+		extLen := int(binary.BigEndian.Uint16(b[pos+2:]))
+		data := pos + 4
+		pos = data + extLen
+		if pos > extEnd {
+			return 0, 0, 0, false
+		}
+		if extType != tlsExtensionSNI {
+			continue
+		}
+
+		// Server name list length, name type, name length
+		if extLen < 5 || b[data+2] != tlsSNIHostName {
+			return 0, 0, 0, false
+		}
+		nameLen := int(binary.BigEndian.Uint16(b[data+3:]))
+		sniStart, sniEnd = data+5, data+5+nameLen
+		if nameLen == 0 || sniEnd > pos {
+			return 0, 0, 0, false
+		}
+		return end, sniStart, sniEnd, true
+	}
+	return 0, 0, 0, false
+}
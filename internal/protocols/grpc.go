@@ -0,0 +1,221 @@
+package protocols
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// gunConn carries a byte stream over a gRPC bidirectional stream using the
+// "Gun" service of v2ray-core and Xray. Each gRPC message is a protobuf Hunk
+// (or MultiHunk in multi mode) whose field 1 holds raw bytes.
+type gunConn struct {
+	writer *io.PipeWriter
+	ready  chan struct{}
+	resp   *http.Response
+	err    error
+	reader *bufio.Reader
+	buf    []byte
+	addr   string
+}
+
+// dialGun opens a Tun (or TunMulti) stream for serviceName. The request is
+// sent without waiting for response headers, since gRPC servers typically
+// only send them alongside the first message.
+func dialGun(ctx context.Context, transport *http2.Transport, scheme, addr, host, serviceName string, multi bool) *gunConn {
+	method := "Tun"
+	if multi {
+		method = "TunMulti"
+	}
+
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Scheme: scheme, Host: addr, Path: "/" + serviceName + "/" + method},
+		Host:   host,
+		Header: make(http.Header),
+		Body:   pr,
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("User-Agent", "grpc-go/1.58.3")
+
+	c := &gunConn{writer: pw, ready: make(chan struct{}), addr: addr}
+	go func() {
+		defer close(c.ready)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			pw.CloseWithError(err)
+			c.err = fmt.Errorf("gRPC stream to %s failed: %v", addr, err)
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			pw.Close()
+			c.err = fmt.Errorf("gRPC stream to %s rejected: %s", addr, resp.Status)
+			return
+		}
+		c.resp = resp
+		c.reader = bufio.NewReader(resp.Body)
+	}()
+
+	return c
+}
+
+func (c *gunConn) Write(p []byte) (int, error) {
+	// A Hunk and a single-entry MultiHunk share the same wire encoding
+	if _, err := c.writer.Write(grpcFrame(appendProtoBytes(nil, 1, p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *gunConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if err := c.readMessage(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// readMessage reads one gRPC message and appends its payload to the buffer
+func (c *gunConn) readMessage() error {
+	<-c.ready
+	if c.err != nil {
+		return c.err
+	}
+
+	msg, err := readGRPCMessage(c.reader)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return c.streamError()
+		}
+		return err
+	}
+
+	// Collect every field 1; other fields are skipped
+	return walkProto(msg, func(field, _ uint64, data []byte) {
+		if field == 1 {
+			c.buf = append(c.buf, data...)
+		}
+	})
+}
+
+// streamError reports the gRPC status carried in the trailers once the
+// server ends the stream
+func (c *gunConn) streamError() error {
+	status := c.resp.Trailer.Get("Grpc-Status")
+	if status == "" || status == "0" {
+		return io.EOF
+	}
+	return fmt.Errorf("gRPC stream closed with status %s: %s", status, c.resp.Trailer.Get("Grpc-Message"))
+}
+
+func (c *gunConn) Close() error {
+	c.writer.Close()
+	select {
+	case <-c.ready:
+		if c.resp != nil {
+			return c.resp.Body.Close()
+		}
+	default:
+	}
+	return nil
+}
+
+func (c *gunConn) CloseWrite() error {
+	return c.writer.Close()
+}
+
+func (c *gunConn) LocalAddr() net.Addr                { return h2Addr("local") }
+func (c *gunConn) RemoteAddr() net.Addr               { return h2Addr(c.addr) }
+func (c *gunConn) SetDeadline(t time.Time) error      { return nil }
+func (c *gunConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *gunConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// grpcFrame prefixes an uncompressed message with the gRPC length header
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// readGRPCMessage reads one length-prefixed gRPC message
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, fmt.Errorf("compressed gRPC messages are not supported")
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// appendProtoBytes appends a length-delimited protobuf field
+func appendProtoBytes(b []byte, field uint64, data []byte) []byte {
+	b = binary.AppendUvarint(b, field<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// walkProto calls fn for every varint and length-delimited field of a
+// protobuf message. Fixed-width fields are skipped.
+func walkProto(msg []byte, fn func(field, varint uint64, data []byte)) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return fmt.Errorf("malformed protobuf message")
+		}
+		msg = msg[n:]
+
+		switch tag & 7 {
+		case 0: // varint
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return fmt.Errorf("malformed protobuf message")
+			}
+			msg = msg[n:]
+			fn(tag>>3, v, nil)
+		case 1: // fixed64
+			if len(msg) < 8 {
+				return fmt.Errorf("malformed protobuf message")
+			}
+			msg = msg[8:]
+		case 5: // fixed32
+			if len(msg) < 4 {
+				return fmt.Errorf("malformed protobuf message")
+			}
+			msg = msg[4:]
+		case 2: // length-delimited
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || length > uint64(len(msg)-n) {
+				return fmt.Errorf("malformed protobuf message")
+			}
+			fn(tag>>3, 0, msg[n:n+int(length)])
+			msg = msg[n+int(length):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", tag&7)
+		}
+	}
+	return nil
+}
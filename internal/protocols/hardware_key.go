@@ -0,0 +1,162 @@
+package protocols
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"ssh-tunnel/internal/config"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// hardwareKeyAuth authenticates with the server's smartcard or security
+// key through the ssh-agent. The private keys never leave the hardware, so
+// the agent, which loaded them with ssh-add, does the signing.
+func hardwareKeyAuth(server config.Server) (ssh.AuthMethod, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("hardware keys need a running ssh-agent (SSH_AUTH_SOCK is not set)")
+	}
+
+	var wanted ssh.PublicKey
+	if path := hardwareKeyPublicKeyPath(server); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key: %v", err)
+		}
+		if wanted, _, _, _, err = ssh.ParseAuthorizedKey(data); err != nil {
+			return nil, fmt.Errorf("failed to parse public key %s: %v", path, err)
+		}
+	}
+
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach ssh-agent: %v", err)
+		}
+		defer conn.Close()
+
+		keys, err := agent.NewClient(conn).List()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list ssh-agent keys: %v", err)
+		}
+
+		var signers []ssh.Signer
+		for _, key := range keys {
+			if !hardwareKeyMatches(server.HardwareKey, key, wanted) {
+				continue
+			}
+			signers = append(signers, &agentSigner{
+				socket: socket,
+				key:    key,
+				touch:  strings.HasPrefix(key.Type(), "sk-"),
+				server: server.Name,
+			})
+		}
+		if len(signers) == 0 {
+			return nil, fmt.Errorf("no matching %s key in the ssh-agent; %s", server.HardwareKey.Type, hardwareKeyHint(server))
+		}
+		return signers, nil
+	}), nil
+}
+
+// hardwareKeyPublicKeyPath returns the .pub file picking the server's key,
+// if there is one
+func hardwareKeyPublicKeyPath(server config.Server) string {
+	if path := server.HardwareKey.PublicKey; path != "" {
+		return expandHome(path)
+	}
+	if server.KeyPath != "" {
+		path := expandHome(server.KeyPath) + ".pub"
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// hardwareKeyMatches reports whether an agent key is the server's hardware
+// key: the configured public key, or else any key of the hardware type.
+// ssh-agent names PKCS#11 keys without a label after their provider.
+func hardwareKeyMatches(hw *config.HardwareKeyConfig, key *agent.Key, wanted ssh.PublicKey) bool {
+	if wanted != nil {
+		return bytes.Equal(key.Marshal(), wanted.Marshal())
+	}
+	switch hw.Type {
+	case config.HardwareKeyFIDO2:
+		return strings.HasPrefix(key.Type(), "sk-")
+	case config.HardwareKeyPKCS11:
+		return key.Comment == hw.Provider
+	}
+	return false
+}
+
+// hardwareKeyHint tells how to load the server's key into the agent
+func hardwareKeyHint(server config.Server) string {
+	hw := server.HardwareKey
+	if hw.Type == config.HardwareKeyPKCS11 {
+		hint := "load the token with: ssh-add -s " + hw.Provider
+		if hw.PublicKey == "" {
+			hint += " (or set public_key if the agent labels its keys)"
+		}
+		return hint
+	}
+	if server.KeyPath != "" {
+		return "load it with: ssh-add " + server.KeyPath
+	}
+	return "load it with: ssh-add ~/.ssh/id_ed25519_sk, or ssh-add -K for resident keys"
+}
+
+// agentSigner signs with a key held by the ssh-agent, connecting for each
+// signature so no agent connection outlives the handshake
+type agentSigner struct {
+	socket string
+	key    *agent.Key
+	touch  bool   // Security keys wait for a touch before signing
+	server string // For the touch prompt
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.key
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *agentSigner) SignWithAlgorithm(_ io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512:
+		flags = agent.SignatureFlagRsaSha512
+	}
+
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach ssh-agent: %v", err)
+	}
+	defer conn.Close()
+
+	if s.touch {
+		log.Printf("👆 Touch your security key to authenticate to %s (%s)", s.server, s.key.Comment)
+	}
+	return agent.NewClient(conn).SignWithFlags(s.key, data, flags)
+}
+
+// expandHome replaces a leading "~/" with the home directory
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return home + path[1:]
+		}
+	}
+	return path
+}
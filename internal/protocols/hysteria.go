@@ -48,7 +48,7 @@ func (t *HysteriaTunnel) GetName() string {
 	return t.server.Name
 }
 
-// Test tests the connection
+// Test times a QUIC version negotiation round trip with the server
 func (t *HysteriaTunnel) Test() (time.Duration, error) {
-	return 0, fmt.Errorf("Hysteria test not yet implemented")
+	return quicPing(t.server)
 }
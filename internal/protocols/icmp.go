@@ -0,0 +1,45 @@
+package protocols
+
+import (
+	"net"
+	"time"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/icmptunnel"
+)
+
+// ICMPTunnel implements the Tunnel interface by running SSH over a stream
+// carried in ICMP echo messages. The server side is the ICMP agent started
+// with `tunnel icmp-server`, which relays sessions to the local sshd.
+type ICMPTunnel struct {
+	*SSHTunnel
+}
+
+// NewICMPTunnel creates a new ICMP tunnel
+func NewICMPTunnel(server config.Server) *ICMPTunnel {
+	t := NewSSHTunnel(server)
+	t.dial = dialICMP
+	return &ICMPTunnel{SSHTunnel: t}
+}
+
+// Test measures the time of an ICMP tunnel handshake with the agent
+func (t *ICMPTunnel) Test() (time.Duration, error) {
+	start := time.Now()
+	conn, err := dialICMP(t.server, t.server.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	conn.Close()
+
+	return latency, nil
+}
+
+// dialICMP opens a stream to the ICMP tunnel agent on the server
+func dialICMP(server config.Server, timeout time.Duration) (net.Conn, error) {
+	return icmptunnel.Dial(server.Host, server.ICMP.Key, icmptunnel.Options{
+		MTU:          server.ICMP.MTU,
+		PollInterval: server.ICMP.PollInterval,
+		Timeout:      timeout,
+	})
+}
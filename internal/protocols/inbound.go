@@ -0,0 +1,530 @@
+package protocols
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/crash"
+)
+
+// DialFunc opens an outbound connection through a tunnel
+type DialFunc func(network, addr string) (net.Conn, error)
+
+// SOCKS5 protocol constants
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthNoAcceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSuccess             = 0x00
+	socks5RepGeneralFailure      = 0x01
+	socks5RepCmdNotSupported     = 0x07
+	socks5RepAddrTypeUnsupported = 0x08
+)
+
+// SOCKS4 protocol constants
+const (
+	socks4Version    = 0x04
+	socks4CmdConnect = 0x01
+
+	socks4RepGranted  = 0x5a
+	socks4RepRejected = 0x5b
+)
+
+// serveSOCKS5 handles a single SOCKS5 client connection. UDP ASSOCIATE is
+// served when packets is set.
+func serveSOCKS5(conn net.Conn, reader *bufio.Reader, dial DialFunc, packets PacketFunc) error {
+	if err := socks5Handshake(reader, conn); err != nil {
+		return err
+	}
+
+	target, cmd, err := readSOCKS5Request(reader)
+	if err != nil {
+		if errors.Is(err, errAddrTypeUnsupported) {
+			writeSOCKS5Reply(conn, socks5RepAddrTypeUnsupported)
+		}
+		return err
+	}
+
+	if cmd == socks5CmdUDPAssociate && packets != nil {
+		return serveUDPAssociate(conn, reader, packets)
+	}
+	if cmd != socks5CmdConnect {
+		writeSOCKS5Reply(conn, socks5RepCmdNotSupported)
+		return fmt.Errorf("unsupported SOCKS5 command: %d", cmd)
+	}
+
+	remote, err := dial("tcp", target)
+	if err != nil {
+		writeSOCKS5Reply(conn, socks5RepGeneralFailure)
+		return fmt.Errorf("failed to dial %s: %v", target, err)
+	}
+	defer remote.Close()
+
+	if err := writeSOCKS5Reply(conn, socks5RepSuccess); err != nil {
+		return err
+	}
+
+	relay(&bufferedConn{Conn: conn, reader: reader}, remote)
+	return nil
+}
+
+var errAddrTypeUnsupported = errors.New("unsupported SOCKS5 address type")
+
+// socks5Handshake performs method negotiation (no authentication)
+func socks5Handshake(reader *bufio.Reader, w io.Writer) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 greeting: %v", err)
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 methods: %v", err)
+	}
+
+	for _, method := range methods {
+		if method == socks5AuthNone {
+			_, err := w.Write([]byte{socks5Version, socks5AuthNone})
+			return err
+		}
+	}
+
+	w.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+	return fmt.Errorf("no acceptable SOCKS5 authentication method")
+}
+
+// readSOCKS5Request parses a SOCKS5 request and returns the target address
+func readSOCKS5Request(reader *bufio.Reader) (string, byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", 0, fmt.Errorf("failed to read SOCKS5 request: %v", err)
+	}
+	if header[0] != socks5Version {
+		return "", 0, fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+
+	var host string
+	switch header[3] {
+	case socks5AtypIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socks5AtypIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socks5AtypDomain:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", 0, err
+		}
+		domain := make([]byte, length)
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return "", 0, err
+		}
+		if err := checkDomain(string(domain)); err != nil {
+			return "", 0, err
+		}
+		host = string(domain)
+	default:
+		return "", 0, errAddrTypeUnsupported
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(reader, portBytes); err != nil {
+		return "", 0, err
+	}
+	port := binary.BigEndian.Uint16(portBytes)
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), header[1], nil
+}
+
+// checkDomain rejects SOCKS target names that cannot be a host: empty
+// ones, and ones with brackets, whitespace or control characters, or a
+// colon outside an IPv6 literal
+func checkDomain(domain string) error {
+	if domain == "" {
+		return fmt.Errorf("empty SOCKS target host")
+	}
+	for i := 0; i < len(domain); i++ {
+		c := domain[i]
+		if c <= ' ' || c == 0x7f || c == '[' || c == ']' || (c == ':' && net.ParseIP(domain) == nil) {
+			return fmt.Errorf("invalid SOCKS target host %q", domain)
+		}
+	}
+	return nil
+}
+
+// writeSOCKS5Reply writes a reply with an unspecified bind address
+func writeSOCKS5Reply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// serveSOCKS4 handles a single SOCKS4 or SOCKS4a client connection
+func serveSOCKS4(conn net.Conn, reader *bufio.Reader, dial DialFunc) error {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return fmt.Errorf("failed to read SOCKS4 request: %v", err)
+	}
+	if header[0] != socks4Version {
+		return fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+
+	// The user ID is ignored, like SOCKS5 authentication
+	if _, err := readSOCKS4String(reader); err != nil {
+		return err
+	}
+
+	host := net.IP(header[4:8]).String()
+	if header[4] == 0 && header[5] == 0 && header[6] == 0 && header[7] != 0 {
+		// SOCKS4a: 0.0.0.x means the domain name follows
+		domain, err := readSOCKS4String(reader)
+		if err != nil {
+			return err
+		}
+		if err := checkDomain(domain); err != nil {
+			writeSOCKS4Reply(conn, socks4RepRejected)
+			return err
+		}
+		host = domain
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(header[2:4]))))
+
+	if header[1] != socks4CmdConnect {
+		writeSOCKS4Reply(conn, socks4RepRejected)
+		return fmt.Errorf("unsupported SOCKS4 command: %d", header[1])
+	}
+
+	remote, err := dial("tcp", target)
+	if err != nil {
+		writeSOCKS4Reply(conn, socks4RepRejected)
+		return fmt.Errorf("failed to dial %s: %v", target, err)
+	}
+	defer remote.Close()
+
+	if err := writeSOCKS4Reply(conn, socks4RepGranted); err != nil {
+		return err
+	}
+
+	relay(&bufferedConn{Conn: conn, reader: reader}, remote)
+	return nil
+}
+
+// readSOCKS4String reads a NUL-terminated field of at most 255 bytes
+func readSOCKS4String(reader *bufio.Reader) (string, error) {
+	var field []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("failed to read SOCKS4 request: %v", err)
+		}
+		if b == 0 {
+			return string(field), nil
+		}
+		if len(field) == 255 {
+			return "", fmt.Errorf("SOCKS4 request field too long")
+		}
+		field = append(field, b)
+	}
+}
+
+// writeSOCKS4Reply writes a reply; SOCKS4 clients ignore the address
+func writeSOCKS4Reply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{0x00, rep, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// serveAuto detects the client's protocol from its first byte: SOCKS
+// requests start with the version, anything else is taken as HTTP
+func serveAuto(conn net.Conn, reader *bufio.Reader, dial DialFunc, packets PacketFunc) error {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return fmt.Errorf("failed to read client request: %v", err)
+	}
+
+	switch first[0] {
+	case socks5Version:
+		return serveSOCKS5(conn, reader, dial, packets)
+	case socks4Version:
+		return serveSOCKS4(conn, reader, dial)
+	default:
+		return serveHTTPProxy(conn, reader, dial)
+	}
+}
+
+// serveHTTPProxy handles a single HTTP proxy client connection
+func serveHTTPProxy(conn net.Conn, reader *bufio.Reader, dial DialFunc) error {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read HTTP request: %v", err)
+	}
+
+	if req.Method == http.MethodConnect {
+		if _, _, err := net.SplitHostPort(req.Host); err != nil {
+			io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\n\r\n")
+			return fmt.Errorf("invalid CONNECT target %q: %v", req.Host, err)
+		}
+		remote, err := dial("tcp", req.Host)
+		if err != nil {
+			writeHTTPDialError(conn, err)
+			return fmt.Errorf("failed to dial %s: %v", req.Host, err)
+		}
+		defer remote.Close()
+
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			return err
+		}
+
+		relay(&bufferedConn{Conn: conn, reader: reader}, remote)
+		return nil
+	}
+
+	// Plain HTTP request: forward it and relay the rest of the connection.
+	// Proxy requests must use absolute-form; anything else would make us
+	// dial our own host.
+	if req.URL.Hostname() == "" {
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\n\r\n")
+		return fmt.Errorf("HTTP proxy request without target host: %s", req.RequestURI)
+	}
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		host = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+
+	remote, err := dial("tcp", host)
+	if err != nil {
+		writeHTTPDialError(conn, err)
+		return fmt.Errorf("failed to dial %s: %v", host, err)
+	}
+	defer remote.Close()
+
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.RequestURI = ""
+	if err := req.Write(remote); err != nil {
+		return fmt.Errorf("failed to forward request: %v", err)
+	}
+
+	relay(&bufferedConn{Conn: conn, reader: reader}, remote)
+	return nil
+}
+
+// writeHTTPDialError tells an HTTP proxy client the target could not be
+// reached, or that the memory budget turned the connection away
+func writeHTTPDialError(w io.Writer, err error) {
+	var budgetErr *MemoryBudgetError
+	if errors.As(err, &budgetErr) {
+		fmt.Fprintf(w, "HTTP/1.1 503 Service Unavailable\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s\n",
+			len(budgetErr.Error())+1, budgetErr.Error())
+		return
+	}
+	io.WriteString(w, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+}
+
+// relay copies data in both directions until either side is closed, with
+// relay buffers of the configured size
+func relay(local, remote net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		buf := getBuffer()
+		defer putBuffer(buf)
+		io.CopyBuffer(remote, local, *buf)
+		closeWrite(remote)
+	}()
+
+	go func() {
+		defer wg.Done()
+		buf := getBuffer()
+		defer putBuffer(buf)
+		io.CopyBuffer(local, remote, *buf)
+		closeWrite(local)
+	}()
+
+	wg.Wait()
+}
+
+// closeWrite half-closes the connection when supported
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// bufferedConn is a net.Conn that drains a bufio.Reader before the socket
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+// handleInbound serves a local client connection using the configured proxy type
+func handleInbound(conn net.Conn, proxy config.ProxyType, dial DialFunc) error {
+	return handleInboundUDP(conn, proxy, dial, nil)
+}
+
+// handleInboundUDP is handleInbound for tunnels that relay UDP, which SOCKS5
+// clients reach with UDP ASSOCIATE
+func handleInboundUDP(conn net.Conn, proxy config.ProxyType, dial DialFunc, packets PacketFunc) error {
+	defer crash.Recover("proxy connection")
+
+	mem, err := admitConnection(string(proxy), conn.RemoteAddr())
+	if err != nil {
+		rejectInbound(conn, proxy, err)
+		return err
+	}
+	defer mem.release()
+
+	reader := bufio.NewReaderSize(conn, mem.readerSize)
+	return serveInbound(conn, reader, proxy, mem.trackDial(mitmDial(qosDial(dial))), packets)
+}
+
+// rejectInbound answers a client in its own protocol with err, so it sees
+// why rather than a reset connection
+func rejectInbound(conn net.Conn, proxy config.ProxyType, err error) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	refuse := func(string, string) (net.Conn, error) { return nil, err }
+	serveInbound(conn, bufio.NewReaderSize(conn, 512), proxy, refuse, nil)
+}
+
+// serveInbound serves a client connection with the proxy protocol
+func serveInbound(conn net.Conn, reader *bufio.Reader, proxy config.ProxyType, dial DialFunc, packets PacketFunc) error {
+	switch proxy {
+	case config.ProxyHTTP, config.ProxyHTTPS:
+		return serveHTTPProxy(conn, reader, dial)
+	case config.ProxySOCKS4:
+		return serveSOCKS4(conn, reader, dial)
+	case config.ProxyAuto:
+		return serveAuto(conn, reader, dial, packets)
+	default:
+		return serveSOCKS5(conn, reader, dial, packets)
+	}
+}
+
+// dialLocalProxy opens a connection to addr through a local proxy port,
+// speaking HTTP CONNECT or SOCKS5 to it
+func dialLocalProxy(proxy config.ProxyType, port int, addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	reader := bufio.NewReader(conn)
+	if proxy == config.ProxyHTTP || proxy == config.ProxyHTTPS {
+		err = httpConnect(conn, reader, addr)
+	} else {
+		err = socks5Connect(conn, reader, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// httpConnect asks an HTTP proxy for a tunnel to addr
+func httpConnect(conn net.Conn, reader *bufio.Reader, addr string) error {
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return fmt.Errorf("failed to read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+	return nil
+}
+
+// socks5Connect asks a SOCKS5 proxy for a connection to addr
+func socks5Connect(conn net.Conn, reader *bufio.Reader, addr string) error {
+	target, err := socksAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, 1, socks5AuthNone}); err != nil {
+		return err
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(reader, method); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 method: %v", err)
+	}
+	if method[0] != socks5Version || method[1] != socks5AuthNone {
+		return fmt.Errorf("SOCKS5 proxy requires authentication")
+	}
+
+	request := append([]byte{socks5Version, socks5CmdConnect, 0x00}, target...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 reply: %v", err)
+	}
+	if header[1] != socks5RepSuccess {
+		return fmt.Errorf("SOCKS5 proxy refused %s: reply %d", addr, header[1])
+	}
+
+	// Skip the bound address
+	var skip int
+	switch header[3] {
+	case socks5AtypIPv4:
+		skip = net.IPv4len
+	case socks5AtypIPv6:
+		skip = net.IPv6len
+	case socks5AtypDomain:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		skip = int(length)
+	default:
+		return errAddrTypeUnsupported
+	}
+	_, err = reader.Discard(skip + 2)
+	return err
+}
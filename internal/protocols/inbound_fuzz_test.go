@@ -0,0 +1,106 @@
+package protocols
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+// fuzzConn is a client connection that sends a fixed request and
+// discards whatever the server writes back
+type fuzzConn struct {
+	io.Reader
+}
+
+func (c fuzzConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c fuzzConn) Close() error                       { return nil }
+func (c fuzzConn) LocalAddr() net.Addr                { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080} }
+func (c fuzzConn) RemoteAddr() net.Addr               { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000} }
+func (c fuzzConn) SetDeadline(t time.Time) error      { return nil }
+func (c fuzzConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c fuzzConn) SetWriteDeadline(t time.Time) error { return nil }
+
+var fuzzProxies = []config.ProxyType{config.ProxySOCKS5, config.ProxySOCKS4, config.ProxyHTTP, config.ProxyAuto}
+
+var errFuzzDial = errors.New("dial refused by fuzz test")
+
+// FuzzServeInbound feeds arbitrary client requests to every inbound
+// protocol. A request may only lead to a single dial of a well-formed
+// host:port.
+func FuzzServeInbound(f *testing.F) {
+	seeds := [][]byte{
+		// SOCKS5 CONNECT to an IPv4 address, a domain and an IPv6 address
+		{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x00, 0x50},
+		append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, 11}, append([]byte("example.com"), 0x01, 0xbb)...),
+		append([]byte{0x05, 0x02, 0x02, 0x00, 0x05, 0x01, 0x00, 0x04}, append(net.ParseIP("2001:db8::1"), 0x00, 0x16)...),
+		// SOCKS5 UDP ASSOCIATE, unsupported address type, no acceptable method
+		{0x05, 0x01, 0x00, 0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+		{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x09},
+		{0x05, 0x01, 0x02},
+		// SOCKS4 and SOCKS4a
+		append([]byte{0x04, 0x01, 0x00, 0x50, 10, 0, 0, 1}, []byte("user\x00")...),
+		append([]byte{0x04, 0x01, 0x01, 0xbb, 0, 0, 0, 1}, []byte("\x00example.com\x00")...),
+		// HTTP CONNECT and absolute-form requests
+		[]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"),
+		[]byte("CONNECT example.com HTTP/1.1\r\n\r\n"),
+		[]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nProxy-Connection: keep-alive\r\n\r\n"),
+		[]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"),
+		{},
+	}
+	for _, seed := range seeds {
+		for i := range fuzzProxies {
+			f.Add(uint8(i), seed)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, proxy uint8, data []byte) {
+		dials := 0
+		dial := func(network, addr string) (net.Conn, error) {
+			dials++
+			if network != "tcp" {
+				t.Fatalf("dialed network %q", network)
+			}
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				t.Fatalf("dialed malformed address %q: %v", addr, err)
+			}
+			if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+				t.Fatalf("dialed invalid port in %q", addr)
+			}
+			return nil, errFuzzDial
+		}
+
+		conn := fuzzConn{Reader: bytes.NewReader(data)}
+		serveInbound(conn, bufio.NewReader(conn), fuzzProxies[int(proxy)%len(fuzzProxies)], dial, nil)
+		if dials > 1 {
+			t.Fatalf("one request dialed %d times", dials)
+		}
+	})
+}
+
+// FuzzReadSOCKS5Request checks the SOCKS5 request parser on its own,
+// where the fuzzer reaches the address types quickly
+func FuzzReadSOCKS5Request(f *testing.F) {
+	f.Add([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x04, 0x38})
+	f.Add(append([]byte{0x05, 0x01, 0x00, 0x03, 9}, append([]byte("localhost"), 0x00, 0x50)...))
+	f.Add(append([]byte{0x05, 0x01, 0x00, 0x04}, append(net.IPv6loopback, 0x00, 0x50)...))
+	f.Add([]byte{0x05, 0x01, 0x00, 0x03, 0})
+	f.Add([]byte{0x04, 0x01, 0x00, 0x01})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		target, _, err := readSOCKS5Request(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return
+		}
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			t.Fatalf("parsed malformed target %q: %v", target, err)
+		}
+	})
+}
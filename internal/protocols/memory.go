@@ -0,0 +1,217 @@
+package protocols
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+// maxReaderSize caps the read buffer for proxy handshakes; requests
+// longer than it are read in pieces
+const maxReaderSize = 4 << 10
+
+// memory accounts for the buffers of proxied connections and enforces the
+// memory budget. Settings changed by configureMemory apply to new
+// connections; open ones keep their reservation until they close.
+var memory = &memoryAccount{
+	bufferSize: config.DefaultBufferSize,
+	conns:      make(map[uint64]*connMemory),
+}
+
+// memoryAccount is the memory reserved by open connections
+type memoryAccount struct {
+	mu         sync.Mutex
+	bufferSize int
+	budget     int64 // Zero for none
+	inUse      int64
+	peak       int64
+	rejected   uint64
+	nextID     uint64
+	conns      map[uint64]*connMemory
+	buffers    sync.Pool // *[]byte; buffers of an old size are dropped
+}
+
+// connMemory is a connection's reservation
+type connMemory struct {
+	id         uint64
+	listener   string
+	client     string
+	target     string // Set once the client names it; guarded by memory.mu
+	bytes      int64
+	readerSize int
+	since      time.Time
+}
+
+// MemoryStats is the memory held by proxied connections
+type MemoryStats struct {
+	BufferSize  int                `json:"buffer_size"`
+	Budget      int64              `json:"budget,omitempty"` // Zero for none
+	InUse       int64              `json:"in_use"`
+	Peak        int64              `json:"peak"`
+	Connections int                `json:"connections"`
+	Rejected    uint64             `json:"rejected"`    // Connections turned away by the budget
+	HeapInUse   uint64             `json:"heap_in_use"` // The whole process, for comparison
+	PerConn     []ConnectionMemory `json:"per_connection,omitempty"`
+}
+
+// ConnectionMemory is the memory one proxied connection holds
+type ConnectionMemory struct {
+	ID       uint64    `json:"id"`
+	Listener string    `json:"listener"` // Proxy type, "shadowsocks" or "remote_forward"
+	Client   string    `json:"client"`
+	Target   string    `json:"target,omitempty"`
+	Bytes    int64     `json:"bytes"`
+	Since    time.Time `json:"since"`
+}
+
+// MemoryBudgetError rejects a connection the memory budget has no room for
+type MemoryBudgetError struct {
+	Budget int64
+	InUse  int64
+	Need   int64
+}
+
+func (e *MemoryBudgetError) Error() string {
+	return fmt.Sprintf("memory budget exhausted: %s of %s in use and a connection needs %s, rejecting new connections until some close",
+		formatSize(e.InUse), formatSize(e.Budget), formatSize(e.Need))
+}
+
+// configureMemory applies the buffer size and budget of cfg
+func configureMemory(cfg *config.Config) {
+	bufferSize, budget, err := cfg.Memory.Sizes()
+	if err != nil {
+		log.Printf("Memory settings ignored: %v", err)
+		bufferSize, budget = config.DefaultBufferSize, 0
+	}
+
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	memory.bufferSize = bufferSize
+	memory.budget = budget
+}
+
+// admitConnection reserves memory for a connection from client, or
+// returns a *MemoryBudgetError when the budget has no room for it
+func admitConnection(listener string, client net.Addr) (*connMemory, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	readerSize := min(memory.bufferSize, maxReaderSize)
+	need := 2*int64(memory.bufferSize) + int64(readerSize)
+	if memory.budget > 0 && memory.inUse+need > memory.budget {
+		memory.rejected++
+		return nil, &MemoryBudgetError{Budget: memory.budget, InUse: memory.inUse, Need: need}
+	}
+
+	memory.nextID++
+	cm := &connMemory{
+		id:         memory.nextID,
+		listener:   listener,
+		bytes:      need,
+		readerSize: readerSize,
+		since:      time.Now(),
+	}
+	if client != nil {
+		cm.client = client.String()
+	}
+	memory.conns[cm.id] = cm
+	memory.inUse += need
+	memory.peak = max(memory.peak, memory.inUse)
+	return cm, nil
+}
+
+// release returns the connection's reservation
+func (cm *connMemory) release() {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if _, ok := memory.conns[cm.id]; ok {
+		delete(memory.conns, cm.id)
+		memory.inUse -= cm.bytes
+	}
+}
+
+// trackDial records the target the client asks for
+func (cm *connMemory) trackDial(dial DialFunc) DialFunc {
+	return func(network, addr string) (net.Conn, error) {
+		memory.mu.Lock()
+		cm.target = addr
+		memory.mu.Unlock()
+		return dial(network, addr)
+	}
+}
+
+// getBuffer returns a relay buffer of the configured size
+func getBuffer() *[]byte {
+	memory.mu.Lock()
+	size := memory.bufferSize
+	memory.mu.Unlock()
+
+	if buf, ok := memory.buffers.Get().(*[]byte); ok && len(*buf) == size {
+		return buf
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+// putBuffer returns a relay buffer for reuse
+func putBuffer(buf *[]byte) {
+	memory.buffers.Put(buf)
+}
+
+// GetMemoryStats returns the memory held by proxied connections, largest
+// and oldest first
+func GetMemoryStats() MemoryStats {
+	var runtimeStats runtime.MemStats
+	runtime.ReadMemStats(&runtimeStats)
+
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	stats := MemoryStats{
+		BufferSize:  memory.bufferSize,
+		Budget:      memory.budget,
+		InUse:       memory.inUse,
+		Peak:        memory.peak,
+		Connections: len(memory.conns),
+		Rejected:    memory.rejected,
+		HeapInUse:   runtimeStats.HeapInuse,
+	}
+	for _, cm := range memory.conns {
+		stats.PerConn = append(stats.PerConn, ConnectionMemory{
+			ID:       cm.id,
+			Listener: cm.listener,
+			Client:   cm.client,
+			Target:   cm.target,
+			Bytes:    cm.bytes,
+			Since:    cm.since,
+		})
+	}
+	sort.Slice(stats.PerConn, func(i, j int) bool {
+		a, b := stats.PerConn[i], stats.PerConn[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Since.Before(b.Since)
+	})
+	return stats
+}
+
+// formatSize formats a byte count as KB, MB or GB
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
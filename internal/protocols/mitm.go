@@ -0,0 +1,210 @@
+package protocols
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/mitm"
+)
+
+// mitmState is the HTTPS interceptor in force, nil when interception is
+// disabled
+var mitmState atomic.Pointer[interceptor]
+
+// interceptor decrypts connections to the configured domains so requests
+// can be logged and matched against url rules
+type interceptor struct {
+	config    config.MITMConfig
+	authority *mitm.Authority
+	rules     []config.RoutingRule // url rules, in order
+}
+
+// configureMITM installs the HTTPS interceptor when enabled, creating the
+// local CA on first use
+func configureMITM(cfg *config.Config) {
+	if !cfg.MITM.Enabled {
+		mitmState.Store(nil)
+		return
+	}
+
+	authority, created, err := mitm.LoadOrCreate(cfg.MITM.CADir, cfg.MITM.Domains)
+	if err != nil {
+		log.Printf("HTTPS interception disabled: %v", err)
+		mitmState.Store(nil)
+		return
+	}
+
+	ic := &interceptor{config: cfg.MITM, authority: authority}
+	for _, rule := range cfg.Routing {
+		if rule.Type == "url" {
+			ic.rules = append(ic.rules, rule)
+		}
+	}
+
+	log.Printf("⚠️ DEBUGGING: HTTPS interception is enabled for %s", strings.Join(cfg.MITM.Domains, ", "))
+	if created {
+		log.Printf("Created MITM CA %s (SHA-256 %s); run `tunnel mitm-ca` for how to trust it",
+			authority.CertPath(), authority.Fingerprint())
+	}
+	mitmState.Store(ic)
+}
+
+// mitmDial wraps dial so connections to intercepted domains are decrypted.
+// The connection handed back is one end of a pipe; the interceptor serves
+// the other end and talks to the real server over the dialed connection.
+func mitmDial(dial DialFunc) DialFunc {
+	ic := mitmState.Load()
+	if ic == nil {
+		return dial
+	}
+
+	return func(network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || !ic.config.Intercepts(host) {
+			return dial(network, addr)
+		}
+
+		remote, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		local, inner := net.Pipe()
+		go ic.serve(inner, remote, host)
+		return local, nil
+	}
+}
+
+// serve decrypts one client connection; anything that is not TLS is
+// relayed unchanged
+func (ic *interceptor) serve(local, remote net.Conn, host string) {
+	defer local.Close()
+	defer remote.Close()
+
+	reader := bufio.NewReader(local)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] != tlsRecordHandshake {
+		relay(&bufferedConn{Conn: local, reader: reader}, remote)
+		return
+	}
+
+	clientTLS := tls.Server(&bufferedConn{Conn: local, reader: reader}, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+			return ic.authority.Certificate(name)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+	if err := clientTLS.Handshake(); err != nil {
+		log.Printf("MITM handshake with client for %s failed (is the CA trusted?): %v", host, err)
+		return
+	}
+
+	serverName := clientTLS.ConnectionState().ServerName
+	if serverName == "" {
+		serverName = host
+	}
+	serverTLS := tls.Client(remote, &tls.Config{ServerName: serverName, NextProtos: []string{"http/1.1"}})
+	remote.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := serverTLS.Handshake(); err != nil {
+		log.Printf("MITM handshake with %s failed: %v", serverName, err)
+		return
+	}
+	remote.SetDeadline(time.Time{})
+
+	ic.proxyHTTP(clientTLS, serverTLS)
+}
+
+// proxyHTTP forwards HTTP/1.1 requests one at a time, logging each and
+// answering blocked ones locally
+func (ic *interceptor) proxyHTTP(client, server net.Conn) {
+	clientReader := bufio.NewReader(client)
+	serverReader := bufio.NewReader(server)
+
+	for {
+		req, err := http.ReadRequest(clientReader)
+		if err != nil {
+			return
+		}
+		url := "https://" + req.Host + req.URL.RequestURI()
+
+		if rule := ic.match(url); rule != nil && rule.Action == "block" {
+			log.Printf("MITM %s %s -> blocked by url rule %s", req.Method, url, rule.Pattern)
+			io.Copy(io.Discard, req.Body)
+			if err := writeBlocked(client, req); err != nil || req.Close {
+				return
+			}
+			continue
+		}
+
+		start := time.Now()
+		if err := req.Write(server); err != nil {
+			log.Printf("MITM %s %s -> %v", req.Method, url, err)
+			return
+		}
+		resp, err := http.ReadResponse(serverReader, req)
+		if err != nil {
+			log.Printf("MITM %s %s -> %v", req.Method, url, err)
+			return
+		}
+		log.Printf("MITM %s %s -> %d (%v)", req.Method, url, resp.StatusCode, time.Since(start).Round(time.Millisecond))
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// WebSocket and other upgrades: hand over the raw streams
+			if err := resp.Write(client); err != nil {
+				return
+			}
+			relay(&bufferedConn{Conn: client, reader: clientReader}, &bufferedConn{Conn: server, reader: serverReader})
+			return
+		}
+
+		// Bodies without a length end when the server closes
+		closeAfter := resp.Close || req.Close || (resp.ContentLength < 0 && len(resp.TransferEncoding) == 0)
+		err = resp.Write(client)
+		resp.Body.Close()
+		if err != nil || closeAfter {
+			return
+		}
+	}
+}
+
+// match returns the first url rule covering url
+func (ic *interceptor) match(url string) *config.RoutingRule {
+	for i := range ic.rules {
+		if ic.rules[i].MatchesURL(url) {
+			return &ic.rules[i]
+		}
+	}
+	return nil
+}
+
+// writeBlocked answers a request refused by a url rule
+func writeBlocked(w io.Writer, req *http.Request) error {
+	body := fmt.Sprintf("Blocked by url rule: %s\n", req.URL.Path)
+	resp := &http.Response{
+		StatusCode:    http.StatusForbidden,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         req.Close,
+	}
+	return resp.Write(w)
+}
@@ -0,0 +1,166 @@
+package protocols
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+// dialer is implemented by tunnels the mixed port can send connections
+// through
+type dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// Dial opens a connection as the first matching routing rule says:
+// directly, not at all, or through the servers the rule names. Otherwise
+// it goes through the auto-selected tunnel, or else the connected tunnel
+// with the best priority, trying the next on failure.
+func (tm *TunnelManager) Dial(network, addr string) (net.Conn, error) {
+	var target string
+	if rule := tm.route(addr); rule != nil {
+		switch rule.Action {
+		case "direct":
+			return net.DialTimeout(network, addr, 10*time.Second)
+		case "block":
+			return nil, fmt.Errorf("connection to %s blocked by routing rule", addr)
+		}
+		target = rule.Server
+	}
+
+	tm.mu.RLock()
+	selected := tm.selected
+	priorities := make(map[string]int)
+	var names []string
+	candidates := make(map[string]*supervisor)
+	for i := range tm.config.Servers {
+		server := &tm.config.Servers[i]
+		priorities[server.Name] = server.Priority
+
+		sup, exists := tm.supervisors[server.Name]
+		if !exists || (target != "" && !server.MatchesTarget(target)) {
+			continue
+		}
+		if _, ok := sup.tunnel.(dialer); ok {
+			names = append(names, server.Name)
+			candidates[server.Name] = sup
+		}
+	}
+	tm.mu.RUnlock()
+
+	// Priority 1 is the highest; unset priorities go last
+	rank := func(name string) int {
+		if name == selected {
+			return -1
+		}
+		if p := priorities[name]; p > 0 {
+			return p
+		}
+		return int(^uint(0) >> 1)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if ri, rj := rank(names[i]), rank(names[j]); ri != rj {
+			return ri < rj
+		}
+		return names[i] < names[j]
+	})
+
+	lastErr := fmt.Errorf("no connected tunnel available")
+	for _, name := range names {
+		sup := candidates[name]
+		if sup.snapshot().Status != string(StateConnected) {
+			continue
+		}
+
+		conn, err := sup.tunnel.(dialer).Dial(network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = fmt.Errorf("%s: %v", name, err)
+	}
+	return nil, lastErr
+}
+
+// route returns the routing rule with an action that matches addr, if any.
+// URL rules are applied by interception instead.
+func (tm *TunnelManager) route(addr string) *config.RoutingRule {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	cfg := tm.currentConfig()
+	for i := range cfg.Routing {
+		rule := &cfg.Routing[i]
+		if rule.Action == "" || rule.Type == "url" {
+			continue
+		}
+		if rule.Matches(host, port) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// DialTunnel opens a connection through one named tunnel
+func (tm *TunnelManager) DialTunnel(name, network, addr string) (net.Conn, error) {
+	tm.mu.RLock()
+	sup, exists := tm.supervisors[name]
+	tm.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("tunnel %s not found", name)
+	}
+	d, ok := sup.tunnel.(dialer)
+	if !ok {
+		return nil, fmt.Errorf("tunnel %s cannot dial", name)
+	}
+	if sup.snapshot().Status != string(StateConnected) {
+		return nil, fmt.Errorf("tunnel %s is not connected", name)
+	}
+	return d.Dial(network, addr)
+}
+
+// startMixed serves HTTP, SOCKS5 and SOCKS4 on one port, sending every
+// connection through Dial
+func (tm *TunnelManager) startMixed(port int) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("failed to create mixed port listener: %v", err)
+	}
+
+	tm.mu.Lock()
+	tm.mixed = listener
+	ctx := tm.ctx
+	tm.mu.Unlock()
+
+	log.Printf("Mixed proxy started on port %d", port)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return // Context cancelled
+				}
+				log.Printf("Error accepting mixed port connection: %v", err)
+				continue
+			}
+
+			go func() {
+				defer conn.Close()
+				if err := handleInbound(conn, config.ProxyAuto, tm.Dial); err != nil {
+					log.Printf("Mixed port connection error: %v", err)
+				}
+			}()
+		}
+	}()
+
+	return nil
+}
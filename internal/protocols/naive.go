@@ -0,0 +1,237 @@
+package protocols
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+
+	"golang.org/x/net/http2"
+)
+
+// NaiveTunnel implements the Tunnel interface for NaiveProxy-style
+// HTTP/2 CONNECT over TLS, as served by Caddy with the forwardproxy plugin
+type NaiveTunnel struct {
+	server    config.Server
+	dial      DialFunc // Reaches the server; replaced when it is a chain hop
+	transport *http2.Transport
+	listener  net.Listener
+	status    *TunnelStatus
+	mu        sync.RWMutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// NewNaiveTunnel creates a new Naive tunnel
+func NewNaiveTunnel(server config.Server) *NaiveTunnel {
+	return &NaiveTunnel{
+		server: server,
+		dial:   (&net.Dialer{Timeout: server.Timeout}).Dial,
+		status: &TunnelStatus{
+			ServerName: server.Name,
+			Status:     "disconnected",
+		},
+	}
+}
+
+// Start starts the Naive tunnel
+func (t *NaiveTunnel) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	t.status.Status = "connecting"
+	t.status.StartTime = time.Now()
+
+	t.transport = t.newTransport()
+
+	listener, err := listenLocal(t.server)
+	if err != nil {
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+		return fmt.Errorf("failed to create local listener: %v", err)
+	}
+
+	t.listener = listener
+	t.status.Status = "connected"
+	log.Printf("%s proxy started on port %d for %s (naive)", t.server.Proxy, t.server.LocalPort, t.server.Name)
+
+	go t.acceptConnections()
+
+	return nil
+}
+
+// Stop stops the Naive tunnel
+func (t *NaiveTunnel) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cancel != nil {
+		t.cancel()
+	}
+
+	if t.listener != nil {
+		t.listener.Close()
+		t.listener = nil
+	}
+
+	if t.transport != nil {
+		t.transport.CloseIdleConnections()
+	}
+
+	t.status.Status = "disconnected"
+	return nil
+}
+
+// GetStatus returns the current status
+func (t *NaiveTunnel) GetStatus() *TunnelStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	statusCopy := *t.status
+	return &statusCopy
+}
+
+// GetName returns the tunnel name
+func (t *NaiveTunnel) GetName() string {
+	return t.server.Name
+}
+
+// Test measures the TLS handshake time to the fronting server
+func (t *NaiveTunnel) Test() (time.Duration, error) {
+	start := time.Now()
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(t.server.Host, t.server.Port), t.tlsConfig())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	return time.Since(start), nil
+}
+
+// Dial opens a stream to addr through an HTTP/2 CONNECT request
+func (t *NaiveTunnel) Dial(network, addr string) (net.Conn, error) {
+	t.mu.RLock()
+	transport := t.transport
+	ctx := t.ctx
+	t.mu.RUnlock()
+
+	if transport == nil {
+		return nil, fmt.Errorf("tunnel %s is not running", t.server.Name)
+	}
+
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: net.JoinHostPort(t.server.Host, t.server.Port)},
+		Host:   addr,
+		Header: make(http.Header),
+		Body:   pr,
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString(
+		[]byte(t.server.Naive.Username+":"+t.server.Naive.Password)))
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		pw.Close()
+		return nil, fmt.Errorf("CONNECT to %s failed: %v", addr, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		pw.Close()
+		return nil, fmt.Errorf("CONNECT to %s rejected: %s", addr, resp.Status)
+	}
+
+	return &h2Conn{reader: resp.Body, writer: pw, addr: addr}, nil
+}
+
+// acceptConnections accepts and handles incoming connections
+func (t *NaiveTunnel) acceptConnections() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if t.ctx.Err() != nil {
+				return // Context cancelled
+			}
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := handleInbound(conn, t.server.Proxy, t.Dial); err != nil {
+				log.Printf("Connection error for %s: %v", t.server.Name, err)
+			}
+		}()
+	}
+}
+
+// newTransport creates the HTTP/2 transport CONNECT streams share
+func (t *NaiveTunnel) newTransport() *http2.Transport {
+	return &http2.Transport{
+		TLSClientConfig: t.tlsConfig(),
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := t.dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return tlsHandshake(wrapFragment(t.server, conn), cfg, t.server.Timeout)
+		},
+	}
+}
+
+func (t *NaiveTunnel) tlsConfig() *tls.Config {
+	serverName := t.server.Host
+	if t.server.Naive != nil && t.server.Naive.SNI != "" {
+		serverName = t.server.Naive.SNI
+	}
+	return &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         []string{"h2"},
+		InsecureSkipVerify: t.server.InsecureSkipVerify,
+	}
+}
+
+// h2Conn adapts an HTTP/2 CONNECT stream to net.Conn
+type h2Conn struct {
+	reader io.ReadCloser
+	writer *io.PipeWriter
+	addr   string
+}
+
+func (c *h2Conn) Read(p []byte) (int, error)  { return c.reader.Read(p) }
+func (c *h2Conn) Write(p []byte) (int, error) { return c.writer.Write(p) }
+
+func (c *h2Conn) Close() error {
+	c.writer.Close()
+	return c.reader.Close()
+}
+
+func (c *h2Conn) CloseWrite() error {
+	return c.writer.Close()
+}
+
+func (c *h2Conn) LocalAddr() net.Addr                { return h2Addr("local") }
+func (c *h2Conn) RemoteAddr() net.Addr               { return h2Addr(c.addr) }
+func (c *h2Conn) SetDeadline(t time.Time) error      { return nil }
+func (c *h2Conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *h2Conn) SetWriteDeadline(t time.Time) error { return nil }
+
+type h2Addr string
+
+func (a h2Addr) Network() string { return "h2" }
+func (a h2Addr) String() string  { return string(a) }
@@ -0,0 +1,68 @@
+package protocols
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+	"gitlab.com/yawning/obfs4.git/transports/base"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4"
+)
+
+// obfs4Obfuscator runs the obfs4 pluggable transport over the connection,
+// so it works with tunnel obfs-server and with any obfs4proxy or lyrebird
+// bridge. The stream looks like uniformly random bytes, and without the
+// bridge's cert a prober cannot get the server to answer.
+type obfs4Obfuscator struct {
+	factory base.ClientFactory
+	args    *pt.Args
+}
+
+func newObfs4Obfuscator(cert string, iatMode int) (*obfs4Obfuscator, error) {
+	factory, err := (&obfs4.Transport{}).ClientFactory("")
+	if err != nil {
+		return nil, err
+	}
+	args := &pt.Args{}
+	args.Add("cert", cert)
+	args.Add("iat-mode", strconv.Itoa(iatMode))
+
+	// Parsed once here to report a bad cert with the config, and again
+	// for each connection, which needs a fresh session key
+	if _, err := factory.ParseArgs(args); err != nil {
+		return nil, fmt.Errorf("invalid obfs4 settings: %v", err)
+	}
+	return &obfs4Obfuscator{factory: factory, args: args}, nil
+}
+
+func (o *obfs4Obfuscator) Name() string { return "obfs4" }
+
+func (o *obfs4Obfuscator) WrapConn(conn net.Conn) (net.Conn, error) {
+	args, err := o.factory.ParseArgs(o.args)
+	if err != nil {
+		return nil, err
+	}
+	// The connection is already open; the transport only handshakes over it
+	established := func(string, string) (net.Conn, error) { return conn, nil }
+	return o.factory.Dial("tcp", conn.RemoteAddr().String(), established, args)
+}
+
+// newObfs4ServerFactory loads the bridge identity from stateDir, creating
+// it on first use
+func newObfs4ServerFactory(stateDir string, iatMode int) (base.ServerFactory, error) {
+	if stateDir == "" {
+		return nil, fmt.Errorf("obfs4 obfuscation requires a state directory")
+	}
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create obfs4 state directory: %v", err)
+	}
+	args := &pt.Args{}
+	args.Add("iat-mode", strconv.Itoa(iatMode))
+	factory, err := (&obfs4.Transport{}).ServerFactory(stateDir, args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load obfs4 state: %v", err)
+	}
+	return factory, nil
+}
@@ -0,0 +1,274 @@
+package protocols
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+// Obfuscator wraps a raw TCP connection in an obfuscation layer before the
+// tunnel protocol handshake runs over it
+type Obfuscator interface {
+	Name() string
+	WrapConn(conn net.Conn) (net.Conn, error)
+}
+
+// NewObfuscator creates an obfuscator from the server configuration.
+// It returns nil when no obfuscation is configured.
+func NewObfuscator(server config.Server) (Obfuscator, error) {
+	cfg := server.Obfuscation
+	if cfg == nil || cfg.Type == "" || cfg.Type == "none" {
+		return nil, nil
+	}
+
+	switch cfg.Type {
+	case "xor":
+		if cfg.Key == "" {
+			return nil, fmt.Errorf("xor obfuscation requires a key")
+		}
+		return &xorObfuscator{key: sha256.Sum256([]byte(cfg.Key))}, nil
+	case "tls":
+		// The certificate is checked against the name the server was
+		// configured with, not the address it resolved to
+		serverName := cfg.SNI
+		if serverName == "" {
+			serverName = server.Host
+		}
+		return &tlsObfuscator{serverName: serverName, insecure: server.InsecureSkipVerify}, nil
+	case "obfs4":
+		return newObfs4Obfuscator(cfg.Cert, cfg.IATMode)
+	default:
+		return nil, fmt.Errorf("unsupported obfuscation type: %s", cfg.Type)
+	}
+}
+
+// dialObfuscated dials the server over TCP and applies the configured obfuscation
+func dialObfuscated(server config.Server, timeout time.Duration) (net.Conn, error) {
+	obfuscator, err := NewObfuscator(server)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(server.Host, server.Port), timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapObfuscated(obfuscator, wrapFragment(server, conn))
+}
+
+// wrapObfuscated applies an obfuscator, which may be nil, to an established
+// connection, closing it on failure
+func wrapObfuscated(obfuscator Obfuscator, conn net.Conn) (net.Conn, error) {
+	if obfuscator == nil {
+		return conn, nil
+	}
+
+	wrapped, err := obfuscator.WrapConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s obfuscation failed: %v", obfuscator.Name(), err)
+	}
+
+	return wrapped, nil
+}
+
+// xorObfuscator scrambles the stream with an AES-CTR keystream derived from
+// a shared key. Each direction starts with a random IV so identical payloads
+// never produce identical bytes on the wire.
+type xorObfuscator struct {
+	key [32]byte
+}
+
+func (o *xorObfuscator) Name() string { return "xor" }
+
+func (o *xorObfuscator) WrapConn(conn net.Conn) (net.Conn, error) {
+	block, err := aes.NewCipher(o.key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(iv); err != nil {
+		return nil, err
+	}
+
+	return &xorConn{
+		Conn:    conn,
+		block:   block,
+		encrypt: cipher.NewCTR(block, iv),
+	}, nil
+}
+
+// xorConn applies the keystream to all traffic; the peer's IV is read lazily
+// on the first Read so the handshake does not require a round trip
+type xorConn struct {
+	net.Conn
+	block   cipher.Block
+	encrypt cipher.Stream
+	decrypt cipher.Stream
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+}
+
+func (c *xorConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if c.decrypt == nil {
+		iv := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(c.Conn, iv); err != nil {
+			return 0, err
+		}
+		c.decrypt = cipher.NewCTR(c.block, iv)
+	}
+
+	n, err := c.Conn.Read(p)
+	c.decrypt.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+func (c *xorConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	buf := make([]byte, len(p))
+	c.encrypt.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
+
+// tlsObfuscator wraps the stream in an outer TLS session (tls-in-tls when the
+// inner protocol is itself TLS based) so it looks like ordinary HTTPS
+type tlsObfuscator struct {
+	serverName string
+	insecure   bool
+	roots      *x509.CertPool // The system roots when nil
+}
+
+func (o *tlsObfuscator) Name() string { return "tls" }
+
+func (o *tlsObfuscator) WrapConn(conn net.Conn) (net.Conn, error) {
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         o.serverName,
+		RootCAs:            o.roots,
+		InsecureSkipVerify: o.insecure,
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// ObfuscationListener is the server side of an obfuscation layer: it
+// accepts obfuscated connections, unwraps them and forwards the inner
+// stream to a local service such as sshd or a Trojan server
+type ObfuscationListener struct {
+	wrap   func(net.Conn) (net.Conn, error)
+	target string
+	client config.ObfuscationConfig // What clients configure, for obfs4
+}
+
+// NewObfuscationListener creates the server side of an obfuscation layer.
+// tls needs the certificate and key the clients will verify; xor needs the
+// clients' key. obfs4 keeps its identity in stateDir, in obfs4proxy's
+// format, and creates one there on first use.
+func NewObfuscationListener(cfg config.ObfuscationConfig, certFile, keyFile, stateDir, target string) (*ObfuscationListener, error) {
+	l := &ObfuscationListener{target: target, client: config.ObfuscationConfig{Type: cfg.Type}}
+	switch cfg.Type {
+	case "xor":
+		if cfg.Key == "" {
+			return nil, fmt.Errorf("xor obfuscation requires a key")
+		}
+		// The keystream runs the same way in both directions, so the
+		// client's wrapper unwraps on the server too
+		l.wrap = (&xorObfuscator{key: sha256.Sum256([]byte(cfg.Key))}).WrapConn
+	case "tls":
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("tls obfuscation requires a certificate and key")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate: %v", err)
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+		l.wrap = func(conn net.Conn) (net.Conn, error) {
+			tlsConn := tls.Server(conn, tlsConfig)
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			if err := tlsConn.Handshake(); err != nil {
+				return nil, err
+			}
+			conn.SetDeadline(time.Time{})
+			return tlsConn, nil
+		}
+	case "obfs4":
+		factory, err := newObfs4ServerFactory(stateDir, cfg.IATMode)
+		if err != nil {
+			return nil, err
+		}
+		l.client.Cert, _ = factory.Args().Get("cert")
+		l.client.IATMode = cfg.IATMode
+		l.wrap = func(conn net.Conn) (net.Conn, error) {
+			conn.SetDeadline(time.Now().Add(30 * time.Second))
+			inner, err := factory.WrapConn(conn)
+			if err != nil {
+				return nil, err
+			}
+			conn.SetDeadline(time.Time{})
+			return inner, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported obfuscation type: %s (supported: xor, tls, obfs4)", cfg.Type)
+	}
+	return l, nil
+}
+
+// ClientConfig returns the obfuscation block clients need, without the
+// xor key they already share
+func (l *ObfuscationListener) ClientConfig() config.ObfuscationConfig {
+	return l.client
+}
+
+// Serve accepts connections until the listener is closed
+func (l *ObfuscationListener) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go l.handle(conn)
+	}
+}
+
+func (l *ObfuscationListener) handle(conn net.Conn) {
+	defer conn.Close()
+
+	inner, err := l.wrap(conn)
+	if err != nil {
+		log.Printf("Obfuscation handshake from %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	remote, err := net.DialTimeout("tcp", l.target, 10*time.Second)
+	if err != nil {
+		log.Printf("Failed to reach %s: %v", l.target, err)
+		return
+	}
+	defer remote.Close()
+
+	relay(inner, remote)
+}
@@ -0,0 +1,315 @@
+package protocols
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+// echoServer answers every connection with what it reads
+func echoServer(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// writeTestCert writes a self-signed certificate for host, an IP address
+// or a hostname
+func writeTestCert(t *testing.T, host string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestObfuscationRoundTrip(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, "127.0.0.1")
+
+	tests := []struct {
+		name     string
+		obfs     config.ObfuscationConfig
+		insecure bool
+	}{
+		{"xor", config.ObfuscationConfig{Type: "xor", Key: "shared-key"}, false},
+		{"tls", config.ObfuscationConfig{Type: "tls"}, true},
+		{"obfs4", config.ObfuscationConfig{Type: "obfs4"}, false},
+		{"obfs4 paranoid", config.ObfuscationConfig{Type: "obfs4", IATMode: 2}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, err := NewObfuscationListener(tt.obfs, certFile, keyFile, t.TempDir(), echoServer(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go server.Serve(ln)
+
+			host, port, _ := net.SplitHostPort(ln.Addr().String())
+			obfs := tt.obfs
+			if obfs.Type == "obfs4" {
+				obfs.Cert = server.ClientConfig().Cert
+			}
+			conn, err := dialObfuscated(config.Server{
+				Host:               host,
+				Port:               port,
+				Obfuscation:        &obfs,
+				InsecureSkipVerify: tt.insecure,
+			}, 5*time.Second)
+			if err != nil {
+				t.Fatalf("dial failed: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			for _, msg := range []string{"SSH-2.0-test\r\n", "second write"} {
+				if _, err := io.WriteString(conn, msg); err != nil {
+					t.Fatal(err)
+				}
+				buf := make([]byte, len(msg))
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					t.Fatalf("read failed: %v", err)
+				}
+				if string(buf) != msg {
+					t.Fatalf("echo = %q, want %q", buf, msg)
+				}
+			}
+		})
+	}
+}
+
+// TestTLSObfuscationVerifiesHostname checks the outer certificate against
+// the configured host, which resolves to an address the certificate does
+// not name
+func TestTLSObfuscationVerifiesHostname(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, "localhost")
+	server, err := NewObfuscationListener(config.ObfuscationConfig{Type: "tls"}, certFile, keyFile, "", echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go server.Serve(ln)
+
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	tests := []struct {
+		name  string
+		host  string
+		sni   string
+		valid bool
+	}{
+		{"hostname", "localhost", "", true},
+		{"sni overrides host", "127.0.0.1", "localhost", true},
+		{"address", "127.0.0.1", "", false},
+		{"other sni", "localhost", "example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obfuscator, err := NewObfuscator(config.Server{
+				Host:        tt.host,
+				Port:        port,
+				Obfuscation: &config.ObfuscationConfig{Type: "tls", SNI: tt.sni},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			obfuscator.(*tlsObfuscator).roots = roots
+
+			raw, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := wrapObfuscated(obfuscator, raw)
+			if err != nil {
+				if tt.valid {
+					t.Fatalf("handshake failed: %v", err)
+				}
+				return
+			}
+			defer conn.Close()
+			if !tt.valid {
+				t.Fatal("certificate accepted for a name it does not cover")
+			}
+		})
+	}
+}
+
+func TestObfuscationKeyMismatch(t *testing.T) {
+	server, err := NewObfuscationListener(config.ObfuscationConfig{Type: "xor", Key: "server-key"}, "", "", "", echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go server.Serve(ln)
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	conn, err := dialObfuscated(config.Server{
+		Host:        host,
+		Port:        port,
+		Obfuscation: &config.ObfuscationConfig{Type: "xor", Key: "other-key"},
+	}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	msg := "SSH-2.0-test\r\n"
+	io.WriteString(conn, msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err == nil && string(buf) == msg {
+		t.Fatal("a different key read the plaintext back")
+	}
+}
+
+// TestObfs4Identity checks that the bridge keeps its identity across
+// restarts, and that a client with another bridge's cert gets nothing
+func TestObfs4Identity(t *testing.T) {
+	stateDir := t.TempDir()
+	first, err := NewObfuscationListener(config.ObfuscationConfig{Type: "obfs4"}, "", "", stateDir, echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := NewObfuscationListener(config.ObfuscationConfig{Type: "obfs4"}, "", "", stateDir, echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ClientConfig().Cert == "" || first.ClientConfig().Cert != restarted.ClientConfig().Cert {
+		t.Fatalf("cert changed across restarts: %q, %q", first.ClientConfig().Cert, restarted.ClientConfig().Cert)
+	}
+
+	other, err := NewObfuscationListener(config.ObfuscationConfig{Type: "obfs4"}, "", "", t.TempDir(), echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go first.Serve(ln)
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	server := config.Server{
+		Host:        host,
+		Port:        port,
+		Obfuscation: &config.ObfuscationConfig{Type: "obfs4", Cert: other.ClientConfig().Cert},
+	}
+	obfuscator, err := NewObfuscator(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The bridge stays silent, and the client's handshake deadline is a
+	// minute
+	timer := time.AfterFunc(2*time.Second, func() { raw.Close() })
+	defer timer.Stop()
+	if conn, err := wrapObfuscated(obfuscator, raw); err == nil {
+		conn.Close()
+		t.Fatal("handshake succeeded with another bridge's cert")
+	}
+
+	if _, err := NewObfuscator(config.Server{Obfuscation: &config.ObfuscationConfig{Type: "obfs4", Cert: "not-a-cert"}}); err == nil {
+		t.Error("a malformed cert was accepted")
+	}
+}
+
+func TestObfuscationListenerConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		obfs config.ObfuscationConfig
+	}{
+		{"xor without key", config.ObfuscationConfig{Type: "xor"}},
+		{"tls without certificate", config.ObfuscationConfig{Type: "tls"}},
+		{"obfs4 without state directory", config.ObfuscationConfig{Type: "obfs4"}},
+		{"obfs4 with an unknown iat mode", config.ObfuscationConfig{Type: "obfs4", IATMode: 3}},
+		{"unknown type", config.ObfuscationConfig{Type: "meek"}},
+	}
+
+	for _, tt := range tests {
+		stateDir := ""
+		if tt.obfs.IATMode != 0 {
+			stateDir = t.TempDir()
+		}
+		if _, err := NewObfuscationListener(tt.obfs, "", "", stateDir, "127.0.0.1:22"); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package protocols
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/probe"
+)
+
+// openSSHPasswordEnv passes a server's password to the askpass script, so
+// it never appears on a command line
+const openSSHPasswordEnv = "SSH_TUNNEL_PASSWORD"
+
+// OpenSSHTunnel implements the Tunnel interface with the system ssh
+// command. ssh serves a dynamic (SOCKS) forward on a loopback port and the
+// tunnel serves the server's local port through it, so proxy types,
+// bandwidth limits and traffic counters work as with the native engine.
+// When ssh exits the tunnel reports an error and the supervisor restarts
+// it.
+type OpenSSHTunnel struct {
+	server      config.Server
+	cmd         *exec.Cmd
+	exited      chan struct{}
+	askpass     string // Generated askpass script, removed on stop
+	dynamicPort int
+	listener    net.Listener
+	sent        atomic.Uint64
+	received    atomic.Uint64
+	status      *TunnelStatus
+	mu          sync.RWMutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+// NewOpenSSHTunnel creates a tunnel driven by the system ssh command
+func NewOpenSSHTunnel(server config.Server) *OpenSSHTunnel {
+	if server.OpenSSH == nil {
+		server.OpenSSH = &config.OpenSSHConfig{Binary: "ssh"}
+	}
+	return &OpenSSHTunnel{
+		server: server,
+		status: &TunnelStatus{
+			ServerName: server.Name,
+			Status:     "disconnected",
+		},
+	}
+}
+
+// Start runs ssh, waits for its dynamic forward and opens the local port
+func (t *OpenSSHTunnel) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	t.status.Status = "connecting"
+	t.status.StartTime = time.Now()
+
+	if err := t.startLocked(); err != nil {
+		t.stopLocked()
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+		return err
+	}
+
+	t.status.Status = "connected"
+	log.Printf("%s proxy started on port %d for %s (%s)", t.server.Proxy, t.server.LocalPort, t.server.Name, t.server.OpenSSH.Binary)
+
+	go t.acceptConnections(t.ctx, t.listener)
+
+	return nil
+}
+
+func (t *OpenSSHTunnel) startLocked() error {
+	binary := t.server.OpenSSH.Binary
+
+	port, err := freeLoopbackPort()
+	if err != nil {
+		return fmt.Errorf("failed to pick a port for ssh: %v", err)
+	}
+	t.dynamicPort = port
+
+	output := &execOutput{name: t.server.Name}
+	cmd := exec.CommandContext(t.ctx, binary, openSSHArgs(t.server, port)...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.WaitDelay = 2 * time.Second
+	secret := openSSHSecret(t.server)
+	if secret != "" && runtime.GOOS == "windows" {
+		return fmt.Errorf("password and PIN authentication with engine openssh is not supported on Windows, use a key or the agent")
+	}
+	// Without a terminal ssh only shows a security key's touch request
+	// through askpass
+	touch := t.server.HardwareKey != nil && t.server.HardwareKey.Type == config.HardwareKeyFIDO2
+	if secret != "" || (touch && runtime.GOOS != "windows") {
+		if t.askpass, err = writeAskpass(t.server.Name); err != nil {
+			return fmt.Errorf("failed to write askpass script: %v", err)
+		}
+		cmd.Env = append(os.Environ(),
+			openSSHPasswordEnv+"="+secret,
+			"SSH_ASKPASS="+t.askpass,
+			"SSH_ASKPASS_REQUIRE=force",
+		)
+		if os.Getenv("DISPLAY") == "" {
+			// ssh before 8.4 only uses askpass with a display set
+			cmd.Env = append(cmd.Env, "DISPLAY=none")
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s (is OpenSSH installed?): %v", binary, err)
+	}
+	t.cmd = cmd
+
+	exited := make(chan struct{})
+	t.exited = exited
+	ctx := t.ctx
+	go func() {
+		err := cmd.Wait()
+		close(exited)
+		if ctx.Err() != nil {
+			return // Stopped
+		}
+
+		msg := fmt.Sprintf("%s exited", binary)
+		if err != nil {
+			msg = fmt.Sprintf("%s exited: %v", binary, err)
+		}
+		if last := output.lastLine(); last != "" {
+			msg += " (" + last + ")"
+		}
+		log.Printf("%s for %s", msg, t.server.Name)
+
+		t.mu.Lock()
+		t.status.Status = "error"
+		t.status.LastError = msg
+		t.mu.Unlock()
+	}()
+
+	// ssh opens the dynamic forward once authenticated
+	forward := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	deadline := time.Now().Add(t.server.Timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", forward, time.Second)
+		if err == nil {
+			conn.Close()
+			break
+		}
+
+		select {
+		case <-exited:
+			if last := output.lastLine(); last != "" {
+				return fmt.Errorf("%s exited during startup: %s", binary, last)
+			}
+			return fmt.Errorf("%s exited during startup", binary)
+		case <-t.ctx.Done():
+			return t.ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not connect within %v", binary, t.server.Timeout)
+		}
+	}
+
+	listener, err := listenLocal(t.server)
+	if err != nil {
+		return fmt.Errorf("failed to create local listener: %v", err)
+	}
+	t.listener = listener
+	return nil
+}
+
+// openSSHArgs builds the ssh command line for a server with a dynamic
+// forward on port. ssh keeps the first value it sees for an option, so the
+// user's options go before the generated ones.
+func openSSHArgs(server config.Server, port int) []string {
+	args := []string{"-N", "-D", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), "-p", server.Port}
+	if server.OpenSSH.ConfigFile != "" {
+		args = append(args, "-F", server.OpenSSH.ConfigFile)
+	}
+
+	names := make([]string, 0, len(server.OpenSSH.Options))
+	for name := range server.OpenSSH.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "-o", name+"="+server.OpenSSH.Options[name])
+	}
+
+	timeout := int(server.Timeout.Seconds())
+	if timeout < 1 {
+		timeout = 1
+	}
+	args = append(args,
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", "ForwardAgent=no",
+		"-o", "ServerAliveInterval=15",
+		"-o", "ServerAliveCountMax=3",
+		"-o", "ConnectTimeout="+strconv.Itoa(timeout),
+		"-o", "LogLevel=ERROR",
+	)
+	switch {
+	case server.InsecureSkipVerify:
+		args = append(args, "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null")
+	case server.KnownHosts != "":
+		args = append(args, "-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile="+server.KnownHosts)
+	default:
+		args = append(args, "-o", "StrictHostKeyChecking=yes")
+	}
+	if openSSHSecret(server) != "" {
+		args = append(args, "-o", "NumberOfPasswordPrompts=1")
+	} else {
+		args = append(args, "-o", "BatchMode=yes")
+	}
+	if hw := server.HardwareKey; hw != nil && hw.Provider != "" {
+		if hw.Type == config.HardwareKeyPKCS11 {
+			args = append(args, "-o", "PKCS11Provider="+hw.Provider)
+		} else {
+			args = append(args, "-o", "SecurityKeyProvider="+hw.Provider)
+		}
+	}
+	if server.KeyPath != "" {
+		args = append(args, "-i", server.KeyPath, "-o", "IdentitiesOnly=yes")
+	} else if hw := server.HardwareKey; hw != nil && hw.PublicKey != "" {
+		// ssh picks the token's or agent's key matching the public key
+		args = append(args, "-i", hw.PublicKey, "-o", "IdentitiesOnly=yes")
+	}
+
+	return append(args, server.User+"@"+server.Host)
+}
+
+// freeLoopbackPort returns a loopback TCP port that is free right now
+func freeLoopbackPort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// openSSHSecret returns what the askpass script answers ssh's prompt with:
+// the password, or the PIN of a hardware key
+func openSSHSecret(server config.Server) string {
+	if server.HardwareKey != nil {
+		return server.HardwareKey.PIN
+	}
+	return server.Password
+}
+
+// writeAskpass writes a script that prints the password from the
+// environment, for ssh to run instead of prompting on a terminal. When ssh
+// only notifies, as when a security key waits for a touch, the script
+// passes the message on to ssh's output.
+func writeAskpass(name string) (string, error) {
+	dir := filepath.Join(os.TempDir(), "ssh-tunnel-exec")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, strings.NewReplacer("/", "_", string(os.PathSeparator), "_").Replace(name)+"-askpass.sh")
+	script := "#!/bin/sh\n" +
+		"if [ \"$SSH_ASKPASS_PROMPT\" = none ]; then echo \"$1\" >&2; exit 0; fi\n" +
+		"printf '%s\\n' \"$" + openSSHPasswordEnv + "\"\n"
+	if err := os.WriteFile(path, []byte(script), 0700); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// acceptConnections serves the local port through ssh's dynamic forward
+func (t *OpenSSHTunnel) acceptConnections(ctx context.Context, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+			counted := &countedConn{Conn: conn, read: &t.sent, written: &t.received}
+			if err := handleInbound(counted, t.server.Proxy, t.Dial); err != nil {
+				log.Printf("Connection error for %s: %v", t.server.Name, err)
+			}
+		}()
+	}
+}
+
+// Stop stops ssh and closes the local port
+func (t *OpenSSHTunnel) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stopLocked()
+	t.status.Status = "disconnected"
+	return nil
+}
+
+func (t *OpenSSHTunnel) stopLocked() {
+	if t.cancel != nil {
+		t.cancel()
+	}
+
+	if t.listener != nil {
+		t.listener.Close()
+		t.listener = nil
+	}
+
+	// The context kills ssh; wait so the forward port is released
+	if t.exited != nil {
+		<-t.exited
+		t.exited = nil
+	}
+	t.cmd = nil
+	t.dynamicPort = 0
+
+	if t.askpass != "" {
+		os.Remove(t.askpass)
+		t.askpass = ""
+	}
+}
+
+// GetStatus returns the current status
+func (t *OpenSSHTunnel) GetStatus() *TunnelStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	statusCopy := *t.status
+	statusCopy.BytesSent = t.sent.Load()
+	statusCopy.BytesRecv = t.received.Load()
+	return &statusCopy
+}
+
+// GetName returns the tunnel name
+func (t *OpenSSHTunnel) GetName() string {
+	return t.server.Name
+}
+
+// Test measures latency to the server with ICMP echo, or with a TCP
+// connect when ICMP is filtered
+func (t *OpenSSHTunnel) Test() (time.Duration, error) {
+	result, err := probe.Latency(t.server.Host, t.server.Port, probe.Options{})
+	if err != nil {
+		return 0, err
+	}
+	return result.Avg, nil
+}
+
+// Dial opens a connection to addr through ssh's dynamic forward
+func (t *OpenSSHTunnel) Dial(network, addr string) (net.Conn, error) {
+	t.mu.RLock()
+	port := t.dynamicPort
+	t.mu.RUnlock()
+
+	if port == 0 {
+		return nil, fmt.Errorf("ssh tunnel %s is not connected", t.server.Name)
+	}
+	return dialLocalProxy(config.ProxySOCKS5, port, addr, 10*time.Second)
+}
+
+// countedConn adds the bytes read from and written to a connection to
+// counters
+type countedConn struct {
+	net.Conn
+	read    *atomic.Uint64
+	written *atomic.Uint64
+}
+
+func (c *countedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(uint64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(uint64(n))
+	return n, err
+}
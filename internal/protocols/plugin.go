@@ -0,0 +1,133 @@
+package protocols
+
+import (
+	"fmt"
+	"log"
+	"plugin"
+	"sort"
+	"sync"
+
+	"ssh-tunnel/internal/config"
+)
+
+// TunnelFactory creates a tunnel for a server entry whose transport was
+// registered by a plugin
+type TunnelFactory func(server config.Server) (Tunnel, error)
+
+// RegisterFunc registers a transport with the tunnel manager. It is handed
+// to Go plugins, whose RegisterTransports symbol must have the type
+// func(RegisterFunc) error.
+type RegisterFunc func(transport config.TransportType, factory TunnelFactory) error
+
+// pluginSymbol is the symbol looked up in Go plugins
+const pluginSymbol = "RegisterTransports"
+
+// builtinTransports cannot be replaced by plugins
+var builtinTransports = map[config.TransportType]bool{
+	config.TransportSSH: true, config.TransportHysteria: true, config.TransportV2Ray: true,
+	config.TransportWireGuard: true, config.TransportTrojan: true, config.TransportVLESS: true,
+	config.TransportVMess: true, config.TransportTUIC: true, config.TransportNaive: true,
+	config.TransportDNS: true, config.TransportICMP: true, config.TransportSSH3: true,
+}
+
+// transportRegistry holds the transports added by plugins
+var transportRegistry = struct {
+	mu        sync.RWMutex
+	factories map[config.TransportType]TunnelFactory
+}{factories: make(map[config.TransportType]TunnelFactory)}
+
+// RegisterTransport makes a new transport available to createTunnel.
+// Built-in transports and transports that are already registered are
+// rejected.
+func RegisterTransport(transport config.TransportType, factory TunnelFactory) error {
+	if transport == "" || factory == nil {
+		return fmt.Errorf("transport name and factory are required")
+	}
+	if builtinTransports[transport] {
+		return fmt.Errorf("transport %s is built in and cannot be replaced", transport)
+	}
+
+	transportRegistry.mu.Lock()
+	defer transportRegistry.mu.Unlock()
+
+	if _, exists := transportRegistry.factories[transport]; exists {
+		return fmt.Errorf("transport %s is already registered", transport)
+	}
+	transportRegistry.factories[transport] = factory
+	return nil
+}
+
+// RegisteredTransports lists the transports added by plugins
+func RegisteredTransports() []config.TransportType {
+	transportRegistry.mu.RLock()
+	defer transportRegistry.mu.RUnlock()
+
+	transports := make([]config.TransportType, 0, len(transportRegistry.factories))
+	for transport := range transportRegistry.factories {
+		transports = append(transports, transport)
+	}
+	sort.Slice(transports, func(i, j int) bool { return transports[i] < transports[j] })
+	return transports
+}
+
+// lookupTransport returns the plugin factory for a transport
+func lookupTransport(transport config.TransportType) (TunnelFactory, bool) {
+	transportRegistry.mu.RLock()
+	defer transportRegistry.mu.RUnlock()
+
+	factory, ok := transportRegistry.factories[transport]
+	return factory, ok
+}
+
+// LoadPlugins loads the configured Go plugins and registers the transports
+// served by gRPC sidecars. A plugin that fails to load is logged and
+// skipped so the remaining transports keep working.
+func LoadPlugins(plugins []config.PluginConfig) {
+	for _, p := range plugins {
+		var err error
+		if p.Path != "" {
+			err = loadGoPlugin(p.Path)
+		} else {
+			err = registerSidecar(p)
+		}
+		if err != nil {
+			log.Printf("Failed to load plugin %s: %v", p.Name(), err)
+			continue
+		}
+		log.Printf("Loaded plugin %s", p.Name())
+	}
+}
+
+// loadGoPlugin opens a plugin built with -buildmode=plugin against this
+// module and calls its RegisterTransports function
+func loadGoPlugin(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+
+	sym, err := p.Lookup(pluginSymbol)
+	if err != nil {
+		return err
+	}
+
+	register, ok := sym.(func(RegisterFunc) error)
+	if !ok {
+		return fmt.Errorf("%s has type %T, want func(protocols.RegisterFunc) error", pluginSymbol, sym)
+	}
+	return register(RegisterTransport)
+}
+
+// registerSidecar registers every transport served by a sidecar
+func registerSidecar(p config.PluginConfig) error {
+	client := newSidecarClient(p.Sidecar)
+	for _, transport := range p.Transports {
+		factory := func(server config.Server) (Tunnel, error) {
+			return newSidecarTunnel(server, client), nil
+		}
+		if err := RegisterTransport(config.TransportType(transport), factory); err != nil {
+			return err
+		}
+	}
+	return nil
+}
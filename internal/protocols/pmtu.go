@@ -0,0 +1,65 @@
+package protocols
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/platform"
+	"ssh-tunnel/internal/pmtu"
+)
+
+const (
+	// maxPathMTU is the largest path MTU probed for, Ethernet's
+	maxPathMTU = 1500
+
+	// pathMTUTimeout bounds the wait for each probe's reply
+	pathMTUTimeout = 500 * time.Millisecond
+)
+
+// resolvePathMTU returns the configured MTU, or probes the path to the
+// server when none is set. It returns 0 when the MTU stays unknown, e.g.
+// because the server does not answer ICMP echo.
+func resolvePathMTU(server config.Server, configured int) int {
+	if configured > 0 {
+		return configured
+	}
+	if !platform.Supported(platform.PathMTU) {
+		return 0 // Transport defaults, without a failed probe per connect
+	}
+
+	mtu, err := pmtu.Probe(server.Host, maxPathMTU, pathMTUTimeout)
+	if err != nil {
+		log.Printf("Path MTU probe to %s failed, using transport defaults: %v", server.Host, err)
+		return 0
+	}
+	if mtu < maxPathMTU {
+		log.Printf("Path MTU to %s (%s) is %d", server.Host, server.Name, mtu)
+	}
+	return mtu
+}
+
+// withPathMTU resolves the MTU of a QUIC transport before its client config
+// is generated, and fails early when QUIC packets cannot pass the path
+// without fragmentation
+func withPathMTU(server config.Server) (config.Server, error) {
+	var mtu int
+	switch {
+	case server.Transport == config.TransportHysteria && server.Hysteria != nil:
+		hy := *server.Hysteria
+		hy.MTU = resolvePathMTU(server, hy.MTU)
+		server.Hysteria, mtu = &hy, hy.MTU
+	case server.Transport == config.TransportTUIC && server.TUIC != nil:
+		tuic := *server.TUIC
+		tuic.MTU = resolvePathMTU(server, tuic.MTU)
+		server.TUIC, mtu = &tuic, tuic.MTU
+	default:
+		return server, nil
+	}
+
+	if mtu > 0 && mtu < config.QUICMinMTU {
+		return server, fmt.Errorf("path MTU to %s is %d, below the %d bytes QUIC needs", server.Host, mtu, config.QUICMinMTU)
+	}
+	return server, nil
+}
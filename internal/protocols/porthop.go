@@ -0,0 +1,216 @@
+package protocols
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+// hopPacket is a datagram received on one of the hop sockets
+type hopPacket struct {
+	data []byte
+	err  error
+}
+
+// hoppingConn is a net.PacketConn for UDP transports that periodically
+// moves to a new local socket and a random destination port from the
+// server's hopping range. The transport above sees a single stable peer
+// address. The previous socket keeps receiving until the next hop so
+// in-flight replies are not lost.
+type hoppingConn struct {
+	ip       net.IP
+	ports    []int
+	interval time.Duration
+	peer     *net.UDPAddr // Address reported to the transport
+
+	mu           sync.Mutex
+	current      *net.UDPConn
+	previous     *net.UDPConn
+	port         int
+	readDeadline time.Time
+
+	packets chan hopPacket
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// dialPortHopping resolves host and opens the first hop socket
+func dialPortHopping(host string, hop *config.PortHoppingConfig) (*hoppingConn, error) {
+	ports, err := hop.PortList()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+
+	c := &hoppingConn{
+		ip:       addr.IP,
+		ports:    ports,
+		interval: hop.Interval,
+		peer:     &net.UDPAddr{IP: addr.IP, Port: ports[0]},
+		packets:  make(chan hopPacket, 256),
+		closed:   make(chan struct{}),
+	}
+	if err := c.hop(); err != nil {
+		return nil, err
+	}
+
+	go c.hopLoop()
+	return c, nil
+}
+
+// hop switches to a fresh socket and destination port
+func (c *hoppingConn) hop() error {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return fmt.Errorf("failed to open UDP socket: %v", err)
+	}
+
+	c.mu.Lock()
+	port := c.ports[rand.Intn(len(c.ports))]
+	for attempt := 0; port == c.port && attempt < 8; attempt++ {
+		port = c.ports[rand.Intn(len(c.ports))]
+	}
+	if c.previous != nil {
+		c.previous.Close()
+	}
+	c.previous, c.current, c.port = c.current, conn, port
+	c.mu.Unlock()
+
+	go c.readLoop(conn)
+	return nil
+}
+
+func (c *hoppingConn) hopLoop() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			if err := c.hop(); err != nil {
+				c.deliver(hopPacket{err: err})
+				return
+			}
+		}
+	}
+}
+
+// readLoop forwards datagrams from the server on one socket until it is
+// closed by a later hop
+func (c *hoppingConn) readLoop(conn *net.UDPConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(c.ip) {
+			continue // Not from the server
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		c.deliver(hopPacket{data: data})
+	}
+}
+
+func (c *hoppingConn) deliver(packet hopPacket) {
+	select {
+	case c.packets <- packet:
+	case <-c.closed:
+	default:
+		// Transport is not reading fast enough; drop like a full socket buffer
+	}
+}
+
+func (c *hoppingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case packet := <-c.packets:
+		if packet.err != nil {
+			return 0, nil, packet.err
+		}
+		return copy(p, packet.data), c.peer, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// WriteTo sends p to the server's current hop port; addr is ignored since
+// the connection only talks to one peer
+func (c *hoppingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	conn, port := c.current, c.port
+	c.mu.Unlock()
+
+	if conn == nil {
+		return 0, net.ErrClosed
+	}
+	return conn.WriteToUDP(p, &net.UDPAddr{IP: c.ip, Port: port})
+}
+
+func (c *hoppingConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, conn := range []*net.UDPConn{c.current, c.previous} {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+		c.current, c.previous = nil, nil
+	})
+	return nil
+}
+
+func (c *hoppingConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.current == nil {
+		return &net.UDPAddr{}
+	}
+	return c.current.LocalAddr()
+}
+
+func (c *hoppingConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.SetReadDeadline(t), c.SetWriteDeadline(t))
+}
+
+func (c *hoppingConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *hoppingConn) SetWriteDeadline(t time.Time) error {
+	// Writes to UDP sockets do not block meaningfully
+	return nil
+}
@@ -2,57 +2,15 @@ package protocols
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
+	"net"
 	"time"
 
 	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/wireguard"
 )
 
-// V2RayTunnel implements the Tunnel interface for V2Ray protocol
-type V2RayTunnel struct {
-	server config.Server
-	status *TunnelStatus
-}
-
-// NewV2RayTunnel creates a new V2Ray tunnel
-func NewV2RayTunnel(server config.Server) *V2RayTunnel {
-	return &V2RayTunnel{
-		server: server,
-		status: &TunnelStatus{
-			ServerName: server.Name,
-			Status:     "disconnected",
-		},
-	}
-}
-
-// Start starts the V2Ray tunnel
-func (t *V2RayTunnel) Start(ctx context.Context) error {
-	// TODO: Implement V2Ray protocol
-	return fmt.Errorf("V2Ray protocol not yet implemented")
-}
-
-// Stop stops the V2Ray tunnel
-func (t *V2RayTunnel) Stop() error {
-	t.status.Status = "disconnected"
-	return nil
-}
-
-// GetStatus returns the current status
-func (t *V2RayTunnel) GetStatus() *TunnelStatus {
-	statusCopy := *t.status
-	return &statusCopy
-}
-
-// GetName returns the tunnel name
-func (t *V2RayTunnel) GetName() string {
-	return t.server.Name
-}
-
-// Test tests the connection
-func (t *V2RayTunnel) Test() (time.Duration, error) {
-	return 0, fmt.Errorf("V2Ray test not yet implemented")
-}
-
 // WireGuardTunnel implements the Tunnel interface for WireGuard protocol
 type WireGuardTunnel struct {
 	server config.Server
@@ -93,52 +51,68 @@ func (t *WireGuardTunnel) GetName() string {
 	return t.server.Name
 }
 
-// Test tests the connection
+// Test times a WireGuard handshake with the server. A completed handshake
+// moves the server's endpoint for our key to the probe's address, so this
+// only suits tunnels that are not carrying traffic.
 func (t *WireGuardTunnel) Test() (time.Duration, error) {
-	return 0, fmt.Errorf("WireGuard test not yet implemented")
-}
-
-// TrojanTunnel implements the Tunnel interface for Trojan protocol
-type TrojanTunnel struct {
-	server config.Server
-	status *TunnelStatus
-}
-
-// NewTrojanTunnel creates a new Trojan tunnel
-func NewTrojanTunnel(server config.Server) *TrojanTunnel {
-	return &TrojanTunnel{
-		server: server,
-		status: &TunnelStatus{
-			ServerName: server.Name,
-			Status:     "disconnected",
-		},
+	wg := t.server.WireGuard
+	if wg == nil {
+		return 0, fmt.Errorf("wireguard settings missing")
+	}
+	private, err := wireguard.ParseKey(wg.PrivateKey)
+	if err != nil {
+		return 0, fmt.Errorf("private_key: %v", err)
+	}
+	public, err := wireguard.ParseKey(wg.PublicKey)
+	if err != nil {
+		return 0, fmt.Errorf("public_key: %v", err)
+	}
+	var psk wireguard.Key
+	if wg.PreSharedKey != "" {
+		if psk, err = wireguard.ParseKey(wg.PreSharedKey); err != nil {
+			return 0, fmt.Errorf("pre_shared_key: %v", err)
+		}
 	}
-}
-
-// Start starts the Trojan tunnel
-func (t *TrojanTunnel) Start(ctx context.Context) error {
-	// TODO: Implement Trojan protocol
-	return fmt.Errorf("Trojan protocol not yet implemented")
-}
-
-// Stop stops the Trojan tunnel
-func (t *TrojanTunnel) Stop() error {
-	t.status.Status = "disconnected"
-	return nil
-}
-
-// GetStatus returns the current status
-func (t *TrojanTunnel) GetStatus() *TunnelStatus {
-	statusCopy := *t.status
-	return &statusCopy
-}
-
-// GetName returns the tunnel name
-func (t *TrojanTunnel) GetName() string {
-	return t.server.Name
-}
 
-// Test tests the connection
-func (t *TrojanTunnel) Test() (time.Duration, error) {
-	return 0, fmt.Errorf("Trojan test not yet implemented")
+	addr := net.JoinHostPort(t.server.Host, t.server.Port)
+	conn, err := net.DialTimeout("udp", addr, quicProbeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// UDP may drop a datagram; retry before giving up
+	buf := make([]byte, 1500)
+	perAttempt := quicProbeTimeout / probeAttempts
+	for attempt := 0; attempt < probeAttempts; attempt++ {
+		handshake := wireguard.NewHandshake(private, public, psk)
+		initiation, err := handshake.Initiation()
+		if err != nil {
+			return 0, err
+		}
+
+		start := time.Now()
+		if _, err := conn.Write(initiation); err != nil {
+			return 0, fmt.Errorf("failed to send WireGuard handshake to %s: %v", addr, err)
+		}
+
+		conn.SetReadDeadline(start.Add(perAttempt))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break // Timed out, or ICMP unreachable; try again
+			}
+			reply := buf[:n]
+			// A server under load answers with a cookie instead, which
+			// still times the round trip
+			if n == wireguard.CookieReplySize && reply[0] == wireguard.MessageCookieReply &&
+				binary.LittleEndian.Uint32(reply[4:8]) == handshake.LocalIndex() {
+				return time.Since(start), nil
+			}
+			if _, err := handshake.ConsumeResponse(reply); err == nil {
+				return time.Since(start), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no WireGuard handshake response from %s", addr)
 }
@@ -0,0 +1,267 @@
+package protocols
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+// Traffic classes, in scheduling order
+const (
+	classInteractive = iota
+	classBulk
+	numClasses
+)
+
+// qosChunk bounds how much one connection sends or receives per grant, so
+// a bulk transfer cannot hold the link for long once interactive traffic
+// arrives
+const qosChunk = 16 << 10
+
+// qosState is the QoS configuration in force, nil when QoS is disabled
+var qosState atomic.Pointer[qosPolicy]
+
+// qosPolicy classifies connections and holds the shared budgets
+type qosPolicy struct {
+	rules         []config.RoutingRule // Rules setting a priority
+	ports         map[int]bool         // Interactive by default
+	bulkThreshold int64
+	upload        *prioritySchedule // nil when unlimited
+	download      *prioritySchedule
+}
+
+// configureQoS installs the QoS policy for all tunnels
+func configureQoS(cfg *config.Config) {
+	if !cfg.QoS.Enabled {
+		qosState.Store(nil)
+		return
+	}
+
+	policy := &qosPolicy{
+		ports:         make(map[int]bool),
+		bulkThreshold: cfg.QoS.BulkThreshold,
+	}
+	for _, rule := range cfg.Routing {
+		if rule.Priority != "" {
+			policy.rules = append(policy.rules, rule)
+		}
+	}
+	for _, port := range cfg.QoS.InteractivePorts {
+		policy.ports[port] = true
+	}
+	if rate, err := config.ParseBandwidth(cfg.QoS.Upload); err == nil {
+		policy.upload = newPrioritySchedule(rate)
+	}
+	if rate, err := config.ParseBandwidth(cfg.QoS.Download); err == nil {
+		policy.download = newPrioritySchedule(rate)
+	}
+
+	qosState.Store(policy)
+}
+
+// qosDial wraps dial so remote connections are scheduled by QoS class
+func qosDial(dial DialFunc) DialFunc {
+	policy := qosState.Load()
+	if policy == nil {
+		return dial
+	}
+
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		c := &qosConn{Conn: conn, policy: policy, class: -1}
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+		c.classify(addr)
+		return c, nil
+	}
+}
+
+// classify fixes the class of connections matched by a rule or an
+// interactive port; others are left to the bulk threshold
+func (c *qosConn) classify(addr string) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	for _, rule := range c.policy.rules {
+		if rule.Matches(host, port) {
+			if rule.Priority == config.PriorityBulk {
+				c.class = classBulk
+			} else {
+				c.class = classInteractive
+			}
+			return
+		}
+	}
+	if c.policy.ports[port] {
+		c.class = classInteractive
+	}
+}
+
+// qosConn is a remote connection: writes are uploads, reads downloads
+type qosConn struct {
+	net.Conn
+	policy      *qosPolicy
+	class       int // Fixed class, or -1 to use the bulk threshold
+	transferred atomic.Int64
+	ctx         context.Context // Cancelled on Close to release waiting callers
+	cancel      context.CancelFunc
+}
+
+// currentClass returns the class for the connection's next chunk
+func (c *qosConn) currentClass() int {
+	if c.class >= 0 {
+		return c.class
+	}
+	if c.transferred.Load() > c.policy.bulkThreshold {
+		return classBulk
+	}
+	return classInteractive
+}
+
+func (c *qosConn) Read(p []byte) (int, error) {
+	schedule := c.policy.download
+	if schedule != nil && len(p) > qosChunk {
+		p = p[:qosChunk]
+	}
+
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		class := c.currentClass()
+		c.transferred.Add(int64(n))
+		if schedule != nil {
+			schedule.wait(c.ctx, class, n)
+		}
+	}
+	return n, err
+}
+
+func (c *qosConn) Write(p []byte) (int, error) {
+	schedule := c.policy.upload
+	if schedule == nil {
+		n, err := c.Conn.Write(p)
+		c.transferred.Add(int64(n))
+		return n, err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		chunk := len(p)
+		if chunk > qosChunk {
+			chunk = qosChunk
+		}
+		if err := schedule.wait(c.ctx, c.currentClass(), chunk); err != nil {
+			return written, net.ErrClosed
+		}
+
+		n, err := c.Conn.Write(p[:chunk])
+		written += n
+		c.transferred.Add(int64(n))
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the underlying connection when supported
+func (c *qosConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+func (c *qosConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// prioritySchedule is a token bucket shared by all tunnels that serves
+// waiting interactive traffic before any bulk traffic
+type prioritySchedule struct {
+	rate  float64 // Bytes per second
+	burst float64
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	waiting [numClasses]int
+}
+
+func newPrioritySchedule(rate float64) *prioritySchedule {
+	burst := rate / 20 // 50ms of traffic
+	if burst < 2*qosChunk {
+		burst = 2 * qosChunk
+	}
+	return &prioritySchedule{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until n bytes of class may pass
+func (s *prioritySchedule) wait(ctx context.Context, class, n int) error {
+	need := float64(n)
+	queued := false
+
+	s.mu.Lock()
+	for {
+		now := time.Now()
+		s.tokens += now.Sub(s.last).Seconds() * s.rate
+		if s.tokens > s.burst {
+			s.tokens = s.burst
+		}
+		s.last = now
+
+		if s.tokens >= need && !s.higherWaiting(class) {
+			s.tokens -= need
+			if queued {
+				s.waiting[class]--
+			}
+			s.mu.Unlock()
+			return nil
+		}
+		if !queued {
+			s.waiting[class]++
+			queued = true
+		}
+
+		// Sleep until enough tokens accumulate; bulk re-checks as often
+		// since interactive traffic may take them first
+		delay := time.Duration((need - s.tokens) / s.rate * float64(time.Second))
+		if delay < time.Millisecond {
+			delay = time.Millisecond
+		}
+		s.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			s.mu.Lock()
+			s.waiting[class]--
+			s.mu.Unlock()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		s.mu.Lock()
+	}
+}
+
+// higherWaiting reports whether a more urgent class is queued; the caller
+// holds s.mu
+func (s *prioritySchedule) higherWaiting(class int) bool {
+	for c := 0; c < class; c++ {
+		if s.waiting[c] > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package protocols
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"ssh-tunnel/internal/config"
+)
+
+const (
+	// quicProbeVersion is a reserved version (RFC 9000 section 15) no
+	// server supports, so the server must answer with Version Negotiation
+	quicProbeVersion = 0x1a2a3a4a
+
+	// quicMinInitialSize is the size below which servers may drop Initial
+	// packets instead of answering them
+	quicMinInitialSize = 1200
+
+	quicConnIDLen    = 8
+	salamanderSalt   = 8
+	probeAttempts    = 3
+	quicProbeTimeout = 5 * time.Second
+)
+
+// quicPing measures the round trip to a QUIC server without a QUIC stack:
+// it sends an Initial for an unsupported version and times the Version
+// Negotiation reply, which every QUIC server sends before any handshake.
+// Hysteria's Salamander obfuscation is applied when configured.
+func quicPing(server config.Server) (time.Duration, error) {
+	var obfsKey []byte
+	if hy := server.Hysteria; server.Transport == config.TransportHysteria && hy != nil && hy.Obfs != "" {
+		if hy.Obfs != "salamander" {
+			return 0, fmt.Errorf("latency test not supported with %s obfuscation", hy.Obfs)
+		}
+		obfsKey = []byte(hy.ObfsPassword)
+	}
+	rtt, _, err := quicNegotiate(server, obfsKey)
+	return rtt, err
+}
+
+// quicNegotiate sends the version negotiation probe, obfuscated with
+// Salamander when obfsKey is set, and returns the round trip and the QUIC
+// versions the server offers
+func quicNegotiate(server config.Server, obfsKey []byte) (time.Duration, []uint32, error) {
+	addr := net.JoinHostPort(server.Host, server.Port)
+	conn, err := net.DialTimeout("udp", addr, quicProbeTimeout)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+
+	packet, dcid, scid, err := quicProbePacket()
+	if err != nil {
+		return 0, nil, err
+	}
+	if obfsKey != nil {
+		if packet, err = salamanderSeal(obfsKey, packet); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	// UDP may drop a datagram; retry before giving up
+	buf := make([]byte, 1500)
+	perAttempt := quicProbeTimeout / probeAttempts
+	for attempt := 0; attempt < probeAttempts; attempt++ {
+		start := time.Now()
+		if _, err := conn.Write(packet); err != nil {
+			return 0, nil, fmt.Errorf("failed to send QUIC probe to %s: %v", addr, err)
+		}
+
+		conn.SetReadDeadline(start.Add(perAttempt))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break // Timed out, or ICMP unreachable; try again
+			}
+			reply := buf[:n]
+			if obfsKey != nil {
+				if reply, err = salamanderOpen(obfsKey, reply); err != nil {
+					continue
+				}
+			}
+			if isVersionNegotiation(reply, dcid, scid) {
+				return time.Since(start), negotiatedVersions(reply, dcid, scid), nil
+			}
+		}
+	}
+	return 0, nil, fmt.Errorf("no QUIC response from %s", addr)
+}
+
+// quicProbePacket builds a padded long-header Initial for quicProbeVersion
+func quicProbePacket() (packet, dcid, scid []byte, err error) {
+	ids := make([]byte, 2*quicConnIDLen+1)
+	if _, err := rand.Read(ids); err != nil {
+		return nil, nil, nil, err
+	}
+	dcid, scid = ids[:quicConnIDLen], ids[quicConnIDLen:2*quicConnIDLen]
+
+	packet = make([]byte, 0, quicMinInitialSize)
+	packet = append(packet, 0xc0|ids[2*quicConnIDLen]&0x0f) // Long header, fixed bit, Initial
+	packet = binary.BigEndian.AppendUint32(packet, quicProbeVersion)
+	packet = append(packet, quicConnIDLen)
+	packet = append(packet, dcid...)
+	packet = append(packet, quicConnIDLen)
+	packet = append(packet, scid...)
+	packet = packet[:quicMinInitialSize] // Zero padding
+	return packet, dcid, scid, nil
+}
+
+// isVersionNegotiation checks a reply is the Version Negotiation packet
+// for our probe: version 0 with the connection IDs swapped
+func isVersionNegotiation(packet, dcid, scid []byte) bool {
+	if len(packet) < 7 || packet[0]&0x80 == 0 || binary.BigEndian.Uint32(packet[1:5]) != 0 {
+		return false
+	}
+	rest := packet[5:]
+	if int(rest[0]) != len(scid) || len(rest) < 1+len(scid)+1 || !bytes.Equal(rest[1:1+len(scid)], scid) {
+		return false
+	}
+	rest = rest[1+len(scid):]
+	return int(rest[0]) == len(dcid) && len(rest) >= 1+len(dcid) && bytes.Equal(rest[1:1+len(dcid)], dcid)
+}
+
+// negotiatedVersions lists the versions in a Version Negotiation packet
+// isVersionNegotiation accepted
+func negotiatedVersions(packet, dcid, scid []byte) []uint32 {
+	var versions []uint32
+	for rest := packet[5+1+len(scid)+1+len(dcid):]; len(rest) >= 4; rest = rest[4:] {
+		versions = append(versions, binary.BigEndian.Uint32(rest))
+	}
+	return versions
+}
+
+// salamanderSeal obfuscates a packet the way Hysteria 2's Salamander does:
+// a random salt, then the payload XORed with BLAKE2b-256(password, salt)
+func salamanderSeal(key, packet []byte) ([]byte, error) {
+	out := make([]byte, salamanderSalt+len(packet))
+	if _, err := rand.Read(out[:salamanderSalt]); err != nil {
+		return nil, err
+	}
+	salamanderXOR(key, out[:salamanderSalt], out[salamanderSalt:], packet)
+	return out, nil
+}
+
+// salamanderOpen reverses salamanderSeal
+func salamanderOpen(key, packet []byte) ([]byte, error) {
+	if len(packet) <= salamanderSalt {
+		return nil, fmt.Errorf("short packet")
+	}
+	out := make([]byte, len(packet)-salamanderSalt)
+	salamanderXOR(key, packet[:salamanderSalt], out, packet[salamanderSalt:])
+	return out, nil
+}
+
+func salamanderXOR(key, salt, dst, src []byte) {
+	pad := blake2b.Sum256(append(append([]byte(nil), key...), salt...))
+	for i := range src {
+		dst[i] = src[i] ^ pad[i%len(pad)]
+	}
+}
@@ -0,0 +1,52 @@
+package protocols
+
+import "sort"
+
+// Readiness tells whether the tunnels this instance exists for are up
+type Readiness struct {
+	Ready        bool     `json:"ready"`
+	Required     []string `json:"required,omitempty"`      // Servers that must be connected
+	RequiredDown []string `json:"required_down,omitempty"` // Required servers not connected
+	OptionalDown []string `json:"optional_down,omitempty"` // Other running or failed servers not connected
+}
+
+// Readiness reports whether every required server is connected. With no
+// server required, one connected tunnel is enough. Optional servers that
+// are down are listed but never make the instance unready.
+func (tm *TunnelManager) Readiness() Readiness {
+	tm.mu.RLock()
+	required := requiredServers(tm.config)
+	tm.mu.RUnlock()
+
+	var readiness Readiness
+	connected := 0
+	statuses := tm.GetStatus()
+	for name, status := range statuses {
+		up := status.Status == string(StateConnected)
+		if up {
+			connected++
+		}
+		switch {
+		case required[name] && !up:
+			readiness.RequiredDown = append(readiness.RequiredDown, name)
+		case !up && status.Status != string(StateIdle):
+			readiness.OptionalDown = append(readiness.OptionalDown, name)
+		}
+	}
+	for name := range required {
+		readiness.Required = append(readiness.Required, name)
+		if _, exists := statuses[name]; !exists {
+			readiness.RequiredDown = append(readiness.RequiredDown, name)
+		}
+	}
+	sort.Strings(readiness.Required)
+	sort.Strings(readiness.RequiredDown)
+	sort.Strings(readiness.OptionalDown)
+
+	if len(required) > 0 {
+		readiness.Ready = len(readiness.RequiredDown) == 0
+	} else {
+		readiness.Ready = connected > 0
+	}
+	return readiness
+}
@@ -0,0 +1,228 @@
+package protocols
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"ssh-tunnel/internal/autodiscovery"
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/crash"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// remoteForward serves connections to a port of the SSH server from a
+// local address
+type remoteForward struct {
+	cfg      config.RemoteForwardConfig
+	server   string
+	listener net.Listener
+	relay    *ssh.Session // Publishes a loopback forward sshd would not
+}
+
+// startRemoteForwards asks the server to listen for every remote forward.
+// A forward that fails is logged and skipped, as ssh does.
+func (t *SSHTunnel) startRemoteForwards(client *ssh.Client) []*remoteForward {
+	var forwards []*remoteForward
+	for _, cfg := range t.server.RemoteForwards {
+		f, err := startRemoteForward(client, t.server, cfg)
+		if err != nil {
+			log.Printf("⚠️  Remote forward %s -> %s on %s failed: %v", cfg.Remote, cfg.Local, t.server.Name, err)
+			continue
+		}
+		forwards = append(forwards, f)
+	}
+	return forwards
+}
+
+func startRemoteForward(client *ssh.Client, server config.Server, cfg config.RemoteForwardConfig) (*remoteForward, error) {
+	remote, err := cfg.RemoteAddress()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := client.Listen("tcp", remote)
+	if err != nil {
+		return nil, fmt.Errorf("server refused to listen on %s: %v", remote, err)
+	}
+	f := &remoteForward{cfg: cfg, server: server.Name, listener: listener}
+
+	// With GatewayPorts no, sshd quietly listens on loopback whatever
+	// address was asked for
+	if cfg.Public && cfg.Gateway != config.GatewayNone {
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		public, err := listensPublicly(client, port)
+		switch {
+		case err != nil:
+			log.Printf("⚠️  Could not check that %s on %s is public: %v", remote, server.Name, err)
+		case !public:
+			if err := f.publish(client, server, remote); err != nil {
+				f.close()
+				return nil, err
+			}
+		}
+	}
+
+	log.Printf("🔁 Forwarding %s on %s to %s", remote, server.Name, cfg.Local)
+	go f.serve()
+	return f, nil
+}
+
+// publish makes a forward that sshd keeps on loopback reachable on the
+// public address: the server relays it to a loopback forward. With the sshd
+// gateway GatewayPorts is also set, which takes effect for the next
+// connection.
+func (f *remoteForward) publish(client *ssh.Client, server config.Server, public string) error {
+	log.Printf("⚠️  sshd on %s has GatewayPorts no, so %s only listens on loopback", server.Name, public)
+
+	if f.cfg.Gateway == config.GatewaySSHD {
+		if backup, err := allowGatewayPorts(client, server.User); err != nil {
+			log.Printf("⚠️  Failed to set GatewayPorts on %s: %v", server.Name, err)
+		} else {
+			log.Printf("🔧 Set GatewayPorts clientspecified on %s (backup at %s); forwards are public from the next connection", server.Name, backup)
+		}
+	}
+
+	f.listener.Close()
+	listener, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("server refused a loopback forward: %v", err)
+	}
+	f.listener = listener
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to open relay session: %v", err)
+	}
+	session.Stderr = &execOutput{name: server.Name + " tcp-relay"}
+	if err := session.Start(tcpRelayCommand(f.cfg.Relay, public, listener.Addr().String())); err != nil {
+		session.Close()
+		return fmt.Errorf("failed to start relay: %v", err)
+	}
+	f.relay = session
+
+	_, port, _ := net.SplitHostPort(public)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(250 * time.Millisecond) {
+		if ok, _ := listensPublicly(client, port); ok {
+			log.Printf("🔀 Relaying %s on %s to the forward", public, server.Name)
+			return nil
+		}
+	}
+	return fmt.Errorf("relay did not start listening on %s; install socat or %q on the server, or set GatewayPorts clientspecified", public, f.cfg.Relay)
+}
+
+// tcpRelayCommand relays a public address to a loopback forward on the
+// server, with socat when it is installed or else the relay helper, until
+// the session closes its stdin
+func tcpRelayCommand(helper, public, target string) string {
+	host, port, _ := net.SplitHostPort(public)
+	_, targetPort, _ := net.SplitHostPort(target)
+	listen := fmt.Sprintf("TCP4-LISTEN:%s,bind=%s", port, host)
+	if strings.Contains(host, ":") {
+		listen = fmt.Sprintf("TCP6-LISTEN:%s,bind=[%s]", port, host)
+	}
+	return fmt.Sprintf(`if command -v socat >/dev/null; then
+  socat '%s,fork,reuseaddr' TCP4:127.0.0.1:%s &
+else
+  %s '%s' 127.0.0.1:%s &
+fi
+relay=$!
+cat >/dev/null
+kill $relay`, listen, targetPort, helper, public, targetPort)
+}
+
+// listensPublicly reports whether a TCP port of the server is bound to an
+// address other than loopback
+func listensPublicly(client *ssh.Client, port string) (bool, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+
+	output, err := session.Output(fmt.Sprintf("ss -Hltn 'sport = :%s' 2>/dev/null || netstat -ltn 2>/dev/null", port))
+	if err != nil {
+		return false, fmt.Errorf("neither ss nor netstat works: %v", err)
+	}
+
+	found := false
+	for _, line := range strings.Split(string(output), "\n") {
+		// The local address is the fourth column of both
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		local := fields[3]
+		i := strings.LastIndex(local, ":")
+		if i < 0 || local[i+1:] != port {
+			continue
+		}
+		found = true
+		host := strings.Trim(local[:i], "[]")
+		if !strings.HasPrefix(host, "127.") && host != "::1" {
+			return true, nil
+		}
+	}
+	if !found {
+		return false, fmt.Errorf("no listener on port %s", port)
+	}
+	return false, nil
+}
+
+// allowGatewayPorts sets GatewayPorts clientspecified in the server's
+// sshd_config, with sudo unless logged in as root, and returns the backup
+func allowGatewayPorts(client *ssh.Client, user string) (string, error) {
+	script, backup := autodiscovery.SSHDFixCommand([]string{"GatewayPorts clientspecified"})
+
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	shell := "sh -s"
+	if user != "root" {
+		shell = "sudo -n sh -s"
+	}
+	session.Stdin = strings.NewReader(script)
+	if output, err := session.CombinedOutput(shell); err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return backup, nil
+}
+
+// serve connects each connection the server forwards to the local address
+func (f *remoteForward) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return // Closed with the forward or the connection
+		}
+		go func() {
+			defer crash.Recover("remote forward connection")
+			defer conn.Close()
+			mem, err := admitConnection("remote_forward", conn.RemoteAddr())
+			if err != nil {
+				log.Printf("⚠️  Remote forward on %s: connection rejected: %v", f.server, err)
+				return
+			}
+			defer mem.release()
+			local, err := net.DialTimeout("tcp", f.cfg.Local, 10*time.Second)
+			if err != nil {
+				log.Printf("⚠️  Remote forward on %s: failed to reach %s: %v", f.server, f.cfg.Local, err)
+				return
+			}
+			defer local.Close()
+			relay(conn, local)
+		}()
+	}
+}
+
+func (f *remoteForward) close() {
+	f.listener.Close()
+	if f.relay != nil {
+		f.relay.Close()
+	}
+}
@@ -0,0 +1,105 @@
+package protocols
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/crash"
+	"ssh-tunnel/internal/shadowsocks"
+)
+
+const (
+	// shadowsocksHandshakeTimeout bounds the wait for a client's salt and
+	// target address
+	shadowsocksHandshakeTimeout = 30 * time.Second
+
+	// shadowsocksDrainTimeout is how long connections failing to
+	// authenticate are held open before being dropped
+	shadowsocksDrainTimeout = time.Minute
+)
+
+// startShadowsocks serves Shadowsocks clients on the LAN, sending their
+// connections through the pinned tunnel or else through Dial
+func (tm *TunnelManager) startShadowsocks(ss config.ShadowsocksConfig) error {
+	ciph, err := shadowsocks.NewCipher(ss.Method, ss.Password)
+	if err != nil {
+		return err
+	}
+
+	dial := DialFunc(tm.Dial)
+	if ss.Server != "" {
+		name := ss.Server
+		dial = func(network, addr string) (net.Conn, error) {
+			return tm.DialTunnel(name, network, addr)
+		}
+	}
+	dial = mitmDial(qosDial(dial))
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", ss.Port))
+	if err != nil {
+		return fmt.Errorf("failed to create shadowsocks listener: %v", err)
+	}
+
+	tm.mu.Lock()
+	tm.shadowsocks = listener
+	ctx := tm.ctx
+	tm.mu.Unlock()
+
+	log.Printf("Shadowsocks server started on port %d (%s)", ss.Port, ss.Method)
+
+	salts := shadowsocks.NewSaltFilter()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return // Context cancelled
+				}
+				log.Printf("Error accepting shadowsocks connection: %v", err)
+				continue
+			}
+
+			go func() {
+				defer crash.Recover("shadowsocks connection")
+				defer conn.Close()
+				mem, err := admitConnection("shadowsocks", conn.RemoteAddr())
+				if err != nil {
+					log.Printf("Shadowsocks connection from %s rejected: %v", conn.RemoteAddr(), err)
+					return
+				}
+				defer mem.release()
+				if err := serveShadowsocks(ciph.Server(conn, salts), mem.trackDial(dial)); err != nil {
+					log.Printf("Shadowsocks connection error from %s: %v", conn.RemoteAddr(), err)
+				}
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// serveShadowsocks reads the client's target and relays to it
+func serveShadowsocks(conn *shadowsocks.Conn, dial DialFunc) error {
+	conn.SetReadDeadline(time.Now().Add(shadowsocksHandshakeTimeout))
+	target, err := conn.ReadTarget()
+	if err != nil {
+		if errors.Is(err, shadowsocks.ErrAuth) {
+			shadowsocks.Drain(conn.Conn, shadowsocksDrainTimeout)
+		}
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	remote, err := dial("tcp", target)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", target, err)
+	}
+	defer remote.Close()
+
+	relay(conn, remote)
+	return nil
+}
@@ -0,0 +1,285 @@
+package protocols
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"ssh-tunnel/internal/config"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+// ShellOptions configures a tunnel shell session
+type ShellOptions struct {
+	Command string // Run instead of a login shell
+	NoAgent bool   // Do not forward the agent, whatever the server's policy
+}
+
+// RunShell opens an interactive shell, or runs a command, on an SSH
+// server with the terminal attached, and returns the remote exit status.
+// The local ssh-agent is forwarded as the server's agent_forwarding policy
+// allows.
+func RunShell(server config.Server, opts ShellOptions) (int, error) {
+	if server.Exec != nil || (server.Transport != config.TransportSSH && server.Transport != config.TransportICMP) {
+		return 0, fmt.Errorf("server %s does not use the ssh transport", server.Name)
+	}
+	if len(server.Chain) > 0 {
+		return 0, fmt.Errorf("shells through chains are not supported")
+	}
+
+	client, err := DialSSH(server)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return 0, fmt.Errorf("failed to open session: %v", err)
+	}
+	defer session.Close()
+
+	// A terminal in raw mode passes keys on one at a time, and the server
+	// echoes them
+	pty := term.IsTerminal(int(os.Stdin.Fd())) && (opts.Command == "" || term.IsTerminal(int(os.Stdout.Fd())))
+	input := newShellInput(os.Stdin)
+	input.raw = pty
+	session.Stdin = input
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	policy := server.AgentForwarding
+	if opts.NoAgent {
+		policy = config.AgentForwardingOff
+	}
+	if err := forwardAgent(client, session, server.Name, policy, input, pty); err != nil {
+		log.Printf("⚠️  Agent forwarding disabled: %v", err)
+	}
+
+	if pty {
+		width, height, err := term.GetSize(int(os.Stdout.Fd()))
+		if err != nil {
+			width, height = 80, 24
+		}
+		termType := os.Getenv("TERM")
+		if termType == "" {
+			termType = "xterm-256color"
+		}
+		if err := session.RequestPty(termType, height, width, ssh.TerminalModes{ssh.ECHO: 1}); err != nil {
+			return 0, fmt.Errorf("failed to allocate a terminal: %v", err)
+		}
+
+		state, err := term.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return 0, fmt.Errorf("failed to put the terminal in raw mode: %v", err)
+		}
+		defer term.Restore(int(os.Stdin.Fd()), state)
+
+		stop := watchWindowSize(session)
+		defer stop()
+	}
+
+	if opts.Command != "" {
+		err = session.Run(opts.Command)
+	} else {
+		if err := session.Shell(); err != nil {
+			return 0, fmt.Errorf("failed to start shell: %v", err)
+		}
+		err = session.Wait()
+	}
+
+	var exitErr *ssh.ExitError
+	var missing *ssh.ExitMissingError
+	switch {
+	case err == nil:
+		return 0, nil
+	case errors.As(err, &exitErr):
+		return exitErr.ExitStatus(), nil
+	case errors.As(err, &missing):
+		return 255, nil // Closed without a status, like ssh
+	default:
+		return 0, err
+	}
+}
+
+// forwardAgent offers the local ssh-agent to the server under a policy.
+// Under confirm the server can only sign, after the user agrees on the
+// terminal, and never add or remove keys.
+func forwardAgent(client *ssh.Client, session *ssh.Session, server, policy string, input *shellInput, pty bool) error {
+	if policy == "" || policy == config.AgentForwardingOff {
+		return nil
+	}
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return fmt.Errorf("no ssh-agent is running (SSH_AUTH_SOCK is not set)")
+	}
+
+	switch policy {
+	case config.AgentForwardingOn:
+		if err := agent.ForwardToRemote(client, socket); err != nil {
+			return err
+		}
+	case config.AgentForwardingConfirm:
+		if !pty {
+			return fmt.Errorf("agent_forwarding confirm needs a terminal to ask on")
+		}
+		channels := client.HandleChannelOpen("auth-agent@openssh.com")
+		if channels == nil {
+			return fmt.Errorf("agent forwarding is already set up")
+		}
+		go func() {
+			for open := range channels {
+				channel, reqs, err := open.Accept()
+				if err != nil {
+					continue
+				}
+				go ssh.DiscardRequests(reqs)
+				go func() {
+					defer channel.Close()
+					conn, err := net.Dial("unix", socket)
+					if err != nil {
+						log.Printf("⚠️  Failed to reach ssh-agent: %v", err)
+						return
+					}
+					defer conn.Close()
+					agent.ServeAgent(&confirmingAgent{
+						ExtendedAgent: agent.NewClient(conn),
+						server:        server,
+						input:         input,
+					}, channel)
+				}()
+			}
+		}()
+	default:
+		return fmt.Errorf("unsupported agent_forwarding: %s", policy)
+	}
+
+	return agent.RequestAgentForwarding(session)
+}
+
+// errAgentRefused is what the server gets for requests the user or the
+// confirm policy refused
+var errAgentRefused = errors.New("refused by agent forwarding policy")
+
+// confirmingAgent lists the local agent's keys, but signs only with the
+// user's consent, and refuses changes to the agent
+type confirmingAgent struct {
+	agent.ExtendedAgent
+	server string
+	input  *shellInput
+}
+
+func (a *confirmingAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *confirmingAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	name := ssh.FingerprintSHA256(key)
+	if keys, err := a.List(); err == nil {
+		for _, k := range keys {
+			if k.Comment != "" && string(k.Marshal()) == string(key.Marshal()) {
+				name = k.Comment + " " + name
+			}
+		}
+	}
+	if !a.input.confirm(fmt.Sprintf("🔑 %s wants to sign with %s. Allow? [y/N] ", a.server, name)) {
+		return nil, errAgentRefused
+	}
+	return a.ExtendedAgent.SignWithFlags(key, data, flags)
+}
+
+func (a *confirmingAgent) Add(agent.AddedKey) error       { return errAgentRefused }
+func (a *confirmingAgent) Remove(ssh.PublicKey) error     { return errAgentRefused }
+func (a *confirmingAgent) RemoveAll() error               { return errAgentRefused }
+func (a *confirmingAgent) Lock([]byte) error              { return errAgentRefused }
+func (a *confirmingAgent) Unlock([]byte) error            { return errAgentRefused }
+func (a *confirmingAgent) Signers() ([]ssh.Signer, error) { return nil, errAgentRefused }
+
+func (a *confirmingAgent) Extension(string, []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+// shellInput passes the terminal's input to the session, except for the
+// answer to a confirmation, which it keeps to itself
+type shellInput struct {
+	pipe    *io.PipeReader
+	raw     bool // The terminal is in raw mode
+	asking  sync.Mutex
+	mu      sync.Mutex
+	pending chan byte // Waiting for an answer
+	closed  bool      // No more input, so no answers
+}
+
+func newShellInput(r io.Reader) *shellInput {
+	pr, pw := io.Pipe()
+	in := &shellInput{pipe: pr}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				in.mu.Lock()
+				answer := in.pending
+				in.pending = nil
+				in.mu.Unlock()
+				if answer != nil {
+					answer <- buf[0] // Whatever else was typed goes too
+				} else if _, err := pw.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				in.mu.Lock()
+				in.closed = true
+				if in.pending != nil {
+					in.pending <- 0
+				}
+				in.mu.Unlock()
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return in
+}
+
+func (in *shellInput) Read(p []byte) (int, error) {
+	return in.pipe.Read(p)
+}
+
+// confirm asks a yes/no question on the terminal, one at a time
+func (in *shellInput) confirm(prompt string) bool {
+	in.asking.Lock()
+	defer in.asking.Unlock()
+
+	answer := make(chan byte, 1)
+	in.mu.Lock()
+	if in.closed {
+		in.mu.Unlock()
+		return false
+	}
+	in.pending = answer
+	in.mu.Unlock()
+
+	newline := "\n"
+	if in.raw {
+		newline = "\r\n"
+	}
+	fmt.Fprint(os.Stderr, newline+strings.TrimSpace(prompt)+" ")
+	key := <-answer
+	allowed := key == 'y' || key == 'Y'
+	if allowed {
+		fmt.Fprint(os.Stderr, "yes"+newline)
+	} else {
+		fmt.Fprint(os.Stderr, "no"+newline)
+	}
+	return allowed
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+
+package protocols
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// watchWindowSize tells the server when the terminal is resized, until
+// the returned function is called
+func watchWindowSize(session *ssh.Session) func() {
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	go func() {
+		for range resized {
+			if width, height, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+				session.WindowChange(height, width)
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(resized)
+		close(resized)
+	}
+}
@@ -0,0 +1,32 @@
+package protocols
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// watchWindowSize tells the server when the console is resized, until the
+// returned function is called. Windows has no SIGWINCH, so it polls.
+func watchWindowSize(session *ssh.Session) func() {
+	done := make(chan struct{})
+	go func() {
+		width, height, _ := term.GetSize(int(os.Stdout.Fd()))
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if w, h, err := term.GetSize(int(os.Stdout.Fd())); err == nil && (w != width || h != height) {
+				width, height = w, h
+				session.WindowChange(height, width)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
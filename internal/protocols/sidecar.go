@@ -0,0 +1,236 @@
+package protocols
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+
+	"golang.org/x/net/http2"
+)
+
+// sidecarService is the gRPC service a sidecar implements; see PLUGINS.md
+// for the protobuf definition
+const sidecarService = "/sshtunnel.plugin.v1.TunnelPlugin/"
+
+// sidecarTimeout bounds calls other than Start
+const sidecarTimeout = 5 * time.Second
+
+// sidecarClient makes unary gRPC calls to a plugin sidecar over h2c, on a
+// TCP address or a "unix:" socket path
+type sidecarClient struct {
+	addr      string
+	transport *http2.Transport
+}
+
+func newSidecarClient(addr string) *sidecarClient {
+	network, address := "tcp", addr
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, address = "unix", path
+	}
+
+	return &sidecarClient{
+		addr: addr,
+		transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, _, _ string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, address)
+			},
+		},
+	}
+}
+
+// call invokes a unary method and returns the response message
+func (c *sidecarClient) call(ctx context.Context, method string, req []byte) ([]byte, error) {
+	httpReq := &http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Scheme: "http", Host: "sidecar", Path: sidecarService + method},
+		Header: make(http.Header),
+		Body:   io.NopCloser(bytes.NewReader(grpcFrame(req))),
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/grpc")
+	httpReq.Header.Set("TE", "trailers")
+
+	resp, err := c.transport.RoundTrip(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("sidecar %s: %v", c.addr, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sidecar %s: %s", c.addr, resp.Status)
+	}
+
+	// Errors may come as a trailers-only response, with the status in the
+	// headers and no message
+	if err := grpcStatus(resp.Header); err != nil {
+		return nil, fmt.Errorf("sidecar %s: %v", c.addr, err)
+	}
+
+	msg, err := readGRPCMessage(resp.Body)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("sidecar %s: %v", c.addr, err)
+	}
+	io.Copy(io.Discard, resp.Body) // Reach the trailers
+
+	if err := grpcStatus(resp.Trailer); err != nil {
+		return nil, fmt.Errorf("sidecar %s: %v", c.addr, err)
+	}
+	return msg, nil
+}
+
+// grpcStatus converts a non-OK grpc-status into an error
+func grpcStatus(h http.Header) error {
+	status := h.Get("Grpc-Status")
+	if status == "" || status == "0" {
+		return nil
+	}
+	return fmt.Errorf("status %s: %s", status, h.Get("Grpc-Message"))
+}
+
+// SidecarTunnel implements the Tunnel interface by delegating to a plugin
+// sidecar process, which runs the tunnel and serves its local port
+type SidecarTunnel struct {
+	server config.Server
+	client *sidecarClient
+	status *TunnelStatus
+	mu     sync.RWMutex
+}
+
+// newSidecarTunnel creates a tunnel served by the given sidecar
+func newSidecarTunnel(server config.Server, client *sidecarClient) *SidecarTunnel {
+	return &SidecarTunnel{
+		server: server,
+		client: client,
+		status: &TunnelStatus{
+			ServerName: server.Name,
+			Status:     "disconnected",
+		},
+	}
+}
+
+// tunnelRef encodes the TunnelRef message naming this tunnel
+func (t *SidecarTunnel) tunnelRef() []byte {
+	return appendProtoBytes(nil, 1, []byte(t.server.Name))
+}
+
+// Start asks the sidecar to start the tunnel with the full server entry
+func (t *SidecarTunnel) Start(ctx context.Context) error {
+	t.mu.Lock()
+	t.status.Status = "connecting"
+	t.status.StartTime = time.Now()
+	t.mu.Unlock()
+
+	serverJSON, err := json.Marshal(t.server)
+	if err != nil {
+		return fmt.Errorf("failed to encode server: %v", err)
+	}
+	req := appendProtoBytes(t.tunnelRef(), 2, serverJSON)
+
+	startCtx, cancel := context.WithTimeout(ctx, t.server.Timeout)
+	defer cancel()
+
+	if _, err := t.client.call(startCtx, "Start", req); err != nil {
+		t.mu.Lock()
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+		t.mu.Unlock()
+		return err
+	}
+
+	t.mu.Lock()
+	t.status.Status = "connected"
+	t.mu.Unlock()
+	return nil
+}
+
+// Stop asks the sidecar to stop the tunnel
+func (t *SidecarTunnel) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), sidecarTimeout)
+	defer cancel()
+
+	_, err := t.client.call(ctx, "Stop", t.tunnelRef())
+
+	t.mu.Lock()
+	t.status.Status = "disconnected"
+	t.mu.Unlock()
+	return err
+}
+
+// GetStatus merges the sidecar's view of a started tunnel into the status
+func (t *SidecarTunnel) GetStatus() *TunnelStatus {
+	t.mu.RLock()
+	statusCopy := *t.status
+	t.mu.RUnlock()
+
+	if statusCopy.Status != "connected" {
+		return &statusCopy
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sidecarTimeout)
+	defer cancel()
+
+	msg, err := t.client.call(ctx, "Status", t.tunnelRef())
+	if err != nil {
+		statusCopy.Status = "error"
+		statusCopy.LastError = err.Error()
+		return &statusCopy
+	}
+
+	// StatusReply: status = 1, last_error = 2, bytes_sent = 3, bytes_recv = 4
+	err = walkProto(msg, func(field, varint uint64, data []byte) {
+		switch field {
+		case 1:
+			statusCopy.Status = string(data)
+		case 2:
+			statusCopy.LastError = string(data)
+		case 3:
+			statusCopy.BytesSent = varint
+		case 4:
+			statusCopy.BytesRecv = varint
+		}
+	})
+	if err != nil {
+		statusCopy.Status = "error"
+		statusCopy.LastError = fmt.Sprintf("invalid status from sidecar: %v", err)
+	}
+	return &statusCopy
+}
+
+// GetName returns the tunnel name
+func (t *SidecarTunnel) GetName() string {
+	return t.server.Name
+}
+
+// Test asks the sidecar to measure the tunnel's latency
+func (t *SidecarTunnel) Test() (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sidecarTimeout)
+	defer cancel()
+
+	msg, err := t.client.call(ctx, "Test", t.tunnelRef())
+	if err != nil {
+		return 0, err
+	}
+
+	// TestReply: latency_ns = 1
+	var latency time.Duration
+	err = walkProto(msg, func(field, varint uint64, _ []byte) {
+		if field == 1 {
+			latency = time.Duration(varint)
+		}
+	})
+	return latency, err
+}
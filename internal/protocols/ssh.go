@@ -5,14 +5,12 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"os/exec"
-	"regexp"
-	"runtime"
-	"strconv"
+	"os"
 	"sync"
 	"time"
 
 	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/probe"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -20,7 +18,10 @@ import (
 // SSHTunnel implements the Tunnel interface for SSH connections
 type SSHTunnel struct {
 	server   config.Server
+	dial     func(server config.Server, timeout time.Duration) (net.Conn, error)
 	client   *ssh.Client
+	channels *channelTracker // Of the current client
+	forwards []*remoteForward
 	listener net.Listener
 	status   *TunnelStatus
 	mu       sync.RWMutex
@@ -32,6 +33,7 @@ type SSHTunnel struct {
 func NewSSHTunnel(server config.Server) *SSHTunnel {
 	return &SSHTunnel{
 		server: server,
+		dial:   dialObfuscated,
 		status: &TunnelStatus{
 			ServerName: server.Name,
 			Status:     "disconnected",
@@ -48,40 +50,39 @@ func (t *SSHTunnel) Start(ctx context.Context) error {
 	t.status.Status = "connecting"
 	t.status.StartTime = time.Now()
 
-	// Create SSH client configuration
-	config := &ssh.ClientConfig{
-		User:            t.server.User,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // In production, use proper host key verification
-		Timeout:         t.server.Timeout,
+	config, err := sshClientConfig(t.server)
+	if err != nil {
+		return err
 	}
 
-	// Add authentication method
-	if t.server.Password != "" {
-		config.Auth = []ssh.AuthMethod{
-			ssh.Password(t.server.Password),
-		}
-	} else if t.server.KeyPath != "" {
-		// TODO: Implement key-based authentication
-		return fmt.Errorf("key-based authentication not yet implemented")
-	} else {
-		return fmt.Errorf("no authentication method provided")
+	// Connect to SSH server through the configured dialer (plain TCP,
+	// an obfuscation layer or the ICMP tunnel)
+	addr := net.JoinHostPort(t.server.Host, t.server.Port)
+	conn, err := t.dial(t.server, t.server.Timeout)
+	if err != nil {
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+		return fmt.Errorf("failed to connect to SSH server: %v", err)
 	}
 
-	// Connect to SSH server
-	addr := fmt.Sprintf("%s:%s", t.server.Host, t.server.Port)
-	client, err := ssh.Dial("tcp", addr, config)
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
 	if err != nil {
+		conn.Close()
 		t.status.Status = "error"
 		t.status.LastError = err.Error()
 		return fmt.Errorf("failed to connect to SSH server: %v", err)
 	}
 
-	t.client = client
+	t.client = ssh.NewClient(sshConn, chans, reqs)
+	t.channels = newChannelTracker(t.server.Name, t.server.Name, addr)
+	t.channels.register()
 	t.status.Status = "connected"
+	go t.watchConnection(t.ctx, t.client)
+	t.forwards = t.startRemoteForwards(t.client)
 
 	// Start the appropriate proxy type
 	switch t.server.Proxy {
-	case "socks5":
+	case "socks5", "socks4", "auto":
 		return t.startSOCKS5()
 	case "http":
 		return t.startHTTP()
@@ -90,6 +91,89 @@ func (t *SSHTunnel) Start(ctx context.Context) error {
 	}
 }
 
+// DialSSH connects and authenticates to an SSH server, over its
+// obfuscation layer or the ICMP tunnel, for a caller that runs its own
+// sessions on it
+func DialSSH(server config.Server) (*ssh.Client, error) {
+	clientConfig, err := sshClientConfig(server)
+	if err != nil {
+		return nil, err
+	}
+	dial := dialObfuscated
+	if server.Transport == config.TransportICMP {
+		dial = dialICMP
+	}
+	conn, err := dial(server, server.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SSH server: %v", err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, net.JoinHostPort(server.Host, server.Port), clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to SSH server: %v", err)
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// sshClientConfig builds the client configuration for a server
+func sshClientConfig(server config.Server) (*ssh.ClientConfig, error) {
+	hostKeyCallback, hostKeyAlgorithms, err := config.HostKeyCallback(server)
+	if err != nil {
+		return nil, err
+	}
+	clientConfig := &ssh.ClientConfig{
+		User:              server.User,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           server.Timeout,
+	}
+
+	// Add authentication method
+	if server.HardwareKey != nil {
+		auth, err := hardwareKeyAuth(server)
+		if err != nil {
+			return nil, err
+		}
+		clientConfig.Auth = []ssh.AuthMethod{auth}
+	} else if server.Password != "" {
+		clientConfig.Auth = []ssh.AuthMethod{
+			ssh.Password(server.Password),
+		}
+	} else if server.KeyPath != "" {
+		signer, err := loadPrivateKey(server.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		clientConfig.Auth = []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		}
+	} else {
+		return nil, fmt.Errorf("no authentication method provided")
+	}
+
+	return clientConfig, nil
+}
+
+// loadPrivateKey reads an unencrypted private key; "~/" is the home
+// directory
+func loadPrivateKey(keyPath string) (ssh.Signer, error) {
+	keyPath = expandHome(keyPath)
+
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %v", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, fmt.Errorf("private key %s is protected by a passphrase, which is not supported", keyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+	return signer, nil
+}
+
 // Stop stops the SSH tunnel
 func (t *SSHTunnel) Stop() error {
 	t.mu.Lock()
@@ -103,15 +187,45 @@ func (t *SSHTunnel) Stop() error {
 		t.listener.Close()
 	}
 
+	for _, f := range t.forwards {
+		f.close()
+	}
+	t.forwards = nil
+
 	if t.client != nil {
 		t.client.Close()
 		t.client = nil
 	}
+	if t.channels != nil {
+		t.channels.unregister()
+		t.channels = nil
+	}
 
 	t.status.Status = "disconnected"
 	return nil
 }
 
+// watchConnection marks the tunnel as failed when the SSH connection drops
+// without the tunnel being stopped
+func (t *SSHTunnel) watchConnection(ctx context.Context, client *ssh.Client) {
+	err := client.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.client == client {
+		t.status.Status = "error"
+		if err != nil {
+			t.status.LastError = err.Error()
+		} else {
+			t.status.LastError = "SSH connection closed"
+		}
+	}
+}
+
 // GetStatus returns the current status
 func (t *SSHTunnel) GetStatus() *TunnelStatus {
 	t.mu.RLock()
@@ -127,21 +241,57 @@ func (t *SSHTunnel) GetName() string {
 	return t.server.Name
 }
 
-// Test tests the connection and measures latency
+// Test measures latency to the server with ICMP echo, or with a TCP
+// connect when ICMP is filtered
 func (t *SSHTunnel) Test() (time.Duration, error) {
-	return t.pingTest()
+	result, err := probe.Latency(t.server.Host, t.server.Port, probe.Options{})
+	if err != nil {
+		return 0, err
+	}
+	return result.Avg, nil
+}
+
+// Dial opens a connection to addr through the SSH session
+func (t *SSHTunnel) Dial(network, addr string) (net.Conn, error) {
+	t.mu.RLock()
+	client, channels := t.client, t.channels
+	t.mu.RUnlock()
+
+	if client == nil {
+		return nil, fmt.Errorf("ssh tunnel %s is not connected", t.server.Name)
+	}
+	return channels.dial(client)(network, addr)
 }
 
-// startSOCKS5 starts a SOCKS5 proxy
+// RunCommand runs a command on the server in a session of the tunnel's
+// SSH connection and returns its combined output
+func (t *SSHTunnel) RunCommand(cmd string) ([]byte, error) {
+	t.mu.RLock()
+	client := t.client
+	t.mu.RUnlock()
+
+	if client == nil {
+		return nil, fmt.Errorf("ssh tunnel %s is not connected", t.server.Name)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session: %v", err)
+	}
+	defer session.Close()
+	return session.CombinedOutput(cmd)
+}
+
+// startSOCKS5 starts a SOCKS proxy, also serving HTTP with the auto proxy
+// type
 func (t *SSHTunnel) startSOCKS5() error {
 	// Create local listener
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", t.server.LocalPort))
+	listener, err := listenLocal(t.server)
 	if err != nil {
 		return fmt.Errorf("failed to create local listener: %v", err)
 	}
 
 	t.listener = listener
-	log.Printf("SOCKS5 proxy started on port %d for %s", t.server.LocalPort, t.server.Name)
+	log.Printf("%s proxy started on port %d for %s", t.server.Proxy, t.server.LocalPort, t.server.Name)
 
 	// Accept connections
 	go t.acceptConnections()
@@ -152,7 +302,7 @@ func (t *SSHTunnel) startSOCKS5() error {
 // startHTTP starts an HTTP proxy
 func (t *SSHTunnel) startHTTP() error {
 	// Create local listener
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", t.server.LocalPort))
+	listener, err := listenLocal(t.server)
 	if err != nil {
 		return fmt.Errorf("failed to create local listener: %v", err)
 	}
@@ -193,57 +343,19 @@ func (t *SSHTunnel) acceptConnections() {
 func (t *SSHTunnel) handleConnection(localConn net.Conn) {
 	defer localConn.Close()
 
-	// This is a simplified implementation
-	// In a full implementation, you would parse SOCKS5/HTTP requests
-	// and establish remote connections through the SSH tunnel
-
-	log.Printf("Handling connection for %s", t.server.Name)
-
-	// For now, just close the connection
-	// TODO: Implement full SOCKS5/HTTP proxy logic
-}
-
-// pingTest performs a ping test to measure latency
-func (t *SSHTunnel) pingTest() (time.Duration, error) {
-	var cmd *exec.Cmd
-	var re *regexp.Regexp
-
-	if runtime.GOOS == "windows" {
-		cmd = exec.Command("ping", "-n", "1", t.server.Host)
-		re = regexp.MustCompile(`time[=<]?(\d+)ms`)
-	} else {
-		cmd = exec.Command("ping", "-c", "1", t.server.Host)
-		re = regexp.MustCompile(`time[=<]([\d.]+) ms`)
-	}
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return 0, fmt.Errorf("ping failed: %v", err)
-	}
+	t.mu.RLock()
+	client, channels := t.client, t.channels
+	t.mu.RUnlock()
 
-	matches := re.FindStringSubmatch(string(output))
-	if len(matches) < 2 {
-		// Fallback to simple connection test
-		return t.connectionTest()
+	if client == nil {
+		return
 	}
 
-	latencyFloat, err := strconv.ParseFloat(matches[1], 64)
-	if err != nil {
-		return t.connectionTest()
+	var packets PacketFunc
+	if t.server.UDP != nil {
+		packets = t.ListenPacket
 	}
-
-	return time.Duration(latencyFloat * float64(time.Millisecond)), nil
-}
-
-// connectionTest performs a simple connection test
-func (t *SSHTunnel) connectionTest() (time.Duration, error) {
-	start := time.Now()
-
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%s", t.server.Host, t.server.Port), 5*time.Second)
-	if err != nil {
-		return 0, err
+	if err := handleInboundUDP(localConn, t.server.Proxy, channels.dial(client), packets); err != nil {
+		log.Printf("Connection error for %s: %v", t.server.Name, err)
 	}
-	defer conn.Close()
-
-	return time.Since(start), nil
 }
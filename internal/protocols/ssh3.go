@@ -0,0 +1,433 @@
+package protocols
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/ssh"
+
+	"ssh-tunnel/internal/config"
+)
+
+// SSH3 runs each proxied connection as a CONNECT request on its own QUIC
+// stream, so a lost packet only stalls the connection it belongs to. The
+// first request on a connection is an extended CONNECT (":protocol ssh3")
+// to the configured path that logs in: the companion server logs in to
+// its host's sshd with the user's password, or with the user's key by
+// relaying sshd's signing requests over the request's stream, and then
+// forwards the CONNECTs through that SSH connection.
+const (
+	ssh3Protocol        = "ssh3"
+	ssh3PublicKeyHeader = "Ssh3-Public-Key" // The user's key, in authorized_keys format
+
+	// Messages on the login stream: a type, a 4-byte length and a payload
+	ssh3MsgOK        = 0x00
+	ssh3MsgFailure   = 0x01 // Payload: the reason
+	ssh3MsgSign      = 0x02 // Payload: the data sshd wants signed
+	ssh3MsgSignature = 0x03 // Payload: the signature, in SSH wire format
+
+	ssh3MaxMessage = 64 << 10
+	ssh3KeepAlive  = 15 * time.Second
+)
+
+// SSH3Tunnel implements the Tunnel interface for the experimental SSH over
+// HTTP/3 transport. A lost connection is redialed on the next use.
+type SSH3Tunnel struct {
+	server   config.Server
+	signer   ssh.Signer // Set with key_path
+	listener net.Listener
+	status   *TunnelStatus
+	mu       sync.RWMutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	connMu sync.Mutex // Serializes dialing
+	client *http3.ClientConn
+}
+
+// NewSSH3Tunnel creates a new SSH3 tunnel
+func NewSSH3Tunnel(server config.Server) *SSH3Tunnel {
+	return &SSH3Tunnel{
+		server: server,
+		status: &TunnelStatus{
+			ServerName: server.Name,
+			Status:     "disconnected",
+		},
+	}
+}
+
+// Start connects and logs in to the companion server and opens the local
+// proxy
+func (t *SSH3Tunnel) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.server.KeyPath != "" {
+		signer, err := loadPrivateKey(t.server.KeyPath)
+		if err != nil {
+			return err
+		}
+		t.signer = signer
+	}
+
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	t.status.Status = "connecting"
+	t.status.StartTime = time.Now()
+
+	if _, _, err := t.connect(); err != nil {
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+		return err
+	}
+
+	listener, err := listenLocal(t.server)
+	if err != nil {
+		t.closeConn()
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+		return fmt.Errorf("failed to create local listener: %v", err)
+	}
+
+	t.listener = listener
+	t.status.Status = "connected"
+	log.Printf("%s proxy started on port %d for %s (ssh3)", t.server.Proxy, t.server.LocalPort, t.server.Name)
+
+	go t.acceptConnections()
+
+	return nil
+}
+
+// Stop stops the SSH3 tunnel
+func (t *SSH3Tunnel) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cancel != nil {
+		t.cancel()
+	}
+
+	if t.listener != nil {
+		t.listener.Close()
+		t.listener = nil
+	}
+
+	t.closeConn()
+
+	t.status.Status = "disconnected"
+	return nil
+}
+
+// GetStatus returns the current status
+func (t *SSH3Tunnel) GetStatus() *TunnelStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	statusCopy := *t.status
+	return &statusCopy
+}
+
+// GetName returns the tunnel name
+func (t *SSH3Tunnel) GetName() string {
+	return t.server.Name
+}
+
+// Test times a QUIC version negotiation round trip with the server
+func (t *SSH3Tunnel) Test() (time.Duration, error) {
+	return quicPing(t.server)
+}
+
+// Dial opens a CONNECT request stream to addr, which the companion server
+// reaches through sshd
+func (t *SSH3Tunnel) Dial(network, addr string) (net.Conn, error) {
+	client, err := t.connection()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(t.ctx, t.server.Timeout)
+	defer cancel()
+	stream, err := client.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SSH3 stream: %v", err)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Host:   addr,
+		URL:    &url.URL{Host: addr},
+		Header: make(http.Header),
+	}
+	stream.SetReadDeadline(time.Now().Add(t.server.Timeout))
+	if err := stream.SendRequestHeader(req); err != nil {
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, fmt.Errorf("failed to send SSH3 connect: %v", err)
+	}
+	resp, err := stream.ReadResponse()
+	if err != nil {
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, fmt.Errorf("failed to read SSH3 connect response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		reason, _ := io.ReadAll(io.LimitReader(stream, 512))
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, fmt.Errorf("ssh3 server could not reach %s: %s %s", addr, resp.Status, strings.TrimSpace(string(reason)))
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	return &quicStreamConn{Stream: stream, local: client.LocalAddr(), remote: client.RemoteAddr()}, nil
+}
+
+// connection returns the connection to the server, dialing a new one when
+// it was lost
+func (t *SSH3Tunnel) connection() (*http3.ClientConn, error) {
+	t.mu.RLock()
+	ctx := t.ctx
+	t.mu.RUnlock()
+	if ctx == nil || ctx.Err() != nil {
+		return nil, fmt.Errorf("tunnel %s is not running", t.server.Name)
+	}
+
+	client, dialed, err := t.connect()
+	if err != nil || dialed {
+		// A failed redial is reported for the supervisor to restart the
+		// tunnel; a later successful one clears it
+		t.mu.Lock()
+		if err != nil {
+			t.status.Status = "error"
+			t.status.LastError = err.Error()
+		} else if t.status.Status == "error" {
+			t.status.Status = "connected"
+		}
+		t.mu.Unlock()
+	}
+	return client, err
+}
+
+// connect dials and logs in unless the current connection is still up,
+// and reports whether it dialed. Start calls it holding t.mu, so it only
+// takes connMu.
+func (t *SSH3Tunnel) connect() (*http3.ClientConn, bool, error) {
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
+
+	if t.client != nil && t.client.Context().Err() == nil {
+		return t.client, false, nil
+	}
+
+	addr := net.JoinHostPort(t.server.Host, t.server.Port)
+	ctx, cancel := context.WithTimeout(t.ctx, t.server.Timeout)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, t.tlsConfig(), &quic.Config{
+		KeepAlivePeriod:      ssh3KeepAlive,
+		HandshakeIdleTimeout: t.server.Timeout,
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+
+	client := (&http3.Transport{}).NewClientConn(conn)
+	login, err := t.login(ctx, client)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, false, err
+	}
+
+	// The server ends the login stream when its SSH connection ends
+	go func() {
+		io.Copy(io.Discard, login)
+		conn.CloseWithError(0, "")
+	}()
+
+	t.client = client
+	return client, true, nil
+}
+
+// login sends the extended CONNECT that logs in, signs what sshd asks the
+// key to sign, and returns the login stream, which lasts as long as the
+// server's SSH connection
+func (t *SSH3Tunnel) login(ctx context.Context, client *http3.ClientConn) (http3.RequestStream, error) {
+	stream, err := client.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SSH3 stream: %v", err)
+	}
+	authority := net.JoinHostPort(t.server.Host, t.server.Port)
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Proto:  ssh3Protocol,
+		Host:   authority,
+		URL:    &url.URL{Scheme: "https", Host: authority, Path: t.server.SSH3.Path},
+		Header: make(http.Header),
+	}
+	req.SetBasicAuth(t.server.User, t.server.Password)
+	if t.signer != nil {
+		key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(t.signer.PublicKey())))
+		req.Header.Set(ssh3PublicKeyHeader, key)
+	}
+
+	deadline, _ := ctx.Deadline()
+	stream.SetDeadline(deadline)
+	if err := stream.SendRequestHeader(req); err != nil {
+		return nil, fmt.Errorf("failed to send SSH3 login: %v", err)
+	}
+	resp, err := stream.ReadResponse()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH3 login response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ssh3 server refused the login: %s", resp.Status)
+	}
+
+	for {
+		kind, payload, err := readSSH3Message(stream)
+		if err != nil {
+			return nil, fmt.Errorf("ssh3 login failed: %v", err)
+		}
+		switch kind {
+		case ssh3MsgOK:
+			stream.SetDeadline(time.Time{})
+			return stream, nil
+		case ssh3MsgFailure:
+			return nil, fmt.Errorf("ssh3 login failed: %s", payload)
+		case ssh3MsgSign:
+			signature, err := t.sign(payload)
+			if err != nil {
+				writeSSH3Message(stream, ssh3MsgFailure, []byte(err.Error()))
+				return nil, err
+			}
+			if err := writeSSH3Message(stream, ssh3MsgSignature, ssh.Marshal(signature)); err != nil {
+				return nil, fmt.Errorf("ssh3 login failed: %v", err)
+			}
+		default:
+			return nil, fmt.Errorf("ssh3 login failed: unexpected message %d", kind)
+		}
+	}
+}
+
+// sign signs a publickey authentication request sshd sent the companion
+// server, after checking that it is one, for this user and key, so the
+// server cannot get anything else signed
+func (t *SSH3Tunnel) sign(data []byte) (*ssh.Signature, error) {
+	if t.signer == nil {
+		return nil, errors.New("ssh3 server asked for a signature, but no key is configured")
+	}
+
+	// RFC 4252 section 7: the session identifier, then the request
+	rest, malformed := data, false
+	field := func() []byte {
+		if len(rest) < 4 || uint64(len(rest)-4) < uint64(binary.BigEndian.Uint32(rest)) {
+			malformed = true
+			return nil
+		}
+		size := binary.BigEndian.Uint32(rest)
+		f := rest[4 : 4+size]
+		rest = rest[4+size:]
+		return f
+	}
+	flag := func() byte {
+		if len(rest) < 1 {
+			malformed = true
+			return 0
+		}
+		b := rest[0]
+		rest = rest[1:]
+		return b
+	}
+	field()
+	msg, user, service, method := flag(), field(), field(), field()
+	hasSignature, algorithm, key := flag(), field(), field()
+	if malformed || len(rest) != 0 || msg != 50 || hasSignature != 1 || // SSH_MSG_USERAUTH_REQUEST
+		string(user) != t.server.User || string(service) != "ssh-connection" || string(method) != "publickey" ||
+		!bytes.Equal(key, t.signer.PublicKey().Marshal()) {
+		return nil, errors.New("ssh3 server asked to sign something other than this user's login")
+	}
+
+	if signer, ok := t.signer.(ssh.AlgorithmSigner); ok {
+		return signer.SignWithAlgorithm(rand.Reader, data, string(algorithm))
+	}
+	return t.signer.Sign(rand.Reader, data)
+}
+
+// closeConn closes the connection to the server
+func (t *SSH3Tunnel) closeConn() {
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
+
+	if t.client != nil {
+		t.client.CloseWithError(0, "")
+		t.client = nil
+	}
+}
+
+func (t *SSH3Tunnel) tlsConfig() *tls.Config {
+	serverName := t.server.SSH3.SNI
+	if serverName == "" {
+		serverName = t.server.Host
+	}
+	return &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         []string{http3.NextProtoH3},
+		InsecureSkipVerify: t.server.InsecureSkipVerify,
+	}
+}
+
+// acceptConnections accepts and handles incoming connections
+func (t *SSH3Tunnel) acceptConnections() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if t.ctx.Err() != nil {
+				return // Context cancelled
+			}
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := handleInbound(conn, t.server.Proxy, t.Dial); err != nil {
+				log.Printf("Connection error for %s: %v", t.server.Name, err)
+			}
+		}()
+	}
+}
+
+// writeSSH3Message writes a login stream message
+func writeSSH3Message(w io.Writer, kind byte, payload []byte) error {
+	b := binary.BigEndian.AppendUint32([]byte{kind}, uint32(len(payload)))
+	_, err := w.Write(append(b, payload...))
+	return err
+}
+
+// readSSH3Message reads a login stream message
+func readSSH3Message(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > ssh3MaxMessage {
+		return 0, nil, fmt.Errorf("message of %d bytes is too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
@@ -0,0 +1,252 @@
+package protocols
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/ssh"
+)
+
+// ssh3LoginTimeout bounds a login, including the client's signatures
+const ssh3LoginTimeout = 30 * time.Second
+
+// SSH3Server is the companion server of the SSH3 transport. It serves
+// HTTP/3, logs each client connection in to sshd with the client's
+// credentials and forwards the client's CONNECT requests through that SSH
+// connection, so sshd's accounts and forwarding rules still apply. Other
+// requests get a 404.
+type SSH3Server struct {
+	tlsConfig *tls.Config
+	path      string
+	sshAddr   string
+	hostKeys  ssh.HostKeyCallback
+
+	mu       sync.Mutex
+	sessions map[http3.Connection]*ssh.Client
+}
+
+// NewSSH3Server creates the companion server for clients that log in at
+// path, with the certificate they verify. hostKeys verifies the sshd at
+// sshAddr.
+func NewSSH3Server(certFile, keyFile, path, sshAddr string, hostKeys ssh.HostKeyCallback) (*SSH3Server, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %v", err)
+	}
+	return &SSH3Server{
+		tlsConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		path:      path,
+		sshAddr:   sshAddr,
+		hostKeys:  hostKeys,
+		sessions:  make(map[http3.Connection]*ssh.Client),
+	}, nil
+}
+
+// SSHDHostKeys verifies sshd against the public keys in the files matching
+// pattern, such as /etc/ssh/ssh_host_*_key.pub
+func SSHDHostKeys(pattern string) (ssh.HostKeyCallback, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host key pattern %s: %v", pattern, err)
+	}
+
+	var keys [][]byte
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read host key: %v", err)
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse host key %s: %v", file, err)
+		}
+		keys = append(keys, key.Marshal())
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no host keys match %s", pattern)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		for _, known := range keys {
+			if bytes.Equal(known, key.Marshal()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("sshd at %s presented an unknown host key", hostname)
+	}, nil
+}
+
+// Serve serves HTTP/3 on conn until it is closed
+func (s *SSH3Server) Serve(conn net.PacketConn) error {
+	server := &http3.Server{
+		Handler:    s,
+		TLSConfig:  s.tlsConfig,
+		QUICConfig: &quic.Config{KeepAlivePeriod: ssh3KeepAlive},
+	}
+	return server.Serve(conn)
+}
+
+func (s *SSH3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.NotFound(w, r)
+		return
+	}
+	conn := w.(http3.Hijacker).Connection()
+
+	if r.Proto == ssh3Protocol {
+		if r.URL.Path != s.path {
+			http.NotFound(w, r)
+			return
+		}
+		s.login(w, r, conn)
+		return
+	}
+	s.forward(w, r, conn)
+}
+
+// login logs the connection in to sshd and keeps the SSH connection until
+// the login stream or the QUIC connection ends
+func (s *SSH3Server) login(w http.ResponseWriter, r *http.Request, conn http3.Connection) {
+	user, password, ok := r.BasicAuth()
+	if !ok || user == "" {
+		http.Error(w, "login required", http.StatusUnauthorized)
+		return
+	}
+	var key ssh.PublicKey
+	if line := r.Header.Get(ssh3PublicKeyHeader); line != "" {
+		var err error
+		if key, _, _, _, err = ssh.ParseAuthorizedKey([]byte(line)); err != nil {
+			http.Error(w, "invalid public key", http.StatusBadRequest)
+			return
+		}
+	}
+	s.mu.Lock()
+	loggedIn := s.sessions[conn] != nil
+	s.mu.Unlock()
+	if loggedIn {
+		http.Error(w, "already logged in", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	stream := w.(http3.HTTPStreamer).HTTPStream()
+	defer stream.Close()
+
+	var auth []ssh.AuthMethod
+	if key != nil {
+		auth = append(auth, ssh.PublicKeys(&ssh3RelaySigner{key: key, stream: stream}))
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	stream.SetDeadline(time.Now().Add(ssh3LoginTimeout))
+	client, err := ssh.Dial("tcp", s.sshAddr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: s.hostKeys,
+		Timeout:         ssh3LoginTimeout,
+	})
+	if err != nil {
+		log.Printf("SSH3 login for %s from %s failed: %v", user, conn.RemoteAddr(), err)
+		writeSSH3Message(stream, ssh3MsgFailure, []byte(fmt.Sprintf("login to sshd failed: %v", err)))
+		return
+	}
+	defer client.Close()
+
+	s.mu.Lock()
+	if s.sessions[conn] != nil {
+		s.mu.Unlock()
+		writeSSH3Message(stream, ssh3MsgFailure, []byte("already logged in"))
+		return
+	}
+	s.sessions[conn] = client
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, conn)
+		s.mu.Unlock()
+	}()
+
+	stream.SetDeadline(time.Time{})
+	if err := writeSSH3Message(stream, ssh3MsgOK, nil); err != nil {
+		return
+	}
+	log.Printf("SSH3 session for %s from %s", user, conn.RemoteAddr())
+
+	// Ending the login stream tells the client the SSH connection is gone
+	go func() {
+		client.Wait()
+		stream.CancelRead(0)
+	}()
+	io.Copy(io.Discard, stream)
+}
+
+// forward relays a CONNECT request's stream to its target through the
+// connection's SSH connection
+func (s *SSH3Server) forward(w http.ResponseWriter, r *http.Request, conn http3.Connection) {
+	s.mu.Lock()
+	client := s.sessions[conn]
+	s.mu.Unlock()
+	if client == nil {
+		http.Error(w, "login required", http.StatusForbidden)
+		return
+	}
+
+	remote, err := client.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer remote.Close()
+
+	w.WriteHeader(http.StatusOK)
+	local := &quicStreamConn{Stream: w.(http3.HTTPStreamer).HTTPStream(), local: conn.LocalAddr(), remote: conn.RemoteAddr()}
+	defer local.Close()
+
+	relay(local, remote)
+}
+
+// ssh3RelaySigner signs with the client's key by asking the client over
+// the login stream
+type ssh3RelaySigner struct {
+	key    ssh.PublicKey
+	stream io.ReadWriter
+}
+
+func (s *ssh3RelaySigner) PublicKey() ssh.PublicKey {
+	return s.key
+}
+
+func (s *ssh3RelaySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+// SignWithAlgorithm relays data, which names the algorithm, to the client
+func (s *ssh3RelaySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	if err := writeSSH3Message(s.stream, ssh3MsgSign, data); err != nil {
+		return nil, err
+	}
+	kind, payload, err := readSSH3Message(s.stream)
+	if err != nil {
+		return nil, err
+	}
+	if kind != ssh3MsgSignature {
+		return nil, fmt.Errorf("client refused to sign: %s", payload)
+	}
+	signature := new(ssh.Signature)
+	if err := ssh.Unmarshal(payload, signature); err != nil {
+		return nil, fmt.Errorf("invalid signature: %v", err)
+	}
+	return signature, nil
+}
@@ -0,0 +1,354 @@
+package protocols
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/ssh"
+
+	"ssh-tunnel/internal/config"
+)
+
+const (
+	testSSH3User     = "tunnel"
+	testSSH3Password = "ssh3 secret"
+)
+
+// testSSHD is an sshd that accepts the test user's password and the
+// authorized key, and opens direct-tcpip channels. Results reports each
+// channel's target.
+type testSSHD struct {
+	addr    string
+	hostKey ssh.PublicKey
+	results chan string
+	conns   chan *ssh.ServerConn
+}
+
+func newTestSSHD(t *testing.T, authorized ssh.PublicKey) *testSSHD {
+	t.Helper()
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == testSSH3User && string(password) == testSSH3Password {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if authorized != nil && meta.User() == testSSH3User && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	cfg.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	d := &testSSHD{
+		addr:    ln.Addr().String(),
+		hostKey: hostKey.PublicKey(),
+		results: make(chan string, 16),
+		conns:   make(chan *ssh.ServerConn, 4),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sconn, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				d.conns <- sconn
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					go d.directTCPIP(newChannel)
+				}
+			}()
+		}
+	}()
+	return d
+}
+
+func (d *testSSHD) directTCPIP(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &payload) != nil {
+		newChannel.Reject(ssh.UnknownChannelType, "direct-tcpip only")
+		return
+	}
+	target := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	d.results <- target
+	remote, err := net.Dial("tcp", target)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer remote.Close()
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(channel, remote)
+		channel.CloseWrite()
+	}()
+	io.Copy(remote, channel)
+}
+
+// newSSH3TestServer runs the companion server in front of sshd
+func newSSH3TestServer(t *testing.T, sshd *testSSHD) string {
+	t.Helper()
+
+	certFile, keyFile := writeTestCert(t, "127.0.0.1")
+	server, err := NewSSH3Server(certFile, keyFile, "/ssh3-term", sshd.addr, ssh.FixedHostKey(sshd.hostKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go server.Serve(conn)
+	return conn.LocalAddr().String()
+}
+
+func ssh3TestTunnel(t *testing.T, addr, password string, signer ssh.Signer) *SSH3Tunnel {
+	t.Helper()
+
+	host, port, _ := net.SplitHostPort(addr)
+	tunnel := NewSSH3Tunnel(config.Server{
+		Name:               "ssh3",
+		Host:               host,
+		Port:               port,
+		User:               testSSH3User,
+		Password:           password,
+		Transport:          config.TransportSSH3,
+		Timeout:            5 * time.Second,
+		InsecureSkipVerify: true,
+		SSH3:               &config.SSH3Config{Path: "/ssh3-term"},
+	})
+	tunnel.signer = signer
+	tunnel.ctx, tunnel.cancel = context.WithCancel(context.Background())
+	t.Cleanup(func() { tunnel.Stop() })
+	return tunnel
+}
+
+// ssh3Echo sends payload through the tunnel to the echo server at target
+func ssh3Echo(t *testing.T, tunnel *SSH3Tunnel, target string, payload []byte) {
+	t.Helper()
+
+	conn, err := tunnel.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go conn.Write(payload)
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("echo differs from what was sent")
+	}
+}
+
+func TestSSH3Password(t *testing.T) {
+	sshd := newTestSSHD(t, nil)
+	tunnel := ssh3TestTunnel(t, newSSH3TestServer(t, sshd), testSSH3Password, nil)
+	target := echoServer(t)
+
+	// Each connection runs on its own stream over the one login
+	for i := 0; i < 3; i++ {
+		ssh3Echo(t, tunnel, target, bytes.Repeat([]byte("ssh3 stream "), 10000))
+		if result := <-sshd.results; result != target {
+			t.Errorf("sshd result = %q, want %q", result, target)
+		}
+	}
+	if n := len(sshd.conns); n != 1 {
+		t.Errorf("companion made %d SSH connections, want 1", n)
+	}
+}
+
+func TestSSH3PublicKey(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RSA keys sign with the rsa-sha2 algorithm sshd picks
+	for name, key := range map[string]interface{}{"ed25519": edKey, "rsa": rsaKey} {
+		t.Run(name, func(t *testing.T) {
+			signer, err := ssh.NewSignerFromKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sshd := newTestSSHD(t, signer.PublicKey())
+			tunnel := ssh3TestTunnel(t, newSSH3TestServer(t, sshd), "", signer)
+			target := echoServer(t)
+
+			ssh3Echo(t, tunnel, target, []byte("signed in"))
+			if result := <-sshd.results; result != target {
+				t.Errorf("sshd result = %q, want %q", result, target)
+			}
+		})
+	}
+}
+
+func TestSSH3LoginFailure(t *testing.T) {
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	other, _ := ssh.NewSignerFromKey(otherKey)
+
+	sshd := newTestSSHD(t, nil)
+	addr := newSSH3TestServer(t, sshd)
+	for name, tunnel := range map[string]*SSH3Tunnel{
+		"password": ssh3TestTunnel(t, addr, "wrong", nil),
+		"key":      ssh3TestTunnel(t, addr, "", other),
+	} {
+		if _, err := tunnel.Dial("tcp", "127.0.0.1:80"); err == nil || !strings.Contains(err.Error(), "login failed") {
+			t.Errorf("%s: Dial error = %v, want a failed login", name, err)
+		}
+	}
+}
+
+// TestSSH3SignOnlyLogins checks that the client only signs a publickey
+// login for its own user and key
+func TestSSH3SignOnlyLogins(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(key)
+	tunnel := NewSSH3Tunnel(config.Server{User: testSSH3User})
+	tunnel.signer = signer
+
+	login := func(user, method string) []byte {
+		var b []byte
+		for i, field := range []string{"session", "", user, "ssh-connection", method, "", "ssh-ed25519", string(signer.PublicKey().Marshal())} {
+			switch i {
+			case 1:
+				b = append(b, 50)
+			case 5:
+				b = append(b, 1)
+			default:
+				b = binary.BigEndian.AppendUint32(b, uint32(len(field)))
+				b = append(b, field...)
+			}
+		}
+		return b
+	}
+
+	signature, err := tunnel.sign(login(testSSH3User, "publickey"))
+	if err != nil {
+		t.Fatalf("sign login: %v", err)
+	}
+	if err := signer.PublicKey().Verify(login(testSSH3User, "publickey"), signature); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+	for name, data := range map[string][]byte{
+		"other user":   login("root", "publickey"),
+		"other method": login(testSSH3User, "hostbased"),
+		"not a login":  []byte("arbitrary data"),
+		"trailing":     append(login(testSSH3User, "publickey"), 0),
+	} {
+		if _, err := tunnel.sign(data); err == nil {
+			t.Errorf("%s: signed", name)
+		}
+	}
+}
+
+// TestSSH3RequiresLogin checks what a client that has not logged in gets
+func TestSSH3RequiresLogin(t *testing.T) {
+	addr := newSSH3TestServer(t, newTestSSHD(t, nil))
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer transport.Close()
+
+	resp, err := transport.RoundTrip(&http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Scheme: "https", Host: addr, Path: "/ssh3-term"},
+		Header: make(http.Header),
+	})
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET status = %d, want 404", resp.StatusCode)
+	}
+
+	resp, err = transport.RoundTrip(&http.Request{
+		Method: http.MethodConnect,
+		Host:   "127.0.0.1:22",
+		URL:    &url.URL{Scheme: "https", Host: addr},
+		Header: make(http.Header),
+	})
+	if err != nil {
+		t.Fatalf("CONNECT: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("CONNECT status = %d, want 403", resp.StatusCode)
+	}
+}
+
+// TestSSH3Redial checks that losing the companion's SSH connection ends
+// the client's connection, and the next use logs in again
+func TestSSH3Redial(t *testing.T) {
+	sshd := newTestSSHD(t, nil)
+	tunnel := ssh3TestTunnel(t, newSSH3TestServer(t, sshd), testSSH3Password, nil)
+	target := echoServer(t)
+
+	ssh3Echo(t, tunnel, target, []byte("before"))
+	<-sshd.results
+
+	tunnel.connMu.Lock()
+	lost := tunnel.client.Context()
+	tunnel.connMu.Unlock()
+	(<-sshd.conns).Close()
+	select {
+	case <-lost.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client kept the connection of a lost login")
+	}
+
+	ssh3Echo(t, tunnel, target, []byte("after"))
+	<-sshd.results
+	if n := len(sshd.conns); n != 1 {
+		t.Errorf("companion made %d new SSH connections, want 1", n)
+	}
+}
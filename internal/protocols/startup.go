@@ -0,0 +1,151 @@
+package protocols
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"ssh-tunnel/internal/config"
+)
+
+// Components reported in a startup report besides servers
+const (
+	componentServer      = "server"
+	componentMixed       = "mixed_port"
+	componentShadowsocks = "shadowsocks"
+	componentUDPForward  = "udp_forward"
+	componentAutoSelect  = "auto_select"
+)
+
+// statusFailed is the status reported for servers whose tunnel could not
+// be created, which have no supervisor
+const statusFailed = "failed"
+
+// StartupResult is how one server or listener fared when the manager
+// started
+type StartupResult struct {
+	Component string `json:"component"` // "server", "mixed_port", "shadowsocks", "udp_forward" or "auto_select"
+	Name      string `json:"name"`
+	OK        bool   `json:"ok"`
+	Required  bool   `json:"required,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// StartupReport collects the results of the last Start
+type StartupReport struct {
+	Time    time.Time       `json:"time"`
+	Strict  bool            `json:"strict"`
+	Results []StartupResult `json:"results"`
+}
+
+// Failures returns the results that failed
+func (r StartupReport) Failures() []StartupResult {
+	var failed []StartupResult
+	for _, result := range r.Results {
+		if !result.OK {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// RequiredFailures returns the failed results of required servers
+func (r StartupReport) RequiredFailures() []StartupResult {
+	var failed []StartupResult
+	for _, result := range r.Failures() {
+		if result.Required {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Summary describes the report in one line, e.g. "4 of 5 servers started;
+// failed: b (unsupported transport)"
+func (r StartupReport) Summary() string {
+	servers, started := 0, 0
+	for _, result := range r.Results {
+		if result.Component == componentServer {
+			servers++
+			if result.OK {
+				started++
+			}
+		}
+	}
+
+	summary := fmt.Sprintf("%d of %d servers started", started, servers)
+	failures := r.Failures()
+	if len(failures) == 0 {
+		return summary
+	}
+	parts := make([]string, 0, len(failures))
+	for _, result := range failures {
+		name := result.Name
+		if result.Component != componentServer {
+			name = result.Component + " " + name
+		}
+		if result.Required {
+			name += " [required]"
+		}
+		parts = append(parts, fmt.Sprintf("%s (%s)", name, result.Error))
+	}
+	return summary + "; failed: " + strings.Join(parts, ", ")
+}
+
+// StartupError is returned by Start in strict mode when required servers
+// failed to start
+type StartupError struct {
+	Report StartupReport
+}
+
+func (e *StartupError) Error() string {
+	var names []string
+	for _, result := range e.Report.RequiredFailures() {
+		names = append(names, result.Name)
+	}
+	return fmt.Sprintf("required servers failed to start: %s", strings.Join(names, ", "))
+}
+
+// requiredServers returns the names of the servers whose failure fails a
+// strict startup: those marked required, or every enabled server when
+// none is
+func requiredServers(cfg *config.Config) map[string]bool {
+	required := make(map[string]bool)
+	for _, server := range cfg.Servers {
+		if server.Enabled && server.Required {
+			required[server.Name] = true
+		}
+	}
+	if len(required) == 0 && cfg.StrictStartup {
+		for _, server := range cfg.Servers {
+			if server.Enabled {
+				required[server.Name] = true
+			}
+		}
+	}
+	return required
+}
+
+// recordStartup adds how a listener or auto-selection fared to the report
+// of the current Start
+func (tm *TunnelManager) recordStartup(component, name string, err error) {
+	result := StartupResult{Component: component, Name: name, OK: err == nil}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tm.startup.Results = append(tm.startup.Results, result)
+}
+
+// StartupReport returns the results of the last Start
+func (tm *TunnelManager) StartupReport() StartupReport {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	report := tm.startup
+	report.Results = append([]StartupResult(nil), tm.startup.Results...)
+	return report
+}
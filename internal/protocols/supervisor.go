@@ -0,0 +1,250 @@
+package protocols
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/crash"
+)
+
+// TunnelState is a step in a tunnel's lifecycle:
+// idle → connecting → connected, and connecting/connected → backoff →
+// connecting after a failure. Stopping returns the tunnel to idle.
+type TunnelState string
+
+const (
+	StateIdle       TunnelState = "idle"
+	StateConnecting TunnelState = "connecting"
+	StateConnected  TunnelState = "connected"
+	StateBackoff    TunnelState = "backoff"
+)
+
+// Supervisor timing
+const (
+	minBackoff     = time.Second
+	maxBackoff     = time.Minute
+	healthInterval = 2 * time.Second
+)
+
+// supervisor owns the lifecycle of a single tunnel. Its goroutine is the
+// only writer of the tunnel's state; callers read snapshots.
+type supervisor struct {
+	tunnel     Tunnel
+	maxRetries int
+	onChange   func() // Called after every status change, without s.mu held
+
+	// Timing, replaced by tests
+	healthInterval time.Duration
+	wait           func(ctx context.Context, d time.Duration) bool
+
+	mu      sync.Mutex
+	status  TunnelStatus
+	cancel  context.CancelFunc
+	done    chan struct{}
+	running bool
+}
+
+// newSupervisor creates an idle supervisor. maxRetries bounds consecutive
+// failed attempts before giving up; zero retries forever. onChange may be
+// nil.
+func newSupervisor(tunnel Tunnel, maxRetries int, onChange func()) *supervisor {
+	return &supervisor{
+		tunnel:     tunnel,
+		maxRetries: maxRetries,
+		onChange:   onChange,
+
+		healthInterval: healthInterval,
+		wait:           waitBackoff,
+
+		status: TunnelStatus{
+			ServerName: tunnel.GetName(),
+			Status:     string(StateIdle),
+		},
+	}
+}
+
+// start launches the supervisor loop under parent. It is a no-op if the
+// supervisor is already running.
+func (s *supervisor) start(parent context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.running = true
+	s.status.LastError = ""
+	s.status.Retries = 0
+
+	go s.run(ctx, s.done)
+}
+
+// stop cancels the loop and waits until the tunnel has been stopped
+func (s *supervisor) stop() {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
+	cancel, done := s.cancel, s.done
+	s.mu.Unlock()
+
+	cancel()
+	<-done
+}
+
+// isRunning reports whether the supervisor loop is active
+func (s *supervisor) isRunning() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.running
+}
+
+// snapshot returns a copy of the current status
+func (s *supervisor) snapshot() TunnelStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.status
+}
+
+// setLatency records the latest latency measurement
+func (s *supervisor) setLatency(latency time.Duration) {
+	s.mu.Lock()
+	s.status.Latency = latency
+	s.mu.Unlock()
+	s.changed()
+}
+
+// changed notifies the owner that the status was updated
+func (s *supervisor) changed() {
+	if s.onChange != nil {
+		s.onChange()
+	}
+}
+
+func (s *supervisor) setState(state TunnelState, err error) {
+	s.mu.Lock()
+	defer s.changed()
+	defer s.mu.Unlock()
+
+	s.status.Status = string(state)
+	switch state {
+	case StateConnecting:
+		s.status.StartTime = time.Now()
+	case StateConnected:
+		s.status.LastError = ""
+		s.status.Retries = 0
+	}
+	if err != nil {
+		s.status.LastError = err.Error()
+	}
+}
+
+// run drives the state machine until ctx is cancelled or retries are
+// exhausted, then stops the tunnel and returns to idle
+func (s *supervisor) run(ctx context.Context, done chan struct{}) {
+	name := s.tunnel.GetName()
+	defer func() {
+		if err := s.tunnel.Stop(); err != nil {
+			log.Printf("Failed to stop tunnel %s: %v", name, err)
+		}
+		s.mu.Lock()
+		s.status.Status = string(StateIdle)
+		s.running = false
+		s.mu.Unlock()
+		s.changed()
+		close(done)
+	}()
+
+	backoff := minBackoff
+	failures := 0
+	for {
+		s.setState(StateConnecting, nil)
+		// A panic fails the attempt like any error, so the tunnel restarts
+		err := crash.Catch("tunnel "+name, func() error { return s.tunnel.Start(ctx) })
+		if err == nil {
+			s.setState(StateConnected, nil)
+			log.Printf("Tunnel %s connected", name)
+			backoff, failures = minBackoff, 0
+
+			err = crash.Catch("tunnel "+name, func() error { return s.watch(ctx) })
+			if err == nil {
+				return // Stopped
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Release whatever the failed attempt left behind before retrying
+		s.tunnel.Stop()
+
+		failures++
+		if s.maxRetries > 0 && failures > s.maxRetries {
+			s.setState(StateIdle, err)
+			log.Printf("Tunnel %s failed %d times, giving up: %v", name, failures, err)
+			return
+		}
+
+		s.mu.Lock()
+		s.status.Status = string(StateBackoff)
+		s.status.LastError = err.Error()
+		s.status.Retries = failures
+		s.mu.Unlock()
+		s.changed()
+		log.Printf("Tunnel %s failed, retrying in %v: %v", name, backoff, err)
+
+		if !s.wait(ctx, backoff) {
+			return
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// waitBackoff sleeps for d, returning false if ctx is cancelled first
+func waitBackoff(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// watch polls a connected tunnel until ctx is cancelled (returning nil) or
+// the tunnel reports an error
+func (s *supervisor) watch(ctx context.Context) error {
+	ticker := time.NewTicker(s.healthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			status := s.tunnel.GetStatus()
+			if status.Status == "error" {
+				if status.LastError != "" {
+					return fmt.Errorf("connection lost: %s", status.LastError)
+				}
+				return fmt.Errorf("connection lost")
+			}
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package protocols
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTunnel is a Tunnel whose Start results are scripted. Once the script
+// runs out every Start fails. A started tunnel reports itself lost once
+// drop is set.
+type fakeTunnel struct {
+	mu      sync.Mutex
+	results []error
+	starts  int
+	stops   int
+	drop    bool
+}
+
+func (f *fakeTunnel) Start(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.starts++
+	if len(f.results) == 0 {
+		return errors.New("connection refused")
+	}
+	err := f.results[0]
+	f.results = f.results[1:]
+	return err
+}
+
+func (f *fakeTunnel) Stop() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stops++
+	return nil
+}
+
+func (f *fakeTunnel) GetStatus() *TunnelStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.drop {
+		return &TunnelStatus{ServerName: "fake", Status: "error", LastError: "reset by peer"}
+	}
+	return &TunnelStatus{ServerName: "fake", Status: "connected"}
+}
+
+func (f *fakeTunnel) GetName() string { return "fake" }
+
+func (f *fakeTunnel) Test() (time.Duration, error) { return time.Millisecond, nil }
+
+func (f *fakeTunnel) setDrop(drop bool) {
+	f.mu.Lock()
+	f.drop = drop
+	f.mu.Unlock()
+}
+
+func (f *fakeTunnel) counts() (starts, stops int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.starts, f.stops
+}
+
+// recordBackoff replaces the supervisor's backoff sleep with one that
+// hands each requested delay to the test and returns at once
+func recordBackoff(s *supervisor) <-chan time.Duration {
+	delays := make(chan time.Duration)
+	s.wait = func(ctx context.Context, d time.Duration) bool {
+		select {
+		case delays <- d:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return delays
+}
+
+func nextBackoff(t *testing.T, delays <-chan time.Duration) time.Duration {
+	t.Helper()
+
+	select {
+	case d := <-delays:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not back off")
+		return 0
+	}
+}
+
+func TestSupervisorBackoffGrows(t *testing.T) {
+	tunnel := &fakeTunnel{}
+	s := newSupervisor(tunnel, 0, nil)
+	delays := recordBackoff(s)
+
+	s.start(context.Background())
+	defer s.stop()
+
+	want := []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 32 * time.Second, time.Minute, time.Minute,
+	}
+	for i, w := range want {
+		if got := nextBackoff(t, delays); got != w {
+			t.Fatalf("backoff %d = %v, want %v", i, got, w)
+		}
+	}
+
+	status := s.snapshot()
+	if status.Status != string(StateBackoff) {
+		t.Errorf("status = %s, want %s", status.Status, StateBackoff)
+	}
+	if status.Retries != len(want) {
+		t.Errorf("retries = %d, want %d", status.Retries, len(want))
+	}
+	if status.LastError != "connection refused" {
+		t.Errorf("last error = %q", status.LastError)
+	}
+}
+
+func TestSupervisorBackoffResetsOnConnect(t *testing.T) {
+	fail := errors.New("connection refused")
+	tunnel := &fakeTunnel{results: []error{fail, fail, fail, nil}}
+	connected := make(chan struct{}, 1)
+	var s *supervisor
+	s = newSupervisor(tunnel, 0, func() {
+		if s.snapshot().Status == string(StateConnected) {
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		}
+	})
+	s.healthInterval = 10 * time.Millisecond
+	delays := recordBackoff(s)
+
+	s.start(context.Background())
+	defer s.stop()
+
+	for i, w := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if got := nextBackoff(t, delays); got != w {
+			t.Fatalf("backoff %d = %v, want %v", i, got, w)
+		}
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel never connected")
+	}
+	if retries := s.snapshot().Retries; retries != 0 {
+		t.Errorf("retries after connect = %d, want 0", retries)
+	}
+
+	// Losing the connection starts over from the shortest backoff
+	tunnel.setDrop(true)
+	for i, w := range []time.Duration{time.Second, 2 * time.Second} {
+		if got := nextBackoff(t, delays); got != w {
+			t.Fatalf("backoff %d after reconnect = %v, want %v", i, got, w)
+		}
+	}
+	if status := s.snapshot(); status.LastError != "connection refused" {
+		t.Errorf("last error = %q", status.LastError)
+	}
+}
+
+func TestSupervisorStopDuringBackoff(t *testing.T) {
+	tunnel := &fakeTunnel{}
+	backoff := make(chan struct{}, 1)
+	var s *supervisor
+	s = newSupervisor(tunnel, 0, func() {
+		if s.snapshot().Status == string(StateBackoff) {
+			select {
+			case backoff <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	s.start(context.Background())
+	select {
+	case <-backoff:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor never backed off")
+	}
+
+	// The first backoff is a second; stopping must not wait it out
+	stopped := make(chan struct{})
+	began := time.Now()
+	go func() {
+		s.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop blocked during backoff")
+	}
+	if elapsed := time.Since(began); elapsed >= minBackoff {
+		t.Errorf("stop took %v, longer than the backoff", elapsed)
+	}
+
+	if s.isRunning() {
+		t.Error("supervisor still running after stop")
+	}
+	if status := s.snapshot(); status.Status != string(StateIdle) {
+		t.Errorf("status = %s, want %s", status.Status, StateIdle)
+	}
+	starts, stops := tunnel.counts()
+	if starts != 1 {
+		t.Errorf("tunnel started %d times during one backoff", starts)
+	}
+	// Once after the failed attempt, once when the supervisor exits
+	if stops != 2 {
+		t.Errorf("tunnel stopped %d times, want 2", stops)
+	}
+}
+
+func TestSupervisorGivesUp(t *testing.T) {
+	tunnel := &fakeTunnel{}
+	s := newSupervisor(tunnel, 2, nil)
+	delays := recordBackoff(s)
+
+	s.start(context.Background())
+	nextBackoff(t, delays)
+	nextBackoff(t, delays)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.isRunning() {
+		if time.Now().After(deadline) {
+			t.Fatal("supervisor kept retrying past max retries")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if starts, _ := tunnel.counts(); starts != 3 {
+		t.Errorf("tunnel started %d times, want 3", starts)
+	}
+	if status := s.snapshot(); status.Status != string(StateIdle) || status.LastError == "" {
+		t.Errorf("status = %s (%q), want idle with the last error", status.Status, status.LastError)
+	}
+}
@@ -0,0 +1,43 @@
+package protocols
+
+import (
+	"fmt"
+
+	"ssh-tunnel/internal/diagnostics"
+)
+
+// commandRunner is implemented by tunnels that can run commands on their
+// server, over the SSH connection they carry
+type commandRunner interface {
+	RunCommand(cmd string) ([]byte, error)
+}
+
+// TraceRemote traces from a connected tunnel's server towards
+// destination, over the tunnel's own SSH connection
+func (tm *TunnelManager) TraceRemote(name, destination string, tracer *diagnostics.Tracer) (string, error) {
+	tm.mu.RLock()
+	server, _ := tm.findServer(name)
+	sup := tm.supervisors[name]
+	tm.mu.RUnlock()
+
+	if sup == nil {
+		return "", fmt.Errorf("tunnel %s not found", name)
+	}
+	runner, ok := sup.tunnel.(commandRunner)
+	if !ok {
+		transport := string(server.Transport)
+		switch {
+		case server.Exec != nil:
+			transport += " through " + server.Exec.Binary
+		case len(server.Chain) > 0:
+			transport = "a chain"
+		case server.Engine == "openssh":
+			transport += " with the openssh engine"
+		}
+		return "", fmt.Errorf("remote traces need a native ssh connection to run commands on, and %s uses %s", name, transport)
+	}
+	if sup.snapshot().Status != string(StateConnected) {
+		return "", fmt.Errorf("tunnel %s is not connected", name)
+	}
+	return tracer.TraceRemote(runner.RunCommand, destination)
+}
@@ -0,0 +1,77 @@
+package protocols
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/diagnostics"
+)
+
+// fakeRunner is a fakeTunnel that records the commands run on its server
+type fakeRunner struct {
+	fakeTunnel
+	commands []string
+}
+
+func (f *fakeRunner) RunCommand(cmd string) ([]byte, error) {
+	f.commands = append(f.commands, cmd)
+	return []byte("1. 10.0.0.1\n"), nil
+}
+
+// traceManager returns a tunnel manager with tunnel supervised as a
+// connected server named "fake"
+func traceManager(tunnel Tunnel, transport config.TransportType) *TunnelManager {
+	tm := NewTunnelManager(&config.Config{
+		Servers: []config.Server{{Name: "fake", Transport: transport}},
+	})
+	sup := newSupervisor(tunnel, 0, nil)
+	sup.status.Status = string(StateConnected)
+	tm.supervisors["fake"] = sup
+	return tm
+}
+
+func TestTraceRemoteRunsOverTunnel(t *testing.T) {
+	runner := &fakeRunner{}
+	tm := traceManager(runner, config.TransportSSH)
+	tracer := diagnostics.NewTracer(30, 3, time.Second, diagnostics.TraceUDP)
+
+	output, err := tm.TraceRemote("fake", "example.com", tracer)
+	if err != nil {
+		t.Fatalf("TraceRemote: %v", err)
+	}
+	if output != "1. 10.0.0.1\n" {
+		t.Errorf("output = %q", output)
+	}
+	if len(runner.commands) != 1 || !strings.Contains(runner.commands[0], "mtr -n -u --report -c 3 example.com") {
+		t.Errorf("commands = %q", runner.commands)
+	}
+
+	if _, err := tm.TraceRemote("fake", "example.com; reboot", tracer); err == nil {
+		t.Error("expected an invalid destination to be rejected")
+	}
+	if len(runner.commands) != 1 {
+		t.Errorf("invalid destination reached the server: %q", runner.commands)
+	}
+}
+
+func TestTraceRemoteUnsupported(t *testing.T) {
+	tracer := diagnostics.NewTracer(30, 3, time.Second, diagnostics.TraceICMP)
+
+	tm := traceManager(&fakeTunnel{}, config.TransportHysteria)
+	_, err := tm.TraceRemote("fake", "example.com", tracer)
+	if err == nil || !strings.Contains(err.Error(), "uses hysteria") {
+		t.Errorf("err = %v, want an unsupported transport error", err)
+	}
+
+	if _, err := tm.TraceRemote("missing", "example.com", tracer); err == nil {
+		t.Error("expected an unknown tunnel to fail")
+	}
+
+	tm = traceManager(&fakeRunner{}, config.TransportSSH)
+	tm.supervisors["fake"].status.Status = string(StateBackoff)
+	if _, err := tm.TraceRemote("fake", "example.com", tracer); err == nil {
+		t.Error("expected a disconnected tunnel to fail")
+	}
+}
@@ -0,0 +1,90 @@
+package protocols
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// TunnelTraffic is the number of bytes local clients exchanged through a
+// tunnel's proxy listener since the process started
+type TunnelTraffic struct {
+	BytesSent uint64 `json:"bytes_sent"` // From clients, through the tunnel
+	BytesRecv uint64 `json:"bytes_recv"` // Back to clients
+}
+
+// trafficCounter counts the traffic of one server. Counters outlive
+// tunnel restarts, like the shapers.
+type trafficCounter struct {
+	sent atomic.Uint64
+	recv atomic.Uint64
+}
+
+var traffic = struct {
+	mu sync.Mutex
+	m  map[string]*trafficCounter
+}{m: make(map[string]*trafficCounter)}
+
+func trafficCounterFor(name string) *trafficCounter {
+	traffic.mu.Lock()
+	defer traffic.mu.Unlock()
+
+	counter, ok := traffic.m[name]
+	if !ok {
+		counter = &trafficCounter{}
+		traffic.m[name] = counter
+	}
+	return counter
+}
+
+// GetTunnelTraffic returns the traffic of every tunnel that has had a
+// proxy listener
+func GetTunnelTraffic() map[string]TunnelTraffic {
+	traffic.mu.Lock()
+	defer traffic.mu.Unlock()
+
+	out := make(map[string]TunnelTraffic, len(traffic.m))
+	for name, counter := range traffic.m {
+		out[name] = TunnelTraffic{BytesSent: counter.sent.Load(), BytesRecv: counter.recv.Load()}
+	}
+	return out
+}
+
+// countingListener hands out connections counting into counter
+type countingListener struct {
+	net.Listener
+	counter *trafficCounter
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, counter: l.counter}, nil
+}
+
+// countingConn is a local client connection: reads are sent through the
+// tunnel, writes are received from it
+type countingConn struct {
+	net.Conn
+	counter *trafficCounter
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.counter.sent.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.counter.recv.Add(uint64(n))
+	return n, err
+}
+
+// CloseWrite half-closes the underlying connection when supported
+func (c *countingConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
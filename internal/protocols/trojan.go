@@ -0,0 +1,282 @@
+package protocols
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/mux"
+)
+
+// Trojan commands
+const (
+	trojanCmdConnect = 0x01
+	trojanCmdMux     = 0x7f // trojan-go: the stream carries an smux session
+)
+
+// trojanMuxAddr is the placeholder target of a trojan-go mux connection
+const trojanMuxAddr = "MUX_CONN:0"
+
+// TrojanTunnel implements the Tunnel interface for the Trojan protocol:
+// TLS to the server, then the password hash and target address. With mux
+// enabled, proxied connections are streams over a few long-lived Trojan
+// connections, as with trojan-go's mux.
+type TrojanTunnel struct {
+	server   config.Server
+	dial     DialFunc  // Reaches the server; replaced when it is a chain hop
+	pool     *mux.Pool // Only with mux enabled
+	listener net.Listener
+	status   *TunnelStatus
+	mu       sync.RWMutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewTrojanTunnel creates a new Trojan tunnel
+func NewTrojanTunnel(server config.Server) *TrojanTunnel {
+	return &TrojanTunnel{
+		server: server,
+		dial:   (&net.Dialer{Timeout: server.Timeout}).Dial,
+		status: &TunnelStatus{
+			ServerName: server.Name,
+			Status:     "disconnected",
+		},
+	}
+}
+
+// Start starts the Trojan tunnel
+func (t *TrojanTunnel) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	t.status.Status = "connecting"
+	t.status.StartTime = time.Now()
+
+	if t.muxEnabled() {
+		t.pool = t.newPool()
+	}
+
+	listener, err := listenLocal(t.server)
+	if err != nil {
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+		return fmt.Errorf("failed to create local listener: %v", err)
+	}
+
+	t.listener = listener
+	t.status.Status = "connected"
+	log.Printf("%s proxy started on port %d for %s (trojan)", t.server.Proxy, t.server.LocalPort, t.server.Name)
+
+	go t.acceptConnections()
+
+	return nil
+}
+
+// Stop stops the Trojan tunnel
+func (t *TrojanTunnel) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cancel != nil {
+		t.cancel()
+	}
+
+	if t.listener != nil {
+		t.listener.Close()
+		t.listener = nil
+	}
+
+	if t.pool != nil {
+		t.pool.Close()
+		t.pool = nil
+	}
+
+	t.status.Status = "disconnected"
+	return nil
+}
+
+// GetStatus returns the current status
+func (t *TrojanTunnel) GetStatus() *TunnelStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	statusCopy := *t.status
+	return &statusCopy
+}
+
+// GetName returns the tunnel name
+func (t *TrojanTunnel) GetName() string {
+	return t.server.Name
+}
+
+// Test measures the TLS handshake time to the server
+func (t *TrojanTunnel) Test() (time.Duration, error) {
+	start := time.Now()
+
+	conn, err := t.dialTLS()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	return time.Since(start), nil
+}
+
+// Dial opens a stream to addr, over a shared connection when mux is enabled
+func (t *TrojanTunnel) Dial(network, addr string) (net.Conn, error) {
+	t.mu.RLock()
+	pool := t.pool
+	t.mu.RUnlock()
+
+	if pool == nil {
+		return t.dialTrojan(trojanCmdConnect, addr)
+	}
+
+	// Each trojan-go mux stream starts with the command and target address
+	header, err := socksAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := pool.Dial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mux stream: %v", err)
+	}
+	if _, err := stream.Write(append([]byte{trojanCmdConnect}, header...)); err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("failed to send mux request: %v", err)
+	}
+	return stream, nil
+}
+
+// muxEnabled reports whether connections share mux sessions
+func (t *TrojanTunnel) muxEnabled() bool {
+	return t.server.Mux != nil && t.server.Mux.Enabled
+}
+
+// newPool creates the pool of mux sessions
+func (t *TrojanTunnel) newPool() *mux.Pool {
+	return mux.NewPool(func() (net.Conn, error) {
+		return t.dialTrojan(trojanCmdMux, trojanMuxAddr)
+	}, t.server.Mux.MaxStreams, t.server.Mux.IdleTimeout)
+}
+
+// acceptConnections accepts and handles incoming connections
+func (t *TrojanTunnel) acceptConnections() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if t.ctx.Err() != nil {
+				return // Context cancelled
+			}
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := handleInbound(conn, t.server.Proxy, t.Dial); err != nil {
+				log.Printf("Connection error for %s: %v", t.server.Name, err)
+			}
+		}()
+	}
+}
+
+// dialTLS connects to the server, applying any obfuscation, and completes
+// the TLS handshake
+func (t *TrojanTunnel) dialTLS() (net.Conn, error) {
+	obfuscator, err := NewObfuscator(t.server)
+	if err != nil {
+		return nil, err
+	}
+
+	serverAddr := net.JoinHostPort(t.server.Host, t.server.Port)
+	conn, err := t.dial("tcp", serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", serverAddr, err)
+	}
+	conn = wrapFragment(t.server, conn)
+	if conn, err = wrapObfuscated(obfuscator, conn); err != nil {
+		return nil, err
+	}
+
+	tlsConn, err := tlsHandshake(conn, &tls.Config{ServerName: t.server.Host, InsecureSkipVerify: t.server.InsecureSkipVerify}, t.server.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("trojan TLS handshake with %s failed: %v", serverAddr, err)
+	}
+	return tlsConn, nil
+}
+
+// dialTrojan opens a Trojan connection carrying cmd for addr
+func (t *TrojanTunnel) dialTrojan(cmd byte, addr string) (net.Conn, error) {
+	request, err := trojanRequest(t.server.Password, cmd, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := t.dialTLS()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send trojan request: %v", err)
+	}
+	return conn, nil
+}
+
+// trojanRequest encodes the Trojan request header for addr
+func trojanRequest(password string, cmd byte, addr string) ([]byte, error) {
+	target, err := socksAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum224([]byte(password))
+	buf := []byte(hex.EncodeToString(hash[:]))
+	buf = append(buf, '\r', '\n', cmd)
+	buf = append(buf, target...)
+	return append(buf, '\r', '\n'), nil
+}
+
+// socksAddr encodes addr as a SOCKS5 address and port, the form Trojan uses
+func socksAddr(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %v", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+
+	var buf []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, socks5AtypIPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, socks5AtypIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain too long: %s", host)
+		}
+		buf = append(buf, socks5AtypDomain, byte(len(host)))
+		buf = append(buf, host...)
+	}
+
+	return binary.BigEndian.AppendUint16(buf, uint16(port)), nil
+}
@@ -0,0 +1,741 @@
+package protocols
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/udprelay"
+)
+
+// TUIC v5 commands
+const (
+	tuicVersion = 0x05
+
+	tuicCmdAuthenticate = 0x00
+	tuicCmdConnect      = 0x01
+	tuicCmdPacket       = 0x02
+	tuicCmdDissociate   = 0x03
+	tuicCmdHeartbeat    = 0x04
+
+	tuicAtypNone   = 0xff
+	tuicAtypDomain = 0x00
+	tuicAtypIPv4   = 0x01
+	tuicAtypIPv6   = 0x02
+)
+
+const (
+	// tuicHeartbeat is how often a heartbeat keeps the connection in use
+	tuicHeartbeat = 10 * time.Second
+
+	// tuicDatagramSize bounds a Packet command sent as a QUIC datagram,
+	// which fits in the smallest packet QUIC allows
+	tuicDatagramSize = 1100
+)
+
+// TUICTunnel implements the Tunnel interface for TUIC v5: one QUIC
+// connection to the server, authenticated by the UUID and a token derived
+// from the password, carrying each proxied connection on its own stream
+// and UDP as Packet commands, in QUIC datagrams or on streams as
+// udp_relay_mode says. A lost connection is redialed on the next use.
+type TUICTunnel struct {
+	server   config.Server
+	uuid     [16]byte
+	mtu      int // Resolved path MTU, 0 when unknown
+	listener net.Listener
+	status   *TunnelStatus
+	mu       sync.RWMutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	connMu sync.Mutex // Serializes dialing
+	conn   quic.Connection
+
+	assocMu   sync.Mutex
+	assocs    map[uint16]*tuicPacketConn
+	nextAssoc uint16
+}
+
+// NewTUICTunnel creates a new TUIC tunnel
+func NewTUICTunnel(server config.Server) *TUICTunnel {
+	return &TUICTunnel{
+		server: server,
+		assocs: make(map[uint16]*tuicPacketConn),
+		status: &TunnelStatus{
+			ServerName: server.Name,
+			Status:     "disconnected",
+		},
+	}
+}
+
+// Start connects and authenticates to the server and opens the local
+// proxy
+func (t *TUICTunnel) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	uuid, err := parseUUID(t.server.TUIC.UUID)
+	if err != nil {
+		return err
+	}
+	t.uuid = uuid
+
+	server, err := withPathMTU(t.server)
+	if err != nil {
+		return err
+	}
+	t.mtu = server.TUIC.MTU
+
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	t.status.Status = "connecting"
+	t.status.StartTime = time.Now()
+
+	if _, _, err := t.connect(); err != nil {
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+		return err
+	}
+
+	listener, err := listenLocal(t.server)
+	if err != nil {
+		t.closeConn()
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+		return fmt.Errorf("failed to create local listener: %v", err)
+	}
+
+	t.listener = listener
+	t.status.Status = "connected"
+	log.Printf("%s proxy started on port %d for %s (tuic)", t.server.Proxy, t.server.LocalPort, t.server.Name)
+
+	go t.acceptConnections()
+
+	return nil
+}
+
+// Stop stops the TUIC tunnel
+func (t *TUICTunnel) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cancel != nil {
+		t.cancel()
+	}
+
+	if t.listener != nil {
+		t.listener.Close()
+		t.listener = nil
+	}
+
+	t.closeConn()
+
+	t.status.Status = "disconnected"
+	return nil
+}
+
+// GetStatus returns the current status
+func (t *TUICTunnel) GetStatus() *TunnelStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	statusCopy := *t.status
+	return &statusCopy
+}
+
+// GetName returns the tunnel name
+func (t *TUICTunnel) GetName() string {
+	return t.server.Name
+}
+
+// Test times a QUIC version negotiation round trip with the server
+func (t *TUICTunnel) Test() (time.Duration, error) {
+	return quicPing(t.server)
+}
+
+// Dial opens a stream carrying a connection to addr
+func (t *TUICTunnel) Dial(network, addr string) (net.Conn, error) {
+	header, err := tuicAddr([]byte{tuicVersion, tuicCmdConnect}, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := t.connection()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(t.ctx, t.server.Timeout)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open TUIC stream: %v", err)
+	}
+
+	// The server answers nothing; the target's bytes follow on the stream
+	if _, err := stream.Write(header); err != nil {
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, fmt.Errorf("failed to send TUIC connect: %v", err)
+	}
+	return &quicStreamConn{Stream: stream, local: conn.LocalAddr(), remote: conn.RemoteAddr()}, nil
+}
+
+// ListenPacket opens a UDP association with the server
+func (t *TUICTunnel) ListenPacket() (net.PacketConn, error) {
+	if _, err := t.connection(); err != nil {
+		return nil, err
+	}
+
+	t.assocMu.Lock()
+	defer t.assocMu.Unlock()
+
+	id := t.nextAssoc
+	for t.assocs[id] != nil {
+		id++
+	}
+	t.nextAssoc = id + 1
+
+	c := &tuicPacketConn{
+		tunnel:  t,
+		id:      id,
+		packets: make(chan tuicPacket, 64),
+		closed:  make(chan struct{}),
+		frags:   make(map[uint16]*tuicFragments),
+	}
+	t.assocs[id] = c
+	return c, nil
+}
+
+// connection returns the connection to the server, dialing a new one when
+// it was lost
+func (t *TUICTunnel) connection() (quic.Connection, error) {
+	t.mu.RLock()
+	ctx := t.ctx
+	t.mu.RUnlock()
+	if ctx == nil || ctx.Err() != nil {
+		return nil, fmt.Errorf("tunnel %s is not running", t.server.Name)
+	}
+
+	conn, dialed, err := t.connect()
+	if err != nil || dialed {
+		// A failed redial is reported for the supervisor to restart the
+		// tunnel; a later successful one clears it
+		t.mu.Lock()
+		if err != nil {
+			t.status.Status = "error"
+			t.status.LastError = err.Error()
+		} else if t.status.Status == "error" {
+			t.status.Status = "connected"
+		}
+		t.mu.Unlock()
+	}
+	return conn, err
+}
+
+// connect dials and authenticates unless the current connection is still
+// up, and reports whether it dialed. Start calls it holding t.mu, so it
+// only takes connMu.
+func (t *TUICTunnel) connect() (quic.Connection, bool, error) {
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
+
+	if t.conn != nil && t.conn.Context().Err() == nil {
+		return t.conn, false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(t.ctx, t.server.Timeout)
+	defer cancel()
+	conn, err := t.dial(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := t.authenticate(ctx, conn); err != nil {
+		conn.CloseWithError(0, "")
+		return nil, false, err
+	}
+
+	t.conn = conn
+	go t.heartbeat(conn)
+	go t.receiveDatagrams(conn)
+	go t.acceptUniStreams(conn)
+	return conn, true, nil
+}
+
+// dial opens a QUIC connection to the server, on a port hopping socket
+// when the server has a hopping range
+func (t *TUICTunnel) dial(ctx context.Context) (quic.Connection, error) {
+	addr := net.JoinHostPort(t.server.Host, t.server.Port)
+	if t.server.PortHopping == nil {
+		conn, err := quic.DialAddr(ctx, addr, t.tlsConfig(), t.quicConfig())
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+		}
+		return conn, nil
+	}
+
+	pc, err := dialPortHopping(t.server.Host, t.server.PortHopping)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := quic.Dial(ctx, pc, pc.peer, t.tlsConfig(), t.quicConfig())
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	// quic-go leaves a socket it was handed open
+	go func() {
+		<-conn.Context().Done()
+		pc.Close()
+	}()
+	return conn, nil
+}
+
+// authenticate sends the UUID and the token, keying material exported
+// from the TLS session with the UUID as label and the password as context
+func (t *TUICTunnel) authenticate(ctx context.Context, conn quic.Connection) error {
+	state := conn.ConnectionState().TLS
+	token, err := state.ExportKeyingMaterial(string(t.uuid[:]), []byte(t.server.TUIC.Password), 32)
+	if err != nil {
+		return fmt.Errorf("failed to derive TUIC token: %v", err)
+	}
+
+	stream, err := conn.OpenUniStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open TUIC stream: %v", err)
+	}
+	command := append([]byte{tuicVersion, tuicCmdAuthenticate}, t.uuid[:]...)
+	if _, err := stream.Write(append(command, token...)); err != nil {
+		return fmt.Errorf("failed to send TUIC authentication: %v", err)
+	}
+	return stream.Close()
+}
+
+// closeConn closes the connection to the server and the UDP associations
+func (t *TUICTunnel) closeConn() {
+	t.connMu.Lock()
+	if t.conn != nil {
+		t.conn.CloseWithError(0, "")
+		t.conn = nil
+	}
+	t.connMu.Unlock()
+
+	t.assocMu.Lock()
+	for id, c := range t.assocs {
+		c.closeOnce.Do(func() { close(c.closed) })
+		delete(t.assocs, id)
+	}
+	t.assocMu.Unlock()
+}
+
+func (t *TUICTunnel) tlsConfig() *tls.Config {
+	serverName := t.server.TUIC.SNI
+	if serverName == "" {
+		serverName = t.server.Host
+	}
+	alpn := t.server.TUIC.ALPN
+	if len(alpn) == 0 {
+		alpn = []string{"h3"}
+	}
+	return &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         alpn,
+		InsecureSkipVerify: t.server.InsecureSkipVerify,
+	}
+}
+
+func (t *TUICTunnel) quicConfig() *quic.Config {
+	cfg := &quic.Config{
+		EnableDatagrams:      true,
+		KeepAlivePeriod:      tuicHeartbeat,
+		HandshakeIdleTimeout: t.server.Timeout,
+	}
+	if t.mtu > 0 && t.mtu < maxPathMTU {
+		// Size packets to the path instead of probing upwards on a path
+		// known to carry less than a full Ethernet frame
+		cfg.DisablePathMTUDiscovery = true
+		if size := t.mtu - 48; size > 1200 { // IPv6 and UDP headers
+			cfg.InitialPacketSize = uint16(size)
+		}
+	}
+	return cfg
+}
+
+// heartbeat keeps the connection in use while it is up
+func (t *TUICTunnel) heartbeat(conn quic.Connection) {
+	ticker := time.NewTicker(tuicHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.Context().Done():
+			return
+		case <-ticker.C:
+			conn.SendDatagram([]byte{tuicVersion, tuicCmdHeartbeat})
+		}
+	}
+}
+
+// receiveDatagrams delivers the packets the server sends as datagrams
+func (t *TUICTunnel) receiveDatagrams(conn quic.Connection) {
+	for {
+		data, err := conn.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+		if len(data) >= 2 && data[0] == tuicVersion && data[1] == tuicCmdPacket {
+			t.deliver(data[2:])
+		}
+	}
+}
+
+// acceptUniStreams delivers the packets the server sends on streams
+func (t *TUICTunnel) acceptUniStreams(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			data, err := io.ReadAll(io.LimitReader(stream, 2+10+256+65535))
+			if err == nil && len(data) >= 2 && data[0] == tuicVersion && data[1] == tuicCmdPacket {
+				t.deliver(data[2:])
+			}
+		}()
+	}
+}
+
+// deliver hands a Packet command's body to its association
+func (t *TUICTunnel) deliver(body []byte) {
+	packet, err := parseTUICPacket(body)
+	if err != nil {
+		return
+	}
+	t.assocMu.Lock()
+	c := t.assocs[packet.assoc]
+	t.assocMu.Unlock()
+	if c != nil {
+		c.receive(packet)
+	}
+}
+
+// acceptConnections accepts and handles incoming connections
+func (t *TUICTunnel) acceptConnections() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if t.ctx.Err() != nil {
+				return // Context cancelled
+			}
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := handleInbound(conn, t.server.Proxy, t.Dial); err != nil {
+				log.Printf("Connection error for %s: %v", t.server.Name, err)
+			}
+		}()
+	}
+}
+
+// quicStreamConn is a proxied connection on a QUIC stream, or on an
+// HTTP/3 stream, which frames what is written in DATA frames
+type quicStreamConn struct {
+	quic.Stream
+	local, remote net.Addr
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr  { return c.local }
+func (c *quicStreamConn) RemoteAddr() net.Addr { return c.remote }
+
+// CloseWrite ends sending, which is all closing a QUIC stream does
+func (c *quicStreamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+// Close closes both directions
+func (c *quicStreamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// tuicAddr appends a TUIC address: the type, then the host and the port
+func tuicAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %v", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, tuicAtypIPv4), ip4...)
+		} else {
+			b = append(append(b, tuicAtypIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain name too long: %s", host)
+		}
+		b = append(append(b, tuicAtypDomain, byte(len(host))), host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// splitTUICAddr reads a TUIC address from the start of b, returning ""
+// for the None address
+func splitTUICAddr(b []byte) (string, []byte, error) {
+	if len(b) < 1 {
+		return "", nil, errors.New("short address")
+	}
+	var host string
+	switch b[0] {
+	case tuicAtypNone:
+		return "", b[1:], nil
+	case tuicAtypIPv4:
+		if len(b) < 1+4+2 {
+			return "", nil, errors.New("short address")
+		}
+		host, b = net.IP(b[1:5]).String(), b[5:]
+	case tuicAtypIPv6:
+		if len(b) < 1+16+2 {
+			return "", nil, errors.New("short address")
+		}
+		host, b = net.IP(b[1:17]).String(), b[17:]
+	case tuicAtypDomain:
+		if len(b) < 2 || len(b) < 2+int(b[1])+2 {
+			return "", nil, errors.New("short address")
+		}
+		host, b = string(b[2:2+int(b[1])]), b[2+int(b[1]):]
+	default:
+		return "", nil, fmt.Errorf("unknown address type %d", b[0])
+	}
+	port := binary.BigEndian.Uint16(b)
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), b[2:], nil
+}
+
+// tuicPacket is one fragment of a UDP packet, from a Packet command
+type tuicPacket struct {
+	assoc     uint16
+	id        uint16
+	fragTotal byte
+	fragID    byte
+	addr      string // Only in the first fragment
+	payload   []byte
+}
+
+// parseTUICPacket decodes a Packet command's body
+func parseTUICPacket(b []byte) (tuicPacket, error) {
+	if len(b) < 8 {
+		return tuicPacket{}, errors.New("short packet")
+	}
+	p := tuicPacket{
+		assoc:     binary.BigEndian.Uint16(b),
+		id:        binary.BigEndian.Uint16(b[2:]),
+		fragTotal: b[4],
+		fragID:    b[5],
+	}
+	size := int(binary.BigEndian.Uint16(b[6:]))
+	addr, rest, err := splitTUICAddr(b[8:])
+	if err != nil {
+		return tuicPacket{}, err
+	}
+	if len(rest) < size || p.fragTotal == 0 || p.fragID >= p.fragTotal {
+		return tuicPacket{}, errors.New("malformed packet")
+	}
+	p.addr, p.payload = addr, rest[:size]
+	return p, nil
+}
+
+// tuicFragments collects the fragments of one packet
+type tuicFragments struct {
+	addr     string
+	parts    [][]byte
+	received int
+	started  time.Time
+}
+
+// tuicPacketConn is a UDP association over the TUIC connection. Packets
+// are addressed by their remote destination, which may be a domain.
+type tuicPacketConn struct {
+	tunnel    *TUICTunnel
+	id        uint16
+	packets   chan tuicPacket // Whole packets
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu     sync.Mutex
+	nextID uint16
+	frags  map[uint16]*tuicFragments
+}
+
+// receive queues a fragment, or the packet it completes, for ReadFrom
+func (c *tuicPacketConn) receive(p tuicPacket) {
+	if p.fragTotal > 1 {
+		c.mu.Lock()
+		f := c.frags[p.id]
+		if f == nil || time.Since(f.started) > 10*time.Second {
+			f = &tuicFragments{parts: make([][]byte, p.fragTotal), started: time.Now()}
+			c.frags[p.id] = f
+		}
+		if int(p.fragTotal) != len(f.parts) || f.parts[p.fragID] != nil {
+			c.mu.Unlock()
+			return
+		}
+		f.parts[p.fragID] = append([]byte(nil), p.payload...)
+		if p.fragID == 0 {
+			f.addr = p.addr
+		}
+		f.received++
+		if f.received < len(f.parts) {
+			c.mu.Unlock()
+			return
+		}
+		delete(c.frags, p.id)
+		c.mu.Unlock()
+
+		var payload []byte
+		for _, part := range f.parts {
+			payload = append(payload, part...)
+		}
+		p = tuicPacket{addr: f.addr, payload: payload}
+	} else {
+		p.payload = append([]byte(nil), p.payload...)
+	}
+
+	select {
+	case c.packets <- p:
+	default: // Dropped, as UDP would be
+	}
+}
+
+func (c *tuicPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.packets:
+		return copy(b, p.payload), udprelay.Addr(p.addr), nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// WriteTo sends a packet, fragmented to fit in datagrams in native relay
+// mode, or whole on its own stream in quic mode
+func (c *tuicPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	conn, err := c.tunnel.connection()
+	if err != nil {
+		return 0, err
+	}
+
+	target, err := tuicAddr(nil, addr.String())
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	id := c.nextID
+	c.nextID++
+	c.mu.Unlock()
+
+	if c.tunnel.server.TUIC.UDPRelayMode == "quic" {
+		stream, err := conn.OpenUniStream()
+		if err != nil {
+			return 0, err
+		}
+		if _, err := stream.Write(c.command(id, 1, 0, target, b)); err != nil {
+			stream.CancelWrite(0)
+			return 0, err
+		}
+		return len(b), stream.Close()
+	}
+
+	// Fragments after the first carry no address
+	fragSize := tuicDatagramSize - 2 - 8 - len(target)
+	fragTotal := (len(b) + fragSize - 1) / fragSize
+	if fragTotal == 0 {
+		fragTotal = 1
+	}
+	if fragTotal > 255 {
+		return 0, fmt.Errorf("udp packet of %d bytes is too large", len(b))
+	}
+	for i := 0; i < fragTotal; i++ {
+		end := (i + 1) * fragSize
+		if end > len(b) {
+			end = len(b)
+		}
+		addrPart := target
+		if i > 0 {
+			addrPart = []byte{tuicAtypNone}
+		}
+		if err := conn.SendDatagram(c.command(id, byte(fragTotal), byte(i), addrPart, b[i*fragSize:end])); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// command encodes a Packet command
+func (c *tuicPacketConn) command(id uint16, fragTotal, fragID byte, addr, payload []byte) []byte {
+	b := []byte{tuicVersion, tuicCmdPacket}
+	b = binary.BigEndian.AppendUint16(b, c.id)
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = append(b, fragTotal, fragID)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	b = append(b, addr...)
+	return append(b, payload...)
+}
+
+// Close ends the association on the server with a Dissociate command
+func (c *tuicPacketConn) Close() error {
+	first := false
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		first = true
+	})
+	if !first {
+		return nil
+	}
+
+	t := c.tunnel
+	t.assocMu.Lock()
+	delete(t.assocs, c.id)
+	t.assocMu.Unlock()
+
+	t.connMu.Lock()
+	conn := t.conn
+	t.connMu.Unlock()
+	if conn == nil || conn.Context().Err() != nil {
+		return nil
+	}
+	stream, err := conn.OpenUniStream()
+	if err != nil {
+		return nil
+	}
+	stream.Write(binary.BigEndian.AppendUint16([]byte{tuicVersion, tuicCmdDissociate}, c.id))
+	return stream.Close()
+}
+
+func (c *tuicPacketConn) LocalAddr() net.Addr { return udprelay.Addr("tuic:0") }
+
+func (c *tuicPacketConn) SetDeadline(t time.Time) error      { return errors.ErrUnsupported }
+func (c *tuicPacketConn) SetReadDeadline(t time.Time) error  { return errors.ErrUnsupported }
+func (c *tuicPacketConn) SetWriteDeadline(t time.Time) error { return errors.ErrUnsupported }
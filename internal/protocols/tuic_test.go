@@ -0,0 +1,368 @@
+package protocols
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"ssh-tunnel/internal/config"
+)
+
+const (
+	testTUICUUID     = "0dc2f7b1-8f6e-4c7c-9a38-2b3a1f2f0e11"
+	testTUICPassword = "tuic secret"
+)
+
+// tuicTestServer is a TUIC v5 server that echoes connections and UDP
+// packets. Results reports each connect target, each dissociated
+// association and each failed authentication.
+type tuicTestServer struct {
+	addr    string
+	results chan string
+	conns   chan quic.Connection
+}
+
+func newTUICTestServer(t *testing.T) *tuicTestServer {
+	t.Helper()
+
+	certFile, keyFile := writeTestCert(t, "127.0.0.1")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h3"},
+	}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &tuicTestServer{
+		addr:    ln.Addr().String(),
+		results: make(chan string, 16),
+		conns:   make(chan quic.Connection, 4),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			s.conns <- conn
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *tuicTestServer) serve(conn quic.Connection) {
+	authenticated := make(chan struct{})
+
+	go func() {
+		for {
+			stream, err := conn.AcceptUniStream(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				command, err := io.ReadAll(stream)
+				if err != nil || len(command) < 2 {
+					return
+				}
+				switch command[1] {
+				case tuicCmdAuthenticate:
+					if err := s.authenticate(conn, command[2:]); err != nil {
+						s.results <- "error: " + err.Error()
+						conn.CloseWithError(1, "authentication failed")
+						return
+					}
+					close(authenticated)
+				case tuicCmdPacket:
+					<-authenticated
+					echo, _ := conn.OpenUniStream()
+					echo.Write(command)
+					echo.Close()
+				case tuicCmdDissociate:
+					s.results <- fmt.Sprintf("dissociate %d", binary.BigEndian.Uint16(command[2:]))
+				}
+			}()
+		}
+	}()
+
+	go func() {
+		for {
+			datagram, err := conn.ReceiveDatagram(context.Background())
+			if err != nil {
+				return
+			}
+			// Fragments are echoed as they come, for the client to reassemble
+			if datagram[1] == tuicCmdPacket {
+				conn.SendDatagram(datagram)
+			}
+		}
+	}()
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			select {
+			case <-authenticated:
+			case <-conn.Context().Done():
+				return
+			}
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(stream, header); err != nil || header[1] != tuicCmdConnect {
+				return
+			}
+			target, err := readTUICAddr(stream)
+			if err != nil {
+				return
+			}
+			s.results <- target
+			io.Copy(stream, stream)
+		}()
+	}
+}
+
+// authenticate checks the UUID and the token, exported from the server
+// side of the TLS session
+func (s *tuicTestServer) authenticate(conn quic.Connection, b []byte) error {
+	uuid, _ := parseUUID(testTUICUUID)
+	if len(b) != 16+32 || !bytes.Equal(b[:16], uuid[:]) {
+		return errors.New("unknown uuid")
+	}
+	state := conn.ConnectionState().TLS
+	token, err := state.ExportKeyingMaterial(string(uuid[:]), []byte(testTUICPassword), 32)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b[16:], token) {
+		return errors.New("wrong token")
+	}
+	return nil
+}
+
+// readTUICAddr reads a TUIC address from a stream
+func readTUICAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var size int
+	switch atyp[0] {
+	case tuicAtypIPv4:
+		size = 4
+	case tuicAtypIPv6:
+		size = 16
+	case tuicAtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		atyp, size = append(atyp, length[0]), int(length[0])
+	default:
+		return "", fmt.Errorf("unknown address type %d", atyp[0])
+	}
+	rest := make([]byte, size+2)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return "", err
+	}
+	addr, _, err := splitTUICAddr(append(atyp, rest...))
+	return addr, err
+}
+
+func tuicTestTunnel(t *testing.T, addr, password, relayMode string) *TUICTunnel {
+	t.Helper()
+
+	host, port, _ := net.SplitHostPort(addr)
+	tunnel := NewTUICTunnel(config.Server{
+		Name:               "tuic",
+		Host:               host,
+		Port:               port,
+		Transport:          config.TransportTUIC,
+		Timeout:            5 * time.Second,
+		InsecureSkipVerify: true,
+		TUIC:               &config.TUICConfig{UUID: testTUICUUID, Password: password, UDPRelayMode: relayMode},
+	})
+
+	var err error
+	if tunnel.uuid, err = parseUUID(testTUICUUID); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ctx, tunnel.cancel = context.WithCancel(context.Background())
+	t.Cleanup(func() { tunnel.Stop() })
+	return tunnel
+}
+
+// tuicEcho sends payload over a new connection to target and checks that
+// it comes back
+func tuicEcho(t *testing.T, tunnel *TUICTunnel, target string, payload []byte) {
+	t.Helper()
+
+	conn, err := tunnel.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go conn.Write(payload)
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("echo differs from what was sent")
+	}
+}
+
+func TestTUICConnect(t *testing.T) {
+	server := newTUICTestServer(t)
+	tunnel := tuicTestTunnel(t, server.addr, testTUICPassword, "")
+
+	for _, target := range []string{"example.com:443", "10.1.2.3:80", "[2001:db8::1]:53"} {
+		tuicEcho(t, tunnel, target, bytes.Repeat([]byte("tuic stream "), 10000))
+		if result := <-server.results; result != target {
+			t.Errorf("server result = %q, want %q", result, target)
+		}
+	}
+
+	// Every connection shares the one QUIC connection
+	if n := len(server.conns); n != 1 {
+		t.Errorf("client made %d QUIC connections, want 1", n)
+	}
+}
+
+// TestTUICPortHopping connects over a hopping socket. The interval is long
+// since the quic-go test server does not follow a client to a new address.
+func TestTUICPortHopping(t *testing.T) {
+	server := newTUICTestServer(t)
+	tunnel := tuicTestTunnel(t, server.addr, testTUICPassword, "")
+	_, port, _ := net.SplitHostPort(server.addr)
+	// Both hops go to the one port the test server listens on
+	tunnel.server.PortHopping = &config.PortHoppingConfig{Ports: port + "," + port, Interval: time.Hour}
+
+	tuicEcho(t, tunnel, "example.com:443", []byte("hop"))
+	<-server.results
+
+	tunnel.connMu.Lock()
+	conn := tunnel.conn
+	tunnel.connMu.Unlock()
+	if conn.RemoteAddr().String() != server.addr {
+		t.Errorf("connection goes to %v, want the first hop port %s", conn.RemoteAddr(), server.addr)
+	}
+}
+
+func TestTUICWrongPassword(t *testing.T) {
+	server := newTUICTestServer(t)
+	tunnel := tuicTestTunnel(t, server.addr, "wrong", "")
+
+	if conn, err := tunnel.Dial("tcp", "example.com:443"); err == nil {
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("hello"))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("read succeeded with the wrong password")
+		}
+	}
+	if result := <-server.results; result != "error: wrong token" {
+		t.Errorf("server result = %q, want a rejected token", result)
+	}
+}
+
+// TestTUICRedial checks that a lost connection is replaced on the next use
+func TestTUICRedial(t *testing.T) {
+	server := newTUICTestServer(t)
+	tunnel := tuicTestTunnel(t, server.addr, testTUICPassword, "")
+
+	tuicEcho(t, tunnel, "example.com:443", []byte("before"))
+	<-server.results
+
+	first := <-server.conns
+	first.CloseWithError(0, "restart")
+	tunnel.connMu.Lock()
+	lost := tunnel.conn.Context()
+	tunnel.connMu.Unlock()
+	select {
+	case <-lost.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not see the connection close")
+	}
+
+	tuicEcho(t, tunnel, "example.com:443", []byte("after"))
+	<-server.results
+	if n := len(server.conns); n != 1 {
+		t.Errorf("client made %d new QUIC connections, want 1", n)
+	}
+	if status := tunnel.GetStatus(); status.Status == "error" {
+		t.Errorf("status after redial = %q: %s", status.Status, status.LastError)
+	}
+}
+
+func TestTUICUDP(t *testing.T) {
+	for _, mode := range []string{"native", "quic"} {
+		t.Run(mode, func(t *testing.T) {
+			server := newTUICTestServer(t)
+			tunnel := tuicTestTunnel(t, server.addr, testTUICPassword, mode)
+
+			pc, err := tunnel.ListenPacket()
+			if err != nil {
+				t.Fatalf("ListenPacket: %v", err)
+			}
+
+			// The large packet is fragmented across datagrams in native mode
+			for _, size := range []int{10, 3000} {
+				payload := bytes.Repeat([]byte{byte(size)}, size)
+				if _, err := pc.WriteTo(payload, &net.UDPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 53}); err != nil {
+					t.Fatalf("WriteTo: %v", err)
+				}
+
+				type result struct {
+					payload []byte
+					addr    net.Addr
+				}
+				got := make(chan result, 1)
+				go func() {
+					buf := make([]byte, 65535)
+					n, addr, err := pc.ReadFrom(buf)
+					if err == nil {
+						got <- result{buf[:n], addr}
+					}
+				}()
+				select {
+				case r := <-got:
+					if !bytes.Equal(r.payload, payload) || r.addr.String() != "10.1.2.3:53" {
+						t.Errorf("got %d bytes from %v, want the %d sent to 10.1.2.3:53", len(r.payload), r.addr, size)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("no reply to the %d byte packet", size)
+				}
+			}
+
+			pc.Close()
+			select {
+			case result := <-server.results:
+				if result != "dissociate 0" {
+					t.Errorf("server result = %q, want the association dissociated", result)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("server did not see the association end")
+			}
+		})
+	}
+}
@@ -2,33 +2,56 @@ package protocols
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/diagnostics"
+	"ssh-tunnel/internal/probe"
 )
 
 // TunnelStatus represents the status of a tunnel
 type TunnelStatus struct {
 	ServerName string        `json:"server_name"`
-	Status     string        `json:"status"` // "connected", "connecting", "disconnected", "error"
+	Status     string        `json:"status"` // A TunnelState for managed tunnels
 	StartTime  time.Time     `json:"start_time"`
 	LastError  string        `json:"last_error,omitempty"`
+	Retries    int           `json:"retries,omitempty"`
+	Required   bool          `json:"required,omitempty"`             // See config.Server.Required
+	Insecure   bool          `json:"insecure_skip_verify,omitempty"` // The server's identity is not verified
 	BytesSent  uint64        `json:"bytes_sent"`
 	BytesRecv  uint64        `json:"bytes_recv"`
 	Latency    time.Duration `json:"latency"`
 }
 
-// TunnelManager manages multiple tunnel connections
+// TunnelManager manages multiple tunnel connections. Each tunnel is driven
+// by its own supervisor; the manager's lock only guards the set of tunnels.
+// Status reads never take the lock: supervisors publish a complete status
+// snapshot whenever a tunnel changes, and readers load it atomically.
 type TunnelManager struct {
-	config  *config.Config
-	tunnels map[string]Tunnel
-	status  map[string]*TunnelStatus
-	mu      sync.RWMutex
-	ctx     context.Context
-	cancel  context.CancelFunc
+	config      *config.Config
+	tunnels     map[string]Tunnel
+	supervisors map[string]*supervisor
+	mu          sync.RWMutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	statusMu sync.Mutex // Serializes publishStatus so snapshots never go back in time
+	status   atomic.Pointer[map[string]*TunnelStatus]
+	watchers map[chan struct{}]struct{} // Told of each new snapshot; guarded by statusMu
+
+	selected    string       // Tunnel chosen by auto-selection, preferred by Dial
+	mixed       net.Listener // The mixed port, when configured
+	shadowsocks net.Listener // The Shadowsocks inbound, when enabled
+	udpForwards []net.PacketConn
+
+	startup StartupReport // Results of the last Start
 }
 
 // Tunnel interface for different protocol implementations
@@ -42,49 +65,103 @@ type Tunnel interface {
 
 // NewTunnelManager creates a new tunnel manager
 func NewTunnelManager(cfg *config.Config) *TunnelManager {
+	configureQoS(cfg)
+	configureMITM(cfg)
+	configureMemory(cfg)
+
 	return &TunnelManager{
-		config:  cfg,
-		tunnels: make(map[string]Tunnel),
-		status:  make(map[string]*TunnelStatus),
+		config:      cfg,
+		tunnels:     make(map[string]Tunnel),
+		supervisors: make(map[string]*supervisor),
 	}
 }
 
-// Start starts the tunnel manager
+// Start starts the tunnel manager. Servers and listeners that fail to
+// start are logged and left out, and the results are kept for
+// StartupReport; with strict_startup, a failed required server fails Start
+// with a *StartupError before any listener is opened.
 func (tm *TunnelManager) Start(ctx context.Context) error {
 	tm.mu.Lock()
-	defer tm.mu.Unlock()
 
 	tm.ctx, tm.cancel = context.WithCancel(ctx)
+	tm.tunnels = make(map[string]Tunnel)
+	tm.supervisors = make(map[string]*supervisor)
+	tm.startup = StartupReport{Time: time.Now(), Strict: tm.config.StrictStartup}
+	required := requiredServers(tm.config)
 
 	// Initialize tunnels for all enabled servers
 	for _, server := range tm.config.Servers {
 		if !server.Enabled {
 			continue
 		}
+		if server.InsecureSkipVerify {
+			log.Printf("🚨 INSECURE: %s does not verify the server's host key or certificate (insecure_skip_verify), its traffic can be intercepted", server.Name)
+		}
 
+		result := StartupResult{Component: componentServer, Name: server.Name, Required: required[server.Name]}
 		tunnel, err := tm.createTunnel(server)
 		if err != nil {
 			log.Printf("Failed to create tunnel for %s: %v", server.Name, err)
+			result.Error = err.Error()
+			tm.startup.Results = append(tm.startup.Results, result)
 			continue
 		}
+		result.OK = true
+		tm.startup.Results = append(tm.startup.Results, result)
 
 		tm.tunnels[server.Name] = tunnel
-		tm.status[server.Name] = &TunnelStatus{
-			ServerName: server.Name,
-			Status:     "disconnected",
+		tm.supervisors[server.Name] = newSupervisor(tunnel, server.MaxRetries, tm.publishStatus)
+	}
+
+	autoSelect := tm.config.AutoSelect
+	selectionMethod := tm.config.SelectionMethod
+	mixedPort := tm.config.MixedPort
+	ss := tm.config.Shadowsocks
+	strict := tm.config.StrictStartup
+	tm.mu.Unlock()
+
+	tm.publishStatus()
+
+	if report := tm.StartupReport(); strict && len(report.RequiredFailures()) > 0 {
+		return &StartupError{Report: report}
+	}
+
+	if mixedPort > 0 {
+		err := tm.startMixed(mixedPort)
+		if err != nil {
+			log.Printf("Mixed port disabled: %v", err)
+		}
+		tm.recordStartup(componentMixed, fmt.Sprintf(":%d", mixedPort), err)
+	}
+
+	if ss.Enabled {
+		err := tm.startShadowsocks(ss)
+		if err != nil {
+			log.Printf("Shadowsocks server disabled: %v", err)
 		}
+		tm.recordStartup(componentShadowsocks, fmt.Sprintf(":%d", ss.Port), err)
 	}
 
+	tm.startUDPForwards()
+
 	// Start auto-selection if enabled
-	if tm.config.AutoSelect {
-		return tm.startAutoSelected()
+	var err error
+	if autoSelect {
+		if err = tm.startAutoSelected(); err != nil {
+			tm.recordStartup(componentAutoSelect, selectionMethod, err)
+		}
 	}
 
-	return nil
+	if report := tm.StartupReport(); len(report.Failures()) > 0 {
+		log.Printf("⚠️  Partial startup: %s", report.Summary())
+	}
+	return err
 }
 
-// Stop stops all tunnels
+// Stop stops all tunnels and the manager's context
 func (tm *TunnelManager) Stop() error {
+	tm.StopAllTunnels()
+
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
@@ -92,102 +169,204 @@ func (tm *TunnelManager) Stop() error {
 		tm.cancel()
 	}
 
-	var errors []error
-	for name, tunnel := range tm.tunnels {
-		if err := tunnel.Stop(); err != nil {
-			errors = append(errors, fmt.Errorf("failed to stop tunnel %s: %v", name, err))
-		}
+	if tm.mixed != nil {
+		tm.mixed.Close()
+		tm.mixed = nil
+	}
 
-		if status, ok := tm.status[name]; ok {
-			status.Status = "disconnected"
-		}
+	if tm.shadowsocks != nil {
+		tm.shadowsocks.Close()
+		tm.shadowsocks = nil
 	}
 
-	if len(errors) > 0 {
-		return fmt.Errorf("errors stopping tunnels: %v", errors)
+	for _, local := range tm.udpForwards {
+		local.Close()
 	}
+	tm.udpForwards = nil
 
 	return nil
 }
 
-// StartTunnel starts a specific tunnel
-func (tm *TunnelManager) StartTunnel(serverName string) error {
-	tm.mu.Lock()
-	defer tm.mu.Unlock()
+// StartTunnel starts a tunnel under its supervisor, which keeps
+// reconnecting with backoff until the tunnel is stopped. "tag:<tag>"
+// starts every tunnel with the tag.
+func (tm *TunnelManager) StartTunnel(target string) error {
+	tm.mu.RLock()
+	sups := tm.resolveTargets(target)
+	ctx := tm.ctx
+	tm.mu.RUnlock()
 
-	tunnel, exists := tm.tunnels[serverName]
-	if !exists {
-		return fmt.Errorf("tunnel %s not found", serverName)
+	if len(sups) == 0 {
+		return fmt.Errorf("tunnel %s not found", target)
+	}
+	if ctx == nil || ctx.Err() != nil {
+		return fmt.Errorf("tunnel manager is not running")
 	}
 
-	status := tm.status[serverName]
-	status.Status = "connecting"
-	status.StartTime = time.Now()
+	for _, sup := range sups {
+		sup.start(ctx)
+	}
+	return nil
+}
 
-	go func() {
-		if err := tunnel.Start(tm.ctx); err != nil {
-			tm.mu.Lock()
-			status.Status = "error"
-			status.LastError = err.Error()
-			tm.mu.Unlock()
-			log.Printf("Tunnel %s failed: %v", serverName, err)
-		} else {
-			tm.mu.Lock()
-			status.Status = "connected"
-			tm.mu.Unlock()
-		}
-	}()
+// StopTunnel stops a tunnel, or every tunnel with a tag for "tag:<tag>",
+// and waits for them to exit
+func (tm *TunnelManager) StopTunnel(target string) error {
+	tm.mu.RLock()
+	sups := tm.resolveTargets(target)
+	tm.mu.RUnlock()
+
+	if len(sups) == 0 {
+		return fmt.Errorf("tunnel %s not found", target)
+	}
+
+	var wg sync.WaitGroup
+	for _, sup := range sups {
+		wg.Add(1)
+		go func(sup *supervisor) {
+			defer wg.Done()
+			sup.stop()
+		}(sup)
+	}
+	wg.Wait()
 
 	return nil
 }
 
-// StopAllTunnels stops all running tunnels
-func (tm *TunnelManager) StopAllTunnels() error {
-	tm.mu.Lock()
-	defer tm.mu.Unlock()
+// RestartTunnel stops a tunnel, or every tunnel with a tag for
+// "tag:<tag>", and starts it again
+func (tm *TunnelManager) RestartTunnel(target string) error {
+	if err := tm.StopTunnel(target); err != nil {
+		return err
+	}
+	return tm.StartTunnel(target)
+}
 
-	var errors []error
-	for name, tunnel := range tm.tunnels {
-		if err := tunnel.Stop(); err != nil {
-			errors = append(errors, fmt.Errorf("failed to stop tunnel %s: %v", name, err))
-		}
+// HasTunnel reports whether a server reference names a tunnel, or a tag
+// some tunnel has
+func (tm *TunnelManager) HasTunnel(target string) bool {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
 
-		if status, ok := tm.status[name]; ok {
-			status.Status = "disconnected"
-		}
-	}
+	return len(tm.resolveTargets(target)) > 0
+}
 
-	if len(errors) > 0 {
-		return fmt.Errorf("errors stopping tunnels: %v", errors)
+// StopAllTunnels stops all running tunnels and waits for them to exit
+func (tm *TunnelManager) StopAllTunnels() error {
+	var wg sync.WaitGroup
+	for _, sup := range tm.supervisorList() {
+		wg.Add(1)
+		go func(sup *supervisor) {
+			defer wg.Done()
+			sup.stop()
+		}(sup)
 	}
+	wg.Wait()
 
 	return nil
 }
 
-// RestartTunnels restarts all tunnels
+// RestartTunnels stops every running tunnel and starts the same set again.
+// When nothing was running, auto-selection is rerun if enabled.
 func (tm *TunnelManager) RestartTunnels() error {
+	tm.mu.RLock()
+	var running []string
+	for name, sup := range tm.supervisors {
+		if sup.isRunning() {
+			running = append(running, name)
+		}
+	}
+	autoSelect := tm.config.AutoSelect
+	tm.mu.RUnlock()
+
 	if err := tm.StopAllTunnels(); err != nil {
 		return err
 	}
 
-	time.Sleep(time.Second) // Brief pause between stop and start
+	if len(running) == 0 {
+		if autoSelect {
+			return tm.startAutoSelected()
+		}
+		return nil
+	}
 
-	return tm.Start(tm.ctx)
+	for _, name := range running {
+		if err := tm.StartTunnel(name); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// GetStatus returns the status of all tunnels
+// GetStatus returns the status of all tunnels. It does not lock and returns
+// a shared snapshot, which callers must not modify.
 func (tm *TunnelManager) GetStatus() map[string]*TunnelStatus {
+	if status := tm.status.Load(); status != nil {
+		return *status
+	}
+	return map[string]*TunnelStatus{}
+}
+
+// publishStatus rebuilds the status snapshot from the supervisors and swaps
+// it in for readers
+func (tm *TunnelManager) publishStatus() {
+	tm.statusMu.Lock()
+	defer tm.statusMu.Unlock()
+
 	tm.mu.RLock()
-	defer tm.mu.RUnlock()
+	status := make(map[string]*TunnelStatus, len(tm.supervisors))
+	for name, sup := range tm.supervisors {
+		snapshot := sup.snapshot()
+		status[name] = &snapshot
+	}
+	for _, result := range tm.startup.Results {
+		if result.Component == componentServer && !result.OK {
+			status[result.Name] = &TunnelStatus{
+				ServerName: result.Name,
+				Status:     statusFailed,
+				LastError:  result.Error,
+			}
+		}
+	}
+	for name := range requiredServers(tm.config) {
+		if s, ok := status[name]; ok {
+			s.Required = true
+		}
+	}
+	for _, server := range tm.config.Servers {
+		if s, ok := status[server.Name]; ok && server.InsecureSkipVerify {
+			s.Insecure = true
+		}
+	}
+	tm.mu.RUnlock()
 
-	result := make(map[string]*TunnelStatus)
-	for name, status := range tm.status {
-		// Create a copy to avoid race conditions
-		statusCopy := *status
-		result[name] = &statusCopy
+	tm.status.Store(&status)
+	for ch := range tm.watchers {
+		select {
+		case ch <- struct{}{}:
+		default: // The watcher has yet to read the last snapshot
+		}
 	}
+}
+
+// Watch returns a channel that receives a value after the status snapshot
+// changes, so a watcher can read it with GetStatus, and a function ending
+// the watch. Changes made before the watcher reads coalesce.
+func (tm *TunnelManager) Watch() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
 
-	return result
+	tm.statusMu.Lock()
+	defer tm.statusMu.Unlock()
+	if tm.watchers == nil {
+		tm.watchers = make(map[chan struct{}]struct{})
+	}
+	tm.watchers[ch] = struct{}{}
+
+	return ch, func() {
+		tm.statusMu.Lock()
+		defer tm.statusMu.Unlock()
+		delete(tm.watchers, ch)
+	}
 }
 
 // GetTunnels returns all tunnel configurations
@@ -198,8 +377,27 @@ func (tm *TunnelManager) GetTunnels() []config.Server {
 	return tm.config.Servers
 }
 
-// TestServer tests connectivity to a specific server
-func (tm *TunnelManager) TestServer(serverName string) interface{} {
+// TestServer tests connectivity to a specific server, or to every server
+// with a tag for "tag:<tag>"
+func (tm *TunnelManager) TestServer(target string) interface{} {
+	if strings.HasPrefix(target, config.TagPrefix) {
+		tm.mu.RLock()
+		var names []string
+		for i := range tm.config.Servers {
+			if _, exists := tm.tunnels[tm.config.Servers[i].Name]; exists && tm.config.Servers[i].MatchesTarget(target) {
+				names = append(names, tm.config.Servers[i].Name)
+			}
+		}
+		tm.mu.RUnlock()
+
+		results := make([]interface{}, 0, len(names))
+		for _, name := range names {
+			results = append(results, tm.TestServer(name))
+		}
+		return results
+	}
+
+	serverName := target
 	tm.mu.RLock()
 	tunnel, exists := tm.tunnels[serverName]
 	tm.mu.RUnlock()
@@ -226,6 +424,26 @@ func (tm *TunnelManager) TestServer(serverName string) interface{} {
 	}
 }
 
+// ProbeLatency measures the latency of a tunnel and records it in its status
+func (tm *TunnelManager) ProbeLatency(serverName string) (time.Duration, error) {
+	tm.mu.RLock()
+	tunnel, exists := tm.tunnels[serverName]
+	sup := tm.supervisors[serverName]
+	tm.mu.RUnlock()
+
+	if !exists {
+		return 0, fmt.Errorf("tunnel %s not found", serverName)
+	}
+
+	latency, err := tunnel.Test()
+	if err != nil {
+		return 0, err
+	}
+
+	sup.setLatency(latency)
+	return latency, nil
+}
+
 // UpdateConfig updates the configuration
 func (tm *TunnelManager) UpdateConfig(cfg *config.Config) error {
 	tm.mu.Lock()
@@ -240,11 +458,115 @@ func (tm *TunnelManager) UpdateConfig(cfg *config.Config) error {
 	return nil
 }
 
+// ReloadServer brings a server's tunnel in line with the configuration
+// after its entry was added, changed or removed. The tunnel under name is
+// stopped and dropped; when an enabled entry named newName remains, its
+// tunnel is created and, if the old one was running, started. name is
+// empty for an added server, and newName for a removed one.
+func (tm *TunnelManager) ReloadServer(name, newName string) error {
+	tm.mu.RLock()
+	old := tm.supervisors[name]
+	tm.mu.RUnlock()
+
+	running := false
+	if old != nil {
+		running = old.isRunning()
+		old.stop()
+	}
+
+	tm.mu.Lock()
+	delete(tm.tunnels, name)
+	delete(tm.supervisors, name)
+	if name != "" && tm.selected == name {
+		tm.selected = newName
+	}
+	server, exists := tm.findServer(newName)
+	if exists && server.Enabled {
+		tunnel, err := tm.createTunnel(server)
+		if err != nil {
+			tm.mu.Unlock()
+			tm.publishStatus()
+			return fmt.Errorf("failed to create tunnel for %s: %v", newName, err)
+		}
+		tm.tunnels[newName] = tunnel
+		tm.supervisors[newName] = newSupervisor(tunnel, server.MaxRetries, tm.publishStatus)
+	} else {
+		running = false
+		if newName != "" && tm.selected == newName {
+			tm.selected = ""
+		}
+	}
+	ctx := tm.ctx
+	tm.mu.Unlock()
+
+	tm.publishStatus()
+	if running && ctx != nil && ctx.Err() == nil {
+		return tm.StartTunnel(newName)
+	}
+	return nil
+}
+
+// currentConfig returns the active configuration
+func (tm *TunnelManager) currentConfig() *config.Config {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	return tm.config
+}
+
+// supervisorList returns a snapshot of all supervisors
+func (tm *TunnelManager) supervisorList() []*supervisor {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	list := make([]*supervisor, 0, len(tm.supervisors))
+	for _, sup := range tm.supervisors {
+		list = append(list, sup)
+	}
+	return list
+}
+
+// tunnelSnapshot returns a copy of the tunnels auto-selection may pick,
+// those with one of auto_select_tags when set, so selection can test
+// servers without holding the lock
+func (tm *TunnelManager) tunnelSnapshot() map[string]Tunnel {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	tunnels := make(map[string]Tunnel, len(tm.tunnels))
+	for i := range tm.config.Servers {
+		server := &tm.config.Servers[i]
+		if tunnel, exists := tm.tunnels[server.Name]; exists && tm.config.InSelection(server) {
+			tunnels[server.Name] = tunnel
+		}
+	}
+	return tunnels
+}
+
+// resolveTargets returns the supervisors a server reference covers: the
+// named tunnel, or every tunnel with the tag for "tag:<tag>". The caller
+// holds tm.mu.
+func (tm *TunnelManager) resolveTargets(target string) []*supervisor {
+	var sups []*supervisor
+	for i := range tm.config.Servers {
+		server := &tm.config.Servers[i]
+		if sup, exists := tm.supervisors[server.Name]; exists && server.MatchesTarget(target) {
+			sups = append(sups, sup)
+		}
+	}
+	return sups
+}
+
 // startAutoSelected starts the best available server based on selection method
 func (tm *TunnelManager) startAutoSelected() error {
-	switch tm.config.SelectionMethod {
+	cfg := tm.currentConfig()
+	switch cfg.SelectionMethod {
 	case "latency":
 		return tm.startBestLatency()
+	case "throughput":
+		return tm.startBestThroughput()
+	case "score":
+		return tm.startBestScore(cfg.Scoring)
 	case "random":
 		return tm.startRandom()
 	case "load":
@@ -259,7 +581,7 @@ func (tm *TunnelManager) startBestLatency() error {
 	var bestServer string
 	var bestLatency time.Duration = time.Hour // Initialize with a high value
 
-	for name, tunnel := range tm.tunnels {
+	for name, tunnel := range tm.tunnelSnapshot() {
 		latency, err := tunnel.Test()
 		if err != nil {
 			log.Printf("Failed to test server %s: %v", name, err)
@@ -277,14 +599,148 @@ func (tm *TunnelManager) startBestLatency() error {
 	}
 
 	log.Printf("Auto-selected server %s with latency %v", bestServer, bestLatency)
-	return tm.StartTunnel(bestServer)
+	return tm.startSelected(bestServer)
+}
+
+// startBestThroughput starts the server with the best combination of recent
+// speed test results and live latency. Servers without a recent speed test
+// are ranked on latency alone.
+func (tm *TunnelManager) startBestThroughput() error {
+	weight := tm.currentConfig().ThroughputShare()
+	return tm.startBestScore(config.ScoringWeights{
+		Latency:    1 - weight,
+		Throughput: weight,
+	})
+}
+
+// startBestScore tests every server and starts the one ranked highest by
+// the given scoring weights
+func (tm *TunnelManager) startBestScore(weights config.ScoringWeights) error {
+	latencies := make(map[string]time.Duration)
+	for name, tunnel := range tm.tunnelSnapshot() {
+		latency, err := tunnel.Test()
+		if err != nil {
+			log.Printf("Failed to test server %s: %v", name, err)
+			continue
+		}
+		latencies[name] = latency
+	}
+
+	if len(latencies) == 0 {
+		return fmt.Errorf("no available servers found")
+	}
+
+	var throughput map[string]float64
+	var maxThroughput float64
+	if weights.Throughput > 0 {
+		throughput = tm.recentThroughput()
+		for name := range latencies {
+			if throughput[name] > maxThroughput {
+				maxThroughput = throughput[name]
+			}
+		}
+		if maxThroughput == 0 {
+			// No speed tests available, rank on the remaining components
+			weights.Throughput = 0
+		}
+	}
+
+	tm.mu.RLock()
+	servers := make(map[string]config.Server)
+	for _, server := range tm.config.Servers {
+		servers[server.Name] = server
+	}
+	preferredRegion := tm.config.PreferredRegion
+	tm.mu.RUnlock()
+
+	var loss map[string]float64
+	if weights.PacketLoss > 0 {
+		loss = measurePacketLoss(servers, latencies)
+	}
+
+	var bestServer string
+	var bestScore float64
+	for name, latency := range latencies {
+		server := servers[name]
+		score := weights.Score(config.ScoreInput{
+			Latency:       latency,
+			InRegion:      preferredRegion != "" && server.Region == preferredRegion,
+			Priority:      server.Priority,
+			Cost:          server.Cost,
+			Throughput:    throughput[name],
+			MaxThroughput: maxThroughput,
+			PacketLoss:    loss[name],
+		})
+		if config.Outranks(score, name, bestScore, bestServer) {
+			bestScore = score
+			bestServer = name
+		}
+	}
+
+	log.Printf("Auto-selected server %s with latency %v (score %.2f)", bestServer, latencies[bestServer], bestScore)
+	return tm.startSelected(bestServer)
+}
+
+// lossProbes is how many probes measure a server's packet loss when
+// auto-selecting by score
+const lossProbes = 5
+
+// measurePacketLoss probes the servers that answered a latency test in
+// parallel and returns the fraction of probes each lost
+func measurePacketLoss(servers map[string]config.Server, latencies map[string]time.Duration) map[string]float64 {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	loss := make(map[string]float64)
+	for name := range latencies {
+		server := servers[name]
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			result, _ := probe.Latency(server.Host, server.Port, probe.Options{Count: lossProbes, Timeout: 2 * time.Second})
+			if result == nil {
+				return // Could not resolve; score without loss
+			}
+			mu.Lock()
+			loss[name] = result.Loss
+			mu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+	return loss
+}
+
+// recentThroughput returns the download rate of the latest speed test or
+// bench for each server, ignoring results older than ThroughputMaxAge
+func (tm *TunnelManager) recentThroughput() map[string]float64 {
+	throughput := make(map[string]float64)
+
+	entries, err := diagnostics.NewHistory("").Load("", time.Now().Add(-tm.currentConfig().ThroughputMaxAge))
+	if err != nil {
+		log.Printf("Failed to load throughput history: %v", err)
+		return throughput
+	}
+
+	// Entries are stored oldest first, so later results overwrite earlier ones
+	for _, entry := range entries {
+		if entry.Kind != "throughput" && entry.Kind != "bench" {
+			continue
+		}
+		// Both results report download_mbps
+		var result diagnostics.ThroughputResult
+		if err := json.Unmarshal(entry.Result, &result); err != nil {
+			continue
+		}
+		throughput[entry.Server] = result.DownloadMbps
+	}
+
+	return throughput
 }
 
 // startRandom starts a random available server
 func (tm *TunnelManager) startRandom() error {
 	// Simple implementation - just pick the first available
-	for name := range tm.tunnels {
-		return tm.StartTunnel(name)
+	for name := range tm.tunnelSnapshot() {
+		return tm.startSelected(name)
 	}
 	return fmt.Errorf("no available servers found")
 }
@@ -295,13 +751,62 @@ func (tm *TunnelManager) startLeastLoad() error {
 	return tm.startBestLatency()
 }
 
+// startSelected starts the tunnel picked by auto-selection and makes it the
+// one Dial prefers
+func (tm *TunnelManager) startSelected(name string) error {
+	tm.mu.Lock()
+	tm.selected = name
+	tm.mu.Unlock()
+
+	return tm.StartTunnel(name)
+}
+
+// findServer looks up a server entry by name; the caller holds tm.mu
+func (tm *TunnelManager) findServer(name string) (config.Server, bool) {
+	for _, server := range tm.config.Servers {
+		if server.Name == name {
+			return server, true
+		}
+	}
+	return config.Server{}, false
+}
+
 // createTunnel creates a tunnel instance based on the server configuration
 func (tm *TunnelManager) createTunnel(server config.Server) (Tunnel, error) {
+	if server.Exec != nil {
+		return NewExecTunnel(server), nil
+	}
+
+	if len(server.Chain) > 0 {
+		var hops []config.Server
+		for _, name := range server.Chain {
+			hop, ok := tm.findServer(name)
+			if !ok {
+				return nil, fmt.Errorf("chain hop %s not found", name)
+			}
+			hops = append(hops, hop)
+		}
+		return NewChainTunnel(server, hops), nil
+	}
+
 	switch server.Transport {
 	case config.TransportSSH:
+		if server.Engine == config.EngineOpenSSH {
+			return NewOpenSSHTunnel(server), nil
+		}
 		return NewSSHTunnel(server), nil
 	case config.TransportHysteria:
 		return NewHysteriaTunnel(server), nil
+	case config.TransportTUIC:
+		return NewTUICTunnel(server), nil
+	case config.TransportNaive:
+		return NewNaiveTunnel(server), nil
+	case config.TransportDNS:
+		return NewDNSTunnel(server), nil
+	case config.TransportICMP:
+		return NewICMPTunnel(server), nil
+	case config.TransportSSH3:
+		return NewSSH3Tunnel(server), nil
 	case config.TransportV2Ray, config.TransportVMess, config.TransportVLESS:
 		return NewV2RayTunnel(server), nil
 	case config.TransportWireGuard:
@@ -309,6 +814,9 @@ func (tm *TunnelManager) createTunnel(server config.Server) (Tunnel, error) {
 	case config.TransportTrojan:
 		return NewTrojanTunnel(server), nil
 	default:
+		if factory, ok := lookupTransport(server.Transport); ok {
+			return factory(server)
+		}
 		return nil, fmt.Errorf("unsupported transport type: %s", server.Transport)
 	}
 }
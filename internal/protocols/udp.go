@@ -0,0 +1,406 @@
+package protocols
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"ssh-tunnel/internal/config"
+	"ssh-tunnel/internal/udprelay"
+)
+
+const socks5CmdUDPAssociate = 0x03
+
+// PacketFunc opens a UDP relay through a tunnel. The returned PacketConn
+// addresses datagrams by their remote destination, which may be a domain.
+type PacketFunc func() (net.PacketConn, error)
+
+// packetDialer is implemented by tunnels that can relay UDP
+type packetDialer interface {
+	ListenPacket() (net.PacketConn, error)
+}
+
+// ListenPacket starts a UDP relay on the server by running the relay helper
+// in its own session, which ends when the relay is closed
+func (t *SSHTunnel) ListenPacket() (net.PacketConn, error) {
+	if t.server.UDP == nil {
+		return nil, fmt.Errorf("udp relay is not enabled for %s", t.server.Name)
+	}
+
+	t.mu.RLock()
+	client := t.client
+	t.mu.RUnlock()
+	if client == nil {
+		return nil, fmt.Errorf("ssh tunnel %s is not connected", t.server.Name)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open udp relay session: %v", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	session.Stderr = &execOutput{name: t.server.Name + " udp-relay"}
+	if err := session.Start(t.server.UDP.Relay); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to start udp relay %q: %v", t.server.UDP.Relay, err)
+	}
+
+	return udprelay.NewConn(&sessionStream{Reader: stdout, WriteCloser: stdin, session: session}), nil
+}
+
+// sessionStream is the relay helper's stdio
+type sessionStream struct {
+	io.Reader
+	io.WriteCloser
+	session *ssh.Session
+}
+
+func (s *sessionStream) Close() error {
+	s.WriteCloser.Close()
+	return s.session.Close()
+}
+
+// ListenPacket relays UDP through the client's SOCKS5 UDP ASSOCIATE
+func (t *ExecTunnel) ListenPacket() (net.PacketConn, error) {
+	if t.server.Proxy != config.ProxySOCKS5 {
+		return nil, fmt.Errorf("udp relay through %s needs proxy socks5", t.server.Exec.Binary)
+	}
+	return socks5Associate(t.server.LocalPort, 10*time.Second)
+}
+
+// socks5Associate sets up a UDP association with a local SOCKS5 proxy. The
+// association lasts until the relay is closed or the proxy drops it.
+func socks5Associate(port int, timeout time.Duration) (net.PacketConn, error) {
+	ctrl, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), timeout)
+	if err != nil {
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Now().Add(timeout))
+	reader := bufio.NewReader(ctrl)
+
+	if _, err := ctrl.Write([]byte{socks5Version, 1, socks5AuthNone}); err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(reader, method); err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("failed to read SOCKS5 method: %v", err)
+	}
+	if method[0] != socks5Version || method[1] != socks5AuthNone {
+		ctrl.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy requires authentication")
+	}
+
+	request := []byte{socks5Version, socks5CmdUDPAssociate, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := ctrl.Write(request); err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	// The reply has the request's layout, with the relay's address
+	bound, rep, err := readSOCKS5Request(reader)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("failed to read SOCKS5 reply: %v", err)
+	}
+	if rep != socks5RepSuccess {
+		ctrl.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy refused UDP ASSOCIATE: reply %d", rep)
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	host, boundPort, _ := net.SplitHostPort(bound)
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	udp, err := net.Dial("udp", net.JoinHostPort(host, boundPort))
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	c := &socksPacketConn{Conn: udp, ctrl: ctrl, buf: make([]byte, 65535)}
+	go func() {
+		io.Copy(io.Discard, reader)
+		c.Close()
+	}()
+	return c, nil
+}
+
+// socksPacketConn sends datagrams through a SOCKS5 UDP association
+type socksPacketConn struct {
+	net.Conn // To the proxy's relay address
+	ctrl     net.Conn
+	buf      []byte
+}
+
+func (c *socksPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := c.buf
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < 3 || buf[2] != 0 {
+			continue // Fragments are not supported
+		}
+		from, payload, err := udprelay.SplitAddr(buf[3:n])
+		if err != nil {
+			continue
+		}
+		return copy(p, payload), udprelay.Addr(from), nil
+	}
+}
+
+func (c *socksPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	datagram, err := udprelay.AppendAddr([]byte{0, 0, 0}, addr.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(append(datagram, p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socksPacketConn) Close() error {
+	c.ctrl.Close()
+	return c.Conn.Close()
+}
+
+// serveUDPAssociate relays a SOCKS5 client's datagrams through the tunnel
+// for as long as the client keeps its control connection open
+func serveUDPAssociate(conn net.Conn, reader *bufio.Reader, packets PacketFunc) error {
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	local, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		writeSOCKS5Reply(conn, socks5RepGeneralFailure)
+		return fmt.Errorf("failed to open UDP relay port: %v", err)
+	}
+	defer local.Close()
+
+	remote, err := packets()
+	if err != nil {
+		writeSOCKS5Reply(conn, socks5RepGeneralFailure)
+		return err
+	}
+	defer remote.Close()
+
+	reply, err := udprelay.AppendAddr([]byte{socks5Version, socks5RepSuccess, 0x00}, local.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(reply); err != nil {
+		return err
+	}
+
+	// Only the client that opened the association may use it; it is bound
+	// to the first address sending from the client's host
+	clientHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	clientIP := net.ParseIP(clientHost)
+	var client atomic.Pointer[net.UDPAddr]
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := remote.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			to := client.Load()
+			if to == nil {
+				continue
+			}
+			datagram, err := udprelay.AppendAddr([]byte{0, 0, 0}, from.String())
+			if err != nil {
+				continue
+			}
+			local.WriteTo(append(datagram, buf[:n]...), to)
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, src, err := local.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			from := src.(*net.UDPAddr)
+			if to := client.Load(); to == nil {
+				if !from.IP.Equal(clientIP) {
+					continue
+				}
+				client.Store(from)
+			} else if !from.IP.Equal(to.IP) || from.Port != to.Port {
+				continue
+			}
+
+			if n < 3 || buf[2] != 0 {
+				continue // Fragments are not supported
+			}
+			target, payload, err := udprelay.SplitAddr(buf[3:n])
+			if err != nil {
+				continue
+			}
+			remote.WriteTo(payload, udprelay.Addr(target))
+		}
+	}()
+
+	io.Copy(io.Discard, reader)
+	return nil
+}
+
+// udpFlow is one client's relay through a UDP forward
+type udpFlow struct {
+	remote     net.PacketConn
+	lastActive atomic.Int64 // Unix nanoseconds
+}
+
+// serveUDPForward relays datagrams arriving on local to target through the
+// tunnel. Each client address gets its own relay, closed after idle.
+func serveUDPForward(local net.PacketConn, target string, packets PacketFunc, idle time.Duration) {
+	var mu sync.Mutex
+	flows := make(map[string]*udpFlow)
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		mu.Lock()
+		for _, flow := range flows {
+			flow.remote.Close()
+		}
+		mu.Unlock()
+	}()
+
+	go func() {
+		reaper := time.NewTicker(idle / 2)
+		defer reaper.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-reaper.C:
+			}
+
+			cutoff := time.Now().Add(-idle).UnixNano()
+			mu.Lock()
+			for key, flow := range flows {
+				if flow.lastActive.Load() < cutoff {
+					flow.remote.Close()
+					delete(flows, key)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := local.ReadFrom(buf)
+		if err != nil {
+			return // Listener closed
+		}
+
+		mu.Lock()
+		flow := flows[client.String()]
+		mu.Unlock()
+		if flow == nil {
+			remote, err := packets()
+			if err != nil {
+				log.Printf("UDP forward to %s: %v", target, err)
+				continue
+			}
+			flow = &udpFlow{remote: remote}
+			mu.Lock()
+			flows[client.String()] = flow
+			mu.Unlock()
+
+			go func(flow *udpFlow, client net.Addr) {
+				buf := make([]byte, 65535)
+				for {
+					n, _, err := flow.remote.ReadFrom(buf)
+					if err != nil {
+						return
+					}
+					flow.lastActive.Store(time.Now().UnixNano())
+					local.WriteTo(buf[:n], client)
+				}
+			}(flow, client)
+		}
+
+		flow.lastActive.Store(time.Now().UnixNano())
+		flow.remote.WriteTo(buf[:n], udprelay.Addr(target))
+	}
+}
+
+// ListenPacket opens a UDP relay through one named tunnel
+func (tm *TunnelManager) ListenPacket(name string) (net.PacketConn, error) {
+	tm.mu.RLock()
+	sup, exists := tm.supervisors[name]
+	tm.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("tunnel %s not found", name)
+	}
+	d, ok := sup.tunnel.(packetDialer)
+	if !ok {
+		return nil, fmt.Errorf("tunnel %s cannot relay UDP", name)
+	}
+	if sup.snapshot().Status != string(StateConnected) {
+		return nil, fmt.Errorf("tunnel %s is not connected", name)
+	}
+	return d.ListenPacket()
+}
+
+// startUDPForwards opens the local UDP ports of every tunnel's forwards
+func (tm *TunnelManager) startUDPForwards() {
+	tm.mu.RLock()
+	servers := tm.config.Servers
+	tm.mu.RUnlock()
+
+	for _, server := range servers {
+		if !server.Enabled || server.UDP == nil {
+			continue
+		}
+		name := server.Name
+		packets := func() (net.PacketConn, error) { return tm.ListenPacket(name) }
+
+		for _, spec := range server.UDP.Forwards {
+			forward, err := config.ParseUDPForward(spec)
+			if err != nil {
+				continue
+			}
+			local, err := net.ListenPacket("udp", fmt.Sprintf(":%d", forward.LocalPort))
+			tm.recordStartup(componentUDPForward, spec, err)
+			if err != nil {
+				log.Printf("UDP forward %s disabled: %v", spec, err)
+				continue
+			}
+
+			tm.mu.Lock()
+			tm.udpForwards = append(tm.udpForwards, local)
+			tm.mu.Unlock()
+
+			log.Printf("UDP forward started on port %d to %s through %s", forward.LocalPort, forward.Target, name)
+			go serveUDPForward(local, forward.Target, packets, server.UDP.Timeout)
+		}
+	}
+}
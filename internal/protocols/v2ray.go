@@ -0,0 +1,479 @@
+package protocols
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ssh-tunnel/internal/config"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/websocket"
+)
+
+// VLESS protocol constants
+const (
+	vlessVersion = 0x00
+	vlessCmdTCP  = 0x01
+
+	vlessAtypIPv4   = 0x01
+	vlessAtypDomain = 0x02
+	vlessAtypIPv6   = 0x03
+)
+
+// V2RayTunnel implements the Tunnel interface for V2Ray-family protocols.
+// The outbound protocol is VLESS for the vless transport and VMess, with
+// AEAD headers, for vmess and v2ray; it runs over raw TCP, WebSocket or
+// gRPC, with optional TLS. Setting host and sni lets the WebSocket and gRPC
+// transports be fronted through a CDN such as Cloudflare while dialing any
+// edge address.
+type V2RayTunnel struct {
+	server    config.Server
+	dial      DialFunc // Reaches the server; replaced when it is a chain hop
+	uuid      [16]byte
+	security  byte             // VMess body security
+	transport *http2.Transport // gRPC only
+	listener  net.Listener
+	status    *TunnelStatus
+	mu        sync.RWMutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// NewV2RayTunnel creates a new V2Ray tunnel
+func NewV2RayTunnel(server config.Server) *V2RayTunnel {
+	return &V2RayTunnel{
+		server: server,
+		dial:   (&net.Dialer{Timeout: server.Timeout}).Dial,
+		status: &TunnelStatus{
+			ServerName: server.Name,
+			Status:     "disconnected",
+		},
+	}
+}
+
+// Start starts the V2Ray tunnel
+func (t *V2RayTunnel) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.server.V2Ray.Network == "kcp" {
+		return fmt.Errorf("the kcp network needs an exec client")
+	}
+
+	uuid, err := parseUUID(t.server.V2Ray.UUID)
+	if err != nil {
+		return err
+	}
+	t.uuid = uuid
+	if t.security, err = vmessSecurity(t.server.V2Ray.Security); err != nil {
+		return err
+	}
+
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	t.status.Status = "connecting"
+	t.status.StartTime = time.Now()
+
+	if t.network() == "grpc" {
+		t.transport = t.grpcTransport()
+	}
+
+	listener, err := listenLocal(t.server)
+	if err != nil {
+		t.status.Status = "error"
+		t.status.LastError = err.Error()
+		return fmt.Errorf("failed to create local listener: %v", err)
+	}
+
+	t.listener = listener
+	t.status.Status = "connected"
+	log.Printf("%s proxy started on port %d for %s (%s/%s)", t.server.Proxy, t.server.LocalPort, t.server.Name, t.protocol(), t.network())
+
+	go t.acceptConnections()
+
+	return nil
+}
+
+// Stop stops the V2Ray tunnel
+func (t *V2RayTunnel) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cancel != nil {
+		t.cancel()
+	}
+
+	if t.listener != nil {
+		t.listener.Close()
+		t.listener = nil
+	}
+
+	if t.transport != nil {
+		t.transport.CloseIdleConnections()
+		t.transport = nil
+	}
+
+	t.status.Status = "disconnected"
+	return nil
+}
+
+// GetStatus returns the current status
+func (t *V2RayTunnel) GetStatus() *TunnelStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	statusCopy := *t.status
+	return &statusCopy
+}
+
+// GetName returns the tunnel name
+func (t *V2RayTunnel) GetName() string {
+	return t.server.Name
+}
+
+// Test measures the time to establish the transport (TCP, TLS and the
+// WebSocket upgrade) through the fronting server. For gRPC only the
+// Test times a request through the server: the transport handshakes, then
+// a VLESS or VMess request for a URL test, which the server only answers
+// for an authenticated client. gRPC, whose streams need the running
+// transport, is timed up to the TLS handshake.
+func (t *V2RayTunnel) Test() (time.Duration, error) {
+	if t.network() == "kcp" {
+		return 0, fmt.Errorf("latency test not supported for mKCP")
+	}
+	uuid, err := parseUUID(t.server.V2Ray.UUID)
+	if err != nil {
+		return 0, err
+	}
+	security, err := vmessSecurity(t.server.V2Ray.Security)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if t.network() == "grpc" {
+		conn, err := t.dialConn()
+		if err != nil {
+			return 0, err
+		}
+		conn.Close()
+		return time.Since(start), nil
+	}
+
+	conn, err := t.dialTransport()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(t.server.Timeout))
+
+	if t.protocol() == "vless" {
+		err = probeVLESS(conn, uuid)
+	} else {
+		err = probeVMess(conn, uuid, security)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// Dial opens a VLESS or VMess stream to addr
+func (t *V2RayTunnel) Dial(network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if t.network() == "grpc" {
+		conn, err = t.dialGRPC()
+	} else {
+		conn, err = t.dialTransport()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if t.protocol() == "vmess" {
+		stream, err := dialVMess(conn, t.uuid, t.security, addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return stream, nil
+	}
+
+	request, err := vlessRequest(t.uuid, addr)
+	if err == nil {
+		_, err = conn.Write(request)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send VLESS request: %v", err)
+	}
+
+	return &vlessConn{Conn: conn}, nil
+}
+
+// acceptConnections accepts and handles incoming connections
+func (t *V2RayTunnel) acceptConnections() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if t.ctx.Err() != nil {
+				return // Context cancelled
+			}
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := handleInbound(conn, t.server.Proxy, t.Dial); err != nil {
+				log.Printf("Connection error for %s: %v", t.server.Name, err)
+			}
+		}()
+	}
+}
+
+// protocol is the outbound protocol: vless, or vmess for the vmess and
+// v2ray transports
+func (t *V2RayTunnel) protocol() string {
+	if t.server.Transport == config.TransportVLESS {
+		return "vless"
+	}
+	return "vmess"
+}
+
+func (t *V2RayTunnel) network() string {
+	if t.server.V2Ray.Network == "" {
+		return "tcp"
+	}
+	return t.server.V2Ray.Network
+}
+
+// hostHeader returns the HTTP Host (or gRPC :authority) to present. Behind a
+// CDN this is the proxied domain, which may differ from the dialed host.
+func (t *V2RayTunnel) hostHeader() string {
+	if t.server.V2Ray.Host != "" {
+		return t.server.V2Ray.Host
+	}
+	if host := t.server.V2Ray.Headers["Host"]; host != "" {
+		return host
+	}
+	return t.server.Host
+}
+
+func (t *V2RayTunnel) tlsConfig() *tls.Config {
+	serverName := t.server.V2Ray.SNI
+	if serverName == "" {
+		serverName = t.hostHeader()
+	}
+	nextProto := "http/1.1"
+	if t.network() == "grpc" {
+		nextProto = "h2"
+	}
+	return &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         []string{nextProto},
+		InsecureSkipVerify: t.server.InsecureSkipVerify,
+	}
+}
+
+// dialTransport connects to the server and completes the TLS and WebSocket
+// handshakes required by the configured stream settings
+func (t *V2RayTunnel) dialTransport() (net.Conn, error) {
+	conn, err := t.dialConn()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.network() != "ws" {
+		return conn, nil
+	}
+
+	ws, err := t.upgradeWebSocket(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// dialGRPC opens a gRPC stream on the shared HTTP/2 connection
+func (t *V2RayTunnel) dialGRPC() (net.Conn, error) {
+	t.mu.RLock()
+	transport := t.transport
+	ctx := t.ctx
+	t.mu.RUnlock()
+
+	if transport == nil {
+		return nil, fmt.Errorf("tunnel %s is not running", t.server.Name)
+	}
+
+	scheme := "http"
+	if t.server.V2Ray.TLS == "tls" {
+		scheme = "https"
+	}
+	grpc := t.server.V2Ray.GRPC
+	addr := net.JoinHostPort(t.server.Host, t.server.Port)
+
+	return dialGun(ctx, transport, scheme, addr, t.hostHeader(), grpc.ServiceName, grpc.MultiMode), nil
+}
+
+// grpcTransport creates the HTTP/2 transport all gRPC streams share; h2c is
+// used without TLS
+func (t *V2RayTunnel) grpcTransport() *http2.Transport {
+	return &http2.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return t.dialConn()
+		},
+		AllowHTTP:       true,
+		ReadIdleTimeout: 30 * time.Second,
+	}
+}
+
+// dialConn opens the TCP connection, with TLS when configured
+func (t *V2RayTunnel) dialConn() (net.Conn, error) {
+	addr := net.JoinHostPort(t.server.Host, t.server.Port)
+	conn, err := t.dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+
+	if t.server.V2Ray.TLS != "tls" {
+		return conn, nil
+	}
+
+	tlsConn, err := tlsHandshake(wrapFragment(t.server, conn), t.tlsConfig(), t.server.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	return tlsConn, nil
+}
+
+// tlsHandshake runs a TLS client handshake on conn within timeout, closing
+// the connection on failure
+func tlsHandshake(conn net.Conn, cfg *tls.Config, timeout time.Duration) (net.Conn, error) {
+	tlsConn := tls.Client(conn, cfg)
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// upgradeWebSocket performs the WebSocket handshake on an established
+// connection using the configured path, Host and extra headers
+func (t *V2RayTunnel) upgradeWebSocket(conn net.Conn) (net.Conn, error) {
+	scheme, origin := "ws", "http"
+	if t.server.V2Ray.TLS == "tls" {
+		scheme, origin = "wss", "https"
+	}
+
+	host := t.hostHeader()
+	wsConfig, err := websocket.NewConfig(scheme+"://"+host+t.server.V2Ray.Path, origin+"://"+host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid websocket location: %v", err)
+	}
+	for name, value := range t.server.V2Ray.Headers {
+		if !strings.EqualFold(name, "Host") {
+			wsConfig.Header.Set(name, value)
+		}
+	}
+	if wsConfig.Header.Get("User-Agent") == "" {
+		wsConfig.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
+	}
+
+	conn.SetDeadline(time.Now().Add(t.server.Timeout))
+	ws, err := websocket.NewClient(wsConfig, conn)
+	if err != nil {
+		return nil, fmt.Errorf("websocket handshake with %s failed: %v", host, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// vlessRequest encodes the VLESS request header for a TCP stream to addr
+func vlessRequest(uuid [16]byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %v", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+
+	buf := []byte{vlessVersion}
+	buf = append(buf, uuid[:]...)
+	buf = append(buf, 0, vlessCmdTCP, byte(port>>8), byte(port))
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, vlessAtypIPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, vlessAtypIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain name too long: %s", host)
+		}
+		buf = append(buf, vlessAtypDomain, byte(len(host)))
+		buf = append(buf, host...)
+	}
+
+	return buf, nil
+}
+
+// parseUUID decodes a textual UUID into its 16 raw bytes
+func parseUUID(s string) ([16]byte, error) {
+	var uuid [16]byte
+	raw, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(raw) != len(uuid) {
+		return uuid, fmt.Errorf("invalid UUID: %s", s)
+	}
+	copy(uuid[:], raw)
+	return uuid, nil
+}
+
+// vlessConn strips the VLESS response header before the first read
+type vlessConn struct {
+	net.Conn
+	once sync.Once
+	err  error
+}
+
+func (c *vlessConn) Read(p []byte) (int, error) {
+	c.once.Do(func() {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			c.err = fmt.Errorf("failed to read VLESS response: %v", err)
+			return
+		}
+		if header[0] != vlessVersion {
+			c.err = fmt.Errorf("unexpected VLESS response version: %d", header[0])
+			return
+		}
+		if _, err := io.CopyN(io.Discard, c.Conn, int64(header[1])); err != nil {
+			c.err = fmt.Errorf("failed to read VLESS addons: %v", err)
+		}
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,558 @@
+package protocols
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"ssh-tunnel/internal/config"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Conformance check results
+const (
+	VerifyPass = "pass"
+	VerifyFail = "fail"
+	VerifySkip = "skip" // Not applicable, or not something the server must support
+)
+
+// Targets for the address type variants; both answer HTTP
+const (
+	verifyIPv4Target = "1.1.1.1:80"
+	verifyIPv6Target = "[2606:4700:4700::1111]:80"
+
+	verifyTimeout = 10 * time.Second // When the server has no timeout
+)
+
+// VerifyCheck is the outcome of one conformance check
+type VerifyCheck struct {
+	Group    string        `json:"group"` // e.g. "ssh", "socks", "vless"
+	Name     string        `json:"name"`
+	Result   string        `json:"result"`
+	Detail   string        `json:"detail,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// VerifyReport is a server's compatibility report
+type VerifyReport struct {
+	Server    string        `json:"server"`
+	Transport string        `json:"transport"`
+	Time      time.Time     `json:"time"`
+	Checks    []VerifyCheck `json:"checks"`
+}
+
+// Compatible reports whether no check failed
+func (r *VerifyReport) Compatible() bool {
+	for _, check := range r.Checks {
+		if check.Result == VerifyFail {
+			return false
+		}
+	}
+	return true
+}
+
+// Render formats the report as a table, one group after another
+func (r *VerifyReport) Render() string {
+	var b strings.Builder
+	counts := map[string]int{}
+	group := ""
+	for _, check := range r.Checks {
+		if check.Group != group {
+			group = check.Group
+			fmt.Fprintf(&b, "%s\n", strings.ToUpper(group))
+		}
+		mark := "✅"
+		switch check.Result {
+		case VerifyFail:
+			mark = "❌"
+		case VerifySkip:
+			mark = "⏭️ "
+		}
+		duration := ""
+		if check.Duration > 0 {
+			duration = check.Duration.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(&b, "  %s %-28s %8s  %s\n", mark, check.Name, duration, check.Detail)
+		counts[check.Result]++
+	}
+	fmt.Fprintf(&b, "\n%d passed, %d failed, %d skipped\n", counts[VerifyPass], counts[VerifyFail], counts[VerifySkip])
+	return b.String()
+}
+
+// errVerifySkip marks a check that does not apply
+type errVerifySkip string
+
+func (e errVerifySkip) Error() string { return string(e) }
+
+// verifier runs checks into a report
+type verifier struct {
+	report  *VerifyReport
+	group   string
+	timeout time.Duration
+}
+
+// check runs fn and records its result; fn returns a detail for the report
+func (v *verifier) check(name string, fn func() (string, error)) bool {
+	start := time.Now()
+	detail, err := fn()
+	check := VerifyCheck{Group: v.group, Name: name, Result: VerifyPass, Detail: detail, Duration: time.Since(start)}
+
+	var skip errVerifySkip
+	switch {
+	case errors.As(err, &skip):
+		check.Result, check.Detail, check.Duration = VerifySkip, skip.Error(), 0
+	case err != nil:
+		check.Result, check.Detail = VerifyFail, err.Error()
+	}
+	v.report.Checks = append(v.report.Checks, check)
+	return err == nil
+}
+
+// Verify runs the conformance suite for a server's protocol against the
+// server, without starting its tunnel: SSH channel types and the SOCKS
+// behaviors through them, VLESS handshake variants, and Hysteria's QUIC
+// negotiation. Other transports get a connectivity check.
+func (tm *TunnelManager) Verify(name string) (*VerifyReport, error) {
+	tm.mu.RLock()
+	server, ok := tm.findServer(name)
+	tm.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("server %s not found", name)
+	}
+
+	v := &verifier{
+		report:  &VerifyReport{Server: server.Name, Transport: string(server.Transport), Time: time.Now()},
+		timeout: server.Timeout,
+	}
+	if v.timeout <= 0 {
+		v.timeout = verifyTimeout
+	}
+
+	switch {
+	case server.Exec != nil || len(server.Chain) > 0:
+		tm.verifyGeneric(v, server)
+	case server.Transport == config.TransportSSH || server.Transport == config.TransportICMP:
+		verifySSH(v, server)
+	case server.Transport == config.TransportVLESS && server.V2Ray != nil && server.V2Ray.Network != "kcp":
+		verifyVLESS(v, server)
+	case server.Transport == config.TransportHysteria && server.Hysteria != nil:
+		verifyHysteria(v, server)
+	default:
+		tm.verifyGeneric(v, server)
+	}
+	return v.report, nil
+}
+
+// verifyGeneric times the tunnel's own latency test, for transports
+// without a conformance suite
+func (tm *TunnelManager) verifyGeneric(v *verifier, server config.Server) {
+	v.group = "connectivity"
+	v.check("latency test", func() (string, error) {
+		tunnel, err := tm.createTunnel(server)
+		if err != nil {
+			return "", err
+		}
+		rtt, err := tunnel.Test()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%v", rtt.Round(time.Millisecond)), nil
+	})
+	v.check("conformance suite", func() (string, error) {
+		return "", errVerifySkip(fmt.Sprintf("none for %s yet", describeTransport(server)))
+	})
+}
+
+func describeTransport(server config.Server) string {
+	switch {
+	case server.Exec != nil:
+		return "exec servers"
+	case len(server.Chain) > 0:
+		return "chains"
+	default:
+		return string(server.Transport)
+	}
+}
+
+// verifySSH checks the channel types and requests tunnels rely on, then
+// the SOCKS proxy behaviors through direct-tcpip channels
+func verifySSH(v *verifier, server config.Server) {
+	v.group = "ssh"
+	var client *ssh.Client
+	ok := v.check("handshake", func() (string, error) {
+		clientConfig, err := sshClientConfig(server)
+		if err != nil {
+			return "", err
+		}
+		dial := dialObfuscated
+		if server.Transport == config.TransportICMP {
+			dial = dialICMP
+		}
+		conn, err := dial(server, v.timeout)
+		if err != nil {
+			return "", fmt.Errorf("failed to connect: %v", err)
+		}
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, net.JoinHostPort(server.Host, server.Port), clientConfig)
+		if err != nil {
+			conn.Close()
+			return "", err
+		}
+		client = ssh.NewClient(sshConn, chans, reqs)
+		return string(sshConn.ServerVersion()), nil
+	})
+	if !ok {
+		return
+	}
+	defer client.Close()
+
+	v.check("session channel", func() (string, error) {
+		session, err := client.NewSession()
+		if err != nil {
+			return "", err
+		}
+		defer session.Close()
+		stop := closeAfter(session, v.timeout)
+		defer stop()
+		if err := session.Run("exit 0"); err != nil {
+			return "", fmt.Errorf("exec refused: %v", err)
+		}
+		return "exec", nil
+	})
+	v.check("keepalive@openssh.com", func() (string, error) {
+		// Servers answer unknown global requests with a failure; no
+		// answer at all stalls keepalives
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			return "answered", err
+		case <-time.After(v.timeout):
+			return "", fmt.Errorf("no answer within %v", v.timeout)
+		}
+	})
+	v.check("direct-tcpip", func() (string, error) {
+		conn, err := client.Dial("tcp", probeTarget)
+		if err != nil {
+			return "", err
+		}
+		return verifyHTTP(conn, v.timeout)
+	})
+	v.check("direct-tcpip refusal", func() (string, error) {
+		conn, err := client.Dial("tcp", "127.0.0.1:1")
+		if err == nil {
+			conn.Close()
+			return "", fmt.Errorf("opened a channel to a closed port")
+		}
+		var openErr *ssh.OpenChannelError
+		if !errors.As(err, &openErr) {
+			return "", err
+		}
+		return fmt.Sprintf("rejected: %v", openErr.Reason), nil
+	})
+	v.check("tcpip-forward", func() (string, error) {
+		listener, err := client.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", fmt.Errorf("remote forwarding refused: %v", err)
+		}
+		defer listener.Close()
+		return fmt.Sprintf("bound %s", listener.Addr()), nil
+	})
+	v.check("direct-streamlocal@openssh.com", func() (string, error) {
+		conn, err := client.Dial("unix", "/nonexistent/tunnel-verify.sock")
+		if err == nil {
+			conn.Close()
+			return "", fmt.Errorf("opened a channel to a missing socket")
+		}
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) && openErr.Reason == ssh.ConnectionFailed {
+			return "supported", nil
+		}
+		return "", errVerifySkip(fmt.Sprintf("not offered: %v", err))
+	})
+
+	verifySOCKS(v, client.Dial)
+}
+
+// verifySOCKS drives the local proxy, as a client would, over dial
+func verifySOCKS(v *verifier, dial DialFunc) {
+	v.group = "socks"
+	proxied := func(handshake func(net.Conn, *bufio.Reader) error) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			handleInbound(server, config.ProxyAuto, dial)
+		}()
+		client.SetDeadline(time.Now().Add(v.timeout))
+		reader := bufio.NewReader(client)
+		if err := handshake(client, reader); err != nil {
+			client.Close()
+			return nil, err
+		}
+		client.SetDeadline(time.Time{})
+		return &bufferedConn{Conn: client, reader: reader}, nil
+	}
+	socks5 := func(target string) func() (string, error) {
+		return func() (string, error) {
+			conn, err := proxied(func(conn net.Conn, reader *bufio.Reader) error {
+				return socks5Connect(conn, reader, target)
+			})
+			if err != nil {
+				return "", err
+			}
+			return verifyHTTP(conn, v.timeout)
+		}
+	}
+
+	v.check("socks5 connect (domain)", socks5(probeTarget))
+	v.check("socks5 connect (ipv4)", socks5(verifyIPv4Target))
+	v.check("socks5 connect (ipv6)", func() (string, error) {
+		detail, err := socks5(verifyIPv6Target)()
+		if err != nil {
+			return "", errVerifySkip(fmt.Sprintf("no IPv6 from the server: %v", err))
+		}
+		return detail, nil
+	})
+	v.check("socks5 refused target", func() (string, error) {
+		conn, err := proxied(func(conn net.Conn, reader *bufio.Reader) error {
+			return socks5Connect(conn, reader, "127.0.0.1:1")
+		})
+		if err == nil {
+			conn.Close()
+			return "", fmt.Errorf("reported success for a closed port")
+		}
+		return "failure reply", nil
+	})
+	v.check("socks4a connect", func() (string, error) {
+		host, port, _ := net.SplitHostPort(probeTarget)
+		conn, err := proxied(func(conn net.Conn, reader *bufio.Reader) error {
+			p, _ := strconv.Atoi(port)
+			// 0.0.0.1 and an empty user ID, then the domain
+			request := []byte{socks4Version, socks4CmdConnect, byte(p >> 8), byte(p), 0, 0, 0, 1, 0}
+			request = append(append(request, host...), 0)
+			if _, err := conn.Write(request); err != nil {
+				return err
+			}
+			reply := make([]byte, 8)
+			if _, err := io.ReadFull(reader, reply); err != nil {
+				return fmt.Errorf("failed to read SOCKS4 reply: %v", err)
+			}
+			if reply[1] != socks4RepGranted {
+				return fmt.Errorf("SOCKS4 proxy refused %s: reply %d", probeTarget, reply[1])
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		return verifyHTTP(conn, v.timeout)
+	})
+	v.check("http connect", func() (string, error) {
+		conn, err := proxied(func(conn net.Conn, reader *bufio.Reader) error {
+			return httpConnect(conn, reader, probeTarget)
+		})
+		if err != nil {
+			return "", err
+		}
+		return verifyHTTP(conn, v.timeout)
+	})
+}
+
+// verifyVLESS tries VLESS requests for each address type, with the first
+// payload in the request and after it, and checks that a client with an
+// unknown UUID gets no answer
+func verifyVLESS(v *verifier, server config.Server) {
+	v.group = "vless"
+	t := NewV2RayTunnel(server)
+	uuid, err := parseUUID(server.V2Ray.UUID)
+	if err != nil {
+		v.check("uuid", func() (string, error) { return "", err })
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	t.ctx = ctx
+	if t.network() == "grpc" {
+		t.transport = t.grpcTransport()
+		defer t.transport.CloseIdleConnections()
+	}
+	open := func() (net.Conn, error) {
+		if t.network() == "grpc" {
+			return t.dialGRPC()
+		}
+		return t.dialTransport()
+	}
+
+	transport := t.network()
+	if server.V2Ray.TLS == "tls" {
+		transport += "+tls"
+	}
+	ok := v.check("transport", func() (string, error) {
+		conn, err := open()
+		if err != nil {
+			return "", err
+		}
+		conn.Close()
+		return transport, nil
+	})
+	if !ok {
+		return
+	}
+
+	request := func(id [16]byte, target string, split bool) (string, error) {
+		header, err := vlessRequest(id, target)
+		if err != nil {
+			return "", err
+		}
+		conn, err := open()
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		stop := closeAfter(conn, v.timeout)
+		defer stop()
+
+		if split {
+			if _, err := conn.Write(header); err != nil {
+				return "", fmt.Errorf("failed to send VLESS request: %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+			_, err = conn.Write(probeRequest)
+		} else {
+			_, err = conn.Write(append(header, probeRequest...))
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to send VLESS request: %v", err)
+		}
+
+		response := make([]byte, 2)
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return "", fmt.Errorf("no VLESS response: %v", err)
+		}
+		if response[0] != vlessVersion {
+			return "", fmt.Errorf("unexpected VLESS response version: %d", response[0])
+		}
+		if _, err := io.CopyN(io.Discard, conn, int64(response[1])); err != nil {
+			return "", fmt.Errorf("failed to read VLESS addons: %v", err)
+		}
+		status, err := readStatusLine(bufio.NewReader(conn))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s, %d bytes of addons", status, response[1]), nil
+	}
+
+	v.check("request (domain)", func() (string, error) { return request(uuid, probeTarget, false) })
+	v.check("request (ipv4)", func() (string, error) { return request(uuid, verifyIPv4Target, false) })
+	v.check("request (ipv6)", func() (string, error) {
+		detail, err := request(uuid, verifyIPv6Target, false)
+		if err != nil {
+			return "", errVerifySkip(fmt.Sprintf("no IPv6 from the server: %v", err))
+		}
+		return detail, nil
+	})
+	v.check("payload after request", func() (string, error) { return request(uuid, probeTarget, true) })
+	v.check("unknown uuid rejected", func() (string, error) {
+		var other [16]byte
+		rand.Read(other[:])
+		if _, err := request(other, probeTarget, false); err == nil {
+			return "", fmt.Errorf("server answered a client with an unknown UUID")
+		}
+		return "no response", nil
+	})
+}
+
+// verifyHysteria checks the QUIC version negotiation Hysteria 2 runs on,
+// and that Salamander hides the server from plain QUIC
+func verifyHysteria(v *verifier, server config.Server) {
+	v.group = "hysteria"
+	hy := server.Hysteria
+	var obfsKey []byte
+	if hy.Obfs != "" {
+		if hy.Obfs != "salamander" {
+			v.check("obfuscation", func() (string, error) {
+				return "", errVerifySkip(fmt.Sprintf("%s obfuscation is not supported", hy.Obfs))
+			})
+			return
+		}
+		obfsKey = []byte(hy.ObfsPassword)
+	}
+
+	negotiated := v.check("quic version negotiation", func() (string, error) {
+		_, versions, err := quicNegotiate(server, obfsKey)
+		if err != nil {
+			return "", err
+		}
+		offered := make([]string, 0, len(versions))
+		v1 := false
+		for _, version := range versions {
+			offered = append(offered, fmt.Sprintf("0x%08x", version))
+			v1 = v1 || version == 0x00000001
+		}
+		if !v1 {
+			return "", fmt.Errorf("QUIC v1 not offered (%s)", strings.Join(offered, ", "))
+		}
+		return strings.Join(offered, ", "), nil
+	})
+	v.check("salamander", func() (string, error) {
+		if obfsKey == nil {
+			return "", errVerifySkip("not configured")
+		}
+		if !negotiated {
+			return "", errVerifySkip("no answer to obfuscated QUIC either")
+		}
+		if _, _, err := quicNegotiate(server, nil); err == nil {
+			return "", fmt.Errorf("server also answers plain QUIC")
+		}
+		return "plain QUIC ignored", nil
+	})
+	v.check("bandwidth negotiation", func() (string, error) {
+		bandwidth := hy.Bandwidth
+		if bandwidth == "" {
+			bandwidth = "none"
+		}
+		return "", errVerifySkip(fmt.Sprintf("needs the Hysteria QUIC handshake, which is not implemented yet (configured: %s)", bandwidth))
+	})
+}
+
+// verifyHTTP sends the URL test request over conn and returns the status
+// line of the answer
+func verifyHTTP(conn net.Conn, timeout time.Duration) (string, error) {
+	defer conn.Close()
+	stop := closeAfter(conn, timeout)
+	defer stop()
+
+	if _, err := conn.Write(probeRequest); err != nil {
+		return "", err
+	}
+	return readStatusLine(bufio.NewReader(conn))
+}
+
+// readStatusLine reads an HTTP response's status line
+func readStatusLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("no HTTP response: %v", err)
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "HTTP/") {
+		return "", fmt.Errorf("not an HTTP response: %q", line)
+	}
+	return line, nil
+}
+
+// closeAfter closes c when timeout passes first; some connections, like
+// gRPC streams, ignore deadlines
+func closeAfter(c io.Closer, timeout time.Duration) func() bool {
+	return time.AfterFunc(timeout, func() { c.Close() }).Stop
+}
@@ -0,0 +1,441 @@
+package protocols
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// VMess constants for AEAD headers with AES-128-GCM or ChaCha20-Poly1305
+// bodies
+const (
+	vmessVersion          = 1
+	vmessOptionChunk      = 0x01
+	vmessSecurityAESGCM   = 0x03
+	vmessSecurityChaCha20 = 0x04
+	vmessCmdTCP           = 0x01
+
+	vmessAtypIPv4   = 0x01
+	vmessAtypDomain = 0x02
+	vmessAtypIPv6   = 0x03
+
+	vmessCmdKeySalt = "c48619fe-8f02-49e0-b9e9-edf763e17e21"
+
+	// vmessChunkSize is the most payload sent in one body chunk, as Xray
+	// sends them
+	vmessChunkSize = 8192
+)
+
+// vmessSecurity returns the body security byte for a configured security
+// name; "auto" picks AES-128-GCM
+func vmessSecurity(name string) (byte, error) {
+	switch name {
+	case "", "auto", "aes-128-gcm":
+		return vmessSecurityAESGCM, nil
+	case "chacha20-poly1305":
+		return vmessSecurityChaCha20, nil
+	default:
+		return 0, fmt.Errorf("unsupported vmess security: %s (supported: auto, aes-128-gcm, chacha20-poly1305)", name)
+	}
+}
+
+// vmessSession is the client side of one VMess AEAD connection
+type vmessSession struct {
+	cmdKey         [16]byte
+	requestKey     [16]byte
+	requestIV      [16]byte
+	responseKey    [16]byte
+	responseIV     [16]byte
+	responseHeader byte
+	security       byte
+	count          uint16 // Request chunks sealed
+	readCount      uint16 // Response chunks opened
+	requestAEAD    cipher.AEAD
+	responseAEAD   cipher.AEAD
+}
+
+func newVMessSession(uuid [16]byte, security byte) (*vmessSession, error) {
+	s := &vmessSession{
+		cmdKey:   md5.Sum(append(uuid[:], vmessCmdKeySalt...)),
+		security: security,
+	}
+
+	random := make([]byte, 33)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	copy(s.requestKey[:], random[:16])
+	copy(s.requestIV[:], random[16:32])
+	s.responseHeader = random[32]
+
+	key := sha256.Sum256(s.requestKey[:])
+	iv := sha256.Sum256(s.requestIV[:])
+	copy(s.responseKey[:], key[:16])
+	copy(s.responseIV[:], iv[:16])
+
+	var err error
+	if s.requestAEAD, err = vmessBodyAEAD(security, s.requestKey[:]); err != nil {
+		return nil, err
+	}
+	if s.responseAEAD, err = vmessBodyAEAD(security, s.responseKey[:]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// vmessBodyAEAD creates the body cipher; ChaCha20-Poly1305 stretches the
+// 16-byte key with MD5, as VMess does
+func vmessBodyAEAD(security byte, key []byte) (cipher.AEAD, error) {
+	if security == vmessSecurityChaCha20 {
+		first := md5.Sum(key)
+		second := md5.Sum(first[:])
+		return chacha20poly1305.New(append(first[:], second[:]...))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// requestHeader encodes and seals the request header for a TCP stream to
+// addr
+func (s *vmessSession) requestHeader(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %v", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+
+	padding := make([]byte, 1)
+	rand.Read(padding)
+	paddingLen := int(padding[0] % 16)
+
+	buf := []byte{vmessVersion}
+	buf = append(buf, s.requestIV[:]...)
+	buf = append(buf, s.requestKey[:]...)
+	buf = append(buf, s.responseHeader, vmessOptionChunk, byte(paddingLen<<4)|s.security, 0, vmessCmdTCP)
+	buf = append(buf, byte(port>>8), byte(port))
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, vmessAtypIPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, vmessAtypIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain name too long: %s", host)
+		}
+		buf = append(buf, vmessAtypDomain, byte(len(host)))
+		buf = append(buf, host...)
+	}
+
+	pad := make([]byte, paddingLen)
+	rand.Read(pad)
+	buf = append(buf, pad...)
+	checksum := fnv.New32a()
+	checksum.Write(buf)
+	buf = checksum.Sum(buf)
+
+	return s.sealHeader(buf)
+}
+
+// sealHeader wraps the header in the AEAD envelope: an encrypted auth ID,
+// then the sealed length and header keyed by the auth ID and a nonce
+func (s *vmessSession) sealHeader(header []byte) ([]byte, error) {
+	authID, err := s.authID(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(header)))
+	sealedLength := gcmSeal(
+		vmessKDF(s.cmdKey[:], "VMess Header AEAD Key_Length", authID, nonce)[:16],
+		vmessKDF(s.cmdKey[:], "VMess Header AEAD Nonce_Length", authID, nonce)[:12],
+		length, authID)
+	sealedHeader := gcmSeal(
+		vmessKDF(s.cmdKey[:], "VMess Header AEAD Key", authID, nonce)[:16],
+		vmessKDF(s.cmdKey[:], "VMess Header AEAD Nonce", authID, nonce)[:12],
+		header, authID)
+
+	out := append(authID, sealedLength...)
+	out = append(out, nonce...)
+	return append(out, sealedHeader...), nil
+}
+
+// authID is the timestamped, checksummed ID the server authenticates the
+// connection by
+func (s *vmessSession) authID(now time.Time) ([]byte, error) {
+	plain := make([]byte, 16)
+	binary.BigEndian.PutUint64(plain, uint64(now.Unix()))
+	if _, err := rand.Read(plain[8:12]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(plain[12:], crc32.ChecksumIEEE(plain[:12]))
+
+	block, err := aes.NewCipher(vmessKDF(s.cmdKey[:], "AES Auth ID Encryption")[:16])
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	block.Encrypt(id, plain)
+	return id, nil
+}
+
+// sealChunk encodes one request body chunk. An empty chunk ends the
+// request.
+func (s *vmessSession) sealChunk(payload []byte) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, s.requestIV[:12])
+	binary.BigEndian.PutUint16(nonce, s.count)
+	s.count++
+
+	chunk := make([]byte, 2, 2+len(payload)+s.requestAEAD.Overhead())
+	binary.BigEndian.PutUint16(chunk, uint16(len(payload)+s.requestAEAD.Overhead()))
+	return s.requestAEAD.Seal(chunk, nonce, payload, nil)
+}
+
+// openChunk reads and opens one response body chunk, returning io.EOF
+// for the empty chunk that ends the response
+func (s *vmessSession) openChunk(r io.Reader) ([]byte, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 12)
+	copy(nonce, s.responseIV[:12])
+	binary.BigEndian.PutUint16(nonce, s.readCount)
+	s.readCount++
+
+	payload, err := s.responseAEAD.Open(sealed[:0], nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VMess chunk: %v", err)
+	}
+	if len(payload) == 0 {
+		return nil, io.EOF
+	}
+	return payload, nil
+}
+
+// readResponseHeader reads and authenticates the server's response header
+func (s *vmessSession) readResponseHeader(r io.Reader) error {
+	sealedLength := make([]byte, 2+16)
+	if _, err := io.ReadFull(r, sealedLength); err != nil {
+		return fmt.Errorf("failed to read VMess response: %v", err)
+	}
+	length, err := gcmOpen(
+		vmessKDF(s.responseKey[:], "AEAD Resp Header Len Key")[:16],
+		vmessKDF(s.responseIV[:], "AEAD Resp Header Len IV")[:12],
+		sealedLength)
+	if err != nil {
+		return fmt.Errorf("invalid VMess response: %v", err)
+	}
+
+	sealedHeader := make([]byte, int(binary.BigEndian.Uint16(length))+16)
+	if _, err := io.ReadFull(r, sealedHeader); err != nil {
+		return fmt.Errorf("failed to read VMess response: %v", err)
+	}
+	header, err := gcmOpen(
+		vmessKDF(s.responseKey[:], "AEAD Resp Header Key")[:16],
+		vmessKDF(s.responseIV[:], "AEAD Resp Header IV")[:12],
+		sealedHeader)
+	if err != nil {
+		return fmt.Errorf("invalid VMess response: %v", err)
+	}
+	if len(header) < 1 || header[0] != s.responseHeader {
+		return fmt.Errorf("invalid VMess response header")
+	}
+	return nil
+}
+
+// vmessKDF is VMess's key derivation: HMAC-SHA256 nested once per path
+// element, rooted at a fixed salt
+func vmessKDF(key []byte, path ...interface{}) []byte {
+	newHash := func() hash.Hash { return hmac.New(sha256.New, []byte("VMess AEAD KDF")) }
+	for _, p := range path {
+		var value []byte
+		switch v := p.(type) {
+		case string:
+			value = []byte(v)
+		case []byte:
+			value = v
+		}
+		parent := newHash
+		newHash = func() hash.Hash { return hmac.New(parent, value) }
+	}
+
+	mac := newHash()
+	mac.Write(key)
+	return mac.Sum(nil)
+}
+
+func gcmSeal(key, nonce, plaintext, ad []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	return aead.Seal(nil, nonce, plaintext, ad)
+}
+
+func gcmOpen(key, nonce, ciphertext []byte) ([]byte, error) {
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// probeTarget and probeRequest make the URL test V2Ray probes send through
+// the server, the same check other proxy clients use: the server only
+// answers authenticated requests, and only once the target has replied
+const probeTarget = "www.gstatic.com:80"
+
+var probeRequest = []byte("HEAD /generate_204 HTTP/1.1\r\nHost: www.gstatic.com\r\nConnection: close\r\n\r\n")
+
+// probeVMess sends a VMess request for the URL test over conn and waits for
+// the authenticated response header
+func probeVMess(conn net.Conn, uuid [16]byte, security byte) error {
+	session, err := newVMessSession(uuid, security)
+	if err != nil {
+		return err
+	}
+	header, err := session.requestHeader(probeTarget)
+	if err != nil {
+		return err
+	}
+
+	var request bytes.Buffer
+	request.Write(header)
+	request.Write(session.sealChunk(probeRequest))
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		return fmt.Errorf("failed to send VMess request: %v", err)
+	}
+	return session.readResponseHeader(conn)
+}
+
+// probeVLESS sends a VLESS request for the URL test over conn and waits for
+// the response
+func probeVLESS(conn net.Conn, uuid [16]byte) error {
+	request, err := vlessRequest(uuid, probeTarget)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(append(request, probeRequest...)); err != nil {
+		return fmt.Errorf("failed to send VLESS request: %v", err)
+	}
+
+	// The response header arrives with the target's first bytes
+	_, err = (&vlessConn{Conn: conn}).Read(make([]byte, 1))
+	if err != nil {
+		return fmt.Errorf("no VLESS response: %v", err)
+	}
+	return nil
+}
+
+// vmessConn carries a stream as VMess body chunks, after the request
+// header sent by dialVMess. The response header is read before the first
+// chunk.
+type vmessConn struct {
+	net.Conn
+	session *vmessSession
+
+	readOnce sync.Once
+	readErr  error
+	pending  []byte
+
+	writeMu sync.Mutex
+}
+
+// dialVMess sends the request header for a stream to addr over conn
+func dialVMess(conn net.Conn, uuid [16]byte, security byte, addr string) (net.Conn, error) {
+	session, err := newVMessSession(uuid, security)
+	if err != nil {
+		return nil, err
+	}
+	header, err := session.requestHeader(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to send VMess request: %v", err)
+	}
+	return &vmessConn{Conn: conn, session: session}, nil
+}
+
+func (c *vmessConn) Read(p []byte) (int, error) {
+	c.readOnce.Do(func() {
+		c.readErr = c.session.readResponseHeader(c.Conn)
+	})
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+
+	if len(c.pending) == 0 {
+		payload, err := c.session.openChunk(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = payload
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *vmessConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		size := len(p)
+		if size > vmessChunkSize {
+			size = vmessChunkSize
+		}
+		if _, err := c.Conn.Write(c.session.sealChunk(p[:size])); err != nil {
+			return written, err
+		}
+		written += size
+		p = p[size:]
+	}
+	return written, nil
+}
+
+// Close ends the request with an empty chunk before closing the
+// connection
+func (c *vmessConn) Close() error {
+	c.writeMu.Lock()
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.Conn.Write(c.session.sealChunk(nil))
+	c.writeMu.Unlock()
+
+	return c.Conn.Close()
+}
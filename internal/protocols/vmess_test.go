@@ -0,0 +1,334 @@
+package protocols
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"ssh-tunnel/internal/config"
+)
+
+const testVMessUUID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+// vmessServerConn is the server side of a VMess connection, as a V2Ray
+// server decodes it
+type vmessServerConn struct {
+	conn           net.Conn
+	target         string
+	responseHeader byte
+	requestAEAD    cipher.AEAD
+	requestIV      []byte
+	responseAEAD   cipher.AEAD
+	responseKey    []byte
+	responseIV     []byte
+	readCount      uint16
+	writeCount     uint16
+}
+
+func aeadOpen(key, nonce, sealed, ad []byte) ([]byte, error) {
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	return aead.Open(nil, nonce, sealed, ad)
+}
+
+// acceptVMess reads and authenticates the AEAD request header
+func acceptVMess(conn net.Conn, uuid [16]byte) (*vmessServerConn, error) {
+	cmdKey := md5.Sum(append(uuid[:], vmessCmdKeySalt...))
+
+	authID := make([]byte, 16)
+	if _, err := io.ReadFull(conn, authID); err != nil {
+		return nil, err
+	}
+	block, _ := aes.NewCipher(vmessKDF(cmdKey[:], "AES Auth ID Encryption")[:16])
+	plain := make([]byte, 16)
+	block.Decrypt(plain, authID)
+	if crc32.ChecksumIEEE(plain[:12]) != binary.BigEndian.Uint32(plain[12:]) {
+		return nil, fmt.Errorf("auth id checksum mismatch")
+	}
+	if at := time.Unix(int64(binary.BigEndian.Uint64(plain)), 0); time.Since(at).Abs() > 2*time.Minute {
+		return nil, fmt.Errorf("auth id timestamp %v out of range", at)
+	}
+
+	rest := make([]byte, 18+8)
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		return nil, err
+	}
+	sealedLength, nonce := rest[:18], rest[18:]
+	length, err := aeadOpen(
+		vmessKDF(cmdKey[:], "VMess Header AEAD Key_Length", authID, nonce)[:16],
+		vmessKDF(cmdKey[:], "VMess Header AEAD Nonce_Length", authID, nonce)[:12],
+		sealedLength, authID)
+	if err != nil {
+		return nil, fmt.Errorf("header length: %v", err)
+	}
+	sealedHeader := make([]byte, int(binary.BigEndian.Uint16(length))+16)
+	if _, err := io.ReadFull(conn, sealedHeader); err != nil {
+		return nil, err
+	}
+	header, err := aeadOpen(
+		vmessKDF(cmdKey[:], "VMess Header AEAD Key", authID, nonce)[:16],
+		vmessKDF(cmdKey[:], "VMess Header AEAD Nonce", authID, nonce)[:12],
+		sealedHeader, authID)
+	if err != nil {
+		return nil, fmt.Errorf("header: %v", err)
+	}
+
+	checksum := fnv.New32a()
+	checksum.Write(header[:len(header)-4])
+	if !bytes.Equal(checksum.Sum(nil), header[len(header)-4:]) {
+		return nil, fmt.Errorf("header checksum mismatch")
+	}
+	if header[0] != vmessVersion || header[34] != vmessOptionChunk || header[37] != vmessCmdTCP {
+		return nil, fmt.Errorf("unexpected header %x", header[:38])
+	}
+
+	s := &vmessServerConn{conn: conn, requestIV: header[1:17], responseHeader: header[33]}
+	security := header[35] & 0x0f
+	port := binary.BigEndian.Uint16(header[38:40])
+	var host string
+	switch header[40] {
+	case vmessAtypIPv4:
+		host = net.IP(header[41:45]).String()
+	case vmessAtypIPv6:
+		host = net.IP(header[41:57]).String()
+	case vmessAtypDomain:
+		host = string(header[42 : 42+int(header[41])])
+	}
+	s.target = net.JoinHostPort(host, fmt.Sprint(port))
+
+	requestKey := header[17:33]
+	responseKey := sha256.Sum256(requestKey)
+	responseIV := sha256.Sum256(s.requestIV)
+	s.responseKey, s.responseIV = responseKey[:16], responseIV[:16]
+	if s.requestAEAD, err = vmessBodyAEAD(security, requestKey); err != nil {
+		return nil, err
+	}
+	if s.responseAEAD, err = vmessBodyAEAD(security, s.responseKey); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readChunk returns the next request chunk, io.EOF for the empty one
+func (s *vmessServerConn) readChunk() ([]byte, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(s.conn, length); err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(s.conn, sealed); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	copy(nonce, s.requestIV[:12])
+	binary.BigEndian.PutUint16(nonce, s.readCount)
+	s.readCount++
+
+	payload, err := s.requestAEAD.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) == 0 {
+		return nil, io.EOF
+	}
+	return payload, nil
+}
+
+// writeResponseHeader sends the sealed response header
+func (s *vmessServerConn) writeResponseHeader() error {
+	header := []byte{s.responseHeader, 0, 0, 0}
+	length := binary.BigEndian.AppendUint16(nil, uint16(len(header)))
+	out := gcmSeal(vmessKDF(s.responseKey, "AEAD Resp Header Len Key")[:16],
+		vmessKDF(s.responseIV, "AEAD Resp Header Len IV")[:12], length, nil)
+	out = append(out, gcmSeal(vmessKDF(s.responseKey, "AEAD Resp Header Key")[:16],
+		vmessKDF(s.responseIV, "AEAD Resp Header IV")[:12], header, nil)...)
+	_, err := s.conn.Write(out)
+	return err
+}
+
+// writeChunk sends one response chunk
+func (s *vmessServerConn) writeChunk(payload []byte) error {
+	nonce := make([]byte, 12)
+	copy(nonce, s.responseIV[:12])
+	binary.BigEndian.PutUint16(nonce, s.writeCount)
+	s.writeCount++
+
+	sealed := s.responseAEAD.Seal(nil, nonce, payload, nil)
+	_, err := s.conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(sealed))), sealed...))
+	return err
+}
+
+// serveVMessEcho answers a VMess connection by echoing its request body
+// back and reports the requested target, or the error that ended it
+func serveVMessEcho(conn net.Conn, uuid [16]byte, results chan<- string) {
+	defer conn.Close()
+
+	s, err := acceptVMess(conn, uuid)
+	if err != nil {
+		results <- "error: " + err.Error()
+		return
+	}
+	if err := s.writeResponseHeader(); err != nil {
+		results <- "error: " + err.Error()
+		return
+	}
+	for {
+		payload, err := s.readChunk()
+		if err == io.EOF {
+			s.writeChunk(nil)
+			results <- s.target
+			return
+		}
+		if err != nil {
+			results <- "error: " + err.Error()
+			return
+		}
+		s.writeChunk(payload)
+	}
+}
+
+// vmessTestServer serves VMess echo connections over raw TCP, or over
+// WebSocket at /ws
+func vmessTestServer(t *testing.T, network string) (string, <-chan string) {
+	t.Helper()
+
+	uuid, _ := parseUUID(testVMessUUID)
+	results := make(chan string, 4)
+
+	if network == "ws" {
+		server := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			serveVMessEcho(ws, uuid, results)
+		}})
+		t.Cleanup(server.Close)
+		return strings.TrimPrefix(server.URL, "http://"), results
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveVMessEcho(conn, uuid, results)
+		}
+	}()
+	return ln.Addr().String(), results
+}
+
+func vmessTestTunnel(t *testing.T, addr, network, security, uuid string) *V2RayTunnel {
+	t.Helper()
+
+	host, port, _ := net.SplitHostPort(addr)
+	tunnel := NewV2RayTunnel(config.Server{
+		Name:      "vmess",
+		Host:      host,
+		Port:      port,
+		Transport: config.TransportVMess,
+		Timeout:   5 * time.Second,
+		V2Ray:     &config.V2RayConfig{UUID: uuid, Network: network, Path: "/ws", Security: security},
+	})
+
+	var err error
+	if tunnel.uuid, err = parseUUID(uuid); err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.security, err = vmessSecurity(security); err != nil {
+		t.Fatal(err)
+	}
+	return tunnel
+}
+
+func TestVMessRoundTrip(t *testing.T) {
+	for _, network := range []string{"tcp", "ws"} {
+		for _, security := range []string{"auto", "chacha20-poly1305"} {
+			t.Run(network+"/"+security, func(t *testing.T) {
+				addr, results := vmessTestServer(t, network)
+				tunnel := vmessTestTunnel(t, addr, network, security, testVMessUUID)
+
+				conn, err := tunnel.Dial("tcp", "example.com:443")
+				if err != nil {
+					t.Fatalf("Dial: %v", err)
+				}
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+				// Larger than a chunk, so it is split
+				payload := bytes.Repeat([]byte("vmess chunk "), 3000)
+				go conn.Write(payload)
+				got := make([]byte, len(payload))
+				if _, err := io.ReadFull(conn, got); err != nil {
+					t.Fatalf("read echo: %v", err)
+				}
+				if !bytes.Equal(got, payload) {
+					t.Fatal("echo differs from what was sent")
+				}
+
+				// Closing sends the empty chunk that ends the request
+				conn.Close()
+				select {
+				case result := <-results:
+					if result != "example.com:443" {
+						t.Errorf("server result = %q, want the target", result)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("server did not see the request end")
+				}
+			})
+		}
+	}
+}
+
+func TestVMessIPTarget(t *testing.T) {
+	addr, results := vmessTestServer(t, "tcp")
+	tunnel := vmessTestTunnel(t, addr, "tcp", "", testVMessUUID)
+
+	for _, target := range []string{"10.1.2.3:80", "[2001:db8::1]:53"} {
+		conn, err := tunnel.Dial("tcp", target)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		conn.Close()
+		if result := <-results; result != target {
+			t.Errorf("server result = %q, want %q", result, target)
+		}
+	}
+}
+
+func TestVMessWrongUUID(t *testing.T) {
+	addr, results := vmessTestServer(t, "tcp")
+	tunnel := vmessTestTunnel(t, addr, "tcp", "", "00000000-0000-0000-0000-000000000000")
+
+	conn, err := tunnel.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("hello"))
+
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("read succeeded with the wrong UUID")
+	}
+	if result := <-results; !strings.HasPrefix(result, "error: ") {
+		t.Errorf("server accepted the wrong UUID: %q", result)
+	}
+}
@@ -0,0 +1,171 @@
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// redacted replaces sensitive values in bundles
+const redacted = "[REDACTED]"
+
+// Bundle is a sanitized recording of API traffic and internal events that
+// can be attached to bug reports and replayed against a local instance
+type Bundle struct {
+	Version      string          `json:"version"`
+	StartedAt    time.Time       `json:"started_at"`
+	EndedAt      time.Time       `json:"ended_at"`
+	Config       interface{}     `json:"config,omitempty"`
+	Interactions []Interaction   `json:"interactions"`
+	Events       []Event         `json:"events,omitempty"`
+	Tunnels      json.RawMessage `json:"tunnels,omitempty"`
+}
+
+// Interaction is a single API request and its response
+type Interaction struct {
+	Timestamp      time.Time         `json:"timestamp"`
+	Method         string            `json:"method"`
+	Path           string            `json:"path"`
+	Query          string            `json:"query,omitempty"`
+	RequestHeaders map[string]string `json:"request_headers,omitempty"`
+	RequestBody    interface{}       `json:"request_body,omitempty"`
+	Status         int               `json:"status"`
+	ResponseBody   interface{}       `json:"response_body,omitempty"`
+	Duration       time.Duration     `json:"duration"`
+}
+
+// Event is an internal log event captured during the recording window
+type Event struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Level     string                 `json:"level"`
+	Component string                 `json:"component"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// Save writes the bundle as indented JSON
+func (b *Bundle) Save(path string) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal bundle: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create bundle directory: %v", err)
+	}
+
+	return os.WriteFile(path, data, 0600)
+}
+
+// LoadBundle reads a bundle from disk
+func LoadBundle(path string) (*Bundle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %v", err)
+	}
+
+	var bundle Bundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("failed to parse bundle: %v", err)
+	}
+
+	return &bundle, nil
+}
+
+// sensitiveKeys are matched case-insensitively against JSON keys and headers
+var sensitiveKeys = []string{
+	"password", "passwd", "secret", "token", "key", "auth", "uuid",
+	"private", "credential", "cookie", "psk", "seed",
+}
+
+func isSensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, key := range sensitiveKeys {
+		if strings.Contains(name, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sanitize returns a copy of a decoded JSON value with sensitive fields
+// redacted
+func Sanitize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			if isSensitive(k) && !isEmptyOrFlag(val) {
+				out[k] = redacted
+			} else {
+				out[k] = Sanitize(val)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, val := range v {
+			out[i] = Sanitize(val)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// isEmptyOrFlag reports whether a value reveals nothing worth redacting
+func isEmptyOrFlag(value interface{}) bool {
+	switch v := value.(type) {
+	case nil, bool:
+		return true
+	case string:
+		return v == ""
+	default:
+		return false
+	}
+}
+
+// SanitizeObject converts any JSON-serializable value into its sanitized
+// generic form
+func SanitizeObject(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return sanitizeJSON(data)
+}
+
+// sanitizeJSON decodes and sanitizes a JSON body; non-JSON bodies are
+// dropped rather than risk leaking secrets
+func sanitizeJSON(data []byte) interface{} {
+	if len(data) == 0 {
+		return nil
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return fmt.Sprintf("<%d bytes of non-JSON data omitted>", len(data))
+	}
+	return Sanitize(decoded)
+}
+
+// sanitizeHeaders keeps request headers useful for replay, redacting
+// credentials
+func sanitizeHeaders(h http.Header) map[string]string {
+	out := make(map[string]string)
+	for name, values := range h {
+		if len(values) == 0 {
+			continue
+		}
+		if isSensitive(name) {
+			out[name] = redacted
+		} else {
+			out[name] = strings.Join(values, ", ")
+		}
+	}
+	return out
+}
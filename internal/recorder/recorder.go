@@ -0,0 +1,179 @@
+package recorder
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// maxBodySize caps how much of each request and response body is recorded
+const maxBodySize = 256 * 1024
+
+// Recorder captures API interactions for a fixed window and writes them to
+// a sanitized bundle when the window ends
+type Recorder struct {
+	output  string
+	window  time.Duration
+	started time.Time
+	bundle  *Bundle
+	active  bool
+	timer   *time.Timer
+
+	// Finalize is called before the bundle is written so the owner can
+	// attach events, configuration and tunnel state
+	Finalize func(b *Bundle)
+
+	mu sync.Mutex
+}
+
+// NewRecorder creates a recorder that writes its bundle to output
+func NewRecorder(output string, window time.Duration) *Recorder {
+	return &Recorder{
+		output: output,
+		window: window,
+	}
+}
+
+// Start begins recording; the bundle is written once the window elapses
+func (r *Recorder) Start(version string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.started = time.Now()
+	r.bundle = &Bundle{
+		Version:   version,
+		StartedAt: r.started,
+	}
+	r.active = true
+	r.timer = time.AfterFunc(r.window, func() {
+		if err := r.Stop(); err != nil {
+			log.Printf("Failed to write debug bundle: %v", err)
+		}
+	})
+
+	log.Printf("🎥 Recording API interactions for %v to %s", r.window, r.output)
+}
+
+// Stop ends recording and writes the bundle. It is a no-op if the
+// recording already finished.
+func (r *Recorder) Stop() error {
+	r.mu.Lock()
+	if !r.active {
+		r.mu.Unlock()
+		return nil
+	}
+	r.active = false
+	r.timer.Stop()
+	bundle := r.bundle
+	r.mu.Unlock()
+
+	bundle.EndedAt = time.Now()
+	if r.Finalize != nil {
+		r.Finalize(bundle)
+	}
+
+	if err := bundle.Save(r.output); err != nil {
+		return err
+	}
+
+	log.Printf("🎥 Debug bundle with %d interactions written to %s", len(bundle.Interactions), r.output)
+	return nil
+}
+
+// Started returns when the recording began
+func (r *Recorder) Started() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.started
+}
+
+// Middleware records every request passing through while active
+func (r *Recorder) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r.mu.Lock()
+			active := r.active
+			r.mu.Unlock()
+			if !active {
+				return next(c)
+			}
+
+			req := c.Request()
+			var reqBody []byte
+			if req.Body != nil {
+				reqBody, _ = io.ReadAll(io.LimitReader(req.Body, maxBodySize))
+				req.Body = io.NopCloser(bytes.NewReader(reqBody))
+			}
+
+			capture := &captureWriter{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = capture
+
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			interaction := Interaction{
+				Timestamp:      start,
+				Method:         req.Method,
+				Path:           req.URL.Path,
+				Query:          sanitizeQuery(req.URL.Query()),
+				RequestHeaders: sanitizeHeaders(req.Header),
+				RequestBody:    sanitizeJSON(reqBody),
+				Status:         c.Response().Status,
+				ResponseBody:   sanitizeJSON(capture.body.Bytes()),
+				Duration:       time.Since(start),
+			}
+
+			r.mu.Lock()
+			if r.active {
+				r.bundle.Interactions = append(r.bundle.Interactions, interaction)
+			}
+			r.mu.Unlock()
+
+			return nil
+		}
+	}
+}
+
+// captureWriter tees the response body into a bounded buffer
+type captureWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	if room := maxBodySize - w.body.Len(); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		w.body.Write(p[:room])
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func sanitizeQuery(values url.Values) string {
+	query := make(url.Values, len(values))
+	for k, v := range values {
+		if isSensitive(k) {
+			query[k] = []string{redacted}
+		} else {
+			query[k] = v
+		}
+	}
+	return query.Encode()
+}
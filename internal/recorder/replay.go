@@ -0,0 +1,139 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ReplayResult compares a replayed request with the recorded one
+type ReplayResult struct {
+	Method         string        `json:"method"`
+	Path           string        `json:"path"`
+	RecordedStatus int           `json:"recorded_status"`
+	Status         int           `json:"status"`
+	Duration       time.Duration `json:"duration"`
+	Error          string        `json:"error,omitempty"`
+}
+
+// Matches reports whether the replayed status equals the recorded one
+func (r *ReplayResult) Matches() bool {
+	return r.Error == "" && r.Status == r.RecordedStatus
+}
+
+// Replayer sends the interactions of a bundle to a running instance
+type Replayer struct {
+	target   string
+	token    string
+	realtime bool
+	client   *http.Client
+}
+
+// NewReplayer creates a replayer for the API at target, e.g.
+// "http://localhost:8888". token replaces the redacted Authorization header.
+func NewReplayer(target, token string, realtime bool) *Replayer {
+	return &Replayer{
+		target:   strings.TrimRight(target, "/"),
+		token:    token,
+		realtime: realtime,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Replay sends every recorded interaction in order. With realtime enabled
+// the original spacing between requests is preserved.
+func (rp *Replayer) Replay(bundle *Bundle) []ReplayResult {
+	var results []ReplayResult
+	var previous time.Time
+
+	for _, interaction := range bundle.Interactions {
+		if rp.realtime && !previous.IsZero() {
+			time.Sleep(interaction.Timestamp.Sub(previous))
+		}
+		previous = interaction.Timestamp
+
+		results = append(results, rp.replayOne(interaction))
+	}
+
+	return results
+}
+
+func (rp *Replayer) replayOne(interaction Interaction) ReplayResult {
+	result := ReplayResult{
+		Method:         interaction.Method,
+		Path:           interaction.Path,
+		RecordedStatus: interaction.Status,
+	}
+
+	var body io.Reader
+	if interaction.RequestBody != nil {
+		data, err := json.Marshal(interaction.RequestBody)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		body = bytes.NewReader(data)
+	}
+
+	url := rp.target + interaction.Path
+	if interaction.Query != "" {
+		url += "?" + interaction.Query
+	}
+
+	req, err := http.NewRequest(interaction.Method, url, body)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	for name, value := range interaction.RequestHeaders {
+		if value == redacted || strings.EqualFold(name, "Content-Length") {
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	if rp.token != "" {
+		req.Header.Set("Authorization", "Bearer "+rp.token)
+	}
+
+	start := time.Now()
+	resp, err := rp.client.Do(req)
+	result.Duration = time.Since(start)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	result.Status = resp.StatusCode
+	return result
+}
+
+// RenderReplay formats replay results, flagging status mismatches
+func RenderReplay(results []ReplayResult) string {
+	var b strings.Builder
+
+	mismatches := 0
+	for _, r := range results {
+		mark := "✅"
+		if !r.Matches() {
+			mark = "❌"
+			mismatches++
+		}
+
+		fmt.Fprintf(&b, "%s %-6s %-35s recorded %d, got %d (%v)", mark, r.Method, r.Path,
+			r.RecordedStatus, r.Status, r.Duration.Round(time.Millisecond))
+		if r.Error != "" {
+			fmt.Fprintf(&b, " error: %s", r.Error)
+		}
+		b.WriteString("\n")
+	}
+
+	fmt.Fprintf(&b, "\n%d requests replayed, %d mismatches\n", len(results), mismatches)
+	return b.String()
+}
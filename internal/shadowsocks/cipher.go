@@ -0,0 +1,85 @@
+// Package shadowsocks implements the server side of the Shadowsocks AEAD
+// protocol over TCP, as spoken by shadowsocks-libev, shadowsocks-rust and
+// most router and TV clients
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Methods lists the supported AEAD methods
+var Methods = []string{"chacha20-ietf-poly1305", "aes-128-gcm", "aes-256-gcm"}
+
+// Cipher derives per-connection AEADs from the password
+type Cipher struct {
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// NewCipher creates the cipher for method and password
+func NewCipher(method, password string) (*Cipher, error) {
+	if password == "" {
+		return nil, fmt.Errorf("shadowsocks password is required")
+	}
+
+	var keySize int
+	var newAEAD func(key []byte) (cipher.AEAD, error)
+	switch strings.ToLower(method) {
+	case "chacha20-ietf-poly1305":
+		keySize, newAEAD = chacha20poly1305.KeySize, chacha20poly1305.New
+	case "aes-128-gcm", "aes-256-gcm":
+		keySize = 16
+		if strings.HasPrefix(strings.ToLower(method), "aes-256") {
+			keySize = 32
+		}
+		newAEAD = func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported shadowsocks method: %s (supported: %s)", method, strings.Join(Methods, ", "))
+	}
+
+	return &Cipher{key: deriveKey(password, keySize), newAEAD: newAEAD}, nil
+}
+
+// SaltSize is the length of the salt starting each direction of a
+// connection
+func (c *Cipher) SaltSize() int {
+	return len(c.key)
+}
+
+// aead returns the AEAD for one direction keyed by its salt
+func (c *Cipher) aead(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+// deriveKey stretches the password with OpenSSL's EVP_BytesToKey, as every
+// Shadowsocks implementation does
+func deriveKey(password string, size int) []byte {
+	var key, prev []byte
+	for len(key) < size {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:size]
+}
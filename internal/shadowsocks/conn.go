@@ -0,0 +1,241 @@
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxPayload is the largest payload one AEAD chunk may carry
+const maxPayload = 0x3FFF
+
+// ErrAuth reports a connection whose salt or first chunk does not
+// authenticate, i.e. a wrong password, a replay or a probe
+var ErrAuth = errors.New("shadowsocks authentication failed")
+
+// Conn is an encrypted Shadowsocks stream over a TCP connection
+type Conn struct {
+	net.Conn
+	cipher *Cipher
+	salts  *SaltFilter
+
+	rmu     sync.Mutex
+	reader  cipher.AEAD
+	rnonce  []byte
+	pending []byte
+	rbuf    []byte
+
+	wmu    sync.Mutex
+	writer cipher.AEAD
+	wnonce []byte
+	wbuf   []byte
+}
+
+// Server wraps an accepted connection; salts, when set, rejects replayed
+// salts
+func (c *Cipher) Server(conn net.Conn, salts *SaltFilter) *Conn {
+	return &Conn{Conn: conn, cipher: c, salts: salts}
+}
+
+// Client wraps an outgoing connection to a Shadowsocks server
+func (c *Cipher) Client(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, cipher: c}
+}
+
+// initReader reads the peer's salt and sets up the read direction
+func (c *Conn) initReader() error {
+	salt := make([]byte, c.cipher.SaltSize())
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	if c.salts != nil && !c.salts.add(salt) {
+		return ErrAuth
+	}
+
+	aead, err := c.cipher.aead(salt)
+	if err != nil {
+		return err
+	}
+	c.reader = aead
+	c.rnonce = make([]byte, aead.NonceSize())
+	c.rbuf = make([]byte, maxPayload+aead.Overhead())
+	return nil
+}
+
+// initWriter sends our salt and sets up the write direction
+func (c *Conn) initWriter() error {
+	salt := make([]byte, c.cipher.SaltSize())
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	aead, err := c.cipher.aead(salt)
+	if err != nil {
+		return err
+	}
+	c.writer = aead
+	c.wnonce = make([]byte, aead.NonceSize())
+	c.wbuf = make([]byte, 0, len(salt)+2+maxPayload+2*aead.Overhead())
+	c.wbuf = append(c.wbuf, salt...)
+	return nil
+}
+
+// readChunk decrypts the next chunk into c.pending
+func (c *Conn) readChunk() error {
+	overhead := c.reader.Overhead()
+	buf := c.rbuf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	if _, err := c.reader.Open(buf[:0], c.rnonce, buf, nil); err != nil {
+		return ErrAuth
+	}
+	increment(c.rnonce)
+
+	size := int(binary.BigEndian.Uint16(buf) & maxPayload)
+	buf = c.rbuf[:size+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	payload, err := c.reader.Open(buf[:0], c.rnonce, buf, nil)
+	if err != nil {
+		return ErrAuth
+	}
+	increment(c.rnonce)
+
+	c.pending = payload
+	return nil
+}
+
+// Read decrypts data from the peer
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if c.reader == nil {
+		if err := c.initReader(); err != nil {
+			return 0, err
+		}
+	}
+	for len(c.pending) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write encrypts b to the peer in chunks of at most maxPayload bytes
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.writer == nil {
+		if err := c.initWriter(); err != nil {
+			return 0, err
+		}
+	}
+
+	written := 0
+	for len(b) > 0 {
+		size := len(b)
+		if size > maxPayload {
+			size = maxPayload
+		}
+
+		out := c.wbuf
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(size))
+		out = c.writer.Seal(out, c.wnonce, length[:], nil)
+		increment(c.wnonce)
+		out = c.writer.Seal(out, c.wnonce, b[:size], nil)
+		increment(c.wnonce)
+
+		if _, err := c.Conn.Write(out); err != nil {
+			return written, err
+		}
+		c.wbuf = c.wbuf[:0] // The salt only goes out once
+		written += size
+		b = b[size:]
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the underlying connection when it supports it
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// ReadTarget reads the SOCKS-style destination address starting a client's
+// stream and returns it as host:port
+func (c *Conn) ReadTarget() (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(c, atyp[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case 0x01:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 0x04:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		var length [1]byte
+		if _, err := io.ReadFull(c, length[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported address type: %d", atyp[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(c, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// Drain keeps reading and discarding from a connection that failed to
+// authenticate until the peer gives up or timeout passes, so active probes
+// cannot tell a Shadowsocks server from a closed port by its reaction
+func Drain(conn net.Conn, timeout time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	io.Copy(io.Discard, conn)
+}
+
+// increment advances a little-endian nonce counter
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package shadowsocks
+
+import "sync"
+
+// saltGeneration bounds how many salts each generation of the filter holds
+const saltGeneration = 1 << 16
+
+// SaltFilter remembers recently seen salts so a recorded connection cannot
+// be replayed against the server. It keeps two generations and drops the
+// older one when the newer fills up.
+type SaltFilter struct {
+	mu       sync.Mutex
+	current  map[string]struct{}
+	previous map[string]struct{}
+}
+
+// NewSaltFilter creates an empty salt filter
+func NewSaltFilter() *SaltFilter {
+	return &SaltFilter{current: make(map[string]struct{})}
+}
+
+// add records salt and reports whether it was new
+func (f *SaltFilter) add(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := string(salt)
+	if _, ok := f.current[key]; ok {
+		return false
+	}
+	if _, ok := f.previous[key]; ok {
+		return false
+	}
+
+	if len(f.current) >= saltGeneration {
+		f.previous, f.current = f.current, make(map[string]struct{})
+	}
+	f.current[key] = struct{}{}
+	return true
+}
@@ -0,0 +1,226 @@
+// Package udprelay carries UDP datagrams over a byte stream, such as an SSH
+// session running the relay helper on the server. Each datagram is framed
+// as a big-endian uint16 length, a SOCKS5-style address and the payload;
+// the address is the destination on the way out and the source on the way
+// back.
+package udprelay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Address types, as in SOCKS5
+const (
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// MaxDatagram is the largest payload a frame carries
+const MaxDatagram = 65535 - 1 - 255 - 2 - 1
+
+// errNoDeadline is returned by the deadline methods of Conn
+var errNoDeadline = errors.New("udprelay: deadlines not supported")
+
+// Addr is a host:port destination that may still be a domain name
+type Addr string
+
+func (a Addr) Network() string { return "udp" }
+func (a Addr) String() string  { return string(a) }
+
+// AppendAddr encodes a host:port address in SOCKS5 form
+func AppendAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %v", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, atypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, atypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain too long: %s", host)
+		}
+		b = append(b, atypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// SplitAddr decodes a SOCKS5 address at the start of b and returns it with
+// the bytes that follow
+func SplitAddr(b []byte) (string, []byte, error) {
+	if len(b) < 1 {
+		return "", nil, fmt.Errorf("short address")
+	}
+
+	var host string
+	var n int
+	switch b[0] {
+	case atypIPv4:
+		n = 1 + net.IPv4len
+		if len(b) < n+2 {
+			return "", nil, fmt.Errorf("short address")
+		}
+		host = net.IP(b[1:n]).String()
+	case atypIPv6:
+		n = 1 + net.IPv6len
+		if len(b) < n+2 {
+			return "", nil, fmt.Errorf("short address")
+		}
+		host = net.IP(b[1:n]).String()
+	case atypDomain:
+		if len(b) < 2 {
+			return "", nil, fmt.Errorf("short address")
+		}
+		n = 2 + int(b[1])
+		if len(b) < n+2 {
+			return "", nil, fmt.Errorf("short address")
+		}
+		host = string(b[2:n])
+	default:
+		return "", nil, fmt.Errorf("unsupported address type %d", b[0])
+	}
+
+	port := binary.BigEndian.Uint16(b[n:])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), b[n+2:], nil
+}
+
+// writeFrame sends one datagram
+func writeFrame(w io.Writer, addr string, payload []byte) error {
+	if len(payload) > MaxDatagram {
+		return fmt.Errorf("datagram too large: %d bytes", len(payload))
+	}
+	frame, err := AppendAddr(make([]byte, 2, 2+1+255+2+len(payload)), addr)
+	if err != nil {
+		return err
+	}
+	frame = append(frame, payload...)
+	binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+	_, err = w.Write(frame)
+	return err
+}
+
+// readFrame reads one datagram
+func readFrame(r io.Reader, buf []byte) (string, []byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return "", nil, err
+	}
+	frame := buf[:binary.BigEndian.Uint16(length[:])]
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return "", nil, err
+	}
+	return SplitAddr(frame)
+}
+
+// Conn is the client side of a relay stream, used as a PacketConn whose
+// addresses are the remote destinations
+type Conn struct {
+	stream io.ReadWriteCloser
+	reader *bufio.Reader
+	buf    []byte
+	wmu    sync.Mutex
+}
+
+// NewConn starts the client side of a relay on stream
+func NewConn(stream io.ReadWriteCloser) *Conn {
+	return &Conn{
+		stream: stream,
+		reader: bufio.NewReader(stream),
+		buf:    make([]byte, 65535),
+	}
+}
+
+// ReadFrom reads the next datagram and the address it came from
+func (c *Conn) ReadFrom(p []byte) (int, net.Addr, error) {
+	addr, payload, err := readFrame(c.reader, c.buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(p, payload), Addr(addr), nil
+}
+
+// WriteTo sends a datagram to addr, which may name a domain
+func (c *Conn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := writeFrame(c.stream, addr.String(), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *Conn) Close() error        { return c.stream.Close() }
+func (c *Conn) LocalAddr() net.Addr { return Addr("relay:0") }
+
+func (c *Conn) SetDeadline(t time.Time) error      { return errNoDeadline }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return errNoDeadline }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return errNoDeadline }
+
+// Serve is the server side of a relay: it sends the datagrams framed on r
+// from one UDP socket and frames the replies onto w, until r ends
+func Serve(r io.Reader, w io.Writer) error {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if err := writeFrame(w, from.String(), buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	reader := bufio.NewReader(r)
+	buf := make([]byte, 65535)
+	resolved := make(map[string]*net.UDPAddr)
+	for {
+		addr, payload, err := readFrame(reader, buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		to, ok := resolved[addr]
+		if !ok {
+			if to, err = net.ResolveUDPAddr("udp", addr); err != nil {
+				continue // Drop datagrams to names that do not resolve
+			}
+			if len(resolved) > 1024 {
+				resolved = make(map[string]*net.UDPAddr)
+			}
+			resolved[addr] = to
+		}
+		conn.WriteToUDP(payload, to)
+	}
+}
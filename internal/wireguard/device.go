@@ -0,0 +1,487 @@
+package wireguard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Protocol timers, as in the WireGuard paper
+const (
+	RekeyAfterTime   = 120 * time.Second
+	RejectAfterTime  = 180 * time.Second
+	RekeyAttemptTime = 90 * time.Second
+	RekeyTimeout     = 5 * time.Second
+	KeepaliveTimeout = 10 * time.Second
+
+	timerTick = time.Second
+	peerQueue = 16 // Packets held per peer while a handshake runs
+)
+
+// SendFunc puts a WireGuard message on the wire to a peer
+type SendFunc func(peer Key, msg []byte) error
+
+// ReceiveFunc takes a decrypted packet from a peer
+type ReceiveFunc func(peer Key, packet []byte)
+
+// Device runs WireGuard sessions with a set of peers. It does not own a
+// socket: outgoing messages go to a SendFunc and the caller passes every
+// message it receives to HandleMessage, so any packet transport can carry
+// it. Sessions are set up on demand when a packet is sent, rekeyed and
+// kept alive by the timers Run drives.
+type Device struct {
+	send    SendFunc
+	receive ReceiveFunc
+
+	mu            sync.Mutex
+	private       Key
+	previous      Key       // Replaced private key, still answering handshakes
+	previousUntil time.Time // Zero without a previous key
+	peers         map[Key]*peer
+	indices       map[uint32]*peer // Local indices of handshakes and sessions
+}
+
+// PeerStatus describes a peer of a device
+type PeerStatus struct {
+	PublicKey     Key
+	LastHandshake time.Time // Zero before the first handshake completed
+	TxBytes       uint64
+	RxBytes       uint64
+}
+
+type peer struct {
+	public Key
+	psk    Key
+
+	handshake        *Handshake
+	handshakeStarted time.Time // First attempt of the running handshake
+	lastInitiation   time.Time
+	lastTimestamp    [12]byte // Of the newest initiation the peer sent
+
+	current  *Session
+	previous *Session
+	next     *Session // Responded to, until the initiator uses it
+	queue    [][]byte
+
+	lastHandshake time.Time
+	lastSent      time.Time
+	lastReceived  time.Time // Of data, not keepalives
+	txBytes       uint64
+	rxBytes       uint64
+}
+
+// outgoing is a message to send once the device lock is released
+type outgoing struct {
+	peer Key
+	msg  []byte
+}
+
+// NewDevice creates a device with a private key
+func NewDevice(private Key, send SendFunc, receive ReceiveFunc) *Device {
+	return &Device{
+		private: private,
+		send:    send,
+		receive: receive,
+		peers:   make(map[Key]*peer),
+		indices: make(map[uint32]*peer),
+	}
+}
+
+// PublicKey returns the device's public key
+func (d *Device) PublicKey() Key {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.private.PublicKey()
+}
+
+// SetPrivateKey replaces the device's private key. Established sessions do
+// not depend on it and carry on; new handshakes use the new key, and
+// handshakes from peers that still know the old public key are answered
+// with the old key until overlap has passed.
+func (d *Device) SetPrivateKey(private Key, overlap time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if private == d.private {
+		return
+	}
+	d.previous, d.previousUntil = d.private, time.Now().Add(overlap)
+	d.private = private
+	for _, p := range d.peers {
+		// A handshake in flight used the old key; the next tick retries
+		p.lastInitiation = time.Time{}
+	}
+}
+
+// RekeyPeer moves a peer that rotated its key to its new public key,
+// keeping its sessions, so traffic flows until the next handshake, which
+// uses the new key. It reports whether from was a peer.
+func (d *Device) RekeyPeer(from, to Key) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.peers[from]
+	if !ok {
+		return false
+	}
+	if _, taken := d.peers[to]; taken {
+		return false
+	}
+	p.lastInitiation = time.Time{} // Retry a handshake in flight with the new key
+	delete(d.peers, from)
+	p.public = to
+	d.peers[to] = p
+	return true
+}
+
+// AddPeer adds a peer, or updates its pre-shared key
+func (d *Device) AddPeer(public, psk Key) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if p, ok := d.peers[public]; ok {
+		p.psk = psk
+		return
+	}
+	d.peers[public] = &peer{public: public, psk: psk}
+}
+
+// RemovePeer removes a peer and its sessions
+func (d *Device) RemovePeer(public Key) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.peers[public]
+	if !ok {
+		return
+	}
+	if p.handshake != nil {
+		delete(d.indices, p.handshake.LocalIndex())
+	}
+	for _, s := range []*Session{p.current, p.previous, p.next} {
+		if s != nil {
+			delete(d.indices, s.LocalIndex)
+		}
+	}
+	delete(d.peers, public)
+}
+
+// Peers returns the status of every peer
+func (d *Device) Peers() []PeerStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	peers := make([]PeerStatus, 0, len(d.peers))
+	for _, p := range d.peers {
+		peers = append(peers, PeerStatus{
+			PublicKey:     p.public,
+			LastHandshake: p.lastHandshake,
+			TxBytes:       p.txBytes,
+			RxBytes:       p.rxBytes,
+		})
+	}
+	return peers
+}
+
+// Send encrypts a packet to a peer. Without a usable session the packet
+// waits for the handshake Send starts.
+func (d *Device) Send(public Key, packet []byte) error {
+	d.mu.Lock()
+	p, ok := d.peers[public]
+	if !ok {
+		d.mu.Unlock()
+		return fmt.Errorf("unknown WireGuard peer")
+	}
+
+	var out []outgoing
+	if s := p.current; usable(s) {
+		msg, err := s.Seal(packet)
+		if err != nil {
+			d.mu.Unlock()
+			return err
+		}
+		p.lastSent = time.Now()
+		p.txBytes += uint64(len(msg))
+		out = append(out, outgoing{public, msg})
+		if s.Initiator && (time.Since(s.EstablishedTime) > RekeyAfterTime || s.Sent() > RekeyAfterMessages) {
+			out = d.initiateLocked(p, out)
+		}
+	} else {
+		if len(p.queue) == peerQueue {
+			p.queue = p.queue[1:]
+		}
+		p.queue = append(p.queue, append([]byte(nil), packet...))
+		out = d.initiateLocked(p, out)
+	}
+	d.mu.Unlock()
+
+	return d.flush(out)
+}
+
+// HandleMessage processes a message received from the wire
+func (d *Device) HandleMessage(msg []byte) error {
+	if len(msg) < 4 || msg[1] != 0 || msg[2] != 0 || msg[3] != 0 {
+		return fmt.Errorf("not a WireGuard message")
+	}
+	switch msg[0] {
+	case MessageInitiation:
+		return d.handleInitiation(msg)
+	case MessageResponse:
+		return d.handleResponse(msg)
+	case MessageTransport:
+		return d.handleTransport(msg)
+	case MessageCookieReply:
+		return nil // Only sent under load to peers with mac2, which we never ask for
+	default:
+		return fmt.Errorf("unknown WireGuard message type %d", msg[0])
+	}
+}
+
+func (d *Device) handleInitiation(msg []byte) error {
+	d.mu.Lock()
+	private, previous := d.private, d.previous
+	if !d.previousUntil.IsZero() && time.Now().After(d.previousUntil) {
+		d.previous, d.previousUntil = Key{}, time.Time{}
+		previous = Key{}
+	}
+	d.mu.Unlock()
+
+	in, err := ConsumeInitiation(private, msg)
+	if err != nil && previous != (Key{}) {
+		in, err = ConsumeInitiation(previous, msg)
+	}
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	p, ok := d.peers[in.RemotePublic]
+	if !ok {
+		d.mu.Unlock()
+		return fmt.Errorf("handshake initiation from an unknown peer")
+	}
+	if bytes.Compare(in.Timestamp[:], p.lastTimestamp[:]) <= 0 {
+		d.mu.Unlock()
+		return fmt.Errorf("replayed handshake initiation")
+	}
+	response, kp, err := in.Respond(p.psk)
+	if err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	p.lastTimestamp = in.Timestamp
+
+	if p.next != nil {
+		delete(d.indices, p.next.LocalIndex)
+	}
+	p.next = NewSession(kp, false)
+	d.indices[kp.LocalIndex] = p
+	d.mu.Unlock()
+
+	return d.flush([]outgoing{{p.public, response}})
+}
+
+func (d *Device) handleResponse(msg []byte) error {
+	if len(msg) != ResponseSize {
+		return ErrInvalidResponse
+	}
+	index := binary.LittleEndian.Uint32(msg[8:12])
+
+	d.mu.Lock()
+	p, ok := d.indices[index]
+	if !ok || p.handshake == nil || p.handshake.LocalIndex() != index {
+		d.mu.Unlock()
+		return ErrInvalidResponse
+	}
+	kp, err := p.handshake.ConsumeResponse(msg)
+	if err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	p.handshake = nil
+	p.handshakeStarted = time.Time{}
+	d.rotateLocked(p, NewSession(kp, true))
+
+	// The first message confirms the session to the responder
+	out := d.flushQueueLocked(p, nil)
+	if len(out) == 0 {
+		out = d.sealLocked(p, nil, out)
+	}
+	d.mu.Unlock()
+
+	return d.flush(out)
+}
+
+func (d *Device) handleTransport(msg []byte) error {
+	if len(msg) < TransportOverhead {
+		return ErrInvalidTransport
+	}
+	index := binary.LittleEndian.Uint32(msg[4:8])
+
+	d.mu.Lock()
+	p, ok := d.indices[index]
+	var s *Session
+	if ok {
+		for _, candidate := range []*Session{p.current, p.previous, p.next} {
+			if candidate != nil && candidate.LocalIndex == index {
+				s = candidate
+				break
+			}
+		}
+	}
+	d.mu.Unlock()
+	if s == nil || time.Since(s.EstablishedTime) > RejectAfterTime {
+		return ErrInvalidTransport
+	}
+
+	packet, err := s.Open(msg)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	var out []outgoing
+	if s == p.next {
+		// The initiator uses the session we responded with
+		p.next = nil
+		d.rotateLocked(p, s)
+		out = d.flushQueueLocked(p, out)
+	}
+	p.rxBytes += uint64(len(msg))
+	if len(packet) > 0 {
+		p.lastReceived = time.Now()
+	}
+	d.mu.Unlock()
+
+	if err := d.flush(out); err != nil {
+		return err
+	}
+	if len(packet) > 0 {
+		d.receive(p.public, packet)
+	}
+	return nil
+}
+
+// Run drives handshake retries, session expiry and keepalives until done
+// is closed
+func (d *Device) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(timerTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			d.tick()
+		}
+	}
+}
+
+func (d *Device) tick() {
+	d.mu.Lock()
+	var out []outgoing
+	now := time.Now()
+	for _, p := range d.peers {
+		if p.handshake != nil && now.Sub(p.lastInitiation) > RekeyTimeout {
+			if now.Sub(p.handshakeStarted) > RekeyAttemptTime {
+				// Give up until there is something to send again
+				delete(d.indices, p.handshake.LocalIndex())
+				p.handshake = nil
+				p.handshakeStarted = time.Time{}
+				p.queue = nil
+			} else {
+				out = d.initiateLocked(p, out)
+			}
+		}
+
+		for _, s := range []**Session{&p.current, &p.previous, &p.next} {
+			if *s != nil && now.Sub((*s).EstablishedTime) > 3*RejectAfterTime {
+				delete(d.indices, (*s).LocalIndex)
+				*s = nil
+			}
+		}
+
+		// Passive keepalive: tell a peer sending data that its packets
+		// arrive even when we have nothing to send back
+		if usable(p.current) && p.lastReceived.After(p.lastSent) && now.Sub(p.lastReceived) > KeepaliveTimeout {
+			out = d.sealLocked(p, nil, out)
+		}
+	}
+	d.mu.Unlock()
+
+	d.flush(out)
+}
+
+// initiateLocked starts a handshake with a peer unless one was sent
+// within RekeyTimeout
+func (d *Device) initiateLocked(p *peer, out []outgoing) []outgoing {
+	now := time.Now()
+	if p.handshake != nil {
+		if now.Sub(p.lastInitiation) < RekeyTimeout {
+			return out
+		}
+		delete(d.indices, p.handshake.LocalIndex())
+	}
+
+	h := NewHandshake(d.private, p.public, p.psk)
+	msg, err := h.Initiation()
+	if err != nil {
+		p.handshake = nil
+		return out
+	}
+	p.handshake = h
+	p.lastInitiation = now
+	if p.handshakeStarted.IsZero() {
+		p.handshakeStarted = now
+	}
+	d.indices[h.LocalIndex()] = p
+	return append(out, outgoing{p.public, msg})
+}
+
+// rotateLocked makes s the peer's current session
+func (d *Device) rotateLocked(p *peer, s *Session) {
+	if p.previous != nil {
+		delete(d.indices, p.previous.LocalIndex)
+	}
+	p.previous = p.current
+	p.current = s
+	p.lastHandshake = s.EstablishedTime
+	d.indices[s.LocalIndex] = p
+}
+
+// flushQueueLocked encrypts the packets that waited for a session
+func (d *Device) flushQueueLocked(p *peer, out []outgoing) []outgoing {
+	for _, packet := range p.queue {
+		out = d.sealLocked(p, packet, out)
+	}
+	p.queue = nil
+	return out
+}
+
+func (d *Device) sealLocked(p *peer, packet []byte, out []outgoing) []outgoing {
+	msg, err := p.current.Seal(packet)
+	if err != nil {
+		return out
+	}
+	p.lastSent = time.Now()
+	p.txBytes += uint64(len(msg))
+	return append(out, outgoing{p.public, msg})
+}
+
+func (d *Device) flush(out []outgoing) error {
+	var first error
+	for _, o := range out {
+		if err := d.send(o.peer, o.msg); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// usable reports whether a session may still encrypt
+func usable(s *Session) bool {
+	return s != nil && time.Since(s.EstablishedTime) < RejectAfterTime && s.Sent() < RejectAfterMessages
+}
@@ -0,0 +1,243 @@
+package wireguard
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+var (
+	interopDeviceIP = netip.MustParseAddr("10.0.0.1") // Our Device
+	interopPeerIP   = netip.MustParseAddr("10.0.0.2") // wireguard-go
+)
+
+// peerBind is a wireguard-go socket whose other end is a Device
+type peerBind struct {
+	device *Device
+	rx     chan []byte
+
+	mu     sync.Mutex
+	closed chan struct{}
+}
+
+func newPeerBind() *peerBind {
+	return &peerBind{rx: make(chan []byte, 1024), closed: make(chan struct{})}
+}
+
+// send is the Device's SendFunc
+func (b *peerBind) send(peer Key, msg []byte) error {
+	b.rx <- append([]byte(nil), msg...)
+	return nil
+}
+
+func (b *peerBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	closed := make(chan struct{})
+	b.closed = closed
+	b.mu.Unlock()
+
+	receive := func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case <-closed:
+			return 0, net.ErrClosed
+		case msg := <-b.rx:
+			sizes[0] = copy(bufs[0], msg)
+			eps[0] = bindtest.ChannelEndpoint(1)
+			return 1, nil
+		}
+	}
+	return []conn.ReceiveFunc{receive}, 1, nil
+}
+
+func (b *peerBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+	return nil
+}
+
+func (b *peerBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	for _, buf := range bufs {
+		go b.device.HandleMessage(append([]byte(nil), buf...))
+	}
+	return nil
+}
+
+func (b *peerBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	return bindtest.ChannelEndpoint(1), nil
+}
+
+func (b *peerBind) SetMark(mark uint32) error {
+	return nil
+}
+
+func (b *peerBind) BatchSize() int {
+	return 1
+}
+
+// interopPair is a Device and a wireguard-go device peered with each other
+type interopPair struct {
+	device   *Device
+	received chan []byte // Packets the Device received
+	peer     *tuntest.ChannelTUN
+	peerKey  Key
+}
+
+// newInteropPair peers a Device with a wireguard-go device. wireguard-go is
+// told the Device's public key is known, which is its current one unless
+// the test replaces it.
+func newInteropPair(t *testing.T, private, known, psk Key) *interopPair {
+	t.Helper()
+
+	var peerPrivate Key
+	if _, err := rand.Read(peerPrivate[:]); err != nil {
+		t.Fatal(err)
+	}
+	p := &interopPair{
+		received: make(chan []byte, 64),
+		peer:     tuntest.NewChannelTUN(),
+		peerKey:  peerPrivate.PublicKey(),
+	}
+
+	bind := newPeerBind()
+	p.device = NewDevice(private, bind.send, func(peer Key, packet []byte) {
+		if peer != p.peerKey {
+			t.Errorf("packet attributed to the wrong peer")
+		}
+		p.received <- append([]byte(nil), packet...)
+	})
+	bind.device = p.device
+	p.device.AddPeer(p.peerKey, psk)
+	done := make(chan struct{})
+	go p.device.Run(done)
+	t.Cleanup(func() { close(done) })
+
+	wg := device.NewDevice(p.peer.TUN(), bind, device.NewLogger(device.LogLevelSilent, ""))
+	t.Cleanup(wg.Close)
+	err := wg.IpcSet(fmt.Sprintf("private_key=%s\npublic_key=%s\npreshared_key=%s\nendpoint=127.0.0.1:1\nallowed_ip=%s/32\n",
+		hex.EncodeToString(peerPrivate[:]), hex.EncodeToString(known[:]), hex.EncodeToString(psk[:]), interopDeviceIP))
+	if err != nil {
+		t.Fatalf("configure wireguard-go: %v", err)
+	}
+	if err := wg.Up(); err != nil {
+		t.Fatalf("start wireguard-go: %v", err)
+	}
+	return p
+}
+
+// toPeer sends packet from the Device and checks that wireguard-go
+// delivers it unchanged
+func (p *interopPair) toPeer(t *testing.T, packet []byte) {
+	t.Helper()
+
+	if err := p.device.Send(p.peerKey, packet); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	select {
+	case got := <-p.peer.Inbound:
+		if !bytes.Equal(got, packet) {
+			t.Fatalf("wireguard-go delivered %x, want %x", got, packet)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("wireguard-go did not deliver the %d byte packet", len(packet))
+	}
+}
+
+// fromPeer sends packet from wireguard-go and checks that the Device
+// receives it unchanged
+func (p *interopPair) fromPeer(t *testing.T, packet []byte) {
+	t.Helper()
+
+	select {
+	case p.peer.Outbound <- packet:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wireguard-go did not take the packet")
+	}
+	select {
+	case got := <-p.received:
+		if !bytes.Equal(got, packet) {
+			t.Fatalf("Device received %x, want %x", got, packet)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Device did not receive the %d byte packet", len(packet))
+	}
+}
+
+// ipv4Packet builds a UDP-looking IPv4 packet of size bytes
+func ipv4Packet(src, dst netip.Addr, size int) []byte {
+	packet := make([]byte, size)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(size))
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:16], src.AsSlice())
+	copy(packet[16:20], dst.AsSlice())
+	for i := 20; i < size; i++ {
+		packet[i] = byte(i)
+	}
+	return packet
+}
+
+// TestInteropWireGuardGo runs handshakes and traffic between a Device and
+// wireguard-go, the reference userspace implementation, with either side
+// initiating
+func TestInteropWireGuardGo(t *testing.T) {
+	// Sizes around the 16-byte padding boundary, and a full packet
+	sizes := []int{20, 21, 36, 100, 1420}
+
+	for _, psk := range []Key{{}, repeatKey(5)} {
+		for _, deviceFirst := range []bool{true, false} {
+			name := fmt.Sprintf("psk=%t/device initiates=%t", psk != Key{}, deviceFirst)
+			t.Run(name, func(t *testing.T) {
+				var private Key
+				rand.Read(private[:])
+				p := newInteropPair(t, private, private.PublicKey(), psk)
+
+				for _, size := range sizes {
+					if deviceFirst {
+						p.toPeer(t, ipv4Packet(interopDeviceIP, interopPeerIP, size))
+						p.fromPeer(t, ipv4Packet(interopPeerIP, interopDeviceIP, size))
+					} else {
+						p.fromPeer(t, ipv4Packet(interopPeerIP, interopDeviceIP, size))
+						p.toPeer(t, ipv4Packet(interopDeviceIP, interopPeerIP, size))
+					}
+				}
+
+				peers := p.device.Peers()
+				if len(peers) != 1 || peers[0].LastHandshake.IsZero() || peers[0].TxBytes == 0 || peers[0].RxBytes == 0 {
+					t.Errorf("peer status = %+v", peers)
+				}
+			})
+		}
+	}
+}
+
+// TestInteropReplacedKey checks that wireguard-go, still configured with
+// the key a Device replaced, completes its handshake during the overlap
+func TestInteropReplacedKey(t *testing.T) {
+	var old, replacement Key
+	rand.Read(old[:])
+	rand.Read(replacement[:])
+
+	p := newInteropPair(t, old, old.PublicKey(), Key{})
+	p.device.SetPrivateKey(replacement, time.Minute)
+
+	p.fromPeer(t, ipv4Packet(interopPeerIP, interopDeviceIP, 64))
+	p.toPeer(t, ipv4Packet(interopDeviceIP, interopPeerIP, 64))
+}
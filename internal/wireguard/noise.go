@@ -0,0 +1,262 @@
+// Package wireguard implements the WireGuard protocol: the Noise IKpsk2
+// handshake from both sides, transport data messages, and a Device that
+// runs sessions with peers over any packet transport
+package wireguard
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Message types and sizes
+const (
+	MessageInitiation  = 1
+	MessageResponse    = 2
+	MessageCookieReply = 3
+	MessageTransport   = 4
+
+	InitiationSize  = 148
+	ResponseSize    = 92
+	CookieReplySize = 64
+)
+
+const (
+	construction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	identifier   = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	labelMAC1    = "mac1----"
+)
+
+// ErrInvalidResponse reports a response that does not authenticate
+var ErrInvalidResponse = errors.New("invalid handshake response")
+
+// Key is a Curve25519 key or a pre-shared key
+type Key [32]byte
+
+// ParseKey decodes a base64 key as used in WireGuard configs
+func ParseKey(s string) (Key, error) {
+	var key Key
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(raw) != len(key) {
+		return key, fmt.Errorf("invalid WireGuard key")
+	}
+	copy(key[:], raw)
+	return key, nil
+}
+
+// PublicKey derives the public key of a private key
+func (k Key) PublicKey() Key {
+	var pub Key
+	out, _ := curve25519.X25519(k[:], curve25519.Basepoint)
+	copy(pub[:], out)
+	return pub
+}
+
+// Keypair holds the transport keys of an established session
+type Keypair struct {
+	Send, Receive   Key
+	LocalIndex      uint32
+	RemoteIndex     uint32
+	EstablishedTime time.Time
+}
+
+// Handshake is an initiator's handshake in progress
+type Handshake struct {
+	localPrivate Key
+	localPublic  Key
+	remotePublic Key
+	presharedKey Key
+
+	chainKey   [blake2s.Size]byte
+	hash       [blake2s.Size]byte
+	ephemeral  Key
+	localIndex uint32
+}
+
+// NewHandshake prepares a handshake with the peer remotePublic; psk may be
+// the zero key
+func NewHandshake(localPrivate, remotePublic, psk Key) *Handshake {
+	return &Handshake{
+		localPrivate: localPrivate,
+		localPublic:  localPrivate.PublicKey(),
+		remotePublic: remotePublic,
+		presharedKey: psk,
+	}
+}
+
+// Initiation builds a handshake initiation message
+func (h *Handshake) Initiation() ([]byte, error) {
+	var index [4]byte
+	if _, err := rand.Read(index[:]); err != nil {
+		return nil, err
+	}
+	var ephemeral Key
+	if _, err := rand.Read(ephemeral[:]); err != nil {
+		return nil, err
+	}
+	return h.initiation(binary.LittleEndian.Uint32(index[:]), ephemeral, time.Now())
+}
+
+// initiation builds the initiation from the random parts Initiation draws
+func (h *Handshake) initiation(localIndex uint32, ephemeral Key, now time.Time) ([]byte, error) {
+	h.localIndex, h.ephemeral = localIndex, ephemeral
+
+	h.chainKey = blake2s.Sum256([]byte(construction))
+	h.hash = mixHash(h.chainKey, []byte(identifier))
+	h.hash = mixHash(h.hash, h.remotePublic[:])
+
+	msg := make([]byte, InitiationSize)
+	msg[0] = MessageInitiation
+	binary.LittleEndian.PutUint32(msg[4:8], h.localIndex)
+
+	ephemeralPublic := h.ephemeral.PublicKey()
+	copy(msg[8:40], ephemeralPublic[:])
+	h.chainKey = kdf1(h.chainKey[:], ephemeralPublic[:])
+	h.hash = mixHash(h.hash, ephemeralPublic[:])
+
+	// Our static key, encrypted to the responder
+	ss, err := dh(h.ephemeral, h.remotePublic)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	h.chainKey, key = kdf2(h.chainKey[:], ss)
+	seal(msg[40:40:88], key, h.localPublic[:], h.hash[:])
+	h.hash = mixHash(h.hash, msg[40:88])
+
+	// Timestamp, so the responder can reject replays
+	ss, err = dh(h.localPrivate, h.remotePublic)
+	if err != nil {
+		return nil, err
+	}
+	h.chainKey, key = kdf2(h.chainKey[:], ss)
+	seal(msg[88:88:116], key, tai64n(now), h.hash[:])
+	h.hash = mixHash(h.hash, msg[88:116])
+
+	copy(msg[116:132], mac1(msg[:116], h.remotePublic))
+	// mac2 stays zero: it only matters once the responder sends a cookie
+	return msg, nil
+}
+
+// LocalIndex identifies the handshake in the responder's reply
+func (h *Handshake) LocalIndex() uint32 {
+	return h.localIndex
+}
+
+// ConsumeResponse authenticates the responder's reply and derives the
+// session keys
+func (h *Handshake) ConsumeResponse(msg []byte) (*Keypair, error) {
+	if len(msg) != ResponseSize || msg[0] != MessageResponse {
+		return nil, ErrInvalidResponse
+	}
+	if binary.LittleEndian.Uint32(msg[8:12]) != h.localIndex {
+		return nil, ErrInvalidResponse
+	}
+	if !validMAC1(msg[:60], msg[60:76], h.localPublic) {
+		return nil, ErrInvalidResponse
+	}
+	remoteIndex := binary.LittleEndian.Uint32(msg[4:8])
+
+	var remoteEphemeral Key
+	copy(remoteEphemeral[:], msg[12:44])
+	chainKey := kdf1(h.chainKey[:], remoteEphemeral[:])
+	hash := mixHash(h.hash, remoteEphemeral[:])
+
+	ss, err := dh(h.ephemeral, remoteEphemeral)
+	if err != nil {
+		return nil, ErrInvalidResponse
+	}
+	chainKey = kdf1(chainKey[:], ss)
+	ss, err = dh(h.localPrivate, remoteEphemeral)
+	if err != nil {
+		return nil, ErrInvalidResponse
+	}
+	chainKey = kdf1(chainKey[:], ss)
+
+	var tau, key [32]byte
+	chainKey, tau, key = kdf3(chainKey[:], h.presharedKey[:])
+	hash = mixHash(hash, tau[:])
+
+	aead, _ := chacha20poly1305.New(key[:])
+	var nonce [chacha20poly1305.NonceSize]byte
+	if _, err := aead.Open(nil, nonce[:], msg[44:60], hash[:]); err != nil {
+		return nil, ErrInvalidResponse
+	}
+
+	send, receive := kdf2(chainKey[:], nil)
+	return &Keypair{
+		Send:            send,
+		Receive:         receive,
+		LocalIndex:      h.localIndex,
+		RemoteIndex:     remoteIndex,
+		EstablishedTime: time.Now(),
+	}, nil
+}
+
+func dh(private, public Key) ([]byte, error) {
+	return curve25519.X25519(private[:], public[:])
+}
+
+func seal(dst []byte, key [32]byte, plaintext, ad []byte) {
+	aead, _ := chacha20poly1305.New(key[:])
+	var nonce [chacha20poly1305.NonceSize]byte
+	aead.Seal(dst, nonce[:], plaintext, ad)
+}
+
+func mixHash(h [blake2s.Size]byte, data []byte) [blake2s.Size]byte {
+	return blake2s.Sum256(append(h[:], data...))
+}
+
+func newHMAC(key []byte) hash.Hash {
+	return hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+}
+
+func hmacSum(key []byte, data ...[]byte) [32]byte {
+	mac := newHMAC(key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	var out [32]byte
+	copy(out[:], mac.Sum(nil))
+	return out
+}
+
+func kdf1(key, input []byte) [32]byte {
+	prk := hmacSum(key, input)
+	return hmacSum(prk[:], []byte{1})
+}
+
+func kdf2(key, input []byte) ([32]byte, [32]byte) {
+	prk := hmacSum(key, input)
+	t1 := hmacSum(prk[:], []byte{1})
+	t2 := hmacSum(prk[:], t1[:], []byte{2})
+	return t1, t2
+}
+
+func kdf3(key, input []byte) ([32]byte, [32]byte, [32]byte) {
+	prk := hmacSum(key, input)
+	t1 := hmacSum(prk[:], []byte{1})
+	t2 := hmacSum(prk[:], t1[:], []byte{2})
+	t3 := hmacSum(prk[:], t2[:], []byte{3})
+	return t1, t2, t3
+}
+
+// tai64n encodes t as the 12-byte TAI64N timestamp in initiations
+func tai64n(t time.Time) []byte {
+	out := make([]byte, 12)
+	binary.BigEndian.PutUint64(out, uint64(0x400000000000000a+t.Unix()))
+	binary.BigEndian.PutUint32(out[8:], uint32(t.Nanosecond()))
+	return out
+}
@@ -0,0 +1,230 @@
+package wireguard
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// Handshake vectors from an independent implementation of the whitepaper,
+// itself checked against the X25519 and ChaCha20-Poly1305 vectors of RFC
+// 7748 and RFC 8439. The static keys are 32 bytes of 1 (initiator) and 2
+// (responder), the ephemerals 3 and 4, the pre-shared key 0 or 5.
+var handshakeVectors = []struct {
+	name                 string
+	psk                  byte
+	initiation, response string
+	send, receive        string // The initiator's transport keys
+	transport, keepalive string // vectorPacket sent by the initiator, counter 0; a keepalive back, counter 7
+}{
+	{
+		name:       "no psk",
+		initiation: "01000000443322115dfedd3b6bd47f6fa28ee15d969d5bb0ea53774d488bdaf9df1c6e0124b3ef220a26599fb2188bb723276fc173af67616c817fc32fd04d686d87ec152fac10eed2bda3bb3b6f1eded6977684082284d817fb46b3a99b6be3ba7cf3c3fb1c735e18246a700c43a4d05a1d12d612891d19abf09e0dab06891a9f8a0c4d00000000000000000000000000000000",
+		response:   "020000008877665544332211ac01b2209e86354fb853237b5de0f4fab13c7fcbf433a61c019369617fecf10be4480c6df5f9d92002e8ea59405577505530c637f19c918434293b8421aed44100000000000000000000000000000000",
+		send:       "b30c71d520eb54edcf0ad32b6c2e5bdff747e6e2bf8a126ae52eb1c7140b4398",
+		receive:    "bc8d9cb5d3c1654d26eef4fab1426ff05fff238c2ddac280941197772e21c21c",
+		transport:  "04000000887766550000000000000000067baccfdbf2adb69e2e9d55c804ad13519cfe99aea9975f433fcd2679ff69f164414ba970cf4e30dc1ec4f52cf83681",
+		keepalive:  "04000000443322110700000000000000c1408ef2a4b8ad4d43c3e9be124e414e",
+	},
+	{
+		name:       "psk",
+		psk:        5,
+		initiation: "01000000443322115dfedd3b6bd47f6fa28ee15d969d5bb0ea53774d488bdaf9df1c6e0124b3ef220a26599fb2188bb723276fc173af67616c817fc32fd04d686d87ec152fac10eed2bda3bb3b6f1eded6977684082284d817fb46b3a99b6be3ba7cf3c3fb1c735e18246a700c43a4d05a1d12d612891d19abf09e0dab06891a9f8a0c4d00000000000000000000000000000000",
+		response:   "020000008877665544332211ac01b2209e86354fb853237b5de0f4fab13c7fcbf433a61c019369617fecf10b1ad738e7cfdf92f92c429061ef41996530716b8a4a73511b2c18f2944802c07a00000000000000000000000000000000",
+		send:       "a18cc809fd05b6b5f99644cf506f89dce368c2f54a9dbeb9a384f36c274317ef",
+		receive:    "b1aa1b797d3a45da97552b8084ade493aa767f15af95854bc86557f6dacd851d",
+		transport:  "04000000887766550000000000000000caaa96b87055e3d3742aa6ade9b244d1de3645d8a8f7adf856ae3fa02413523fdc79005fef6ec9ebe13c78553b6ca1cb",
+		keepalive:  "04000000443322110700000000000000d68f7955809f31693ffe73b3308b78cf",
+	},
+}
+
+// vectorPacket is an ICMP echo from 10.0.0.1 to 10.0.0.2
+var vectorPacket = mustHex("4500001c000000004001f98e0a0000010a000002" + "0800f7ff00000000")
+
+const (
+	vectorInitiatorIndex = 0x11223344
+	vectorResponderIndex = 0x55667788
+)
+
+var vectorTime = time.Unix(1700000000, 123456789)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func repeatKey(b byte) Key {
+	var k Key
+	for i := range k {
+		k[i] = b
+	}
+	return k
+}
+
+func TestHandshakeVectors(t *testing.T) {
+	initiatorPrivate, responderPrivate := repeatKey(1), repeatKey(2)
+
+	for _, v := range handshakeVectors {
+		t.Run(v.name, func(t *testing.T) {
+			var psk Key
+			if v.psk != 0 {
+				psk = repeatKey(v.psk)
+			}
+
+			h := NewHandshake(initiatorPrivate, responderPrivate.PublicKey(), psk)
+			initiation, err := h.initiation(vectorInitiatorIndex, repeatKey(3), vectorTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(initiation); got != v.initiation {
+				t.Fatalf("initiation = %s, want %s", got, v.initiation)
+			}
+
+			in, err := ConsumeInitiation(responderPrivate, initiation)
+			if err != nil {
+				t.Fatalf("ConsumeInitiation: %v", err)
+			}
+			if in.RemotePublic != initiatorPrivate.PublicKey() {
+				t.Error("initiation names the wrong initiator")
+			}
+			if !bytes.Equal(in.Timestamp[:], tai64n(vectorTime)) {
+				t.Errorf("timestamp = %x, want %x", in.Timestamp, tai64n(vectorTime))
+			}
+
+			response, responderKeys, err := in.respond(psk, vectorResponderIndex, repeatKey(4))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(response); got != v.response {
+				t.Fatalf("response = %s, want %s", got, v.response)
+			}
+			initiatorKeys, err := h.ConsumeResponse(response)
+			if err != nil {
+				t.Fatalf("ConsumeResponse: %v", err)
+			}
+
+			if got := hex.EncodeToString(initiatorKeys.Send[:]); got != v.send {
+				t.Errorf("initiator send key = %s, want %s", got, v.send)
+			}
+			if got := hex.EncodeToString(initiatorKeys.Receive[:]); got != v.receive {
+				t.Errorf("initiator receive key = %s, want %s", got, v.receive)
+			}
+			if responderKeys.Send != initiatorKeys.Receive || responderKeys.Receive != initiatorKeys.Send {
+				t.Error("responder keys do not mirror the initiator's")
+			}
+			if initiatorKeys.RemoteIndex != vectorResponderIndex || responderKeys.RemoteIndex != vectorInitiatorIndex {
+				t.Errorf("remote indices = %#x and %#x", initiatorKeys.RemoteIndex, responderKeys.RemoteIndex)
+			}
+
+			initiator, responder := NewSession(initiatorKeys, true), NewSession(responderKeys, false)
+			msg, err := initiator.Seal(vectorPacket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(msg); got != v.transport {
+				t.Errorf("transport = %s, want %s", got, v.transport)
+			}
+			packet, err := responder.Open(msg)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			if !bytes.Equal(packet, vectorPacket) {
+				t.Errorf("opened %x, want the packet without padding", packet)
+			}
+
+			responder.counter = 7
+			msg, err = responder.Seal(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(msg); got != v.keepalive {
+				t.Errorf("keepalive = %s, want %s", got, v.keepalive)
+			}
+			if packet, err := initiator.Open(msg); err != nil || len(packet) != 0 {
+				t.Errorf("Open keepalive = %x, %v", packet, err)
+			}
+		})
+	}
+}
+
+func TestHandshakeRejects(t *testing.T) {
+	initiatorPrivate, responderPrivate := repeatKey(1), repeatKey(2)
+	h := NewHandshake(initiatorPrivate, responderPrivate.PublicKey(), Key{})
+	initiation, err := h.Initiation()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every byte before mac2 is authenticated
+	for _, i := range []int{0, 4, 8, 40, 88, 116, 131} {
+		tampered := append([]byte(nil), initiation...)
+		tampered[i] ^= 1
+		if _, err := ConsumeInitiation(responderPrivate, tampered); err == nil {
+			t.Errorf("initiation with byte %d changed accepted", i)
+		}
+	}
+	if _, err := ConsumeInitiation(repeatKey(9), initiation); err == nil {
+		t.Error("initiation accepted by the wrong responder")
+	}
+
+	in, err := ConsumeInitiation(responderPrivate, initiation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, _, err := in.Respond(repeatKey(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.ConsumeResponse(response); err != ErrInvalidResponse {
+		t.Errorf("response with a different psk: err = %v, want ErrInvalidResponse", err)
+	}
+}
+
+func TestSessionReplay(t *testing.T) {
+	kp := &Keypair{Send: repeatKey(7), Receive: repeatKey(7), EstablishedTime: time.Now()}
+	sender, receiver := NewSession(kp, true), NewSession(kp, false)
+
+	var msgs [][]byte
+	for i := 0; i < replayWindow+2; i++ {
+		msg, err := sender.Seal(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	if _, err := receiver.Open(msgs[2]); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := receiver.Open(msgs[2]); err != ErrInvalidTransport {
+		t.Errorf("replayed message: err = %v, want ErrInvalidTransport", err)
+	}
+	// Reordered messages inside the window still arrive
+	if _, err := receiver.Open(msgs[1]); err != nil {
+		t.Errorf("reordered message: %v", err)
+	}
+	if _, err := receiver.Open(msgs[len(msgs)-1]); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	// Message 0 was never seen, but is now further back than the window
+	if _, err := receiver.Open(msgs[0]); err != ErrInvalidTransport {
+		t.Errorf("message behind the window: err = %v, want ErrInvalidTransport", err)
+	}
+	if _, err := receiver.Open(msgs[len(msgs)-2]); err != nil {
+		t.Errorf("message just inside the window: %v", err)
+	}
+
+	tampered := append([]byte(nil), msgs[5]...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := receiver.Open(tampered); err != ErrInvalidTransport {
+		t.Errorf("tampered message: err = %v, want ErrInvalidTransport", err)
+	}
+	// A forged message must not have moved the window
+	if _, err := receiver.Open(msgs[5]); err != nil {
+		t.Errorf("authentic message after a forgery: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package wireguard
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ErrInvalidInitiation reports an initiation that does not authenticate
+var ErrInvalidInitiation = errors.New("invalid handshake initiation")
+
+// Initiation is a handshake initiation a responder authenticated, waiting
+// for its response
+type Initiation struct {
+	RemotePublic Key      // The initiator's static key
+	Timestamp    [12]byte // TAI64N; every new initiation of a peer has a higher one
+
+	remoteIndex     uint32
+	remoteEphemeral Key
+	chainKey        [blake2s.Size]byte
+	hash            [blake2s.Size]byte
+}
+
+// ConsumeInitiation authenticates an initiation sent to localPrivate and
+// tells who sent it. The caller checks that the initiator is a peer and
+// that the timestamp is newer than its last one before responding.
+func ConsumeInitiation(localPrivate Key, msg []byte) (*Initiation, error) {
+	if len(msg) != InitiationSize || msg[0] != MessageInitiation {
+		return nil, ErrInvalidInitiation
+	}
+	localPublic := localPrivate.PublicKey()
+	if !validMAC1(msg[:116], msg[116:132], localPublic) {
+		return nil, ErrInvalidInitiation
+	}
+
+	in := &Initiation{remoteIndex: binary.LittleEndian.Uint32(msg[4:8])}
+	copy(in.remoteEphemeral[:], msg[8:40])
+
+	chainKey := blake2s.Sum256([]byte(construction))
+	hash := mixHash(chainKey, []byte(identifier))
+	hash = mixHash(hash, localPublic[:])
+	chainKey = kdf1(chainKey[:], in.remoteEphemeral[:])
+	hash = mixHash(hash, in.remoteEphemeral[:])
+
+	// The initiator's static key
+	ss, err := dh(localPrivate, in.remoteEphemeral)
+	if err != nil {
+		return nil, ErrInvalidInitiation
+	}
+	var key [32]byte
+	chainKey, key = kdf2(chainKey[:], ss)
+	static, err := open(key, msg[40:88], hash[:])
+	if err != nil {
+		return nil, ErrInvalidInitiation
+	}
+	copy(in.RemotePublic[:], static)
+	hash = mixHash(hash, msg[40:88])
+
+	// The timestamp, proving the initiator holds its static key
+	ss, err = dh(localPrivate, in.RemotePublic)
+	if err != nil {
+		return nil, ErrInvalidInitiation
+	}
+	chainKey, key = kdf2(chainKey[:], ss)
+	timestamp, err := open(key, msg[88:116], hash[:])
+	if err != nil {
+		return nil, ErrInvalidInitiation
+	}
+	copy(in.Timestamp[:], timestamp)
+	hash = mixHash(hash, msg[88:116])
+
+	in.chainKey, in.hash = chainKey, hash
+	return in, nil
+}
+
+// Respond builds the response to an initiation and derives the session
+// keys; psk is the pre-shared key of the initiator, or the zero key
+func (in *Initiation) Respond(psk Key) ([]byte, *Keypair, error) {
+	var index [4]byte
+	if _, err := rand.Read(index[:]); err != nil {
+		return nil, nil, err
+	}
+	var ephemeral Key
+	if _, err := rand.Read(ephemeral[:]); err != nil {
+		return nil, nil, err
+	}
+	return in.respond(psk, binary.LittleEndian.Uint32(index[:]), ephemeral)
+}
+
+// respond builds the response from the random parts Respond draws
+func (in *Initiation) respond(psk Key, localIndex uint32, ephemeral Key) ([]byte, *Keypair, error) {
+	msg := make([]byte, ResponseSize)
+	msg[0] = MessageResponse
+	binary.LittleEndian.PutUint32(msg[4:8], localIndex)
+	binary.LittleEndian.PutUint32(msg[8:12], in.remoteIndex)
+
+	ephemeralPublic := ephemeral.PublicKey()
+	copy(msg[12:44], ephemeralPublic[:])
+	chainKey := kdf1(in.chainKey[:], ephemeralPublic[:])
+	hash := mixHash(in.hash, ephemeralPublic[:])
+
+	ss, err := dh(ephemeral, in.remoteEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+	chainKey = kdf1(chainKey[:], ss)
+	ss, err = dh(ephemeral, in.RemotePublic)
+	if err != nil {
+		return nil, nil, err
+	}
+	chainKey = kdf1(chainKey[:], ss)
+
+	var tau, key [32]byte
+	chainKey, tau, key = kdf3(chainKey[:], psk[:])
+	hash = mixHash(hash, tau[:])
+	seal(msg[44:44:60], key, nil, hash[:])
+
+	copy(msg[60:76], mac1(msg[:60], in.RemotePublic))
+
+	receive, send := kdf2(chainKey[:], nil)
+	return msg, &Keypair{
+		Send:            send,
+		Receive:         receive,
+		LocalIndex:      localIndex,
+		RemoteIndex:     in.remoteIndex,
+		EstablishedTime: time.Now(),
+	}, nil
+}
+
+// mac1 authenticates a handshake message to the receiver's static key
+func mac1(msg []byte, receiver Key) []byte {
+	key := blake2s.Sum256(append([]byte(labelMAC1), receiver[:]...))
+	mac, _ := blake2s.New128(key[:])
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+func validMAC1(msg, sum []byte, receiver Key) bool {
+	return subtle.ConstantTimeCompare(mac1(msg, receiver), sum) == 1
+}
+
+func open(key [32]byte, ciphertext, ad []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(key[:])
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Open(nil, nonce[:], ciphertext, ad)
+}
@@ -0,0 +1,168 @@
+package wireguard
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Transport message layout and limits
+const (
+	TransportHeaderSize = 16
+	TransportOverhead   = TransportHeaderSize + chacha20poly1305.Overhead
+
+	// RejectAfterMessages is how many messages a session may carry
+	RejectAfterMessages = 1<<64 - 1<<13 - 1
+	// RekeyAfterMessages is when the initiator starts a new handshake
+	RekeyAfterMessages = 1 << 60
+)
+
+// ErrInvalidTransport reports a transport message that does not decrypt
+// or was seen before
+var ErrInvalidTransport = errors.New("invalid transport message")
+
+// Session encrypts and decrypts the transport messages of a keypair
+type Session struct {
+	*Keypair
+	Initiator bool // Whether the local side started the handshake
+
+	send    cipher.AEAD
+	receive cipher.AEAD
+
+	mu      sync.Mutex
+	counter uint64 // Next send counter
+	replay  replayFilter
+}
+
+// NewSession starts a session with the keys of a completed handshake
+func NewSession(kp *Keypair, initiator bool) *Session {
+	send, _ := chacha20poly1305.New(kp.Send[:])
+	receive, _ := chacha20poly1305.New(kp.Receive[:])
+	return &Session{Keypair: kp, Initiator: initiator, send: send, receive: receive}
+}
+
+// Sent returns how many messages the session encrypted
+func (s *Session) Sent() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counter
+}
+
+// Seal encrypts a packet into a transport message; an empty packet is a
+// keepalive
+func (s *Session) Seal(packet []byte) ([]byte, error) {
+	s.mu.Lock()
+	counter := s.counter
+	if counter >= RejectAfterMessages {
+		s.mu.Unlock()
+		return nil, errors.New("session exhausted")
+	}
+	s.counter++
+	s.mu.Unlock()
+
+	padded := (len(packet) + 15) &^ 15
+	msg := make([]byte, TransportHeaderSize, TransportHeaderSize+padded+chacha20poly1305.Overhead)
+	msg[0] = MessageTransport
+	binary.LittleEndian.PutUint32(msg[4:8], s.RemoteIndex)
+	binary.LittleEndian.PutUint64(msg[8:16], counter)
+
+	plaintext := make([]byte, padded)
+	copy(plaintext, packet)
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	return s.send.Seal(msg, nonce[:], plaintext, nil), nil
+}
+
+// Open decrypts a transport message addressed to the session and returns
+// the packet without padding; a keepalive yields an empty packet
+func (s *Session) Open(msg []byte) ([]byte, error) {
+	if len(msg) < TransportOverhead || msg[0] != MessageTransport {
+		return nil, ErrInvalidTransport
+	}
+	counter := binary.LittleEndian.Uint64(msg[8:16])
+	if counter >= RejectAfterMessages {
+		return nil, ErrInvalidTransport
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	plaintext, err := s.receive.Open(nil, nonce[:], msg[TransportHeaderSize:], nil)
+	if err != nil {
+		return nil, ErrInvalidTransport
+	}
+
+	// Only authentic messages move the replay window
+	s.mu.Lock()
+	fresh := s.replay.accept(counter)
+	s.mu.Unlock()
+	if !fresh {
+		return nil, ErrInvalidTransport
+	}
+	return trimPadding(plaintext), nil
+}
+
+// trimPadding cuts a decrypted packet to the length its IP header gives
+func trimPadding(packet []byte) []byte {
+	if len(packet) == 0 {
+		return packet
+	}
+	var length int
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return packet
+		}
+		length = int(binary.BigEndian.Uint16(packet[2:4]))
+	case 6:
+		if len(packet) < 40 {
+			return packet
+		}
+		length = 40 + int(binary.BigEndian.Uint16(packet[4:6]))
+	default:
+		return packet
+	}
+	if length < len(packet) {
+		return packet[:length]
+	}
+	return packet
+}
+
+// replayFilter tracks the counters seen in a sliding window, as in RFC 6479
+type replayFilter struct {
+	last   uint64
+	blocks [replayBlocks]uint64
+}
+
+const (
+	replayBlocks = 128 // Of 64 bits; the window is one block short of that
+	replayWindow = (replayBlocks - 1) * 64
+)
+
+// accept records counter and reports whether it was new and in the window
+func (f *replayFilter) accept(counter uint64) bool {
+	index := counter >> 6
+	if counter > f.last {
+		current := f.last >> 6
+		diff := index - current
+		if diff > replayBlocks {
+			diff = replayBlocks
+		}
+		for i := uint64(1); i <= diff; i++ {
+			f.blocks[(current+i)%replayBlocks] = 0
+		}
+		f.last = counter
+	} else if f.last-counter > replayWindow {
+		return false
+	}
+
+	block := &f.blocks[index%replayBlocks]
+	bit := uint64(1) << (counter & 63)
+	if *block&bit != 0 {
+		return false
+	}
+	*block |= bit
+	return true
+}
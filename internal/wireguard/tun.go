@@ -0,0 +1,33 @@
+package wireguard
+
+import "os"
+
+// DefaultMTU leaves room for WireGuard's overhead in a 1500-byte path
+const DefaultMTU = 1420
+
+// TUN is a layer 3 network interface: reads return the IP packets the
+// system routes to it and writes inject packets into the system
+type TUN struct {
+	file *os.File
+	name string
+}
+
+// Name returns the interface name
+func (t *TUN) Name() string {
+	return t.name
+}
+
+// Read reads one packet
+func (t *TUN) Read(packet []byte) (int, error) {
+	return t.file.Read(packet)
+}
+
+// Write injects one packet
+func (t *TUN) Write(packet []byte) (int, error) {
+	return t.file.Write(packet)
+}
+
+// Close removes the interface
+func (t *TUN) Close() error {
+	return t.file.Close()
+}
@@ -0,0 +1,94 @@
+//go:build linux
+
+package wireguard
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	tunSetIff = 0x400454ca
+	iffTun    = 0x0001
+	iffNoPi   = 0x1000
+)
+
+// OpenTUN creates the TUN interface name with the addresses cidrs, such as
+// "10.99.0.2/24" and "fd7a:115c:a1e0::2/64", and brings it up
+func OpenTUN(name string, cidrs []string, mtu int) (*TUN, error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, fmt.Errorf("interface name %q is too long", name)
+	}
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /dev/net/tun: %v", err)
+	}
+
+	var req struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(req.name[:], name)
+	req.flags = iffTun | iffNoPi
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIff, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to create interface %s: %v", name, errno)
+	}
+
+	// Non-blocking once attached, so the runtime poller serves reads and
+	// Close interrupts them
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), "/dev/net/tun")
+
+	if err := addAddresses(name, cidrs); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to address interface %s: %v", name, err)
+	}
+	if err := runIP("link", "set", name, "mtu", strconv.Itoa(mtu), "up"); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to bring up interface %s: %v", name, err)
+	}
+	return &TUN{file: file, name: name}, nil
+}
+
+// runIP runs the ip command, including its output in errors
+func runIP(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// addAddresses adds addresses to an interface. IPv6 ones skip duplicate
+// address detection, which would hold them back for a second or two on an
+// interface no other host is on.
+func addAddresses(name string, cidrs []string) error {
+	for _, cidr := range cidrs {
+		args := []string{"addr", "add", cidr, "dev", name}
+		if strings.Contains(cidr, ":") {
+			args = append(args, "nodad")
+		}
+		if err := runIP(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetAddress replaces the interface's addresses with cidrs
+func (t *TUN) SetAddress(cidrs []string) error {
+	if err := runIP("addr", "flush", "dev", t.name); err != nil {
+		return err
+	}
+	return addAddresses(t.name, cidrs)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package wireguard
+
+import "ssh-tunnel/internal/platform"
+
+// OpenTUN creates a TUN interface; only Linux is supported
+func OpenTUN(name string, cidrs []string, mtu int) (*TUN, error) {
+	return nil, platform.Unsupported(platform.TUN)
+}
+
+// SetAddress replaces the interface's addresses with cidrs
+func (t *TUN) SetAddress(cidrs []string) error {
+	return platform.Unsupported(platform.TUN)
+}